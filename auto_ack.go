@@ -0,0 +1,74 @@
+package stomp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// autoAcker sends the ACK frames for a subscription with
+// SubscribeOpt.AutoCumulativeAck. The frames are sent from
+// its own goroutine, because the subscription's read loop
+// must never wait for the processing loop.
+type autoAcker struct {
+	sub      *Subscription
+	every    int
+	interval time.Duration
+	trigger  chan struct{} // signalled once every messages have been delivered
+
+	mutex  sync.Mutex
+	latest *Message // latest message delivered, nil once acknowledged
+	count  int      // messages delivered since the last ACK frame
+}
+
+// delivered records that msg has been delivered on the C channel.
+func (a *autoAcker) delivered(msg *Message) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.latest = msg
+	a.count++
+	if a.every > 0 && a.count >= a.every {
+		select {
+		case a.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run acknowledges the delivered messages until the subscription closes.
+func (a *autoAcker) run() {
+	var tick <-chan time.Time
+	if a.interval > 0 {
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-a.trigger:
+		case <-tick:
+		case <-a.sub.closeChan:
+			return
+		}
+		a.ack()
+	}
+}
+
+// ack acknowledges the latest message delivered, and the messages before it.
+func (a *autoAcker) ack() {
+	a.mutex.Lock()
+	msg := a.latest
+	a.latest = nil
+	a.count = 0
+	a.mutex.Unlock()
+
+	// An error is delivered on C as the subscription closes, so checking
+	// the state also ensures that nothing is acknowledged after an error.
+	if msg == nil || atomic.LoadInt32(&a.sub.state) != subStateActive {
+		return
+	}
+	if err := a.sub.AckUpTo(msg); err != nil {
+		a.sub.conn.log.Warnf("Subscription %s: %s: failed to send ACK: %v", a.sub.id, a.sub.destination, err)
+	}
+}
@@ -0,0 +1,219 @@
+package stomp
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// bridgeOptions are the settings for a call to Bridge.
+type bridgeOptions struct {
+	concurrency int
+	drop        []string
+	rewrite     func(msg *Message, h *frame.Header) error
+}
+
+// BridgeOpt contains options for the Bridge function.
+var BridgeOpt struct {
+	// Concurrency republishes up to n messages at once, each waiting for
+	// its own receipt, so that the round trip to the destination server
+	// does not limit the rate of the bridge. The messages may then arrive
+	// in a different order from the one they were received in. The default
+	// is 1, which keeps the order.
+	Concurrency func(n int) func(*bridgeOptions) error
+
+	// DropHeaders removes the header entries with the names specified from
+	// the messages republished.
+	DropHeaders func(names ...string) func(*bridgeOptions) error
+
+	// RewriteHeader calls f with each message received and the header of the
+	// SEND frame that republishes it, once the other header entries have been
+	// removed, so that f can add, change and remove header entries. If f
+	// returns an error, the message is not republished, and it is negatively
+	// acknowledged. f is called on the goroutines that republish the messages.
+	RewriteHeader func(f func(msg *Message, h *frame.Header) error) func(*bridgeOptions) error
+}
+
+func init() {
+	BridgeOpt.Concurrency = func(n int) func(*bridgeOptions) error {
+		return func(o *bridgeOptions) error {
+			if n < 1 {
+				return ErrInvalidOptionValue
+			}
+			o.concurrency = n
+			return nil
+		}
+	}
+	BridgeOpt.DropHeaders = func(names ...string) func(*bridgeOptions) error {
+		return func(o *bridgeOptions) error {
+			o.drop = append(o.drop, names...)
+			return nil
+		}
+	}
+	BridgeOpt.RewriteHeader = func(f func(msg *Message, h *frame.Header) error) func(*bridgeOptions) error {
+		return func(o *bridgeOptions) error {
+			if f == nil {
+				return ErrNilOption
+			}
+			o.rewrite = f
+			return nil
+		}
+	}
+}
+
+// The header entries of a MESSAGE frame that describe its delivery from
+// the source server, which are not republished.
+var bridgedHeaders = []string{
+	frame.Destination,
+	frame.Subscription,
+	frame.MessageId,
+	frame.Ack,
+	frame.ContentLength,
+	frame.ContentType,
+	frame.Receipt,
+}
+
+// Bridge republishes the messages received on src to the server of dst, at
+// the destinations returned by destFn, or at their own destinations if
+// destFn is nil. Each message is sent with a receipt, and acknowledged on
+// src once the RECEIPT frame has arrived, so that a message is never lost
+// between the servers, although it may be republished more than once. If
+// the send fails, the message is negatively acknowledged, so that the source
+// server can deliver it again. The header entries of a message are
+// republished, apart from those that describe its delivery from the source
+// server, and the body is republished as it was received, even if it has
+// been decompressed by ConnOpt.AutoDecompress. A streamed body is streamed
+// to dst with Conn.SendStream.
+//
+// The subscription must have been created with AckClientIndividual,
+// otherwise ErrBridgeAckMode is returned, and the program must not read
+// from its C channel while Bridge is running. Bridge returns when ctx is
+// done, returning ctx.Err(), when src closes, returning the error that
+// closed it or ErrCompletedSubscription, or when dst closes, returning
+// ErrConnectionClosed. It waits for the sends in progress to complete
+// before it returns, but does not unsubscribe from src or disconnect dst.
+// The messages received that were not republished are not acknowledged,
+// so the source server delivers them again once src is closed.
+func Bridge(ctx context.Context, src *Subscription, dst *Conn, destFn func(*Message) string, opts ...func(*bridgeOptions) error) error {
+	if src.AckMode() != AckClientIndividual {
+		return ErrBridgeAckMode
+	}
+	b := &bridgeOptions{concurrency: 1}
+	for _, opt := range opts {
+		if opt == nil {
+			return ErrNilOption
+		}
+		if err := opt(b); err != nil {
+			return err
+		}
+	}
+	if destFn == nil {
+		destFn = func(msg *Message) string { return msg.Destination }
+	}
+
+	// the sends in progress are completed once ctx is done
+	sendCtx := context.WithoutCancel(ctx)
+	msgs := make(chan *Message)
+	var wg sync.WaitGroup
+	for i := 0; i < b.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range msgs {
+				err := b.republish(sendCtx, dst, destFn(msg), msg)
+				if msg.BodyReader != nil {
+					msg.BodyReader.Close()
+				}
+				if err != nil {
+					src.conn.log.Warnf("Subscription %s: %s: cannot republish message, sending NACK: %v", src.id, src.destination, err)
+					if src.conn.Version() != V10 {
+						src.acknowledge(msg, nackSend)
+					}
+					continue
+				}
+				src.acknowledge(msg, ackSend)
+			}
+		}()
+	}
+
+	err := b.dispatch(ctx, src, dst, msgs)
+	close(msgs)
+	wg.Wait()
+	return err
+}
+
+// dispatch passes the messages received on src to the goroutines that
+// republish them, until Bridge returns the error.
+func (b *bridgeOptions) dispatch(ctx context.Context, src *Subscription, dst *Conn, msgs chan<- *Message) error {
+	for {
+		select {
+		case msg, ok := <-src.C:
+			if !ok {
+				return ErrCompletedSubscription
+			}
+			if msg.Err != nil && !errors.Is(msg.Err, ErrDecompress) {
+				if src.Active() {
+					// the error is for the subscription alone, see
+					// SubscribeOpt.KeepOpenOnError
+					src.conn.log.Warnf("Subscription %s: %s: bridge ignored error: %v", src.id, src.destination, msg.Err)
+					continue
+				}
+				return msg.Err
+			}
+			select {
+			case msgs <- msg:
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-dst.closeCh:
+				return ErrConnectionClosed
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-dst.closeCh:
+			return ErrConnectionClosed
+		}
+	}
+}
+
+// republish sends msg to the destination on dst, and waits for the receipt.
+func (b *bridgeOptions) republish(ctx context.Context, dst *Conn, destination string, msg *Message) error {
+	h := msg.Header.Clone()
+	if h == nil {
+		h = frame.NewHeader()
+	}
+	for _, name := range bridgedHeaders {
+		h.Del(name)
+	}
+	for _, name := range b.drop {
+		h.Del(name)
+	}
+
+	body := msg.Body
+	if f := msg.Frame(); f != nil {
+		body = f.Body
+	} else if msg.Err == nil && msg.Conn.autoDecompress && lookupCodec(h.Get(contentEncodingHeader)) != nil {
+		// the body as it was received is gone
+		h.Del(contentEncodingHeader)
+	}
+
+	if b.rewrite != nil {
+		if err := b.rewrite(msg, h); err != nil {
+			return err
+		}
+	}
+
+	opts := []func(*frame.Frame) error{
+		SendOpt.Receipt,
+		func(f *frame.Frame) error {
+			f.Header.AddHeader(h)
+			return nil
+		},
+	}
+	if msg.BodyReader != nil {
+		contentLength, _, _ := msg.Header.ContentLength()
+		return dst.SendStream(destination, msg.ContentType, int64(contentLength), msg.BodyReader, opts...)
+	}
+	return dst.SendWithContext(ctx, destination, msg.ContentType, body, opts...)
+}
@@ -0,0 +1,132 @@
+package stomp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_bridge(c *C) {
+	const n = 3
+	src, srcRW := connectHelper(c, V12)
+	dst, dstRW := connectHelper(c, V12)
+	srcStop := make(chan struct{})
+	dstStop := make(chan struct{})
+
+	go func() {
+		defer close(srcStop)
+		f, err := srcRW.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.SUBSCRIBE)
+		c.Check(f.Header.Get(frame.Ack), Equals, "client-individual")
+		for i := 0; i < n; i++ {
+			body := fmt.Sprintf("message %d", i)
+			msg := frame.New(frame.MESSAGE,
+				frame.Subscription, f.Header.Get(frame.Id),
+				frame.MessageId, strconv.Itoa(i),
+				frame.Destination, "/queue/edge",
+				frame.Ack, "ack-"+strconv.Itoa(i),
+				frame.ContentType, "text/plain",
+				"x-keep", "keep",
+				"x-drop", "drop")
+			msg.Body = []byte(body)
+			srcRW.Write(msg)
+		}
+
+		// the message that the destination server refused is not lost
+		for _, command := range []string{frame.ACK, frame.ACK, frame.NACK} {
+			f, err := srcRW.Read()
+			c.Assert(err, IsNil)
+			c.Check(f.Command, Equals, command)
+		}
+		f, err = srcRW.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.DISCONNECT)
+		srcRW.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+	}()
+
+	go func() {
+		defer close(dstStop)
+		for i := 0; i < n; i++ {
+			f, err := dstRW.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, frame.SEND)
+			c.Check(f.Header.Get(frame.Destination), Equals, "/queue/central")
+			c.Check(f.Header.Get(frame.ContentType), Equals, "text/plain")
+			c.Check(f.Header.Get("x-keep"), Equals, "keep")
+			c.Check(f.Header.Get("x-bridged"), Equals, strconv.Itoa(i))
+			for _, name := range []string{frame.Subscription, frame.MessageId, frame.Ack, "x-drop"} {
+				_, ok := f.Header.Contains(name)
+				c.Check(ok, Equals, false, Commentf("%s", name))
+			}
+			c.Check(string(f.Body), Equals, fmt.Sprintf("message %d", i))
+			receipt := f.Header.Get(frame.Receipt)
+			c.Assert(receipt, Not(Equals), "")
+			if i < n-1 {
+				dstRW.Write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+			} else {
+				dstRW.Write(frame.New(frame.ERROR, frame.ReceiptId, receipt, frame.Message, "refused"))
+			}
+		}
+		dstRW.Close()
+	}()
+
+	sub, err := src.Subscribe("/queue/edge", AckClientIndividual)
+	c.Assert(err, IsNil)
+
+	err = Bridge(context.Background(), sub, dst,
+		func(msg *Message) string {
+			return "/queue/central"
+		},
+		BridgeOpt.DropHeaders("x-drop"),
+		BridgeOpt.RewriteHeader(func(msg *Message, h *frame.Header) error {
+			h.Set("x-bridged", msg.Id())
+			return nil
+		}))
+	c.Check(err, Equals, ErrConnectionClosed)
+	<-dstStop
+	c.Check(sub.Active(), Equals, true)
+
+	c.Check(src.Disconnect(), IsNil)
+	<-srcStop
+}
+
+func (s *StompSuite) Test_bridge_options(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		for i := 0; i < 2; i++ {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, frame.SUBSCRIBE)
+		}
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+	c.Check(Bridge(context.Background(), sub, conn, nil), Equals, ErrBridgeAckMode)
+
+	sub, err = conn.Subscribe("/queue/test-2", AckClientIndividual)
+	c.Assert(err, IsNil)
+	c.Check(Bridge(context.Background(), sub, conn, nil, BridgeOpt.Concurrency(0)), Equals, ErrInvalidOptionValue)
+	c.Check(Bridge(context.Background(), sub, conn, nil, BridgeOpt.RewriteHeader(nil)), Equals, ErrNilOption)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = Bridge(ctx, sub, conn, nil, BridgeOpt.Concurrency(4))
+	c.Check(errors.Is(err, context.DeadlineExceeded), Equals, true)
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
@@ -0,0 +1,195 @@
+package stomp
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// The BrokerFlavor type identifies a STOMP server product, for features
+// such as durable subscriptions that each product implements with its own
+// header entries.
+type BrokerFlavor int
+
+const (
+	// The flavor is detected from the "server" header entry of the
+	// CONNECTED frame.
+	BrokerAuto BrokerFlavor = iota
+
+	// ActiveMQ Classic.
+	BrokerActiveMQ
+
+	// ActiveMQ Artemis.
+	BrokerArtemis
+
+	// RabbitMQ, with the STOMP plugin.
+	BrokerRabbitMQ
+
+	// A server that is not recognised from its "server" header entry,
+	// or that did not send one.
+	BrokerUnknown
+)
+
+// String returns the string representation of the BrokerFlavor value.
+func (b BrokerFlavor) String() string {
+	switch b {
+	case BrokerAuto:
+		return "auto"
+	case BrokerActiveMQ:
+		return "ActiveMQ"
+	case BrokerArtemis:
+		return "Artemis"
+	case BrokerRabbitMQ:
+		return "RabbitMQ"
+	case BrokerUnknown:
+		return "unknown"
+	}
+	panic("invalid BrokerFlavor value")
+}
+
+// detectBrokerFlavor returns the flavor of the server that sent the
+// "server" header entry, or BrokerUnknown if it is not recognised.
+func detectBrokerFlavor(server string) BrokerFlavor {
+	switch {
+	case strings.HasPrefix(server, "ActiveMQ-Artemis"), strings.Contains(server, "Artemis"):
+		return BrokerArtemis
+	case strings.HasPrefix(server, "ActiveMQ"):
+		return BrokerActiveMQ
+	case strings.HasPrefix(server, "RabbitMQ"):
+		return BrokerRabbitMQ
+	}
+	return BrokerUnknown
+}
+
+// resolve returns the flavor, or the detected flavor if it is BrokerAuto.
+func (b BrokerFlavor) resolve(detected BrokerFlavor) (BrokerFlavor, error) {
+	if b == BrokerAuto {
+		b = detected
+	}
+	if b == BrokerUnknown {
+		return b, ErrUnknownBroker
+	}
+	return b, nil
+}
+
+// known reports whether the flavor identifies a server product.
+func (b BrokerFlavor) known() bool {
+	return b != BrokerAuto && b != BrokerUnknown
+}
+
+// setPrefetchHeader sets the header entries of a SUBSCRIBE frame that limit
+// the number of messages that the server sends before they are acknowledged.
+// If the flavor is not known, the header entries of every flavor are set.
+func (b BrokerFlavor) setPrefetchHeader(f *frame.Frame, n int) {
+	value := strconv.Itoa(n)
+	if !b.known() || b == BrokerActiveMQ {
+		f.Header.Set("activemq.prefetchSize", value)
+	}
+	if !b.known() || b == BrokerArtemis {
+		f.Header.Set("consumer-window-size", value)
+	}
+	if !b.known() || b == BrokerRabbitMQ {
+		f.Header.Set("prefetch-count", value)
+	}
+}
+
+// setTTLHeader sets the header entries of a SEND frame that limit the time
+// that the server keeps the message, which is sent at now. If the flavor is
+// not known, the header entries of every flavor are set.
+func (b BrokerFlavor) setTTLHeader(f *frame.Frame, ttl time.Duration, now time.Time) {
+	if b != BrokerRabbitMQ {
+		f.Header.Set(frame.Expires, strconv.FormatInt(now.Add(ttl).UnixMilli(), 10))
+	}
+	if !b.known() || b == BrokerRabbitMQ {
+		f.Header.Set(frame.Expiration, strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+}
+
+// The Feature type is an enumeration of the broker-specific features that
+// the options of this package use, for Conn.Supports.
+type Feature int
+
+const (
+	// The "requeue" header entry of NACK frames, set by NackOpt.NoRequeue.
+	FeatureNackRequeueHeader Feature = iota
+
+	// A header entry of SUBSCRIBE frames that limits the number of
+	// messages sent before they are acknowledged, set by
+	// SubscribeOpt.Prefetch.
+	FeaturePrefetchHeader
+
+	// Temporary destinations, whose names start with "/temp-queue/",
+	// as used by Conn.Request.
+	FeatureTempQueues
+
+	// Durable subscriptions, as requested by SubscribeOpt.Durable.
+	FeatureDurableSubscriptions
+
+	// The "selector" header entry of SUBSCRIBE frames, set by
+	// SubscribeOpt.Selector.
+	FeatureSelectors
+)
+
+// String returns the string representation of the Feature value.
+func (f Feature) String() string {
+	switch f {
+	case FeatureNackRequeueHeader:
+		return "nack-requeue-header"
+	case FeaturePrefetchHeader:
+		return "prefetch-header"
+	case FeatureTempQueues:
+		return "temp-queues"
+	case FeatureDurableSubscriptions:
+		return "durable-subscriptions"
+	case FeatureSelectors:
+		return "selectors"
+	}
+	panic("invalid Feature value")
+}
+
+// supports reports whether servers of the flavor support the feature.
+func (b BrokerFlavor) supports(feature Feature) bool {
+	switch feature {
+	case FeatureNackRequeueHeader:
+		return b == BrokerRabbitMQ
+	case FeaturePrefetchHeader, FeatureDurableSubscriptions:
+		return b.known()
+	case FeatureTempQueues:
+		return b == BrokerActiveMQ || b == BrokerRabbitMQ
+	case FeatureSelectors:
+		return b == BrokerActiveMQ || b == BrokerArtemis
+	}
+	return false
+}
+
+// Flavor returns the flavor of the STOMP server, detected from the
+// "server" header entry of the CONNECTED frame, or BrokerUnknown if it
+// is not recognised.
+func (c *Conn) Flavor() BrokerFlavor {
+	return c.flavor
+}
+
+// Supports reports whether the STOMP server supports the feature,
+// according to its flavor. It returns false for every feature if
+// the flavor is BrokerUnknown.
+func (c *Conn) Supports(feature Feature) bool {
+	return c.flavor.supports(feature)
+}
+
+// rabbitCancelMessage is the "message" header entry of the ERROR frame that
+// RabbitMQ sends when it cancels a subscription, for example because its
+// queue has been deleted. The connection stays open.
+const rabbitCancelMessage = "Server cancelled subscription"
+
+// isCancellation reports whether an ERROR frame tells that the server has
+// cancelled the subscription in its "subscription" header entry, without
+// closing the connection.
+func isCancellation(f *frame.Frame) bool {
+	if _, ok := f.Header.Contains(frame.Subscription); !ok {
+		return false
+	}
+	_, local := f.Header.Contains(localErrorHeader)
+	return !local && f.Header.Get(frame.Message) == rabbitCancelMessage
+}
@@ -0,0 +1,146 @@
+package stomp
+
+import (
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	"github.com/go-stomp/stomp/testutil"
+	. "gopkg.in/check.v1"
+)
+
+// connectServerHelper sets up a connection to a server that sends the
+// server header entry in the CONNECTED frame.
+func connectServerHelper(c *C, server string) (*Conn, *fakeReaderWriter) {
+	fc1, fc2 := testutil.NewFakeConn(c)
+	rw := &fakeReaderWriter{
+		reader: frame.NewReader(fc2),
+		writer: frame.NewWriter(fc2),
+		conn:   fc2,
+	}
+
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.CONNECT)
+		rw.Write(frame.New(frame.CONNECTED, frame.Version, "1.2", frame.Server, server))
+	}()
+
+	conn, err := Connect(fc1)
+	c.Assert(err, IsNil)
+	<-stop
+	return conn, rw
+}
+
+func (s *StompSuite) Test_detect_broker_flavor(c *C) {
+	c.Check(detectBrokerFlavor("ActiveMQ/5.18.3"), Equals, BrokerActiveMQ)
+	c.Check(detectBrokerFlavor("ActiveMQ-Artemis/2.31.2 ActiveMQ Artemis Messaging Engine"), Equals, BrokerArtemis)
+	c.Check(detectBrokerFlavor("RabbitMQ/3.12.0"), Equals, BrokerRabbitMQ)
+	c.Check(detectBrokerFlavor("stompd/x.y.z"), Equals, BrokerUnknown)
+}
+
+func (s *StompSuite) Test_conn_flavor(c *C) {
+	for _, tc := range []struct {
+		server   string
+		flavor   BrokerFlavor
+		features []Feature
+	}{
+		{"ActiveMQ/5.18.3", BrokerActiveMQ,
+			[]Feature{FeaturePrefetchHeader, FeatureTempQueues, FeatureDurableSubscriptions, FeatureSelectors}},
+		{"ActiveMQ-Artemis/2.31.2", BrokerArtemis,
+			[]Feature{FeaturePrefetchHeader, FeatureDurableSubscriptions, FeatureSelectors}},
+		{"RabbitMQ/3.12.0", BrokerRabbitMQ,
+			[]Feature{FeatureNackRequeueHeader, FeaturePrefetchHeader, FeatureTempQueues, FeatureDurableSubscriptions}},
+		{"", BrokerUnknown, nil},
+	} {
+		conn, rw := connectServerHelper(c, tc.server)
+		c.Check(conn.Flavor(), Equals, tc.flavor)
+		var features []Feature
+		for _, feature := range []Feature{FeatureNackRequeueHeader, FeaturePrefetchHeader,
+			FeatureTempQueues, FeatureDurableSubscriptions, FeatureSelectors} {
+			if conn.Supports(feature) {
+				features = append(features, feature)
+			}
+		}
+		c.Check(features, DeepEquals, tc.features, Commentf("%s", tc.flavor))
+		rw.Close()
+	}
+}
+
+func (s *StompSuite) Test_subscription_prefetch(c *C) {
+	prefetchHelper(c, "ActiveMQ/5.18.3", map[string]string{"activemq.prefetchSize": "10"})
+	prefetchHelper(c, "ActiveMQ-Artemis/2.31.2", map[string]string{"consumer-window-size": "10"})
+	prefetchHelper(c, "RabbitMQ/3.12.0", map[string]string{"prefetch-count": "10"})
+	prefetchHelper(c, "", map[string]string{
+		"activemq.prefetchSize": "10",
+		"consumer-window-size":  "10",
+		"prefetch-count":        "10",
+	})
+}
+
+func prefetchHelper(c *C, server string, expected map[string]string) {
+	conn, rw := connectServerHelper(c, server)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		for _, key := range []string{"activemq.prefetchSize", "consumer-window-size", "prefetch-count"} {
+			c.Check(f1.Header.Get(key), Equals, expected[key], Commentf("%s %s", server, key))
+		}
+		rw.Close()
+	}()
+
+	_, err := conn.Subscribe("/queue/test-1", AckClient, SubscribeOpt.Prefetch(0))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+
+	_, err = conn.Subscribe("/queue/test-1", AckClient, SubscribeOpt.Prefetch(10))
+	c.Assert(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_ttl_header(c *C) {
+	now := time.UnixMilli(1700000000000)
+	for _, tc := range []struct {
+		flavor     BrokerFlavor
+		expires    string
+		expiration string
+	}{
+		{BrokerActiveMQ, "1700000060000", ""},
+		{BrokerArtemis, "1700000060000", ""},
+		{BrokerRabbitMQ, "", "60000"},
+		{BrokerAuto, "1700000060000", "60000"},
+	} {
+		f := frame.New(frame.SEND)
+		tc.flavor.setTTLHeader(f, time.Minute, now)
+		c.Check(f.Header.Get(frame.Expires), Equals, tc.expires, Commentf("%v", tc.flavor))
+		c.Check(f.Header.Get(frame.Expiration), Equals, tc.expiration, Commentf("%v", tc.flavor))
+	}
+}
+
+func (s *StompSuite) Test_send_ttl(c *C) {
+	conn, rw := connectServerHelper(c, "RabbitMQ/3.12.0")
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SEND)
+		c.Check(f1.Header.Get(frame.Expiration), Equals, "1500")
+		c.Check(f1.Header.Get(frame.Expires), Equals, "")
+		c.Check(f1.Header.Get(frame.Persistent), Equals, "true")
+		rw.Close()
+	}()
+
+	err := conn.Send("/queue/test-1", "text/plain", nil, SendOpt.TTL(0))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+
+	err = conn.Send("/queue/test-1", "text/plain", nil, SendOpt.TTL(1500*time.Millisecond), SendOpt.Persistent)
+	c.Check(err, IsNil)
+	<-stop
+}
@@ -0,0 +1,113 @@
+package stomp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxDecompressedSize is the default limit on the size of a message
+// body decompressed by ConnOpt.AutoDecompress.
+const DefaultMaxDecompressedSize = 64 << 20
+
+// The header entry that names the encoding of a compressed body.
+const contentEncodingHeader = "content-encoding"
+
+// A Codec compresses and decompresses message bodies, for SendOpt.Compress
+// and ConnOpt.AutoDecompress. CodecGzip is provided; other encodings, such
+// as zstd, can be supported by implementing Codec and calling RegisterCodec.
+type Codec interface {
+	// Encoding returns the value of the "content-encoding" header entry
+	// of the messages compressed by the codec, such as "gzip".
+	Encoding() string
+
+	// Compress returns body compressed.
+	Compress(body []byte) ([]byte, error)
+
+	// Decompress returns a reader of the decompressed contents of r.
+	Decompress(r io.Reader) (io.ReadCloser, error)
+}
+
+// CodecGzip compresses message bodies with gzip.
+var CodecGzip Codec = gzipCodec{}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Encoding() string {
+	return "gzip"
+}
+
+func (gzipCodec) Compress(body []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+var (
+	codecsMutex sync.RWMutex
+	codecs      = map[string]Codec{"gzip": CodecGzip}
+)
+
+// RegisterCodec makes the codec known to ConnOpt.AutoDecompress, which
+// decompresses the messages whose "content-encoding" header entry is equal
+// to its Encoding, ignoring case. It replaces a codec registered earlier for
+// the same encoding, including CodecGzip.
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	codecs[strings.ToLower(codec.Encoding())] = codec
+}
+
+// lookupCodec returns the codec registered for the encoding, or nil.
+func lookupCodec(encoding string) Codec {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	return codecs[strings.ToLower(encoding)]
+}
+
+// decompress returns the body of msg decompressed, if it has a
+// "content-encoding" header entry for a registered codec, or nil if it
+// does not. The decompressed body must not be longer than limit bytes.
+func decompress(msg *Message, limit int) ([]byte, error) {
+	encoding, ok := msg.Header.Contains(contentEncodingHeader)
+	if !ok {
+		return nil, nil
+	}
+	codec := lookupCodec(encoding)
+	if codec == nil {
+		return nil, nil
+	}
+
+	r, err := codec.Decompress(bytes.NewReader(msg.Body))
+	if err != nil {
+		return nil, newDecompressError(encoding, err)
+	}
+	defer r.Close()
+	body, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, newDecompressError(encoding, err)
+	}
+	if len(body) > limit {
+		return nil, newDecompressError(encoding, fmt.Errorf("body is larger than %d bytes", limit))
+	}
+	return body, nil
+}
+
+// newDecompressError describes a body that cannot be decompressed, in
+// more detail than ErrDecompress, which it wraps.
+func newDecompressError(encoding string, err error) Error {
+	return Error{Message: fmt.Sprintf("%s: %s: %v", ErrDecompress.Message, encoding, err), cause: ErrDecompress}
+}
@@ -0,0 +1,134 @@
+package stomp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+// reverseCodec is a codec for the tests, which reverses the body.
+type reverseCodec struct{}
+
+func (reverseCodec) Encoding() string {
+	return "x-reverse"
+}
+
+func (reverseCodec) Compress(body []byte) ([]byte, error) {
+	reversed := make([]byte, len(body))
+	for i, b := range body {
+		reversed[len(body)-1-i] = b
+	}
+	return reversed, nil
+}
+
+func (c reverseCodec) Decompress(r io.Reader) (io.ReadCloser, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	body, _ = c.Compress(body)
+	return io.NopCloser(bytes.NewReader(body)), nil
+}
+
+func (s *StompSuite) Test_compress(c *C) {
+	RegisterCodec(reverseCodec{})
+	conn, rw := connectHelper(c, V12, ConnOpt.AutoDecompress(true), ConnOpt.MaxDecompressedSize(1<<20))
+	stop := make(chan struct{})
+
+	bomb, err := CodecGzip.Compress(make([]byte, 1<<20+1))
+	c.Assert(err, IsNil)
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		message := func(encoding string, body []byte) {
+			f := frame.New(frame.MESSAGE,
+				frame.Subscription, f1.Header.Get(frame.Id),
+				frame.MessageId, "message-1",
+				frame.Destination, "/queue/test-1",
+				frame.ContentType, "application/json",
+				frame.ContentLength, strconv.Itoa(len(body)))
+			if encoding != "" {
+				f.Header.Set(contentEncodingHeader, encoding)
+			}
+			f.Body = body
+			rw.Write(f)
+		}
+
+		// the messages sent are echoed to the subscription
+		for i := 0; i < 2; i++ {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, frame.SEND)
+			c.Check(f.Header.Get(frame.ContentType), Equals, "application/json")
+			c.Check(f.Header.Get(frame.ContentLength), Equals, f.Header.Get("original-length"))
+			message(f.Header.Get(contentEncodingHeader), f.Body)
+		}
+		message("gzip", []byte("not gzip"))
+		message("gzip", bomb)
+		message("br", []byte("unknown"))
+		message("", []byte("plain"))
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+
+	body := []byte(`{"items":"` + strings.Repeat("item,", 100000) + `"}`)
+	for i, codec := range []Codec{CodecGzip, reverseCodec{}} {
+		compressed, err := codec.Compress(body)
+		c.Assert(err, IsNil)
+		opts := []func(*frame.Frame) error{SendOpt.Compress(codec), SendOpt.Header("original-length", strconv.Itoa(len(compressed)))}
+		if i == 0 {
+			// the compressed body still has a content-length
+			opts = append([]func(*frame.Frame) error{SendOpt.NoContentLength}, opts...)
+		}
+		err = conn.Send("/queue/test-1", "application/json", body, opts...)
+		c.Assert(err, IsNil)
+
+		msg := <-sub.C
+		c.Assert(msg.Err, IsNil)
+		c.Check(msg.Body, DeepEquals, body)
+		c.Check(msg.Header.Get(contentEncodingHeader), Equals, codec.Encoding())
+		c.Check(msg.ContentType, Equals, "application/json")
+	}
+	if c.Failed() {
+		return
+	}
+
+	// the errors are for the messages alone
+	for _, expected := range []string{
+		"cannot decompress body: gzip: unexpected EOF",
+		"cannot decompress body: gzip: body is larger than 1048576 bytes",
+	} {
+		msg := <-sub.C
+		c.Assert(msg.Err, NotNil)
+		c.Check(msg.Err, ErrorMatches, expected)
+		c.Check(errors.Is(msg.Err, ErrDecompress), Equals, true)
+		c.Check(msg.ShouldAck(), Equals, false)
+		c.Check(sub.Active(), Equals, true)
+	}
+	msg := <-sub.C
+	c.Check(string(msg.Body), Equals, "unknown")
+	msg = <-sub.C
+	c.Check(string(msg.Body), Equals, "plain")
+	c.Check(sub.Stats().Errors, Equals, uint64(2))
+
+	c.Check(conn.Send("/queue/test-1", "", nil, SendOpt.Compress(nil)), Equals, ErrNilOption)
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+
+	_, err = Connect(nil, ConnOpt.MaxDecompressedSize(0))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+}
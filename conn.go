@@ -1,13 +1,17 @@
 package stomp
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-stomp/stomp/frame"
@@ -17,55 +21,160 @@ import (
 // to avoid premature disconnections due to network latency.
 const DefaultHeartBeatError = 5 * time.Second
 
+// Default fraction of the heart-beat send interval after which
+// the client sends a heart-beat to an idle connection.
+const DefaultHeartBeatSendFraction = 0.8
+
 // Default timeout of calling Conn.Send function
 const DefaultMsgSendTimeout = 10 * time.Second
 
+// Number of errors that the channel returned by Conn.Errors can hold.
+const errorChannelCapacity = 16
+
+// Number of requests queued for writing whose frames are written
+// to the server with a single flush.
+const maxCoalescedWrites = 64
+
 // A Conn is a connection to a STOMP server. Create a Conn using either
 // the Dial or Connect function.
 type Conn struct {
+	epoch                   uint64 // connection generation, accessed atomically, first for alignment
+	heartBeatSend           int64  // negotiated heart-beat intervals, accessed atomically
+	heartBeatRecv           int64
 	conn                    io.ReadWriteCloser
+	connMutex               sync.Mutex // protects conn, which changes when reconnecting
 	readCh                  chan *frame.Frame
+	readErr                 *error // set by readLoop before readCh is closed
+	errorCh                 chan error
+	errorMutex              sync.Mutex // protects errorCh from being closed while sending
+	errorsClosed            bool
+	closeCh                 chan struct{} // closed when processLoop has stopped
+	loopDone                chan struct{} // closed when processLoop starts to stop
+	channelsClosing         chan struct{} // closed when processLoop starts to close the channels
 	writeCh                 chan writeRequest
 	version                 Version
 	session                 string
 	server                  string
+	flavor                  BrokerFlavor // detected from server
+	connectedHeader         *frame.Header
+	readBufferSize          int
+	writeBufferSize         int
 	readTimeout             time.Duration
 	writeTimeout            time.Duration
 	msgSendTimeout          time.Duration
+	unsubscribeTimeout      time.Duration
+	transactionTimeout      time.Duration
 	hbGracePeriodMultiplier float64
-	closed                  bool
+	closed                  int32 // accessed atomically, changed while holding closeMutex
 	closeMutex              *sync.Mutex
 	options                 *connOptions
+	connectOptions          *connOptions     // retained for reconnecting
+	reconnectPolicy         *ReconnectPolicy // nil if not reconnecting
+	reconnecting            int32            // accessed atomically
+	queuedSends             int32            // accessed atomically
+	log                     Logger
+	onHeartBeatError        func(error)
+	onPanic                 func(recovered any, stack []byte)
+	metrics                 Metrics
+	tracer                  *tracer
+	subsMutex               sync.Mutex
+	subs                    map[string]*Subscription // subscriptions that have not closed
+	durables                map[string]BrokerFlavor  // flavors of durable subscriptions, by name
+	replies                 replier
+	sendInterceptors        []func(*frame.Frame) error
+	validationLevel         ValidationLevel
+	maxDestinationLength    int // zero if destinations are not limited
+	onUnknownFrame          func(*frame.Frame)
+	autoDecompress          bool
+	maxDecompressedSize     int
+	discardFrames           bool   // unless the frames are needed to release their bodies
+	pingDestination         string // empty if Ping uses a transaction
+	receiveInterceptors     []func(*frame.Frame) error
+	bodies                  sync.Map      // *frame.BodyReader of streamed MESSAGE frames, by frame
+	ackBatchMax             int           // zero if acks are not batched
+	ackFlushInterval        time.Duration // zero if batched acks are not flushed periodically
+	failureMutex            sync.Mutex
+	failure                 error // the most recent cause of a connection failure
+	state                   int32 // ConnState, accessed atomically, changed while holding stateMutex
+	stateMutex              sync.Mutex
+	onStateChange           func(old, new ConnState)
 }
 
 type writeRequest struct {
 	Frame *frame.Frame      // frame to send
 	C     chan *frame.Frame // response channel
+	ctx   context.Context   // if non-nil, the frame is discarded once done
+	msg   *Message          // message acknowledged by an ACK or NACK frame
+
+	// If Frame is nil, the request tells the processing loop
+	// that the sender is no longer waiting for this receipt.
+	forget string
+
+	// If non-nil, frames that are written with a single flush.
+	batch []writeRequest
+
+	// If non-nil, the request has no frame, and the processing loop
+	// closes the channel once no receipts are outstanding.
+	idle chan struct{}
+
+	// If non-nil, the request has no frame, and the processing loop
+	// flushes any batched acks and sends the result on the channel.
+	flushed chan error
+
+	// The frame is an ACK that can be written without flushing
+	// the writer, when acks are batched.
+	deferFlush bool
+
+	// If non-nil, the body of the SEND frame is read from the stream.
+	stream *streamBody
+
+	// If non-nil, the response channel for the receipt of a SUBSCRIBE
+	// frame, whose C channel receives the frames of the subscription.
+	receiptC chan *frame.Frame
 }
 
 // Dial creates a network connection to a STOMP server and performs
 // the STOMP connect protocol sequence. The network endpoint of the
 // STOMP server is specified by network and addr. STOMP protocol
-// options can be specified in opts.
+// options can be specified in opts. If ConnOpt.TLSConfig is specified,
+// the network connection is secured with TLS. The network can be any
+// network supported by net.Dial, such as "tcp" or "unix", or by the
+// dialer specified with ConnOpt.Dialer.
 func Dial(network, addr string, opts ...func(*Conn) error) (*Conn, error) {
-	c, err := net.Dial(network, addr)
+	return DialWithContext(context.Background(), network, addr, opts...)
+}
+
+// DialWithContext creates a network connection and performs the STOMP
+// connect protocol sequence, in the same way as Dial. If the context is
+// done before the connect sequence is complete, the network connection
+// is closed, and the error returned wraps the context's error. The
+// context has no effect once the Conn has been returned.
+func DialWithContext(ctx context.Context, network, addr string, opts ...func(*Conn) error) (*Conn, error) {
+	options := dialOptions(opts)
+	c, err := dialNetwork(ctx, network, addr, options.TLSConfig, options)
 	if err != nil {
 		return nil, err
 	}
 
-	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	// The host is that of the remote address, unless the connection is
+	// made by a dialer, which may connect through a proxy. There is no
+	// host for networks such as "unix".
+	hostAddr := addr
+	if options.Dialer == nil && c.RemoteAddr() != nil {
+		hostAddr = c.RemoteAddr().String()
+	}
+	if host, _, err := net.SplitHostPort(hostAddr); err == nil {
+		// Add option to set host and make it the first option in list,
+		// so that if host has been explicitly specified it will override.
+		opts = append([](func(*Conn) error){ConnOpt.Host(host)}, opts...)
+	}
+
+	conn, err := ConnectWithContext(ctx, c, opts...)
 	if err != nil {
-		if innerErr := c.Close(); innerErr != nil {
-			return nil, fmt.Errorf("failed to close connect: %w, original error: %v", innerErr, err)
-		}
+		c.Close()
 		return nil, err
 	}
-
-	// Add option to set host and make it the first option in list,
-	// so that if host has been explicitly specified it will override.
-	opts = append([](func(*Conn) error){ConnOpt.Host(host)}, opts...)
-
-	return Connect(c, opts...)
+	return conn, nil
 }
 
 // Connect creates a STOMP connection and performs the STOMP connect
@@ -73,12 +182,17 @@ func Dial(network, addr string, opts ...func(*Conn) error) (*Conn, error) {
 // been created by the program. The opts parameter provides the
 // opportunity to specify STOMP protocol options.
 func Connect(conn io.ReadWriteCloser, opts ...func(*Conn) error) (*Conn, error) {
-	reader := frame.NewReader(conn)
-	writer := frame.NewWriter(conn)
+	return connect(context.Background(), conn, opts)
+}
 
+// connect performs the STOMP connect protocol sequence for Connect
+// and ConnectWithContext. The context is passed to the credentials
+// function specified with ConnOpt.CredentialsFunc.
+func connect(ctx context.Context, conn io.ReadWriteCloser, opts []func(*Conn) error) (*Conn, error) {
 	c := &Conn{
 		conn:       conn,
 		closeMutex: &sync.Mutex{},
+		subs:       make(map[string]*Subscription),
 	}
 
 	options, err := newConnOptions(c, opts)
@@ -86,12 +200,8 @@ func Connect(conn io.ReadWriteCloser, opts ...func(*Conn) error) (*Conn, error)
 		return nil, err
 	}
 
-	if options.ReadBufferSize > 0 {
-		reader = frame.NewReaderSize(conn, options.ReadBufferSize)
-	}
-
-	if options.WriteBufferSize > 0 {
-		writer = frame.NewWriterSize(conn, options.ReadBufferSize)
+	if options.Reconnect != nil && options.Reconnect.Dial == nil {
+		return nil, errors.New("reconnect policy requires a Dial function")
 	}
 
 	readChannelCapacity := 20
@@ -106,9 +216,22 @@ func Connect(conn io.ReadWriteCloser, opts ...func(*Conn) error) (*Conn, error)
 	}
 
 	c.hbGracePeriodMultiplier = options.HeartBeatGracePeriodMultiplier
+	c.onStateChange = options.OnStateChange
+	c.onPanic = options.OnPanic
+	c.metrics = options.Metrics
+
+	c.log = options.Logger
+	if c.log == nil {
+		c.log = getDefaultLogger()
+	}
 
 	c.readCh = make(chan *frame.Frame, readChannelCapacity)
+	c.readErr = new(error)
 	c.writeCh = make(chan writeRequest, writeChannelCapacity)
+	c.errorCh = make(chan error, errorChannelCapacity)
+	c.closeCh = make(chan struct{})
+	c.loopDone = make(chan struct{})
+	c.channelsClosing = make(chan struct{})
 
 	if options.Host == "" {
 		// host not specified yet, attempt to get from net.Conn if possible
@@ -124,82 +247,271 @@ func Connect(conn io.ReadWriteCloser, opts ...func(*Conn) error) (*Conn, error)
 		}
 	}
 
-	connectFrame, err := options.NewFrame()
+	if options.TraceWriter != nil {
+		options.tracer = newTracer(options.TraceWriter, options.TraceBodyLength)
+		c.tracer = options.tracer
+	}
+
+	reader, writer, response, err := connectHandshake(ctx, conn, options)
 	if err != nil {
+		c.tracer.stop()
+		c.setState(Closed)
+		return nil, err
+	}
+
+	c.server = response.Header.Get(frame.Server)
+	c.flavor = detectBrokerFlavor(c.server)
+	c.session = response.Header.Get(frame.Session)
+	c.connectedHeader = response.Header.Clone()
+
+	if c.version, err = negotiatedVersion(response); err != nil {
+		c.tracer.stop()
+		c.setState(Closed)
 		return nil, err
 	}
 
+	if c.readTimeout, c.writeTimeout, err = c.negotiateHeartBeat(response, options); err != nil {
+		c.tracer.stop()
+		c.setState(Closed)
+		return nil, err
+	}
+
+	c.msgSendTimeout = options.MsgSendTimeout
+	c.replies.prefix = options.ReplyDestinationPrefix
+	c.onHeartBeatError = options.OnHeartBeatError
+	c.sendInterceptors = options.SendInterceptors
+	c.validationLevel = options.ValidationLevel
+	c.maxDestinationLength = options.MaxDestinationLength
+	c.onUnknownFrame = options.OnUnknownFrame
+	c.autoDecompress = options.AutoDecompress
+	c.maxDecompressedSize = options.MaxDecompressedSize
+	c.discardFrames = options.DiscardFrames && !options.BodyPool
+	c.pingDestination = options.PingDestination
+	c.receiveInterceptors = options.ReceiveInterceptors
+	c.unsubscribeTimeout = options.UnsubscribeTimeout
+	c.transactionTimeout = options.TransactionTimeout
+	c.ackBatchMax = options.AckBatchMax
+	c.ackFlushInterval = options.AckFlushInterval
+
+	if options.Reconnect != nil {
+		c.reconnectPolicy = options.Reconnect
+		c.connectOptions = options
+	}
+
+	c.readBufferSize = reader.BufferSize()
+	c.writeBufferSize = writer.BufferSize()
+
+	c.setState(Connected)
+	go readLoop(c.readCh, c.readErr, reader, c)
+	go processLoop(c, writer)
+
+	return c, nil
+}
+
+// ConnectWithContext creates a STOMP connection and performs the STOMP
+// connect protocol sequence over conn, in the same way as Connect. If the
+// context is done before the connect sequence is complete, conn is closed,
+// and the error returned wraps the context's error, so that
+// errors.Is(err, context.DeadlineExceeded) reports whether the connect
+// sequence timed out. The context has no effect once the Conn has been
+// returned.
+func ConnectWithContext(ctx context.Context, conn io.ReadWriteCloser, opts ...func(*Conn) error) (*Conn, error) {
+	if err := ctx.Err(); err != nil {
+		conn.Close()
+		return nil, newContextError(err)
+	}
+
+	// the connect sequence is abandoned if the context is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	c, err := connect(ctx, conn, opts)
+	if !stop() {
+		if err == nil {
+			// the connection has been closed, stop the goroutines
+			c.MustDisconnect()
+		}
+		return nil, newContextError(ctx.Err())
+	}
+	return c, err
+}
+
+// connectHandshake performs the STOMP connect protocol sequence on conn,
+// and returns the CONNECTED frame received from the server.
+func connectHandshake(ctx context.Context, conn io.ReadWriter, options *connOptions) (*frame.Reader, *frame.Writer, *frame.Frame, error) {
+	limits := []frame.ReaderOption{
+		frame.MaxFrameSize(options.MaxFrameSize),
+		frame.MaxHeaders(options.MaxHeaders, options.MaxHeaderBytes),
+	}
+	if options.BodyPool {
+		limits = append(limits, frame.BodyPool())
+	}
+	if options.OnUnknownFrame != nil {
+		limits = append(limits, frame.AnyCommand())
+	}
+	reader := frame.NewReader(conn, limits...)
+	writer := frame.NewWriter(conn)
+
+	if options.ReadBufferSize > 0 {
+		reader = frame.NewReaderSize(conn, options.ReadBufferSize, limits...)
+	}
+
+	if options.WriteBufferSize > 0 {
+		writer = frame.NewWriterSize(conn, options.WriteBufferSize)
+	}
+
+	connectFrame, err := options.NewFrame(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err = intercept(options.SendInterceptors, connectFrame); err != nil {
+		return nil, nil, nil, err
+	}
+
 	err = writer.Write(connectFrame)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
+	options.tracer.sent(connectFrame)
 
 	response, err := reader.Read()
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
+	options.tracer.received(response)
 	if response == nil {
-		return nil, errors.New("unexpected empty frame")
+		return nil, nil, nil, errors.New("unexpected empty frame")
+	}
+	if err = intercept(options.ReceiveInterceptors, response); err != nil {
+		return nil, nil, nil, err
 	}
 
 	if response.Command != frame.CONNECTED {
-		return nil, newError(response)
+		return nil, nil, nil, newError(response)
 	}
 
-	c.server = response.Header.Get(frame.Server)
-	c.session = response.Header.Get(frame.Session)
+	// header values are encoded according to the negotiated version
+	if version, err := negotiatedVersion(response); err == nil {
+		reader.SetVersion(string(version))
+		writer.SetVersion(string(version))
+	}
 
-	if versionString := response.Header.Get(frame.Version); versionString != "" {
-		version := Version(versionString)
-		if err = version.CheckSupported(); err != nil {
-			return nil, Error{
-				Message: err.Error(),
-				Frame:   response,
-			}
+	return reader, writer, response, nil
+}
+
+// prepareSend calls the send interceptors with a frame that is about to
+// be sent, then checks it as specified by ConnOpt.ValidateFrames. A body
+// containing NUL without a content-length is always rejected.
+func (c *Conn) prepareSend(f *frame.Frame) error {
+	if err := intercept(c.sendInterceptors, f); err != nil {
+		return err
+	}
+	// without a content-length the frame would end at the first NUL
+	if bytes.IndexByte(f.Body, 0) >= 0 {
+		if _, ok := f.Header.Contains(frame.ContentLength); !ok {
+			return ErrNulInBody
 		}
-		c.version = version
-	} else {
+	}
+	return validateFrame(f, c.validationLevel, c.version)
+}
+
+// intercept calls each of the interceptors with frame f, in order,
+// stopping at the first error.
+func intercept(interceptors []func(*frame.Frame) error, f *frame.Frame) error {
+	for _, interceptor := range interceptors {
+		if err := interceptor(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// negotiatedVersion returns the protocol version in a CONNECTED frame.
+func negotiatedVersion(response *frame.Frame) (Version, error) {
+	versionString := response.Header.Get(frame.Version)
+	if versionString == "" {
 		// no version in the response, so assume version 1.0
-		c.version = V10
+		return V10, nil
+	}
+
+	version := Version(versionString)
+	if err := version.CheckSupported(); err != nil {
+		return "", Error{
+			Message: err.Error(),
+			Frame:   response,
+		}
 	}
+	return version, nil
+}
 
-	if heartBeat, ok := response.Header.Contains(frame.HeartBeat); ok {
-		readTimeout, writeTimeout, err := frame.ParseHeartBeat(heartBeat)
+// negotiateHeartBeat returns the read and write timeouts that follow
+// from the heart-beat header of a CONNECTED frame, and records the
+// negotiated intervals for the HeartBeat method.
+func (c *Conn) negotiateHeartBeat(response *frame.Frame, options *connOptions) (readTimeout, writeTimeout time.Duration, err error) {
+	heartBeat, ok := response.Header.Contains(frame.HeartBeat)
+	if ok {
+		readTimeout, writeTimeout, err = frame.ParseHeartBeat(heartBeat)
 		if err != nil {
-			return nil, Error{
+			return 0, 0, Error{
 				Message: err.Error(),
 				Frame:   response,
 			}
 		}
+	}
 
-		c.readTimeout = readTimeout
-		c.writeTimeout = writeTimeout
+	atomic.StoreInt64(&c.heartBeatSend, int64(writeTimeout))
+	atomic.StoreInt64(&c.heartBeatRecv, int64(readTimeout))
 
-		if c.readTimeout > 0 {
-			// Add time to the read timeout to account for time
-			// delay in other station transmitting timeout
-			c.readTimeout += options.HeartBeatError
-		}
-		if c.writeTimeout > options.HeartBeatError {
+	if readTimeout > 0 {
+		// Add time to the read timeout to account for time
+		// delay in other station transmitting timeout
+		readTimeout += options.HeartBeatError
+	}
+	if writeTimeout > 0 {
+		// Send heart-beats early, so that they are not late when
+		// writing a frame delays the next one
+		early := time.Duration(float64(writeTimeout) * options.HeartBeatSendFraction)
+		if writeTimeout > options.HeartBeatError {
 			// Reduce time from the write timeout to account
 			// for time delay in transmitting to the other station
-			c.writeTimeout -= options.HeartBeatError
+			writeTimeout -= options.HeartBeatError
+		}
+		if early > 0 && early < writeTimeout {
+			writeTimeout = early
 		}
 	}
+	return readTimeout, writeTimeout, nil
+}
 
-	c.msgSendTimeout = options.MsgSendTimeout
-
-	// TODO(jpj): make any non-standard headers in the CONNECTED
-	// frame available. This could be implemented as:
-	// (a) a callback function supplied as an option; or
-	// (b) a property of the Conn structure (eg CustomHeaders)
-	// Neither options are particularly elegant, so wait until
-	// there is a real need for this.
+// HeartBeat returns the heart-beat intervals negotiated with the STOMP
+// server during the connect sequence. The send interval is how often the
+// client sends heart-beats to the server, and the recv interval is how often
+// the server sends heart-beats to the client. A zero interval means that no
+// heart-beats are sent in that direction. The values are updated when the
+// connection is re-established after a failure.
+func (c *Conn) HeartBeat() (send, recv time.Duration) {
+	send = time.Duration(atomic.LoadInt64(&c.heartBeatSend))
+	recv = time.Duration(atomic.LoadInt64(&c.heartBeatRecv))
+	return send, recv
+}
 
-	go readLoop(c, reader)
-	go processLoop(c, writer)
+// readDeadline returns how long to wait for a frame from the server
+// before the connection is considered to have failed.
+func (c *Conn) readDeadline(readTimeout time.Duration) time.Duration {
+	return time.Duration(float64(readTimeout) * c.hbGracePeriodMultiplier)
+}
 
-	return c, nil
+// RemoteAddr returns the network address of the STOMP server, which
+// changes if the connection is re-established with another server.
+// Returns nil if the address is not known, for example if the connection
+// passed to Connect is not a net.Conn, or if the connection is closed.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+	if conn, ok := c.conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
 }
 
 // Version returns the version of the STOMP protocol that
@@ -225,62 +537,527 @@ func (c *Conn) Server() string {
 	return c.server
 }
 
+// ReadBufferSize returns the size of the buffer that frames are read
+// into, as specified with ConnOpt.ReadBufferSize.
+func (c *Conn) ReadBufferSize() int {
+	return c.readBufferSize
+}
+
+// WriteBufferSize returns the size of the buffer that frames are
+// written from, as specified with ConnOpt.WriteBufferSize.
+func (c *Conn) WriteBufferSize() int {
+	return c.writeBufferSize
+}
+
+// ConnectedHeaders returns a copy of the header entries of the CONNECTED
+// frame received from the STOMP server during the connect sequence,
+// including any non-standard entries. If the connection is re-established
+// after a failure, the header entries of the original connection are
+// still returned.
+func (c *Conn) ConnectedHeaders() *frame.Header {
+	return c.connectedHeader.Clone()
+}
+
+// Errors returns a channel that receives connection-level errors: heart-beat
+// timeouts, the network connection closing unexpectedly, frames that cannot
+// be parsed and ERROR frames from the server. Errors that cause the Conn to
+// reconnect are also reported. The channel is closed once the connection
+// has shut down, so the program can range over it.
+//
+// The channel is buffered. If the program does not receive from it, errors
+// that arrive while it is full are discarded.
+func (c *Conn) Errors() <-chan error {
+	return c.errorCh
+}
+
+// reportError makes a connection-level error available on the Errors
+// channel. It is only called by the processLoop goroutine.
+func (c *Conn) reportError(err error) {
+	c.errorMutex.Lock()
+	defer c.errorMutex.Unlock()
+	if c.errorsClosed {
+		return
+	}
+	select {
+	case c.errorCh <- err:
+	default:
+		c.log.Warnf("error channel full, discarding error: %v", err)
+	}
+}
+
 // readLoop is a goroutine that reads frames from the
 // reader and places them onto a channel for processing
-// by the processLoop goroutine
-func readLoop(c *Conn, reader *frame.Reader) {
+// by the processLoop goroutine. The error that stops
+// the loop is stored in errp before the channel is closed.
+func readLoop(ch chan *frame.Frame, errp *error, reader *frame.Reader, c *Conn) {
 	for {
-		f, err := reader.Read()
+		read := reader.BytesRead()
+		f, body, err := reader.ReadStreaming(c.streamsBody)
 		if err != nil {
-			close(c.readCh)
+			if errors.Is(err, frame.ErrFrameTooLarge) {
+				err = newFrameTooLargeError(err)
+			}
+			*errp = err
+			close(ch)
 			return
 		}
-		c.readCh <- f
+		c.tracer.received(f)
+		if body == nil {
+			if c.metrics != nil && f != nil {
+				c.metrics.FrameReceived(f.Command, int(reader.BytesRead()-read))
+			}
+			ch <- f
+			continue
+		}
+
+		// the next frame follows the body, so wait for it to be
+		// read, then tell the processing loop with a heart-beat
+		c.bodies.Store(f, body)
+		ch <- f
+		<-body.Done()
+		if c.metrics != nil {
+			c.metrics.FrameReceived(f.Command, int(reader.BytesRead()-read))
+		}
+		ch <- nil
 	}
 }
 
+// streamsBody reports whether the body of f, a frame read from the server,
+// is to be streamed, according to SubscribeOpt.StreamBodiesOver.
+func (c *Conn) streamsBody(f *frame.Frame, contentLength int) bool {
+	if f.Command != frame.MESSAGE {
+		return false
+	}
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	sub, ok := c.subs[f.Header.Get(frame.Subscription)]
+	return ok && sub.streamOver >= 0 && contentLength > sub.streamOver
+}
+
+// takeBody returns the reader of the body of f, if the body is streamed,
+// or nil otherwise. The caller must read the body or close the reader.
+func (c *Conn) takeBody(f *frame.Frame) io.ReadCloser {
+	if body, ok := c.bodies.LoadAndDelete(f); ok {
+		return body.(*frame.BodyReader)
+	}
+	return nil
+}
+
+// discardBody discards the body of f, if it is streamed, so that the
+// next frame can be read. A pooled body is released.
+func (c *Conn) discardBody(f *frame.Frame) {
+	if body := c.takeBody(f); body != nil {
+		go body.Close()
+	}
+	f.Release()
+}
+
 // processLoop is a goroutine that handles io with
 // the server.
 func processLoop(c *Conn, writer *frame.Writer) {
 	channels := make(map[string]chan *frame.Frame)
 
+	// SUBSCRIBE frames of the subscriptions on the server, keyed by
+	// subscription id, so that they can be re-created after reconnecting.
+	// The frame is nil once the UNSUBSCRIBE frame has been written.
+	subscriptions := make(map[string]*frame.Frame)
+
+	// requests to write before any more are read from the write channel
+	var pending []writeRequest
+
+	// once the DISCONNECT frame has been written the connection is
+	// expected to close, so there is no attempt to reconnect
+	disconnecting := false
+
+	// closed once there are no receipts outstanding
+	var idle []chan struct{}
+
+	readTimeout, writeTimeout := c.readTimeout, c.writeTimeout
+
+	// when the read timer was last started, for reporting read timeouts
+	var readStarted time.Time
 	var readTimeoutChannel <-chan time.Time
 	var readTimer *time.Timer
 	var writeTimeoutChannel <-chan time.Time
 	var writeTimer *time.Timer
 
+	// when the writer last started to send frames to the server, from
+	// which the time until the next heart-beat is measured
+	lastWrite := time.Now()
+
+	// when the frames that requested receipts were written, keyed
+	// by receipt id, if the latency of receipts is measured
+	var receiptsSent map[string]time.Time
+	if c.metrics != nil {
+		receiptsSent = make(map[string]time.Time)
+	}
+
+	// set while the body of a MESSAGE frame is streamed, when nothing
+	// else can be read, so the read timer is not started
+	streaming := false
+
+	// number of ACK frames written without flushing the writer
+	unflushedAcks := 0
+
+	// set while the requests already queued on writeCh are written
+	// together, so that their frames are flushed once
+	coalescing := false
+	coalesced := false // a frame is waiting for the coalesced flush
+	var ackTimeoutChannel <-chan time.Time
+	var ackTimer *time.Timer
+
+	// closeChannels is called when the processing loop stops. It sends f
+	// to every goroutine waiting for a response or for the frames of a
+	// subscription, then closes and forgets every channel, so that each
+	// waiter sees the connection close exactly once, and a second call
+	// does nothing. Paused subscriptions stop waiting to be resumed, so
+	// that they read f.
+	channelsClosed := false
+	closeChannels := func(f *frame.Frame) {
+		if !channelsClosed {
+			channelsClosed = true
+			close(c.channelsClosing)
+		}
+		for id, ch := range channels {
+			ch <- f
+			close(ch)
+			delete(channels, id)
+			delete(subscriptions, id)
+		}
+	}
+
 	defer func() {
+		closeChannels(newErrorFrame(ErrConnectionClosed))
+		// release a DISCONNECT waiting for a response that will not
+		// arrive, before waiting for it to unlock closeMutex
+		close(c.loopDone)
 		if err := c.MustDisconnect(); err != nil {
-			log.Printf("Failed to disconnect: %v", err)
+			c.log.Errorf("Failed to disconnect: %v", err)
 		}
+		c.errorMutex.Lock()
+		c.errorsClosed = true
+		close(c.errorCh)
+		c.errorMutex.Unlock()
+		c.tracer.stop()
+		close(c.closeCh)
 	}()
 
+	// notifyIdle releases the waiters in idle if the server has
+	// responded to every receipt that was requested
+	notifyIdle := func() {
+		if len(idle) == 0 {
+			return
+		}
+		for id := range channels {
+			if _, ok := subscriptions[id]; !ok {
+				return
+			}
+		}
+		for _, ch := range idle {
+			close(ch)
+		}
+		idle = nil
+	}
+
+	// acksFlushed is called once the writer has been flushed, or
+	// replaced, so that no acks are waiting to be flushed
+	acksFlushed := func() {
+		unflushedAcks = 0
+		if ackTimer != nil {
+			ackTimer.Stop()
+			ackTimer = nil
+			ackTimeoutChannel = nil
+		}
+	}
+
+	// flush sends everything written to the writer to the server
+	flush := func() error {
+		acksFlushed()
+		started := time.Now()
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		lastWrite = started
+		return nil
+	}
+
+	// fail is called when the connection to the server has failed, and
+	// returns true if the connection has been re-established. The cause
+	// is reported on the Errors channel, unless the program is closing
+	// the connection.
+	fail := func(err, cause error) bool {
+		c.setFailure(cause)
+		var o *outage
+		if !disconnecting && !c.IsClosed() {
+			c.reportError(cause)
+			o = c.reconnect(err, channels, subscriptions, pending)
+		}
+		if o == nil {
+			closeChannels(newErrorFrame(err))
+			return false
+		}
+
+		writer = o.writer
+		acksFlushed()
+		lastWrite = time.Now()
+		pending = o.pending
+		readTimeout, writeTimeout = o.readTimeout, o.writeTimeout
+		if readTimer != nil {
+			readTimer.Stop()
+			readTimer = nil
+			readTimeoutChannel = nil
+		}
+		if writeTimer != nil {
+			writeTimer.Stop()
+			writeTimer = nil
+			writeTimeoutChannel = nil
+		}
+		notifyIdle()
+		return true
+	}
+
+	// buffer writes the frame of a request written by the
+	// program, without flushing the writer
+	buffer := func(req writeRequest) error {
+		if req.ctx != nil && req.ctx.Err() != nil {
+			// the sender has already given up on this frame, so
+			// it is discarded before anything is written
+			return nil
+		}
+		if req.msg != nil && req.msg.epoch != atomic.LoadUint64(&c.epoch) {
+			// the message was received on a previous connection
+			if req.C != nil {
+				req.C <- newErrorFrame(ErrStaleMessage)
+			}
+			return nil
+		}
+		if req.C != nil {
+			if receipt, ok := req.Frame.Header.Contains(frame.Receipt); ok {
+				// remember the channel for this receipt, unless the
+				// channel is for the frames of a subscription, which
+				// closes when its channel receives a RECEIPT frame
+				if req.receiptC != nil {
+					channels[receipt] = req.receiptC
+				} else if req.Frame.Command != frame.SUBSCRIBE {
+					channels[receipt] = req.C
+				}
+			}
+		}
+
+		switch req.Frame.Command {
+		case frame.SUBSCRIBE:
+			id, _ := req.Frame.Header.Contains(frame.Id)
+			channels[id] = req.C
+			subscriptions[id] = req.Frame
+			if epoch := atomic.LoadUint64(&c.epoch); epoch != 0 {
+				req.C <- newEpochFrame(epoch)
+			}
+		case frame.UNSUBSCRIBE:
+			id, _ := req.Frame.Header.Contains(frame.Id)
+			// is this trying to be too clever -- add a receipt
+			// header so that when the server responds with a
+			// RECEIPT frame, the corresponding channel will be closed
+			req.Frame.Header.Set(frame.Receipt, id)
+			if _, ok := subscriptions[id]; ok {
+				subscriptions[id] = nil
+			}
+		case frame.DISCONNECT:
+			disconnecting = true
+		}
+
+		// frame to send
+		written := writer.BytesWritten()
+		var err error
+		if req.stream != nil {
+			err = writer.WriteStream(req.Frame, req.stream.r, req.stream.size)
+		} else {
+			err = writer.WriteBuffered(req.Frame)
+		}
+		if err == nil {
+			c.tracer.sent(req.Frame)
+			if req.msg != nil {
+				req.msg.Subscription.acknowledged(req.Frame.Command)
+			}
+		}
+		if err == nil && c.metrics != nil {
+			c.frameSent(req.Frame, int(writer.BytesWritten()-written))
+			if receipt, ok := req.Frame.Header.Contains(frame.Receipt); ok {
+				receiptsSent[receipt] = time.Now()
+			}
+		}
+		return err
+	}
+
+	// write sends a request written by the program to the server
+	write := func(req writeRequest) error {
+		if req.batch != nil {
+			for i, r := range req.batch {
+				if err := buffer(r); err != nil {
+					// the rest of the batch is written if the
+					// connection is re-established
+					pending = append(append([]writeRequest{}, req.batch[i+1:]...), pending...)
+					return err
+				}
+			}
+			return flush()
+		}
+		if req.idle != nil {
+			idle = append(idle, req.idle)
+			notifyIdle()
+			return nil
+		}
+		if req.flushed != nil {
+			err := flush()
+			req.flushed <- err
+			return err
+		}
+		if req.Frame == nil {
+			if _, ok := subscriptions[req.forget]; ok {
+				// a subscription closed after an error
+				close(channels[req.forget])
+				delete(subscriptions, req.forget)
+			}
+			delete(channels, req.forget)
+			notifyIdle()
+			return nil
+		}
+		err := buffer(req)
+		if req.stream != nil {
+			req.stream.done <- err
+			// frames that arrived while the body was written have
+			// not been read yet, so the read deadline starts again
+			if readTimer != nil {
+				readTimer.Stop()
+				readTimer = nil
+				readTimeoutChannel = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if req.deferFlush && req.C == nil {
+			// batched ack, which is flushed along with the next
+			// frame, or once enough acks or time have accumulated
+			unflushedAcks++
+			if unflushedAcks < c.ackBatchMax {
+				if ackTimer == nil && c.ackFlushInterval > 0 {
+					ackTimer = time.NewTimer(c.ackFlushInterval)
+					ackTimeoutChannel = ackTimer.C
+				}
+				return nil
+			}
+		}
+		if coalescing {
+			coalesced = true
+			return nil
+		}
+		return flush()
+	}
+
+	// writeQueued writes req, and the requests queued behind it, up to
+	// maxCoalescedWrites in all, with a single flush
+	writeQueued := func(req writeRequest) error {
+		coalescing = true
+		defer func() {
+			coalescing = false
+			coalesced = false
+		}()
+		err := write(req)
+		for n := 1; err == nil && n < maxCoalescedWrites; n++ {
+			var ok bool
+			select {
+			case req, ok = <-c.writeCh:
+			default:
+			}
+			if !ok {
+				// nothing queued, or the channel is closed,
+				// which the loop sees next
+				break
+			}
+			err = write(req)
+		}
+		if err == nil && coalesced {
+			err = flush()
+		}
+		return err
+	}
+
 	for {
-		if c.readTimeout > 0 && readTimer == nil {
-			readTimer = time.NewTimer(time.Duration(float64(c.readTimeout) * c.hbGracePeriodMultiplier))
+		if len(pending) > 0 {
+			// requests queued while reconnecting
+			req := pending[0]
+			pending = pending[1:]
+			if err := write(req); err != nil {
+				if fail(err, err) {
+					continue
+				}
+				return
+			}
+			continue
+		}
+
+		if readTimeout > 0 && readTimer == nil && !streaming {
+			readTimer = time.NewTimer(c.readDeadline(readTimeout))
 			readTimeoutChannel = readTimer.C
+			readStarted = time.Now()
 		}
-		if c.writeTimeout > 0 && writeTimer == nil {
-			writeTimer = time.NewTimer(c.writeTimeout)
+		if writeTimeout > 0 && writeTimer == nil {
+			// a heart-beat is due once nothing has been
+			// written for the write timeout
+			writeTimer = time.NewTimer(writeTimeout - time.Since(lastWrite))
 			writeTimeoutChannel = writeTimer.C
 		}
 
 		select {
 		case <-readTimeoutChannel:
 			// read timeout, close the connection
-			err := ErrReadTimeout
-			sendError(channels, err)
+			readTimer = nil
+			readTimeoutChannel = nil
+			if c.metrics != nil {
+				c.metrics.HeartbeatMissed()
+			}
+			if c.onHeartBeatError != nil {
+				elapsed := time.Since(readStarted)
+				c.safely("heart-beat error function", func() {
+					c.onHeartBeatError(newReadTimeoutError(elapsed, c.readDeadline(readTimeout)))
+				})
+			}
+			if fail(ErrReadTimeout, ErrReadTimeout) {
+				continue
+			}
 			return
 
 		case <-writeTimeoutChannel:
 			// write timeout, send a heart-beat frame
-			err := writer.Write(nil)
+			writeTimer = nil
+			writeTimeoutChannel = nil
+			if time.Since(lastWrite) < writeTimeout {
+				// a frame was written in the meantime
+				continue
+			}
+			// the heart-beat flushes any batched acks
+			err := writer.WriteBuffered(nil)
+			if err == nil {
+				c.tracer.sent(nil)
+				err = flush()
+			}
 			if err != nil {
-				sendError(channels, err)
+				if fail(err, err) {
+					continue
+				}
+				return
+			}
+
+		case <-ackTimeoutChannel:
+			// flush interval elapsed, send the batched acks
+			ackTimer = nil
+			ackTimeoutChannel = nil
+			if err := flush(); err != nil {
+				if fail(err, err) {
+					continue
+				}
 				return
 			}
-			writeTimer = nil
-			writeTimeoutChannel = nil
 
 		case f, ok := <-c.readCh:
 			// stop the read timer
@@ -291,36 +1068,71 @@ func processLoop(c *Conn, writer *frame.Writer) {
 			}
 
 			if !ok {
-				err := ErrConnectionClosed
-				sendError(channels, err)
+				cause := *c.readErr
+				if cause == nil || cause == io.EOF {
+					cause = ErrConnectionClosed
+				}
+				if fail(ErrConnectionClosed, cause) {
+					continue
+				}
 				return
 			}
 
 			if f == nil {
 				// heart-beat received
+				streaming = false
+				continue
+			}
+			_, streaming = c.bodies.Load(f)
+
+			var err error
+			if perr := c.safely("receive interceptor", func() {
+				err = intercept(c.receiveInterceptors, f)
+			}); perr != nil {
+				// the panic has been reported
+				c.discardBody(f)
+				continue
+			}
+			if err != nil {
+				// the frame is discarded
+				c.discardBody(f)
+				c.reportError(err)
 				continue
 			}
 
 			switch f.Command {
 			case frame.RECEIPT:
 				if id, ok := f.Header.Contains(frame.ReceiptId); ok {
+					if sent, ok := receiptsSent[id]; ok {
+						c.metrics.ReceiptLatency(time.Since(sent))
+						delete(receiptsSent, id)
+					}
 					if ch, ok := channels[id]; ok {
 						ch <- f
 						delete(channels, id)
+						delete(subscriptions, id)
 						close(ch)
+						notifyIdle()
 					}
 				} else {
 					err := &Error{Message: "missing receipt-id", Frame: f}
-					sendError(channels, err)
+					c.reportError(err)
+					closeChannels(newErrorFrame(err))
 					return
 				}
 
 			case frame.ERROR:
-				log.Println("received ERROR; Closing underlying connection")
-				for _, ch := range channels {
-					ch <- f
-					close(ch)
+				if id, ok := f.Header.Contains(frame.Subscription); ok && subscriptions[id] != nil && (c.survivesErrors(id) || isCancellation(f)) {
+					// an error for one subscription, which decides
+					// whether it survives, or which the server has
+					// cancelled
+					c.reportError(newError(f))
+					channels[id] <- f
+					continue
 				}
+				c.log.Warnf("received ERROR; Closing underlying connection")
+				c.reportError(newError(f))
+				closeChannels(f)
 
 				c.closeMutex.Lock()
 				defer c.closeMutex.Unlock()
@@ -335,8 +1147,20 @@ func processLoop(c *Conn, writer *frame.Writer) {
 					if ch, ok := channels[id]; ok {
 						ch <- f
 					} else {
-						log.Println("ignored MESSAGE for subscription", id)
+						c.discardBody(f)
+						c.log.Warnf("ignored MESSAGE for subscription %s", id)
 					}
+				} else {
+					c.discardBody(f)
+				}
+
+			default:
+				if c.onUnknownFrame != nil {
+					c.safely("unknown frame function", func() {
+						c.onUnknownFrame(f)
+					})
+				} else {
+					c.log.Warnf("ignored unexpected %s frame", f.Command)
 				}
 			}
 
@@ -348,43 +1172,27 @@ func processLoop(c *Conn, writer *frame.Writer) {
 				writeTimeoutChannel = nil
 			}
 			if !ok {
-				sendError(channels, errors.New("write channel closed"))
+				closeChannels(newErrorFrame(errors.New("write channel closed")))
 				return
 			}
-			if req.C != nil {
-				if receipt, ok := req.Frame.Header.Contains(frame.Receipt); ok {
-					// remember the channel for this receipt
-					channels[receipt] = req.C
+			if err := writeQueued(req); err != nil {
+				if fail(err, err) {
+					continue
 				}
-			}
-
-			switch req.Frame.Command {
-			case frame.SUBSCRIBE:
-				id, _ := req.Frame.Header.Contains(frame.Id)
-				channels[id] = req.C
-			case frame.UNSUBSCRIBE:
-				id, _ := req.Frame.Header.Contains(frame.Id)
-				// is this trying to be too clever -- add a receipt
-				// header so that when the server responds with a
-				// RECEIPT frame, the corresponding channel will be closed
-				req.Frame.Header.Set(frame.Receipt, id)
-			}
-
-			// frame to send
-			err := writer.Write(req.Frame)
-			if err != nil {
-				sendError(channels, err)
 				return
 			}
 		}
 	}
 }
 
-// Send an error to all receipt channels.
-func sendError(m map[string]chan *frame.Frame, err error) {
-	f := frame.New(frame.ERROR, frame.Message, err.Error())
-	for _, ch := range m {
-		ch <- f
+// frameSent reports a frame of size bytes written to the connection.
+func (c *Conn) frameSent(f *frame.Frame, size int) {
+	c.metrics.FrameSent(f.Command, size)
+	switch f.Command {
+	case frame.ACK:
+		c.metrics.AckSent()
+	case frame.NACK:
+		c.metrics.NackSent()
 	}
 }
 
@@ -395,42 +1203,126 @@ func sendError(m map[string]chan *frame.Frame, err error) {
 // with the STOMP server is closed and any further attempt to write
 // to the server will fail.
 func (c *Conn) Disconnect() error {
+	return c.DisconnectWithContext(context.Background())
+}
+
+// DisconnectWithContext disconnects from the STOMP server in the same way
+// as Disconnect, except that it stops waiting for the RECEIPT frame when
+// the context is done. The connection is then closed without waiting any
+// longer, and the error returned wraps ctx.Err(), such as
+// context.DeadlineExceeded. If the context is already done, no DISCONNECT
+// frame is sent.
+//
+// It is safe to disconnect from more than one goroutine at once. Only the
+// first call sends the DISCONNECT frame; the others wait for it to finish,
+// and return nil once the connection is closed.
+func (c *Conn) DisconnectWithContext(ctx context.Context) error {
 	c.closeMutex.Lock()
 	defer c.closeMutex.Unlock()
-	if c.closed {
+	if c.IsClosed() {
 		return nil
 	}
 
-	ch := make(chan *frame.Frame)
-	c.writeCh <- writeRequest{
-		Frame: frame.New(frame.DISCONNECT, frame.Receipt, allocateId()),
-		C:     ch,
+	if ctx.Err() == nil {
+		// buffered, so that the processing loop does not block
+		// if we have stopped waiting
+		ch := make(chan *frame.Frame, 1)
+		request := writeRequest{
+			Frame: frame.New(frame.DISCONNECT, frame.Receipt, allocateReceiptId()),
+			C:     ch,
+		}
+		if err := intercept(c.sendInterceptors, request.Frame); err != nil {
+			return err
+		}
+		c.setState(Disconnecting)
+
+		var response *frame.Frame
+		lost := false
+		select {
+		case c.writeCh <- request:
+			select {
+			case response = <-ch:
+			case <-c.loopDone:
+				response, lost = c.disconnectResponse(ch)
+			case <-ctx.Done():
+			}
+		case <-c.loopDone:
+			lost = true
+		case <-ctx.Done():
+		}
+		if response != nil {
+			// the connection is closed even if the server responds
+			// with an ERROR frame, so that later callers do not send
+			// another DISCONNECT frame that would never be written
+			c.markClosed()
+			if response.Command != frame.RECEIPT {
+				c.closeTransport()
+				return c.frameError(response)
+			}
+			return c.closeTransport()
+		}
+		if lost {
+			close(c.writeCh)
+			return c.tryCloseConn(ErrClosedUnexpectedly)
+		}
 	}
 
-	response := <-ch
-	if response.Command != frame.RECEIPT {
-		return newError(response)
+	// just close writeCh
+	close(c.writeCh)
+	c.markClosed()
+	e := newContextError(ctx.Err())
+	if err := c.closeTransport(); err != nil {
+		return fmt.Errorf("failed to close connection: %w, original error was: %v", err, e)
 	}
+	return e
+}
 
-	c.closed = true
-	return c.conn.Close()
+// disconnectResponse returns the response to a DISCONNECT frame once the
+// processing loop has stopped, which may have been delivered just before
+// it stopped, or whether the response will never arrive.
+func (c *Conn) disconnectResponse(ch chan *frame.Frame) (*frame.Frame, bool) {
+	select {
+	case response := <-ch:
+		return response, false
+	default:
+		return nil, true
+	}
 }
 
 // MustDisconnect will disconnect 'ungracefully' from the STOMP server.
 // This method should be used only as last resort when there are fatal
 // network errors that prevent to do a proper disconnect from the server.
+// It is the same as calling DisconnectWithContext with a context whose
+// deadline has passed, except that it returns nil once the connection
+// is closed.
 func (c *Conn) MustDisconnect() error {
-	c.closeMutex.Lock()
-	defer c.closeMutex.Unlock()
-	if c.closed {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Time{})
+	defer cancel()
+	err := c.DisconnectWithContext(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
 		return nil
 	}
+	return err
+}
 
-	// just close writeCh
-	close(c.writeCh)
+// markClosed records that the connection is closed.
+func (c *Conn) markClosed() {
+	atomic.StoreInt32(&c.closed, 1)
+	c.setState(Closed)
+}
+
+// closeTransport closes the network connection to the server. It is
+// safe to call more than once.
+func (c *Conn) closeTransport() error {
+	c.connMutex.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.connMutex.Unlock()
 
-	c.closed = true
-	return c.conn.Close()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
 }
 
 // Send sends a message to the STOMP server, which in turn sends the message to the specified destination.
@@ -442,63 +1334,211 @@ func (c *Conn) MustDisconnect() error {
 //
 // Any number of options can be specified in opts. See the examples for usage. Options include whether
 // to receive a RECEIPT, should the content-length be suppressed, and sending custom header entries.
+//
+// Frames that servers reject by closing the connection are not sent: an empty destination returns
+// ErrEmptyDestination, a destination longer than ConnOpt.MaxDestinationLength returns
+// ErrDestinationTooLong, and a content-length header entry, specified with SendOpt.Header, that differs
+// from the length of the body returns ErrContentLengthMismatch.
 func (c *Conn) Send(destination, contentType string, body []byte, opts ...func(*frame.Frame) error) error {
+	return c.SendWithContext(context.Background(), destination, contentType, body, opts...)
+}
+
+// SendWithContext is the same as Send, except that the operation is abandoned
+// when the context is done. Cancellation applies both while waiting for the
+// frame to be accepted by the writer and, if a receipt was requested, while
+// waiting for the RECEIPT frame. A frame that has not yet been picked up by the
+// writer when the context is done is never written to the server.
+//
+// If the context is done before the send completes, the returned error is an
+// Error that wraps ctx.Err().
+func (c *Conn) SendWithContext(ctx context.Context, destination, contentType string, body []byte, opts ...func(*frame.Frame) error) error {
+	request, options, err := c.enqueueSend(ctx, destination, contentType, body, opts, false, nil)
+	if err != nil || request.C == nil {
+		return err
+	}
+	return c.waitForReceipt(ctx, request, options.receiptTimeout)
+}
+
+// SendAsync sends a message to the STOMP server in the same way as Send,
+// but does not wait for the server to acknowledge it. A receipt is always
+// requested, and the returned Receipt completes when the RECEIPT frame
+// arrives, or when the send fails. This allows many messages to be sent
+// before waiting for any of the receipts.
+//
+// The returned error is non-nil if the SEND frame could not be created or
+// queued for writing, in which case there is no Receipt. SendOpt.ReceiptTimeout
+// limits how long the Receipt waits for the server.
+func (c *Conn) SendAsync(destination, contentType string, body []byte, opts ...func(*frame.Frame) error) (*Receipt, error) {
+	request, options, err := c.enqueueSend(context.Background(), destination, contentType, body, opts, true, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Receipt{
+		id:   request.Frame.Header.Get(frame.Receipt),
+		done: make(chan struct{}),
+	}
+	go func() {
+		r.err = c.waitForReceipt(context.Background(), request, options.receiptTimeout)
+		close(r.done)
+	}()
+	return r, nil
+}
+
+// enqueueSend creates a SEND frame and places it on the write channel.
+// If receipt is true, a receipt is requested even if the options do not
+// request one. If stream is non-nil, the body is read from it instead.
+// The response channel of the returned request is nil if there is no
+// receipt.
+func (c *Conn) enqueueSend(ctx context.Context, destination, contentType string, body []byte,
+	opts []func(*frame.Frame) error, receipt bool, stream *streamBody) (writeRequest, *sendOptions, error) {
+	if err := c.checkConnected(); err != nil {
+		return writeRequest{}, nil, err
+	}
 	c.closeMutex.Lock()
+	// Once the request is on the write channel the close mutex can be
+	// released, there is no need to hold it while we wait for the receipt.
 	defer c.closeMutex.Unlock()
-	if c.closed {
-		return ErrAlreadyClosed
+	if c.IsClosed() {
+		return writeRequest{}, nil, ErrConnectionClosed
 	}
 
-	f, err := createSendFrame(destination, contentType, body, opts)
+	f, options, err := c.createSendFrame(destination, contentType, body, opts)
 	if err != nil {
-		return err
+		return writeRequest{}, nil, err
+	}
+	if _, ok := f.Header.Contains(frame.Receipt); !ok && receipt {
+		f.Header.Set(frame.Receipt, allocateReceiptId())
+	}
+	if stream != nil {
+		f.Header.Set(frame.ContentLength, strconv.FormatInt(stream.size, 10))
+	}
+	if err = c.prepareSend(f); err != nil {
+		return writeRequest{}, nil, err
 	}
 
-	if _, ok := f.Header.Contains(frame.Receipt); ok {
-		// receipt required
-		request := writeRequest{
-			Frame: f,
-			C:     make(chan *frame.Frame),
+	if c.isReconnecting() {
+		// only a limited number of frames are queued while reconnecting
+		if atomic.AddInt32(&c.queuedSends, 1) > int32(c.reconnectPolicy.MaxQueuedSends) {
+			return writeRequest{}, nil, ErrConnectionClosed
 		}
+	}
 
-		err := sendDataToWriteChWithTimeout(c.writeCh, request, c.msgSendTimeout)
-		if err != nil {
-			return err
-		}
-		response := <-request.C
-		if response.Command != frame.RECEIPT {
-			return newError(response)
-		}
-	} else {
-		// no receipt required
-		request := writeRequest{Frame: f}
+	request := writeRequest{Frame: f, ctx: ctx, stream: stream}
+	if _, ok := f.Header.Contains(frame.Receipt); ok {
+		// receipt required, the response channel is buffered so that the
+		// processing loop never blocks if we have stopped waiting
+		request.C = make(chan *frame.Frame, 1)
+	}
 
-		err := sendDataToWriteChWithTimeout(c.writeCh, request, c.msgSendTimeout)
-		if err != nil {
-			return err
-		}
+	timeout := c.msgSendTimeout
+	if options.receiptTimeout > 0 {
+		timeout = options.receiptTimeout
+	}
+
+	err = sendDataToWriteChWithTimeout(ctx, c.writeCh, request, timeout)
+	if err != nil {
+		return writeRequest{}, nil, err
+	}
+	return request, options, nil
+}
+
+// waitForReceipt waits for the response to a request that has a receipt.
+// If timeout is positive, ErrMsgSendTimeout is returned if the response
+// has not arrived by then.
+func (c *Conn) waitForReceipt(ctx context.Context, request writeRequest, timeout time.Duration) error {
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	select {
+	case response, ok := <-request.C:
+		return c.receiptResult(response, ok)
+	case <-c.closeCh:
+		return c.closedResult(request.C)
+	case <-timeoutCh:
+		c.forgetReceipt(request.Frame.Header.Get(frame.Receipt))
+		return ErrMsgSendTimeout
+	case <-ctx.Done():
+		c.forgetReceipt(request.Frame.Header.Get(frame.Receipt))
+		return newContextError(ctx.Err())
 	}
+}
 
+// receiptResult returns the result of waiting for a receipt, given
+// the response received from the processing loop.
+func (c *Conn) receiptResult(response *frame.Frame, ok bool) error {
+	if !ok {
+		return ErrClosedUnexpectedly
+	}
+	if response.Command != frame.RECEIPT {
+		return c.frameError(response)
+	}
 	return nil
 }
 
-func sendDataToWriteChWithTimeout(ch chan writeRequest, request writeRequest, timeout time.Duration) error {
-	if timeout <= 0 {
-		ch <- request
-		return nil
+// closedResult returns the result of waiting for a receipt once the
+// processing loop has stopped. The response may have been delivered
+// just before it stopped.
+func (c *Conn) closedResult(ch chan *frame.Frame) error {
+	select {
+	case response, ok := <-ch:
+		return c.receiptResult(response, ok)
+	default:
+		return ErrClosedUnexpectedly
+	}
+}
+
+// forgetReceipt tells the processing loop that the sender is no longer
+// waiting for a receipt, so that a late RECEIPT frame is discarded. If the
+// write channel is full the request is not made, in which case the channel
+// is forgotten when the RECEIPT frame arrives.
+func (c *Conn) forgetReceipt(receipt string) {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	if c.IsClosed() {
+		return
+	}
+
+	select {
+	case c.writeCh <- writeRequest{forget: receipt}:
+	default:
+	}
+}
+
+func sendDataToWriteChWithTimeout(ctx context.Context, ch chan writeRequest, request writeRequest, timeout time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return newContextError(err)
+	}
+
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
 	}
 
-	timer := time.NewTimer(timeout)
-	defer timer.Stop()
 	select {
-	case <-timer.C:
+	case <-timeoutCh:
 		return ErrMsgSendTimeout
+	case <-ctx.Done():
+		return newContextError(ctx.Err())
 	case ch <- request:
 		return nil
 	}
 }
 
-func createSendFrame(destination, contentType string, body []byte, opts []func(*frame.Frame) error) (*frame.Frame, error) {
+func (c *Conn) createSendFrame(destination, contentType string, body []byte, opts []func(*frame.Frame) error) (*frame.Frame, *sendOptions, error) {
+	if destination == "" {
+		return nil, nil, ErrEmptyDestination
+	}
+	if c.maxDestinationLength > 0 && len(destination) > c.maxDestinationLength {
+		return nil, nil, ErrDestinationTooLong
+	}
+
 	// Set the content-length before the options, because this provides
 	// an opportunity to remove content-length.
 	f := frame.New(frame.SEND, frame.ContentLength, strconv.Itoa(len(body)))
@@ -508,38 +1548,118 @@ func createSendFrame(destination, contentType string, body []byte, opts []func(*
 		f.Header.Set(frame.ContentType, contentType)
 	}
 
-	for _, opt := range opts {
-		if opt == nil {
-			continue
+	options := &sendOptions{flavor: c.flavor}
+	err := withSettings(f, options, func() error {
+		for _, opt := range opts {
+			if opt == nil {
+				continue
+			}
+			if err := opt(f); err != nil {
+				return err
+			}
 		}
-		if err := opt(f); err != nil {
-			return nil, err
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the server would read a different body from the one sent
+	length := strconv.Itoa(len(f.Body))
+	for i := 0; i < f.Header.Len(); i++ {
+		if key, value := f.Header.GetAt(i); key == frame.ContentLength && value != length {
+			return nil, nil, ErrContentLengthMismatch
 		}
 	}
 
-	return f, nil
+	return f, options, nil
 }
 
 func (c *Conn) IsClosed() bool {
-	return c.closed
+	return atomic.LoadInt32(&c.closed) != 0
+}
+
+// enqueueFrame places f on the write channel, in the same way as
+// enqueueSend. The response channel of the returned request is nil
+// if f does not request a receipt.
+func (c *Conn) enqueueFrame(ctx context.Context, f *frame.Frame, timeout time.Duration) (writeRequest, error) {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	if c.IsClosed() {
+		return writeRequest{}, ErrConnectionClosed
+	}
+	if err := c.prepareSend(f); err != nil {
+		return writeRequest{}, err
+	}
+
+	request := writeRequest{Frame: f, ctx: ctx}
+	if _, ok := f.Header.Contains(frame.Receipt); ok {
+		request.C = make(chan *frame.Frame, 1)
+	}
+	if err := sendDataToWriteChWithTimeout(ctx, c.writeCh, request, timeout); err != nil {
+		return writeRequest{}, err
+	}
+	return request, nil
 }
 
 func (c *Conn) sendFrame(f *frame.Frame) error {
+	return c.sendRequest(writeRequest{Frame: f}, 0)
+}
+
+// SendFrame sends f to the STOMP server, in order with the other frames
+// sent on the connection, for commands that the other methods do not send,
+// such as the extensions of some servers. The send interceptors and the
+// checks of ConnOpt.ValidateFrames apply, and f must not be changed once it
+// has been passed to SendFrame. If f has a "receipt" header entry, SendFrame
+// waits for the RECEIPT frame, as for Send with SendOpt.Receipt, and returns
+// the error if the server responds with an ERROR frame; the time it waits is
+// limited by ConnOpt.MsgSendTimeout.
+//
+// ErrInvalidCommand is returned, and f is not sent, if its command is empty
+// or contains a line break, or if it is one that would corrupt the state of
+// the connection: CONNECT, STOMP and DISCONNECT, for which Disconnect is used
+// instead, and SUBSCRIBE and UNSUBSCRIBE, for which Subscribe and
+// Subscription.Unsubscribe are used instead.
+func (c *Conn) SendFrame(f *frame.Frame) error {
+	switch f.Command {
+	case "", frame.CONNECT, frame.STOMP, frame.DISCONNECT, frame.SUBSCRIBE, frame.UNSUBSCRIBE:
+		return ErrInvalidCommand
+	}
+	if strings.ContainsAny(f.Command, "\r\n") {
+		return ErrInvalidCommand
+	}
+	return c.sendRequest(writeRequest{Frame: f}, c.msgSendTimeout)
+}
+
+// sendAckFrame sends an ACK or NACK frame that acknowledges msg.
+func (c *Conn) sendAckFrame(f *frame.Frame, msg *Message) error {
+	return c.sendRequest(writeRequest{Frame: f, msg: msg}, 0)
+}
+
+// sendRequest writes a request to the server. If the frame requests a
+// receipt and receiptTimeout is positive, ErrMsgSendTimeout is returned
+// if the receipt has not arrived by then.
+func (c *Conn) sendRequest(request writeRequest, receiptTimeout time.Duration) error {
+	f := request.Frame
+
 	// Lock our mutex, but don't close it via defer
 	// If the frame requests a receipt then we want to release the lock before
 	// we block on the response, otherwise we can end up deadlocking
 	c.closeMutex.Lock()
-	if c.closed {
+	if c.IsClosed() {
 		c.closeMutex.Unlock()
 		return c.tryCloseConn(ErrClosedUnexpectedly)
 	}
 
+	if err := c.prepareSend(f); err != nil {
+		c.closeMutex.Unlock()
+		return err
+	}
+
 	if _, ok := f.Header.Contains(frame.Receipt); ok {
-		// receipt required
-		request := writeRequest{
-			Frame: f,
-			C:     make(chan *frame.Frame),
-		}
+		// receipt required, the response channel is buffered so that the
+		// processing loop never blocks if we have stopped waiting
+		request.C = make(chan *frame.Frame, 1)
 
 		c.writeCh <- request
 
@@ -549,7 +1669,16 @@ func (c *Conn) sendFrame(f *frame.Frame) error {
 
 		var response *frame.Frame
 
-		if c.writeTimeout > 0 {
+		if receiptTimeout > 0 {
+			timer := time.NewTimer(receiptTimeout)
+			defer timer.Stop()
+			select {
+			case response, ok = <-request.C:
+			case <-timer.C:
+				c.forgetReceipt(f.Header.Get(frame.Receipt))
+				return ErrMsgSendTimeout
+			}
+		} else if c.writeTimeout > 0 {
 			select {
 			case response, ok = <-request.C:
 			case <-time.After(c.writeTimeout):
@@ -564,11 +1693,10 @@ func (c *Conn) sendFrame(f *frame.Frame) error {
 		}
 
 		if response.Command != frame.RECEIPT {
-			return newError(response)
+			return c.frameError(response)
 		}
 	} else {
 		// no receipt required
-		request := writeRequest{Frame: f}
 		c.writeCh <- request
 
 		// Unlock the mutex now that we're written to the write channel
@@ -578,9 +1706,33 @@ func (c *Conn) sendFrame(f *frame.Frame) error {
 	return nil
 }
 
+// setFailure records the cause of a connection failure, which is
+// wrapped by the errors reported to the program as a result.
+func (c *Conn) setFailure(err error) {
+	c.failureMutex.Lock()
+	c.failure = err
+	c.failureMutex.Unlock()
+}
+
+func (c *Conn) lastFailure() error {
+	c.failureMutex.Lock()
+	defer c.failureMutex.Unlock()
+	return c.failure
+}
+
+// frameError is the same as newError, except that the errors that the
+// client reports when the connection fails wrap the cause of the failure.
+func (c *Conn) frameError(f *frame.Frame) Error {
+	e := newError(f)
+	if f.Command == frame.ERROR {
+		e.cause = errorFrameCause(f, c.lastFailure())
+	}
+	return e
+}
+
 func (c *Conn) tryCloseConn(e error) error {
-	c.closed = true
-	if err := c.conn.Close(); err != nil {
+	c.markClosed()
+	if err := c.closeTransport(); err != nil {
 		return fmt.Errorf("failed to close connection: %w, original error was: %v", err, e)
 	}
 	return e
@@ -591,10 +1743,42 @@ func (c *Conn) tryCloseConn(e error) error {
 // will be received by this subscription. A subscription has a channel
 // on which the calling program can receive messages.
 func (c *Conn) Subscribe(destination string, ack AckMode, opts ...func(*frame.Frame) error) (*Subscription, error) {
+	return c.subscribe(destination, ack, opts, nil)
+}
+
+// subscribe creates a subscription. If handler is non-nil, it is called
+// with the messages received instead of the program reading them from C.
+// If SubscribeOpt.Receipt is specified, subscribe waits for the receipt
+// once the SUBSCRIBE frame has been queued.
+func (c *Conn) subscribe(destination string, ack AckMode, opts []func(*frame.Frame) error, handler HandlerFunc) (*Subscription, error) {
+	sub, receipt, options, err := c.startSubscription(destination, ack, opts, handler)
+	if err != nil || receipt.C == nil {
+		return sub, err
+	}
+	if err = c.waitForReceipt(context.Background(), receipt, options.receiptTimeout); err != nil {
+		// the server may have created the subscription regardless
+		go func() {
+			if err := sub.Unsubscribe(); err != nil && err != ErrCompletedSubscription {
+				c.log.Debugf("Subscription %s: %s: failed to unsubscribe after the receipt failed: %v", sub.id, destination, err)
+			}
+		}()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// startSubscription creates a subscription and queues the SUBSCRIBE frame.
+// If the frame requests a receipt, the returned request has the channel on
+// which the response arrives.
+func (c *Conn) startSubscription(destination string, ack AckMode, opts []func(*frame.Frame) error, handler HandlerFunc) (*Subscription, writeRequest, *subscribeOptions, error) {
+	var receipt writeRequest
+	if err := c.checkConnected(); err != nil {
+		return nil, receipt, nil, err
+	}
 	c.closeMutex.Lock()
 	defer c.closeMutex.Unlock()
-	if c.closed {
-		return nil, c.tryCloseConn(ErrClosedUnexpectedly)
+	if c.IsClosed() {
+		return nil, receipt, nil, c.tryCloseConn(ErrConnectionClosed)
 	}
 
 	ch := make(chan *frame.Frame)
@@ -603,42 +1787,170 @@ func (c *Conn) Subscribe(destination string, ack AckMode, opts ...func(*frame.Fr
 		frame.Destination, destination,
 		frame.Ack, ack.String())
 
-	for _, opt := range opts {
-		if opt == nil {
-			continue
+	options := newSubscribeOptions()
+	options.flavor = c.flavor
+	err := withSettings(subscribeFrame, options, func() error {
+		for _, opt := range opts {
+			if opt == nil {
+				continue
+			}
+			err := opt(subscribeFrame)
+			if err != nil {
+				return err
+			}
 		}
-		err := opt(subscribeFrame)
-		if err != nil {
-			return nil, err
+		return nil
+	})
+	if err != nil {
+		return nil, receipt, nil, err
+	}
+	if options.workers > 1 && handler == nil {
+		return nil, receipt, nil, ErrInvalidOptionValue
+	}
+	autoAck := options.autoAckEvery > 0 || options.autoAckInterval > 0
+	if autoAck && (handler != nil || options.channelCapacity > 0) {
+		return nil, receipt, nil, ErrInvalidOptionValue
+	}
+	capacity := options.channelCapacity
+	if capacity < 0 {
+		// messages on an automatically acknowledged subscription are
+		// handed over to the program, so that they are acknowledged
+		// only once the program has received them
+		capacity = defaultSubscriptionChannelCapacity
+		if autoAck {
+			capacity = 0
 		}
 	}
 
 	// If the option functions have not specified the "id" header entry,
-	// create one.
+	// create one. The id includes the epoch of the connection, so that it
+	// differs from the ids of the subscriptions made before reconnecting.
 	id, ok := subscribeFrame.Header.Contains(frame.Id)
 	if !ok {
-		id = allocateId()
+		id = fmt.Sprintf("sub-%d-%s", atomic.LoadUint64(&c.epoch), allocateId())
 		subscribeFrame.Header.Add(frame.Id, id)
 	}
 
+	if err = c.prepareSend(subscribeFrame); err != nil {
+		return nil, receipt, nil, err
+	}
+
 	request := writeRequest{
 		Frame: subscribeFrame,
 		C:     ch,
 	}
+	if options.receipt {
+		request.receiptC = make(chan *frame.Frame, 1)
+		receipt = writeRequest{Frame: subscribeFrame, C: request.receiptC}
+	}
 
 	sub := &Subscription{
-		id:          id,
-		destination: destination,
-		conn:        c,
-		ackMode:     ack,
-		C:           make(chan *Message, 16),
-		closeChan:   make(chan struct{}),
+		id:             id,
+		destination:    destination,
+		conn:           c,
+		ackMode:        ack,
+		overflow:       options.overflow,
+		onError:        options.onError,
+		retry:          options.retry,
+		streamOver:     options.streamOver,
+		keepOpen:       options.keepOpen,
+		onCancel:       options.onCancel,
+		subscribeFrame: subscribeFrame.Clone(),
+		C:              make(chan *Message, capacity),
+		closeChan:      make(chan struct{}),
+		unsubscribing:  make(chan struct{}),
+	}
+	if options.separateErrors {
+		sub.errs = make(chan *Error, 1)
+		sub.Errs = sub.errs
+	}
+	if options.receipt {
+		// the receipt is for this frame alone, not for the frames that
+		// subscribe again after an error
+		sub.subscribeFrame.Header.Del(frame.Receipt)
+	}
+	if err = c.addSubscription(sub); err != nil {
+		return nil, receipt, nil, err
+	}
+	if handler != nil {
+		sub.handlerDone = make(chan struct{})
+		go sub.runHandler(handler, options.workers)
+	}
+	if autoAck {
+		sub.autoAck = &autoAcker{
+			sub:      sub,
+			every:    options.autoAckEvery,
+			interval: options.autoAckInterval,
+			trigger:  make(chan struct{}, 1),
+		}
+		go sub.autoAck.run()
+	}
+	if options.durable != "" {
+		c.addDurable(options.durable, options.durableFlavor)
 	}
 	go sub.readLoop(ch)
 
 	// TODO is this safe? There is no check if writeCh is actually open.
 	c.writeCh <- request
-	return sub, nil
+	return sub, receipt, options, nil
+}
+
+// addSubscription records a subscription until it closes. An error is
+// returned if another subscription that has not closed has the same id,
+// since the frames for both would be delivered to one of them.
+func (c *Conn) addSubscription(sub *Subscription) error {
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	if _, ok := c.subs[sub.id]; ok {
+		return newSubscriptionIdInUseError(sub.id)
+	}
+	c.subs[sub.id] = sub
+	return nil
+}
+
+func (c *Conn) removeSubscription(sub *Subscription) {
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	if c.subs[sub.id] == sub {
+		delete(c.subs, sub.id)
+	}
+}
+
+// survivesErrors reports whether the subscription with the id handles
+// the errors that the server reports for it, without the connection
+// being closed.
+func (c *Conn) survivesErrors(id string) bool {
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	sub, ok := c.subs[id]
+	return ok && sub.handlesErrors()
+}
+
+// forgetSubscription tells the processing loop that the subscription with
+// the id has been closed after an error, without being unsubscribed. The
+// processing loop closes the subscription's channel.
+func (c *Conn) forgetSubscription(id string) {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	if c.IsClosed() {
+		return
+	}
+	c.writeCh <- writeRequest{forget: id}
+}
+
+// activeSubscriptions returns the subscriptions that have not closed,
+// ordered by id.
+func (c *Conn) activeSubscriptions() []*Subscription {
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	subs := make([]*Subscription, 0, len(c.subs))
+	for _, sub := range c.subs {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].id < subs[j].id
+	})
+	return subs
 }
 
 // TODO check further for race conditions
@@ -646,29 +1958,72 @@ func (c *Conn) Subscribe(destination string, ack AckMode, opts ...func(*frame.Fr
 // Ack acknowledges a message received from the STOMP server.
 // If the message was received on a subscription with AckMode == AckAuto,
 // then no operation is performed.
+//
+// The ACK frame identifies the message as the negotiated protocol version
+// requires: with its message-id for STOMP 1.0, with its subscription and
+// message-id for STOMP 1.1, and with the value of its ack header entry
+// for STOMP 1.2. If the MESSAGE frame does not have the header entry that
+// is required, ErrMissingMessageId or ErrMissingAck is returned.
 func (c *Conn) Ack(m *Message) error {
-	f, err := c.createAckNackFrame(m, true)
+	f, err := c.createAckNackFrame(m, true, nil)
 	if err != nil {
 		return err
 	}
 
 	if f != nil {
-		return c.sendFrame(f)
+		return c.sendRequest(writeRequest{Frame: f, msg: m, deferFlush: c.batchesAcks(m)}, 0)
 	}
 	return nil
 }
 
+// batchesAcks reports whether the ACK frame for msg can be batched
+// with other ACK frames, as specified by ConnOpt.AckBatching.
+func (c *Conn) batchesAcks(msg *Message) bool {
+	return c.ackBatchMax > 1 && msg.Subscription.AckMode() == AckClientIndividual
+}
+
+// FlushAcks sends any ACK frames that have been batched, as specified
+// by ConnOpt.AckBatching, to the server. It returns once the frames
+// have been written to the network connection, which makes it useful
+// before a checkpoint. If acks are not batched, it has no effect.
+func (c *Conn) FlushAcks() error {
+	c.closeMutex.Lock()
+	if c.IsClosed() {
+		c.closeMutex.Unlock()
+		return ErrClosedUnexpectedly
+	}
+
+	// buffered, so that the processing loop never blocks
+	ch := make(chan error, 1)
+	c.writeCh <- writeRequest{flushed: ch}
+	c.closeMutex.Unlock()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-c.closeCh:
+		return ErrClosedUnexpectedly
+	}
+}
+
 // Nack indicates to the server that a message was not received
-// by the client. Returns an error if the STOMP version does not
-// support the NACK message.
+// by the client. Returns ErrNackNotSupported for STOMP 1.0, which
+// does not support the NACK frame. The NACK frame identifies the
+// message in the same way as the ACK frame sent by Ack.
 func (c *Conn) Nack(m *Message) error {
-	f, err := c.createAckNackFrame(m, false)
+	return c.NackWithOpts(m)
+}
+
+// NackWithOpts is the same as Nack, except that options for the NACK
+// frame can be specified, such as NackOpt.NoRequeue or NackOpt.Header.
+func (c *Conn) NackWithOpts(m *Message, opts ...func(*frame.Frame) error) error {
+	f, err := c.createAckNackFrame(m, false, opts)
 	if err != nil {
 		return err
 	}
 
 	if f != nil {
-		return c.sendFrame(f)
+		return c.sendAckFrame(f, m)
 	}
 	return nil
 }
@@ -676,22 +2031,65 @@ func (c *Conn) Nack(m *Message) error {
 // Begin is used to start a transaction. Transactions apply to sending
 // and acknowledging. Any messages sent or acknowledged during a transaction
 // will be processed atomically by the STOMP server based on the transaction.
-func (c *Conn) Begin() *Transaction {
-	t, _ := c.BeginWithError()
+// The options are those of TransactionOpt.
+func (c *Conn) Begin(opts ...func(*frame.Frame) error) *Transaction {
+	t, _ := c.BeginWithError(opts...)
 	return t
 }
 
 // BeginWithError is used to start a transaction, but also returns the error
-// (if any) from sending the frame to start the transaction.
-func (c *Conn) BeginWithError() (*Transaction, error) {
+// (if any) from sending the frame to start the transaction. With
+// TransactionOpt.Receipt, it waits for the server to process the BEGIN
+// frame, and returns the error if the server responds with an ERROR frame.
+func (c *Conn) BeginWithError(opts ...func(*frame.Frame) error) (*Transaction, error) {
 	id := allocateId()
 	f := frame.New(frame.BEGIN, frame.Transaction, id)
-	err := c.sendFrame(f)
-	return &Transaction{id: id, conn: c}, err
+	epoch := atomic.LoadUint64(&c.epoch)
+	tx := &Transaction{id: id, conn: c, epoch: epoch}
+
+	timeout, err := c.transactionOptions(f, opts)
+	if err != nil {
+		return tx, err
+	}
+	request, err := c.enqueueFrame(context.Background(), f, timeout)
+	if err != nil || request.C == nil {
+		return tx, err
+	}
+	return tx, c.waitForReceipt(context.Background(), request, timeout)
+}
+
+// transactionOptions runs the options for a BEGIN, COMMIT or ABORT frame,
+// and returns how long to wait for its receipt.
+func (c *Conn) transactionOptions(f *frame.Frame, opts []func(*frame.Frame) error) (time.Duration, error) {
+	options := &transactionOptions{timeout: c.transactionTimeout}
+	err := withSettings(f, options, func() error {
+		for _, opt := range opts {
+			if opt == nil {
+				continue
+			}
+			if err := opt(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return options.timeout, err
+}
+
+// JoinTransaction returns a Transaction for a transaction that has already
+// been begun by other code, such as another component that shares the
+// connection, so that frames can be sent and acknowledged in it. No BEGIN
+// frame is sent. The transaction can be committed or aborted, which ends it
+// for all of its participants; its Joined method reports that it was joined.
+// The STOMP standard makes a transaction belong to the connection that
+// began it, so it can be joined across connections only if the server
+// supports that.
+func (c *Conn) JoinTransaction(id string) *Transaction {
+	return &Transaction{id: id, conn: c, epoch: atomic.LoadUint64(&c.epoch), joined: true}
 }
 
 // Create an ACK or NACK frame. Complicated by version incompatibilities.
-func (c *Conn) createAckNackFrame(msg *Message, ack bool) (*frame.Frame, error) {
+func (c *Conn) createAckNackFrame(msg *Message, ack bool, opts []func(*frame.Frame) error) (*frame.Frame, error) {
 	if !ack && !c.version.SupportsNack() {
 		return nil, ErrNackNotSupported
 	}
@@ -711,6 +2109,12 @@ func (c *Conn) createAckNackFrame(msg *Message, ack bool) (*frame.Frame, error)
 		}
 	}
 
+	if msg.epoch != atomic.LoadUint64(&c.epoch) {
+		// the server has forgotten about messages received
+		// before the connection was re-established
+		return nil, ErrStaleMessage
+	}
+
 	var f *frame.Frame
 	if ack {
 		f = frame.New(frame.ACK)
@@ -718,21 +2122,36 @@ func (c *Conn) createAckNackFrame(msg *Message, ack bool) (*frame.Frame, error)
 		f = frame.New(frame.NACK)
 	}
 
+	// STOMP 1.0 identifies the message by its message-id, STOMP 1.1 by its
+	// subscription and message-id, and STOMP 1.2 by the value of the ack
+	// header entry of the MESSAGE frame, which is not the same as its
+	// message-id for some servers.
 	switch c.version {
 	case V10, V11:
-		f.Header.Add(frame.Subscription, msg.Subscription.Id())
-		if messageId, ok := msg.Header.Contains(frame.MessageId); ok {
+		if c.version == V11 {
+			f.Header.Add(frame.Subscription, msg.Subscription.Id())
+		}
+		if messageId := msg.Header.Get(frame.MessageId); messageId != "" {
 			f.Header.Add(frame.MessageId, messageId)
 		} else {
 			return nil, ErrMissingMessageId
 		}
 	case V12:
-		if ack, ok := msg.Header.Contains(frame.Ack); ok {
+		if ack := msg.Header.Get(frame.Ack); ack != "" {
 			f.Header.Add(frame.Id, ack)
 		} else {
 			return nil, ErrMissingAck
 		}
 	}
 
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if err := opt(f); err != nil {
+			return nil, err
+		}
+	}
+
 	return f, nil
 }
@@ -1,7 +1,11 @@
 package stomp
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"net"
 	"strings"
 	"time"
 
@@ -17,12 +21,43 @@ type connOptions struct {
 	WriteTimeout                              time.Duration
 	HeartBeatError                            time.Duration
 	MsgSendTimeout                            time.Duration
+	UnsubscribeTimeout                        time.Duration
+	TransactionTimeout                        time.Duration
 	HeartBeatGracePeriodMultiplier            float64
+	HeartBeatSendFraction                     float64
+	OnPanic                                   func(recovered any, stack []byte)
+	Metrics                                   Metrics
+	TraceWriter                               io.Writer
+	TraceBodyLength                           int
+	tracer                                    *tracer
 	Login, Passcode                           string
 	AcceptVersions                            []string
 	Header                                    *frame.Header
 	ReadChannelCapacity, WriteChannelCapacity int
 	ReadBufferSize, WriteBufferSize           int
+	Reconnect                                 *ReconnectPolicy
+	Logger                                    Logger
+	OnHeartBeatError                          func(error)
+	ReplyDestinationPrefix                    string
+	SendInterceptors, ReceiveInterceptors     []func(*frame.Frame) error
+	AckBatchMax                               int
+	AckFlushInterval                          time.Duration
+	OnStateChange                             func(old, new ConnState)
+	TLSConfig                                 *tls.Config
+	WebsocketBinary                           bool
+	ConnectTimeout                            time.Duration
+	Dialer                                    func(ctx context.Context, network, addr string) (net.Conn, error)
+	Credentials                               func(ctx context.Context) (login, passcode string, err error)
+	MaxFrameSize                              int
+	MaxHeaders, MaxHeaderBytes                int
+	BodyPool                                  bool
+	ValidationLevel                           ValidationLevel
+	MaxDestinationLength                      int
+	OnUnknownFrame                            func(*frame.Frame)
+	AutoDecompress                            bool
+	MaxDecompressedSize                       int
+	DiscardFrames                             bool
+	PingDestination                           string
 }
 
 func newConnOptions(conn *Conn, opts []func(*Conn) error) (*connOptions, error) {
@@ -31,8 +66,14 @@ func newConnOptions(conn *Conn, opts []func(*Conn) error) (*connOptions, error)
 		ReadTimeout:                    time.Minute,
 		WriteTimeout:                   time.Minute,
 		HeartBeatGracePeriodMultiplier: 1.0,
+		HeartBeatSendFraction:          DefaultHeartBeatSendFraction,
 		HeartBeatError:                 DefaultHeartBeatError,
 		MsgSendTimeout:                 DefaultMsgSendTimeout,
+		UnsubscribeTimeout:             DefaultUnsubscribeTimeout,
+		TransactionTimeout:             DefaultTransactionTimeout,
+		ReplyDestinationPrefix:         DefaultReplyDestinationPrefix,
+		TraceBodyLength:                DefaultTraceBodyLength,
+		MaxDecompressedSize:            DefaultMaxDecompressedSize,
 	}
 
 	// This is a slight of hand, attach the options to the Conn long
@@ -59,7 +100,18 @@ func newConnOptions(conn *Conn, opts []func(*Conn) error) (*connOptions, error)
 	return co, nil
 }
 
-func (co *connOptions) NewFrame() (*frame.Frame, error) {
+// dialOptions returns the options in opts that are needed before the
+// network connection is created. Any errors in the options are reported
+// when the options are used to connect.
+func dialOptions(opts []func(*Conn) error) *connOptions {
+	options, err := newConnOptions(&Conn{}, opts)
+	if err != nil {
+		return &connOptions{}
+	}
+	return options
+}
+
+func (co *connOptions) NewFrame(ctx context.Context) (*frame.Frame, error) {
 	f := frame.New(co.FrameCommand)
 	if co.Host != "" {
 		f.Header.Set(frame.Host, co.Host)
@@ -73,9 +125,21 @@ func (co *connOptions) NewFrame() (*frame.Frame, error) {
 	}
 
 	// login, passcode
-	if co.Login != "" || co.Passcode != "" {
-		f.Header.Set(frame.Login, co.Login)
-		f.Header.Set(frame.Passcode, co.Passcode)
+	login, passcode := co.Login, co.Passcode
+	if co.Credentials != nil {
+		var err error
+		if perr := callSafely("credentials function", co.OnPanic, func() {
+			login, passcode, err = co.Credentials(ctx)
+		}); perr != nil {
+			err = perr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get credentials: %w", err)
+		}
+	}
+	if login != "" || passcode != "" {
+		f.Header.Set(frame.Login, login)
+		f.Header.Set(frame.Passcode, passcode)
 	}
 
 	// accept-version
@@ -97,6 +161,15 @@ var ConnOpt struct {
 	// server.
 	Login func(login, passcode string) func(*Conn) error
 
+	// CredentialsFunc is a connect option that specifies a function that
+	// returns the "login" and "passcode" values, instead of the fixed values
+	// specified with ConnOpt.Login. The function is called each time a CONNECT
+	// frame is sent, including when reconnecting, so it can return short-lived
+	// tokens. If it returns an error, the connection attempt fails with an error
+	// that wraps it. The context is that passed to ConnectWithContext or
+	// DialWithContext, if any.
+	CredentialsFunc func(f func(ctx context.Context) (login, passcode string, err error)) func(*Conn) error
+
 	// Host is a connect option that allows the calling program to
 	// specify the value of the "host" header.
 	Host func(host string) func(*Conn) error
@@ -138,11 +211,39 @@ var ConnOpt struct {
 	// Less than or equal to zero means infinite
 	MsgSendTimeout func(msgSendTimeout time.Duration) func(*Conn) error
 
-	// HeartBeatGracePeriodMultiplier is used to calculate the effective read heart-beat timeout
-	// the broker will enforce for each client’s connection. The multiplier is applied to
-	// the read-timeout interval the client specifies in its CONNECT frame
+	// UnsubscribeTimeout is a connect option that allows the client to specify
+	// how long Subscription.Unsubscribe waits for the subscription to close
+	// after sending the UNSUBSCRIBE frame. The timeout can be overridden for
+	// a single call using UnsubscribeOpt.Timeout.
+	// If not specified, this option defaults to 120 seconds.
+	// Less than or equal to zero means infinite
+	UnsubscribeTimeout func(unsubscribeTimeout time.Duration) func(*Conn) error
+
+	// TransactionTimeout is a connect option that allows the client to specify
+	// how long Transaction.Commit, Transaction.CommitWithContext and
+	// Transaction.AbortWithContext wait for the server to process the
+	// COMMIT or ABORT frame. If not specified, this option defaults to
+	// DefaultTransactionTimeout.
+	// Less than or equal to zero means infinite
+	TransactionTimeout func(transactionTimeout time.Duration) func(*Conn) error
+
+	// HeartBeatGracePeriodMultiplier is a connect option that allows the client to tolerate
+	// servers that send heart-beats late. The client considers the connection to have failed
+	// when no frame has been received for the negotiated read heart-beat interval multiplied
+	// by this value. The multiplier must be at least 1.0, which is the default.
 	HeartBeatGracePeriodMultiplier func(multiplier float64) func(*Conn) error
 
+	// HeartBeatSendFraction is a connect option that specifies when the client
+	// sends heart-beats to the server: a heart-beat is sent once nothing has been
+	// written for this fraction of the negotiated send interval, or for the
+	// interval less the time specified by ConnOpt.HeartBeatError, if that is
+	// shorter. Every frame written to the server restarts the wait, so that
+	// heart-beats are only sent when the connection is idle, and sending them
+	// early means that they are not late when a large frame delays the next
+	// one. The fraction must be greater than zero and at most 1.0. If not
+	// specified, this option defaults to 0.8.
+	HeartBeatSendFraction func(fraction float64) func(*Conn) error
+
 	// Header is a connect option that allows the client to specify a custom
 	// header entry in the STOMP frame. This connect option can be specified
 	// multiple times for multiple custom headers.
@@ -160,13 +261,224 @@ var ConnOpt struct {
 
 	// ReadBufferSize specifies number of bytes that can be used to read the message
 	// A high number may affect memory usage while a too low number may lock the
-	// system up. Default is set to 4096.
+	// system up. Default is set to 4096. The size must be at least
+	// frame.MinBufferSize. Conn.ReadBufferSize returns the size used.
 	ReadBufferSize func(size int) func(*Conn) error
 
 	// WriteBufferSize specifies number of bytes that can be used to write the message
 	// A high number may affect memory usage while a too low number may lock the
-	// system up. Default is set to 4096.
+	// system up. Default is set to 4096. The size must be at least
+	// frame.MinBufferSize. Conn.WriteBufferSize returns the size used.
 	WriteBufferSize func(size int) func(*Conn) error
+
+	// MaxFrameSize limits the size of the body of the frames received from
+	// the server to n bytes, so that a misbehaving server cannot make the
+	// client allocate an unbounded amount of memory. A frame with a larger
+	// body causes the connection to fail with an error that wraps
+	// ErrFrameTooLarge, in the same way as a network failure. Bodies streamed
+	// with SubscribeOpt.StreamBodiesOver are not limited. Zero, the default,
+	// means no limit.
+	MaxFrameSize func(n int) func(*Conn) error
+
+	// MaxHeaders limits the header of the frames received from the server to
+	// count header entries, and the command and header lines of a frame to a
+	// total of bytes bytes. A frame that exceeds either limit causes the
+	// connection to fail in the same way as with ConnOpt.MaxFrameSize. Zero,
+	// the default, means no limit.
+	MaxHeaders func(count, bytes int) func(*Conn) error
+
+	// Reconnect is a connect option that re-establishes the connection
+	// to the STOMP server if it fails, according to the policy. Active
+	// subscriptions are re-created on the new connection. When used with
+	// Connect, the policy must specify the Dial function; DialWithReconnect
+	// can be used instead of Dial to reconnect to the same address.
+	Reconnect func(policy ReconnectPolicy) func(*Conn) error
+
+	// Logger is a connect option that specifies the logger for diagnostic
+	// messages from the connection and its subscriptions. If not specified,
+	// the logger set with SetDefaultLogger is used.
+	Logger func(l Logger) func(*Conn) error
+
+	// OnHeartBeatError is a connect option that specifies a function to call
+	// when no frame has been received from the server before the heart-beat
+	// read deadline. The error describes the time elapsed, and wraps
+	// ErrReadTimeout. The function is called before the connection is closed
+	// or re-established, on the goroutine that processes the connection, so it
+	// must return promptly and must not send frames on the connection.
+	OnHeartBeatError func(f func(err error)) func(*Conn) error
+
+	// ReplyDestinationPrefix is a connect option that specifies the prefix
+	// of the destination that Conn.Request receives replies on. Brokers use
+	// different conventions for temporary destinations, so the prefix should
+	// suit the broker. If not specified, this option defaults to "/temp-queue/".
+	ReplyDestinationPrefix func(prefix string) func(*Conn) error
+
+	// SendInterceptor is a connect option that specifies a function that is
+	// called with every frame before it is sent to the server, starting with
+	// the CONNECT frame. The function can inspect or modify the frame. If it
+	// returns an error the frame is not sent, and the operation that would
+	// have sent it returns the error. Heart-beats are not intercepted. This
+	// connect option can be specified multiple times, and the interceptors
+	// are called in the order specified.
+	SendInterceptor func(interceptor func(*frame.Frame) error) func(*Conn) error
+
+	// ReceiveInterceptor is a connect option that specifies a function that
+	// is called with every frame received from the server, starting with the
+	// response to the CONNECT frame, before the frame is processed. If it
+	// returns an error while connecting the connect fails, otherwise the error
+	// is reported on the Conn.Errors channel and the frame is discarded.
+	// Heart-beats are not intercepted. The function is called on the goroutine
+	// that processes the connection, so it must return promptly and must not
+	// send frames on the connection. This connect option can be specified
+	// multiple times, and the interceptors are called in the order specified.
+	ReceiveInterceptor func(interceptor func(*frame.Frame) error) func(*Conn) error
+
+	// AckBatching is a connect option that reduces the number of network writes
+	// for subscriptions with ack:client-individual. The ACK frames sent by
+	// Conn.Ack are written without flushing until max frames have accumulated,
+	// flushInterval has elapsed since the first of them, or another frame is
+	// sent, so the order of the frames sent on the connection is unchanged.
+	// Disconnect flushes the acks before the DISCONNECT frame, and
+	// Conn.FlushAcks flushes them at any time. A zero flushInterval means
+	// that acks are not flushed periodically.
+	AckBatching func(max int, flushInterval time.Duration) func(*Conn) error
+
+	// OnStateChange is a connect option that specifies a function to call
+	// whenever the state of the connection changes, starting with the change
+	// from Connecting to Connected. The calls are made in order, and the
+	// function must return promptly. It must not disconnect, because it may
+	// be called while the connection is disconnecting.
+	OnStateChange func(f func(old, new ConnState)) func(*Conn) error
+
+	// OnPanic is a connect option that specifies a function to call when
+	// the client recovers from a panic in a function of the program that the
+	// client calls on one of its own goroutines, such as a handler, a receive
+	// interceptor, or the functions specified with SubscribeOpt.OnError,
+	// ConnOpt.OnStateChange, ConnOpt.OnHeartBeatError and
+	// ConnOpt.CredentialsFunc. The function is called with the value passed
+	// to panic, and the stack trace of the goroutine that panicked. Whether or
+	// not this option is specified, such panics do not crash the program: an
+	// error that wraps ErrPanic is sent on the Errors channel instead, and the
+	// call is treated as having failed. A panic in a subscription closes the
+	// subscription, and C is closed after an error message.
+	OnPanic func(f func(recovered any, stack []byte)) func(*Conn) error
+
+	// Metrics is a connect option that specifies a Metrics to receive
+	// statistics about the connection and its subscriptions. Without this
+	// option no statistics are collected.
+	Metrics func(m Metrics) func(*Conn) error
+
+	// TraceWriter is a connect option that specifies a writer to which
+	// every frame sent and received is written, for debugging. Each line is
+	// prefixed with a timestamp and ">>>" for a frame sent or "<<<" for a
+	// frame received, heart-beats are written as "(heart-beat)", and the
+	// passcode of the CONNECT frame is hidden. The frames are written by a
+	// goroutine of their own, one frame per call to Write, so a slow writer
+	// does not block the connection: if too many frames are waiting to be
+	// written, the latest are dropped and counted by Conn.TraceDropped.
+	TraceWriter func(w io.Writer) func(*Conn) error
+
+	// TraceBodyLength is a connect option that specifies how many bytes of
+	// the body of each frame are written by ConnOpt.TraceWriter. The default
+	// is DefaultTraceBodyLength. A negative length means that bodies are
+	// written in full.
+	TraceBodyLength func(n int) func(*Conn) error
+
+	// TLSConfig is a connect option that specifies that Dial and DialWithReconnect
+	// secure the network connection with TLS, using the configuration specified.
+	// The configuration can include client certificates. If it does not specify
+	// the ServerName, the host name in the address is used, both for SNI and to
+	// verify the server's certificate. The option has no effect with Connect,
+	// which uses a network connection that has already been established.
+	TLSConfig func(config *tls.Config) func(*Conn) error
+
+	// WebsocketBinary is a connect option that specifies that ConnectWebsocket
+	// sends STOMP frames in WebSocket binary messages instead of text messages.
+	// Binary messages are needed if message bodies are not valid UTF-8.
+	WebsocketBinary func(*Conn) error
+
+	// ConnectTimeout is a connect option that limits the time that Dial, DialTLS,
+	// DialWithReconnect and DialFailover take to create each network connection,
+	// including the TLS handshake. It does not include the STOMP connect protocol
+	// sequence. Zero, which is the default, means no limit. DialFailover also
+	// accepts the timeout as a URI parameter, which this option overrides.
+	ConnectTimeout func(timeout time.Duration) func(*Conn) error
+
+	// Dialer is a connect option that specifies the function that Dial, DialTLS,
+	// DialWithReconnect and DialFailover use to create network connections,
+	// instead of net.Dialer. The DialContext method of net.Dialer, and of the
+	// dialers in golang.org/x/net/proxy, can be used, for example to connect
+	// through a SOCKS proxy. The context is done when the timeout specified with
+	// ConnOpt.ConnectTimeout has elapsed. TLS, if specified, is applied to the
+	// connections that the dialer returns.
+	Dialer func(d func(ctx context.Context, network, addr string) (net.Conn, error)) func(*Conn) error
+
+	// BodyPool is a connect option that takes the buffers for the bodies of
+	// the messages received from a pool, as described for frame.BodyPool,
+	// instead of allocating a new buffer for each body. Call
+	// Message.Release once the program has finished with the body of a
+	// message, so that the buffer can be reused; a message that is not
+	// released is collected as usual. Use Message.Copy to keep a message
+	// after it is released.
+	BodyPool func(*Conn) error
+
+	// ValidateFrames is a connect option that checks the frames sent by
+	// Send, by Transaction.Send and by the other operations on the connection,
+	// after the send interceptors have been called, and before the frames are
+	// written. A frame that fails the checks of the level specified is not
+	// sent, and the operation returns an error that wraps ErrInvalidFrame and
+	// describes the problem. The default is ValidationNone.
+	ValidateFrames func(level ValidationLevel) func(*Conn) error
+
+	// MaxDestinationLength limits the destinations of the messages sent by
+	// Send and Transaction.Send to n bytes. A longer destination is not sent,
+	// and ErrDestinationTooLong is returned, because servers that limit the
+	// length of destinations close the connection instead. Zero, the default,
+	// means no limit.
+	MaxDestinationLength func(n int) func(*Conn) error
+
+	// OnUnknownFrame is a connect option that accepts frames from the server
+	// whose commands are not STOMP commands, such as the extensions of some
+	// servers, and calls f with each of them, after the receive interceptors.
+	// f is also called with the frames of other commands that the client does
+	// not expect from the server. Without this option a frame with a command
+	// that is not a STOMP command causes the connection to fail. f is called
+	// on the goroutine that processes the frames received, so it must return
+	// promptly, and must not wait for an operation on the connection, such as
+	// Conn.SendFrame; do that from another goroutine.
+	OnUnknownFrame func(f func(*frame.Frame)) func(*Conn) error
+
+	// AutoDecompress is a connect option that specifies whether the bodies
+	// of the messages received are decompressed before they are delivered,
+	// if their "content-encoding" header entry names a codec that is known,
+	// such as CodecGzip or one registered with RegisterCodec. The header of
+	// a decompressed message is the one received. A message whose body
+	// cannot be decompressed, or is larger than ConnOpt.MaxDecompressedSize
+	// once decompressed, is delivered with its Err field set to an error
+	// that wraps ErrDecompress and with its body as received; it can still
+	// be acknowledged, and the subscription stays open. Streamed bodies are
+	// not decompressed. The default is false.
+	AutoDecompress func(enabled bool) func(*Conn) error
+
+	// MaxDecompressedSize limits the bodies decompressed by
+	// ConnOpt.AutoDecompress to n bytes, so that a small compressed body
+	// cannot make the client allocate an unbounded amount of memory. The
+	// default is DefaultMaxDecompressedSize.
+	MaxDecompressedSize func(n int) func(*Conn) error
+
+	// DiscardFrames is a connect option that stops the messages received
+	// from keeping the frames that they were received in, for programs
+	// that keep many messages and do not call Message.Frame, which returns
+	// nil for them. It has no effect with ConnOpt.BodyPool, because
+	// Message.Release needs the frame to return its body to the pool.
+	DiscardFrames func(*Conn) error
+
+	// PingDestination is a connect option that makes Conn.Ping send an empty
+	// message to the destination specified, with a receipt, instead of
+	// beginning and aborting a transaction, for servers that do not support
+	// transactions. The destination should be one whose messages the server
+	// discards.
+	PingDestination func(destination string) func(*Conn) error
 }
 
 func init() {
@@ -224,8 +536,25 @@ func init() {
 		}
 	}
 
+	ConnOpt.UnsubscribeTimeout = func(unsubscribeTimeout time.Duration) func(*Conn) error {
+		return func(c *Conn) error {
+			c.options.UnsubscribeTimeout = unsubscribeTimeout
+			return nil
+		}
+	}
+
+	ConnOpt.TransactionTimeout = func(transactionTimeout time.Duration) func(*Conn) error {
+		return func(c *Conn) error {
+			c.options.TransactionTimeout = transactionTimeout
+			return nil
+		}
+	}
+
 	ConnOpt.HeartBeatGracePeriodMultiplier = func(multiplier float64) func(*Conn) error {
 		return func(c *Conn) error {
+			if !(multiplier >= 1.0) {
+				return ErrInvalidOptionValue
+			}
 			c.options.HeartBeatGracePeriodMultiplier = multiplier
 			return nil
 		}
@@ -258,6 +587,9 @@ func init() {
 
 	ConnOpt.ReadBufferSize = func(size int) func(*Conn) error {
 		return func(c *Conn) error {
+			if size < frame.MinBufferSize {
+				return ErrInvalidOptionValue
+			}
 			c.options.ReadBufferSize = size
 			return nil
 		}
@@ -265,8 +597,252 @@ func init() {
 
 	ConnOpt.WriteBufferSize = func(size int) func(*Conn) error {
 		return func(c *Conn) error {
+			if size < frame.MinBufferSize {
+				return ErrInvalidOptionValue
+			}
 			c.options.WriteBufferSize = size
 			return nil
 		}
 	}
+
+	ConnOpt.Reconnect = func(policy ReconnectPolicy) func(*Conn) error {
+		return func(c *Conn) error {
+			if err := policy.validate(); err != nil {
+				return err
+			}
+			c.options.Reconnect = policy.withDefaults()
+			return nil
+		}
+	}
+
+	ConnOpt.Logger = func(l Logger) func(*Conn) error {
+		return func(c *Conn) error {
+			if l == nil {
+				return ErrNilOption
+			}
+			c.options.Logger = l
+			return nil
+		}
+	}
+
+	ConnOpt.OnHeartBeatError = func(f func(err error)) func(*Conn) error {
+		return func(c *Conn) error {
+			if f == nil {
+				return ErrNilOption
+			}
+			c.options.OnHeartBeatError = f
+			return nil
+		}
+	}
+
+	ConnOpt.ReplyDestinationPrefix = func(prefix string) func(*Conn) error {
+		return func(c *Conn) error {
+			if prefix == "" {
+				return ErrInvalidOptionValue
+			}
+			c.options.ReplyDestinationPrefix = prefix
+			return nil
+		}
+	}
+
+	ConnOpt.SendInterceptor = func(interceptor func(*frame.Frame) error) func(*Conn) error {
+		return func(c *Conn) error {
+			if interceptor == nil {
+				return ErrNilOption
+			}
+			c.options.SendInterceptors = append(c.options.SendInterceptors, interceptor)
+			return nil
+		}
+	}
+
+	ConnOpt.ReceiveInterceptor = func(interceptor func(*frame.Frame) error) func(*Conn) error {
+		return func(c *Conn) error {
+			if interceptor == nil {
+				return ErrNilOption
+			}
+			c.options.ReceiveInterceptors = append(c.options.ReceiveInterceptors, interceptor)
+			return nil
+		}
+	}
+	ConnOpt.AckBatching = func(max int, flushInterval time.Duration) func(*Conn) error {
+		return func(c *Conn) error {
+			if max < 1 || flushInterval < 0 {
+				return ErrInvalidOptionValue
+			}
+			c.options.AckBatchMax = max
+			c.options.AckFlushInterval = flushInterval
+			return nil
+		}
+	}
+	ConnOpt.OnStateChange = func(f func(old, new ConnState)) func(*Conn) error {
+		return func(c *Conn) error {
+			if f == nil {
+				return ErrNilOption
+			}
+			c.options.OnStateChange = f
+			return nil
+		}
+	}
+	ConnOpt.TLSConfig = func(config *tls.Config) func(*Conn) error {
+		return func(c *Conn) error {
+			if config == nil {
+				return ErrNilOption
+			}
+			c.options.TLSConfig = config
+			return nil
+		}
+	}
+	ConnOpt.WebsocketBinary = func(c *Conn) error {
+		c.options.WebsocketBinary = true
+		return nil
+	}
+	ConnOpt.ConnectTimeout = func(timeout time.Duration) func(*Conn) error {
+		return func(c *Conn) error {
+			if timeout < 0 {
+				return ErrInvalidOptionValue
+			}
+			c.options.ConnectTimeout = timeout
+			return nil
+		}
+	}
+	ConnOpt.Dialer = func(d func(ctx context.Context, network, addr string) (net.Conn, error)) func(*Conn) error {
+		return func(c *Conn) error {
+			if d == nil {
+				return ErrNilOption
+			}
+			c.options.Dialer = d
+			return nil
+		}
+	}
+	ConnOpt.CredentialsFunc = func(f func(ctx context.Context) (login, passcode string, err error)) func(*Conn) error {
+		return func(c *Conn) error {
+			if f == nil {
+				return ErrNilOption
+			}
+			c.options.Credentials = f
+			return nil
+		}
+	}
+	ConnOpt.MaxFrameSize = func(n int) func(*Conn) error {
+		return func(c *Conn) error {
+			if n < 0 {
+				return ErrInvalidOptionValue
+			}
+			c.options.MaxFrameSize = n
+			return nil
+		}
+	}
+	ConnOpt.MaxHeaders = func(count, bytes int) func(*Conn) error {
+		return func(c *Conn) error {
+			if count < 0 || bytes < 0 {
+				return ErrInvalidOptionValue
+			}
+			c.options.MaxHeaders = count
+			c.options.MaxHeaderBytes = bytes
+			return nil
+		}
+	}
+	ConnOpt.HeartBeatSendFraction = func(fraction float64) func(*Conn) error {
+		return func(c *Conn) error {
+			if !(fraction > 0 && fraction <= 1.0) {
+				return ErrInvalidOptionValue
+			}
+			c.options.HeartBeatSendFraction = fraction
+			return nil
+		}
+	}
+	ConnOpt.OnPanic = func(f func(recovered any, stack []byte)) func(*Conn) error {
+		return func(c *Conn) error {
+			if f == nil {
+				return ErrNilOption
+			}
+			c.options.OnPanic = f
+			return nil
+		}
+	}
+	ConnOpt.Metrics = func(m Metrics) func(*Conn) error {
+		return func(c *Conn) error {
+			if m == nil {
+				return ErrNilOption
+			}
+			c.options.Metrics = m
+			return nil
+		}
+	}
+	ConnOpt.TraceWriter = func(w io.Writer) func(*Conn) error {
+		return func(c *Conn) error {
+			if w == nil {
+				return ErrNilOption
+			}
+			c.options.TraceWriter = w
+			return nil
+		}
+	}
+	ConnOpt.TraceBodyLength = func(n int) func(*Conn) error {
+		return func(c *Conn) error {
+			c.options.TraceBodyLength = n
+			return nil
+		}
+	}
+	ConnOpt.BodyPool = func(c *Conn) error {
+		c.options.BodyPool = true
+		return nil
+	}
+	ConnOpt.ValidateFrames = func(level ValidationLevel) func(*Conn) error {
+		return func(c *Conn) error {
+			switch level {
+			case ValidationNone, ValidationBasic, ValidationStrict:
+			default:
+				return ErrInvalidOptionValue
+			}
+			c.options.ValidationLevel = level
+			return nil
+		}
+	}
+	ConnOpt.MaxDestinationLength = func(n int) func(*Conn) error {
+		return func(c *Conn) error {
+			if n < 0 {
+				return ErrInvalidOptionValue
+			}
+			c.options.MaxDestinationLength = n
+			return nil
+		}
+	}
+	ConnOpt.OnUnknownFrame = func(f func(*frame.Frame)) func(*Conn) error {
+		return func(c *Conn) error {
+			if f == nil {
+				return ErrNilOption
+			}
+			c.options.OnUnknownFrame = f
+			return nil
+		}
+	}
+	ConnOpt.AutoDecompress = func(enabled bool) func(*Conn) error {
+		return func(c *Conn) error {
+			c.options.AutoDecompress = enabled
+			return nil
+		}
+	}
+	ConnOpt.MaxDecompressedSize = func(n int) func(*Conn) error {
+		return func(c *Conn) error {
+			if n <= 0 {
+				return ErrInvalidOptionValue
+			}
+			c.options.MaxDecompressedSize = n
+			return nil
+		}
+	}
+	ConnOpt.DiscardFrames = func(c *Conn) error {
+		c.options.DiscardFrames = true
+		return nil
+	}
+	ConnOpt.PingDestination = func(destination string) func(*Conn) error {
+		return func(c *Conn) error {
+			if destination == "" {
+				return ErrInvalidOptionValue
+			}
+			c.options.PingDestination = destination
+			return nil
+		}
+	}
 }
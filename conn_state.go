@@ -0,0 +1,77 @@
+package stomp
+
+import (
+	"sync/atomic"
+)
+
+// The ConnState type is an enumeration of the states of a Conn.
+type ConnState int32
+
+const (
+	// The connect protocol sequence is in progress, either when the
+	// Conn is created or when it is re-establishing a failed connection.
+	Connecting ConnState = iota
+
+	// The connection to the STOMP server is ready for use.
+	Connected
+
+	// The program has called Disconnect, and the Conn is waiting for
+	// the server to acknowledge the DISCONNECT frame.
+	Disconnecting
+
+	// The connection is closed and cannot be used again.
+	Closed
+)
+
+// String returns the string representation of the ConnState value.
+func (s ConnState) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Disconnecting:
+		return "disconnecting"
+	case Closed:
+		return "closed"
+	}
+	panic("invalid ConnState value")
+}
+
+// State returns the current state of the connection.
+func (c *Conn) State() ConnState {
+	return ConnState(atomic.LoadInt32(&c.state))
+}
+
+// setState changes the state of the connection, and calls the function
+// specified with ConnOpt.OnStateChange. A closed connection stays closed,
+// and a connection that is disconnecting is not re-established. The
+// function is called without holding stateMutex, so that it can
+// disconnect.
+func (c *Conn) setState(state ConnState) {
+	c.stateMutex.Lock()
+	old := c.State()
+	if old == state || old == Closed || (old == Disconnecting && state != Closed) {
+		c.stateMutex.Unlock()
+		return
+	}
+	atomic.StoreInt32(&c.state, int32(state))
+	fn := c.onStateChange
+	c.stateMutex.Unlock()
+
+	if fn != nil {
+		c.safely("state change function", func() {
+			fn(old, state)
+		})
+	}
+}
+
+// checkConnected returns ErrConnectionClosed if the program has
+// disconnected, so that frames are not written to a connection that
+// is closing. Frames can still be written while reconnecting.
+func (c *Conn) checkConnected() error {
+	if state := c.State(); state == Disconnecting || state == Closed {
+		return ErrConnectionClosed
+	}
+	return nil
+}
@@ -1,8 +1,13 @@
 package stomp
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-stomp/stomp/frame"
@@ -118,9 +123,9 @@ func (s *StompSuite) Test_successful_connect_and_disconnect(c *C) {
 			c.Assert(err, IsNil)
 			c.Assert(f2.Command, Equals, "DISCONNECT")
 			receipt, _ := f2.Header.Contains("receipt")
-			c.Check(receipt, Equals, "1")
+			c.Check(receipt, Equals, "rcpt-1")
 
-			writer.Write(frame.New("RECEIPT", frame.ReceiptId, "1"))
+			writer.Write(frame.New("RECEIPT", frame.ReceiptId, "rcpt-1"))
 		}()
 
 		client, err := Connect(fc1, tc.Options...)
@@ -162,15 +167,16 @@ func (s *StompSuite) Test_successful_connect_with_nonstandard_header(c *C) {
 		connectedFrame.Header.Add("heart-beat", "0,0")
 		connectedFrame.Header.Add("server", "RabbitMQ/3.2.1")
 		connectedFrame.Header.Add("version", "1.0")
+		connectedFrame.Header.Add("x-broker-node", "rabbit@node-1")
 		writer.Write(connectedFrame)
 
 		f2, err := reader.Read()
 		c.Assert(err, IsNil)
 		c.Assert(f2.Command, Equals, "DISCONNECT")
 		receipt, _ := f2.Header.Contains("receipt")
-		c.Check(receipt, Equals, "1")
+		c.Check(receipt, Equals, "rcpt-1")
 
-		writer.Write(frame.New("RECEIPT", frame.ReceiptId, "1"))
+		writer.Write(frame.New("RECEIPT", frame.ReceiptId, "rcpt-1"))
 	}()
 
 	client, err := Connect(fc1,
@@ -183,6 +189,12 @@ func (s *StompSuite) Test_successful_connect_with_nonstandard_header(c *C) {
 	c.Assert(client.Session(), Equals, "session-0voRHrG-VbBedx1Gwwb62Q")
 	c.Assert(client.Server(), Equals, "RabbitMQ/3.2.1")
 
+	header := client.ConnectedHeaders()
+	c.Check(header.Get("x-broker-node"), Equals, "rabbit@node-1")
+	c.Check(header.Get("heart-beat"), Equals, "0,0")
+	header.Set("x-broker-node", "changed")
+	c.Check(client.ConnectedHeaders().Get("x-broker-node"), Equals, "rabbit@node-1")
+
 	err = client.Disconnect()
 	c.Assert(err, IsNil)
 
@@ -213,7 +225,7 @@ func (s *StompSuite) Test_connect_not_panic_on_empty_response(c *C) {
 }
 
 // Sets up a connection for testing
-func connectHelper(c *C, version Version) (*Conn, *fakeReaderWriter) {
+func connectHelper(c *C, version Version, opts ...func(*Conn) error) (*Conn, *fakeReaderWriter) {
 	fc1, fc2 := testutil.NewFakeConn(c)
 	stop := make(chan struct{})
 
@@ -229,7 +241,7 @@ func connectHelper(c *C, version Version) (*Conn, *fakeReaderWriter) {
 		close(stop)
 	}()
 
-	conn, err := Connect(fc1)
+	conn, err := Connect(fc1, opts...)
 	c.Assert(err, IsNil)
 	c.Assert(conn, NotNil)
 	<-stop
@@ -292,12 +304,7 @@ func subscribeHelper(c *C, ackMode AckMode, version Version, opts ...func(*frame
 			if ackMode.ShouldAck() {
 				f5, _ := rw.Read()
 				c.Assert(f5.Command, Equals, "ACK")
-				if version == V12 {
-					c.Assert(f5.Header.Get("id"), Equals, messageId)
-				} else {
-					c.Assert(f5.Header.Get("subscription"), Equals, id)
-					c.Assert(f5.Header.Get("message-id"), Equals, messageId)
-				}
+				checkAckHeader(c, f5, version, id, messageId)
 			}
 		}
 
@@ -342,6 +349,26 @@ func subscribeHelper(c *C, ackMode AckMode, version Version, opts ...func(*frame
 	conn.Disconnect()
 }
 
+// checkAckHeader checks that an ACK or NACK frame identifies the message
+// in the way required by the protocol version. For STOMP 1.2, messageId
+// is the value of the ack header entry of the message.
+func checkAckHeader(c *C, f *frame.Frame, version Version, subscription, messageId string) {
+	switch version {
+	case V10:
+		c.Check(f.Header.Get(frame.MessageId), Equals, messageId)
+		c.Check(f.Header.Get(frame.Subscription), Equals, "")
+		c.Check(f.Header.Get(frame.Id), Equals, "")
+	case V11:
+		c.Check(f.Header.Get(frame.Subscription), Equals, subscription)
+		c.Check(f.Header.Get(frame.MessageId), Equals, messageId)
+		c.Check(f.Header.Get(frame.Id), Equals, "")
+	case V12:
+		c.Check(f.Header.Get(frame.Id), Equals, messageId)
+		c.Check(f.Header.Get(frame.Subscription), Equals, "")
+		c.Check(f.Header.Get(frame.MessageId), Equals, "")
+	}
+}
+
 func (s *StompSuite) TestTransaction(c *C) {
 
 	ackModes := []AckMode{AckAuto, AckClient, AckClientIndividual}
@@ -408,12 +435,7 @@ func subscribeTransactionHelper(c *C, ackMode AckMode, version Version, abort bo
 				} else {
 					c.Assert(f5.Command, Equals, "ACK")
 				}
-				if version == V12 {
-					c.Assert(f5.Header.Get("id"), Equals, messageId)
-				} else {
-					c.Assert(f5.Header.Get("subscription"), Equals, id)
-					c.Assert(f5.Header.Get("message-id"), Equals, messageId)
-				}
+				checkAckHeader(c, f5, version, id, messageId)
 				c.Assert(f5.Header.Get("transaction"), Equals, tx)
 			}
 
@@ -428,6 +450,8 @@ func subscribeTransactionHelper(c *C, ackMode AckMode, version Version, abort bo
 				c.Assert(commitFrame.Command, Equals, "ABORT")
 			} else {
 				c.Assert(commitFrame.Command, Equals, "COMMIT")
+				rw.Write(frame.New(frame.RECEIPT,
+					frame.ReceiptId, commitFrame.Header.Get(frame.Receipt)))
 			}
 			c.Assert(commitFrame.Header.Get("transaction"), Equals, tx)
 		}
@@ -471,9 +495,9 @@ func subscribeTransactionHelper(c *C, ackMode AckMode, version Version, abort bo
 		err = tx.Send("/queue/another-queue", "text/plain", []byte(bodyText))
 		c.Assert(err, IsNil)
 		if abort {
-			tx.Abort()
+			c.Assert(tx.Abort(), IsNil)
 		} else {
-			tx.Commit()
+			c.Assert(tx.Commit(), IsNil)
 		}
 	}
 
@@ -532,10 +556,74 @@ func (s *StompSuite) TestHeartBeatWriteTimeout(c *C) {
 	conn.Disconnect()
 }
 
+// slowConn is a connection that takes a while to write.
+type slowConn struct {
+	*testutil.FakeConn
+	delay time.Duration
+}
+
+func (sc slowConn) Write(p []byte) (int, error) {
+	time.Sleep(sc.delay)
+	return sc.FakeConn.Write(p)
+}
+
+func (s *StompSuite) TestHeartBeatSendFraction(c *C) {
+	fc1, fc2 := testutil.NewFakeConn(c)
+	reader := frame.NewReader(fc2)
+	writer := frame.NewWriter(fc2)
+	arrivals := make(chan time.Time, 100)
+
+	go func() {
+		f1, err := reader.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "CONNECT")
+		writer.Write(frame.New("CONNECTED", "version", "1.2", "heart-beat", "0,200"))
+		for {
+			if _, err := reader.Read(); err != nil {
+				close(arrivals)
+				return
+			}
+			arrivals <- time.Now()
+		}
+	}()
+
+	_, err := Connect(fc1, ConnOpt.HeartBeatSendFraction(0))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+	_, err = Connect(fc1, ConnOpt.HeartBeatSendFraction(1.5))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+
+	// each write takes a quarter of the interval, so heart-beats sent
+	// at the interval would arrive late
+	conn, err := Connect(slowConn{FakeConn: fc1, delay: 50 * time.Millisecond},
+		ConnOpt.HeartBeat(200*time.Millisecond, 0),
+		ConnOpt.HeartBeatError(time.Millisecond))
+	c.Assert(err, IsNil)
+	start := time.Now()
+
+	// frames are written for a while, and then the connection is idle
+	for i := 0; i < 5; i++ {
+		c.Assert(conn.Send("/queue/test-1", "text/plain", nil), IsNil)
+		time.Sleep(100 * time.Millisecond)
+	}
+	time.Sleep(600 * time.Millisecond)
+	fc1.Close()
+
+	last := start
+	count := 0
+	for t := range arrivals {
+		c.Check(t.Sub(last) < 200*time.Millisecond, Equals, true, Commentf("gap %v", t.Sub(last)))
+		last = t
+		count++
+	}
+	// at least the sends, and the heart-beats while idle
+	c.Check(count >= 8, Equals, true, Commentf("%d frames", count))
+}
+
 func createHeartBeatConnection(
 	c *C,
 	readTimeout, writeTimeout int,
-	readTimeoutError time.Duration) (*Conn, *fakeReaderWriter) {
+	readTimeoutError time.Duration,
+	opts ...func(*Conn) error) (*Conn, *fakeReaderWriter) {
 	fc1, fc2 := testutil.NewFakeConn(c)
 	stop := make(chan struct{})
 
@@ -553,9 +641,11 @@ func createHeartBeatConnection(
 		close(stop)
 	}()
 
-	conn, err := Connect(fc1,
+	opts = append([]func(*Conn) error{
 		ConnOpt.HeartBeat(time.Millisecond, time.Millisecond),
-		ConnOpt.HeartBeatError(readTimeoutError))
+		ConnOpt.HeartBeatError(readTimeoutError),
+	}, opts...)
+	conn, err := Connect(fc1, opts...)
 	c.Assert(conn, NotNil)
 	c.Assert(err, IsNil)
 	<-stop
@@ -565,3 +655,1244 @@ func createHeartBeatConnection(
 		conn:   fc2,
 	}
 }
+
+func (s *StompSuite) Test_send_with_context_cancelled_waiting_for_receipt(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+	received := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SEND")
+		c.Assert(f1.Header.Get(frame.Receipt), Not(Equals), "")
+		close(received)
+
+		// never send the RECEIPT, wait for the DISCONNECT instead
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+
+	err := conn.SendWithContext(ctx, "/queue/test-1", "text/plain",
+		[]byte("hello"), SendOpt.Receipt)
+	c.Assert(err, NotNil)
+	c.Assert(errors.Is(err, context.Canceled), Equals, true)
+	_, isStompError := err.(Error)
+	c.Assert(isStompError, Equals, true)
+
+	err = conn.Disconnect()
+	c.Assert(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_send_with_context_already_cancelled(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		// the first frame received should be the second send,
+		// the cancelled send must not reach the server
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SEND")
+		c.Assert(string(f1.Body), Equals, "second")
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := conn.SendWithContext(ctx, "/queue/test-1", "text/plain", []byte("first"))
+	c.Assert(errors.Is(err, context.Canceled), Equals, true)
+
+	err = conn.Send("/queue/test-1", "text/plain", []byte("second"))
+	c.Assert(err, IsNil)
+
+	err = conn.Disconnect()
+	c.Assert(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_errors_heart_beat_timeout(c *C) {
+	conn, _ := createHeartBeatConnection(c, 100, 10000, time.Millisecond)
+
+	err, ok := <-conn.Errors()
+	c.Assert(ok, Equals, true)
+	c.Check(err, Equals, ErrReadTimeout)
+
+	_, ok = <-conn.Errors()
+	c.Check(ok, Equals, false)
+}
+
+func (s *StompSuite) Test_heart_beat_negotiated(c *C) {
+	conn, rw := createHeartBeatConnection(c, 100, 10000, time.Millisecond)
+	defer rw.Close()
+
+	send, recv := conn.HeartBeat()
+	c.Check(send, Equals, 10*time.Second)
+	c.Check(recv, Equals, 100*time.Millisecond)
+}
+
+func (s *StompSuite) Test_heart_beat_error_callback(c *C) {
+	errs := make(chan error, 1)
+	conn, rw := createHeartBeatConnection(c, 100, 10000, time.Millisecond,
+		ConnOpt.OnHeartBeatError(func(err error) {
+			errs <- err
+		}))
+	defer rw.Close()
+
+	err := <-errs
+	c.Check(errors.Is(err, ErrReadTimeout), Equals, true)
+	c.Check(err, ErrorMatches, "read timeout: no frame received for .*, deadline 101ms")
+
+	// the callback is called before the connection is closed
+	err = <-conn.Errors()
+	c.Check(err, Equals, ErrReadTimeout)
+}
+
+func (s *StompSuite) Test_heart_beat_grace_period(c *C) {
+	errs := make(chan error, 1)
+	_, rw := createHeartBeatConnection(c, 100, 10000, time.Millisecond,
+		ConnOpt.HeartBeatGracePeriodMultiplier(2.0),
+		ConnOpt.OnHeartBeatError(func(err error) {
+			errs <- err
+		}))
+	defer rw.Close()
+
+	err := <-errs
+	c.Check(err, ErrorMatches, "read timeout: no frame received for .*, deadline 202ms")
+}
+
+func (s *StompSuite) Test_heart_beat_grace_period_invalid(c *C) {
+	fc1, fc2 := testutil.NewFakeConn(c)
+	defer fc2.Close()
+
+	for _, multiplier := range []float64{0, 0.5, -1, math.NaN()} {
+		conn, err := Connect(fc1, ConnOpt.HeartBeatGracePeriodMultiplier(multiplier))
+		c.Check(conn, IsNil)
+		c.Check(err, Equals, ErrInvalidOptionValue)
+	}
+}
+
+func (s *StompSuite) Test_errors_error_frame(c *C) {
+	conn, rw := connectHelper(c, V12)
+
+	go func() {
+		rw.Write(frame.New(frame.ERROR, frame.Message, "server is shutting down"))
+	}()
+
+	var errs []error
+	for err := range conn.Errors() {
+		errs = append(errs, err)
+	}
+	c.Assert(errs, HasLen, 1)
+	c.Check(errs[0], ErrorMatches, "server is shutting down")
+	rw.Close()
+}
+
+func (s *StompSuite) Test_errors_invalid_frame(c *C) {
+	conn, rw := connectHelper(c, V12)
+
+	go func() {
+		rw.conn.Write([]byte("message\n\n\x00"))
+	}()
+
+	var errs []error
+	for err := range conn.Errors() {
+		errs = append(errs, err)
+	}
+	c.Assert(errs, HasLen, 1)
+	c.Check(errs[0], Equals, frame.ErrInvalidCommand)
+	rw.Close()
+}
+
+func (s *StompSuite) Test_errors_closed_on_disconnect(c *C) {
+	conn, rw := connectHelper(c, V12)
+
+	go func() {
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+		rw.Close()
+	}()
+
+	err := conn.Disconnect()
+	c.Assert(err, IsNil)
+
+	err, ok := <-conn.Errors()
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, false)
+}
+
+func (s *StompSuite) Test_disconnect_with_context(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		// no receipt for the DISCONNECT frame
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.DISCONNECT)
+
+		// the connection is closed by the client
+		_, err = rw.Read()
+		c.Check(err, NotNil)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := conn.DisconnectWithContext(ctx)
+	c.Check(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	c.Check(conn.State(), Equals, Closed)
+	<-stop
+
+	c.Check(conn.DisconnectWithContext(context.Background()), IsNil)
+	c.Check(conn.MustDisconnect(), IsNil)
+}
+
+func (s *StompSuite) Test_concurrent_disconnect(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.SUBSCRIBE)
+
+		// only one DISCONNECT frame is sent
+		f, err = rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.DISCONNECT)
+		time.Sleep(10 * time.Millisecond)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+		_, err = rw.Read()
+		c.Check(err, NotNil)
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+
+	const n = 5
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() { errs <- conn.Disconnect() }()
+	}
+	for i := 0; i < n; i++ {
+		c.Check(<-errs, IsNil)
+	}
+	c.Check(conn.State(), Equals, Closed)
+	c.Check(conn.MustDisconnect(), IsNil)
+	<-stop
+
+	// the subscription is closed once
+	for range sub.C {
+	}
+	c.Check(sub.Active(), Equals, false)
+}
+
+func (s *StompSuite) Test_disconnect_connection_lost(c *C) {
+	conn, rw := connectHelper(c, V12)
+
+	go func() {
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.DISCONNECT)
+		rw.Close()
+	}()
+
+	c.Check(conn.Disconnect(), NotNil)
+	c.Check(conn.State(), Equals, Closed)
+	c.Check(conn.Disconnect(), IsNil)
+}
+
+func (s *StompSuite) Test_send_coalesced(c *C) {
+	const n = 200
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		// the frames queued while the first is written are
+		// written together, in order
+		for i := 0; i < n; i++ {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, frame.SEND)
+			c.Assert(string(f.Body), Equals, fmt.Sprint(i))
+		}
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+	}()
+
+	for i := 0; i < n; i++ {
+		c.Assert(conn.Send("/queue/test-1", "text/plain", []byte(fmt.Sprint(i))), IsNil)
+	}
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_buffer_sizes(c *C) {
+	conn, rw := connectHelper(c, V12)
+	c.Check(conn.ReadBufferSize(), Equals, 4096)
+	c.Check(conn.WriteBufferSize(), Equals, 4096)
+	conn.MustDisconnect()
+	rw.Close()
+
+	conn, rw = connectHelper(c, V12, ConnOpt.ReadBufferSize(1024), ConnOpt.WriteBufferSize(frame.MinBufferSize))
+	c.Check(conn.ReadBufferSize(), Equals, 1024)
+	c.Check(conn.WriteBufferSize(), Equals, frame.MinBufferSize)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		// a frame larger than the buffers is read and written in parts
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SEND)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f1.Header.Get(frame.Receipt),
+			"x-large", strings.Repeat("y", 2000)))
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+	}()
+
+	c.Check(conn.Send("/queue/test-1", "text/plain", make([]byte, 2000), SendOpt.Receipt), IsNil)
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+
+	for _, opt := range []func(*Conn) error{
+		ConnOpt.ReadBufferSize(0),
+		ConnOpt.ReadBufferSize(frame.MinBufferSize - 1),
+		ConnOpt.WriteBufferSize(-1),
+		ConnOpt.WriteBufferSize(frame.MinBufferSize - 1),
+	} {
+		_, err := Connect(nil, opt)
+		c.Check(err, Equals, ErrInvalidOptionValue)
+	}
+}
+
+func (s *StompSuite) Test_errors_broker_error(c *C) {
+	conn, rw := connectHelper(c, V12)
+
+	go func() {
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		f2 := frame.New(frame.ERROR, frame.Message, "connection closed")
+		f2.Body = []byte("no such destination")
+		rw.Write(f2)
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+	msg := <-sub.C
+	c.Assert(msg.Err, NotNil)
+	c.Check(msg.Err.Error(), Equals, "connection closed")
+
+	// the server's message is not mistaken for the client's error
+	c.Check(errors.Is(msg.Err, ErrConnectionClosed), Equals, false)
+	var brokerErr *BrokerError
+	c.Assert(errors.As(msg.Err, &brokerErr), Equals, true)
+	c.Check(brokerErr.Message, Equals, "connection closed")
+	c.Check(string(brokerErr.Body), Equals, "no such destination")
+	c.Check(brokerErr.Frame.Command, Equals, frame.ERROR)
+
+	err = <-conn.Errors()
+	c.Check(errors.As(err, &brokerErr), Equals, true)
+	rw.Close()
+}
+
+func (s *StompSuite) Test_errors_wrap_cause(c *C) {
+	conn, rw := connectHelper(c, V12)
+
+	go func() {
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		rw.conn.Write([]byte("message\n\n\x00"))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+	msg := <-sub.C
+	c.Assert(msg.Err, NotNil)
+	c.Check(msg.Err.Error(), Equals, "connection closed")
+	c.Check(errors.Is(msg.Err, ErrConnectionClosed), Equals, true)
+	c.Check(errors.Is(msg.Err, frame.ErrInvalidCommand), Equals, true)
+	var brokerErr *BrokerError
+	c.Check(errors.As(msg.Err, &brokerErr), Equals, false)
+	rw.Close()
+
+	e := Error{Message: ErrConnectionClosed.Message, cause: io.ErrUnexpectedEOF}
+	c.Check(errors.Is(e, ErrConnectionClosed), Equals, true)
+	c.Check(errors.Is(e, io.ErrUnexpectedEOF), Equals, true)
+	c.Check(errors.Is(e, ErrClosedUnexpectedly), Equals, false)
+	c.Check(errors.Is(&e, ErrConnectionClosed), Equals, true)
+}
+
+// stateRecorder records the changes of state of a connection.
+type stateRecorder struct {
+	mu      sync.Mutex
+	changes []string
+}
+
+func (r *stateRecorder) record(old, new ConnState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changes = append(r.changes, old.String()+"->"+new.String())
+}
+
+func (r *stateRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.changes...)
+}
+
+func (s *StompSuite) Test_conn_state(c *C) {
+	var states stateRecorder
+	conn, rw := connectHelper(c, V12, ConnOpt.OnStateChange(states.record))
+	c.Check(conn.State(), Equals, Connected)
+
+	go func() {
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, "DISCONNECT")
+		c.Check(conn.State(), Equals, Disconnecting)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+		rw.Close()
+	}()
+
+	err := conn.Disconnect()
+	c.Assert(err, IsNil)
+	c.Check(conn.State(), Equals, Closed)
+	c.Check(states.get(), DeepEquals, []string{
+		"connecting->connected",
+		"connected->disconnecting",
+		"disconnecting->closed",
+	})
+
+	// the errors are the sentinel, which was ErrAlreadyClosed before
+	// Conn.State was added
+	err = conn.Send("/queue/test-1", "text/plain", []byte("hello"))
+	c.Check(err == ErrConnectionClosed, Equals, true)
+	c.Check(err == ErrAlreadyClosed, Equals, true)
+	_, err = conn.Subscribe("/queue/test-1", AckAuto)
+	c.Check(err == ErrConnectionClosed, Equals, true)
+	c.Check(err == ErrAlreadyClosed, Equals, true)
+	_, err = conn.SendAsync("/queue/test-1", "text/plain", []byte("hello"))
+	c.Check(err == ErrConnectionClosed, Equals, true)
+}
+
+func (s *StompSuite) Test_conn_state_must_disconnect(c *C) {
+	var states stateRecorder
+	conn, rw := connectHelper(c, V12, ConnOpt.OnStateChange(states.record))
+	defer rw.Close()
+
+	err := conn.MustDisconnect()
+	c.Assert(err, IsNil)
+	c.Check(conn.State(), Equals, Closed)
+	c.Check(states.get(), DeepEquals, []string{
+		"connecting->connected",
+		"connected->closed",
+	})
+
+	fc1, fc2 := testutil.NewFakeConn(c)
+	defer fc2.Close()
+	_, err = Connect(fc1, ConnOpt.OnStateChange(nil))
+	c.Check(err, Equals, ErrNilOption)
+}
+
+func (s *StompSuite) Test_send_receipt_timeout(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+	timedOut := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SEND")
+		receipt, ok := f1.Header.Contains(frame.Receipt)
+		c.Assert(ok, Equals, true)
+
+		// the RECEIPT arrives after the sender has stopped waiting
+		<-timedOut
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "SEND")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	err := conn.Send("/queue/test-1", "text/plain", []byte("slow"),
+		SendOpt.ReceiptTimeout(20*time.Millisecond))
+	c.Check(err, Equals, ErrMsgSendTimeout)
+	close(timedOut)
+
+	err = conn.Send("/queue/test-1", "text/plain", []byte("fast"),
+		SendOpt.ReceiptTimeout(time.Minute))
+	c.Check(err, IsNil)
+
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_send_receipt_timeout_invalid(c *C) {
+	conn, rw := connectHelper(c, V12)
+	defer rw.Close()
+	defer conn.MustDisconnect()
+
+	err := conn.Send("/queue/test-1", "text/plain", nil, SendOpt.ReceiptTimeout(0))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+
+	_, err = conn.Subscribe("/queue/test-1", AckAuto, SendOpt.ReceiptTimeout(time.Second))
+	c.Check(err, Equals, ErrInvalidCommand)
+}
+
+func (s *StompSuite) Test_send_persistent_priority(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SEND)
+		c.Check(f1.Header.Get(frame.Persistent), Equals, "true")
+		c.Check(f1.Header.Get(frame.Priority), Equals, "9")
+		c.Check(f1.Header.Get("x-custom"), Equals, "1")
+		rw.Close()
+	}()
+
+	err := conn.Send("/queue/test-1", "text/plain", nil, SendOpt.Priority(10))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+	err = conn.Send("/queue/test-1", "text/plain", nil, SendOpt.Priority(-1))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+
+	err = conn.Send("/queue/test-1", "text/plain", nil,
+		SendOpt.Persistent, SendOpt.Priority(9), SendOpt.Header("x-custom", "1"))
+	c.Check(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_send_content_length(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		_, ok := f1.Header.Contains(frame.ContentLength)
+		c.Check(ok, Equals, false)
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Check(f2.Header.Get(frame.ContentLength), Equals, "0")
+		rw.Close()
+	}()
+
+	err := conn.Send("/queue/test-1", "text/plain", []byte("a\x00b"), SendOpt.NoContentLength)
+	c.Check(err, Equals, ErrNulInBody)
+
+	err = conn.Send("/queue/test-1", "text/plain", []byte("text"), SendOpt.NoContentLength)
+	c.Check(err, IsNil)
+	err = conn.Send("/queue/test-1", "text/plain", nil, SendOpt.NoContentLength, SendOpt.ForceContentLength)
+	c.Check(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_send_async(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		var receipts []string
+		for i := 0; i < 3; i++ {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, "SEND")
+			c.Check(string(f.Body), Equals, fmt.Sprintf("message %d", i))
+			receipt, ok := f.Header.Contains(frame.Receipt)
+			c.Assert(ok, Equals, true)
+			receipts = append(receipts, receipt)
+		}
+
+		// acknowledge in reverse order
+		for i := len(receipts) - 1; i >= 0; i-- {
+			rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, receipts[i]))
+		}
+
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+	}()
+
+	var receipts []*Receipt
+	for i := 0; i < 3; i++ {
+		r, err := conn.SendAsync("/queue/test-1", "text/plain", []byte(fmt.Sprintf("message %d", i)))
+		c.Assert(err, IsNil)
+		c.Assert(r.Id(), Not(Equals), "")
+		receipts = append(receipts, r)
+	}
+
+	for _, r := range receipts {
+		<-r.Done()
+		c.Check(r.Err(), IsNil)
+	}
+
+	err := conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_send_async_connection_closed(c *C) {
+	conn, rw := connectHelper(c, V12)
+	received := make(chan struct{})
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, "SEND")
+		}
+		close(received)
+	}()
+
+	r1, err := conn.SendAsync("/queue/test-1", "text/plain", []byte("one"))
+	c.Assert(err, IsNil)
+	r2, err := conn.SendAsync("/queue/test-1", "text/plain", []byte("two"), SendOpt.Receipt)
+	c.Assert(err, IsNil)
+
+	<-received
+	c.Check(r1.Err(), IsNil)
+	select {
+	case <-r1.Done():
+		c.Fatal("receipt completed before the connection closed")
+	default:
+	}
+
+	rw.Close()
+	<-r1.Done()
+	<-r2.Done()
+	c.Check(r1.Err(), NotNil)
+	c.Check(r2.Err(), NotNil)
+
+	_, err = conn.SendAsync("/queue/test-1", "text/plain", []byte("three"))
+	c.Check(err, Equals, ErrConnectionClosed)
+}
+
+func (s *StompSuite) Test_send_batch(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		for i := 0; i < 3; i++ {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, "SEND")
+			c.Check(string(f.Body), Equals, fmt.Sprintf("message %d", i))
+			c.Check(f.Header.Get("x-batch"), Equals, "yes")
+			receipt, ok := f.Header.Contains(frame.Receipt)
+			if i < 2 {
+				c.Check(ok, Equals, false)
+				continue
+			}
+			c.Assert(ok, Equals, true)
+			c.Check(f.Header.Get("x-last"), Equals, "yes")
+			rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+		}
+
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+	}()
+
+	msgs := []SendRequest{
+		{Destination: "/queue/test-1", ContentType: "text/plain", Body: []byte("message 0")},
+		{Destination: "/queue/test-1", ContentType: "text/plain", Body: []byte("message 1")},
+		{Destination: "/queue/test-1", ContentType: "text/plain", Body: []byte("message 2"),
+			Opts: []func(*frame.Frame) error{SendOpt.Header("x-last", "yes")}},
+	}
+	err := conn.SendBatch(msgs, SendOpt.Receipt, SendOpt.Header("x-batch", "yes"))
+	c.Check(err, IsNil)
+
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_send_batch_invalid_message(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		// nothing from the batch is sent
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+	}()
+
+	msgs := []SendRequest{
+		{Destination: "/queue/test-1", Body: []byte("message 0")},
+		{Destination: "/queue/test-1", Body: []byte("message 1"),
+			Opts: []func(*frame.Frame) error{SendOpt.ReceiptTimeout(0)}},
+		{Destination: "/queue/test-1", Body: []byte("message 2")},
+	}
+	err := conn.SendBatch(msgs)
+	c.Assert(err, NotNil)
+	batchErr, ok := err.(*BatchError)
+	c.Assert(ok, Equals, true)
+	c.Check(batchErr.Index, Equals, 1)
+	c.Check(errors.Is(err, ErrInvalidOptionValue), Equals, true)
+
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+
+	err = conn.SendBatch(msgs[:1])
+	c.Check(errors.Is(err, ErrConnectionClosed), Equals, true)
+}
+
+func (s *StompSuite) Test_send_interceptors(c *C) {
+	fc1, fc2 := testutil.NewFakeConn(c)
+	rw := &fakeReaderWriter{
+		reader: frame.NewReader(fc2),
+		writer: frame.NewWriter(fc2),
+		conn:   fc2,
+	}
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "CONNECT")
+		c.Check(f1.Header.GetAll("x-trace"), DeepEquals, []string{"first", "second"})
+		rw.Write(frame.New(frame.CONNECTED, frame.Version, "1.2"))
+
+		// the rejected SEND frame is never written
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "SEND")
+		c.Check(f2.Header.Get(frame.Destination), Equals, "/queue/allowed")
+		c.Check(f2.Header.GetAll("x-trace"), DeepEquals, []string{"first", "second"})
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	errRejected := errors.New("rejected")
+	conn, err := Connect(fc1,
+		ConnOpt.SendInterceptor(func(f *frame.Frame) error {
+			f.Header.Add("x-trace", "first")
+			return nil
+		}),
+		ConnOpt.SendInterceptor(func(f *frame.Frame) error {
+			if f.Header.Get(frame.Destination) == "/queue/rejected" {
+				return errRejected
+			}
+			if f.Command != frame.DISCONNECT {
+				f.Header.Add("x-trace", "second")
+			}
+			return nil
+		}))
+	c.Assert(err, IsNil)
+
+	err = conn.Send("/queue/rejected", "text/plain", []byte("rejected"))
+	c.Check(err, Equals, errRejected)
+	err = conn.Send("/queue/allowed", "text/plain", []byte("allowed"))
+	c.Check(err, IsNil)
+
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_receive_interceptors(c *C) {
+	var commands []string
+	errRejected := errors.New("rejected")
+	conn, rw := connectHelper(c, V12,
+		ConnOpt.ReceiveInterceptor(func(f *frame.Frame) error {
+			commands = append(commands, f.Command)
+			return nil
+		}),
+		ConnOpt.ReceiveInterceptor(func(f *frame.Frame) error {
+			if f.Header.Get(frame.MessageId) == "rejected" {
+				return errRejected
+			}
+			return nil
+		}))
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		id := f1.Header.Get(frame.Id)
+		for _, messageId := range []string{"rejected", "accepted"} {
+			rw.Write(frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.MessageId, messageId,
+				frame.Destination, "/queue/test-1"))
+		}
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(msg.Header.Get(frame.MessageId), Equals, "accepted")
+	c.Check(<-conn.Errors(), Equals, errRejected)
+
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+	c.Check(commands, DeepEquals, []string{"CONNECTED", "MESSAGE", "MESSAGE", "RECEIPT"})
+}
+
+func (s *StompSuite) Test_ack_versions(c *C) {
+	for _, version := range []Version{V10, V11, V12} {
+		conn, rw := connectHelper(c, version)
+		stop := make(chan struct{})
+
+		go func() {
+			defer func() {
+				rw.Close()
+				close(stop)
+			}()
+
+			f1, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+			id := f1.Header.Get(frame.Id)
+
+			// the ack header entry differs from the message-id, as it
+			// does for some servers
+			f2 := frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.MessageId, "message-1",
+				frame.Destination, "/queue/test-1")
+			if version == V12 {
+				f2.Header.Add(frame.Ack, "ack-1")
+			}
+			rw.Write(f2)
+
+			// without the header entry that identifies the message
+			// for the version
+			f3 := frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.Destination, "/queue/test-1")
+			if version == V12 {
+				f3.Header.Add(frame.MessageId, "message-2")
+			}
+			rw.Write(f3)
+
+			ack := "message-1"
+			if version == V12 {
+				ack = "ack-1"
+			}
+			f4, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Check(f4.Command, Equals, frame.ACK)
+			checkAckHeader(c, f4, version, id, ack)
+
+			if version.SupportsNack() {
+				f5, err := rw.Read()
+				c.Assert(err, IsNil)
+				c.Check(f5.Command, Equals, frame.NACK)
+				checkAckHeader(c, f5, version, id, ack)
+			}
+		}()
+
+		sub, err := conn.Subscribe("/queue/test-1", AckClientIndividual)
+		c.Assert(err, IsNil)
+		msg1, msg2 := <-sub.C, <-sub.C
+
+		missing := ErrMissingMessageId
+		if version == V12 {
+			missing = ErrMissingAck
+		}
+		c.Check(conn.Ack(msg2), Equals, missing)
+		c.Check(conn.Ack(msg1), IsNil)
+		if version.SupportsNack() {
+			c.Check(conn.Nack(msg2), Equals, missing)
+			c.Check(conn.Nack(msg1), IsNil)
+		} else {
+			c.Check(conn.Nack(msg1), Equals, ErrNackNotSupported)
+		}
+		<-stop
+		conn.MustDisconnect()
+	}
+}
+
+func (s *StompSuite) Test_nack_with_opts(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		rw.Write(frame.New(frame.MESSAGE,
+			frame.Subscription, f1.Header.Get(frame.Id),
+			frame.MessageId, "message-1",
+			frame.Ack, "ack-1",
+			frame.Destination, "/queue/test-1"))
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "NACK")
+		c.Check(f2.Header.Get(frame.Id), Equals, "ack-1")
+		c.Check(f2.Header.Get("requeue"), Equals, "false")
+		c.Check(f2.Header.Get("x-reason"), Equals, "invalid")
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckClientIndividual)
+	c.Assert(err, IsNil)
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+
+	err = msg.NackWithOpts(SendOpt.Receipt)
+	c.Check(err, Equals, ErrInvalidCommand)
+	err = msg.NackWithOpts(NackOpt.NoRequeue, NackOpt.Header("x-reason", "invalid"))
+	c.Check(err, IsNil)
+
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+
+	// the version is checked before the options
+	conn.version = V10
+	err = conn.NackWithOpts(msg, SendOpt.Receipt)
+	c.Check(err, Equals, ErrNackNotSupported)
+	err = (&Message{}).NackWithOpts()
+	c.Check(err, Equals, ErrNotReceivedMessage)
+}
+
+func (s *StompSuite) Test_ack_batching(c *C) {
+	conn, rw := connectHelper(c, V12, ConnOpt.AckBatching(2, 0))
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		for i := 1; i <= 5; i++ {
+			rw.Write(frame.New(frame.MESSAGE,
+				frame.Subscription, f1.Header.Get(frame.Id),
+				frame.MessageId, fmt.Sprintf("message-%d", i),
+				frame.Ack, fmt.Sprintf("ack-%d", i),
+				frame.Destination, "/queue/test-1"))
+		}
+
+		// flushed once the batch is full, by a SEND frame,
+		// by FlushAcks and by the DISCONNECT frame
+		for _, expected := range []string{"ack-1", "ack-2", "ack-3", "SEND", "ack-4", "ack-5", "DISCONNECT"} {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			if f.Command == frame.ACK {
+				c.Check(f.Header.Get(frame.Id), Equals, expected)
+				continue
+			}
+			c.Assert(f.Command, Equals, expected)
+			if receipt, ok := f.Header.Contains(frame.Receipt); ok {
+				rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+			}
+		}
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckClientIndividual)
+	c.Assert(err, IsNil)
+	var msgs []*Message
+	for i := 0; i < 5; i++ {
+		msg := <-sub.C
+		c.Assert(msg.Err, IsNil)
+		msgs = append(msgs, msg)
+	}
+
+	c.Check(conn.Ack(msgs[0]), IsNil)
+	c.Check(conn.Ack(msgs[1]), IsNil)
+	c.Check(conn.Ack(msgs[2]), IsNil)
+	c.Check(conn.Send("/queue/test-2", "text/plain", []byte("hello")), IsNil)
+	c.Check(conn.Ack(msgs[3]), IsNil)
+	c.Check(conn.FlushAcks(), IsNil)
+	c.Check(conn.Ack(msgs[4]), IsNil)
+
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+
+	c.Check(conn.FlushAcks(), Equals, ErrClosedUnexpectedly)
+}
+
+func (s *StompSuite) Test_ack_batching_flush_interval(c *C) {
+	conn, rw := connectHelper(c, V12, ConnOpt.AckBatching(100, 10*time.Millisecond))
+	stop := make(chan struct{})
+	acked := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		rw.Write(frame.New(frame.MESSAGE,
+			frame.Subscription, f1.Header.Get(frame.Id),
+			frame.MessageId, "message-1",
+			frame.Ack, "ack-1",
+			frame.Destination, "/queue/test-1"))
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "ACK")
+		c.Check(f2.Header.Get(frame.Id), Equals, "ack-1")
+		close(acked)
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckClientIndividual)
+	c.Assert(err, IsNil)
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+
+	c.Check(conn.Ack(msg), IsNil)
+
+	// the ack is written once the interval has elapsed
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+		c.Fatal("batched ack was not flushed")
+	}
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_ack_batching_invalid(c *C) {
+	for _, opt := range []func(*Conn) error{
+		ConnOpt.AckBatching(0, 0),
+		ConnOpt.AckBatching(10, -time.Second),
+	} {
+		fc1, fc2 := testutil.NewFakeConn(c)
+		conn, err := Connect(fc1, opt)
+		c.Check(conn, IsNil)
+		c.Check(err, Equals, ErrInvalidOptionValue)
+		fc2.Close()
+	}
+}
+
+func (s *StompSuite) Test_max_frame_size(c *C) {
+	conn, rw := connectHelper(c, V12, ConnOpt.MaxFrameSize(10), ConnOpt.MaxHeaders(8, 0))
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		f := frame.New(frame.MESSAGE,
+			frame.Subscription, f1.Header.Get(frame.Id),
+			frame.Destination, "/queue/test-1",
+			frame.ContentLength, "24")
+		f.Body = []byte("a body that is too large")
+		rw.Write(f)
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+	msg := <-sub.C
+	c.Assert(msg.Err, NotNil)
+	c.Check(errors.Is(msg.Err, ErrFrameTooLarge), Equals, true)
+	c.Check(conn.lastFailure(), ErrorMatches, "frame too large: content-length 24 exceeds the limit of 10")
+	<-stop
+
+	fc, _ := testutil.NewFakeConn(c)
+	_, err = Connect(fc, ConnOpt.MaxFrameSize(-1))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+	_, err = Connect(fc, ConnOpt.MaxHeaders(0, -1))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+}
+
+func (s *StompSuite) Test_send_rejected_frames(c *C) {
+	conn, rw := connectHelper(c, V12, ConnOpt.MaxDestinationLength(16))
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		// only the valid frames are written
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Check(f1.Command, Equals, frame.SEND)
+		c.Check(f1.Header.Get(frame.Destination), Equals, "/queue/test-1")
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Check(f2.Command, Equals, frame.BEGIN)
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	c.Check(conn.Send("", "text/plain", []byte("hello")), Equals, ErrEmptyDestination)
+	c.Check(conn.Send("/queue/test-1234567", "text/plain", []byte("hello")), Equals, ErrDestinationTooLong)
+	c.Check(conn.Send("/queue/test-1", "text/plain", nil, SendOpt.Header(frame.ContentLength, "5")),
+		Equals, ErrContentLengthMismatch)
+	c.Check(conn.Send("/queue/test-1", "text/plain", []byte("hello"), SendOpt.Header(frame.ContentLength, "5")), IsNil)
+
+	tx, err := conn.BeginWithError()
+	c.Assert(err, IsNil)
+	c.Check(tx.Send("", "text/plain", []byte("hello")), Equals, ErrEmptyDestination)
+	c.Check(tx.Send("/queue/test-1234567", "text/plain", []byte("hello")), Equals, ErrDestinationTooLong)
+
+	// the connection is still open
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+
+	_, err = Connect(nil, ConnOpt.MaxDestinationLength(-1))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+}
+
+func (s *StompSuite) Test_send_frame_and_unknown_frames(c *C) {
+	unknown := make(chan *frame.Frame, 1)
+	conn, rw := connectHelper(c, V12, ConnOpt.OnUnknownFrame(func(f *frame.Frame) {
+		unknown <- f
+	}))
+	rw.reader = frame.NewReader(rw.conn, frame.AnyCommand())
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		rw.Write(frame.New("NOTIFY", "event", "queue-created"))
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Check(f1.Command, Equals, "MANAGE")
+		c.Check(f1.Header.Get("op"), Equals, "list")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f1.Header.Get(frame.Receipt)))
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Check(f2.Command, Equals, frame.ACK)
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	f := <-unknown
+	c.Check(f.Command, Equals, "NOTIFY")
+	c.Check(f.Header.Get("event"), Equals, "queue-created")
+
+	c.Check(conn.SendFrame(frame.New("MANAGE", "op", "list", frame.Receipt, "receipt-1")), IsNil)
+	for _, command := range []string{"", "MANAGE\n", frame.CONNECT, frame.STOMP, frame.DISCONNECT, frame.SUBSCRIBE, frame.UNSUBSCRIBE} {
+		c.Check(conn.SendFrame(frame.New(command)), Equals, ErrInvalidCommand, Commentf("command %q", command))
+	}
+	c.Check(conn.SendFrame(frame.New(frame.ACK, frame.Id, "1")), IsNil)
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+
+	_, err := Connect(nil, ConnOpt.OnUnknownFrame(nil))
+	c.Check(err, Equals, ErrNilOption)
+}
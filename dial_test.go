@@ -0,0 +1,119 @@
+package stomp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	"github.com/go-stomp/stomp/testutil"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_dial_unix(c *C) {
+	path := filepath.Join(c.MkDir(), "broker.sock")
+	listener, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	serveStomp(listener)
+
+	conn, err := Dial("unix", path)
+	c.Assert(err, IsNil)
+	c.Check(conn.Version(), Equals, V12)
+	c.Check(conn.RemoteAddr().Network(), Equals, "unix")
+	c.Check(conn.Disconnect(), IsNil)
+}
+
+func (s *StompSuite) Test_dial_dialer(c *C) {
+	listener, _ := listenStomp(c)
+	defer listener.Close()
+
+	// the dialer connects to the server, whatever the address
+	var network, addr string
+	dialer := func(ctx context.Context, n, a string) (net.Conn, error) {
+		network, addr = n, a
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", listener.Addr().String())
+	}
+	conn, err := Dial("tcp", "broker.example.com:61613", ConnOpt.Dialer(dialer), ConnOpt.HeartBeat(0, 0))
+	c.Assert(err, IsNil)
+	c.Check(network, Equals, "tcp")
+	c.Check(addr, Equals, "broker.example.com:61613")
+	c.Check(conn.Disconnect(), IsNil)
+
+	_, err = Dial("tcp", listener.Addr().String(), ConnOpt.Dialer(nil))
+	c.Check(err, Equals, ErrNilOption)
+}
+
+func (s *StompSuite) Test_dial_with_context(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	// the server accepts connections, but never answers CONNECT
+	closed := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.Read(make([]byte, 4096))
+		conn.Read(make([]byte, 4096))
+		conn.Close()
+		close(closed)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = DialWithContext(ctx, "tcp", listener.Addr().String())
+	c.Assert(err, NotNil)
+	c.Check(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		c.Fatal("connection not closed")
+	}
+}
+
+func (s *StompSuite) Test_connect_with_context(c *C) {
+	fc1, fc2 := testutil.NewFakeConn(c)
+	defer fc2.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		reader := frame.NewReader(fc2)
+		f, err := reader.Read()
+		c.Assert(err, IsNil)
+		c.Check(f.Command, Equals, frame.CONNECT)
+		cancel()
+	}()
+
+	_, err := ConnectWithContext(ctx, fc1)
+	c.Check(errors.Is(err, context.Canceled), Equals, true)
+
+	// a done context prevents the connect sequence
+	fc3, fc4 := testutil.NewFakeConn(c)
+	defer fc4.Close()
+	_, err = ConnectWithContext(ctx, fc3)
+	c.Check(errors.Is(err, context.Canceled), Equals, true)
+
+	// the context has no effect once connected
+	fc5, fc6 := testutil.NewFakeConn(c)
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		reader := frame.NewReader(fc6)
+		writer := frame.NewWriter(fc6)
+		reader.Read()
+		writer.Write(frame.New(frame.CONNECTED, frame.Version, "1.2"))
+		f, err := reader.Read()
+		c.Assert(err, IsNil)
+		c.Check(f.Command, Equals, frame.DISCONNECT)
+		writer.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+	}()
+	conn, err := ConnectWithContext(ctx, fc5, ConnOpt.HeartBeat(0, 0))
+	c.Assert(err, IsNil)
+	cancel()
+	c.Check(conn.Disconnect(), IsNil)
+}
@@ -0,0 +1,81 @@
+package stomp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Drain disconnects from the STOMP server gracefully, allowing messages
+// that have already been received and sent to be completed. It unsubscribes
+// from every active subscription and waits for each to close, then waits for
+// the server to respond to every receipt that is outstanding, including the
+// receipts for sends that are in progress, and finally performs the same
+// DISCONNECT protocol sequence as Disconnect.
+//
+// Messages that were received before a subscription closed remain available
+// on its C channel, and can be acknowledged until the DISCONNECT frame is
+// sent.
+//
+// Each step is bounded by the context. A step that does not complete before
+// the context is done does not stop the drain; instead its error is included
+// in the returned error, which combines the errors of all the steps. If the
+// context is done before the server responds to the DISCONNECT frame, the
+// connection is closed without waiting any longer.
+func (c *Conn) Drain(ctx context.Context) error {
+	if c.IsClosed() {
+		return nil
+	}
+
+	subs := c.activeSubscriptions()
+	errs := make([]error, len(subs), len(subs)+2)
+	done := make(chan struct{})
+	for i, sub := range subs {
+		go func(i int, sub *Subscription) {
+			defer func() { done <- struct{}{} }()
+			err := sub.UnsubscribeWithContext(ctx, UnsubscribeOpt.Timeout(0))
+			if err != nil && err != ErrCompletedSubscription {
+				errs[i] = fmt.Errorf("subscription %s: %w", sub.id, err)
+			}
+		}(i, sub)
+	}
+	for range subs {
+		<-done
+	}
+
+	if err := c.waitForIdle(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("waiting for receipts: %w", err))
+	}
+
+	if err := c.DisconnectWithContext(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("disconnect: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// waitForIdle waits until the server has responded to all of the
+// receipts requested by the frames written so far. If another goroutine
+// has disconnected in the meantime, there is nothing left to wait for.
+func (c *Conn) waitForIdle(ctx context.Context) error {
+	c.closeMutex.Lock()
+	if c.IsClosed() {
+		c.closeMutex.Unlock()
+		return nil
+	}
+	idle := make(chan struct{})
+	err := sendDataToWriteChWithTimeout(ctx, c.writeCh, writeRequest{idle: idle}, 0)
+	c.closeMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-idle:
+		return nil
+	case <-c.closeCh:
+		return ErrClosedUnexpectedly
+	case <-ctx.Done():
+		return newContextError(ctx.Err())
+	}
+}
@@ -0,0 +1,102 @@
+package stomp
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_drain(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+	var receiptSent int32
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		id := f1.Header.Get(frame.Id)
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "SEND")
+		receipt := f2.Header.Get(frame.Receipt)
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "UNSUBSCRIBE")
+		c.Check(f3.Header.Get(frame.Id), Equals, id)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+
+		// the DISCONNECT frame is not sent until the receipt for the SEND
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&receiptSent, 1)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+
+		f4, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f4.Command, Equals, "DISCONNECT")
+		c.Check(atomic.LoadInt32(&receiptSent), Equals, int32(1))
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f4.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckClient)
+	c.Assert(err, IsNil)
+	r, err := conn.SendAsync("/queue/test-2", "text/plain", []byte("message"))
+	c.Assert(err, IsNil)
+
+	err = conn.Drain(context.Background())
+	c.Check(err, IsNil)
+	c.Check(sub.Active(), Equals, false)
+	c.Check(conn.IsClosed(), Equals, true)
+	<-r.Done()
+	c.Check(r.Err(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_drain_timeout(c *C) {
+	conn, rw := connectHelper(c, V12)
+	unsubscribed := make(chan struct{})
+
+	go func() {
+		defer rw.Close()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+
+		// the UNSUBSCRIBE frame is never acknowledged
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "UNSUBSCRIBE")
+		close(unsubscribed)
+
+		for {
+			if _, err := rw.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = conn.Drain(ctx)
+	<-unsubscribed
+
+	c.Assert(err, NotNil)
+	c.Check(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	c.Check(err, ErrorMatches, "(?s)subscription "+sub.Id()+": context deadline exceeded.*")
+	c.Check(conn.IsClosed(), Equals, true)
+}
@@ -0,0 +1,71 @@
+package stomp
+
+import (
+	"github.com/go-stomp/stomp/frame"
+)
+
+// setDurableHeader sets the header entries that identify the durable
+// subscription called name, in a SUBSCRIBE or UNSUBSCRIBE frame.
+func (b BrokerFlavor) setDurableHeader(f *frame.Frame, name string) error {
+	f.Header.Set(frame.Id, name)
+	switch b {
+	case BrokerActiveMQ:
+		f.Header.Set("activemq.subscriptionName", name)
+	case BrokerArtemis:
+		f.Header.Set("durable-subscription-name", name)
+	case BrokerRabbitMQ:
+		f.Header.Set("durable", "true")
+		f.Header.Set("auto-delete", "false")
+	default:
+		return ErrInvalidOptionValue
+	}
+	return nil
+}
+
+// addDurable records the flavor used for the durable subscription called
+// name, for Conn.UnsubscribeDurable.
+func (c *Conn) addDurable(name string, flavor BrokerFlavor) {
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	if c.durables == nil {
+		c.durables = make(map[string]BrokerFlavor)
+	}
+	c.durables[name] = flavor
+}
+
+// UnsubscribeDurable removes the durable subscription called name from the
+// STOMP server, so that the server no longer keeps messages for it. The
+// UNSUBSCRIBE frame has the header entries of the flavor that was specified
+// with SubscribeOpt.Durable for the name on this Conn, or else the flavor
+// detected from the "server" header entry of the CONNECTED frame. If the
+// flavor cannot be detected, ErrUnknownBroker is returned.
+//
+// The durable subscription must not be active on this Conn: a subscription
+// that receives messages must be unsubscribed with Subscription.Unsubscribe
+// first, which leaves the durable subscription on the server. Otherwise
+// ErrSubscriptionActive is returned.
+func (c *Conn) UnsubscribeDurable(name string) error {
+	if err := c.checkConnected(); err != nil {
+		return err
+	}
+
+	c.subsMutex.Lock()
+	_, active := c.subs[name]
+	flavor, ok := c.durables[name]
+	c.subsMutex.Unlock()
+	if active {
+		return ErrSubscriptionActive
+	}
+	if !ok {
+		var err error
+		if flavor, err = BrokerAuto.resolve(c.flavor); err != nil {
+			return err
+		}
+	}
+
+	f := frame.New(frame.UNSUBSCRIBE)
+	if err := flavor.setDurableHeader(f, name); err != nil {
+		return err
+	}
+	return c.sendFrame(f)
+}
@@ -0,0 +1,80 @@
+package stomp
+
+import (
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_durable_activemq(c *C) {
+	conn, rw := connectServerHelper(c, "ActiveMQ/5.18.3")
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Check(f1.Command, Equals, frame.SUBSCRIBE)
+		c.Check(f1.Header.Get(frame.Id), Equals, "orders")
+		c.Check(f1.Header.Get("activemq.subscriptionName"), Equals, "orders")
+		c.Check(f1.Header.Get("durable"), Equals, "")
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Check(f2.Command, Equals, frame.UNSUBSCRIBE)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Check(f3.Command, Equals, frame.UNSUBSCRIBE)
+		c.Check(f3.Header.Get(frame.Id), Equals, "orders")
+		c.Check(f3.Header.Get("activemq.subscriptionName"), Equals, "orders")
+		rw.Close()
+	}()
+
+	sub, err := conn.Subscribe("/topic/orders", AckAuto, SubscribeOpt.Durable("orders", BrokerAuto))
+	c.Assert(err, IsNil)
+	c.Check(conn.UnsubscribeDurable("orders"), Equals, ErrSubscriptionActive)
+	c.Check(sub.Unsubscribe(), IsNil)
+	c.Check(conn.UnsubscribeDurable("orders"), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_durable_rabbitmq(c *C) {
+	// the flavor specified for the subscription is used to unsubscribe
+	conn, rw := connectServerHelper(c, "")
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Check(f1.Command, Equals, frame.SUBSCRIBE)
+		c.Check(f1.Header.Get(frame.Id), Equals, "orders")
+		c.Check(f1.Header.Get("durable"), Equals, "true")
+		c.Check(f1.Header.Get("auto-delete"), Equals, "false")
+		c.Check(f1.Header.Get("activemq.subscriptionName"), Equals, "")
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Check(f2.Command, Equals, frame.UNSUBSCRIBE)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Check(f3.Command, Equals, frame.UNSUBSCRIBE)
+		c.Check(f3.Header.Get(frame.Id), Equals, "orders")
+		c.Check(f3.Header.Get("durable"), Equals, "true")
+		c.Check(f3.Header.Get("auto-delete"), Equals, "false")
+		rw.Close()
+	}()
+
+	_, err := conn.Subscribe("/topic/orders", AckAuto, SubscribeOpt.Durable("orders", BrokerAuto))
+	c.Check(err, Equals, ErrUnknownBroker)
+	c.Check(conn.UnsubscribeDurable("other"), Equals, ErrUnknownBroker)
+
+	sub, err := conn.Subscribe("/topic/orders", AckAuto, SubscribeOpt.Durable("orders", BrokerRabbitMQ))
+	c.Assert(err, IsNil)
+	c.Check(sub.Unsubscribe(), IsNil)
+	c.Check(conn.UnsubscribeDurable("orders"), IsNil)
+	<-stop
+}
@@ -1,6 +1,9 @@
 package stomp
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/go-stomp/stomp/frame"
 )
 
@@ -15,32 +18,189 @@ var (
 	ErrCannotNackAutoSub     = newErrorMessage("cannot send NACK for a subscription with ack:auto")
 	ErrCompletedSubscription = newErrorMessage("subscription is unsubscribed")
 	ErrClosedUnexpectedly    = newErrorMessage("connection closed unexpectedly")
-	ErrAlreadyClosed         = newErrorMessage("connection already closed")
 	ErrMsgSendTimeout        = newErrorMessage("msg send timeout")
 	ErrNilOption             = newErrorMessage("nil option")
+	ErrInvalidOptionValue    = newErrorMessage("invalid option value")
 	ErrReadTimeout           = newErrorMessage("read timeout")
 	ErrConnectionClosed      = newErrorMessage("connection closed")
 	ErrErrorFrame            = newErrorMessage("Errored Frame")
 	ErrMissingMessageId      = newErrorMessage("missing header: " + frame.MessageId)
 	ErrMissingAck            = newErrorMessage("missing header: " + frame.Ack)
 	ErrUnsubscribeTimeout    = newErrorMessage("timeout while waiting to unsubscribe")
+	ErrSubscriptionOverflow  = newErrorMessage("subscription channel overflow")
+	ErrStaleMessage          = newErrorMessage("message was received on a previous connection")
+	ErrNilHandler            = newErrorMessage("nil handler")
+	ErrNoCumulativeAck       = newErrorMessage("cumulative ack requires a subscription with ack:client")
+	ErrUnknownBroker         = newErrorMessage("cannot detect the broker flavor from the server header")
+	ErrSubscriptionActive    = newErrorMessage("subscription is active")
+	ErrInvalidSelector       = newErrorMessage("invalid selector")
+	ErrNulInBody             = newErrorMessage("body contains NUL, content-length is required")
+	ErrFrameTooLarge         = newErrorMessage("frame too large")
+	ErrPanic                 = newErrorMessage("panic")
+	ErrTransactionBroken     = newErrorMessage("transaction is broken")
+	ErrNestedTransaction     = newErrorMessage("transactions cannot be nested")
+	ErrInvalidFrame          = newErrorMessage("invalid frame")
+	ErrPoolClosed            = newErrorMessage("pool is closed")
+	ErrNoHealthyConnection   = newErrorMessage("no healthy connection in the pool")
+	ErrSubscriptionIdInUse   = newErrorMessage("subscription id is in use")
+	ErrEmptyDestination      = newErrorMessage("destination is empty")
+	ErrDestinationTooLong    = newErrorMessage("destination is too long")
+	ErrContentLengthMismatch = newErrorMessage("content-length does not match the body")
+	ErrNotJSON               = newErrorMessage("content type is not JSON")
+	ErrInvalidUTF8           = newErrorMessage("body is not valid UTF-8")
+	ErrDecompress            = newErrorMessage("cannot decompress body")
+	ErrBridgeAckMode         = newErrorMessage("bridge requires a subscription with ack:client-individual")
 )
 
+// ErrAlreadyClosed is the same value as ErrConnectionClosed, which the
+// methods of a Conn that the program has disconnected return.
+//
+// Deprecated: Use ErrConnectionClosed.
+var ErrAlreadyClosed = ErrConnectionClosed
+
+// ErrSubscriptionCancelledByBroker is wrapped by the error delivered on
+// Subscription.C when the server cancels the subscription, as RabbitMQ does
+// when the queue of the subscription is deleted. See SubscribeOpt.OnCancel.
+var ErrSubscriptionCancelledByBroker = newErrorMessage("subscription cancelled by the server")
+
 // StompError implements the Error interface, and provides
 // additional information about a STOMP error.
+//
+// The error values of this package can be compared with errors.Is, which
+// also matches errors that the client creates as copies of them, for
+// example to wrap the network error that caused the connection to fail.
+// The errors for ERROR frames received from the server wrap a *BrokerError,
+// which can be retrieved with errors.As.
 type Error struct {
 	Message string
 	Frame   *frame.Frame
+	cause   error
 }
 
 func (e Error) Error() string {
 	return e.Message
 }
 
+// Unwrap returns the underlying cause of the error, if any.
+func (e Error) Unwrap() error {
+	return e.cause
+}
+
+// Is reports whether target is an error value without a frame, such
+// as ErrConnectionClosed, that has the same message as e. Errors created
+// by the client without a frame are the same error if their messages are
+// the same, even if one of them wraps a more specific cause.
+func (e Error) Is(target error) bool {
+	var t Error
+	switch target := target.(type) {
+	case Error:
+		t = target
+	case *Error:
+		if target == nil {
+			return false
+		}
+		t = *target
+	default:
+		return false
+	}
+	return e.Frame == nil && t.Frame == nil && t.cause == nil && e.Message == t.Message
+}
+
+// A BrokerError describes an ERROR frame received from the STOMP server.
+type BrokerError struct {
+	// The ERROR frame.
+	Frame *frame.Frame
+
+	// Value of the "message" header, which is a short description
+	// of the error. Empty if the server did not send the header.
+	Message string
+
+	// The body of the ERROR frame, which may describe the
+	// error in more detail.
+	Body []byte
+}
+
+func (e *BrokerError) Error() string {
+	if e.Message == "" {
+		return "ERROR frame, missing message header"
+	}
+	return e.Message
+}
+
 func newErrorMessage(msg string) Error {
 	return Error{Message: msg}
 }
 
+// newReadTimeoutError describes a heart-beat read timeout in
+// more detail than ErrReadTimeout, which it wraps.
+func newReadTimeoutError(elapsed, deadline time.Duration) Error {
+	return Error{
+		Message: fmt.Sprintf("%s: no frame received for %v, deadline %v", ErrReadTimeout.Message, elapsed, deadline),
+		cause:   ErrReadTimeout,
+	}
+}
+
+// newFrameTooLargeError describes a frame received from the server that
+// exceeds the limits of ConnOpt.MaxFrameSize or ConnOpt.MaxHeaders, in more
+// detail than ErrFrameTooLarge, which it wraps.
+func newFrameTooLargeError(err error) Error {
+	return Error{Message: err.Error(), cause: ErrFrameTooLarge}
+}
+
+// newInvalidFrameError describes a frame rejected by the checks of
+// ConnOpt.ValidateFrames, in more detail than ErrInvalidFrame, which
+// it wraps.
+func newInvalidFrameError(problem string) Error {
+	return Error{Message: ErrInvalidFrame.Message + ": " + problem, cause: ErrInvalidFrame}
+}
+
+// newSubscriptionCancelledError is the cause of the error for an ERROR
+// frame that cancels a subscription. It wraps the BrokerError for the
+// frame, and matches ErrSubscriptionCancelledByBroker.
+func newSubscriptionCancelledError(f *frame.Frame) Error {
+	return Error{Message: ErrSubscriptionCancelledByBroker.Message, cause: errorFrameCause(f, nil)}
+}
+
+// newSubscriptionIdInUseError describes a subscription whose id is
+// already used by an active subscription, in more detail than
+// ErrSubscriptionIdInUse, which it wraps.
+func newSubscriptionIdInUseError(id string) Error {
+	return Error{Message: fmt.Sprintf("%s: %q", ErrSubscriptionIdInUse.Message, id), cause: ErrSubscriptionIdInUse}
+}
+
+// newContextError wraps the error from a done context.
+func newContextError(err error) Error {
+	return Error{Message: err.Error(), cause: err}
+}
+
+// localErrorHeader is the header entry of the ERROR frames that the
+// processing loop sends to the goroutines waiting for a response, to
+// report an error detected by the client. These frames never leave
+// the client.
+const localErrorHeader = "local-error"
+
+func newErrorFrame(err error) *frame.Frame {
+	return frame.New(frame.ERROR, frame.Message, err.Error(), localErrorHeader, "true")
+}
+
+// errorFrameCause returns the error reported by an ERROR frame. If the
+// frame was created by the client, failure is the error that caused the
+// connection to fail, if known.
+func errorFrameCause(f *frame.Frame, failure error) error {
+	message := f.Header.Get(frame.Message)
+	if _, ok := f.Header.Contains(localErrorHeader); !ok {
+		return &BrokerError{Frame: f, Message: message, Body: f.Body}
+	}
+	if failure != nil && failure.Error() == message {
+		return failure
+	}
+	e := Error{Message: message}
+	if failure != nil && e == ErrConnectionClosed {
+		e.cause = failure
+	}
+	return e
+}
+
 func newError(f *frame.Frame) Error {
 	e := Error{Frame: f}
 
@@ -50,6 +210,7 @@ func newError(f *frame.Frame) Error {
 		} else {
 			e.Message = "ERROR frame, missing message header"
 		}
+		e.cause = errorFrameCause(f, nil)
 	} else {
 		e.Message = "Unexpected frame: " + f.Command
 	}
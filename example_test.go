@@ -2,6 +2,7 @@ package stomp_test
 
 import (
 	"fmt"
+	"log"
 	"net"
 	"time"
 
@@ -9,30 +10,36 @@ import (
 	"github.com/go-stomp/stomp/frame"
 )
 
-func ExampleConn_Send(c *stomp.Conn) error {
+func ExampleConn_Send() {
+	c, err := stomp.Dial("tcp", "localhost:61613")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer c.Disconnect()
+
 	// send with receipt and an optional header
-	err := c.Send(
+	err = c.Send(
 		"/queue/test-1",            // destination
 		"text/plain",               // content-type
 		[]byte("Message number 1"), // body
 		stomp.SendOpt.Receipt,
 		stomp.SendOpt.Header("expires", "2049-12-31 23:59:59"))
 	if err != nil {
-		return err
+		log.Println(err)
+		return
 	}
 
 	// send with no receipt and no optional headers
 	err = c.Send("/queue/test-2", "application/xml",
 		[]byte("<message>hello</message>"))
 	if err != nil {
-		return err
+		log.Println(err)
 	}
-
-	return nil
 }
 
 // Creates a new Header.
-func ExampleNewHeader() {
+func Example_newHeader() {
 	/*
 		Creates a header that looks like the following:
 
@@ -50,7 +57,7 @@ func ExampleNewHeader() {
 }
 
 // Creates a STOMP frame.
-func ExampleNewFrame() {
+func Example_newFrame() {
 	/*
 		Creates a STOMP frame that looks like the following:
 
@@ -78,22 +85,26 @@ func doAnotherThingWith(f interface{}, g interface{}) {
 
 }
 
-func ExampleConn_Subscribe_1() error {
+func ExampleConn_Subscribe_first() {
 	conn, err := stomp.Dial("tcp", "localhost:61613")
 	if err != nil {
-		return err
+		log.Println(err)
+		return
 	}
+	defer conn.Disconnect()
 
 	sub, err := conn.Subscribe("/queue/test-2", stomp.AckClient)
 	if err != nil {
-		return err
+		log.Println(err)
+		return
 	}
 
 	// receive 5 messages and then quit
 	for i := 0; i < 5; i++ {
 		msg := <-sub.C
 		if msg.Err != nil {
-			return msg.Err
+			log.Println(msg.Err)
+			return
 		}
 
 		doSomethingWith(msg)
@@ -101,55 +112,64 @@ func ExampleConn_Subscribe_1() error {
 		// acknowledge the message
 		err = conn.Ack(msg)
 		if err != nil {
-			return err
+			log.Println(err)
+			return
 		}
 	}
 
 	err = sub.Unsubscribe()
 	if err != nil {
-		return err
+		log.Println(err)
 	}
-
-	return conn.Disconnect()
 }
 
 // Example of creating subscriptions with various options.
-func ExampleConn_Subscribe_2(c *stomp.Conn) error {
+func ExampleConn_Subscribe_second() {
+	c, err := stomp.Dial("tcp", "localhost:61613")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer c.Disconnect()
+
 	// Subscribe to queue with automatic acknowledgement
 	sub1, err := c.Subscribe("/queue/test-1", stomp.AckAuto)
 	if err != nil {
-		return err
+		log.Println(err)
+		return
 	}
 
 	// Subscribe to queue with client acknowledgement and a custom header value
 	sub2, err := c.Subscribe("/queue/test-2", stomp.AckClient,
 		stomp.SubscribeOpt.Header("x-custom-header", "some-value"))
 	if err != nil {
-		return err
+		log.Println(err)
+		return
 	}
 
 	doSomethingWith(sub1, sub2)
-
-	return nil
 }
 
-func ExampleTransaction() error {
+func ExampleTransaction() {
 	conn, err := stomp.Dial("tcp", "localhost:61613")
 	if err != nil {
-		return err
+		log.Println(err)
+		return
 	}
 	defer conn.Disconnect()
 
 	sub, err := conn.Subscribe("/queue/test-2", stomp.AckClient)
 	if err != nil {
-		return err
+		log.Println(err)
+		return
 	}
 
 	// receive 5 messages and then quit
 	for i := 0; i < 5; i++ {
 		msg := <-sub.C
 		if msg.Err != nil {
-			return msg.Err
+			log.Println(msg.Err)
+			return
 		}
 
 		tx := conn.Begin()
@@ -162,46 +182,48 @@ func ExampleTransaction() error {
 		// acknowledge the message
 		err = tx.Ack(msg)
 		if err != nil {
-			return err
+			log.Println(err)
+			return
 		}
 
 		err = tx.Commit()
 		if err != nil {
-			return err
+			log.Println(err)
+			return
 		}
 	}
 
 	err = sub.Unsubscribe()
 	if err != nil {
-		return err
+		log.Println(err)
 	}
-
-	return nil
 }
 
 // Example of connecting to a STOMP server using an existing network connection.
-func ExampleConnect() error {
+func ExampleConnect() {
 	netConn, err := net.DialTimeout("tcp", "stomp.server.com:61613", 10*time.Second)
 	if err != nil {
-		return err
+		log.Println(err)
+		return
 	}
 
 	stompConn, err := stomp.Connect(netConn)
 	if err != nil {
-		return err
+		log.Println(err)
+		return
 	}
 
 	defer stompConn.Disconnect()
 
 	doSomethingWith(stompConn)
-	return nil
 }
 
 // Connect to a STOMP server using default options.
-func ExampleDial_1() error {
+func ExampleDial_defaults() {
 	conn, err := stomp.Dial("tcp", "192.168.1.1:61613")
 	if err != nil {
-		return err
+		log.Println(err)
+		return
 	}
 
 	err = conn.Send(
@@ -209,17 +231,20 @@ func ExampleDial_1() error {
 		"text/plain",              // content-type
 		[]byte("Test message #1")) // body
 	if err != nil {
-		return err
+		log.Println(err)
+		return
 	}
 
-	return conn.Disconnect()
+	if err = conn.Disconnect(); err != nil {
+		log.Println(err)
+	}
 }
 
 // Connect to a STOMP server that requires authentication. In addition,
 // we are only prepared to use STOMP protocol version 1.1 or 1.2, and
 // the virtual host is named "dragon". In this example the STOMP
 // server also accepts a non-standard header called 'nonce'.
-func ExampleDial_2() error {
+func ExampleDial_options() {
 	conn, err := stomp.Dial("tcp", "192.168.1.1:61613",
 		stomp.ConnOpt.Login("scott", "leopard"),
 		stomp.ConnOpt.AcceptVersion(stomp.V11),
@@ -227,7 +252,8 @@ func ExampleDial_2() error {
 		stomp.ConnOpt.Host("dragon"),
 		stomp.ConnOpt.Header("nonce", "B256B26D320A"))
 	if err != nil {
-		return err
+		log.Println(err)
+		return
 	}
 
 	err = conn.Send(
@@ -235,8 +261,11 @@ func ExampleDial_2() error {
 		"text/plain",              // content-type
 		[]byte("Test message #1")) // body
 	if err != nil {
-		return err
+		log.Println(err)
+		return
 	}
 
-	return conn.Disconnect()
+	if err = conn.Disconnect(); err != nil {
+		log.Println(err)
+	}
 }
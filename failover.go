@@ -0,0 +1,218 @@
+package stomp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPort is the port used for a broker in a failover URI
+// that does not specify one.
+const DefaultPort = "61613"
+
+// DialFailover connects to one of the STOMP servers listed in a failover
+// URI, in the style used by ActiveMQ clients:
+//
+//	failover:(tcp://a:61613,tcp://b:61613)?randomize=true
+//
+// The brokers are tried in the order listed, or in random order if the
+// randomize parameter is true, until the connect protocol sequence
+// succeeds with one of them. The connection is re-established automatically
+// if it fails, in the same way as DialWithReconnect, and each reconnect
+// attempt dials the next broker in the list. Conn.RemoteAddr returns the
+// address of the broker that the Conn is connected to.
+//
+// Brokers are specified with the "tcp" scheme, or with the "ssl" or "tls"
+// scheme to use TLS with the configuration specified by ConnOpt.TLSConfig.
+// The URI parameters are:
+//
+//	randomize              try the brokers in random order (default false)
+//	connectTimeout         limit on the time taken to connect to a broker
+//	maxReconnectAttempts   ReconnectPolicy.MaxAttempts
+//	initialReconnectDelay  ReconnectPolicy.InitialInterval
+//	maxReconnectDelay      ReconnectPolicy.MaxInterval
+//
+// Times are in milliseconds, or in the format accepted by time.ParseDuration.
+// Other parameters are ignored. The ConnOpt.ConnectTimeout and ConnOpt.Reconnect
+// options override the parameters.
+func DialFailover(uri string, opts ...func(*Conn) error) (*Conn, error) {
+	f, err := parseFailoverURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	if f.randomize {
+		rand.Shuffle(len(f.brokers), func(i, j int) {
+			f.brokers[i], f.brokers[j] = f.brokers[j], f.brokers[i]
+		})
+	}
+
+	// the parameters come first, so that options override them
+	params := []func(*Conn) error{
+		ConnOpt.ConnectTimeout(f.connectTimeout),
+		ConnOpt.Reconnect(f.policy),
+	}
+	opts = append(params, opts...)
+	opts = append(opts, func(c *Conn) error {
+		if c.options.Reconnect.Dial == nil {
+			c.options.Reconnect.Dial = func() (io.ReadWriteCloser, error) {
+				return f.dialNext()
+			}
+		}
+		return nil
+	})
+
+	options, err := newConnOptions(&Conn{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	f.options = options
+
+	var errs []error
+	for i := range f.brokers {
+		f.next = i
+		conn, err := f.dialNext()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		host, _, _ := net.SplitHostPort(f.brokers[i].addr)
+		c, err := Connect(conn, append([](func(*Conn) error){ConnOpt.Host(host)}, opts...)...)
+		if err != nil {
+			conn.Close()
+			errs = append(errs, fmt.Errorf("%s: %w", f.brokers[i].addr, err))
+			continue
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("failed to connect to any broker: %w", errors.Join(errs...))
+}
+
+// failoverBroker is a broker listed in a failover URI.
+type failoverBroker struct {
+	network string
+	addr    string
+	tls     bool
+}
+
+// failover holds the brokers and parameters of a failover URI.
+type failover struct {
+	brokers        []failoverBroker
+	randomize      bool
+	connectTimeout time.Duration
+	policy         ReconnectPolicy
+	options        *connOptions // the options for dialing
+	next           int          // the broker to dial next
+}
+
+// dialNext dials the next broker in the list.
+func (f *failover) dialNext() (net.Conn, error) {
+	b := f.brokers[f.next%len(f.brokers)]
+	f.next++
+
+	var config *tls.Config
+	if b.tls {
+		config = f.options.TLSConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+	}
+	return dialNetwork(context.Background(), b.network, b.addr, config, f.options)
+}
+
+// parseFailoverURI parses a failover URI, as described for DialFailover.
+func parseFailoverURI(uri string) (*failover, error) {
+	rest := strings.TrimPrefix(uri, "failover:")
+
+	var list, query string
+	if strings.HasPrefix(rest, "(") {
+		end := strings.Index(rest, ")")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid failover URI %q: missing ')'", uri)
+		}
+		list, rest = rest[1:end], rest[end+1:]
+		if rest != "" && !strings.HasPrefix(rest, "?") {
+			return nil, fmt.Errorf("invalid failover URI %q", uri)
+		}
+		query = strings.TrimPrefix(rest, "?")
+	} else {
+		list, query, _ = strings.Cut(rest, "?")
+	}
+
+	f := &failover{}
+	for _, s := range strings.Split(list, ",") {
+		b, err := parseFailoverBroker(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid failover URI %q: %w", uri, err)
+		}
+		f.brokers = append(f.brokers, b)
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid failover URI %q: %w", uri, err)
+	}
+	for key, values := range params {
+		value := values[0]
+		switch key {
+		case "randomize":
+			f.randomize, err = strconv.ParseBool(value)
+		case "connectTimeout":
+			f.connectTimeout, err = parseFailoverDuration(value)
+		case "maxReconnectAttempts":
+			f.policy.MaxAttempts, err = strconv.Atoi(value)
+		case "initialReconnectDelay":
+			f.policy.InitialInterval, err = parseFailoverDuration(value)
+		case "maxReconnectDelay":
+			f.policy.MaxInterval, err = parseFailoverDuration(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid failover URI %q: parameter %s: %w", uri, key, err)
+		}
+	}
+	return f, nil
+}
+
+func parseFailoverBroker(s string) (failoverBroker, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return failoverBroker{}, err
+	}
+	if u.Hostname() == "" {
+		return failoverBroker{}, fmt.Errorf("missing host: %q", s)
+	}
+
+	b := failoverBroker{network: "tcp"}
+	switch u.Scheme {
+	case "tcp", "tcp4", "tcp6":
+		b.network = u.Scheme
+	case "ssl", "tls":
+		b.tls = true
+	default:
+		return failoverBroker{}, fmt.Errorf("unsupported scheme: %q", s)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = DefaultPort
+	}
+	b.addr = net.JoinHostPort(u.Hostname(), port)
+	return b, nil
+}
+
+// parseFailoverDuration parses a number of milliseconds,
+// or a duration such as "5s".
+func parseFailoverDuration(s string) (time.Duration, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return time.ParseDuration(s)
+}
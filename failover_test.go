@@ -0,0 +1,169 @@
+package stomp
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+// listenStomp starts a STOMP server that completes the connect sequence
+// on each connection, and sends the connections on the returned channel.
+func listenStomp(c *C) (net.Listener, chan net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	return listener, serveStomp(listener)
+}
+
+// serveStomp completes the connect sequence on each connection accepted
+// by listener, and sends the connections on the returned channel.
+func serveStomp(listener net.Listener) chan net.Conn {
+	conns := make(chan net.Conn, 4)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go func() {
+				defer conn.Close()
+				reader := frame.NewReader(conn)
+				writer := frame.NewWriter(conn)
+				for {
+					f, err := reader.Read()
+					if err != nil {
+						return
+					}
+					switch {
+					case f == nil:
+					case f.Command == frame.CONNECT:
+						writer.Write(frame.New(frame.CONNECTED, frame.Version, "1.2"))
+					case f.Command == frame.DISCONNECT:
+						writer.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+					}
+				}
+			}()
+		}
+	}()
+	return conns
+}
+
+// unusedAddr returns an address that nothing is listening on.
+func unusedAddr(c *C) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func (s *StompSuite) Test_parse_failover_uri(c *C) {
+	f, err := parseFailoverURI("failover:(tcp://a:61613,ssl://b,tcp://[::1]:1234)" +
+		"?randomize=true&connectTimeout=500&maxReconnectAttempts=3&initialReconnectDelay=10ms&maxReconnectDelay=2s&useExponentialBackOff=true")
+	c.Assert(err, IsNil)
+	c.Check(f.brokers, DeepEquals, []failoverBroker{
+		{network: "tcp", addr: "a:61613"},
+		{network: "tcp", addr: "b:61613", tls: true},
+		{network: "tcp", addr: "[::1]:1234"},
+	})
+	c.Check(f.randomize, Equals, true)
+	c.Check(f.connectTimeout, Equals, 500*time.Millisecond)
+	c.Check(f.policy, DeepEquals, ReconnectPolicy{
+		MaxAttempts:     3,
+		InitialInterval: 10 * time.Millisecond,
+		MaxInterval:     2 * time.Second,
+	})
+
+	f, err = parseFailoverURI("failover:tcp://a:1,tcp://b:2")
+	c.Assert(err, IsNil)
+	c.Check(f.brokers, HasLen, 2)
+	c.Check(f.randomize, Equals, false)
+
+	for _, uri := range []string{
+		"failover:(tcp://a:1",
+		"failover:(tcp://a:1)x",
+		"failover:(http://a:1)",
+		"failover:()",
+		"failover:(tcp://a:1)?connectTimeout=soon",
+		"failover:(tcp://a:1)?randomize=maybe",
+	} {
+		_, err = parseFailoverURI(uri)
+		c.Check(err, NotNil, Commentf("%s", uri))
+	}
+}
+
+func (s *StompSuite) Test_dial_failover(c *C) {
+	listener, conns := listenStomp(c)
+	defer listener.Close()
+	dead := unusedAddr(c)
+
+	conn, err := DialFailover("failover:(tcp://" + dead + ",tcp://" + listener.Addr().String() + ")" +
+		"?initialReconnectDelay=1&connectTimeout=1s")
+	c.Assert(err, IsNil)
+	c.Check(conn.RemoteAddr().String(), Equals, listener.Addr().String())
+	server := <-conns
+
+	// reconnecting tries the dead broker, and then this one again
+	server.Close()
+	select {
+	case <-conns:
+	case <-time.After(5 * time.Second):
+		c.Fatal("did not reconnect")
+	}
+	for i := 0; i < 1000 && conn.State() != Connected; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(conn.State(), Equals, Connected)
+	c.Check(conn.RemoteAddr().String(), Equals, listener.Addr().String())
+
+	c.Check(conn.Disconnect(), IsNil)
+	c.Check(conn.RemoteAddr(), IsNil)
+}
+
+func (s *StompSuite) Test_dial_failover_host(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	hosts := make(chan string, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := frame.NewReader(conn)
+		writer := frame.NewWriter(conn)
+		f, err := reader.Read()
+		if err != nil {
+			return
+		}
+		hosts <- f.Header.Get(frame.Host)
+		writer.Write(frame.New(frame.CONNECTED, frame.Version, "1.2"))
+		if f, err = reader.Read(); err == nil && f != nil && f.Command == frame.DISCONNECT {
+			writer.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+		}
+	}()
+
+	// the host header entry is the host name in the URI, not the address
+	// that it resolves to
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	conn, err := DialFailover("failover:(tcp://localhost:" + port + ")")
+	c.Assert(err, IsNil)
+	c.Check(<-hosts, Equals, "localhost")
+	c.Check(conn.Disconnect(), IsNil)
+}
+
+func (s *StompSuite) Test_dial_failover_fails(c *C) {
+	_, err := DialFailover("failover:(tcp://" + unusedAddr(c) + ",tcp://" + unusedAddr(c) + ")")
+	c.Assert(err, NotNil)
+	c.Check(err, ErrorMatches, "failed to connect to any broker: (?s).*")
+
+	// options override the parameters
+	_, err = DialFailover("failover:(tcp://"+unusedAddr(c)+")?connectTimeout=1s", ConnOpt.ConnectTimeout(-1))
+	c.Check(errors.Is(err, ErrInvalidOptionValue), Equals, true)
+}
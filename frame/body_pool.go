@@ -0,0 +1,77 @@
+package frame
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// The sizes of the body buffers that are pooled. A buffer for a body has
+// the smallest of the sizes, each a power of two, that holds the body.
+// Larger bodies are allocated as usual.
+const (
+	minPooledBodyShift = 6  // 64 bytes
+	maxPooledBodyShift = 20 // 1 MiB
+)
+
+// bodyPools holds a pool of buffers for each size, as pointers so that
+// returning a buffer to its pool does not allocate.
+var bodyPools [maxPooledBodyShift - minPooledBodyShift + 1]sync.Pool
+
+// bodyPool returns the pool for buffers of n bytes, or nil if bodies of
+// n bytes are not pooled.
+func bodyPool(n int) (*sync.Pool, int) {
+	if n <= 0 || n > 1<<maxPooledBodyShift {
+		return nil, 0
+	}
+	shift := bits.Len(uint(n - 1))
+	if shift < minPooledBodyShift {
+		shift = minPooledBodyShift
+	}
+	return &bodyPools[shift-minPooledBodyShift], 1 << shift
+}
+
+// BodyPool makes the Reader take the buffers for the bodies of frames that
+// have a content-length header entry from a pool shared by all the Readers
+// that use the option, instead of allocating a new buffer for each body.
+// Calling Release on a frame returns its body to the pool, so that it can
+// be reused for a later frame. A frame that is not released is collected
+// as usual, so forgetting to release a frame only costs an allocation.
+func BodyPool() ReaderOption {
+	return func(r *Reader) {
+		r.bodyPool = true
+	}
+}
+
+// newBody returns a buffer of n bytes for the body of f, from the pool if
+// there is one for bodies of n bytes.
+func newBody(f *Frame, n int) []byte {
+	pool, size := bodyPool(n)
+	if pool == nil {
+		return make([]byte, n)
+	}
+	p, _ := pool.Get().(*[]byte)
+	if p == nil {
+		b := make([]byte, size)
+		p = &b
+	}
+	f.pooled = p
+	return (*p)[:n]
+}
+
+// Release returns the body of a frame read by a Reader created with the
+// BodyPool option to the pool, and sets Body to nil. The body must not be
+// used once the frame is released, by the caller or by anything that it
+// has passed the body to, since it is overwritten by a later frame; use
+// Clone to keep a copy. Release does nothing for other frames, and
+// calling it more than once has no further effect. It is not safe to call
+// Release from more than one goroutine at once.
+func (f *Frame) Release() {
+	if f.pooled == nil {
+		return
+	}
+	p := f.pooled
+	f.pooled = nil
+	f.Body = nil
+	pool, _ := bodyPool(cap(*p))
+	pool.Put(p)
+}
@@ -0,0 +1,93 @@
+package frame
+
+import (
+	"io"
+)
+
+// A BodyReader reads the body of a frame returned by Reader.ReadStreaming
+// from the input of the Reader. The Reader cannot read another frame until
+// the body has been read to the end, or the BodyReader has been closed.
+// A BodyReader is not safe for concurrent use.
+type BodyReader struct {
+	r         *Reader
+	remaining int // the number of bytes of the body not yet read
+	err       error
+	done      chan struct{} // closed once the body and the NUL byte have been read
+}
+
+// Read reads the body. It returns io.EOF at the end of the body.
+// If reading the input fails, the error is returned, and the Reader
+// returns the same error for the next frame.
+func (b *BodyReader) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.remaining == 0 {
+		b.finish(io.EOF)
+		return 0, b.err
+	}
+
+	if len(p) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.r.reader.Read(p)
+	b.remaining -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		b.finish(err)
+		return n, err
+	}
+	if b.remaining == 0 {
+		// the NUL byte is read now, so that the Reader can
+		// read the next frame without waiting for io.EOF
+		b.finish(io.EOF)
+	}
+	return n, nil
+}
+
+// Close discards the part of the body that has not been read, so that
+// the Reader can read the next frame. Reading after Close returns io.EOF.
+func (b *BodyReader) Close() error {
+	if b.err == nil {
+		if _, err := io.CopyN(io.Discard, b.r.reader, int64(b.remaining)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			b.finish(err)
+			return err
+		}
+		b.remaining = 0
+		b.finish(io.EOF)
+	}
+	if b.err != io.EOF {
+		return b.err
+	}
+	return nil
+}
+
+// Done returns a channel that is closed once the body has been read to
+// the end, the BodyReader has been closed, or reading the input has failed.
+func (b *BodyReader) Done() <-chan struct{} {
+	return b.done
+}
+
+// finish ends the body with err, which is io.EOF if the body has been
+// read, and releases the Reader.
+func (b *BodyReader) finish(err error) {
+	if b.err != nil {
+		return
+	}
+	if err == io.EOF {
+		err = b.r.readTerminator()
+		if err == nil {
+			err = io.EOF
+		}
+	}
+	b.err = err
+	if err != io.EOF {
+		b.r.err = err
+	}
+	close(b.done)
+}
@@ -2,9 +2,42 @@ package frame
 
 import (
 	"bytes"
+	"io"
 	"strings"
 )
 
+// escaping identifies the header value encoding of a STOMP protocol version.
+type escaping int
+
+const (
+	escape12   escaping = iota // STOMP 1.2 encodes \r, \n, : and \, the default
+	escape11                   // STOMP 1.1 encodes \n, : and \
+	escapeNone                 // STOMP 1.0 has no encoding
+)
+
+// escapingFor returns the header value encoding of a protocol version,
+// such as "1.1".
+func escapingFor(version string) escaping {
+	switch version {
+	case "1.0":
+		return escapeNone
+	case "1.1":
+		return escape11
+	}
+	return escape12
+}
+
+// forCommand returns the encoding used by frames with the command. The
+// CONNECT and CONNECTED frames are not encoded, so that they can be read
+// by STOMP 1.0 peers.
+func (e escaping) forCommand(command string) escaping {
+	switch command {
+	case CONNECT, STOMP, CONNECTED:
+		return escapeNone
+	}
+	return e
+}
+
 var (
 	replacerForEncodeValue = strings.NewReplacer(
 		"\\", "\\\\",
@@ -12,25 +45,77 @@ var (
 		"\n", "\\n",
 		":", "\\c",
 	)
-	replacerForUnencodeValue = strings.NewReplacer(
-		"\\r", "\r",
-		"\\n", "\n",
-		"\\c", ":",
-		"\\\\", "\\",
+	replacerForEncodeValue11 = strings.NewReplacer(
+		"\\", "\\\\",
+		"\n", "\\n",
+		":", "\\c",
 	)
 )
 
 // Encodes a header value using STOMP value encoding
-func encodeValue(s string) []byte {
+func encodeValue(s string, e escaping) []byte {
 	var buf bytes.Buffer
 	buf.Grow(len(s))
-	replacerForEncodeValue.WriteString(&buf, s)
+	writeValue(&buf, s, e)
 	return buf.Bytes()
 }
 
-// Unencodes a header value using STOMP value encoding
-// TODO: return error if invalid sequences found (eg "\t")
-func unencodeValue(b []byte) (string, error) {
-	s := replacerForUnencodeValue.Replace(string(b))
-	return s, nil
+// stringWriter is implemented by the buffers that values are written to.
+type stringWriter interface {
+	io.Writer
+	io.StringWriter
+}
+
+// writeValue writes a header value to w using STOMP value encoding. A
+// value that needs no encoding, which is the usual case, is written as
+// it is without being copied.
+func writeValue(w stringWriter, s string, e escaping) error {
+	var err error
+	switch {
+	case e == escape12 && strings.ContainsAny(s, "\\\r\n:"):
+		_, err = replacerForEncodeValue.WriteString(w, s)
+	case e == escape11 && strings.ContainsAny(s, "\\\n:"):
+		_, err = replacerForEncodeValue11.WriteString(w, s)
+	default:
+		_, err = w.WriteString(s)
+	}
+	return err
+}
+
+// Unencodes a header value using STOMP value encoding. Returns
+// ErrInvalidFrameFormat if the value contains an escape sequence
+// that is not defined by the encoding.
+func unencodeValue(b []byte, e escaping) (string, error) {
+	if e == escapeNone || bytes.IndexByte(b, '\\') < 0 {
+		return string(b), nil
+	}
+
+	var s strings.Builder
+	s.Grow(len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] != '\\' {
+			s.WriteByte(b[i])
+			continue
+		}
+		i++
+		if i == len(b) {
+			return "", ErrInvalidFrameFormat
+		}
+		switch b[i] {
+		case 'n':
+			s.WriteByte('\n')
+		case 'c':
+			s.WriteByte(':')
+		case '\\':
+			s.WriteByte('\\')
+		case 'r':
+			if e != escape12 {
+				return "", ErrInvalidFrameFormat
+			}
+			s.WriteByte('\r')
+		default:
+			return "", ErrInvalidFrameFormat
+		}
+	}
+	return s.String(), nil
 }
@@ -1,6 +1,9 @@
 package frame
 
 import (
+	"bytes"
+	"strings"
+
 	. "gopkg.in/check.v1"
 )
 
@@ -9,12 +12,128 @@ type EncodeSuite struct{}
 var _ = Suite(&EncodeSuite{})
 
 func (s *EncodeSuite) TestEncodeValue(c *C) {
-	val := encodeValue("Contains\r\nNewLine and : colon and \\ backslash")
+	val := encodeValue("Contains\r\nNewLine and : colon and \\ backslash", escape12)
 	c.Check(string(val), Equals, `Contains\r\nNewLine and \c colon and \\ backslash`)
+
+	val = encodeValue("Contains\r\nNewLine and : colon and \\ backslash", escape11)
+	c.Check(string(val), Equals, "Contains\r\\nNewLine and \\c colon and \\\\ backslash")
+
+	val = encodeValue("Contains\r\nNewLine and : colon and \\ backslash", escapeNone)
+	c.Check(string(val), Equals, "Contains\r\nNewLine and : colon and \\ backslash")
 }
 
 func (s *EncodeSuite) TestUnencodeValue(c *C) {
-	val, err := unencodeValue([]byte(`Contains\r\nNewLine and \c colon and \\ backslash`))
+	val, err := unencodeValue([]byte(`Contains\r\nNewLine and \c colon and \\ backslash`), escape12)
 	c.Check(err, IsNil)
 	c.Check(val, Equals, "Contains\r\nNewLine and : colon and \\ backslash")
+
+	val, err = unencodeValue([]byte(`Contains\nNewLine and \c colon and \\ backslash`), escape11)
+	c.Check(err, IsNil)
+	c.Check(val, Equals, "Contains\nNewLine and : colon and \\ backslash")
+
+	val, err = unencodeValue([]byte(`C:\\r\n`), escapeNone)
+	c.Check(err, IsNil)
+	c.Check(val, Equals, `C:\\r\n`)
+}
+
+func (s *EncodeSuite) TestUnencodeInvalid(c *C) {
+	for _, value := range []string{`\t`, `tab\t`, `ends with \`, `\C`, `\\\`, `\ `} {
+		for _, e := range []escaping{escape12, escape11} {
+			_, err := unencodeValue([]byte(value), e)
+			c.Check(err, Equals, ErrInvalidFrameFormat, Commentf("%q", value))
+		}
+	}
+
+	// \r is defined by STOMP 1.2 only
+	_, err := unencodeValue([]byte(`a\rb`), escape11)
+	c.Check(err, Equals, ErrInvalidFrameFormat)
+}
+
+func (s *EncodeSuite) TestRoundTrip(c *C) {
+	values := []string{
+		"",
+		"plain",
+		":",
+		"a:b:c",
+		"\\",
+		"\\\\",
+		`\n`,
+		`\c`,
+		`\r`,
+		`\\n`,
+		"\n",
+		"line one\nline two",
+		"C:\\Program Files\\stomp",
+		"\\:\n\\",
+		"trailing backslash \\",
+	}
+	for _, value := range values {
+		for _, e := range []escaping{escape12, escape11} {
+			val, err := unencodeValue(encodeValue(value, e), e)
+			c.Check(err, IsNil, Commentf("%q", value))
+			c.Check(val, Equals, value, Commentf("%q", value))
+		}
+		val, err := unencodeValue(encodeValue(value+"\r", escape12), escape12)
+		c.Check(err, IsNil)
+		c.Check(val, Equals, value+"\r")
+	}
+}
+
+func (s *EncodeSuite) TestWriteReadVersions(c *C) {
+	values := []string{"a:b", "line one\nline two", `C:\temp\new`, `\\`}
+	for _, version := range []string{"1.1", "1.2"} {
+		var b bytes.Buffer
+		writer := NewWriter(&b)
+		writer.SetVersion(version)
+		reader := NewReader(&b)
+		reader.SetVersion(version)
+
+		f := New(MESSAGE)
+		for _, value := range values {
+			f.Header.Add("key:"+value, value)
+		}
+		c.Assert(writer.Write(f), IsNil)
+		f2, err := reader.Read()
+		c.Assert(err, IsNil)
+		c.Check(f2.Header, DeepEquals, f.Header, Commentf("%s", version))
+	}
+
+	// STOMP 1.0 has no encoding, so the first colon ends the name
+	var b bytes.Buffer
+	writer := NewWriter(&b)
+	writer.SetVersion("1.0")
+	c.Assert(writer.Write(New(MESSAGE, "key", `a:b\c`)), IsNil)
+	c.Check(b.String(), Equals, "MESSAGE\nkey:a:b\\c\n\n\x00")
+	reader := NewReader(&b)
+	reader.SetVersion("1.0")
+	f, err := reader.Read()
+	c.Assert(err, IsNil)
+	c.Check(f.Header.Get("key"), Equals, `a:b\c`)
+}
+
+func (s *EncodeSuite) TestConnectNotEncoded(c *C) {
+	var b bytes.Buffer
+	writer := NewWriter(&b)
+	c.Assert(writer.Write(New(CONNECT, Login, "user:name", Passcode, `pass\word`)), IsNil)
+	c.Check(b.String(), Equals, "CONNECT\nlogin:user:name\npasscode:pass\\word\n\n\x00")
+
+	f, err := NewReader(&b).Read()
+	c.Assert(err, IsNil)
+	c.Check(f.Header.Get(Login), Equals, "user:name")
+	c.Check(f.Header.Get(Passcode), Equals, `pass\word`)
+}
+
+func (s *EncodeSuite) TestReadInvalidEscape(c *C) {
+	reader := NewReader(strings.NewReader("MESSAGE\nfile:C:\\temp\n\n\x00"))
+	_, err := reader.Read()
+	c.Check(err, ErrorMatches, `invalid frame format: invalid escape sequence in header "file"`)
+
+	reader = NewReader(strings.NewReader("MESSAGE\nbad\\tname:value\n\n\x00"))
+	_, err = reader.Read()
+	c.Check(err, ErrorMatches, `invalid frame format: invalid escape sequence in header name "bad\\\\tname"`)
+
+	reader = NewReader(strings.NewReader("MESSAGE\nkey:a\\rb\n\n\x00"))
+	reader.SetVersion("1.1")
+	_, err = reader.Read()
+	c.Check(err, ErrorMatches, `invalid frame format: invalid escape sequence in header "key"`)
 }
@@ -6,4 +6,6 @@ import (
 
 var (
 	ErrInvalidHeartBeat = errors.New("invalid heart-beat")
+	ErrUnreadBody       = errors.New("body of previous frame not read or closed")
+	ErrFrameTooLarge    = errors.New("frame too large")
 )
@@ -3,6 +3,14 @@ Package frame provides functionality for manipulating STOMP frames.
 */
 package frame
 
+import (
+	"bytes"
+	"fmt"
+)
+
+// The length at which String truncates the body of a frame.
+const stringBodyLength = 256
+
 // A Frame represents a STOMP frame. A frame consists of a command
 // followed by a collection of header entries, and then an optional
 // body.
@@ -10,6 +18,8 @@ type Frame struct {
 	Command string
 	Header  *Header
 	Body    []byte
+
+	pooled *[]byte // the buffer of Body, if it is taken from a pool
 }
 
 // New creates a new STOMP frame with the specified command and headers.
@@ -23,8 +33,9 @@ func New(command string, headers ...string) *Frame {
 	return f
 }
 
-// Clone creates a deep copy of the frame and its header. The cloned
-// frame shares the body with the original frame.
+// Clone creates a deep copy of the frame, its header and its body, so
+// that the copy can be used by another goroutine while the original
+// frame is changed.
 func (f *Frame) Clone() *Frame {
 	fc := &Frame{Command: f.Command}
 	if f.Header != nil {
@@ -36,3 +47,30 @@ func (f *Frame) Clone() *Frame {
 	}
 	return fc
 }
+
+// String returns the frame in the format in which it is written by a
+// Writer, with the body truncated to 256 bytes, for debug logging. It
+// is the same as StringTruncated(256).
+func (f *Frame) String() string {
+	return f.StringTruncated(stringBodyLength)
+}
+
+// StringTruncated returns the frame in the format in which it is written by
+// a Writer, with the STOMP 1.2 encoding of header values, except that the NUL
+// byte that ends the frame is omitted, and the body is truncated to maxBody
+// bytes. A truncated body is followed by the number of bytes omitted. If
+// maxBody is negative, the body is not truncated.
+func (f *Frame) StringTruncated(maxBody int) string {
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	w.writeHeader(f)
+	w.Flush()
+
+	if maxBody < 0 || len(f.Body) <= maxBody {
+		b.Write(f.Body)
+	} else {
+		b.Write(f.Body[:maxBody])
+		fmt.Fprintf(&b, "...(%d more bytes)", len(f.Body)-maxBody)
+	}
+	return b.String()
+}
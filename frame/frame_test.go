@@ -1,6 +1,7 @@
 package frame
 
 import (
+	"strings"
 	"testing"
 
 	. "gopkg.in/check.v1"
@@ -65,3 +66,33 @@ func (s *FrameSuite) TestClone(c *C) {
 		c.Check(f1.Body[i], Equals, f2.Body[i])
 	}
 }
+
+func (s *FrameSuite) TestCloneIsDeep(c *C) {
+	f1 := New(MESSAGE, Destination, "/queue/a", "x-death", "1")
+	f1.Body = []byte("body")
+	f2 := f1.Clone()
+
+	f1.Header.Set(Destination, "/queue/b")
+	f1.Header.Add("extra", "value")
+	f1.Body[0] = 'B'
+	c.Check(f2.Header.Get(Destination), Equals, "/queue/a")
+	c.Check(f2.Header.Len(), Equals, 2)
+	c.Check(string(f2.Body), Equals, "body")
+
+	h := f2.Header.Clone()
+	h.Del("x-death")
+	c.Check(f2.Header.Get("x-death"), Equals, "1")
+}
+
+func (s *FrameSuite) TestString(c *C) {
+	f := New(SEND, Destination, "/queue/a", "key", "a:b")
+	f.Body = []byte("hello")
+	c.Check(f.String(), Equals, "SEND\ndestination:/queue/a\nkey:a\\cb\n\nhello")
+	c.Check(f.StringTruncated(2), Equals, "SEND\ndestination:/queue/a\nkey:a\\cb\n\nhe...(3 more bytes)")
+	c.Check(f.StringTruncated(-1), Equals, f.String())
+
+	f.Body = []byte(strings.Repeat("x", 1000))
+	c.Check(strings.HasSuffix(f.String(), strings.Repeat("x", 256)+"...(744 more bytes)"), Equals, true)
+
+	c.Check((&Frame{Command: CONNECT}).String(), Equals, "CONNECT\n\n")
+}
@@ -29,6 +29,16 @@ const (
 	Subscription  = "subscription"
 	MessageId     = "message-id"
 	Message       = "message"
+	ReplyTo       = "reply-to"
+	CorrelationId = "correlation-id"
+	Redelivered   = "redelivered"
+	Selector      = "selector"
+	Persistent    = "persistent"
+	Priority      = "priority"
+	Expires       = "expires"
+	Expiration    = "expiration"
+	TraceParent   = "traceparent"
+	TraceState    = "tracestate"
 )
 
 // A Header represents the header part of a STOMP frame.
@@ -100,9 +110,11 @@ func (h *Header) Get(key string) string {
 	return value
 }
 
-// GetAll returns all of the values associated with a given key.
-// Normally there is only one header entry per key, but it is permitted
-// to have multiple entries according to the STOMP standard.
+// GetAll returns all of the values associated with a given key, in the
+// order of their header entries, or nil if there are none. Normally there
+// is only one header entry per key, but it is permitted to have multiple
+// entries according to the STOMP standard, and some servers repeat header
+// entries. Only the first value is significant to Get and Contains.
 func (h *Header) GetAll(key string) []string {
 	var values []string
 	for i := 0; i < len(h.slice); i += 2 {
@@ -121,6 +133,19 @@ func (h *Header) GetAt(index int) (key, value string) {
 	return h.slice[index], h.slice[index+1]
 }
 
+// Index returns the header name and value of the header entry at index i,
+// in the same way as GetAt. The header entries are in the order in which
+// they were added, or read from a frame, so iterating from 0 to Len()-1
+// visits repeated header entries in order:
+//
+//	for i := 0; i < h.Len(); i++ {
+//		key, value := h.Index(i)
+//		...
+//	}
+func (h *Header) Index(i int) (key, value string) {
+	return h.GetAt(i)
+}
+
 // Contains gets the first value associated with the given key,
 // and also returns a bool indicating whether the header entry
 // exists.
@@ -135,11 +160,21 @@ func (h *Header) Contains(key string) (value string, ok bool) {
 	return
 }
 
-// Del deletes all header entries with the specified key.
-func (h *Header) Del(key string) {
-	for i, ok := h.index(key); ok; i, ok = h.index(key) {
-		h.slice = append(h.slice[:i], h.slice[i+2:]...)
+// Del deletes all header entries with the specified key, and returns
+// the number of header entries deleted. The remaining header entries
+// keep their order.
+func (h *Header) Del(key string) int {
+	n, j := 0, 0
+	for i := 0; i < len(h.slice); i += 2 {
+		if h.slice[i] == key {
+			n++
+			continue
+		}
+		h.slice[j], h.slice[j+1] = h.slice[i], h.slice[i+1]
+		j += 2
 	}
+	h.slice = h.slice[:j]
+	return n
 }
 
 // Len returns the number of header entries in the header.
@@ -147,8 +182,12 @@ func (h *Header) Len() int {
 	return len(h.slice) / 2
 }
 
-// Clone returns a deep copy of a Header.
+// Clone returns a deep copy of a Header, which can be used by another
+// goroutine while h is changed. Returns nil if h is nil.
 func (h *Header) Clone() *Header {
+	if h == nil {
+		return nil
+	}
 	hc := &Header{slice: make([]string, len(h.slice))}
 	copy(hc.slice, h.slice)
 	return hc
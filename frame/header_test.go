@@ -17,6 +17,41 @@ func (s *FrameSuite) TestHeaderGetSetAddDel(c *C) {
 	c.Assert(h.Get("xxx"), Equals, "")
 }
 
+func (s *FrameSuite) TestHeaderRepeated(c *C) {
+	h := NewHeader(
+		"x-death", "first",
+		"destination", "/queue/a",
+		"x-death", "second",
+		"other", "1",
+		"x-death", "third")
+
+	// only the first value is significant
+	c.Check(h.Get("x-death"), Equals, "first")
+	value, ok := h.Contains("x-death")
+	c.Check(value, Equals, "first")
+	c.Check(ok, Equals, true)
+	c.Check(h.GetAll("x-death"), DeepEquals, []string{"first", "second", "third"})
+	c.Check(h.GetAll("missing"), IsNil)
+
+	var keys, values []string
+	for i := 0; i < h.Len(); i++ {
+		key, value := h.Index(i)
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	c.Check(keys, DeepEquals, []string{"x-death", "destination", "x-death", "other", "x-death"})
+	c.Check(values, DeepEquals, []string{"first", "/queue/a", "second", "1", "third"})
+
+	// the remaining entries keep their order
+	c.Check(h.Del("x-death"), Equals, 3)
+	c.Check(h.Del("x-death"), Equals, 0)
+	c.Check(h.Len(), Equals, 2)
+	key, value := h.Index(0)
+	c.Check(key+"="+value, Equals, "destination=/queue/a")
+	key, value = h.Index(1)
+	c.Check(key+"="+value, Equals, "other=1")
+}
+
 func (s *FrameSuite) TestHeaderClone(c *C) {
 	h := Header{}
 	h.Set("xxx", "yyy")
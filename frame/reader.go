@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -26,18 +27,102 @@ var (
 // A STOMP frame is rejected if its command and header section exceed
 // the buffer size.
 type Reader struct {
-	reader *bufio.Reader
+	reader         *bufio.Reader
+	counter        *countingReader
+	body           *BodyReader // the body of the previous frame, if streamed
+	err            error       // set if reading a streamed body failed
+	maxFrameSize   int         // limits are zero if there is no limit
+	maxHeaders     int
+	maxHeaderBytes int
+	headerBytes    int // bytes of the command and header read so far
+	escaping       escaping
+	bodyPool       bool // bodies are taken from a pool, see BodyPool
+	anyCommand     bool // see AnyCommand
+}
+
+// A ReaderOption changes the frames that a Reader accepts, for example
+// by limiting them so that the input cannot make the Reader allocate an
+// unbounded amount of memory.
+type ReaderOption func(r *Reader)
+
+// MaxFrameSize limits the size of the body of a frame to n bytes. Read
+// returns an error that wraps ErrFrameTooLarge if the content-length header
+// entry of a frame is larger, or if a frame without one has a larger body.
+// Bodies streamed by ReadStreaming are not limited, since they are not held
+// in memory. Zero means no limit.
+func MaxFrameSize(n int) ReaderOption {
+	return func(r *Reader) {
+		r.maxFrameSize = n
+	}
+}
+
+// MaxHeaders limits the header of a frame to count header entries,
+// and the command and header lines to a total of bytes bytes, including
+// line endings. Read returns an error that wraps ErrFrameTooLarge if a
+// frame exceeds either limit. Zero means no limit.
+func MaxHeaders(count, bytes int) ReaderOption {
+	return func(r *Reader) {
+		r.maxHeaders = count
+		r.maxHeaderBytes = bytes
+	}
+}
+
+// AnyCommand accepts frames with commands that are not STOMP commands,
+// such as the extensions of some servers. The header entries of such
+// frames are unescaped as for a SEND frame. Without this option Read
+// returns ErrInvalidCommand for them.
+func AnyCommand() ReaderOption {
+	return func(r *Reader) {
+		r.anyCommand = true
+	}
 }
 
 // NewReader creates a Reader with the default underlying buffer size.
-func NewReader(reader io.Reader) *Reader {
-	return NewReaderSize(reader, bufferSize)
+func NewReader(reader io.Reader, opts ...ReaderOption) *Reader {
+	return NewReaderSize(reader, bufferSize, opts...)
 }
 
+// MinBufferSize is the smallest buffer of a Reader or Writer, which holds
+// a typical header line. A smaller size is raised to MinBufferSize.
+const MinBufferSize = 256
+
 // NewReaderSize creates a Reader with an underlying bufferSize
-// of the specified size.
-func NewReaderSize(reader io.Reader, bufferSize int) *Reader {
-	return &Reader{reader: bufio.NewReaderSize(reader, bufferSize)}
+// of the specified size, which is at least MinBufferSize.
+func NewReaderSize(reader io.Reader, bufferSize int, opts ...ReaderOption) *Reader {
+	if bufferSize < MinBufferSize {
+		bufferSize = MinBufferSize
+	}
+	counter := &countingReader{r: reader}
+	r := &Reader{reader: bufio.NewReaderSize(counter, bufferSize), counter: counter}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// countingReader counts the bytes read from an io.Reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// BufferSize returns the size of the underlying buffer.
+func (r *Reader) BufferSize() int {
+	return r.reader.Size()
+}
+
+// BytesRead returns the number of bytes of the frames and heart-beats read
+// so far, not including input that is buffered and not yet read. The size
+// of a frame is the difference before and after reading it, and reading
+// its body, if streamed.
+func (r *Reader) BytesRead() int64 {
+	return r.counter.n - int64(r.reader.Buffered())
 }
 
 // Read a STOMP frame from the input. If the input contains one
@@ -45,13 +130,81 @@ func NewReaderSize(reader io.Reader, bufferSize int) *Reader {
 // be returned for the frame. Calling programs should always check
 // for a nil frame.
 func (r *Reader) Read() (*Frame, error) {
+	f, err := r.readHeader()
+	if err != nil || f == nil {
+		return f, err
+	}
+	if err = r.readBody(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// SetVersion sets the STOMP protocol version, such as "1.1", whose encoding
+// of header values is used to decode the frames that follow. STOMP 1.0 has
+// no encoding, STOMP 1.1 defines the escape sequences \n, \c and \\, and
+// STOMP 1.2 also defines \r. The header values of CONNECT and CONNECTED
+// frames are never decoded. If the version is not set, or not recognised,
+// the STOMP 1.2 encoding is used. A header value that contains an escape
+// sequence not defined by the version is reported as ErrInvalidFrameFormat.
+func (r *Reader) SetVersion(version string) {
+	r.escaping = escapingFor(version)
+}
+
+// ReadStreaming reads a STOMP frame from the input in the same way as Read,
+// except that if the frame has a content-length header entry and stream
+// returns true for the frame and its content length, the body is not read.
+// Instead the frame is returned with a nil body, together with a BodyReader
+// that reads the body from the input. The BodyReader is nil for other frames.
+//
+// The body must be read to the end, or the BodyReader closed, before the next
+// frame can be read: until then Read and ReadStreaming return ErrUnreadBody.
+func (r *Reader) ReadStreaming(stream func(f *Frame, contentLength int) bool) (*Frame, *BodyReader, error) {
+	f, err := r.readHeader()
+	if err != nil || f == nil {
+		return f, nil, err
+	}
+
+	contentLength, ok, err := f.Header.ContentLength()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok || !stream(f, contentLength) {
+		if err = r.readBody(f); err != nil {
+			return nil, nil, err
+		}
+		return f, nil, nil
+	}
+
+	r.body = &BodyReader{r: r, remaining: contentLength, done: make(chan struct{})}
+	return f, r.body, nil
+}
+
+// readHeader reads the command and header of a frame, or returns a nil
+// frame for a heart-beat.
+func (r *Reader) readHeader() (*Frame, error) {
+	if r.body != nil {
+		select {
+		case <-r.body.done:
+			r.body = nil
+		default:
+			return nil, ErrUnreadBody
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	r.headerBytes = 0
 	commandSlice, err := r.readLine()
 	if err != nil {
 		return nil, err
 	}
 
 	if len(commandSlice) == 0 {
-		// received a heart-beat newline char (or cr-lf)
+		// received a heart-beat newline char (or cr-lf), and any
+		// that follow it without a pause are the same heart-beat
+		r.skipEOLs()
 		return nil, nil
 	}
 
@@ -68,7 +221,9 @@ func (r *Reader) Read() (*Frame, error) {
 		MESSAGE, RECEIPT, ERROR:
 		// valid command
 	default:
-		return nil, ErrInvalidCommand
+		if !r.anyCommand {
+			return nil, ErrInvalidCommand
+		}
 	}
 
 	// read headers
@@ -82,6 +237,9 @@ func (r *Reader) Read() (*Frame, error) {
 			// empty line means end of headers
 			break
 		}
+		if r.maxHeaders > 0 && f.Header.Len() >= r.maxHeaders {
+			return nil, fmt.Errorf("%w: more than %d header entries", ErrFrameTooLarge, r.maxHeaders)
+		}
 
 		index := bytes.IndexByte(headerSlice, colon)
 		if index <= 0 {
@@ -89,69 +247,161 @@ func (r *Reader) Read() (*Frame, error) {
 			return nil, ErrInvalidFrameFormat
 		}
 
-		name, err := unencodeValue(headerSlice[0:index])
+		escaping := r.escaping.forCommand(f.Command)
+		name, err := unencodeValue(headerSlice[0:index], escaping)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: invalid escape sequence in header name %q", err, headerSlice[0:index])
 		}
-		value, err := unencodeValue(headerSlice[index+1:])
+		value, err := unencodeValue(headerSlice[index+1:], escaping)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: invalid escape sequence in header %q", err, name)
 		}
 
 		//println("   ", name, ":", value)
 
 		f.Header.Add(name, value)
 	}
+	return f, nil
+}
 
+// readBody reads the body of f, and the NUL byte that follows it.
+func (r *Reader) readBody(f *Frame) (err error) {
 	// get content length from the headers
 	if contentLength, ok, err := f.Header.ContentLength(); err != nil {
 		// happens if the content is malformed
-		return nil, err
+		return err
 	} else if ok {
+		if r.maxFrameSize > 0 && contentLength > r.maxFrameSize {
+			return fmt.Errorf("%w: content-length %d exceeds the limit of %d", ErrFrameTooLarge, contentLength, r.maxFrameSize)
+		}
 		// content length specified in the header, so use that
-		f.Body = make([]byte, contentLength)
-		for bytesRead := 0; bytesRead < contentLength; {
-			n, err := r.reader.Read(f.Body[bytesRead:contentLength])
-			if err != nil {
-				return nil, err
+		if r.bodyPool && contentLength <= maxPreallocatedBody {
+			f.Body = newBody(f, contentLength)
+			if _, err := io.ReadFull(r.reader, f.Body); err != nil {
+				f.Release()
+				return err
 			}
-			bytesRead += n
+		} else if f.Body, err = r.readN(contentLength); err != nil {
+			return err
 		}
+		return r.readTerminator()
+	}
 
-		// read the next byte and verify that it is a null byte
-		terminator, err := r.reader.ReadByte()
-		if err != nil {
-			return nil, err
-		}
-		if terminator != 0 {
-			return nil, ErrInvalidFrameFormat
+	limit := 0
+	if r.maxFrameSize > 0 {
+		limit = r.maxFrameSize + 1 // and the NUL
+	}
+	f.Body, err = r.readDelim(nullByte, limit)
+	if err == errLimit {
+		return fmt.Errorf("%w: body exceeds the limit of %d", ErrFrameTooLarge, r.maxFrameSize)
+	} else if err != nil {
+		return err
+	}
+	// remove trailing null
+	f.Body = f.Body[0 : len(f.Body)-1]
+	return nil
+}
+
+// The largest body buffer allocated before the body has been received.
+const maxPreallocatedBody = 1 << 20
+
+// readN reads a body of n bytes. Its buffer grows as the body is received,
+// so that a large content-length header entry does not allocate memory
+// for bytes that never arrive. An early end of the input is reported as
+// io.ErrUnexpectedEOF, as it is by BodyReader.
+func (r *Reader) readN(n int) ([]byte, error) {
+	b := make([]byte, 0, min(n, maxPreallocatedBody))
+	for len(b) < n {
+		if len(b) == cap(b) {
+			b = append(b, 0)[:len(b)]
 		}
-	} else {
-		f.Body, err = r.reader.ReadBytes(nullByte)
-		if err != nil {
+		m, err := r.reader.Read(b[len(b):min(n, cap(b))])
+		b = b[:len(b)+m]
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
 			return nil, err
 		}
-		// remove trailing null
-		f.Body = f.Body[0 : len(f.Body)-1]
 	}
+	return b, nil
+}
 
-	// pass back frame
-	return f, nil
+// readTerminator reads the next byte and verifies that it is a null byte.
+func (r *Reader) readTerminator() error {
+	terminator, err := r.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if terminator != 0 {
+		return ErrInvalidFrameFormat
+	}
+	return nil
+}
+
+// errLimit is returned by readDelim when the limit is reached.
+var errLimit = errors.New("limit reached")
+
+// readDelim reads until the first occurrence of delim, returning the bytes
+// up to and including delim. If limit is positive, errLimit is returned
+// once more than limit bytes would be read, without reading the rest.
+func (r *Reader) readDelim(delim byte, limit int) ([]byte, error) {
+	var b []byte
+	for {
+		slice, err := r.reader.ReadSlice(delim)
+		if limit > 0 && len(b)+len(slice) > limit {
+			return nil, errLimit
+		}
+		b = append(b, slice...)
+		if err != bufio.ErrBufferFull {
+			return b, err
+		}
+	}
 }
 
-// read one line from input and strip off terminating LF or terminating CR-LF
+// read one line from input and strip off terminating LF or terminating CR-LF,
+// whatever the protocol version
 func (r *Reader) readLine() (line []byte, err error) {
-	line, err = r.reader.ReadBytes(newline)
-	if err != nil {
+	limit := 0
+	if r.maxHeaderBytes > 0 {
+		limit = r.maxHeaderBytes - r.headerBytes
+		if limit <= 0 {
+			return nil, fmt.Errorf("%w: header exceeds the limit of %d bytes", ErrFrameTooLarge, r.maxHeaderBytes)
+		}
+	}
+	line, err = r.readDelim(newline, limit)
+	if err == errLimit {
+		return nil, fmt.Errorf("%w: header exceeds the limit of %d bytes", ErrFrameTooLarge, r.maxHeaderBytes)
+	} else if err != nil {
 		return
 	}
-
-	switch {
-	case bytes.HasSuffix(line, crlfSlice):
-		line = line[0 : len(line)-len(crlfSlice)]
-	case bytes.HasSuffix(line, newlineSlice):
-		line = line[0 : len(line)-len(newlineSlice)]
+	r.headerBytes += len(line)
+	if bytes.IndexByte(line, nullByte) >= 0 {
+		// a frame that ends before its header does
+		return nil, ErrInvalidFrameFormat
 	}
 
+	// a CR is never part of a command or header value: STOMP 1.2
+	// encodes it as \r, and earlier versions have no way to send it
+	line = bytes.TrimRight(bytes.TrimSuffix(line, newlineSlice), "\r")
 	return
 }
+
+// skipEOLs discards the LF and CR-LF line endings that have been received
+// already, without waiting for more input.
+func (r *Reader) skipEOLs() {
+	for {
+		n := r.reader.Buffered()
+		if n > 2 {
+			n = 2
+		}
+		b, _ := r.reader.Peek(n)
+		switch {
+		case len(b) > 0 && b[0] == newline:
+			r.reader.Discard(1)
+		case bytes.Equal(b, crlfSlice):
+			r.reader.Discard(2)
+		default:
+			return
+		}
+	}
+}
@@ -1,8 +1,14 @@
 package frame
 
 import (
+	"bytes"
+	"errors"
 	"io"
+	"math/rand"
+	"regexp"
+	"strconv"
 	"strings"
+	"testing"
 	"testing/iotest"
 
 	. "gopkg.in/check.v1"
@@ -29,7 +35,7 @@ func (s *ReaderSuite) TestConnect(c *C) {
 func (s *ReaderSuite) TestMultipleReads(c *C) {
 	text := "SEND\ndestination:xxx\n\nPayload\x00\n" +
 		"SEND\ndestination:yyy\ncontent-length:12\n" +
-		"dodgy\\c\\n\\cheader:dodgy\\c\\n\\r\\nvalue\\  \\\n\n" +
+		"dodgy\\c\\n\\cheader:dodgy\\c\\n\\r\\nvalue\\\\  \\\\\n\n" +
 		"123456789AB\x00\x00"
 
 	ioreaders := []io.Reader{
@@ -81,6 +87,85 @@ func (s *ReaderSuite) TestMultipleReads(c *C) {
 	}
 }
 
+func (s *ReaderSuite) TestLineEndings(c *C) {
+	eols := []string{"\n", "\r\n"}
+	random := rand.New(rand.NewSource(1))
+	eol := func() string {
+		return eols[random.Intn(len(eols))]
+	}
+
+	for i := 0; i < 200; i++ {
+		// frames with mixed line endings, separated by heart-beats
+		var text strings.Builder
+		count := 1 + random.Intn(5)
+		for j := 0; j < count; j++ {
+			for k := random.Intn(4); k > 0; k-- {
+				text.WriteString(eol())
+			}
+			text.WriteString("MESSAGE" + eol())
+			text.WriteString("destination:/queue/test" + eol())
+			text.WriteString("message-id:" + strconv.Itoa(j) + eol())
+			if j%2 == 0 {
+				text.WriteString("content-length:4" + eol())
+			}
+			text.WriteString(eol() + "body\x00")
+		}
+		text.WriteString(eol())
+
+		ioreaders := []io.Reader{
+			strings.NewReader(text.String()),
+			iotest.OneByteReader(strings.NewReader(text.String())),
+		}
+		for _, ioreader := range ioreaders {
+			reader := NewReader(ioreader)
+			reader.SetVersion([]string{"1.0", "1.1", "1.2"}[i%3])
+			comment := Commentf("input %q", text.String())
+			for j := 0; j < count; {
+				f, err := reader.Read()
+				c.Assert(err, IsNil, comment)
+				if f == nil {
+					continue
+				}
+				c.Assert(f.Command, Equals, "MESSAGE", comment)
+				c.Assert(f.Header.Get("destination"), Equals, "/queue/test", comment)
+				c.Assert(f.Header.Get("message-id"), Equals, strconv.Itoa(j), comment)
+				c.Assert(string(f.Body), Equals, "body", comment)
+				j++
+			}
+			for {
+				f, err := reader.Read()
+				c.Assert(f, IsNil, comment)
+				if err != nil {
+					c.Assert(err, Equals, io.EOF, comment)
+					break
+				}
+			}
+		}
+	}
+}
+
+func (s *ReaderSuite) TestHeartBeats(c *C) {
+	// EOLs received together are a single heart-beat
+	reader := NewReader(strings.NewReader("\n\r\n\n\r\nRECEIPT\r\nreceipt-id:1\r\r\n\r\n\x00\r\n\n"))
+
+	f, err := reader.Read()
+	c.Assert(err, IsNil)
+	c.Check(f, IsNil)
+
+	f, err = reader.Read()
+	c.Assert(err, IsNil)
+	c.Assert(f, NotNil)
+	c.Check(f.Command, Equals, "RECEIPT")
+	c.Check(f.Header.Get("receipt-id"), Equals, "1")
+
+	f, err = reader.Read()
+	c.Assert(err, IsNil)
+	c.Check(f, IsNil)
+
+	_, err = reader.Read()
+	c.Check(err, Equals, io.EOF)
+}
+
 func (s *ReaderSuite) TestSendWithContentLength(c *C) {
 	reader := NewReader(strings.NewReader("SEND\ndestination:xxx\ncontent-length:5\n\n\x00\x01\x02\x03\x04\x00"))
 
@@ -108,6 +193,16 @@ func (s *ReaderSuite) TestInvalidCommand(c *C) {
 	c.Check(err.Error(), Equals, "invalid command")
 }
 
+func (s *ReaderSuite) TestAnyCommand(c *C) {
+	reader := NewReader(strings.NewReader("MANAGE\nop:list\\cqueues\n\nbody\x00"), AnyCommand())
+
+	frame, err := reader.Read()
+	c.Assert(err, IsNil)
+	c.Check(frame.Command, Equals, "MANAGE")
+	c.Check(frame.Header.Get("op"), Equals, "list:queues")
+	c.Check(string(frame.Body), Equals, "body")
+}
+
 func (s *ReaderSuite) TestMissingNull(c *C) {
 	reader := NewReader(strings.NewReader("SEND\ndeestination:xxx\ncontent-length:5\n\n\x00\x01\x02\x03\x04\n"))
 
@@ -138,3 +233,262 @@ func (s *ReaderSuite) TestUnsubscribeWithoutId(c *C) {
 	c.Assert(err, NotNil)
 	c.Check(err.Error(), Equals, "missing header: id")
 }
+
+func (s *ReaderSuite) TestReadStreaming(c *C) {
+	text := "MESSAGE\ndestination:a\ncontent-length:5\n\nhello\x00" +
+		"MESSAGE\ndestination:b\ncontent-length:2\n\nhi\x00" +
+		"MESSAGE\ndestination:c\ncontent-length:5\n\nworld\x00" +
+		"MESSAGE\ndestination:d\n\nend\x00"
+	reader := NewReader(iotest.OneByteReader(strings.NewReader(text)))
+	stream := func(f *Frame, contentLength int) bool {
+		return contentLength > 2
+	}
+
+	f, body, err := reader.ReadStreaming(stream)
+	c.Assert(err, IsNil)
+	c.Assert(body, NotNil)
+	c.Check(f.Header.Get(Destination), Equals, "a")
+	c.Check(f.Body, IsNil)
+
+	// the body must be read before the next frame
+	_, err = reader.Read()
+	c.Check(err, Equals, ErrUnreadBody)
+	b, err := io.ReadAll(body)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, "hello")
+	<-body.Done()
+
+	// a short body is read as usual
+	f, body, err = reader.ReadStreaming(stream)
+	c.Assert(err, IsNil)
+	c.Check(body, IsNil)
+	c.Check(string(f.Body), Equals, "hi")
+
+	// closing discards the rest of the body
+	f, body, err = reader.ReadStreaming(stream)
+	c.Assert(err, IsNil)
+	c.Assert(body, NotNil)
+	p := make([]byte, 2)
+	n, err := body.Read(p)
+	c.Check(err, IsNil)
+	c.Check(string(p[:n]), Equals, "w")
+	c.Check(body.Close(), IsNil)
+	n, err = body.Read(p)
+	c.Check(n, Equals, 0)
+	c.Check(err, Equals, io.EOF)
+
+	// a frame without content-length is never streamed
+	f, body, err = reader.ReadStreaming(stream)
+	c.Assert(err, IsNil)
+	c.Check(body, IsNil)
+	c.Check(string(f.Body), Equals, "end")
+}
+
+func (s *ReaderSuite) TestReadStreamingTruncated(c *C) {
+	reader := NewReader(strings.NewReader("MESSAGE\ncontent-length:5\n\nhel"))
+	_, body, err := reader.ReadStreaming(func(*Frame, int) bool { return true })
+	c.Assert(err, IsNil)
+	c.Check(body.Close(), Equals, io.ErrUnexpectedEOF)
+	_, err = reader.Read()
+	c.Check(err, Equals, io.ErrUnexpectedEOF)
+
+	reader = NewReader(strings.NewReader("MESSAGE\ncontent-length:2\n\nhiX"))
+	_, body, err = reader.ReadStreaming(func(*Frame, int) bool { return true })
+	c.Assert(err, IsNil)
+	_, err = io.ReadAll(body)
+	c.Check(err, Equals, ErrInvalidFrameFormat)
+}
+
+func (s *ReaderSuite) TestMaxFrameSize(c *C) {
+	text := "SEND\ncontent-length:4\n\n1234\x00" +
+		"SEND\n\n1234\x00" +
+		"SEND\ncontent-length:5\n\n12345\x00"
+	reader := NewReader(strings.NewReader(text), MaxFrameSize(4))
+	for i := 0; i < 2; i++ {
+		f, err := reader.Read()
+		c.Assert(err, IsNil)
+		c.Check(string(f.Body), Equals, "1234")
+	}
+	_, err := reader.Read()
+	c.Check(errors.Is(err, ErrFrameTooLarge), Equals, true)
+	c.Check(err, ErrorMatches, "frame too large: content-length 5 exceeds the limit of 4")
+
+	// without content-length, reading stops at the limit
+	reader = NewReaderSize(strings.NewReader("SEND\n\n"+strings.Repeat("x", 10000)), 16, MaxFrameSize(100))
+	_, err = reader.Read()
+	c.Check(err, ErrorMatches, "frame too large: body exceeds the limit of 100")
+
+	// streamed bodies are not limited
+	reader = NewReader(strings.NewReader("SEND\ncontent-length:5\n\n12345\x00"), MaxFrameSize(4))
+	_, body, err := reader.ReadStreaming(func(*Frame, int) bool { return true })
+	c.Assert(err, IsNil)
+	b, err := io.ReadAll(body)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, "12345")
+}
+
+func (s *ReaderSuite) TestMaxHeaders(c *C) {
+	text := "SEND\na:1\nb:2\n\n\x00" +
+		"SEND\na:1\nb:2\nc:3\n\n\x00"
+	reader := NewReader(strings.NewReader(text), MaxHeaders(2, 0))
+	_, err := reader.Read()
+	c.Assert(err, IsNil)
+	_, err = reader.Read()
+	c.Check(errors.Is(err, ErrFrameTooLarge), Equals, true)
+	c.Check(err, ErrorMatches, "frame too large: more than 2 header entries")
+
+	// the command and header lines are 5+4+4+1 bytes
+	reader = NewReader(strings.NewReader(text), MaxHeaders(0, 14))
+	_, err = reader.Read()
+	c.Assert(err, IsNil)
+	_, err = reader.Read()
+	c.Check(err, ErrorMatches, "frame too large: header exceeds the limit of 14 bytes")
+
+	reader = NewReaderSize(strings.NewReader("SEND\nlong:"+strings.Repeat("x", 10000)+"\n\n\x00"), 16, MaxHeaders(0, 100))
+	_, err = reader.Read()
+	c.Check(err, ErrorMatches, "frame too large: header exceeds the limit of 100 bytes")
+}
+
+func (s *ReaderSuite) TestBytesRead(c *C) {
+	first := "MESSAGE\ndestination:/queue/test\n\nhello\x00"
+	reader := NewReader(strings.NewReader(first + "\nRECEIPT\nreceipt-id:1\n\n\x00"))
+
+	_, err := reader.Read()
+	c.Assert(err, IsNil)
+	c.Check(reader.BytesRead(), Equals, int64(len(first)))
+
+	f, err := reader.Read()
+	c.Assert(err, IsNil)
+	c.Check(f, IsNil)
+	c.Check(reader.BytesRead(), Equals, int64(len(first)+1))
+
+	_, err = reader.Read()
+	c.Assert(err, IsNil)
+	c.Check(reader.BytesRead(), Equals, int64(len(first)+1+len("RECEIPT\nreceipt-id:1\n\n\x00")))
+}
+
+func (s *ReaderSuite) TestBufferSize(c *C) {
+	c.Check(NewReader(strings.NewReader("")).BufferSize(), Equals, 4096)
+	c.Check(NewReaderSize(strings.NewReader(""), 8192).BufferSize(), Equals, 8192)
+	c.Check(NewReaderSize(strings.NewReader(""), 8).BufferSize(), Equals, MinBufferSize)
+}
+
+func (s *ReaderSuite) TestBodyPool(c *C) {
+	input := "MESSAGE\ncontent-length:5\n\nhello\x00" +
+		"MESSAGE\ncontent-length:5\n\nworld\x00" +
+		"MESSAGE\n\nno content-length\x00"
+	reader := NewReader(strings.NewReader(input), BodyPool())
+
+	f1, err := reader.Read()
+	c.Assert(err, IsNil)
+	c.Check(string(f1.Body), Equals, "hello")
+	c.Check(cap(f1.Body), Equals, 1<<minPooledBodyShift)
+	clone := f1.Clone()
+	f1.Release()
+	c.Check(f1.Body, IsNil)
+	f1.Release()
+
+	// the released buffer may be reused, which does not change the clone
+	f2, err := reader.Read()
+	c.Assert(err, IsNil)
+	c.Check(string(f2.Body), Equals, "world")
+	c.Check(string(clone.Body), Equals, "hello")
+	clone.Release()
+	c.Check(string(clone.Body), Equals, "hello")
+
+	// a body without a content-length is not pooled
+	f3, err := reader.Read()
+	c.Assert(err, IsNil)
+	f3.Release()
+	c.Check(string(f3.Body), Equals, "no content-length")
+	c.Check(string(f2.Body), Equals, "world")
+
+	for _, size := range []struct{ n, cap int }{
+		{1, 64}, {64, 64}, {65, 128}, {1 << 20, 1 << 20}, {1<<20 + 1, 0}, {0, 0},
+	} {
+		_, cap := bodyPool(size.n)
+		c.Check(cap, Equals, size.cap, Commentf("%d", size.n))
+	}
+}
+
+// malformedFrames are inputs that the Reader must reject, including those
+// found by FuzzReadFrame, with the errors that Read returns.
+var malformedFrames = []struct {
+	input string
+	err   string
+}{
+	{"SEND\ncontent-length:-1\n\n\x00", `strconv.ParseUint: parsing "-1": invalid syntax`},
+	{"SEND\ncontent-length:99999999999\n\nabc\x00", `strconv.ParseUint: parsing "99999999999": value out of range`},
+	{"SEND\ncontent-length:4000000000\n\nabc\x00", "unexpected EOF"},
+	{"SEND\ncontent-length:3\n\nabcd\x00", "invalid frame format"},
+	{"SEND\ncontent-length:5\n\nabc", "unexpected EOF"},
+	{"SEND\ncontent-length:\n\n\x00", `strconv.ParseUint: parsing "": invalid syntax`},
+	{"SEND\nfoo:b\x00ar\n\n\x00", "invalid frame format"},
+	{"SEND\x00\n\n\x00", "invalid frame format"},
+	{"SEND\ndestination:/queue/a\x00MESSAGE\ndestination:/queue/b\n\n\x00", "invalid frame format"},
+	{"SEND\n:value\n\n\x00", "invalid frame format"},
+	{"SEND\nname\n\n\x00", "invalid frame format"},
+	{"SEND\nname:\\x\n\n\x00", `invalid frame format: invalid escape sequence in header "name"`},
+	{"SEND\nname:value\\\n\n\x00", `invalid frame format: invalid escape sequence in header "name"`},
+	{"SEND\nname:value\n", "EOF"},
+	{"SEND", "EOF"},
+}
+
+func (s *ReaderSuite) TestMalformedFrames(c *C) {
+	for _, tc := range malformedFrames {
+		reader := NewReader(strings.NewReader(tc.input), AnyCommand())
+		f, err := reader.Read()
+		c.Check(f, IsNil, Commentf("input %q", tc.input))
+		c.Check(err, ErrorMatches, regexp.QuoteMeta(tc.err), Commentf("input %q", tc.input))
+	}
+
+	// many header entries are limited by MaxHeaders
+	input := "SEND\n" + strings.Repeat("name:value\n", 100000) + "\n\x00"
+	_, err := NewReader(strings.NewReader(input), MaxHeaders(1000, 0)).Read()
+	c.Check(err, ErrorMatches, "frame too large: more than 1000 header entries")
+}
+
+// FuzzReadFrame checks that the Reader returns an error for malformed
+// input, rather than panicking or allocating more than the input needs.
+func FuzzReadFrame(f *testing.F) {
+	f.Add([]byte("CONNECT\nlogin:xxx\npasscode:yyy\n\n\x00"))
+	f.Add([]byte("SEND\ndestination:xxx\ncontent-length:5\n\n\x00\x01\x02\x03\x04\x00\n"))
+	f.Add([]byte("MESSAGE\r\ndestination:/queue/test\r\n\r\nhello\x00\r\n\r\nRECEIPT\nreceipt-id:1\n\n\x00"))
+	f.Add([]byte("SEND\ndodgy\\c\\n\\cheader:dodgy\\c\\n\\r\\nvalue\\\\  \\\\\n\n\x00"))
+
+	for _, tc := range malformedFrames {
+		f.Add([]byte(tc.input))
+	}
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		for _, version := range []string{"1.0", "1.1", "1.2"} {
+			reader := NewReader(bytes.NewReader(input), AnyCommand(), BodyPool())
+			reader.SetVersion(version)
+			for {
+				f, err := reader.Read()
+				if err != nil {
+					if f != nil {
+						t.Fatalf("frame returned with error %v", err)
+					}
+					break
+				}
+				if f != nil {
+					_ = f.String()
+					f.Release()
+				}
+			}
+
+			reader = NewReaderSize(bytes.NewReader(input), MinBufferSize, MaxFrameSize(1024), MaxHeaders(10, 1024))
+			reader.SetVersion(version)
+			for {
+				_, body, err := reader.ReadStreaming(func(*Frame, int) bool { return true })
+				if err != nil {
+					break
+				}
+				if body != nil {
+					io.Copy(io.Discard, body)
+				}
+			}
+		}
+	})
+}
@@ -3,98 +3,211 @@ package frame
 import (
 	"bufio"
 	"io"
+	"strconv"
+	"sync"
 )
 
-// slices used to write frames
+// slices used to find the end of a line
 var (
-	colonSlice   = []byte{58}     // colon ':'
 	crlfSlice    = []byte{13, 10} // CR-LF
 	newlineSlice = []byte{10}     // newline (LF)
-	nullSlice    = []byte{0}      // null character
 )
 
+// defaultWriteBufferSize is the size of the buffer of a Writer created
+// by NewWriter.
+const defaultWriteBufferSize = 4096
+
+// writeBufferPool holds the buffers of Writers of the default size that
+// have nothing to flush, so that an idle Writer, or one that is used to
+// format a single frame, does not hold or allocate a buffer of its own.
+var writeBufferPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewWriterSize(nil, defaultWriteBufferSize)
+	},
+}
+
 // Writes STOMP frames to an underlying io.Writer.
 type Writer struct {
-	writer *bufio.Writer
+	writer   *bufio.Writer // nil while a pooled buffer is released
+	pooled   bool          // the buffer is taken from writeBufferPool
+	counter  *countingWriter
+	escaping escaping
+}
+
+// countingWriter counts the bytes written to an io.Writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
 }
 
 // Creates a new Writer object, which writes to an underlying io.Writer.
 func NewWriter(writer io.Writer) *Writer {
-	return NewWriterSize(writer, 4096)
+	return NewWriterSize(writer, defaultWriteBufferSize)
 }
 
+// NewWriterSize creates a Writer whose buffer has the size specified,
+// which is at least MinBufferSize. The buffer of a Writer of the default
+// size is shared with other Writers while there is nothing to flush.
 func NewWriterSize(writer io.Writer, bufferSize int) *Writer {
-	return &Writer{writer: bufio.NewWriterSize(writer, bufferSize)}
+	if bufferSize < MinBufferSize {
+		bufferSize = MinBufferSize
+	}
+	counter := &countingWriter{w: writer}
+	if bufferSize == defaultWriteBufferSize {
+		return &Writer{pooled: true, counter: counter}
+	}
+	return &Writer{writer: bufio.NewWriterSize(counter, bufferSize), counter: counter}
+}
+
+// BufferSize returns the size of the underlying buffer.
+func (w *Writer) BufferSize() int {
+	if w.writer == nil {
+		return defaultWriteBufferSize
+	}
+	return w.writer.Size()
+}
+
+// buffer returns the buffer that frames are written to, taking one
+// from the pool if necessary.
+func (w *Writer) buffer() *bufio.Writer {
+	if w.writer == nil {
+		w.writer = writeBufferPool.Get().(*bufio.Writer)
+		w.writer.Reset(w.counter)
+	}
+	return w.writer
+}
+
+// BytesWritten returns the number of bytes of the frames and heart-beats
+// written so far, including those that are buffered and not yet flushed.
+// The size of a frame is the difference before and after writing it.
+func (w *Writer) BytesWritten() int64 {
+	if w.writer == nil {
+		return w.counter.n
+	}
+	return w.counter.n + int64(w.writer.Buffered())
+}
+
+// SetVersion sets the STOMP protocol version, such as "1.1", whose encoding
+// of header values is used to write the frames that follow. The encoding is
+// described for Reader.SetVersion. If the version is not set, or not
+// recognised, the STOMP 1.2 encoding is used.
+func (w *Writer) SetVersion(version string) {
+	w.escaping = escapingFor(version)
 }
 
 // Write the contents of a frame to the underlying io.Writer.
 func (w *Writer) Write(f *Frame) error {
-	var err error
+	if err := w.WriteBuffered(f); err != nil {
+		return err
+	}
+	return w.Flush()
+}
 
+// WriteBuffered writes the contents of a frame to the buffer without
+// flushing it, so that several frames can be written to the underlying
+// io.Writer at once. Call Flush after the last frame.
+func (w *Writer) WriteBuffered(f *Frame) error {
 	if f == nil {
 		// nil frame means send a heart-beat LF
-		_, err = w.writer.Write(newlineSlice)
-		if err != nil {
-			return err
-		}
-	} else {
-		_, err = w.writer.Write([]byte(f.Command))
-		if err != nil {
-			return err
-		}
-
-		_, err = w.writer.Write(newlineSlice)
-		if err != nil {
-			return err
-		}
+		return w.buffer().WriteByte('\n')
+	}
 
-		//println("TX:", f.Command)
-		if f.Header != nil {
-			for i := 0; i < f.Header.Len(); i++ {
-				key, value := f.Header.GetAt(i)
-				//println("   ", key, ":", value)
-				_, err = w.writer.Write(encodeValue(key))
-				if err != nil {
-					return err
-				}
-				_, err = w.writer.Write(colonSlice)
-				if err != nil {
-					return err
-				}
-				_, err = w.writer.Write(encodeValue(value))
-				if err != nil {
-					return err
-				}
-				_, err = w.writer.Write(newlineSlice)
-				if err != nil {
-					return err
-				}
-			}
-		}
+	if err := w.writeHeader(f); err != nil {
+		return err
+	}
 
-		_, err = w.writer.Write(newlineSlice)
-		if err != nil {
+	if len(f.Body) > 0 {
+		if _, err := w.writer.Write(f.Body); err != nil {
 			return err
 		}
+	}
 
-		if len(f.Body) > 0 {
-			_, err = w.writer.Write(f.Body)
-			if err != nil {
-				return err
-			}
-		}
+	// write the final null (0) byte
+	return w.writer.WriteByte(0)
+}
 
-		// write the final null (0) byte
-		_, err = w.writer.Write(nullSlice)
-		if err != nil {
-			return err
-		}
+// WriteStream writes a frame whose body is read from body, which must supply
+// size bytes, without holding the whole body in memory. The content-length
+// header entry of the frame is set to size, and f.Body is ignored. The frame
+// is flushed to the underlying io.Writer as the body is read. If body returns
+// an error, or supplies fewer than size bytes, the error is returned and the
+// frame is incomplete, so nothing more can be written to the underlying
+// io.Writer. An early end of the body is reported as io.ErrUnexpectedEOF.
+func (w *Writer) WriteStream(f *Frame, body io.Reader, size int64) error {
+	f.Header.Set(ContentLength, strconv.FormatInt(size, 10))
+	if err := w.writeHeader(f); err != nil {
+		return err
 	}
 
-	err = w.writer.Flush()
+	n, err := io.Copy(w.writer, io.LimitReader(body, size))
 	if err != nil {
 		return err
 	}
+	if n < size {
+		return io.ErrUnexpectedEOF
+	}
 
+	// write the final null (0) byte
+	if err = w.writer.WriteByte(0); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// writeHeader writes the command and header entries of a frame, and the
+// blank line that precedes the body. They are written straight to the
+// buffer, so that writing a frame does not allocate.
+func (w *Writer) writeHeader(f *Frame) error {
+	b := w.buffer()
+	b.WriteString(f.Command)
+	b.WriteByte('\n')
+
+	if f.Header != nil {
+		escaping := w.escaping.forCommand(f.Command)
+		for i := 0; i < f.Header.Len(); i++ {
+			key, value := f.Header.GetAt(i)
+			writeValue(b, key, escaping)
+			b.WriteByte(':')
+			writeValue(b, value, escaping)
+			b.WriteByte('\n')
+		}
+	}
+
+	// a bufio.Writer returns the first error again from each call
+	return b.WriteByte('\n')
+}
+
+// flusher is implemented by an underlying io.Writer that needs to know
+// where the frames written to it end, such as one that sends them over
+// a message-based transport.
+type flusher interface {
+	Flush() error
+}
+
+// Flush writes any buffered frames to the underlying io.Writer. A buffer
+// taken from the pool is returned to it once everything is written. If
+// the underlying io.Writer has a Flush method, it is called then, as the
+// data written to it ends with complete frames or heart-beats.
+func (w *Writer) Flush() error {
+	if w.writer == nil {
+		return nil
+	}
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	if w.pooled {
+		w.writer.Reset(nil)
+		writeBufferPool.Put(w.writer)
+		w.writer = nil
+	}
+	if f, ok := w.counter.w.(flusher); ok {
+		return f.Flush()
+	}
 	return nil
 }
@@ -2,7 +2,10 @@ package frame
 
 import (
 	"bytes"
+	"io"
+	"strconv"
 	"strings"
+	"testing"
 
 	. "gopkg.in/check.v1"
 )
@@ -46,3 +49,163 @@ func writeToBufferAndCheck(c *C, frameText string) {
 	c.Check(newFrameText, Equals, frameText)
 	c.Check(b.String(), Equals, frameText)
 }
+
+func (s *WriterSuite) TestWriteBuffered(c *C) {
+	var b bytes.Buffer
+	writer := NewWriter(&b)
+
+	err := writer.WriteBuffered(New(SEND, Destination, "x"))
+	c.Assert(err, IsNil)
+	err = writer.WriteBuffered(New(SEND, Destination, "y"))
+	c.Assert(err, IsNil)
+	c.Check(b.Len(), Equals, 0)
+
+	err = writer.Flush()
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, "SEND\ndestination:x\n\n\x00SEND\ndestination:y\n\n\x00")
+}
+
+// flushRecorder records the data written to it before each call to Flush.
+type flushRecorder struct {
+	bytes.Buffer
+	flushed []string
+}
+
+func (r *flushRecorder) Flush() error {
+	r.flushed = append(r.flushed, r.String())
+	r.Reset()
+	return nil
+}
+
+func (s *WriterSuite) TestFlushUnderlying(c *C) {
+	var r flushRecorder
+	writer := NewWriterSize(&r, MinBufferSize)
+
+	// the body is written in several parts, some ending with NUL
+	f := New(SEND, Destination, "x", ContentLength, strconv.Itoa(3*MinBufferSize))
+	f.Body = make([]byte, 3*MinBufferSize)
+	c.Assert(writer.Write(f), IsNil)
+	c.Assert(writer.Write(nil), IsNil)
+	c.Check(r.flushed, HasLen, 2)
+	if len(r.flushed) == 2 {
+		c.Check(len(r.flushed[0]), Equals, len("SEND\ndestination:x\ncontent-length:\n\n\x00")+len(f.Header.Get(ContentLength))+len(f.Body))
+		c.Check(r.flushed[1], Equals, "\n")
+	}
+}
+
+func (s *WriterSuite) TestWriteStream(c *C) {
+	var b bytes.Buffer
+	writer := NewWriter(&b)
+
+	err := writer.WriteStream(New(SEND, Destination, "x"), strings.NewReader("a\x00bcd"), 4)
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, "SEND\ndestination:x\ncontent-length:4\n\na\x00bc\x00")
+
+	b.Reset()
+	err = writer.WriteStream(New(SEND, Destination, "x"), strings.NewReader("ab"), 3)
+	c.Check(err, Equals, io.ErrUnexpectedEOF)
+}
+
+func (s *WriterSuite) TestBytesWritten(c *C) {
+	var b bytes.Buffer
+	// the buffer is smaller than the frame, which is flushed part way
+	writer := NewWriterSize(&b, MinBufferSize)
+	c.Check(writer.BytesWritten(), Equals, int64(0))
+
+	destination := "/queue/" + strings.Repeat("x", MinBufferSize)
+	c.Assert(writer.WriteBuffered(New(SEND, Destination, destination)), IsNil)
+	c.Check(writer.BytesWritten(), Equals, int64(len("SEND\ndestination:"+destination+"\n\n\x00")))
+	c.Assert(writer.WriteBuffered(nil), IsNil)
+	c.Assert(writer.Flush(), IsNil)
+	c.Check(writer.BytesWritten(), Equals, int64(b.Len()))
+}
+
+func (s *WriterSuite) TestPooledBuffers(c *C) {
+	// the Writers of the default size share buffers while they
+	// have nothing to flush
+	var b1, b2 bytes.Buffer
+	w1, w2 := NewWriter(&b1), NewWriter(&b2)
+	c.Assert(w1.WriteBuffered(New(SEND, Destination, "/queue/1")), IsNil)
+	c.Assert(w2.WriteBuffered(New(SEND, Destination, "/queue/2")), IsNil)
+	c.Check(b1.Len(), Equals, 0)
+	c.Assert(w1.Flush(), IsNil)
+	c.Assert(w2.Flush(), IsNil)
+	c.Check(w1.writer, IsNil)
+	c.Check(w2.writer, IsNil)
+
+	c.Assert(w1.Write(New(SEND, Destination, "/queue/3")), IsNil)
+	c.Check(b1.String(), Equals, "SEND\ndestination:/queue/1\n\n\x00SEND\ndestination:/queue/3\n\n\x00")
+	c.Check(b2.String(), Equals, "SEND\ndestination:/queue/2\n\n\x00")
+	c.Check(w1.BytesWritten(), Equals, int64(b1.Len()))
+	c.Check(w2.Flush(), IsNil)
+}
+
+func (s *WriterSuite) TestBufferSize(c *C) {
+	var b bytes.Buffer
+	c.Check(NewWriter(&b).BufferSize(), Equals, 4096)
+	c.Check(NewWriterSize(&b, 8192).BufferSize(), Equals, 8192)
+	c.Check(NewWriterSize(&b, 8).BufferSize(), Equals, MinBufferSize)
+
+	// a pooled buffer has the default size while it is in use
+	w := NewWriter(&b)
+	c.Assert(w.WriteBuffered(New(SEND, Destination, "/queue/1")), IsNil)
+	c.Check(w.BufferSize(), Equals, 4096)
+	c.Assert(w.Flush(), IsNil)
+}
+
+// sendFrame returns a small SEND frame like those written by a client.
+func sendFrame() *Frame {
+	f := New(SEND,
+		Destination, "/queue/test-1",
+		ContentType, "text/plain",
+		Receipt, "42",
+		"x-custom", "value:with:colons")
+	f.Body = []byte("small message body")
+	return f
+}
+
+// BenchmarkSendSmallFrames writes and flushes small frames one at a time,
+// as the client does when frames are sent one at a time.
+func BenchmarkSendSmallFrames(b *testing.B) {
+	f := sendFrame()
+	w := NewWriter(io.Discard)
+	w.SetVersion("1.2")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := w.Write(f); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFrameString formats a small frame, as the client does to
+// trace and log frames.
+func BenchmarkFrameString(b *testing.B) {
+	f := sendFrame()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = f.String()
+	}
+}
+
+// BenchmarkSendSmallFramesCoalesced writes small frames, and flushes
+// them sixteen at a time, as the client does when frames are queued
+// faster than they can be written.
+func BenchmarkSendSmallFramesCoalesced(b *testing.B) {
+	f := sendFrame()
+	w := NewWriter(io.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := w.WriteBuffered(f); err != nil {
+			b.Fatal(err)
+		}
+		if i%16 == 15 {
+			if err := w.Flush(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		b.Fatal(err)
+	}
+}
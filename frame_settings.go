@@ -0,0 +1,35 @@
+package stomp
+
+import (
+	"sync"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// Some frame options affect how an operation is carried out rather than
+// the content of the frame, eg a timeout. These options have the same
+// signature as any other frame option, so the settings for the operation
+// are associated with the frame for as long as it takes to run the
+// options. The options then find the settings using the frame.
+//
+// The signature is that of the options of the public API, such as
+// SendOpt.Receipt, which programs pass around and write themselves, so
+// the settings cannot be passed to the options directly. The frame is
+// created for the call, so it identifies the call while its options
+// run, and the entry is deleted when they return, even if one panics.
+// The map only holds entries for the calls in progress.
+var pendingSettings sync.Map
+
+// withSettings associates settings with frame f while fn is called.
+func withSettings(f *frame.Frame, settings interface{}, fn func() error) error {
+	pendingSettings.Store(f, settings)
+	defer pendingSettings.Delete(f)
+	return fn()
+}
+
+// settingsFor returns the settings associated with frame f, or
+// nil if there are none.
+func settingsFor(f *frame.Frame) interface{} {
+	settings, _ := pendingSettings.Load(f)
+	return settings
+}
@@ -0,0 +1,37 @@
+package stomp
+
+import (
+	"errors"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_frame_settings(c *C) {
+	options := &sendOptions{}
+	for _, fn := range []func(f *frame.Frame) error{
+		func(f *frame.Frame) error {
+			c.Check(settingsFor(f), Equals, options)
+			return nil
+		},
+		func(f *frame.Frame) error {
+			return errors.New("option failed")
+		},
+		func(f *frame.Frame) error {
+			panic("option panicked")
+		},
+	} {
+		f := frame.New(frame.SEND)
+		func() {
+			defer func() { recover() }()
+			withSettings(f, options, func() error { return fn(f) })
+		}()
+
+		// the settings are only associated with the frame while the
+		// options run
+		c.Check(settingsFor(f), IsNil)
+		_, ok := pendingSettings.Load(f)
+		c.Check(ok, Equals, false)
+	}
+	c.Check(settingsFor(frame.New(frame.SEND)), IsNil)
+}
@@ -1,8 +1,10 @@
 module github.com/go-stomp/stomp
 
-go 1.14
+go 1.21
+
+require gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f
 
 require (
+	github.com/kr/text v0.1.0 // indirect
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
-	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f
 )
@@ -0,0 +1,205 @@
+package stomp
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// A HandlerFunc processes a message received on a subscription created
+// by Conn.SubscribeHandler. Returning a non-nil error indicates that the
+// message could not be processed.
+type HandlerFunc func(msg *Message) error
+
+// SubscribeFunc creates a subscription in the same way as Subscribe, but
+// instead of the program reading messages from the C channel, handler is
+// called with each message on a goroutine dedicated to the subscription.
+// The program must not read from C. SubscribeOpt.Workers allows several
+// messages to be processed at once.
+//
+// For subscriptions with AckClient or AckClientIndividual, each message is
+// acknowledged once the handler returns. If the handler panics, the message
+// is negatively acknowledged with a NACK frame, unless the STOMP version is
+// 1.0, and the handler continues to be called with the messages that
+// follow. The panic is reported as described for ConnOpt.OnPanic.
+//
+// If the subscription fails, the handler is called with a message whose Err
+// field is set, which is never acknowledged. The handler must not call
+// Unsubscribe, which waits for the handler to finish.
+func (c *Conn) SubscribeFunc(destination string, ack AckMode, handler func(*Message), opts ...func(*frame.Frame) error) (*Subscription, error) {
+	if handler == nil {
+		return nil, ErrNilHandler
+	}
+	return c.subscribe(destination, ack, opts, func(msg *Message) error {
+		handler(msg)
+		return nil
+	})
+}
+
+// SubscribeHandler is the same as SubscribeFunc, except that a message
+// is also negatively acknowledged if the handler returns an error.
+func (c *Conn) SubscribeHandler(destination string, ack AckMode, handler HandlerFunc, opts ...func(*frame.Frame) error) (*Subscription, error) {
+	if handler == nil {
+		return nil, ErrNilHandler
+	}
+	return c.subscribe(destination, ack, opts, handler)
+}
+
+// How a message is acknowledged once the handler has finished with it.
+type ackAction int
+
+const (
+	ackNone ackAction = iota
+	ackSend
+	nackSend
+)
+
+// delivery is a message passed to a worker, numbered in the
+// order it was received.
+type delivery struct {
+	msg *Message
+	seq uint64
+}
+
+// runHandler passes each message received to one of the workers that
+// call handler, until the subscription closes.
+func (s *Subscription) runHandler(handler HandlerFunc, workers int) {
+	defer close(s.handlerDone)
+
+	var tracker *ackTracker
+	if s.ackMode == AckClient {
+		tracker = &ackTracker{sub: s, completed: make(map[uint64]completion)}
+	}
+
+	deliveries := make(chan delivery)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range deliveries {
+				action := s.handle(handler, d.msg)
+				if tracker != nil {
+					tracker.complete(d.seq, d.msg, action)
+				} else {
+					s.acknowledge(d.msg, action)
+					atomic.AddInt32(&s.inFlight, -1)
+				}
+			}
+		}()
+	}
+
+	var seq uint64
+	for msg := range s.C {
+		atomic.AddInt32(&s.inFlight, 1)
+		deliveries <- delivery{msg: msg, seq: seq}
+		seq++
+	}
+	close(deliveries)
+	wg.Wait()
+}
+
+// handle calls handler with msg, and returns how msg should be
+// acknowledged according to the result.
+func (s *Subscription) handle(handler HandlerFunc, msg *Message) ackAction {
+	err := s.callHandler(handler, msg)
+	if msg.BodyReader != nil {
+		// the handler may not have read all of the body
+		msg.BodyReader.Close()
+	}
+	if msg.Err != nil {
+		return ackNone
+	}
+	if !msg.ShouldAck() {
+		if err != nil {
+			s.conn.log.Warnf("Subscription %s: %s: handler failed: %v", s.id, s.destination, err)
+		}
+		return ackNone
+	}
+
+	if err != nil {
+		s.conn.log.Warnf("Subscription %s: %s: handler failed, sending NACK: %v", s.id, s.destination, err)
+		if s.conn.Version() == V10 {
+			return ackNone
+		}
+		return nackSend
+	}
+	return ackSend
+}
+
+// acknowledge sends an ACK or NACK frame for msg.
+func (s *Subscription) acknowledge(msg *Message, action ackAction) {
+	switch action {
+	case ackSend:
+		if err := s.conn.Ack(msg); err != nil {
+			s.conn.log.Errorf("Subscription %s: %s: failed to send ACK: %v", s.id, s.destination, err)
+		}
+	case nackSend:
+		if err := s.conn.Nack(msg); err != nil {
+			s.conn.log.Errorf("Subscription %s: %s: failed to send NACK: %v", s.id, s.destination, err)
+		}
+	}
+}
+
+// callHandler calls handler with msg, returning an error
+// if the handler panics.
+func (s *Subscription) callHandler(handler HandlerFunc, msg *Message) (err error) {
+	if perr := s.conn.safely("handler", func() { err = handler(msg) }); perr != nil {
+		return perr
+	}
+	return err
+}
+
+// completion is a message that the handler has finished with.
+type completion struct {
+	msg    *Message
+	action ackAction
+}
+
+// ackTracker acknowledges the messages of an AckClient subscription in
+// the order they were received, because acknowledging a message also
+// acknowledges the messages before it. A message is only acknowledged
+// once the handler has finished with all of the earlier messages.
+type ackTracker struct {
+	sub       *Subscription
+	mutex     sync.Mutex
+	next      uint64                // the earliest message not yet completed
+	completed map[uint64]completion // completed messages after next
+}
+
+// complete records that the handler has finished with the message
+// numbered seq, and acknowledges any messages that are now in order.
+func (t *ackTracker) complete(seq uint64, msg *Message, action ackAction) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.completed[seq] = completion{msg: msg, action: action}
+
+	// one ACK frame covers a run of successful messages
+	var last *Message
+	released := 0
+	for {
+		c, ok := t.completed[t.next]
+		if !ok {
+			break
+		}
+		delete(t.completed, t.next)
+		t.next++
+		released++
+
+		switch c.action {
+		case ackSend:
+			last = c.msg
+		case nackSend:
+			if last != nil {
+				t.sub.acknowledge(last, ackSend)
+				last = nil
+			}
+			t.sub.acknowledge(c.msg, nackSend)
+		}
+	}
+	if last != nil {
+		t.sub.acknowledge(last, ackSend)
+	}
+	atomic.AddInt32(&t.sub.inFlight, int32(-released))
+}
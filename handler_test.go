@@ -0,0 +1,239 @@
+package stomp
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_subscribe_handler_acks(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		id := f1.Header.Get(frame.Id)
+		for _, messageId := range []string{"ok", "error", "panic"} {
+			rw.Write(frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.MessageId, messageId,
+				frame.Ack, "ack-"+messageId,
+				frame.Destination, "/queue/test-1"))
+		}
+
+		for _, expected := range []string{"ACK ack-ok", "NACK ack-error", "NACK ack-panic"} {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Check(f.Command+" "+f.Header.Get(frame.Id), Equals, expected)
+		}
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "UNSUBSCRIBE")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	handled := make(chan string, 3)
+	sub, err := conn.SubscribeHandler("/queue/test-1", AckClientIndividual, func(msg *Message) error {
+		messageId := msg.Header.Get(frame.MessageId)
+		handled <- messageId
+		switch messageId {
+		case "error":
+			return errors.New("cannot process message")
+		case "panic":
+			panic("cannot process message")
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+
+	for _, expected := range []string{"ok", "error", "panic"} {
+		c.Check(<-handled, Equals, expected)
+	}
+
+	err = sub.Unsubscribe()
+	c.Check(err, IsNil)
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscribe_func_unsubscribe_waits(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		rw.Write(frame.New(frame.MESSAGE,
+			frame.Subscription, f1.Header.Get(frame.Id),
+			frame.MessageId, "message-1",
+			frame.Destination, "/queue/test-1"))
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "UNSUBSCRIBE")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	sub, err := conn.SubscribeFunc("/queue/test-1", AckAuto, func(msg *Message) {
+		close(started)
+		<-release
+	})
+	c.Assert(err, IsNil)
+	<-started
+
+	unsubscribed := make(chan error)
+	go func() {
+		unsubscribed <- sub.Unsubscribe()
+	}()
+
+	select {
+	case <-unsubscribed:
+		c.Fatal("unsubscribe returned before the handler finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	c.Check(<-unsubscribed, IsNil)
+
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+
+	_, err = conn.SubscribeFunc("/queue/test-1", AckAuto, nil)
+	c.Check(err, Equals, ErrNilHandler)
+}
+
+// workersHelper creates a subscription with handler and three workers,
+// sends the messages, and returns the ACK and NACK frames received by
+// the server, as "COMMAND ack-id".
+func workersHelper(c *C, ack AckMode, messageIds []string, handler HandlerFunc, wait func(sub *Subscription)) []string {
+	conn, rw := connectHelper(c, V12)
+	acks := make(chan []string)
+
+	go func() {
+		defer rw.Close()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		id := f1.Header.Get(frame.Id)
+		for _, messageId := range messageIds {
+			rw.Write(frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.MessageId, messageId,
+				frame.Ack, "ack-"+messageId,
+				frame.Destination, "/queue/test-1"))
+		}
+
+		var received []string
+		for {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			if f.Command == frame.DISCONNECT {
+				rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+				break
+			}
+			received = append(received, f.Command+" "+f.Header.Get(frame.Id))
+		}
+		acks <- received
+	}()
+
+	sub, err := conn.SubscribeHandler("/queue/test-1", ack, handler, SubscribeOpt.Workers(3))
+	c.Assert(err, IsNil)
+	wait(sub)
+
+	for sub.InFlight() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	return <-acks
+}
+
+func (s *StompSuite) Test_subscribe_handler_workers(c *C) {
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+
+	acks := workersHelper(c, AckClientIndividual, []string{"1", "2", "3"}, func(msg *Message) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}, func(sub *Subscription) {
+		// all of the messages are processed at once
+		for i := 0; i < 3; i++ {
+			<-started
+		}
+		c.Check(sub.InFlight(), Equals, 3)
+		close(release)
+	})
+
+	sort.Strings(acks)
+	c.Check(acks, DeepEquals, []string{"ACK ack-1", "ACK ack-2", "ACK ack-3"})
+}
+
+func (s *StompSuite) Test_subscribe_handler_workers_ordered_ack(c *C) {
+	handled := make(chan string, 3)
+	release := make(chan struct{})
+
+	acks := workersHelper(c, AckClient, []string{"1", "2", "3", "4"}, func(msg *Message) error {
+		messageId := msg.Header.Get(frame.MessageId)
+		if messageId == "1" {
+			<-release
+		}
+		handled <- messageId
+		if messageId == "3" {
+			return errors.New("cannot process message")
+		}
+		return nil
+	}, func(sub *Subscription) {
+		// the later messages are not acknowledged before the first
+		for i := 0; i < 2; i++ {
+			<-handled
+		}
+		c.Check(sub.InFlight() >= 3, Equals, true)
+		close(release)
+	})
+
+	// the ACK for message 2 also acknowledges message 1
+	c.Check(acks, DeepEquals, []string{"ACK ack-2", "NACK ack-3", "ACK ack-4"})
+}
+
+func (s *StompSuite) Test_subscribe_workers_invalid(c *C) {
+	conn, rw := connectHelper(c, V12)
+	defer rw.Close()
+
+	_, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.Workers(2))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+	_, err = conn.SubscribeFunc("/queue/test-1", AckAuto, func(*Message) {}, SubscribeOpt.Workers(0))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+}
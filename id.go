@@ -2,9 +2,14 @@ package stomp
 
 import (
 	"strconv"
+	"strings"
 	"sync/atomic"
 )
 
+// receiptIdPrefix starts every receipt id that is generated, so
+// that the receipt ids are distinct from the subscription ids.
+const receiptIdPrefix = "rcpt-"
+
 var _lastId uint64
 
 // allocateId returns a unique number for the current
@@ -15,3 +20,14 @@ func allocateId() string {
 	id := atomic.AddUint64(&_lastId, 1)
 	return strconv.FormatUint(id, 10)
 }
+
+// allocateReceiptId returns a unique receipt id for the current
+// process, of the form "rcpt-<n>".
+func allocateReceiptId() string {
+	return receiptIdPrefix + allocateId()
+}
+
+// isReceiptId reports whether id starts like a generated receipt id.
+func isReceiptId(id string) bool {
+	return strings.HasPrefix(id, receiptIdPrefix)
+}
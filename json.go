@@ -0,0 +1,83 @@
+package stomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// JSONContentType is the content type of the messages sent by SendJSON.
+const JSONContentType = "application/json;charset=utf-8"
+
+// A Sender sends messages to the STOMP server. It is implemented by
+// Conn, Transaction and Pool.
+type Sender interface {
+	Send(destination, contentType string, body []byte, opts ...func(*frame.Frame) error) error
+}
+
+// SendJSON sends a message whose body is the JSON encoding of v, with
+// the content type JSONContentType, using s in the same way as Conn.Send.
+// If v cannot be encoded, the error from json.Marshal is returned and
+// nothing is sent.
+func SendJSON(s Sender, destination string, v any, opts ...func(*frame.Frame) error) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Send(destination, JSONContentType, body, opts...)
+}
+
+// DecodeJSON decodes the JSON body of the message into v, as
+// json.Unmarshal does. Unless force is true, an error that wraps
+// ErrNotJSON is returned if the content type of the message is not a
+// JSON content type: "application/json", "text/json" or a type with the
+// "+json" suffix, without a charset parameter other than UTF-8. The body
+// must be valid UTF-8, as JSON requires, otherwise ErrInvalidUTF8 is
+// returned. A streamed body is read to the end.
+func (msg *Message) DecodeJSON(v any, force bool) error {
+	if !force && !isJSONContentType(msg.ContentType) {
+		return newNotJSONError(msg.ContentType)
+	}
+
+	body := msg.Body
+	if msg.BodyReader != nil {
+		var err error
+		if body, err = io.ReadAll(msg.BodyReader); err != nil {
+			return err
+		}
+	}
+	if !utf8.Valid(body) {
+		return ErrInvalidUTF8
+	}
+	return json.Unmarshal(body, v)
+}
+
+// isJSONContentType reports whether the content type is one that
+// DecodeJSON decodes.
+func isJSONContentType(contentType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") {
+		return false
+	}
+	switch {
+	case mediaType == "application/json", mediaType == "text/json":
+		return true
+	case strings.HasSuffix(mediaType, "+json"):
+		return true
+	}
+	return false
+}
+
+// newNotJSONError describes a message whose content type is not a
+// JSON content type, in more detail than ErrNotJSON, which it wraps.
+func newNotJSONError(contentType string) Error {
+	return Error{Message: fmt.Sprintf("%s: %q", ErrNotJSON.Message, contentType), cause: ErrNotJSON}
+}
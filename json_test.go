@@ -0,0 +1,120 @@
+package stomp
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+var (
+	_ Sender = (*Conn)(nil)
+	_ Sender = (*Transaction)(nil)
+	_ Sender = (*Pool)(nil)
+)
+
+type jsonDocument struct {
+	Name  string   `json:"name"`
+	Count int      `json:"count"`
+	Tags  []string `json:"tags"`
+}
+
+func (s *StompSuite) Test_send_json(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	large := jsonDocument{Name: strings.Repeat("é", 1<<18), Count: 2}
+	for i := 0; i < 1000; i++ {
+		large.Tags = append(large.Tags, "tag")
+	}
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+
+		// the messages sent are echoed to the subscription
+		for i := 0; i < 2; i++ {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, frame.SEND)
+			c.Check(f.Header.Get(frame.ContentType), Equals, JSONContentType)
+			msg := frame.New(frame.MESSAGE,
+				frame.Subscription, f1.Header.Get(frame.Id),
+				frame.MessageId, "message-1",
+				frame.Destination, "/queue/test-1",
+				frame.ContentType, f.Header.Get(frame.ContentType))
+			msg.Body = f.Body
+			rw.Write(msg)
+		}
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+
+	// nothing is sent if the value cannot be encoded
+	c.Check(SendJSON(conn, "/queue/test-1", make(chan int)), NotNil)
+
+	for _, doc := range []jsonDocument{{Name: "small", Count: 1, Tags: []string{"a", "b"}}, large} {
+		c.Assert(SendJSON(conn, "/queue/test-1", doc), IsNil)
+		msg := <-sub.C
+		c.Assert(msg.Err, IsNil)
+		var decoded jsonDocument
+		c.Assert(msg.DecodeJSON(&decoded, false), IsNil)
+		c.Check(decoded, DeepEquals, doc)
+	}
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_decode_json(c *C) {
+	testCases := []struct {
+		contentType string
+		body        string
+		force       bool
+		err         string
+	}{
+		{"application/json", `{"name":"a"}`, false, ""},
+		{"application/json; charset=UTF-8", `{"name":"a"}`, false, ""},
+		{"text/json", `{"name":"a"}`, false, ""},
+		{"application/vnd.api+json", `{"name":"a"}`, false, ""},
+		{"text/plain", `{"name":"a"}`, false, `content type is not JSON: "text/plain"`},
+		{"text/plain", `{"name":"a"}`, true, ""},
+		{"", `{"name":"a"}`, false, `content type is not JSON: ""`},
+		{"application/json;charset=iso-8859-1", `{"name":"a"}`, false, `content type is not JSON: "application/json;charset=iso-8859-1"`},
+		{"application/json", "{\"name\":\"\xff\"}", false, "body is not valid UTF-8"},
+		{"application/json", "{\"name\":\"\xff\"}", true, "body is not valid UTF-8"},
+		{"application/json", "", false, "unexpected end of JSON input"},
+	}
+
+	for i, tc := range testCases {
+		msg := &Message{ContentType: tc.contentType, Body: []byte(tc.body)}
+		var doc jsonDocument
+		err := msg.DecodeJSON(&doc, tc.force)
+		if tc.err == "" {
+			c.Check(err, IsNil, Commentf("test case %d", i))
+			c.Check(doc.Name, Equals, "a", Commentf("test case %d", i))
+			continue
+		}
+		c.Assert(err, NotNil, Commentf("test case %d", i))
+		c.Check(err.Error(), Equals, tc.err, Commentf("test case %d", i))
+	}
+
+	err := (&Message{ContentType: "text/plain"}).DecodeJSON(&jsonDocument{}, false)
+	c.Check(errors.Is(err, ErrNotJSON), Equals, true)
+
+	// a streamed body is read
+	msg := &Message{ContentType: JSONContentType, BodyReader: io.NopCloser(strings.NewReader(`{"name":"a"}`))}
+	var doc jsonDocument
+	c.Check(msg.DecodeJSON(&doc, false), IsNil)
+	c.Check(doc.Name, Equals, "a")
+}
@@ -0,0 +1,88 @@
+package stomp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"sync/atomic"
+)
+
+// A Logger receives the diagnostic messages written by a Conn and its
+// subscriptions. Each method formats its arguments in the manner of
+// fmt.Printf. A Logger must be safe for use by multiple goroutines.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdLogger writes all messages to the standard logger of the log
+// package, regardless of their level.
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, args ...interface{}) { log.Printf(format, args...) }
+func (stdLogger) Infof(format string, args ...interface{})  { log.Printf(format, args...) }
+func (stdLogger) Warnf(format string, args ...interface{})  { log.Printf(format, args...) }
+func (stdLogger) Errorf(format string, args ...interface{}) { log.Printf(format, args...) }
+
+// loggerValue wraps the default logger, because an atomic.Value
+// requires every value stored to have the same concrete type.
+type loggerValue struct {
+	Logger
+}
+
+var defaultLogger atomic.Value
+
+func init() {
+	defaultLogger.Store(loggerValue{stdLogger{}})
+}
+
+// SetDefaultLogger sets the logger used by connections that are created
+// without the ConnOpt.Logger option. Connections that already exist are not
+// affected. Passing nil restores the initial default, which writes all
+// messages to the standard logger of the log package.
+func SetDefaultLogger(l Logger) {
+	if l == nil {
+		l = stdLogger{}
+	}
+	defaultLogger.Store(loggerValue{l})
+}
+
+func getDefaultLogger() Logger {
+	return defaultLogger.Load().(loggerValue).Logger
+}
+
+// NewSlogLogger returns a Logger that writes messages to l at the
+// corresponding slog level.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s slogLogger) logf(level slog.Level, format string, args []interface{}) {
+	ctx := context.Background()
+	if s.l.Enabled(ctx, level) {
+		s.l.Log(ctx, level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (s slogLogger) Debugf(format string, args ...interface{}) {
+	s.logf(slog.LevelDebug, format, args)
+}
+
+func (s slogLogger) Infof(format string, args ...interface{}) {
+	s.logf(slog.LevelInfo, format, args)
+}
+
+func (s slogLogger) Warnf(format string, args ...interface{}) {
+	s.logf(slog.LevelWarn, format, args)
+}
+
+func (s slogLogger) Errorf(format string, args ...interface{}) {
+	s.logf(slog.LevelError, format, args)
+}
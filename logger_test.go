@@ -0,0 +1,105 @@
+package stomp
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/go-stomp/stomp/frame"
+	"github.com/go-stomp/stomp/testutil"
+	. "gopkg.in/check.v1"
+)
+
+// captureLogger records the messages logged at each level.
+type captureLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *captureLogger) logf(level, format string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, level+": "+fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) Debugf(format string, args ...interface{}) { l.logf("debug", format, args) }
+func (l *captureLogger) Infof(format string, args ...interface{})  { l.logf("info", format, args) }
+func (l *captureLogger) Warnf(format string, args ...interface{})  { l.logf("warn", format, args) }
+func (l *captureLogger) Errorf(format string, args ...interface{}) { l.logf("error", format, args) }
+
+func (l *captureLogger) Messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.messages...)
+}
+
+func (s *StompSuite) Test_logger_option(c *C) {
+	logger := &captureLogger{}
+	conn, rw := connectHelper(c, V12, ConnOpt.Logger(logger))
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		rw.Write(frame.New(frame.MESSAGE,
+			frame.Subscription, "unknown",
+			frame.MessageId, "message-1",
+			frame.Destination, "/queue/test-1"))
+
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+	}()
+
+	// the MESSAGE is read before the RECEIPT for the DISCONNECT
+	err := conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+
+	c.Check(logger.Messages(), DeepEquals, []string{"warn: ignored MESSAGE for subscription unknown"})
+}
+
+func (s *StompSuite) Test_logger_option_nil(c *C) {
+	fc1, fc2 := testutil.NewFakeConn(c)
+	defer fc2.Close()
+
+	conn, err := Connect(fc1, ConnOpt.Logger(nil))
+	c.Check(conn, IsNil)
+	c.Check(err, Equals, ErrNilOption)
+}
+
+func (s *StompSuite) Test_default_logger(c *C) {
+	logger := &captureLogger{}
+	SetDefaultLogger(logger)
+	defer SetDefaultLogger(nil)
+
+	conn, rw := connectHelper(c, V12)
+	c.Check(conn.log, Equals, Logger(logger))
+	rw.Close()
+
+	SetDefaultLogger(nil)
+	c.Check(getDefaultLogger(), Equals, Logger(stdLogger{}))
+}
+
+func (s *StompSuite) Test_slog_logger(c *C) {
+	var b bytes.Buffer
+	handler := slog.NewTextHandler(&b, &slog.HandlerOptions{Level: slog.LevelInfo})
+	logger := NewSlogLogger(slog.New(handler))
+
+	logger.Debugf("not %s", "logged")
+	logger.Infof("info %d", 1)
+	logger.Warnf("warn %d", 2)
+	logger.Errorf("error %d", 3)
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	c.Assert(lines, HasLen, 3)
+	c.Check(strings.Contains(lines[0], `level=INFO msg="info 1"`), Equals, true)
+	c.Check(strings.Contains(lines[1], `level=WARN msg="warn 2"`), Equals, true)
+	c.Check(strings.Contains(lines[2], `level=ERROR msg="error 3"`), Equals, true)
+}
@@ -1,6 +1,9 @@
 package stomp
 
 import (
+	"bytes"
+	"io"
+
 	"github.com/go-stomp/stomp/frame"
 )
 
@@ -35,15 +38,149 @@ type Message struct {
 	// The message body, which is an arbitrary sequence of bytes.
 	// The ContentType indicates the format of this body.
 	Body []byte // Content of message
+
+	// The message body, if it is streamed from the connection because the
+	// subscription was created with SubscribeOpt.StreamBodiesOver and the
+	// body is larger than the threshold. In this case Body is nil. No more
+	// frames are received on the connection until the body has been read
+	// to the end or BodyReader has been closed, which discards the rest of
+	// the body. For other messages BodyReader is nil.
+	BodyReader io.ReadCloser
+
+	// Identifies the connection to the server that the message was
+	// received on, which changes when the Conn reconnects.
+	epoch uint64
+
+	// The frame that the message was received in, as returned by Frame,
+	// whose body is returned to the pool by Release, if ConnOpt.BodyPool
+	// is specified.
+	frame *frame.Frame
+}
+
+// Release returns the body of the message to the pool of the connection
+// that received it, if the connection was created with ConnOpt.BodyPool,
+// and sets Body to nil. Neither the program nor the library refers to the
+// body once it is released, because it is overwritten by a later message.
+// Release does nothing more if it is called again, and it is not safe to
+// call it from more than one goroutine at once. A message that is never
+// released is collected as usual.
+func (msg *Message) Release() {
+	if msg.frame != nil {
+		msg.frame.Release()
+		msg.frame = nil
+	}
+	msg.Body = nil
+}
+
+// Copy returns a copy of the message whose Header, Body and Frame do not
+// share memory with msg, so that the copy can be kept after msg is released.
+// A streamed body is not copied: the copy has the same BodyReader.
+func (msg *Message) Copy() *Message {
+	mc := *msg
+	mc.frame = nil
+	if msg.Header != nil {
+		mc.Header = msg.Header.Clone()
+	}
+	if msg.Body != nil {
+		mc.Body = make([]byte, len(msg.Body))
+		copy(mc.Body, msg.Body)
+	}
+	if f := msg.frame; f != nil {
+		mc.frame = &frame.Frame{Command: f.Command, Header: mc.Header, Body: mc.Body}
+		if len(f.Body) != len(msg.Body) || len(f.Body) > 0 && &f.Body[0] != &msg.Body[0] {
+			// the body was decompressed
+			mc.frame.Body = bytes.Clone(f.Body)
+		}
+	}
+	return &mc
+}
+
+// Frame returns the MESSAGE frame that the message was received in, for
+// programs that need more of it than the fields of the message provide,
+// or that republish it verbatim to another connection. The frame shares
+// its Header with the message, and its Body too, unless
+// ConnOpt.AutoDecompress has decompressed the body of the message: the
+// frame has the body as it was received, and no body if the body is
+// streamed. Frame returns nil if the message was not received in a
+// MESSAGE frame, once the message has been released, and if the
+// connection was created with ConnOpt.DiscardFrames. For a message whose
+// Err comes from an ERROR frame, the frame is in the Frame field of the
+// *Error.
+func (msg *Message) Frame() *frame.Frame {
+	return msg.frame
 }
 
 // ShouldAck returns true if this message should be acknowledged to
-// the STOMP server that sent it.
+// the STOMP server that sent it. Messages that the server cannot
+// identify in an acknowledgement, because they have no AckId, are
+// never acknowledged.
 func (msg *Message) ShouldAck() bool {
 	if msg.Subscription == nil {
 		// not received from the server, so no acknowledgement required
 		return false
 	}
 
-	return msg.Subscription.AckMode() != AckAuto
+	return msg.Subscription.AckMode() != AckAuto && msg.AckId() != ""
+}
+
+// Id returns the value of the "message-id" header, which the
+// server uses to uniquely identify the message.
+func (msg *Message) Id() string {
+	if msg.Header == nil {
+		return ""
+	}
+	return msg.Header.Get(frame.MessageId)
+}
+
+// AckId returns the value that identifies the message in an ACK or
+// NACK frame. In STOMP 1.2 this is the value of the "ack" header,
+// and in earlier versions it is the value of the "message-id" header.
+// Returns an empty string if the header is missing.
+func (msg *Message) AckId() string {
+	if msg.Header == nil {
+		return ""
+	}
+	version := V12
+	if msg.Conn != nil {
+		version = msg.Conn.Version()
+	}
+	if version == V12 {
+		return msg.Header.Get(frame.Ack)
+	}
+	return msg.Header.Get(frame.MessageId)
+}
+
+// Redelivered returns true if the "redelivered" header indicates that
+// the server has delivered the message before, so the program may have
+// already processed it. Not all servers send this header.
+func (msg *Message) Redelivered() bool {
+	if msg.Header == nil {
+		return false
+	}
+	return msg.Header.Get(frame.Redelivered) == "true"
+}
+
+// Property returns the value of an application-defined header entry of
+// the message, which is what a selector specified with SubscribeOpt.Selector
+// refers to by name. The header entries that the STOMP protocol defines for
+// MESSAGE frames, such as "destination" and "message-id", are not properties.
+func (msg *Message) Property(name string) (string, bool) {
+	if msg.Header == nil {
+		return "", false
+	}
+	switch name {
+	case frame.Destination, frame.MessageId, frame.Subscription, frame.Ack,
+		frame.ContentType, frame.ContentLength:
+		return "", false
+	}
+	return msg.Header.Contains(name)
+}
+
+// NackWithOpts sends a negative acknowledgement for this message to the
+// STOMP server, in the same way as Conn.NackWithOpts.
+func (msg *Message) NackWithOpts(opts ...func(*frame.Frame) error) error {
+	if msg.Conn == nil {
+		return ErrNotReceivedMessage
+	}
+	return msg.Conn.NackWithOpts(msg, opts...)
 }
@@ -0,0 +1,206 @@
+package stomp
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_message_ids(c *C) {
+	header := frame.NewHeader(
+		frame.MessageId, "message-1",
+		frame.Ack, "ack-1",
+		frame.Redelivered, "true")
+	sub := &Subscription{ackMode: AckClientIndividual}
+
+	for _, version := range []Version{V10, V11, V12} {
+		msg := &Message{Header: header, Conn: &Conn{version: version}, Subscription: sub}
+		c.Check(msg.Id(), Equals, "message-1")
+		c.Check(msg.Redelivered(), Equals, true)
+		c.Check(msg.ShouldAck(), Equals, true)
+		if version == V12 {
+			c.Check(msg.AckId(), Equals, "ack-1")
+		} else {
+			c.Check(msg.AckId(), Equals, "message-1")
+		}
+	}
+
+	// a STOMP 1.2 message without an ack header cannot be acknowledged
+	msg := &Message{
+		Header:       frame.NewHeader(frame.MessageId, "message-2", frame.Redelivered, "false"),
+		Conn:         &Conn{version: V12},
+		Subscription: sub,
+	}
+	c.Check(msg.AckId(), Equals, "")
+	c.Check(msg.ShouldAck(), Equals, false)
+	c.Check(msg.Redelivered(), Equals, false)
+
+	msg = &Message{}
+	c.Check(msg.Id(), Equals, "")
+	c.Check(msg.AckId(), Equals, "")
+	c.Check(msg.Redelivered(), Equals, false)
+	c.Check(msg.ShouldAck(), Equals, false)
+}
+
+func (s *StompSuite) Test_message_property(c *C) {
+	msg := &Message{Header: frame.NewHeader(
+		frame.Destination, "/queue/test-1",
+		frame.MessageId, "message-1",
+		"color", "red",
+		"size", "")}
+
+	value, ok := msg.Property("color")
+	c.Check(value, Equals, "red")
+	c.Check(ok, Equals, true)
+	value, ok = msg.Property("size")
+	c.Check(value, Equals, "")
+	c.Check(ok, Equals, true)
+	_, ok = msg.Property("weight")
+	c.Check(ok, Equals, false)
+	_, ok = msg.Property(frame.Destination)
+	c.Check(ok, Equals, false)
+
+	_, ok = (&Message{}).Property("color")
+	c.Check(ok, Equals, false)
+}
+
+func (s *StompSuite) Test_message_body_pool(c *C) {
+	const n = 500
+	conn, rw := connectHelper(c, V12, ConnOpt.BodyPool)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.SUBSCRIBE)
+		id := f.Header.Get(frame.Id)
+		for i := 0; i < n; i++ {
+			body := fmt.Sprintf("message %03d", i)
+			rw.Write(&frame.Frame{
+				Command: frame.MESSAGE,
+				Header: frame.NewHeader(
+					frame.Subscription, id,
+					frame.MessageId, strconv.Itoa(i),
+					frame.Destination, "/queue/test-1",
+					frame.ContentLength, strconv.Itoa(len(body))),
+				Body: []byte(body),
+			})
+		}
+
+		f, err = rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+
+	// the bodies of the messages that follow are read into the buffers
+	// released, while the program reads the bodies, and the race
+	// detector reports it if the library still refers to a buffer
+	var copies []*Message
+	for i := 0; i < n; i++ {
+		msg, err := sub.Read()
+		c.Assert(err, IsNil)
+		c.Assert(string(msg.Body), Equals, fmt.Sprintf("message %03d", i))
+		if i%10 == 0 {
+			copies = append(copies, msg.Copy())
+		}
+		msg.Release()
+		c.Check(msg.Body, IsNil)
+		msg.Release()
+	}
+	for i, msg := range copies {
+		c.Check(string(msg.Body), Equals, fmt.Sprintf("message %03d", i*10))
+		c.Check(msg.Id(), Equals, strconv.Itoa(i*10))
+		msg.Release()
+	}
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_message_frame(c *C) {
+	compressed, err := CodecGzip.Compress([]byte("hello"))
+	c.Assert(err, IsNil)
+
+	for _, tc := range []struct {
+		opts   []func(*Conn) error
+		frames bool
+	}{
+		{[]func(*Conn) error{ConnOpt.AutoDecompress(true)}, true},
+		{[]func(*Conn) error{ConnOpt.AutoDecompress(true), ConnOpt.DiscardFrames}, false},
+		{[]func(*Conn) error{ConnOpt.AutoDecompress(true), ConnOpt.DiscardFrames, ConnOpt.BodyPool}, true},
+	} {
+		conn, rw := connectHelper(c, V12, tc.opts...)
+		stop := make(chan struct{})
+
+		go func() {
+			defer close(stop)
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, frame.SUBSCRIBE)
+			id := f.Header.Get(frame.Id)
+			for _, body := range [][]byte{[]byte("plain"), compressed} {
+				msg := frame.New(frame.MESSAGE,
+					frame.Subscription, id,
+					frame.MessageId, "message-1",
+					frame.Destination, "/queue/test-1",
+					frame.ContentLength, strconv.Itoa(len(body)),
+					"x-broker", "extension")
+				if len(body) == len(compressed) {
+					msg.Header.Set(contentEncodingHeader, "gzip")
+				}
+				msg.Body = body
+				rw.Write(msg)
+			}
+
+			f, err = rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, frame.DISCONNECT)
+			rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+		}()
+
+		sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+		c.Assert(err, IsNil)
+
+		msg := <-sub.C
+		c.Assert(msg.Err, IsNil)
+		if !tc.frames {
+			c.Check(msg.Frame(), IsNil)
+		} else {
+			f := msg.Frame()
+			c.Assert(f, NotNil)
+			c.Check(f.Command, Equals, frame.MESSAGE)
+			c.Check(f.Header, Equals, msg.Header)
+			c.Check(f.Header.Get("x-broker"), Equals, "extension")
+			c.Check(string(f.Body), Equals, "plain")
+
+			mc := msg.Copy()
+			c.Check(mc.Frame().Header, Equals, mc.Header)
+			c.Check(&mc.Frame().Body[0], Equals, &mc.Body[0])
+			msg.Release()
+			c.Check(msg.Frame(), IsNil)
+			c.Check(string(mc.Frame().Body), Equals, "plain")
+		}
+
+		// the frame has the body as it was received
+		msg = <-sub.C
+		c.Assert(msg.Err, IsNil)
+		c.Check(string(msg.Body), Equals, "hello")
+		if tc.frames {
+			c.Check(msg.Frame().Body, DeepEquals, compressed)
+			mc := msg.Copy()
+			msg.Release()
+			c.Check(string(mc.Body), Equals, "hello")
+			c.Check(mc.Frame().Body, DeepEquals, compressed)
+		}
+
+		c.Check(conn.Disconnect(), IsNil)
+		<-stop
+	}
+}
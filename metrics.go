@@ -0,0 +1,41 @@
+package stomp
+
+import (
+	"time"
+)
+
+// A Metrics receives statistics about a Conn and its subscriptions, for
+// example to update Prometheus counters. It is specified with
+// ConnOpt.Metrics. The methods are called on the goroutines of the client
+// as events happen, so they must return promptly without blocking, and a
+// Metrics must be safe for use by multiple goroutines. Heart-beats, and the
+// frames of the connect protocol sequence, are not reported.
+type Metrics interface {
+	// FrameSent is called when a frame has been written to the
+	// connection, with the command and the size of the frame in bytes.
+	// The frame may still be buffered, waiting to be flushed.
+	FrameSent(command string, bytes int)
+
+	// FrameReceived is called when a frame has been read from the
+	// connection, with the command and the size of the frame in bytes.
+	// For a streamed body, it is called once the body has been read.
+	FrameReceived(command string, bytes int)
+
+	// MessageDelivered is called when a message received by a subscription
+	// has been delivered on its C channel, with the destination of the
+	// message. The number of messages waiting to be read is len(C).
+	MessageDelivered(destination string)
+
+	// AckSent and NackSent are called when an ACK or a NACK frame
+	// has been written to the connection.
+	AckSent()
+	NackSent()
+
+	// ReceiptLatency is called when a RECEIPT frame is received, with the
+	// time since the frame that requested the receipt was written.
+	ReceiptLatency(d time.Duration)
+
+	// HeartbeatMissed is called when nothing has been received from the
+	// server within the read timeout negotiated for heart-beats.
+	HeartbeatMissed()
+}
@@ -0,0 +1,136 @@
+package stomp
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+// testMetrics records the statistics reported to it.
+type testMetrics struct {
+	sync.Mutex
+	sent, received   []string
+	receivedBytes    map[string]int
+	delivered        []string
+	acks, nacks      int
+	receipts, missed int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{receivedBytes: make(map[string]int)}
+}
+
+func (m *testMetrics) FrameSent(command string, bytes int) {
+	m.Lock()
+	defer m.Unlock()
+	m.sent = append(m.sent, command)
+}
+
+func (m *testMetrics) FrameReceived(command string, bytes int) {
+	m.Lock()
+	defer m.Unlock()
+	m.received = append(m.received, command)
+	m.receivedBytes[command] += bytes
+}
+
+func (m *testMetrics) MessageDelivered(destination string) {
+	m.Lock()
+	defer m.Unlock()
+	m.delivered = append(m.delivered, destination)
+}
+
+func (m *testMetrics) AckSent() {
+	m.Lock()
+	defer m.Unlock()
+	m.acks++
+}
+
+func (m *testMetrics) NackSent() {
+	m.Lock()
+	defer m.Unlock()
+	m.nacks++
+}
+
+func (m *testMetrics) ReceiptLatency(d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.receipts++
+}
+
+func (m *testMetrics) HeartbeatMissed() {
+	m.Lock()
+	defer m.Unlock()
+	m.missed++
+}
+
+func (s *StompSuite) Test_metrics(c *C) {
+	m := newTestMetrics()
+	conn, rw := connectHelper(c, V12, ConnOpt.Metrics(m))
+	stop := make(chan struct{})
+
+	messageFrame := frame.New(frame.MESSAGE,
+		frame.Destination, "/queue/test-1",
+		frame.MessageId, "1",
+		frame.Ack, "ack-1")
+	messageFrame.Body = []byte("hello")
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		messageFrame.Header.Set(frame.Subscription, f1.Header.Get(frame.Id))
+		rw.Write(messageFrame)
+
+		for _, command := range []string{frame.ACK, frame.NACK, frame.SEND, frame.DISCONNECT} {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, command)
+			if receipt, ok := f.Header.Contains(frame.Receipt); ok {
+				rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+			}
+		}
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckClientIndividual)
+	c.Assert(err, IsNil)
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Assert(conn.Ack(msg), IsNil)
+	c.Assert(conn.Nack(msg), IsNil)
+	c.Assert(conn.Send("/queue/test-2", "text/plain", []byte("hi"), SendOpt.Receipt), IsNil)
+	c.Assert(conn.Disconnect(), IsNil)
+	<-stop
+
+	var b bytes.Buffer
+	c.Assert(frame.NewWriter(&b).Write(messageFrame), IsNil)
+
+	m.Lock()
+	defer m.Unlock()
+	c.Check(m.sent, DeepEquals, []string{frame.SUBSCRIBE, frame.ACK, frame.NACK, frame.SEND, frame.DISCONNECT})
+	c.Check(m.received, DeepEquals, []string{frame.MESSAGE, frame.RECEIPT, frame.RECEIPT})
+	c.Check(m.receivedBytes[frame.MESSAGE], Equals, b.Len())
+	c.Check(m.delivered, DeepEquals, []string{"/queue/test-1"})
+	c.Check(m.acks, Equals, 1)
+	c.Check(m.nacks, Equals, 1)
+	c.Check(m.receipts, Equals, 2)
+
+	_, err = Connect(nil, ConnOpt.Metrics(nil))
+	c.Check(err, Equals, ErrNilOption)
+}
+
+func (s *StompSuite) Test_metrics_heartbeat_missed(c *C) {
+	m := newTestMetrics()
+	conn, _ := createHeartBeatConnection(c, 100, 10000, time.Millisecond, ConnOpt.Metrics(m))
+
+	// the server sends nothing, so the connection fails
+	for err := range conn.Errors() {
+		c.Check(err, Equals, ErrReadTimeout)
+	}
+	m.Lock()
+	defer m.Unlock()
+	c.Check(m.missed, Equals, 1)
+}
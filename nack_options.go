@@ -0,0 +1,39 @@
+package stomp
+
+import (
+	"github.com/go-stomp/stomp/frame"
+)
+
+// NackOpt contains options for the Conn.NackWithOpts and
+// Message.NackWithOpts functions.
+var NackOpt struct {
+	// NoRequeue asks the server to discard the message, or move it to a
+	// dead letter queue, instead of delivering it again. It adds the
+	// "requeue:false" header entry, which is understood by RabbitMQ. Use
+	// Conn.Supports(FeatureNackRequeueHeader) to check for the support.
+	NoRequeue func(*frame.Frame) error
+
+	// Header provides the opportunity to include custom header entries
+	// in the NACK frame, for servers that support other options.
+	Header func(key, value string) func(*frame.Frame) error
+}
+
+func init() {
+	NackOpt.NoRequeue = func(f *frame.Frame) error {
+		if f.Command != frame.NACK {
+			return ErrInvalidCommand
+		}
+		f.Header.Set("requeue", "false")
+		return nil
+	}
+
+	NackOpt.Header = func(key, value string) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			if f.Command != frame.NACK {
+				return ErrInvalidCommand
+			}
+			f.Header.Add(key, value)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package stomp
+
+// The OverflowStrategy type is an enumeration of the actions a Subscription
+// can take when a message is received from the server and the Subscription.C
+// channel is full.
+type OverflowStrategy int
+
+const (
+	// Wait until there is room in the channel. While waiting, the
+	// connection stops reading from the server. This is the default.
+	OverflowBlock OverflowStrategy = iota
+
+	// Discard the oldest message in the channel to make room
+	// for the new message.
+	OverflowDropOldest
+
+	// Discard the new message.
+	OverflowDropNewest
+
+	// Close the subscription. The last message on the channel contains
+	// ErrSubscriptionOverflow, and the subscription is unsubscribed.
+	OverflowFail
+)
+
+// String returns the string representation of the OverflowStrategy value.
+func (o OverflowStrategy) String() string {
+	switch o {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowFail:
+		return "fail"
+	}
+	panic("invalid OverflowStrategy value")
+}
+
+// isValid returns true if o is one of the defined strategies.
+func (o OverflowStrategy) isValid() bool {
+	return o >= OverflowBlock && o <= OverflowFail
+}
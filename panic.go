@@ -0,0 +1,54 @@
+package stomp
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// callSafely calls f, a function of the program that the client calls on
+// one of its own goroutines, and recovers from a panic in f, so that the
+// panic does not stop the goroutine. The panic is returned as an error
+// that wraps ErrPanic.
+func callSafely(name string, onPanic func(recovered any, stack []byte), f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicked(name, r, onPanic)
+		}
+	}()
+	f()
+	return nil
+}
+
+// panicked returns the error for a value recovered from a panic in the
+// function called name, after passing the value and the stack trace to
+// onPanic, if it is not nil. It must be called by the deferred function
+// that recovered, so that the stack trace is that of the panic.
+func panicked(name string, recovered any, onPanic func(recovered any, stack []byte)) error {
+	if onPanic != nil {
+		stack := debug.Stack()
+		callSafely("panic function", nil, func() {
+			onPanic(recovered, stack)
+		})
+	}
+	return Error{
+		Message: fmt.Sprintf("%s: %s: %v", ErrPanic.Message, name, recovered),
+		cause:   ErrPanic,
+	}
+}
+
+// safely calls f in the same way as callSafely, with the function
+// specified with ConnOpt.OnPanic, and reports a panic.
+func (c *Conn) safely(name string, f func()) error {
+	err := callSafely(name, c.onPanic, f)
+	if err != nil {
+		c.reportPanic(err)
+	}
+	return err
+}
+
+// reportPanic logs the error for a recovered panic, and
+// sends it on the Errors channel.
+func (c *Conn) reportPanic(err error) {
+	c.log.Errorf("%v", err)
+	c.reportError(err)
+}
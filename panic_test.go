@@ -0,0 +1,92 @@
+package stomp
+
+import (
+	"errors"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_panic_in_error_function(c *C) {
+	recovered := make(chan any, 1)
+	conn, rw := connectHelper(c, V12, ConnOpt.OnPanic(func(r any, stack []byte) {
+		c.Check(len(stack) > 0, Equals, true)
+		recovered <- r
+	}))
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		rw.Write(frame.New(frame.ERROR, frame.Message, "not authorized", frame.Subscription, f1.Header.Get(frame.Id)))
+
+		// the connection is still open
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.OnError(func(sub *Subscription, err *Error) bool {
+		panic("cannot handle error")
+	}))
+	c.Assert(err, IsNil)
+
+	// a panic does not keep the subscription open
+	_, ok := <-sub.C
+	c.Check(ok, Equals, false)
+	c.Check(<-recovered, Equals, "cannot handle error")
+
+	// the ERROR frame is reported first
+	c.Check(<-conn.Errors(), ErrorMatches, "not authorized")
+	err = <-conn.Errors()
+	c.Check(errors.Is(err, ErrPanic), Equals, true)
+	c.Check(err, ErrorMatches, "panic: subscription error function: cannot handle error")
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+
+	_, err = Connect(nil, ConnOpt.OnPanic(nil))
+	c.Check(err, Equals, ErrNilOption)
+}
+
+func (s *StompSuite) Test_panic_in_receive_interceptor(c *C) {
+	conn, rw := connectHelper(c, V12, ConnOpt.ReceiveInterceptor(func(f *frame.Frame) error {
+		if f.Header.Get(frame.MessageId) == "1" {
+			panic("cannot intercept")
+		}
+		return nil
+	}))
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		id := f1.Header.Get(frame.Id)
+		for _, messageId := range []string{"1", "2"} {
+			rw.Write(frame.New(frame.MESSAGE, frame.Subscription, id, frame.MessageId, messageId, frame.Destination, "/queue/test-1"))
+		}
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+
+	// the frame that caused the panic is discarded
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(msg.Header.Get(frame.MessageId), Equals, "2")
+	err = <-conn.Errors()
+	c.Check(errors.Is(err, ErrPanic), Equals, true)
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
@@ -0,0 +1,36 @@
+package stomp
+
+import (
+	"context"
+	"time"
+)
+
+// Ping checks that the STOMP server responds, and returns the time that
+// it took to respond. This checks the whole round trip, including the
+// processing of frames by the server, whereas heart-beats only check that
+// the network connection is alive.
+//
+// By default Ping begins a transaction and aborts it with a receipt, which
+// has no effect on the server. If ConnOpt.PingDestination is specified, it
+// sends an empty message to that destination with a receipt instead. Ping
+// waits for the receipt until the context is done, in which case the error
+// returned wraps ctx.Err(). If the server responds with an ERROR frame, the
+// error returned wraps a *BrokerError for the frame.
+func (c *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	if c.pingDestination != "" {
+		if err := c.SendWithContext(ctx, c.pingDestination, "", nil, SendOpt.Receipt); err != nil {
+			return 0, err
+		}
+		return time.Since(start), nil
+	}
+
+	tx, err := c.BeginWithError()
+	if err != nil {
+		return 0, err
+	}
+	if err = tx.AbortWithContext(ctx, TransactionOpt.ReceiptTimeout(0)); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
@@ -0,0 +1,83 @@
+package stomp
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_ping(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.BEGIN)
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.ABORT)
+		c.Check(f2.Header.Get(frame.Transaction), Equals, f1.Header.Get(frame.Transaction))
+		time.Sleep(10 * time.Millisecond)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+
+		// the server does not respond to the second ping
+		_, err = rw.Read()
+		c.Assert(err, IsNil)
+		_, err = rw.Read()
+		c.Assert(err, IsNil)
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	latency, err := conn.Ping(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(latency >= 10*time.Millisecond, Equals, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	latency, err = conn.Ping(ctx)
+	c.Check(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	c.Check(latency, Equals, time.Duration(0))
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_ping_destination(c *C) {
+	conn, rw := connectHelper(c, V12, ConnOpt.PingDestination("/queue/ping"))
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SEND)
+		c.Check(f1.Header.Get(frame.Destination), Equals, "/queue/ping")
+		c.Check(len(f1.Body), Equals, 0)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f1.Header.Get(frame.Receipt)))
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.SEND)
+		rw.Write(frame.New(frame.ERROR, frame.ReceiptId, f2.Header.Get(frame.Receipt), frame.Message, "denied"))
+	}()
+
+	_, err := conn.Ping(context.Background())
+	c.Assert(err, IsNil)
+
+	_, err = conn.Ping(context.Background())
+	var brokerErr *BrokerError
+	c.Check(errors.As(err, &brokerErr), Equals, true)
+	<-stop
+
+	_, err = Connect(nil, ConnOpt.PingDestination(""))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+}
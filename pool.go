@@ -0,0 +1,294 @@
+package stomp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// DefaultPoolCloseTimeout is how long Pool.Close waits for each connection
+// of the pool to drain.
+const DefaultPoolCloseTimeout = 10 * time.Second
+
+// A Pool is a set of connections to a STOMP server, for programs that send
+// messages from many goroutines. The frames sent on a Conn are written one
+// at a time, so a single connection limits the rate at which messages can
+// be sent; a Pool spreads the messages over several connections.
+//
+// Each call to Send uses the next healthy connection in turn. A connection
+// is healthy if it is connected, is not reconnecting, and has passed the
+// most recent health check, if HealthCheckInterval is set. A connection
+// that has closed, or has failed a health check, is replaced with a new
+// connection in the background once a call to Send finds it.
+//
+// A Pool is safe for use by multiple goroutines.
+type Pool struct {
+	// HealthCheckInterval is how often each connection of the pool is
+	// checked with Conn.Ping, if it is set before the first call to Send.
+	// A connection whose server does not respond before the next check is
+	// due is considered dead: Send stops using it, and replaces it with a
+	// new connection. If zero, the health of a connection is determined
+	// by its state alone.
+	HealthCheckInterval time.Duration
+
+	dial        func() (*Conn, error)
+	slots       []*poolSlot
+	next        uint32 // accessed atomically
+	closed      int32  // accessed atomically
+	startChecks sync.Once
+	stop        chan struct{} // closed by Close
+	done        chan struct{} // closed when the health checks have stopped
+}
+
+// A poolSlot holds one of the connections of a Pool.
+type poolSlot struct {
+	mutex     sync.Mutex // held while the connection is replaced
+	conn      *Conn      // nil if there is no connection
+	failed    bool       // the connection has failed a health check
+	replacing bool       // the connection is to be replaced in the background
+}
+
+// NewPool creates a Pool of size connections, each created by calling
+// dial, such as
+//
+//	pool := stomp.NewPool(8, func() (*stomp.Conn, error) {
+//		return stomp.Dial("tcp", "localhost:61613")
+//	})
+//
+// The connections are created before NewPool returns. A connection that
+// cannot be created is replaced by Send, in the same way as one that has
+// closed, and Send returns the error from dial if it has no connection to
+// send on. NewPool panics if size is not positive, or if dial is nil.
+func NewPool(size int, dial func() (*Conn, error)) *Pool {
+	if size <= 0 {
+		panic("non-positive size for NewPool")
+	}
+	if dial == nil {
+		panic("nil dial function for NewPool")
+	}
+
+	p := &Pool{
+		dial:  dial,
+		slots: make([]*poolSlot, size),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	for i := range p.slots {
+		p.slots[i] = &poolSlot{}
+		if conn, err := dial(); err == nil {
+			p.slots[i].conn = conn
+		}
+	}
+	return p
+}
+
+// Send sends a message to the STOMP server on the next healthy connection
+// of the pool, in the same way as Conn.Send. If none of the connections are
+// healthy, Send waits for a connection that has closed or failed a health
+// check to be replaced; if there is none to replace, because every connection
+// is reconnecting, ErrNoHealthyConnection is returned. Once the pool is
+// closed, ErrPoolClosed is returned.
+func (p *Pool) Send(destination, contentType string, body []byte, opts ...func(*frame.Frame) error) error {
+	conn, err := p.get()
+	if err != nil {
+		return err
+	}
+	return conn.Send(destination, contentType, body, opts...)
+}
+
+// get returns the next healthy connection, replacing a dead
+// connection if there is no healthy one.
+func (p *Pool) get() (*Conn, error) {
+	if p.isClosed() {
+		return nil, ErrPoolClosed
+	}
+	p.startChecks.Do(func() {
+		if p.HealthCheckInterval > 0 {
+			go p.checkHealth()
+		} else {
+			close(p.done)
+		}
+	})
+
+	n := uint32(len(p.slots))
+	start := atomic.AddUint32(&p.next, 1)
+
+	// the slots whose connections are being replaced are skipped
+	for i := uint32(0); i < n; i++ {
+		s := p.slots[(start+i)%n]
+		if !s.mutex.TryLock() {
+			continue
+		}
+		conn := s.healthy()
+		if conn == nil && s.dead() && !s.replacing {
+			s.replacing = true
+			go p.replace(s)
+		}
+		s.mutex.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+	}
+
+	err := error(ErrNoHealthyConnection)
+	for i := uint32(0); i < n; i++ {
+		conn, replaceErr := p.replace(p.slots[(start+i)%n])
+		if conn != nil {
+			return conn, nil
+		}
+		if replaceErr != nil {
+			err = replaceErr
+		}
+	}
+	return nil, err
+}
+
+// replace returns the connection of a slot if it is healthy, or replaces
+// it with a new connection if it is dead. It returns nil if the connection
+// is reconnecting.
+func (p *Pool) replace(s *poolSlot) (*Conn, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.replacing = false
+	if p.isClosed() {
+		return nil, ErrPoolClosed
+	}
+	if conn := s.healthy(); conn != nil {
+		return conn, nil
+	}
+	if !s.dead() {
+		return nil, nil
+	}
+
+	if s.conn != nil {
+		go s.conn.MustDisconnect()
+	}
+	s.conn, s.failed = nil, false
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	return conn, nil
+}
+
+// healthy returns the connection of the slot if it is healthy, or nil.
+// The slot's mutex must be held.
+func (s *poolSlot) healthy() *Conn {
+	if s.conn == nil || s.failed || s.conn.State() != Connected || s.conn.isReconnecting() {
+		return nil
+	}
+	return s.conn
+}
+
+// dead reports whether the connection of the slot is to be replaced,
+// because it has closed or failed a health check. A connection that is
+// reconnecting is not dead. The slot's mutex must be held.
+func (s *poolSlot) dead() bool {
+	if s.conn == nil || s.failed {
+		return true
+	}
+	state := s.conn.State()
+	return state == Disconnecting || state == Closed
+}
+
+// checkHealth checks the connections of the pool once per
+// interval, until the pool is closed.
+func (p *Pool) checkHealth() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var wg sync.WaitGroup
+		for _, s := range p.slots {
+			s.mutex.Lock()
+			conn := s.healthy()
+			s.mutex.Unlock()
+			if conn == nil {
+				continue
+			}
+
+			wg.Add(1)
+			go func(s *poolSlot, conn *Conn) {
+				defer wg.Done()
+				if err := p.ping(conn); err != nil {
+					s.mutex.Lock()
+					if s.conn == conn {
+						s.failed = true
+					}
+					s.mutex.Unlock()
+				}
+			}(s, conn)
+		}
+		wg.Wait()
+	}
+}
+
+// ping checks conn with Conn.Ping, waiting for the server to respond
+// until the next check is due.
+func (p *Pool) ping(conn *Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.HealthCheckInterval)
+	defer cancel()
+	_, err := conn.Ping(ctx)
+	return err
+}
+
+func (p *Pool) isClosed() bool {
+	return atomic.LoadInt32(&p.closed) != 0
+}
+
+// Close drains every connection of the pool, as described for Conn.Drain,
+// and returns the errors combined. Once the pool is closed Send returns
+// ErrPoolClosed. Calling Close more than once has no further effect. The
+// connections are drained for no longer than DefaultPoolCloseTimeout; use
+// CloseContext for a different limit.
+func (p *Pool) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultPoolCloseTimeout)
+	defer cancel()
+	return p.CloseContext(ctx)
+}
+
+// CloseContext closes the pool in the same way as Close, except that the
+// drain of each connection is bounded by ctx, as described for Conn.Drain.
+func (p *Pool) CloseContext(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		return nil
+	}
+	close(p.stop)
+	// the health checks are not started by Send once the pool is closed
+	p.startChecks.Do(func() { close(p.done) })
+	<-p.done
+
+	var conns []*Conn
+	for _, s := range p.slots {
+		s.mutex.Lock()
+		if s.conn != nil {
+			conns = append(conns, s.conn)
+		}
+		s.conn = nil
+		s.mutex.Unlock()
+	}
+
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn *Conn) {
+			defer wg.Done()
+			errs[i] = conn.Drain(ctx)
+		}(i, conn)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
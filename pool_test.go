@@ -0,0 +1,214 @@
+package stomp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+// poolServer serves the connections of a Pool, counting
+// the SEND frames received on each.
+type poolServer struct {
+	c     *C
+	mutex sync.Mutex
+	rws   []*fakeReaderWriter
+	sends []int32 // accessed atomically
+
+	// if non-nil, reports whether a frame received on
+	// the connection is to be ignored
+	ignore func(conn int, f *frame.Frame) bool
+}
+
+// dial connects to the server, for NewPool.
+func (ps *poolServer) dial() (*Conn, error) {
+	conn, rw := connectHelper(ps.c, V12)
+	ps.mutex.Lock()
+	n := len(ps.rws)
+	ps.rws = append(ps.rws, rw)
+	ps.sends = append(ps.sends, 0)
+	ps.mutex.Unlock()
+
+	// the receipts are written by another goroutine, so that reading
+	// never waits for the client to read a receipt while the client
+	// waits to write a frame
+	receipts := make(chan *frame.Frame, 1024)
+	go func() {
+		for f := range receipts {
+			rw.Write(f)
+		}
+	}()
+
+	go func() {
+		defer close(receipts)
+		for {
+			f, err := rw.Read()
+			if err != nil {
+				return
+			}
+			if f == nil || (ps.ignore != nil && ps.ignore(n, f)) {
+				continue
+			}
+			if f.Command == frame.SEND {
+				ps.mutex.Lock()
+				atomic.AddInt32(&ps.sends[n], 1)
+				ps.mutex.Unlock()
+			}
+			if receipt, ok := f.Header.Contains(frame.Receipt); ok {
+				receipts <- frame.New(frame.RECEIPT, frame.ReceiptId, receipt)
+			}
+			if f.Command == frame.DISCONNECT {
+				return
+			}
+		}
+	}()
+	return conn, nil
+}
+
+func (ps *poolServer) dials() int {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return len(ps.rws)
+}
+
+func (ps *poolServer) sent(conn int) int32 {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return atomic.LoadInt32(&ps.sends[conn])
+}
+
+func (s *StompSuite) Test_pool_send(c *C) {
+	ps := &poolServer{c: c}
+	pool := NewPool(3, ps.dial)
+	c.Check(ps.dials(), Equals, 3)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				c.Check(pool.Send("/queue/test-1", "text/plain", []byte("hello"), SendOpt.Receipt), IsNil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := int32(0)
+	for i := 0; i < 3; i++ {
+		c.Check(ps.sent(i) > 0, Equals, true)
+		total += ps.sent(i)
+	}
+	c.Check(total, Equals, int32(300))
+
+	c.Check(pool.Close(), IsNil)
+	c.Check(pool.Close(), IsNil)
+	c.Check(pool.Send("/queue/test-1", "text/plain", nil), Equals, ErrPoolClosed)
+	for _, slot := range pool.slots {
+		c.Check(slot.conn, IsNil)
+	}
+}
+
+func (s *StompSuite) Test_pool_close_context(c *C) {
+	// the server never responds to the DISCONNECT frames
+	ps := &poolServer{c: c, ignore: func(conn int, f *frame.Frame) bool {
+		return f.Command == frame.DISCONNECT
+	}}
+	pool := NewPool(2, ps.dial)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := pool.CloseContext(ctx)
+	c.Check(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	c.Check(time.Since(start) < 5*time.Second, Equals, true)
+	c.Check(pool.Close(), IsNil)
+}
+
+func (s *StompSuite) Test_pool_replaces_dead_connection(c *C) {
+	ps := &poolServer{c: c}
+	pool := NewPool(2, ps.dial)
+	defer pool.Close()
+
+	// the connection is lost, and is not used by Send
+	dead := pool.slots[0].conn
+	ps.rws[0].Close()
+	for dead.State() != Closed {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		c.Check(pool.Send("/queue/test-1", "text/plain", []byte("hello"), SendOpt.Receipt), IsNil)
+	}
+	for ps.dials() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(ps.sent(0), Equals, int32(0))
+
+	// the new connection is used once it is connected
+	for i := 0; i < 10; i++ {
+		c.Check(pool.Send("/queue/test-1", "text/plain", []byte("hello"), SendOpt.Receipt), IsNil)
+	}
+	c.Check(ps.sent(2) > 0, Equals, true)
+	c.Check(ps.sent(1)+ps.sent(2), Equals, int32(20))
+}
+
+func (s *StompSuite) Test_pool_health_check(c *C) {
+	ps := &poolServer{c: c}
+	// the first connection does not respond to the health check
+	ps.ignore = func(conn int, f *frame.Frame) bool {
+		return conn == 0 && f.Command == frame.ABORT
+	}
+	pool := NewPool(1, ps.dial)
+	pool.HealthCheckInterval = 20 * time.Millisecond
+	defer pool.Close()
+
+	// the health checks start with the first message
+	c.Check(pool.Send("/queue/test-1", "text/plain", []byte("hello"), SendOpt.Receipt), IsNil)
+	slot := pool.slots[0]
+	for {
+		slot.mutex.Lock()
+		failed := slot.failed
+		slot.mutex.Unlock()
+		if failed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// there is no other connection, so Send waits for the replacement
+	c.Check(pool.Send("/queue/test-1", "text/plain", []byte("hello"), SendOpt.Receipt), IsNil)
+	c.Check(ps.dials(), Equals, 2)
+	c.Check(ps.sent(0), Equals, int32(1))
+	c.Check(ps.sent(1), Equals, int32(1))
+}
+
+func (s *StompSuite) Test_pool_dial_error(c *C) {
+	ps := &poolServer{c: c}
+	dialErr := errors.New("connection refused")
+	var failing atomic.Bool
+	failing.Store(true)
+	pool := NewPool(1, func() (*Conn, error) {
+		if failing.Load() {
+			return nil, dialErr
+		}
+		return ps.dial()
+	})
+	defer pool.Close()
+
+	// the connection that could not be created is created by Send
+	c.Check(pool.Send("/queue/test-1", "text/plain", nil), Equals, dialErr)
+	failing.Store(false)
+	c.Check(pool.Send("/queue/test-1", "text/plain", []byte("hello"), SendOpt.Receipt), IsNil)
+	c.Check(ps.sent(0), Equals, int32(1))
+}
+
+func (s *StompSuite) Test_pool_invalid(c *C) {
+	ps := &poolServer{c: c}
+	c.Check(func() { NewPool(0, ps.dial) }, PanicMatches, "non-positive size for NewPool")
+	c.Check(func() { NewPool(1, nil) }, PanicMatches, "nil dial function for NewPool")
+	c.Check(ps.dials(), Equals, 0)
+}
@@ -0,0 +1,33 @@
+package stomp
+
+// A Receipt is the result of a call to Conn.SendAsync. It completes when
+// the STOMP server acknowledges the SEND frame with a RECEIPT frame, or
+// when the send fails.
+type Receipt struct {
+	id   string
+	done chan struct{}
+	err  error
+}
+
+// Id returns the value of the receipt header entry in the SEND frame.
+func (r *Receipt) Id() string {
+	return r.id
+}
+
+// Done returns a channel that is closed when the send has completed.
+func (r *Receipt) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns nil if the send has not completed yet, or if the server
+// received the message. Otherwise it returns the reason the send failed:
+// an Error for an ERROR frame, ErrMsgSendTimeout if SendOpt.ReceiptTimeout
+// expired, or ErrClosedUnexpectedly if the connection closed.
+func (r *Receipt) Err() error {
+	select {
+	case <-r.done:
+		return r.err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,430 @@
+package stomp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// Default values used for any ReconnectPolicy fields that are not specified.
+const (
+	DefaultReconnectInitialInterval = time.Second
+	DefaultReconnectMaxInterval     = 30 * time.Second
+	DefaultReconnectMultiplier      = 2.0
+)
+
+// A ReconnectPolicy specifies how a Conn re-establishes its connection
+// to the STOMP server after the network connection fails. It is used with
+// the ConnOpt.Reconnect option and the DialWithReconnect function.
+//
+// When the connection fails, the Conn dials the server again, performs the
+// STOMP connect protocol sequence with the original connect options, and
+// re-sends the SUBSCRIBE frame for every active subscription. Messages
+// continue to be delivered on the same Subscription.C channels.
+//
+// Reconnection is only attempted after a network failure or a heart-beat
+// timeout. Receiving an ERROR frame from the server closes the connection
+// as usual.
+type ReconnectPolicy struct {
+	// InitialInterval is the time to wait after the first failed attempt
+	// to reconnect. The first attempt is made immediately. Defaults to
+	// DefaultReconnectInitialInterval.
+	InitialInterval time.Duration
+
+	// MaxInterval is the longest time to wait between attempts.
+	// Defaults to DefaultReconnectMaxInterval.
+	MaxInterval time.Duration
+
+	// Multiplier is the factor by which the wait increases after each
+	// failed attempt. Defaults to DefaultReconnectMultiplier.
+	Multiplier float64
+
+	// MaxAttempts is the number of consecutive failed attempts after which
+	// the Conn gives up and closes. Zero means keep trying until the
+	// program disconnects.
+	MaxAttempts int
+
+	// MaxQueuedSends is the number of calls to Send that are accepted while
+	// reconnecting. The frames are queued and written once the connection
+	// has been re-established. Further calls fail with ErrConnectionClosed.
+	// Zero means that all sends fail while reconnecting.
+	MaxQueuedSends int
+
+	// Dial creates a new network connection to the STOMP server. It is
+	// required when using ConnOpt.Reconnect with Connect, and is set
+	// automatically by DialWithReconnect.
+	Dial func() (io.ReadWriteCloser, error)
+}
+
+// withDefaults returns a copy of the policy with default values
+// filled in.
+func (p ReconnectPolicy) withDefaults() *ReconnectPolicy {
+	if p.InitialInterval == 0 {
+		p.InitialInterval = DefaultReconnectInitialInterval
+	}
+	if p.MaxInterval == 0 {
+		p.MaxInterval = DefaultReconnectMaxInterval
+	}
+	if p.MaxInterval < p.InitialInterval {
+		p.MaxInterval = p.InitialInterval
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = DefaultReconnectMultiplier
+	}
+	return &p
+}
+
+func (p *ReconnectPolicy) validate() error {
+	if p.InitialInterval < 0 || p.MaxInterval < 0 || p.MaxAttempts < 0 || p.MaxQueuedSends < 0 {
+		return ErrInvalidOptionValue
+	}
+	if p.Multiplier != 0 && p.Multiplier < 1 {
+		return ErrInvalidOptionValue
+	}
+	return nil
+}
+
+// next returns the wait that follows interval.
+func (p *ReconnectPolicy) next(interval time.Duration) time.Duration {
+	interval = time.Duration(float64(interval) * p.Multiplier)
+	if interval > p.MaxInterval {
+		interval = p.MaxInterval
+	}
+	return interval
+}
+
+// DialWithReconnect is the same as Dial, except that the connection is
+// re-established automatically if it fails. The default ReconnectPolicy
+// is used unless one is specified with ConnOpt.Reconnect in opts; if the
+// policy has no Dial function, the network endpoint is dialed again,
+// using TLS if ConnOpt.TLSConfig is specified.
+func DialWithReconnect(network, addr string, opts ...func(*Conn) error) (*Conn, error) {
+	opts = append([](func(*Conn) error){ConnOpt.Reconnect(ReconnectPolicy{})}, opts...)
+	opts = append(opts, func(c *Conn) error {
+		if c.options.Reconnect.Dial == nil {
+			options := c.options
+			c.options.Reconnect.Dial = func() (io.ReadWriteCloser, error) {
+				return dialNetwork(context.Background(), network, addr, options.TLSConfig, options)
+			}
+		}
+		return nil
+	})
+
+	return Dial(network, addr, opts...)
+}
+
+// isReconnecting reports whether the processing loop is trying to
+// re-establish the connection.
+func (c *Conn) isReconnecting() bool {
+	return atomic.LoadInt32(&c.reconnecting) != 0
+}
+
+// epochHeader is the header entry of the CONNECTED frames that the
+// processing loop delivers to subscriptions. These frames never leave
+// the client, and tell the subscription which connection the messages
+// that follow were received on.
+const epochHeader = "epoch"
+
+func newEpochFrame(epoch uint64) *frame.Frame {
+	return frame.New(frame.CONNECTED, epochHeader, strconv.FormatUint(epoch, 10))
+}
+
+// outage holds the state of the processing loop while it is
+// reconnecting to the server.
+type outage struct {
+	c             *Conn
+	channels      map[string]chan *frame.Frame
+	subscriptions map[string]*frame.Frame
+	pending       []writeRequest
+	closed        bool // the program has closed the connection
+
+	// the new connection, once re-established
+	writer       *frame.Writer
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+// reconnect re-establishes the connection to the server after it failed
+// with cause. Requests that have not been written yet are in pending, and
+// any that are written by the program while reconnecting are added to it.
+// Returns the new connection, with the requests that are still to be
+// written, or nil if the connection could not be re-established.
+func (c *Conn) reconnect(cause error, channels map[string]chan *frame.Frame,
+	subscriptions map[string]*frame.Frame, pending []writeRequest) *outage {
+	policy := c.reconnectPolicy
+	if policy == nil {
+		return nil
+	}
+
+	atomic.StoreInt32(&c.queuedSends, 0)
+	c.setState(Connecting)
+	atomic.StoreInt32(&c.reconnecting, 1)
+	defer atomic.StoreInt32(&c.reconnecting, 0)
+
+	if err := c.closeTransport(); err != nil {
+		c.log.Warnf("failed to close connection: %v", err)
+	}
+	// the reader of the failed connection may still have frames to
+	// deliver, and stops once it has read to the end of its input
+	go c.drainReads(c.readCh)
+	c.log.Warnf("connection failed: %v; reconnecting", cause)
+
+	o := &outage{
+		c:             c,
+		channels:      channels,
+		subscriptions: subscriptions,
+	}
+	o.reset(cause)
+	for _, req := range pending {
+		o.handle(req, true)
+	}
+
+	interval := policy.InitialInterval
+	for attempt := 1; ; attempt++ {
+		// handle anything already written by the program, which also
+		// notices if the program has closed the connection
+		if !o.wait(0) {
+			break
+		}
+
+		err := o.redial()
+		if err == nil {
+			c.log.Infof("reconnected after %d attempt(s)", attempt)
+			c.setState(Connected)
+			return o
+		}
+		c.log.Warnf("reconnect attempt %d failed: %v", attempt, err)
+
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			break
+		}
+		if !o.wait(interval) {
+			break
+		}
+		interval = policy.next(interval)
+	}
+
+	o.fail(cause)
+	return nil
+}
+
+// reset discards everything that relied on the failed connection.
+// Receipts that were expected will never arrive, and subscriptions
+// that were being unsubscribed no longer exist on the server.
+func (o *outage) reset(cause error) {
+	for id, ch := range o.channels {
+		if f, ok := o.subscriptions[id]; ok {
+			if f == nil {
+				o.closeSubscription(id)
+			}
+			continue
+		}
+		ch <- newErrorFrame(cause)
+		delete(o.channels, id)
+	}
+}
+
+// closeSubscription completes an unsubscribe without involving the server.
+func (o *outage) closeSubscription(id string) {
+	if ch, ok := o.channels[id]; ok {
+		ch <- frame.New(frame.RECEIPT, frame.ReceiptId, id)
+		close(ch)
+		delete(o.channels, id)
+	}
+	delete(o.subscriptions, id)
+}
+
+// fail reports cause to the senders of requests that are never written.
+func (o *outage) fail(cause error) {
+	f := newErrorFrame(cause)
+	for _, req := range o.pending {
+		if req.C != nil {
+			req.C <- f
+		}
+	}
+	o.pending = nil
+}
+
+// wait handles requests written by the program until d has elapsed.
+// If d is zero, only the requests already written are handled.
+// Returns false if the program has closed the connection.
+func (o *outage) wait(d time.Duration) bool {
+	var timeoutCh <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	for !o.closed {
+		if d > 0 {
+			select {
+			case req, ok := <-o.c.writeCh:
+				o.handle(req, ok)
+			case <-timeoutCh:
+				return true
+			}
+		} else {
+			select {
+			case req, ok := <-o.c.writeCh:
+				o.handle(req, ok)
+			default:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handle processes a request written by the program while reconnecting.
+func (o *outage) handle(req writeRequest, ok bool) {
+	if !ok {
+		// the write channel is closed by MustDisconnect
+		o.closed = true
+		return
+	}
+	if req.batch != nil {
+		for _, r := range req.batch {
+			o.handle(r, true)
+		}
+		return
+	}
+	if req.idle != nil {
+		// receipts for the requests already queued are outstanding
+		o.pending = append(o.pending, req)
+		return
+	}
+	if req.flushed != nil {
+		// acks that were not flushed were for messages received
+		// on the failed connection, so there is nothing to flush
+		req.flushed <- nil
+		return
+	}
+	if req.Frame == nil {
+		delete(o.channels, req.forget)
+		return
+	}
+	if req.ctx != nil && req.ctx.Err() != nil {
+		return
+	}
+
+	switch req.Frame.Command {
+	case frame.DISCONNECT:
+		// there is no server to tell, so the disconnect succeeds at once
+		if req.C != nil {
+			receipt := req.Frame.Header.Get(frame.Receipt)
+			req.C <- frame.New(frame.RECEIPT, frame.ReceiptId, receipt)
+		}
+		o.closed = true
+
+	case frame.SUBSCRIBE:
+		// the subscription is created along with the others
+		// once the connection has been re-established
+		id, _ := req.Frame.Header.Contains(frame.Id)
+		o.channels[id] = req.C
+		o.subscriptions[id] = req.Frame
+		if epoch := atomic.LoadUint64(&o.c.epoch); epoch != 0 {
+			req.C <- newEpochFrame(epoch)
+		}
+		if req.receiptC != nil {
+			// the server cannot confirm the subscription until then
+			req.receiptC <- newErrorFrame(ErrConnectionClosed)
+			close(req.receiptC)
+		}
+
+	case frame.UNSUBSCRIBE:
+		id, _ := req.Frame.Header.Contains(frame.Id)
+		o.closeSubscription(id)
+
+	case frame.ACK, frame.NACK:
+		// the messages were received on the failed connection
+		if req.C != nil {
+			req.C <- newErrorFrame(ErrStaleMessage)
+		}
+
+	default:
+		o.pending = append(o.pending, req)
+	}
+}
+
+// drainReads discards the frames on ch, the read channel of a failed
+// connection, until its reader closes it, so that the reader does not
+// block sending them.
+func (c *Conn) drainReads(ch chan *frame.Frame) {
+	for f := range ch {
+		if f != nil {
+			c.discardBody(f)
+		}
+	}
+}
+
+// redial creates a new connection to the server and re-creates the
+// subscriptions on it. If successful, the connection is ready for use.
+func (o *outage) redial() error {
+	c := o.c
+	conn, err := c.reconnectPolicy.Dial()
+	if err != nil {
+		return err
+	}
+
+	reader, err := o.connect(conn)
+	if err != nil {
+		if innerErr := conn.Close(); innerErr != nil {
+			c.log.Warnf("failed to close connection: %v", innerErr)
+		}
+		return err
+	}
+
+	c.connMutex.Lock()
+	c.conn = conn
+	c.connMutex.Unlock()
+
+	c.readCh = make(chan *frame.Frame, cap(c.readCh))
+	c.readErr = new(error)
+	go readLoop(c.readCh, c.readErr, reader, c)
+	return nil
+}
+
+func (o *outage) connect(conn io.ReadWriteCloser) (*frame.Reader, error) {
+	c := o.c
+	reader, writer, response, err := connectHandshake(context.Background(), conn, c.connectOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := negotiatedVersion(response)
+	if err != nil {
+		return nil, err
+	}
+	if version != c.version {
+		return nil, fmt.Errorf("server negotiated version %s, previously %s", version, c.version)
+	}
+
+	o.readTimeout, o.writeTimeout, err = c.negotiateHeartBeat(response, c.connectOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	// From now on, messages are from the new connection. Subscriptions
+	// are told before any of their messages can arrive.
+	epoch := atomic.AddUint64(&c.epoch, 1)
+	for id, f := range o.subscriptions {
+		o.channels[id] <- newEpochFrame(epoch)
+		written := writer.BytesWritten()
+		if err = writer.Write(f); err != nil {
+			return nil, err
+		}
+		c.tracer.sent(f)
+		if c.metrics != nil {
+			c.frameSent(f, int(writer.BytesWritten()-written))
+		}
+	}
+
+	o.writer = writer
+	return reader, nil
+}
@@ -0,0 +1,377 @@
+package stomp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	"github.com/go-stomp/stomp/testutil"
+	. "gopkg.in/check.v1"
+)
+
+// fakeDialer creates connections to a fake server, which completes the
+// connect sequence and then hands the server side to the test.
+type fakeDialer struct {
+	c       *C
+	version Version
+	release chan struct{}          // if non-nil, each dial waits for a value
+	servers chan *fakeReaderWriter // connected servers
+}
+
+func newFakeDialer(c *C, version Version) *fakeDialer {
+	return &fakeDialer{
+		c:       c,
+		version: version,
+		servers: make(chan *fakeReaderWriter, 4),
+	}
+}
+
+func (d *fakeDialer) Dial() (io.ReadWriteCloser, error) {
+	if d.release != nil {
+		<-d.release
+	}
+
+	fc1, fc2 := testutil.NewFakeConn(d.c)
+	rw := &fakeReaderWriter{
+		reader: frame.NewReader(fc2),
+		writer: frame.NewWriter(fc2),
+		conn:   fc2,
+	}
+
+	go func() {
+		f1, err := rw.Read()
+		d.c.Assert(err, IsNil)
+		d.c.Assert(f1.Command, Equals, "CONNECT")
+		rw.Write(frame.New("CONNECTED", "version", d.version.String()))
+		d.servers <- rw
+	}()
+
+	return fc1, nil
+}
+
+func (s *StompSuite) Test_reconnect_resubscribes(c *C) {
+	dialer := newFakeDialer(c, V12)
+	conn, rw := connectHelper(c, V12, ConnOpt.Reconnect(ReconnectPolicy{
+		InitialInterval: time.Millisecond,
+		Dial:            dialer.Dial,
+	}))
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		id := f1.Header.Get(frame.Id)
+		rw.Write(frame.New(frame.MESSAGE,
+			frame.Subscription, id,
+			frame.MessageId, "message-1",
+			frame.Ack, "ack-1",
+			frame.Destination, "/queue/test-1"))
+
+		// the broker goes away
+		rw.Close()
+
+		rw2 := <-dialer.servers
+		f2, err := rw2.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "SUBSCRIBE")
+		c.Check(f2.Header.Get(frame.Id), Equals, id)
+		c.Check(f2.Header.Get(frame.Destination), Equals, "/queue/test-1")
+		c.Check(f2.Header.Get(frame.Ack), Equals, "client-individual")
+		rw2.Write(frame.New(frame.MESSAGE,
+			frame.Subscription, id,
+			frame.MessageId, "message-2",
+			frame.Ack, "ack-2",
+			frame.Destination, "/queue/test-1"))
+
+		f3, err := rw2.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "BEGIN")
+
+		f3, err = rw2.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "ACK")
+		c.Check(f3.Header.Get(frame.Id), Equals, "ack-2")
+
+		f4, err := rw2.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f4.Command, Equals, "DISCONNECT")
+		rw2.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f4.Header.Get(frame.Receipt)))
+		rw2.Close()
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckClientIndividual)
+	c.Assert(err, IsNil)
+
+	msg1 := <-sub.C
+	c.Assert(msg1.Err, IsNil)
+	c.Check(msg1.Header.Get(frame.MessageId), Equals, "message-1")
+
+	msg2 := <-sub.C
+	c.Assert(msg2.Err, IsNil)
+	c.Check(msg2.Header.Get(frame.MessageId), Equals, "message-2")
+	c.Check(sub.Active(), Equals, true)
+
+	// message-1 was received on the old connection
+	err = conn.Ack(msg1)
+	c.Check(err, Equals, ErrStaleMessage)
+	err = conn.Begin().Ack(msg1)
+	c.Check(err, Equals, ErrStaleMessage)
+
+	err = conn.Ack(msg2)
+	c.Check(err, IsNil)
+
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_reconnect_queues_sends(c *C) {
+	dialer := newFakeDialer(c, V12)
+	dialer.release = make(chan struct{})
+	conn, rw := connectHelper(c, V12, ConnOpt.Reconnect(ReconnectPolicy{
+		MaxQueuedSends: 1,
+		Dial:           dialer.Dial,
+	}))
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+
+		rw2 := <-dialer.servers
+		f1, err := rw2.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SEND")
+		c.Check(string(f1.Body), Equals, "queued")
+
+		f2, err := rw2.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "DISCONNECT")
+		rw2.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+		rw2.Close()
+	}()
+
+	rw.Close()
+	waitForReconnecting(c, conn)
+
+	err := conn.Send("/queue/test-1", "text/plain", []byte("queued"))
+	c.Check(err, IsNil)
+	err = conn.Send("/queue/test-1", "text/plain", []byte("rejected"))
+	c.Check(err, Equals, ErrConnectionClosed)
+
+	close(dialer.release)
+
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_reconnect_sends_fail_fast(c *C) {
+	dialer := newFakeDialer(c, V12)
+	dialer.release = make(chan struct{})
+	conn, rw := connectHelper(c, V12, ConnOpt.Reconnect(ReconnectPolicy{
+		Dial: dialer.Dial,
+	}))
+
+	rw.Close()
+	waitForReconnecting(c, conn)
+
+	err := conn.Send("/queue/test-1", "text/plain", []byte("rejected"))
+	c.Check(err, Equals, ErrConnectionClosed)
+
+	close(dialer.release)
+	rw2 := <-dialer.servers
+
+	err = conn.MustDisconnect()
+	c.Check(err, IsNil)
+	rw2.Close()
+}
+
+func (s *StompSuite) Test_reconnect_state(c *C) {
+	dialer := newFakeDialer(c, V12)
+	dialer.release = make(chan struct{})
+	var states stateRecorder
+	conn, rw := connectHelper(c, V12,
+		ConnOpt.OnStateChange(states.record),
+		ConnOpt.Reconnect(ReconnectPolicy{Dial: dialer.Dial}))
+
+	rw.Close()
+	waitForReconnecting(c, conn)
+	c.Check(conn.State(), Equals, Connecting)
+
+	close(dialer.release)
+	rw2 := <-dialer.servers
+	for i := 0; i < 1000 && conn.State() != Connected; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(conn.State(), Equals, Connected)
+
+	err := conn.MustDisconnect()
+	c.Check(err, IsNil)
+	rw2.Close()
+	c.Check(states.get(), DeepEquals, []string{
+		"connecting->connected",
+		"connected->connecting",
+		"connecting->connected",
+		"connected->closed",
+	})
+}
+
+func (s *StompSuite) Test_reconnect_disconnect_on_state_change(c *C) {
+	var conn *Conn
+	done := make(chan struct{})
+	onStateChange := func(old, state ConnState) {
+		if state == Connecting {
+			c.Check(conn.MustDisconnect(), IsNil)
+			close(done)
+		}
+	}
+	conn, rw := connectHelper(c, V12,
+		ConnOpt.OnStateChange(onStateChange),
+		ConnOpt.Reconnect(ReconnectPolicy{
+			Dial: func() (io.ReadWriteCloser, error) {
+				return nil, errors.New("connection refused")
+			},
+		}))
+
+	rw.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("state change function did not disconnect")
+	}
+	c.Check(conn.State(), Equals, Closed)
+}
+
+func (s *StompSuite) Test_reconnect_gives_up(c *C) {
+	attempts := 0
+	conn, rw := connectHelper(c, V12, ConnOpt.Reconnect(ReconnectPolicy{
+		InitialInterval: time.Millisecond,
+		MaxAttempts:     3,
+		Dial: func() (io.ReadWriteCloser, error) {
+			attempts++
+			return nil, errors.New("connection refused")
+		},
+	}))
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		rw.Close()
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+	<-stop
+
+	msg := <-sub.C
+	c.Assert(msg.Err, NotNil)
+	c.Check(msg.Err.Error(), Equals, ErrConnectionClosed.Error())
+	c.Check(attempts, Equals, 3)
+
+	_, ok := <-sub.C
+	c.Check(ok, Equals, false)
+}
+
+func (s *StompSuite) Test_reconnect_disconnect_while_reconnecting(c *C) {
+	conn, rw := connectHelper(c, V12, ConnOpt.Reconnect(ReconnectPolicy{
+		InitialInterval: 10 * time.Millisecond,
+		Dial: func() (io.ReadWriteCloser, error) {
+			return nil, errors.New("connection refused")
+		},
+	}))
+
+	rw.Close()
+	waitForReconnecting(c, conn)
+
+	err := conn.Disconnect()
+	c.Check(err, IsNil)
+}
+
+func (s *StompSuite) Test_reconnect_requires_dial(c *C) {
+	fc1, fc2 := testutil.NewFakeConn(c)
+	defer fc2.Close()
+
+	conn, err := Connect(fc1, ConnOpt.Reconnect(ReconnectPolicy{}))
+	c.Check(conn, IsNil)
+	c.Check(err, NotNil)
+
+	_, err = Connect(fc1, ConnOpt.Reconnect(ReconnectPolicy{Multiplier: 0.5}))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+}
+
+func waitForReconnecting(c *C, conn *Conn) {
+	for i := 0; i < 1000; i++ {
+		if conn.isReconnecting() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Fatal("connection is not reconnecting")
+}
+
+func (s *StompSuite) Test_reconnect_credentials(c *C) {
+	var calls int32
+	credentials := func(ctx context.Context) (string, string, error) {
+		n := atomic.AddInt32(&calls, 1)
+		return "guest", fmt.Sprintf("token-%d", n), nil
+	}
+
+	passcodes := make(chan string, 1)
+	dial := func() (io.ReadWriteCloser, error) {
+		fc1, fc2 := testutil.NewFakeConn(c)
+		go func() {
+			reader := frame.NewReader(fc2)
+			f, err := reader.Read()
+			c.Assert(err, IsNil)
+			c.Check(f.Header.Get(frame.Login), Equals, "guest")
+			passcodes <- f.Header.Get(frame.Passcode)
+			frame.NewWriter(fc2).Write(frame.New(frame.CONNECTED, frame.Version, "1.2"))
+			for {
+				if _, err := reader.Read(); err != nil {
+					return
+				}
+			}
+		}()
+		return fc1, nil
+	}
+
+	conn, rw := connectHelper(c, V12,
+		ConnOpt.CredentialsFunc(credentials),
+		ConnOpt.Reconnect(ReconnectPolicy{InitialInterval: time.Millisecond, Dial: dial}))
+	c.Check(atomic.LoadInt32(&calls), Equals, int32(1))
+
+	// a new passcode is obtained for the new connection
+	rw.Close()
+	c.Check(<-passcodes, Equals, "token-2")
+	for i := 0; i < 1000 && conn.State() != Connected; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(conn.MustDisconnect(), IsNil)
+}
+
+func (s *StompSuite) Test_connect_credentials_error(c *C) {
+	fc1, fc2 := testutil.NewFakeConn(c)
+	defer fc2.Close()
+
+	expired := errors.New("token expired")
+	_, err := Connect(fc1, ConnOpt.CredentialsFunc(func(ctx context.Context) (string, string, error) {
+		return "", "", expired
+	}))
+	c.Check(errors.Is(err, expired), Equals, true)
+	c.Check(err, ErrorMatches, "failed to get credentials: token expired")
+
+	_, err = Connect(fc1, ConnOpt.CredentialsFunc(nil))
+	c.Check(err, Equals, ErrNilOption)
+}
@@ -0,0 +1,150 @@
+package stomp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// Default prefix of the destination that Conn.Request receives replies on.
+const DefaultReplyDestinationPrefix = "/temp-queue/"
+
+// Request sends a message to the destination and waits for the reply. The
+// SEND frame has a reply-to header entry naming the destination that the
+// replier should send its reply to, and a correlation-id header entry that
+// the replier should copy to the reply. Options for the SEND frame, such as
+// SendOpt.Header, can be specified in opts.
+//
+// All requests on a connection share a single subscription to the reply
+// destination, which is created by the first request. The destination is the
+// prefix specified with ConnOpt.ReplyDestinationPrefix, followed by a name that
+// is unique to the connection. Replies are matched with requests using the
+// correlation-id header entry, and replies that do not match a waiting request
+// are discarded.
+//
+// Request waits until the reply arrives or the context is done, in which case
+// the returned error is an Error that wraps ctx.Err().
+func (c *Conn) Request(ctx context.Context, destination string, body []byte, opts ...func(*frame.Frame) error) (*Message, error) {
+	correlationId := allocateId()
+	replyTo, ch, err := c.replies.subscribe(c, correlationId)
+	if err != nil {
+		return nil, err
+	}
+	defer c.replies.forget(correlationId)
+
+	// the reply header entries are set after the options,
+	// so that they cannot be replaced
+	sendOpts := make([]func(*frame.Frame) error, 0, len(opts)+1)
+	sendOpts = append(sendOpts, opts...)
+	sendOpts = append(sendOpts, func(f *frame.Frame) error {
+		f.Header.Set(frame.ReplyTo, replyTo)
+		f.Header.Set(frame.CorrelationId, correlationId)
+		return nil
+	})
+	err = c.SendWithContext(ctx, destination, "", body, sendOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg := <-ch:
+		if msg.Err != nil {
+			return nil, msg.Err
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return nil, newContextError(ctx.Err())
+	}
+}
+
+// replier delivers the replies received by a Conn to the goroutines
+// waiting for them in Conn.Request.
+type replier struct {
+	mutex       sync.Mutex
+	prefix      string
+	destination string
+	sub         *Subscription            // nil until the first request
+	waiters     map[string]chan *Message // keyed by correlation id
+}
+
+// subscribe returns the reply destination, subscribing to it if necessary,
+// and the channel that the reply with correlationId is delivered on. The
+// channel is registered with the mutex held, as fail clears the waiters,
+// so that a request cannot wait on a subscription that has already failed.
+func (r *replier) subscribe(c *Conn, correlationId string) (string, chan *Message, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.sub == nil {
+		name := make([]byte, 8)
+		if _, err := rand.Read(name); err != nil {
+			return "", nil, err
+		}
+		destination := r.prefix + "reply-" + hex.EncodeToString(name)
+
+		sub, err := c.Subscribe(destination, AckAuto)
+		if err != nil {
+			return "", nil, err
+		}
+		r.sub = sub
+		r.destination = destination
+		if r.waiters == nil {
+			r.waiters = make(map[string]chan *Message)
+		}
+		go r.dispatch(c, sub)
+	}
+
+	// buffered, so that dispatch never blocks
+	ch := make(chan *Message, 1)
+	r.waiters[correlationId] = ch
+	return r.destination, ch, nil
+}
+
+// forget is called once the request with correlationId has stopped
+// waiting for its reply.
+func (r *replier) forget(correlationId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.waiters, correlationId)
+}
+
+// dispatch delivers the messages received on the reply subscription
+// until it closes.
+func (r *replier) dispatch(c *Conn, sub *Subscription) {
+	for msg := range sub.C {
+		if msg.Err != nil {
+			r.fail(sub, msg.Err)
+			continue
+		}
+
+		correlationId := msg.Header.Get(frame.CorrelationId)
+		r.mutex.Lock()
+		ch, ok := r.waiters[correlationId]
+		delete(r.waiters, correlationId)
+		r.mutex.Unlock()
+
+		if ok {
+			ch <- msg
+		} else {
+			c.log.Debugf("discarded reply with correlation-id %q", correlationId)
+		}
+	}
+	r.fail(sub, ErrCompletedSubscription)
+}
+
+// fail reports err to every waiting request once the reply subscription
+// has failed. The next request creates a new subscription.
+func (r *replier) fail(sub *Subscription, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.sub != sub {
+		return
+	}
+	r.sub = nil
+	for correlationId, ch := range r.waiters {
+		ch <- &Message{Err: err, Conn: sub.conn}
+		delete(r.waiters, correlationId)
+	}
+}
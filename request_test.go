@@ -0,0 +1,113 @@
+package stomp
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_request(c *C) {
+	conn, rw := connectHelper(c, V12, ConnOpt.ReplyDestinationPrefix("/queue/replies."))
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		replyTo := f1.Header.Get(frame.Destination)
+		c.Check(strings.HasPrefix(replyTo, "/queue/replies."), Equals, true)
+		id := f1.Header.Get(frame.Id)
+
+		for i := 0; i < 2; i++ {
+			f2, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f2.Command, Equals, "SEND")
+			c.Check(f2.Header.Get(frame.Destination), Equals, "/queue/service")
+			c.Check(f2.Header.Get(frame.ReplyTo), Equals, replyTo)
+			c.Check(f2.Header.Get("x-custom"), Equals, "yes")
+			correlationId := f2.Header.Get(frame.CorrelationId)
+			c.Check(correlationId, Not(Equals), "")
+
+			// a reply that nobody is waiting for is discarded
+			rw.Write(frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.Destination, replyTo,
+				frame.MessageId, "unknown",
+				frame.CorrelationId, "unknown"))
+
+			reply := frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.Destination, replyTo,
+				frame.MessageId, correlationId,
+				frame.CorrelationId, correlationId)
+			reply.Body = append([]byte("reply to "), f2.Body...)
+			rw.Write(reply)
+		}
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	for _, body := range []string{"first", "second"} {
+		msg, err := conn.Request(context.Background(), "/queue/service", []byte(body),
+			SendOpt.Header("x-custom", "yes"))
+		c.Assert(err, IsNil)
+		c.Check(string(msg.Body), Equals, "reply to "+body)
+	}
+
+	err := conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_request_timeout(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		c.Check(strings.HasPrefix(f1.Header.Get(frame.Destination), DefaultReplyDestinationPrefix), Equals, true)
+
+		// the request is never answered
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "SEND")
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	msg, err := conn.Request(ctx, "/queue/service", []byte("hello"))
+	c.Check(msg, IsNil)
+	c.Check(errors.Is(err, context.DeadlineExceeded), Equals, true)
+
+	conn.replies.mutex.Lock()
+	c.Check(conn.replies.waiters, HasLen, 0)
+	conn.replies.mutex.Unlock()
+
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+}
@@ -0,0 +1,116 @@
+package stomp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// A RetryPolicy specifies how a subscription created with the
+// SubscribeOpt.RetryOnError option is re-established after the server
+// reports an error for the subscription alone, in an ERROR frame with
+// a "subscription" header that is equal to the subscription id.
+//
+// After each such error, the subscription waits, and then sends the
+// original SUBSCRIBE frame again, with the same id, header entries and
+// ack mode. Messages continue to be delivered on the same Subscription.C
+// channel. Retrying stops if the subscription is unsubscribed or the
+// connection closes.
+type RetryPolicy struct {
+	// InitialInterval is the time to wait after the first error.
+	// Defaults to DefaultReconnectInitialInterval.
+	InitialInterval time.Duration
+
+	// MaxInterval is the longest time to wait after an error.
+	// Defaults to DefaultReconnectMaxInterval.
+	MaxInterval time.Duration
+
+	// Multiplier is the factor by which the wait increases after each
+	// consecutive error. Defaults to DefaultReconnectMultiplier.
+	Multiplier float64
+
+	// MaxAttempts is the number of consecutive errors after which the
+	// subscription stops retrying, and the error is handled as if the
+	// policy had not been specified. Errors are consecutive unless a
+	// message is received between them. Zero means keep retrying.
+	MaxAttempts int
+}
+
+// backoff returns the reconnect policy with the same intervals,
+// with default values filled in.
+func (p RetryPolicy) backoff() *ReconnectPolicy {
+	return ReconnectPolicy{
+		InitialInterval: p.InitialInterval,
+		MaxInterval:     p.MaxInterval,
+		Multiplier:      p.Multiplier,
+		MaxAttempts:     p.MaxAttempts,
+	}.withDefaults()
+}
+
+// Retries returns the number of times that the SUBSCRIBE frame has been
+// sent again after an error, for a subscription created with the
+// SubscribeOpt.RetryOnError option.
+func (s *Subscription) Retries() uint64 {
+	return atomic.LoadUint64(&s.retries)
+}
+
+// retryAfter arranges for the SUBSCRIBE frame to be sent again after an
+// ERROR frame for this subscription alone. Returns false if the error
+// is to be handled as usual. Only called by readLoop.
+func (s *Subscription) retryAfter(f *frame.Frame, ch chan *frame.Frame) bool {
+	policy := s.retry
+	if policy == nil || !s.isOwnError(f) || atomic.LoadInt32(&s.state) != subStateActive {
+		return false
+	}
+	if policy.MaxAttempts > 0 && s.retryAttempts >= policy.MaxAttempts {
+		return false
+	}
+	if s.retryAttempts == 0 {
+		s.retryInterval = policy.InitialInterval
+	} else {
+		s.retryInterval = policy.next(s.retryInterval)
+	}
+	s.retryAttempts++
+
+	message, _ := f.Header.Contains(frame.Message)
+	s.conn.log.Warnf("Subscription %s: %s: ERROR message:%s, subscribing again in %v",
+		s.id,
+		s.destination,
+		message,
+		s.retryInterval)
+	go s.resubscribe(s.retryInterval, atomic.LoadUint64(&s.conn.epoch), ch)
+	return true
+}
+
+// resubscribe sends the SUBSCRIBE frame again once wait has elapsed,
+// unless the subscription or the connection has closed in the meantime.
+func (s *Subscription) resubscribe(wait time.Duration, epoch uint64, ch chan *frame.Frame) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.unsubscribing:
+		return
+	case <-s.closeChan:
+		return
+	case <-s.conn.closeCh:
+		return
+	}
+
+	c := s.conn
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	if c.IsClosed() || atomic.LoadInt32(&s.state) != subStateActive {
+		return
+	}
+	if atomic.LoadUint64(&c.epoch) != epoch {
+		// the subscription was sent again when reconnecting
+		return
+	}
+	atomic.AddUint64(&s.retries, 1)
+	c.writeCh <- writeRequest{
+		Frame: s.subscribeFrame.Clone(),
+		C:     ch,
+	}
+}
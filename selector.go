@@ -0,0 +1,44 @@
+package stomp
+
+import (
+	"strings"
+)
+
+// validateSelector performs basic checks on a selector expression: it must
+// not be blank, string literals must be terminated, and parentheses outside
+// string literals must be balanced. In the SQL-92 syntax used by selectors,
+// string literals are enclosed in single quotes, and a quote within a string
+// literal is written as two quotes.
+func validateSelector(expr string) error {
+	if strings.TrimSpace(expr) == "" {
+		return ErrInvalidSelector
+	}
+	depth := 0
+	inString := false
+	for i := 0; i < len(expr); i++ {
+		ch := expr[i]
+		switch {
+		case inString:
+			if ch == '\'' {
+				if i+1 < len(expr) && expr[i+1] == '\'' {
+					i++ // an escaped quote
+				} else {
+					inString = false
+				}
+			}
+		case ch == '\'':
+			inString = true
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+			if depth < 0 {
+				return ErrInvalidSelector
+			}
+		}
+	}
+	if inString || depth != 0 {
+		return ErrInvalidSelector
+	}
+	return nil
+}
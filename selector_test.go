@@ -0,0 +1,60 @@
+package stomp
+
+import (
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_validate_selector(c *C) {
+	for _, expr := range []string{
+		"color = 'red'",
+		"color = 'red' AND (size > 2 OR weight < 5)",
+		"name = 'O''Brien'",
+		"label = '(unbalanced'",
+		"((a = 1))",
+	} {
+		c.Check(validateSelector(expr), IsNil, Commentf("%s", expr))
+	}
+
+	for _, expr := range []string{
+		"",
+		"   ",
+		"color = 'red",
+		"name = 'O'Brien'",
+		"(a = 1",
+		"a = 1)",
+		")a = 1(",
+	} {
+		c.Check(validateSelector(expr), Equals, ErrInvalidSelector, Commentf("%s", expr))
+	}
+}
+
+func (s *StompSuite) Test_subscribe_selector(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		c.Check(f1.Header.Get(frame.Selector), Equals, "color = 'red'")
+		rw.Write(frame.New(frame.MESSAGE,
+			frame.Subscription, f1.Header.Get(frame.Id),
+			frame.MessageId, "1",
+			frame.Destination, "/queue/test-1",
+			"color", "red"))
+	}()
+
+	_, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.Selector("color = 'red"))
+	c.Check(err, Equals, ErrInvalidSelector)
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.Selector("color = 'red'"))
+	c.Assert(err, IsNil)
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	color, _ := msg.Property("color")
+	c.Check(color, Equals, "red")
+	<-stop
+	rw.Close()
+}
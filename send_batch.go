@@ -0,0 +1,134 @@
+package stomp
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// A SendRequest is a message sent as part of a batch by Conn.SendBatch.
+type SendRequest struct {
+	Destination string
+	ContentType string
+	Body        []byte
+
+	// Options for this message only, as for Conn.Send.
+	Opts []func(*frame.Frame) error
+}
+
+// A BatchError is returned by Conn.SendBatch when a message
+// in the batch could not be sent.
+type BatchError struct {
+	Index int   // index of the first message that failed
+	Err   error // reason the message failed
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch message %d: %v", e.Index, e.Err)
+}
+
+// Unwrap returns the reason the message failed.
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// SendBatch sends several messages to the STOMP server. All of the SEND
+// frames are handed to the writer at once and written with a single flush
+// of the network connection, which is much faster than calling Send for
+// each message when sending many small messages.
+//
+// The options in opts apply to every message in the batch, before the
+// options of the message itself. A receipt requested in opts, using
+// SendOpt.Receipt or SendOpt.ReceiptTimeout, is only requested for the last
+// message, which acknowledges the whole batch. To wait for a receipt for
+// a particular message, specify the option in the message's Opts instead.
+// SendBatch waits for every receipt that has been requested.
+//
+// If an error is returned it is a *BatchError. If a frame cannot be created
+// for one of the messages, nothing is sent and the error identifies that
+// message. If the batch cannot be queued for writing, nothing is sent and
+// the index is zero. If a receipt is not received, the error identifies the
+// message for which it was requested; the messages before it were received
+// by the server.
+func (c *Conn) SendBatch(msgs []SendRequest, opts ...func(*frame.Frame) error) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	batch, timeouts, err := c.enqueueBatch(msgs, opts)
+	if err != nil {
+		return err
+	}
+
+	for i, request := range batch {
+		if request.C == nil {
+			continue
+		}
+		if err := c.waitForReceipt(context.Background(), request, timeouts[i]); err != nil {
+			return &BatchError{Index: i, Err: err}
+		}
+	}
+	return nil
+}
+
+// enqueueBatch creates the SEND frames for a batch and places them on
+// the write channel as one request. Returns the requests for the frames,
+// and the receipt timeout for each.
+func (c *Conn) enqueueBatch(msgs []SendRequest, opts []func(*frame.Frame) error) ([]writeRequest, []time.Duration, error) {
+	if err := c.checkConnected(); err != nil {
+		return nil, nil, &BatchError{Index: 0, Err: err}
+	}
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	if c.IsClosed() {
+		return nil, nil, &BatchError{Index: 0, Err: ErrConnectionClosed}
+	}
+
+	// removes a receipt requested for the whole batch
+	// from all but the last message
+	noReceipt := func(f *frame.Frame) error {
+		f.Header.Del(frame.Receipt)
+		return nil
+	}
+
+	batch := make([]writeRequest, len(msgs))
+	timeouts := make([]time.Duration, len(msgs))
+	for i, msg := range msgs {
+		frameOpts := make([]func(*frame.Frame) error, 0, len(opts)+len(msg.Opts)+1)
+		frameOpts = append(frameOpts, opts...)
+		if i < len(msgs)-1 {
+			frameOpts = append(frameOpts, noReceipt)
+		}
+		frameOpts = append(frameOpts, msg.Opts...)
+
+		f, options, err := c.createSendFrame(msg.Destination, msg.ContentType, msg.Body, frameOpts)
+		if err == nil {
+			err = c.prepareSend(f)
+		}
+		if err != nil {
+			return nil, nil, &BatchError{Index: i, Err: err}
+		}
+
+		batch[i].Frame = f
+		if _, ok := f.Header.Contains(frame.Receipt); ok {
+			batch[i].C = make(chan *frame.Frame, 1)
+			timeouts[i] = options.receiptTimeout
+		}
+	}
+
+	if c.isReconnecting() {
+		// only a limited number of frames are queued while reconnecting
+		if atomic.AddInt32(&c.queuedSends, int32(len(batch))) > int32(c.reconnectPolicy.MaxQueuedSends) {
+			return nil, nil, &BatchError{Index: 0, Err: ErrConnectionClosed}
+		}
+	}
+
+	err := sendDataToWriteChWithTimeout(context.Background(), c.writeCh, writeRequest{batch: batch}, c.msgSendTimeout)
+	if err != nil {
+		return nil, nil, &BatchError{Index: 0, Err: err}
+	}
+	return batch, timeouts, nil
+}
@@ -1,9 +1,20 @@
 package stomp
 
 import (
+	"context"
+	"strconv"
+	"time"
+
 	"github.com/go-stomp/stomp/frame"
 )
 
+// sendOptions are the settings for a single call to
+// Conn.Send or Transaction.Send.
+type sendOptions struct {
+	receiptTimeout time.Duration
+	flavor         BrokerFlavor // the flavor of the server, as for Conn.Flavor
+}
+
 // SendOpt contains options for for the Conn.Send and Transaction.Send functions.
 var SendOpt struct {
 	// Receipt specifies that the client should request acknowledgement
@@ -15,14 +26,64 @@ var SendOpt struct {
 	// entry is always included, but some message brokers assign special
 	// meaning to STOMP frames that do not contain a content-length
 	// header entry. (In particular ActiveMQ interprets STOMP frames
-	// with no content-length as being a text message)
+	// with no content-length as being a text message). Without a
+	// content-length the frame ends at the first NUL byte, so
+	// ErrNulInBody is returned if the body contains one.
 	NoContentLength func(*frame.Frame) error
 
+	// ForceContentLength specifies that the SEND frame includes a
+	// content-length header entry for the body, even if it is empty. It
+	// overrides NoContentLength if that is specified earlier in the options.
+	ForceContentLength func(*frame.Frame) error
+
 	// Header provides the opportunity to include custom header entries
 	// in the SEND frame that the client sends to the server. This option
 	// can be specified multiple times if multiple custom header entries
 	// are required.
 	Header func(key, value string) func(*frame.Frame) error
+
+	// ReceiptTimeout requests a receipt, in the same way as Receipt, and
+	// limits how long the send operation waits for it. For this send the
+	// timeout replaces the one specified by ConnOpt.MsgSendTimeout. If the
+	// RECEIPT frame has not arrived when the timeout expires, the send
+	// returns ErrMsgSendTimeout and a late RECEIPT frame is ignored.
+	ReceiptTimeout func(timeout time.Duration) func(*frame.Frame) error
+
+	// Persistent specifies that the server should store the message so that
+	// it is not lost if the server restarts, by setting the "persistent"
+	// header entry to "true".
+	Persistent func(*frame.Frame) error
+
+	// Priority sets the "priority" header entry of the SEND frame. The
+	// priority is from 0, the lowest, to 9, the highest. Servers that support
+	// priorities use 4 if it is not specified.
+	Priority func(n int) func(*frame.Frame) error
+
+	// TTL specifies that the server should discard the message if it has not
+	// been delivered when ttl has elapsed. The header entry depends on the
+	// flavor of the server, which is detected from the "server" header entry of
+	// the CONNECTED frame: ActiveMQ and Artemis use "expires", the time of
+	// expiry in milliseconds since the Unix epoch, and RabbitMQ uses
+	// "expiration", the ttl in milliseconds. If the flavor is not recognised,
+	// both are set. The ttl must be at least a millisecond.
+	TTL func(ttl time.Duration) func(*frame.Frame) error
+
+	// Inject propagates the trace that ctx carries in the header entries
+	// of the SEND frame, using the propagator set with SetTracePropagator.
+	// By default these are the "traceparent" and "tracestate" header
+	// entries of W3C Trace Context, for the TraceContext added to ctx with
+	// ContextWithTrace. If ctx carries no trace, no header entries are set.
+	// The receiver can continue the trace with Message.Extract.
+	Inject func(ctx context.Context) func(*frame.Frame) error
+
+	// Compress compresses the body of the message with the codec, and sets
+	// the "content-encoding" header entry to the codec's encoding, such as
+	// "gzip". The content type is unchanged, and the content-length header
+	// entry is that of the compressed body, even if NoContentLength is
+	// specified earlier in the options. The receiver can decompress the
+	// body with ConnOpt.AutoDecompress. Compress cannot be used with
+	// Conn.SendStream, whose body is not known in advance.
+	Compress func(codec Codec) func(*frame.Frame) error
 }
 
 func init() {
@@ -30,7 +91,7 @@ func init() {
 		if f.Command != frame.SEND {
 			return ErrInvalidCommand
 		}
-		id := allocateId()
+		id := allocateReceiptId()
 		f.Header.Set(frame.Receipt, id)
 		return nil
 	}
@@ -43,6 +104,14 @@ func init() {
 		return nil
 	}
 
+	SendOpt.ForceContentLength = func(f *frame.Frame) error {
+		if f.Command != frame.SEND {
+			return ErrInvalidCommand
+		}
+		f.Header.Set(frame.ContentLength, strconv.Itoa(len(f.Body)))
+		return nil
+	}
+
 	SendOpt.Header = func(key, value string) func(*frame.Frame) error {
 		return func(f *frame.Frame) error {
 			if f.Command != frame.SEND {
@@ -52,4 +121,81 @@ func init() {
 			return nil
 		}
 	}
+
+	SendOpt.ReceiptTimeout = func(timeout time.Duration) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			opts, ok := settingsFor(f).(*sendOptions)
+			if f.Command != frame.SEND || !ok {
+				return ErrInvalidCommand
+			}
+			if timeout <= 0 {
+				return ErrInvalidOptionValue
+			}
+			opts.receiptTimeout = timeout
+			if _, ok := f.Header.Contains(frame.Receipt); !ok {
+				f.Header.Set(frame.Receipt, allocateReceiptId())
+			}
+			return nil
+		}
+	}
+	SendOpt.Persistent = func(f *frame.Frame) error {
+		if f.Command != frame.SEND {
+			return ErrInvalidCommand
+		}
+		f.Header.Set(frame.Persistent, "true")
+		return nil
+	}
+
+	SendOpt.Priority = func(n int) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			if f.Command != frame.SEND {
+				return ErrInvalidCommand
+			}
+			if n < 0 || n > 9 {
+				return ErrInvalidOptionValue
+			}
+			f.Header.Set(frame.Priority, strconv.Itoa(n))
+			return nil
+		}
+	}
+
+	SendOpt.TTL = func(ttl time.Duration) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			opts, ok := settingsFor(f).(*sendOptions)
+			if f.Command != frame.SEND || !ok {
+				return ErrInvalidCommand
+			}
+			if ttl < time.Millisecond {
+				return ErrInvalidOptionValue
+			}
+			opts.flavor.setTTLHeader(f, ttl, time.Now())
+			return nil
+		}
+	}
+
+	SendOpt.Inject = func(ctx context.Context) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			getTracePropagator().Inject(ctx, HeaderCarrier{f.Header})
+			return nil
+		}
+	}
+	SendOpt.Compress = func(codec Codec) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			if f.Command != frame.SEND {
+				return ErrInvalidCommand
+			}
+			if codec == nil {
+				return ErrNilOption
+			}
+			body, err := codec.Compress(f.Body)
+			if err != nil {
+				return err
+			}
+			f.Body = body
+			f.Header.Set(contentEncodingHeader, codec.Encoding())
+			// the compressed body may contain NUL, so it must have a content-length
+			f.Header.Set(frame.ContentLength, strconv.Itoa(len(body)))
+			return nil
+		}
+	}
 }
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"strings"
+)
+
+// Interface for authorizing STOMP clients to send messages and to
+// subscribe to destinations. A client that is not permitted is sent an
+// ERROR frame, which includes the receipt-id of the frame denied and, for
+// a SUBSCRIBE frame, the id of the subscription, and is disconnected.
+// Other clients are not affected.
+type Authorizer interface {
+	// CanSend returns true if the client identified by the principal can
+	// send messages to the destination. The principal is nil if no
+	// authentication is performed.
+	CanSend(principal Principal, destination string) bool
+
+	// CanSubscribe returns true if the client identified by the principal
+	// can subscribe to the destination.
+	CanSubscribe(principal Principal, destination string) bool
+}
+
+// An AuthorizationRule permits the clients identified by a principal name
+// to send messages and to subscribe to the destinations that match
+// patterns, as MatchDestination matches them.
+type AuthorizationRule struct {
+	Principal string   // Name of the principal, or "*" for every client, authenticated or not
+	Send      []string // Patterns of the destinations the clients can send to
+	Subscribe []string // Patterns of the destinations the clients can subscribe to
+}
+
+// A RuleAuthorizer is an Authorizer that permits an operation if one of
+// its rules permits it, and denies it otherwise.
+type RuleAuthorizer []AuthorizationRule
+
+// CanSend implements Authorizer.
+func (a RuleAuthorizer) CanSend(principal Principal, destination string) bool {
+	return a.permits(principal, destination, func(r *AuthorizationRule) []string { return r.Send })
+}
+
+// CanSubscribe implements Authorizer.
+func (a RuleAuthorizer) CanSubscribe(principal Principal, destination string) bool {
+	return a.permits(principal, destination, func(r *AuthorizationRule) []string { return r.Subscribe })
+}
+
+func (a RuleAuthorizer) permits(principal Principal, destination string, patterns func(*AuthorizationRule) []string) bool {
+	for i := range a {
+		rule := &a[i]
+		if rule.Principal != "*" && (principal == nil || principal.Name() != rule.Principal) {
+			continue
+		}
+		for _, pattern := range patterns(rule) {
+			if MatchDestination(pattern, destination) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchDestination reports whether the destination matches the pattern.
+// Both are split into tokens at each "/" and ".", ignoring empty tokens,
+// so that the pattern "queue.orders.>" matches the destination
+// "/queue/orders.created". A "*" token in the pattern matches any one
+// token, and a ">" token at the end of the pattern matches one or more
+// tokens. Other tokens must be equal.
+func MatchDestination(pattern, destination string) bool {
+	p := destinationTokens(pattern)
+	d := destinationTokens(destination)
+	for i, token := range p {
+		if token == ">" && i == len(p)-1 {
+			return len(d) > i
+		}
+		if i >= len(d) || (token != "*" && token != d[i]) {
+			return false
+		}
+	}
+	return len(p) == len(d)
+}
+
+func destinationTokens(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == '/' || r == '.'
+	})
+}
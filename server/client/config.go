@@ -1,20 +1,70 @@
 package client
 
 import (
+	"crypto/tls"
 	"time"
+
+	"github.com/go-stomp/stomp/frame"
 )
 
+// Identifies a client that has been authenticated. The principal
+// is attached to the connection of the client.
+type Principal interface {
+	// Name of the principal, such as a login.
+	Name() string
+}
+
 // Contains information the client package needs from the
 // rest of the STOMP server code.
 type Config interface {
-	// Method to authenticate a login and associated passcode.
-	// Returns true if login/passcode is valid, false otherwise.
-	Authenticate(login, passcode string) bool
+	// Method to authenticate a client from its CONNECT or STOMP frame,
+	// and the state of its TLS connection, which is nil if the client
+	// has not connected with TLS. Returns the principal of the client,
+	// which is nil if no authentication is performed, or an error if
+	// the client is not permitted to connect.
+	Authenticate(f *frame.Frame, state *tls.ConnectionState) (Principal, error)
+
+	// Methods to authorize a client to send messages to a destination,
+	// and to subscribe to a destination. The principal is the one
+	// returned by Authenticate. Returns true if permitted.
+	CanSend(principal Principal, destination string) bool
+	CanSubscribe(principal Principal, destination string) bool
 
 	// Default duration for read/write heart-beat values. If this
 	// returns zero, no heart-beat will take place. If this value is
 	// larger than the maximu permitted value (which is more than
 	// 11 days, but less than 12 days), then it is truncated to the
-	// maximum permitted values.
+	// maximum permitted values. Clients that request shorter
+	// heart-beat intervals are given this duration instead.
 	HeartBeat() time.Duration
+
+	// Maximum duration for read/write heart-beat values, or zero if
+	// there is no maximum. Clients that cannot send heart-beats as
+	// often as this are refused, and heart-beats are sent to clients
+	// at least this often.
+	HeartBeatMax() time.Duration
+
+	// Multiplier of the read heart-beat value negotiated, giving the
+	// time after which a client that has sent nothing is disconnected.
+	HeartBeatGracePeriodMultiplier() float64
+
+	// Limits of the frames received from a client: the size of the
+	// body, and the number of header entries and the size of the command
+	// and header lines. Zero means no limit. A client that sends a
+	// frame exceeding a limit is sent an ERROR frame and disconnected.
+	MaxFrameSize() int
+	MaxHeaders() (count, bytes int)
+
+	// Maximum number of subscriptions of a client, or zero if there is
+	// no maximum. A client that subscribes once more is sent an ERROR
+	// frame and disconnected.
+	MaxSubscriptions() int
+
+	// Rates at which a client may send SEND frames, and the bytes of
+	// their bodies, per second, which are zero if there is no limit.
+	// They are read for each SEND frame, so they can change while the
+	// client is connected. The frames of a client that exceeds a rate
+	// are read more slowly, unless reject is true, when the client is
+	// sent an ERROR frame and disconnected.
+	SendRateLimit() (framesPerSecond, bytesPerSecond float64, reject bool)
 }
@@ -1,11 +1,14 @@
 package client
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-stomp/stomp"
@@ -18,6 +21,11 @@ import (
 // pending frames indefinitely.
 const maxPendingWrites = 16
 
+// Maximum number of pending topic frames allowed to a client before
+// it is disconnected. A topic delivers its messages to the clients
+// without waiting for a client that cannot keep up with them.
+const maxPendingTopicWrites = 1024
+
 // Maximum number of pending frames allowed before the read
 // go routine starts blocking.
 const maxPendingReads = 16
@@ -31,8 +39,11 @@ type Conn struct {
 	subChannel     chan *Subscription                  // Receives subscription messages for client
 	writeChannel   chan *frame.Frame                   // Receives unacknowledged (topic) messages for client
 	readChannel    chan *frame.Frame                   // Receives frames from the client
+	readError      error                               // Sent to the client once the read channel has closed, if not nil
+	limiter        rateLimiter                         // Limits the rate of SEND frames, used by the readLoop go-routine
 	stateFunc      func(c *Conn, f *frame.Frame) error // State processing function
 	writeTimeout   time.Duration                       // Heart beat write timeout
+	lastWrite      time.Time                           // Time of the last frame or heart-beat written
 	version        stomp.Version                       // Negotiated STOMP protocol version
 	closed         bool                                // Is the connection closed
 	txStore        *txStore                            // Stores transactions in progress
@@ -40,6 +51,10 @@ type Conn struct {
 	subList        *SubscriptionList                   // List of subscriptions requiring acknowledgement
 	subs           map[string]*Subscription            // All subscriptions, keyed by id
 	validator      stomp.Validator                     // For validating STOMP frames
+	principal      Principal                           // Authenticated client, nil if no authentication
+	clientId       string                              // The client-id header entry of the CONNECT frame, if any
+	done           chan struct{}                       // Closed once the connection has been cleaned up
+	slow           sync.Once                           // Closes the connection of a slow client
 }
 
 // Creates a new client connection. The config parameter contains
@@ -53,17 +68,24 @@ func NewConn(config Config, rw net.Conn, ch chan Request) *Conn {
 		rw:             rw,
 		requestChannel: ch,
 		subChannel:     make(chan *Subscription, maxPendingWrites),
-		writeChannel:   make(chan *frame.Frame, maxPendingWrites),
+		writeChannel:   make(chan *frame.Frame, maxPendingTopicWrites),
 		readChannel:    make(chan *frame.Frame, maxPendingReads),
 		txStore:        &txStore{},
 		subList:        NewSubscriptionList(),
 		subs:           make(map[string]*Subscription),
+		done:           make(chan struct{}),
 	}
 	go c.readLoop()
 	go c.processLoop()
 	return c
 }
 
+// Returns the principal of the client, as authenticated when it
+// connected, or nil if no authentication was performed.
+func (c *Conn) Principal() Principal {
+	return c.principal
+}
+
 // Write a frame to the connection without requiring
 // any acknowledgement.
 func (c *Conn) Send(f *frame.Frame) {
@@ -72,6 +94,24 @@ func (c *Conn) Send(f *frame.Frame) {
 	c.writeChannel <- f
 }
 
+// Write a frame to the connection, as Send does, unless the
+// connection is cleaned up first, as it is once the client has
+// disconnected. Returns false if the frame was not written.
+func (c *Conn) SendUnlessDone(f *frame.Frame) bool {
+	// the write channel is buffered, so it may have room once done
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.writeChannel <- f:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
 // Send and ERROR message to the client. The client
 // connection will disconnect as soon as the ERROR
 // message has been transmitted. The message header
@@ -81,10 +121,56 @@ func (c *Conn) SendError(err error) {
 	c.Send(f) // will close after successful send
 }
 
+// Send an ERROR message to the client, as SendError does, without
+// blocking: if the client is not reading the frames written to it,
+// the connection is closed instead.
+func (c *Conn) Reject(err error) {
+	select {
+	case c.writeChannel <- frame.New(frame.ERROR, frame.Message, err.Error()):
+	default:
+		c.closeSlow()
+	}
+}
+
+// Send an ERROR message to the client, as SendError does, when the
+// server is shutting down. Returns at once if the connection has
+// already closed, instead of waiting for it to write the frame.
+func (c *Conn) Shutdown(err error) {
+	select {
+	case c.writeChannel <- frame.New(frame.ERROR, frame.Message, err.Error()):
+	case <-c.done:
+	}
+}
+
+// Close the network connection at once. The connection is then
+// cleaned up as if the client had disconnected, and the messages
+// that it has not acknowledged are requeued.
+func (c *Conn) Close() error {
+	return c.rw.Close()
+}
+
+// Close the connection of a client that does not read the topic
+// frames sent to it as fast as they are sent, so that the other
+// subscribers of the topic are not held up.
+func (c *Conn) closeSlow() {
+	c.slow.Do(func() {
+		log.Println("slow client disconnected:", c.rw.RemoteAddr())
+		c.rw.Close()
+	})
+}
+
+// Returns a channel that is closed once the connection has been
+// cleaned up, after the last request for it has been sent to the
+// upper layer.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
 // Send an ERROR frame to the client and immediately. The error
 // message is derived from err. If f is non-nil, it is the frame
 // whose contents have caused the error. Include the receipt-id
-// header if the frame contains a receipt header.
+// header if the frame contains a receipt header, and the subscription
+// header if the frame is a SUBSCRIBE frame.
 func (c *Conn) sendErrorImmediately(err error, f *frame.Frame) {
 	errorFrame := frame.New(frame.ERROR,
 		frame.Message, err.Error())
@@ -95,6 +181,9 @@ func (c *Conn) sendErrorImmediately(err error, f *frame.Frame) {
 		if receipt, ok := f.Header.Contains(frame.Receipt); ok {
 			errorFrame.Header.Add(frame.ReceiptId, receipt)
 		}
+		if id, ok := f.Header.Contains(frame.Id); ok && f.Command == frame.SUBSCRIBE {
+			errorFrame.Header.Add(frame.Subscription, id)
+		}
 	}
 
 	// send the frame to the client, ignore any error condition
@@ -104,7 +193,9 @@ func (c *Conn) sendErrorImmediately(err error, f *frame.Frame) {
 
 // Sends a STOMP frame to the client immediately, does not push onto the
 // write channel to be processed in turn.
+// A nil frame is a heart-beat.
 func (c *Conn) sendImmediately(f *frame.Frame) error {
+	c.lastWrite = time.Now()
 	return c.writer.Write(f)
 }
 
@@ -114,7 +205,9 @@ func (c *Conn) sendImmediately(f *frame.Frame) error {
 // processLoop go-routine. This keeps all processing of frames for
 // this connection on the one go-routine and avoids race conditions.
 func (c *Conn) readLoop() {
-	reader := frame.NewReader(c.rw)
+	reader := frame.NewReader(c.rw,
+		frame.MaxFrameSize(c.config.MaxFrameSize()),
+		frame.MaxHeaders(c.config.MaxHeaders()))
 	expectingConnect := true
 	readTimeout := time.Duration(0)
 	for {
@@ -131,6 +224,11 @@ func (c *Conn) readLoop() {
 			} else {
 				log.Println("read failed:", err, ":", c.rw.RemoteAddr())
 			}
+			if errors.Is(err, frame.ErrFrameTooLarge) {
+				// the client is told why it is disconnected, the
+				// rest of the frame is not read
+				c.readError = exceededMaxFrameSize
+			}
 
 			// Close the read channel so that the processing loop will
 			// know to terminate, if it has not already done so. This is
@@ -152,28 +250,40 @@ func (c *Conn) readLoop() {
 		// read timeout means no synchronization is necessary.
 		if expectingConnect {
 			// Expecting a CONNECT or STOMP command, get the heart-beat
-			cx, _, err := getHeartBeat(f)
+			cx, cy, err := getHeartBeat(f)
 
 			// Ignore the error condition and treat as no read timeout.
 			// The processing loop will handle the error again and
 			// process correctly.
 			if err == nil {
-				// Minimum value as per server config. If the client
-				// has requested shorter periods than this value, the
-				// server will insist on the longer time period.
-				min := asMilliseconds(c.config.HeartBeat(), maxHeartBeat)
-
-				// apply a minimum heartbeat
-				if cx > 0 && cx < min {
-					cx = min
+				read, _, err := negotiateHeartBeat(c.config, cx, cy)
+				if err == nil {
+					// allow for heart-beats that arrive late
+					readTimeout = time.Duration(float64(read) * c.config.HeartBeatGracePeriodMultiplier() * float64(time.Millisecond))
 				}
 
-				readTimeout = time.Duration(cx) * time.Millisecond
-
 				expectingConnect = false
 			}
 		}
 
+		// A client that sends too fast is slowed down by not reading
+		// from it, or disconnected.
+		if f.Command == frame.SEND {
+			wait, ok := c.limiter.take(c.config, len(f.Body), time.Now())
+			if !ok {
+				log.Println("send rate exceeded:", c.rw.RemoteAddr())
+				c.readError = sendRateExceeded
+				close(c.readChannel)
+				return
+			}
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-c.done:
+				}
+			}
+		}
+
 		// Add the frame to the read channel. Note that this will block
 		// if we are reading from the client quicker than the server
 		// can process frames.
@@ -193,7 +303,9 @@ func (c *Conn) processLoop() {
 		var timer *time.Timer
 
 		if c.writeTimeout > 0 {
-			timer = time.NewTimer(c.writeTimeout)
+			// a heart-beat is written once nothing else has been
+			// written for the timeout, however many frames are read
+			timer = time.NewTimer(time.Until(c.lastWrite.Add(c.writeTimeout)))
 			timerChannel = timer.C
 		}
 
@@ -217,7 +329,7 @@ func (c *Conn) processLoop() {
 			c.allocateMessageId(f, nil)
 
 			// write the frame to the client
-			err := c.writer.Write(f)
+			err := c.sendImmediately(f)
 			if err != nil {
 				// if there is an error writing to
 				// the client, there is not much
@@ -237,6 +349,9 @@ func (c *Conn) processLoop() {
 			if !ok {
 				// read channel has been closed, so
 				// exit go-routine (after cleaning up)
+				if c.readError != nil {
+					c.sendErrorImmediately(c.readError, nil)
+				}
 				return
 			}
 
@@ -285,7 +400,7 @@ func (c *Conn) processLoop() {
 				c.allocateMessageId(sub.frame, sub)
 
 				// write the frame to the client
-				err := c.writer.Write(sub.frame)
+				err := c.sendImmediately(sub.frame)
 				if err != nil {
 					// if there is an error writing to
 					// the client, there is not much
@@ -296,8 +411,10 @@ func (c *Conn) processLoop() {
 
 				if sub.ack == frame.AckAuto {
 					// subscription does not require acknowledgement,
-					// so send the subscription back the upper layer
-					// straight away
+					// so the message can be discarded, and the
+					// subscription sent back the upper layer straight
+					// away
+					c.requestChannel <- Request{Op: AckOp, Sub: sub, Frame: sub.frame}
 					sub.frame = nil
 					c.requestChannel <- Request{Op: SubscribeOp, Sub: sub}
 				} else {
@@ -311,7 +428,7 @@ func (c *Conn) processLoop() {
 
 		case _ = <-timerChannel:
 			// write a heart-beat
-			err := c.writer.Write(nil)
+			err := c.sendImmediately(nil)
 			if err != nil {
 				return
 			}
@@ -361,6 +478,7 @@ func (c *Conn) cleanupConn() {
 
 	// Should not hurt to call this if it is already closed?
 	c.rw.Close()
+	close(c.done)
 }
 
 // Discard anything on the write channel. These frames
@@ -412,6 +530,7 @@ func (c *Conn) allocateMessageId(f *frame.Frame, sub *Subscription) {
 			f.Header.Del(frame.Ack)
 		} else {
 			f.Header.Set(frame.Ack, messageId)
+			sub.msgId = c.lastMsgId
 		}
 	}
 }
@@ -464,16 +583,20 @@ func (c *Conn) handleConnect(f *frame.Frame) error {
 		return receiptInConnect
 	}
 
-	// if either of these fields are absent, pass nil to the
-	// authenticator function.
-	login, _ := f.Header.Contains(frame.Login)
-	passcode, _ := f.Header.Contains(frame.Passcode)
-	if !c.config.Authenticate(login, passcode) {
+	var state *tls.ConnectionState
+	if tlsConn, ok := c.rw.(*tls.Conn); ok {
+		connectionState := tlsConn.ConnectionState()
+		state = &connectionState
+	}
+	principal, err := c.config.Authenticate(f, state)
+	if err != nil {
 		// sleep to slow down a rogue client a little bit
-		log.Println("authentication failed")
+		log.Println("authentication failed:", err, ":", c.rw.RemoteAddr())
 		time.Sleep(time.Second)
 		return authenticationFailed
 	}
+	c.principal = principal
+	c.clientId = f.Header.Get(clientIdHeader)
 
 	c.version, err = determineVersion(f)
 	if err != nil {
@@ -481,6 +604,7 @@ func (c *Conn) handleConnect(f *frame.Frame) error {
 		return err
 	}
 	c.validator = stomp.NewValidator(c.version)
+	c.writer.SetVersion(string(c.version))
 
 	if c.version == stomp.V10 {
 		// don't want to handle V1.0 at the moment
@@ -495,27 +619,23 @@ func (c *Conn) handleConnect(f *frame.Frame) error {
 		return err
 	}
 
-	// Minimum value as per server config. If the client
-	// has requested shorter periods than this value, the
-	// server will insist on the longer time period.
-	min := asMilliseconds(c.config.HeartBeat(), maxHeartBeat)
-
-	// apply a minimum heartbeat
-	if cx > 0 && cx < min {
-		cx = min
-	}
-	if cy > 0 && cy < min {
-		cy = min
+	// The server replies with the intervals negotiated, which are
+	// at least as long as those of the client, so that the client
+	// arrives at the same intervals.
+	read, write, err := negotiateHeartBeat(c.config, cx, cy)
+	if err != nil {
+		log.Println("heart-beat interval too long:", cx, ":", c.rw.RemoteAddr())
+		return err
 	}
 
 	// the read timeout has already been processed in the readLoop
 	// go-routine
-	c.writeTimeout = time.Duration(cy) * time.Millisecond
+	c.writeTimeout = time.Duration(write) * time.Millisecond
 
 	response := frame.New(frame.CONNECTED,
 		frame.Version, string(c.version),
 		frame.Server, "stompd/x.y.z", // TODO: get version
-		frame.HeartBeat, fmt.Sprintf("%d,%d", cy, cx))
+		frame.HeartBeat, fmt.Sprintf("%d,%d", write, read))
 
 	c.sendImmediately(response)
 	c.stateFunc = connected
@@ -612,6 +732,11 @@ func (c *Conn) handleSubscribe(f *frame.Frame) error {
 		return missingHeader(frame.Destination)
 	}
 
+	if !c.config.CanSubscribe(c.principal, dest) {
+		log.Println("subscription not authorized:", dest, ":", c.rw.RemoteAddr())
+		return notAuthorized(dest)
+	}
+
 	ack, ok := f.Header.Contains(frame.Ack)
 	if !ok {
 		ack = frame.AckAuto
@@ -622,7 +747,19 @@ func (c *Conn) handleSubscribe(f *frame.Frame) error {
 		return subscriptionExists
 	}
 
+	if limit := c.config.MaxSubscriptions(); limit > 0 && len(c.subs) >= limit {
+		log.Println("too many subscriptions:", limit, ":", c.rw.RemoteAddr())
+		return tooManySubscriptions
+	}
+
 	sub = newSubscription(c, dest, id, ack)
+	sub.browser = f.Header.Get(browserHeader) == "true"
+	if sub.durable, ok = durableName(f); ok {
+		if c.clientId == "" {
+			return durableWithoutClientId
+		}
+		sub.clientId = c.clientId
+	}
 	c.subs[id] = sub
 
 	// send information about new subscription to upper layer
@@ -636,31 +773,37 @@ func (c *Conn) handleUnsubscribe(f *frame.Frame) error {
 		return missingHeader(frame.Id)
 	}
 
+	// an UNSUBSCRIBE frame with a durable subscription name removes
+	// the durable subscription, which need not be active
+	name, durable := durableName(f)
+	if durable && c.clientId == "" {
+		return durableWithoutClientId
+	}
+
 	sub, ok := c.subs[id]
-	if !ok {
+	if !ok && !durable {
 		return subscriptionNotFound
 	}
 
-	// remove the subscription
-	delete(c.subs, id)
+	if ok {
+		// remove the subscription
+		delete(c.subs, id)
 
-	// tell the upper layer of the unsubscribe
-	c.requestChannel <- Request{Op: UnsubscribeOp, Sub: sub}
+		// tell the upper layer of the unsubscribe
+		c.requestChannel <- Request{Op: UnsubscribeOp, Sub: sub}
+	}
+
+	if durable {
+		sub = newSubscription(c, "", id, "")
+		sub.clientId = c.clientId
+		sub.durable = name
+		c.requestChannel <- Request{Op: UnsubscribeDurableOp, Sub: sub}
+	}
 	return nil
 }
 
 func (c *Conn) handleAck(f *frame.Frame) error {
-	var err error
-	var msgId string
-
-	if ack, ok := f.Header.Contains(frame.Ack); ok {
-		msgId = ack
-	} else if msgId, ok = f.Header.Contains(frame.MessageId); !ok {
-		return missingHeader(frame.MessageId)
-	}
-
-	// expecting message id to be a uint64
-	msgId64, err := strconv.ParseUint(msgId, 10, 64)
+	msgId64, err := c.ackMessageId(f)
 	if err != nil {
 		return err
 	}
@@ -680,7 +823,9 @@ func (c *Conn) handleAck(f *frame.Frame) error {
 	} else {
 		// handle any subscriptions that are acknowledged by this msg
 		c.subList.Ack(msgId64, func(s *Subscription) {
-			// remove frame from the subscription, it has been delivered
+			// remove frame from the subscription, it has been delivered,
+			// so the upper layer can discard it
+			c.requestChannel <- Request{Op: AckOp, Sub: s, Frame: s.frame}
 			s.frame = nil
 
 			// let the upper layer know that this subscription
@@ -693,17 +838,7 @@ func (c *Conn) handleAck(f *frame.Frame) error {
 }
 
 func (c *Conn) handleNack(f *frame.Frame) error {
-	var err error
-	var msgId string
-
-	if ack, ok := f.Header.Contains(frame.Ack); ok {
-		msgId = ack
-	} else if msgId, ok = f.Header.Contains(frame.MessageId); !ok {
-		return missingHeader(frame.MessageId)
-	}
-
-	// expecting message id to be a uint64
-	msgId64, err := strconv.ParseUint(msgId, 10, 64)
+	msgId64, err := c.ackMessageId(f)
 	if err != nil {
 		return err
 	}
@@ -723,8 +858,9 @@ func (c *Conn) handleNack(f *frame.Frame) error {
 	} else {
 		// handle any subscriptions that are acknowledged by this msg
 		c.subList.Nack(msgId64, func(s *Subscription) {
-			// send frame back to upper layer for requeue
-			c.requestChannel <- Request{Op: RequeueOp, Frame: s.frame}
+			// send frame back to upper layer, which requeues it or
+			// moves it to a dead-letter queue
+			c.requestChannel <- Request{Op: NackOp, Sub: s, Frame: s.frame, Nack: f}
 
 			// remove frame from the subscription, it has been requeued
 			s.frame = nil
@@ -737,10 +873,41 @@ func (c *Conn) handleNack(f *frame.Frame) error {
 	return nil
 }
 
+// Returns the message-id acknowledged by an ACK or NACK frame. In
+// STOMP 1.2 the frame has the id header, whose value is the ack
+// header of the MESSAGE frame, and in STOMP 1.1 it has the message-id
+// header.
+func (c *Conn) ackMessageId(f *frame.Frame) (uint64, error) {
+	msgId, ok := f.Header.Contains(frame.Ack)
+	if !ok && c.version == stomp.V12 {
+		if msgId, ok = f.Header.Contains(frame.Id); !ok {
+			return 0, missingHeader(frame.Id)
+		}
+	} else if !ok {
+		if msgId, ok = f.Header.Contains(frame.MessageId); !ok {
+			return 0, missingHeader(frame.MessageId)
+		}
+	}
+
+	// expecting message id to be a uint64
+	return strconv.ParseUint(msgId, 10, 64)
+}
+
 // Handle a SEND frame received from the client. Note that
 // this method is called after a SEND message is received,
 // but also after a transaction commit.
 func (c *Conn) handleSend(f *frame.Frame) error {
+	// the frame should already have been validated for the
+	// destination header, but we check again here.
+	dest, ok := f.Header.Contains(frame.Destination)
+	if !ok {
+		return missingHeader(frame.Destination)
+	}
+	if !c.config.CanSend(c.principal, dest) {
+		log.Println("send not authorized:", dest, ":", c.rw.RemoteAddr())
+		return notAuthorized(dest)
+	}
+
 	// Send a receipt and remove the header
 	err := c.sendReceiptImmediately(f)
 	if err != nil {
@@ -757,7 +924,7 @@ func (c *Conn) handleSend(f *frame.Frame) error {
 		// not in a transaction
 		// change from SEND to MESSAGE
 		f.Command = frame.MESSAGE
-		c.requestChannel <- Request{Op: EnqueueOp, Frame: f}
+		c.requestChannel <- Request{Op: EnqueueOp, Frame: f, Conn: c}
 	}
 
 	return nil
@@ -5,7 +5,7 @@ const (
 	unexpectedCommand        = errorMessage("unexpected frame command")
 	unknownCommand           = errorMessage("unknown command")
 	receiptInConnect         = errorMessage("receipt header prohibited in CONNECT or STOMP frame")
-	authenticationFailed     = errorMessage("authentication failed")
+	authenticationFailed     = errorMessage("access denied")
 	txAlreadyInProgress      = errorMessage("transaction already in progress")
 	txUnknown                = errorMessage("unknown transaction")
 	unsupportedVersion       = errorMessage("unsupported version")
@@ -16,8 +16,12 @@ const (
 	unknownVersion           = errorMessage("incompatible version")
 	notConnectFrame          = errorMessage("operation valid for STOMP and CONNECT frames only")
 	invalidHeartBeat         = errorMessage("invalid format for heart-beat")
+	heartBeatTooLong         = errorMessage("heart-beat interval too long")
 	invalidOperationForFrame = errorMessage("invalid operation for frame")
 	exceededMaxFrameSize     = errorMessage("exceeded max frame size")
+	tooManySubscriptions     = errorMessage("too many subscriptions")
+	sendRateExceeded         = errorMessage("send rate exceeded")
+	durableWithoutClientId   = errorMessage("durable subscription requires client-id")
 	invalidHeaderValue       = errorMessage("invalid header value")
 )
 
@@ -31,6 +35,10 @@ func missingHeader(name string) errorMessage {
 	return errorMessage("missing header: " + name)
 }
 
+func notAuthorized(destination string) errorMessage {
+	return errorMessage("not authorized: " + destination)
+}
+
 func prohibitedHeader(name string) errorMessage {
 	return errorMessage("prohibited header: " + name)
 }
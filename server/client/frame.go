@@ -79,6 +79,41 @@ func determineVersion(f *frame.Frame) (version stomp.Version, err error) {
 	return
 }
 
+// Negotiate the heart-beat values of a connection, in milliseconds,
+// from the cx and cy values in the CONNECT or STOMP frame of the
+// client. Returns the interval at which the client must send
+// heart-beats, and the interval at which the server sends them, which
+// are zero if there are no heart-beats in that direction.
+//
+// The intervals are at least the minimum in config, and the write
+// interval is at most the maximum. Returns an error if the client
+// cannot send heart-beats as often as the maximum requires.
+func negotiateHeartBeat(config Config, cx, cy int) (read, write int, err error) {
+	min := asMilliseconds(config.HeartBeat(), maxHeartBeat)
+	max := asMilliseconds(config.HeartBeatMax(), maxHeartBeat)
+
+	if cx > 0 {
+		read = cx
+		if read < min {
+			read = min
+		}
+		if max > 0 && read > max {
+			err = heartBeatTooLong
+			return
+		}
+	}
+	if cy > 0 {
+		write = cy
+		if write < min {
+			write = min
+		}
+		if max > 0 && write > max {
+			write = max
+		}
+	}
+	return
+}
+
 // Determine the heart-beat values in a CONNECT or STOMP frame.
 //
 // Returns 0,0 if the heart-beat header is missing. Otherwise
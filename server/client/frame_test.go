@@ -1,6 +1,8 @@
 package client
 
 import (
+	"time"
+
 	"github.com/go-stomp/stomp"
 	"github.com/go-stomp/stomp/frame"
 	. "gopkg.in/check.v1"
@@ -80,3 +82,38 @@ func (s *FrameSuite) TestHeartBeat(c *C) {
 	_, _, err = getHeartBeat(f)
 	c.Check(err, Equals, invalidOperationForFrame)
 }
+
+// Config whose heart-beat methods alone are called.
+type heartBeatConfig struct {
+	Config
+	min, max time.Duration
+}
+
+func (c heartBeatConfig) HeartBeat() time.Duration    { return c.min }
+func (c heartBeatConfig) HeartBeatMax() time.Duration { return c.max }
+
+func (s *FrameSuite) TestNegotiateHeartBeat(c *C) {
+	testCases := []struct {
+		min, max    time.Duration
+		cx, cy      int
+		read, write int
+		err         error
+	}{
+		{time.Second, 0, 0, 0, 0, 0, nil},
+		{time.Second, 0, 500, 2000, 1000, 2000, nil},
+		{time.Second, 0, 0, 500, 0, 1000, nil},
+		{0, 0, 20, 30, 20, 30, nil},
+		{time.Second, 5 * time.Second, 5000, 9000, 5000, 5000, nil},
+		{time.Second, 5 * time.Second, 0, 0, 0, 0, nil},
+		{time.Second, 5 * time.Second, 5001, 0, 0, 0, heartBeatTooLong},
+	}
+
+	for i, tc := range testCases {
+		read, write, err := negotiateHeartBeat(heartBeatConfig{min: tc.min, max: tc.max}, tc.cx, tc.cy)
+		c.Check(err, Equals, tc.err, Commentf("test case %d", i))
+		if err == nil {
+			c.Check(read, Equals, tc.read, Commentf("test case %d", i))
+			c.Check(write, Equals, tc.write, Commentf("test case %d", i))
+		}
+	}
+}
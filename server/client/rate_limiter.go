@@ -0,0 +1,77 @@
+package client
+
+import (
+	"math"
+	"time"
+)
+
+// Limits the rate at which a client sends SEND frames, with a token
+// bucket for the frames and another for the bytes of their bodies.
+// Used by the readLoop go-routine only.
+type rateLimiter struct {
+	frames tokenBucket
+	bytes  tokenBucket
+}
+
+// Takes the tokens for a SEND frame whose body has size bytes, at the
+// rates returned by the config. Returns how long to wait before the
+// frame is processed, or false if the frame must be rejected.
+func (l *rateLimiter) take(config Config, size int, now time.Time) (time.Duration, bool) {
+	framesPerSecond, bytesPerSecond, reject := config.SendRateLimit()
+	if reject {
+		// reject the frame if either bucket is short of tokens
+		if !l.frames.available(framesPerSecond, 1, now) || !l.bytes.available(bytesPerSecond, float64(size), now) {
+			return 0, false
+		}
+	}
+	wait := l.frames.take(framesPerSecond, 1, now)
+	if w := l.bytes.take(bytesPerSecond, float64(size), now); w > wait {
+		wait = w
+	}
+	return wait, true
+}
+
+// A token bucket holds up to one second of tokens at its rate, which
+// may change between calls. Taking more tokens than there are leaves
+// a debt, which is repaid before more tokens can be taken.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // zero if the bucket is full
+}
+
+// Adds the tokens accumulated since the last call, at the rate.
+func (b *tokenBucket) refill(rate float64, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens = math.Min(rate, b.tokens+rate*now.Sub(b.last).Seconds())
+	}
+	b.last = now
+}
+
+// Reports whether the cost can be taken without leaving a debt. A
+// cost larger than the bucket only needs a full bucket. Always true
+// if the rate is not positive, which means that there is no limit.
+func (b *tokenBucket) available(rate, cost float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	b.refill(rate, now)
+	return b.tokens >= math.Min(cost, rate)
+}
+
+// Takes the cost from the bucket, and returns how long to wait until
+// the debt left, if any, has been repaid.
+func (b *tokenBucket) take(rate, cost float64, now time.Time) time.Duration {
+	if rate <= 0 {
+		// no limit, the bucket is full when a limit is set
+		*b = tokenBucket{}
+		return 0
+	}
+	b.refill(rate, now)
+	b.tokens -= cost
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
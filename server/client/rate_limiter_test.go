@@ -0,0 +1,77 @@
+package client
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type RateLimiterSuite struct{}
+
+var _ = Suite(&RateLimiterSuite{})
+
+type rateLimitConfig struct {
+	Config
+	frames, bytes float64
+	reject        bool
+}
+
+func (c *rateLimitConfig) SendRateLimit() (float64, float64, bool) {
+	return c.frames, c.bytes, c.reject
+}
+
+func (s *RateLimiterSuite) TestDelay(c *C) {
+	config := &rateLimitConfig{frames: 10}
+	var l rateLimiter
+	now := time.Now()
+
+	// a second of frames can be sent at once, and then they wait
+	for i := 0; i < 10; i++ {
+		wait, ok := l.take(config, 100, now)
+		c.Assert(ok, Equals, true)
+		c.Check(wait, Equals, time.Duration(0))
+	}
+	wait, ok := l.take(config, 100, now)
+	c.Check(ok, Equals, true)
+	c.Check(wait, Equals, 100*time.Millisecond)
+	wait, _ = l.take(config, 100, now.Add(100*time.Millisecond))
+	c.Check(wait, Equals, 100*time.Millisecond)
+
+	// the bytes are limited as well, and a body larger than the bucket
+	// waits for as long as it takes to repay
+	config.bytes = 1000
+	wait, _ = l.take(config, 3000, now.Add(10*time.Second))
+	c.Check(wait, Equals, 2*time.Second)
+
+	// the rates can change, and a zero rate means no limit
+	config.frames, config.bytes = 0, 0
+	wait, _ = l.take(config, 3000, now.Add(10*time.Second))
+	c.Check(wait, Equals, time.Duration(0))
+}
+
+func (s *RateLimiterSuite) TestReject(c *C) {
+	config := &rateLimitConfig{frames: 2, bytes: 1000, reject: true}
+	var l rateLimiter
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		wait, ok := l.take(config, 100, now)
+		c.Assert(ok, Equals, true)
+		c.Check(wait, Equals, time.Duration(0))
+	}
+	_, ok := l.take(config, 100, now)
+	c.Check(ok, Equals, false)
+
+	// the tokens accumulate again
+	_, ok = l.take(config, 100, now.Add(500*time.Millisecond))
+	c.Check(ok, Equals, true)
+
+	// a body larger than the bucket needs a full bucket, and leaves a
+	// debt to be repaid
+	_, ok = l.take(config, 5000, now.Add(time.Second))
+	c.Check(ok, Equals, true)
+	_, ok = l.take(config, 100, now.Add(2*time.Second))
+	c.Check(ok, Equals, false)
+	_, ok = l.take(config, 100, now.Add(6*time.Second))
+	c.Check(ok, Equals, true)
+}
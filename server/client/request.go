@@ -15,18 +15,22 @@ func (r RequestOp) String() string {
 
 // Valid value for client request opcodes.
 const (
-	SubscribeOp    RequestOp = iota // subscription ready
-	UnsubscribeOp                   // subscription not ready
-	EnqueueOp                       // send a message to a queue
-	RequeueOp                       // re-queue a message, not successfully sent
-	ConnectedOp                     // connection established
-	DisconnectedOp                  // connection disconnected
+	SubscribeOp          RequestOp = iota // subscription ready
+	UnsubscribeOp                         // subscription not ready
+	EnqueueOp                             // send a message to a queue
+	RequeueOp                             // re-queue a message, not successfully sent
+	ConnectedOp                           // connection established
+	DisconnectedOp                        // connection disconnected
+	AckOp                                 // message acknowledged, no longer stored
+	NackOp                                // message negatively acknowledged
+	UnsubscribeDurableOp                  // durable subscription removed
 )
 
 // Client requests received to be processed by main processing loop
 type Request struct {
 	Op    RequestOp     // opcode for request
-	Sub   *Subscription // SubscribeOp, UnsubscribeOp
-	Frame *frame.Frame  // EnqueueOp, RequeueOp
-	Conn  *Conn         // ConnectedOp, DisconnectedOp
+	Sub   *Subscription // SubscribeOp, UnsubscribeOp, AckOp, NackOp, UnsubscribeDurableOp
+	Frame *frame.Frame  // EnqueueOp, RequeueOp, AckOp, NackOp
+	Nack  *frame.Frame  // NackOp, the NACK frame received from the client
+	Conn  *Conn         // ConnectedOp, DisconnectedOp, EnqueueOp
 }
@@ -1,17 +1,50 @@
 package client
 
 import (
+	"sync"
+
 	"github.com/go-stomp/stomp/frame"
 )
 
+// The header entry of a SUBSCRIBE frame that browses a queue, which is
+// "true", and of the MESSAGE frame that ends the browse, which is "end".
+const browserHeader = "browser"
+
+// The header entry of a CONNECT frame that identifies the client, for
+// its durable subscriptions.
+const clientIdHeader = "client-id"
+
+// The header entries of a SUBSCRIBE or UNSUBSCRIBE frame that name a
+// durable subscription, as ActiveMQ and Artemis clients send them.
+var durableHeaders = []string{"activemq.subscriptionName", "durable-subscription-name"}
+
+// Returns the name of the durable subscription in the frame, and
+// false if the frame does not name one.
+func durableName(f *frame.Frame) (string, bool) {
+	for _, name := range durableHeaders {
+		if value, ok := f.Header.Contains(name); ok && value != "" {
+			return value, true
+		}
+	}
+	return "", false
+}
+
 type Subscription struct {
-	conn    *Conn
-	dest    string
-	id      string            // client's subscription id
-	ack     string            // auto, client, client-individual
-	msgId   uint64            // message-id (or ack) for acknowledgement
-	subList *SubscriptionList // am I in a list
-	frame   *frame.Frame      // message allocated to subscription
+	conn     *Conn
+	dest     string
+	id       string            // client's subscription id
+	ack      string            // auto, client, client-individual
+	msgId    uint64            // message-id (or ack) for acknowledgement
+	subList  *SubscriptionList // am I in a list
+	frame    *frame.Frame      // message allocated to subscription
+	browser  bool              // browses the queue, without consuming
+	clientId string            // client-id of the connection, if durable
+	durable  string            // name of the durable subscription, if any
+
+	mu       sync.Mutex     // protects the fields below, used by Resume
+	backlog  []*frame.Frame // topic frames to be written before the others
+	resuming bool           // the backlog is being written
+	pending  int            // topic frames added to the backlog by SendTopicFrame
 }
 
 func newSubscription(c *Conn, dest string, id string, ack string) *Subscription {
@@ -35,6 +68,22 @@ func (s *Subscription) Id() string {
 	return s.id
 }
 
+// Reports whether the subscription browses its queue, because its
+// SUBSCRIBE frame has the "browser:true" header entry. The messages
+// in the queue are sent to a browser with Browse, instead of being
+// consumed.
+func (s *Subscription) Browser() bool {
+	return s.browser
+}
+
+// Returns the client-id of the connection and the name of the durable
+// subscription, if the SUBSCRIBE frame named one with the
+// "activemq.subscriptionName" or "durable-subscription-name" header
+// entry, otherwise an empty name.
+func (s *Subscription) Durable() (clientId, name string) {
+	return s.clientId, s.durable
+}
+
 func (s *Subscription) IsAckedBy(msgId uint64) bool {
 	switch s.ack {
 	case frame.AckAuto:
@@ -71,9 +120,90 @@ func (s *Subscription) SendQueueFrame(f *frame.Frame) {
 func (s *Subscription) SendTopicFrame(f *frame.Frame) {
 	s.setSubscriptionHeader(f)
 
+	// the frames sent while a backlog is being written wait
+	// for it, so that the client receives them in order
+	s.mu.Lock()
+	if s.resuming {
+		s.pending++
+		if s.pending > maxPendingTopicWrites {
+			s.mu.Unlock()
+			s.conn.closeSlow()
+			return
+		}
+		s.backlog = append(s.backlog, f)
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
 	// topics are handled differently, they just go
-	// straight to the client without acknowledgement
-	s.conn.writeChannel <- f
+	// straight to the client without acknowledgement,
+	// unless the client is falling behind
+	select {
+	case s.conn.writeChannel <- f:
+	default:
+		s.conn.closeSlow()
+	}
+}
+
+// Send copies of the messages in a queue to the client, as part of
+// this subscription, which browses the queue, followed by a MESSAGE
+// frame with the "browser:end" header entry and no body. The frames
+// are sent from another go-routine, at the pace of the client, and
+// are not acknowledged.
+func (s *Subscription) Browse(frames []*frame.Frame) {
+	end := frame.New(frame.MESSAGE,
+		frame.Destination, s.dest,
+		browserHeader, "end")
+	go func() {
+		for _, f := range append(frames, end) {
+			f.Header.Set(frame.Subscription, s.id)
+			select {
+			case s.conn.writeChannel <- f:
+			case <-s.conn.done:
+				return
+			}
+		}
+	}()
+}
+
+// Send the topic messages that a durable subscription buffered while
+// no client was subscribed to it, as part of this subscription,
+// before the frames sent to it from then on with SendTopicFrame. The
+// frames are written from another go-routine, at the pace of the
+// client.
+func (s *Subscription) Resume(frames []*frame.Frame) {
+	if len(frames) == 0 {
+		return
+	}
+	for _, f := range frames {
+		f.Header.Set(frame.Subscription, s.id)
+	}
+	s.mu.Lock()
+	s.backlog = frames
+	s.resuming = true
+	s.mu.Unlock()
+	go func() {
+		for {
+			s.mu.Lock()
+			if len(s.backlog) == 0 {
+				s.backlog = nil
+				s.resuming = false
+				s.pending = 0
+				s.mu.Unlock()
+				return
+			}
+			f := s.backlog[0]
+			s.backlog[0] = nil
+			s.backlog = s.backlog[1:]
+			s.mu.Unlock()
+			select {
+			case s.conn.writeChannel <- f:
+			case <-s.conn.done:
+				return
+			}
+		}
+	}()
 }
 
 func (s *Subscription) setSubscriptionHeader(f *frame.Frame) {
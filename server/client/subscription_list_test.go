@@ -76,6 +76,9 @@ func (s *SubscriptionListSuite) TestAck(c *C) {
 	c.Assert(subs[0], Equals, sub1)
 	c.Assert(subs[1], Equals, sub3)
 
+	// the subscriptions acknowledged can be added to a list again
+	NewSubscriptionList().Add(sub1)
+
 	c.Assert(sl.Get(), Equals, sub2)
 	c.Assert(sl.Get(), Equals, sub4)
 	c.Assert(sl.Get(), IsNil)
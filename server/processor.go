@@ -1,9 +1,17 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-stomp/stomp/frame"
@@ -12,91 +20,341 @@ import (
 	"github.com/go-stomp/stomp/server/topic"
 )
 
+// Time allowed for the TLS handshake of a connection accepted.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// Time allowed for a connection refused to send its CONNECT frame.
+const refuseTimeout = 10 * time.Second
+
+// Content type of the snapshots published to Server.StatsDestination.
+const statsContentType = "application/json;charset=utf-8"
+
 type requestProcessor struct {
-	server *Server
-	ch     chan client.Request
-	tm     *topic.Manager
-	qm     *queue.Manager
-	stop   bool // has stop been requested
+	server  *Server
+	ch      chan client.Request
+	tm      *topic.Manager
+	qm      *queue.Manager
+	qstore  Storage
+	slots   chan struct{}             // one for each connection served, nil if there is no maximum
+	stop    bool                      // has stop been requested
+	clients map[*client.Conn]struct{} // connections that have connected, used by the processing loop only
+	quit    chan struct{}             // closed once the connections have closed after a shutdown
+	stopped chan struct{}             // closed once the requests have been processed after quit
+
+	mu       sync.Mutex // protects the fields below
+	listener net.Listener
+	conns    map[*client.Conn]struct{}
+	closing  bool // no more connections are accepted
 }
 
 func newRequestProcessor(server *Server) *requestProcessor {
 	proc := &requestProcessor{
-		server: server,
-		ch:     make(chan client.Request, 128),
-		tm:     topic.NewManager(),
+		server:  server,
+		ch:      make(chan client.Request, 128),
+		slots:   server.slots,
+		tm:      topic.NewWildcardManager(topicWildcards(server)),
+		quit:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		clients: make(map[*client.Conn]struct{}),
+		conns:   make(map[*client.Conn]struct{}),
 	}
 
-	if server.QueueStorage == nil {
-		proc.qm = queue.NewManager(queue.NewMemoryQueueStorage())
-	} else {
-		proc.qm = queue.NewManager(server.QueueStorage)
+	var qstore Storage
+	switch {
+	case server.Storage != nil:
+		qstore = server.Storage
+	case server.QueueStorage != nil:
+		qstore = newQueueStorage(server.QueueStorage)
+	case server.PriorityQueues:
+		qstore = queue.NewPriorityMemoryQueueStorage()
+	default:
+		qstore = queue.NewMemoryQueueStorage()
 	}
+	qstore.Start()
+	proc.qstore = qstore
+	proc.qm = queue.NewManager(qstore)
+	proc.qm.SetDeadLetterSuffix(server.DeadLetterSuffix)
+	proc.qm.SetMaxRedeliveries(server.maxRedeliveries)
+	proc.qm.SetDelayedDelivery(server.DelayedDelivery)
+	proc.tm.SetDurableLimit(server.durableBufferSize(), server.DurableOverflow)
+	if server.DeadLetterPattern != "" {
+		proc.qm.SetDeadLetterPattern(server.DeadLetterPattern)
+	}
+	proc.qm.OnExpire(func(destination string, deadLettered bool) {
+		server.expired.Add(1)
+		if deadLettered {
+			server.deadLettered.Add(1)
+		}
+	})
 
 	return proc
 }
 
 func (proc *requestProcessor) Serve(l net.Listener) error {
+	proc.mu.Lock()
+	proc.listener = l
+	if proc.closing {
+		// shut down before it started serving
+		l.Close()
+	}
+	proc.mu.Unlock()
 	go proc.Listen(l)
 
+	var sweepChannel <-chan time.Time
+	if interval := proc.server.sweepInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		sweepChannel = ticker.C
+	}
+
+	var statsChannel <-chan time.Time
+	if proc.server.StatsDestination != "" {
+		ticker := time.NewTicker(proc.server.statsInterval())
+		defer ticker.Stop()
+		statsChannel = ticker.C
+	}
+
+	// the timer is reset to the release time of the next delayed message
+	var releaseTimer *time.Timer
+	var releaseTime time.Time
+	defer func() {
+		if releaseTimer != nil {
+			releaseTimer.Stop()
+		}
+	}()
+
 	for {
-		r := <-proc.ch
-		switch r.Op {
-		case client.SubscribeOp:
-			if isQueueDestination(r.Sub.Destination()) {
-				queue := proc.qm.Find(r.Sub.Destination())
-				// todo error handling
-				queue.Subscribe(r.Sub)
-			} else {
-				topic := proc.tm.Find(r.Sub.Destination())
-				topic.Subscribe(r.Sub)
+		var releaseChannel <-chan time.Time
+		if next, ok := proc.qm.NextRelease(); ok {
+			if releaseTimer == nil {
+				releaseTimer = time.NewTimer(time.Until(next))
+			} else if !next.Equal(releaseTime) {
+				releaseTimer.Reset(time.Until(next))
 			}
+			releaseTime = next
+			releaseChannel = releaseTimer.C
+		}
 
-		case client.UnsubscribeOp:
-			if isQueueDestination(r.Sub.Destination()) {
-				queue := proc.qm.Find(r.Sub.Destination())
-				// todo error handling
-				queue.Unsubscribe(r.Sub)
-			} else {
-				topic := proc.tm.Find(r.Sub.Destination())
-				topic.Unsubscribe(r.Sub)
+		select {
+		case r := <-proc.ch:
+			proc.handle(r)
+		case now := <-releaseChannel:
+			// a timer that has been reset may have fired early
+			releaseTime = time.Time{}
+			if err := proc.qm.Release(now); err != nil {
+				log.Printf("stomp: Release error: %v", err)
 			}
-
-		case client.EnqueueOp:
-			destination, ok := r.Frame.Header.Contains(frame.Destination)
-			if !ok {
-				// should not happen, already checked in lower layer
-				panic("missing destination")
+		case now := <-sweepChannel:
+			if err := proc.qm.Sweep(now); err != nil {
+				log.Printf("stomp: Sweep error: %v", err)
 			}
+		case <-statsChannel:
+			proc.tm.Enqueue(proc.server.StatsDestination, proc.statsFrame())
+		case <-proc.quit:
+			// the connections have sent their last requests, which
+			// requeue the messages that they did not acknowledge
+			for len(proc.ch) > 0 {
+				proc.handle(<-proc.ch)
+			}
+			proc.qstore.Stop()
+			close(proc.stopped)
+			return ErrServerClosed
+		}
+	}
+}
 
-			if isQueueDestination(destination) {
-				queue := proc.qm.Find(destination)
-				queue.Enqueue(r.Frame)
-			} else {
-				topic := proc.tm.Find(destination)
-				topic.Enqueue(r.Frame)
+// handle processes a request from a client connection.
+func (proc *requestProcessor) handle(r client.Request) {
+	proc.server.frames.Add(1)
+	switch r.Op {
+	case client.ConnectedOp:
+		proc.clients[r.Conn] = struct{}{}
+		proc.server.connections.Add(1)
+		if proc.server.OnConnect != nil {
+			proc.server.OnConnect(r.Conn)
+		}
+
+	case client.DisconnectedOp:
+		// sent for the connections that did not connect as well
+		if _, ok := proc.clients[r.Conn]; ok {
+			delete(proc.clients, r.Conn)
+			proc.server.connections.Add(-1)
+			if proc.server.OnDisconnect != nil {
+				proc.server.OnDisconnect(r.Conn)
 			}
+		}
 
-		case client.RequeueOp:
-			destination, ok := r.Frame.Header.Contains(frame.Destination)
-			if !ok {
-				// should not happen, already checked in lower layer
-				panic("missing destination")
+	case client.SubscribeOp:
+		if proc.server.isQueueDestination(r.Sub.Destination()) {
+			queue := proc.qm.Find(r.Sub.Destination())
+			if r.Sub.Browser() {
+				frames, err := queue.Browse()
+				if err != nil {
+					log.Printf("stomp: Browse error: %v", err)
+				}
+				r.Sub.Browse(frames)
+				break
+			}
+			// todo error handling
+			queue.Subscribe(r.Sub)
+		} else if clientId, name := r.Sub.Durable(); name != "" {
+			r.Sub.Resume(proc.tm.SubscribeDurable(durableKey(clientId, name), r.Sub.Destination(), r.Sub))
+		} else {
+			proc.tm.Subscribe(r.Sub.Destination(), r.Sub)
+			if r.Sub.Destination() == proc.server.StatsDestination {
+				// the first snapshot is not left until the next tick
+				r.Sub.SendTopicFrame(proc.statsFrame())
 			}
+		}
+
+	case client.UnsubscribeOp:
+		if proc.server.isQueueDestination(r.Sub.Destination()) {
+			queue := proc.qm.Find(r.Sub.Destination())
+			// todo error handling
+			queue.Unsubscribe(r.Sub)
+		} else {
+			proc.tm.Unsubscribe(r.Sub.Destination(), r.Sub)
+		}
+
+	case client.UnsubscribeDurableOp:
+		proc.tm.RemoveDurable(durableKey(r.Sub.Durable()))
 
-			// only requeue to queues, should never happen for topics
-			if isQueueDestination(destination) {
-				queue := proc.qm.Find(destination)
-				queue.Requeue(r.Frame)
+	case client.EnqueueOp:
+		destination, ok := r.Frame.Header.Contains(frame.Destination)
+		if !ok {
+			// should not happen, already checked in lower layer
+			panic("missing destination")
+		}
+
+		if proc.server.OnSend != nil {
+			proc.server.OnSend(r.Conn, r.Frame)
+		}
+		if proc.server.isQueueDestination(destination) {
+			queue := proc.qm.Find(destination)
+			queue.Enqueue(r.Frame)
+		} else if destination != proc.server.StatsDestination {
+			if err := proc.tm.Enqueue(destination, r.Frame); err != nil {
+				// the producer is rejected, see DurableOverflow
+				r.Conn.Reject(err)
 			}
 		}
+
+	case client.RequeueOp:
+		destination, ok := r.Frame.Header.Contains(frame.Destination)
+		if !ok {
+			// should not happen, already checked in lower layer
+			panic("missing destination")
+		}
+
+		// only requeue to queues, should never happen for topics
+		if proc.server.isQueueDestination(destination) {
+			queue := proc.qm.Find(destination)
+			queue.Requeue(r.Frame)
+		}
+
+	case client.AckOp:
+		// only acknowledge to queues, should never happen for topics
+		if proc.server.isQueueDestination(r.Sub.Destination()) {
+			queue := proc.qm.Find(r.Sub.Destination())
+			queue.Ack(r.Frame)
+		}
+
+	case client.NackOp:
+		// only negatively acknowledge to queues, should never happen for topics
+		if proc.server.isQueueDestination(r.Sub.Destination()) {
+			queue := proc.qm.Find(r.Sub.Destination())
+			queue.Nack(r.Frame, r.Nack)
+		}
+	}
+}
+
+// statsFrame returns a MESSAGE frame for the stats destination, whose
+// body is a snapshot of the statistics of the server.
+func (proc *requestProcessor) statsFrame() *frame.Frame {
+	body, err := json.Marshal(proc.server.Stats())
+	if err != nil {
+		// should not happen, the statistics are plain values
+		panic(err)
+	}
+	f := frame.New(frame.MESSAGE,
+		frame.Destination, proc.server.StatsDestination,
+		frame.ContentType, statsContentType,
+		frame.ContentLength, strconv.Itoa(len(body)))
+	f.Body = body
+	return f
+}
+
+// isQueueDestination reports whether the destination is a queue,
+// rather than a topic.
+func (s *Server) isQueueDestination(dest string) bool {
+	if len(s.QueuePrefixes) == 0 {
+		return strings.HasPrefix(dest, QueuePrefix)
+	}
+	for _, prefix := range s.QueuePrefixes {
+		if strings.HasPrefix(dest, prefix) {
+			return true
+		}
 	}
-	// this is no longer required for go 1.1
-	panic("not reached")
+	return false
 }
 
-func isQueueDestination(dest string) bool {
-	return strings.HasPrefix(dest, QueuePrefix)
+// maxRedeliveries returns the maximum number of times that a message
+// in the queue with the destination is redelivered after a NACK.
+func (s *Server) maxRedeliveries(destination string) int {
+	if limit, ok := s.DestinationMaxRedeliveries[destination]; ok {
+		return limit
+	}
+	return s.MaxRedeliveries
+}
+
+func (s *Server) statsInterval() time.Duration {
+	if s.StatsInterval == time.Duration(0) {
+		return DefaultStatsInterval
+	}
+	return s.StatsInterval
+}
+
+func (s *Server) durableBufferSize() int {
+	switch {
+	case s.DurableBufferSize == 0:
+		return DefaultDurableBufferSize
+	case s.DurableBufferSize < 0:
+		return 0
+	}
+	return s.DurableBufferSize
+}
+
+// durableKey identifies the durable subscription called name of the
+// clients with the client-id specified.
+func durableKey(clientId, name string) string {
+	return clientId + "\x00" + name
+}
+
+func (s *Server) sweepInterval() time.Duration {
+	if s.SweepInterval == time.Duration(0) {
+		return DefaultSweepInterval
+	}
+	return s.SweepInterval
+}
+
+// topicWildcards returns the tokens of hierarchical topic destinations
+// configured for the server, or their defaults.
+func topicWildcards(s *Server) topic.Wildcards {
+	w := topic.Wildcards{
+		Separator: s.TopicSeparator,
+		Wildcard:  s.TopicWildcard,
+		Recursive: s.TopicRecursiveWildcard,
+	}
+	if w.Separator == "" {
+		w.Separator = DefaultTopicSeparator
+	}
+	if w.Wildcard == "" {
+		w.Wildcard = DefaultTopicWildcard
+	}
+	if w.Recursive == "" {
+		w.Recursive = DefaultTopicRecursiveWildcard
+	}
+	return w
 }
 
 func (proc *requestProcessor) Listen(l net.Listener) {
@@ -121,12 +379,143 @@ func (proc *requestProcessor) Listen(l net.Listener) {
 			return
 		}
 		timeout = 0
-		// TODO: need to pass Server to connection so it has access to
-		// configuration parameters.
-		_ = client.NewConn(config, rw, proc.ch)
+
+		if !proc.acquire() {
+			go proc.refuse(rw, config)
+			continue
+		}
+
+		if tlsConn, ok := rw.(*tls.Conn); ok {
+			// the handshake is completed before the connection is
+			// served, so that a slow or failed handshake does not
+			// hold up the accept loop
+			go proc.handshake(tlsConn, config)
+			continue
+		}
+		proc.serveConn(rw, config)
+	}
+}
+
+// handshake completes the TLS handshake of a connection accepted, and
+// then serves it. A connection whose handshake fails is closed.
+func (proc *requestProcessor) handshake(rw *tls.Conn, config *config) {
+	rw.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := rw.Handshake(); err != nil {
+		log.Println("TLS handshake failed:", err, ":", rw.RemoteAddr())
+		rw.Close()
+		proc.release()
+		return
+	}
+	rw.SetDeadline(time.Time{})
+	proc.serveConn(rw, config)
+}
+
+// serveConn creates the client connection for a network connection
+// accepted, unless the server is shutting down.
+func (proc *requestProcessor) serveConn(rw net.Conn, config *config) {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	if proc.closing {
+		// accepted as the server was shutting down
+		rw.Close()
+		proc.release()
+		return
+	}
+	// TODO: need to pass Server to connection so it has access to
+	// configuration parameters.
+	conn := client.NewConn(config, rw, proc.ch)
+	proc.conns[conn] = struct{}{}
+	go proc.forget(conn)
+}
+
+// forget removes the connection from those that a shutdown waits
+// for, once it has been cleaned up.
+func (proc *requestProcessor) forget(conn *client.Conn) {
+	<-conn.Done()
+	proc.mu.Lock()
+	delete(proc.conns, conn)
+	proc.mu.Unlock()
+	proc.release()
+}
+
+// acquire takes a slot for a connection accepted, and reports
+// whether one was free.
+func (proc *requestProcessor) acquire() bool {
+	if proc.slots == nil {
+		return true
+	}
+	select {
+	case proc.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees the slot of a connection that has closed.
+func (proc *requestProcessor) release() {
+	if proc.slots != nil {
+		<-proc.slots
+	}
+}
+
+// refuse replies to the CONNECT frame of a connection accepted beyond
+// the maximum with an ERROR frame, and closes it. The CONNECT frame is
+// read first, so that the client receives the ERROR frame instead of
+// a reset connection.
+func (proc *requestProcessor) refuse(rw net.Conn, config *config) {
+	defer rw.Close()
+	log.Println("too many connections:", rw.RemoteAddr())
+	rw.SetDeadline(time.Now().Add(refuseTimeout))
+	reader := frame.NewReader(rw,
+		frame.MaxFrameSize(config.MaxFrameSize()),
+		frame.MaxHeaders(config.MaxHeaders()))
+	for {
+		f, err := reader.Read()
+		if err != nil {
+			return
+		}
+		if f != nil {
+			break
+		}
 	}
-	// This is no longer required for go 1.1
-	panic("not reached")
+	frame.NewWriter(rw).Write(frame.New(frame.ERROR, frame.Message, errTooManyConnections.Error()))
+}
+
+// shutdown stops accepting connections, and returns a channel that
+// is closed once the processor has processed the last requests of
+// the connections and stopped. If notice is not nil, it is sent to
+// the clients in an ERROR frame. The connections still open once ctx
+// is done are closed.
+func (proc *requestProcessor) shutdown(ctx context.Context, notice error) <-chan struct{} {
+	proc.mu.Lock()
+	proc.closing = true
+	if proc.listener != nil {
+		proc.listener.Close()
+	}
+	conns := make([]*client.Conn, 0, len(proc.conns))
+	for conn := range proc.conns {
+		conns = append(conns, conn)
+	}
+	proc.mu.Unlock()
+
+	go func() {
+		for _, conn := range conns {
+			if notice != nil {
+				go conn.Shutdown(notice)
+			}
+		}
+		for _, conn := range conns {
+			select {
+			case <-conn.Done():
+			case <-ctx.Done():
+				conn.Close()
+				<-conn.Done()
+			}
+		}
+		close(proc.quit)
+	}()
+	return proc.stopped
 }
 
 type config struct {
@@ -144,11 +533,124 @@ func (c *config) HeartBeat() time.Duration {
 	return c.server.HeartBeat
 }
 
-func (c *config) Authenticate(login, passcode string) bool {
+func (c *config) HeartBeatMax() time.Duration {
+	return c.server.HeartBeatMax
+}
+
+func (c *config) HeartBeatGracePeriodMultiplier() float64 {
+	if c.server.HeartBeatGracePeriodMultiplier == 0 {
+		return DefaultHeartBeatGracePeriodMultiplier
+	}
+	return c.server.HeartBeatGracePeriodMultiplier
+}
+
+func (c *config) MaxFrameSize() int {
+	return c.server.MaxFrameSize
+}
+
+func (c *config) MaxHeaders() (count, bytes int) {
+	return c.server.MaxHeaders, c.server.MaxHeaderBytes
+}
+
+func (c *config) MaxSubscriptions() int {
+	return c.server.MaxSubscriptionsPerConn
+}
+
+func (c *config) SendRateLimit() (framesPerSecond, bytesPerSecond float64, reject bool) {
+	limit := c.server.sendRateLimit()
+	return limit.FramesPerSecond, limit.BytesPerSecond, limit.Policy == RateLimitReject
+}
+
+// Authenticate calls the authenticator of the server. A panic in the
+// authenticator is reported as an error, so that it denies access to
+// the client instead of stopping the server.
+func (c *config) Authenticate(f *frame.Frame, state *tls.ConnectionState) (principal Principal, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			principal, err = nil, fmt.Errorf("authenticator panicked: %v", r)
+		}
+	}()
+
+	if c.server.FrameAuthenticator != nil {
+		if authenticator, ok := c.server.FrameAuthenticator.(TLSFrameAuthenticator); ok {
+			principal, err = authenticator.AuthenticateTLS(f, state)
+		} else {
+			principal, err = c.server.FrameAuthenticator.AuthenticateFrame(f)
+		}
+		if err == nil && principal == nil {
+			err = errNoPrincipal
+		}
+		return principal, err
+	}
+
 	if c.server.Authenticator != nil {
-		return c.server.Authenticator.Authenticate(login, passcode)
+		// if either of these fields are absent, pass an empty
+		// string to the authenticator function.
+		login, _ := f.Header.Contains(frame.Login)
+		passcode, _ := f.Header.Contains(frame.Passcode)
+		if !c.server.Authenticator.Authenticate(login, passcode) {
+			return nil, errInvalidLogin
+		}
+		if cert := verifiedCertificate(state); cert != nil {
+			return CertificatePrincipal{Login: login, Certificate: cert}, nil
+		}
+		return loginPrincipal(login), nil
+	}
+
+	// no authentication defined, apart from a client certificate
+	if cert := verifiedCertificate(state); cert != nil {
+		return CertificatePrincipal{Certificate: cert}, nil
 	}
+	return nil, nil
+}
+
+// verifiedCertificate returns the certificate of the client verified
+// by the TLS handshake, or nil if there is none.
+func verifiedCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// CanSend calls the authorizer of the server. A panic in the
+// authorizer denies the operation, in the same way as in Authenticate.
+func (c *config) CanSend(principal Principal, destination string) (ok bool) {
+	if c.server.Authorizer == nil {
+		return true
+	}
+	defer recoverAuthorizer(&ok)
+	return c.server.Authorizer.CanSend(principal, destination)
+}
+
+// CanSubscribe calls the authorizer of the server, in the same way
+// as CanSend.
+func (c *config) CanSubscribe(principal Principal, destination string) (ok bool) {
+	if c.server.Authorizer == nil {
+		return true
+	}
+	defer recoverAuthorizer(&ok)
+	return c.server.Authorizer.CanSubscribe(principal, destination)
+}
+
+func recoverAuthorizer(ok *bool) {
+	if r := recover(); r != nil {
+		log.Println("authorizer panicked:", r)
+		*ok = false
+	}
+}
+
+var (
+	errInvalidLogin = errors.New("invalid login or passcode")
+	errNoPrincipal  = errors.New("authenticator returned no principal")
+
+	errTooManyConnections = errors.New("too many connections")
+)
+
+// The principal of a client authenticated by an Authenticator,
+// named by its login.
+type loginPrincipal string
 
-	// no authentication defined
-	return true
+func (p loginPrincipal) Name() string {
+	return string(p)
 }
@@ -0,0 +1,116 @@
+package queue
+
+import (
+	"container/heap"
+	"strconv"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// Header entries of a message sent to a queue that hold it back for a
+// number of milliseconds before it is enqueued, if delayed delivery is
+// enabled. DelayHeader is used if both are present.
+const (
+	DelayHeader          = "delay-ms"
+	ScheduledDelayHeader = "scheduled-delay"
+)
+
+// A message held back until its release time.
+type delayedFrame struct {
+	destination string
+	frame       *frame.Frame
+	release     time.Time
+	seq         uint64 // keeps the order of messages with the same release time
+}
+
+// Min-heap of the delayed messages, by release time.
+type delayHeap []*delayedFrame
+
+func (h delayHeap) Len() int { return len(h) }
+
+func (h delayHeap) Less(i, j int) bool {
+	if h[i].release.Equal(h[j].release) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].release.Before(h[j].release)
+}
+
+func (h delayHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *delayHeap) Push(x any) { *h = append(*h, x.(*delayedFrame)) }
+
+func (h *delayHeap) Pop() any {
+	old := *h
+	d := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return d
+}
+
+// Holds back the messages sent to the queues with a "delay-ms" or
+// "scheduled-delay" header entry, a positive number of milliseconds,
+// until the delay has passed and Release is called. The messages held
+// back are kept in memory, whatever the storage, so they are lost if
+// the server stops before they are released.
+func (qm *Manager) SetDelayedDelivery(enabled bool) {
+	qm.delays = enabled
+}
+
+// Returns the time at which the next delayed message is to be
+// released, and false if there is none.
+func (qm *Manager) NextRelease() (time.Time, bool) {
+	if len(qm.delayed) == 0 {
+		return time.Time{}, false
+	}
+	return qm.delayed[0].release, true
+}
+
+// Enqueues the delayed messages whose release time is not after the
+// time now, in the order of their release times.
+func (qm *Manager) Release(now time.Time) error {
+	for len(qm.delayed) > 0 && !qm.delayed[0].release.After(now) {
+		d := heap.Pop(&qm.delayed).(*delayedFrame)
+		if err := qm.Find(d.destination).enqueue(d.frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Holds back the message in the frame if delayed delivery is enabled
+// and it has a delay, and reports whether it has.
+func (qm *Manager) delay(destination string, f *frame.Frame) bool {
+	if !qm.delays {
+		return false
+	}
+	delay, ok := frameDelay(f)
+	if !ok {
+		return false
+	}
+	qm.lastSeq++
+	heap.Push(&qm.delayed, &delayedFrame{
+		destination: destination,
+		frame:       f,
+		release:     time.Now().Add(delay),
+		seq:         qm.lastSeq,
+	})
+	return true
+}
+
+// Returns the delay of the message in the frame, and false if it does
+// not have a valid positive delay.
+func frameDelay(f *frame.Frame) (time.Duration, bool) {
+	value, ok := f.Header.Contains(DelayHeader)
+	if !ok {
+		value, ok = f.Header.Contains(ScheduledDelayHeader)
+	}
+	if !ok {
+		return 0, false
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
@@ -0,0 +1,303 @@
+package queue
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// Commands of the records in the log of a FileStorage. The log is a
+// sequence of STOMP frames, one per change to the queues.
+const (
+	enqueueRecord = "ENQUEUE" // destination (the queue), id and content-length, then the header and body of the frame
+	dequeueRecord = "DEQUEUE" // id
+	ackRecord     = "ACK"     // id
+	requeueRecord = "REQUEUE" // id
+	removeRecord  = "REMOVE"  // id
+)
+
+// The number of header entries of an ENQUEUE record that precede
+// the header of the frame.
+const enqueueRecordHeaders = 3
+
+// FileStorage is a persistent implementation of the Storage interface.
+// It keeps the queues in memory, and appends each change to them to a
+// log file, from which they are recovered when the file is opened again.
+// Each change is written to the file before the method that makes it
+// returns, so the frames survive the server process stopping abruptly.
+// The file is not synced to the disk, so they may not survive the
+// operating system stopping.
+type FileStorage struct {
+	mutex    sync.Mutex
+	path     string
+	file     *os.File
+	writer   *frame.Writer
+	lists    map[string]*list.List    // of *entry
+	elements map[string]*list.Element // elements of the lists, by id
+	dequeued map[string]*entry        // frames not yet acknowledged, by id
+	lastId   uint64
+}
+
+// OpenFileStorage opens the log file at path, creating it if it does not
+// exist, and recovers the frames that it records. The frames that were
+// dequeued but not acknowledged are returned to the head of their queues,
+// in the order in which they were enqueued. The file is then rewritten
+// with the frames recovered only, so that it does not grow without limit
+// across restarts of the server. A record that was not completely written
+// when the server stopped is discarded. Any other error reading the file
+// is returned, and the file is left unchanged.
+func OpenFileStorage(path string) (*FileStorage, error) {
+	fs := &FileStorage{
+		path:     path,
+		lists:    make(map[string]*list.List),
+		elements: make(map[string]*list.Element),
+		dequeued: make(map[string]*entry),
+	}
+	if err := fs.recover(); err != nil {
+		return nil, err
+	}
+	if err := fs.compact(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *FileStorage) Enqueue(queue string, f *frame.Frame) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.lastId++
+	e := &entry{id: strconv.FormatUint(fs.lastId, 10), queue: queue, frame: f}
+	if err := fs.writer.Write(newEnqueueRecord(e)); err != nil {
+		return err
+	}
+	fs.elements[e.id] = fs.list(queue).PushBack(e)
+	return nil
+}
+
+func (fs *FileStorage) Dequeue(queue string) (*frame.Frame, string, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	l, ok := fs.lists[queue]
+	if !ok || l.Len() == 0 {
+		return nil, "", nil
+	}
+	e := l.Front().Value.(*entry)
+	if err := fs.writer.Write(frame.New(dequeueRecord, frame.Id, e.id)); err != nil {
+		return nil, "", err
+	}
+	fs.dequeue(e.id)
+	return e.frame, e.id, nil
+}
+
+func (fs *FileStorage) Ack(queue string, id string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if _, ok := fs.dequeued[id]; !ok {
+		return errUnknownId
+	}
+	if err := fs.writer.Write(frame.New(ackRecord, frame.Id, id)); err != nil {
+		return err
+	}
+	delete(fs.dequeued, id)
+	return nil
+}
+
+func (fs *FileStorage) Requeue(queue string, id string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if _, ok := fs.dequeued[id]; !ok {
+		return errUnknownId
+	}
+	if err := fs.writer.Write(frame.New(requeueRecord, frame.Id, id)); err != nil {
+		return err
+	}
+	fs.requeue(id)
+	return nil
+}
+
+func (fs *FileStorage) Remove(queue string, id string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if _, ok := fs.elements[id]; !ok {
+		return errUnknownId
+	}
+	if err := fs.writer.Write(frame.New(removeRecord, frame.Id, id)); err != nil {
+		return err
+	}
+	fs.remove(id)
+	return nil
+}
+
+// Calls fn with each frame in the queues, in the order of
+// the names of the queues.
+func (fs *FileStorage) Range(fn func(queue string, id string, frame *frame.Frame) bool) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	rangeLists(fs.lists, fn)
+	return nil
+}
+
+// Start does nothing, because the frames are recovered by
+// OpenFileStorage.
+func (fs *FileStorage) Start() {
+}
+
+// Stop closes the log file. The storage cannot be used afterwards.
+func (fs *FileStorage) Stop() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.file.Close()
+}
+
+func (fs *FileStorage) list(queue string) *list.List {
+	l, ok := fs.lists[queue]
+	if !ok {
+		l = list.New()
+		fs.lists[queue] = l
+	}
+	return l
+}
+
+func (fs *FileStorage) dequeue(id string) {
+	if element, ok := fs.elements[id]; ok {
+		delete(fs.elements, id)
+		e := element.Value.(*entry)
+		fs.lists[e.queue].Remove(element)
+		fs.dequeued[id] = e
+	}
+}
+
+func (fs *FileStorage) remove(id string) {
+	if element, ok := fs.elements[id]; ok {
+		delete(fs.elements, id)
+		fs.lists[element.Value.(*entry).queue].Remove(element)
+	}
+}
+
+func (fs *FileStorage) requeue(id string) {
+	if e, ok := fs.dequeued[id]; ok {
+		delete(fs.dequeued, id)
+		fs.elements[id] = fs.list(e.queue).PushFront(e)
+	}
+}
+
+// recover reads the log file, and makes the changes that it records.
+func (fs *FileStorage) recover() error {
+	file, err := os.Open(fs.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := frame.NewReader(file, frame.AnyCommand())
+	for {
+		record, err := reader.Read()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the end of the log, or the last record is incomplete
+			break
+		} else if err != nil {
+			return err
+		} else if record == nil {
+			continue
+		}
+
+		id := record.Header.Get(frame.Id)
+		switch record.Command {
+		case enqueueRecord:
+			e := readEnqueueRecord(record)
+			fs.elements[e.id] = fs.list(e.queue).PushBack(e)
+		case dequeueRecord:
+			fs.dequeue(id)
+		case ackRecord:
+			delete(fs.dequeued, id)
+		case requeueRecord:
+			fs.requeue(id)
+		case removeRecord:
+			fs.remove(id)
+		}
+		if n, err := strconv.ParseUint(id, 10, 64); err == nil && n > fs.lastId {
+			fs.lastId = n
+		}
+	}
+
+	// the frames that were not acknowledged are delivered again, in
+	// the order in which they were enqueued, ahead of the others
+	ids := make([]uint64, 0, len(fs.dequeued))
+	for id := range fs.dequeued {
+		n, _ := strconv.ParseUint(id, 10, 64)
+		ids = append(ids, n)
+	}
+	slices.Sort(ids)
+	for i := len(ids) - 1; i >= 0; i-- {
+		fs.requeue(strconv.FormatUint(ids[i], 10))
+	}
+	return nil
+}
+
+// compact rewrites the log file with the frames in the queues, and
+// opens it for appending the changes to them.
+func (fs *FileStorage) compact() error {
+	tmp := fs.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	writer := frame.NewWriter(file)
+	rangeLists(fs.lists, func(queue string, id string, f *frame.Frame) bool {
+		err = writer.WriteBuffered(newEnqueueRecord(&entry{id: id, queue: queue, frame: f}))
+		return err == nil
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fs.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	fs.file, err = os.OpenFile(fs.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	fs.writer = frame.NewWriter(fs.file)
+	return nil
+}
+
+// newEnqueueRecord returns the record of a frame added to a queue.
+func newEnqueueRecord(e *entry) *frame.Frame {
+	record := frame.New(enqueueRecord,
+		frame.Destination, e.queue,
+		frame.Id, e.id,
+		frame.ContentLength, strconv.Itoa(len(e.frame.Body)))
+	record.Header.AddHeader(e.frame.Header)
+	record.Body = e.frame.Body
+	return record
+}
+
+// readEnqueueRecord returns the frame added to a queue by an ENQUEUE
+// record.
+func readEnqueueRecord(record *frame.Frame) *entry {
+	f := frame.New(frame.MESSAGE)
+	for i := enqueueRecordHeaders; i < record.Header.Len(); i++ {
+		f.Header.Add(record.Header.GetAt(i))
+	}
+	f.Body = record.Body
+	return &entry{id: record.Header.Get(frame.Id), queue: record.Header.Get(frame.Destination), frame: f}
+}
@@ -0,0 +1,196 @@
+package queue
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+type FileStorageSuite struct{}
+
+var _ = Suite(&FileStorageSuite{})
+
+type storedFrame struct {
+	queue, id string
+	frame     *frame.Frame
+}
+
+func rangeStorage(c *C, s Storage) []storedFrame {
+	var frames []storedFrame
+	err := s.Range(func(queue string, id string, f *frame.Frame) bool {
+		frames = append(frames, storedFrame{queue, id, f})
+		return true
+	})
+	c.Assert(err, IsNil)
+	return frames
+}
+
+func (s *FileStorageSuite) TestRecover(c *C) {
+	path := filepath.Join(c.MkDir(), "queues.log")
+	fs, err := OpenFileStorage(path)
+	c.Assert(err, IsNil)
+
+	var frames []*frame.Frame
+	for _, body := range []string{"one", "two", "three"} {
+		f := frame.New(frame.MESSAGE,
+			frame.Destination, "/queue/a",
+			"escaped", "a:b\nc\\d",
+			frame.ContentLength, "8")
+		f.Body = []byte(body + "\x00\x00\x00\x00\x00")[:8]
+		frames = append(frames, f)
+		c.Assert(fs.Enqueue("/queue/a", f), IsNil)
+	}
+	other := frame.New(frame.MESSAGE, frame.Destination, "/queue/b")
+	other.Body = []byte("other")
+	c.Assert(fs.Enqueue("/queue/b", other), IsNil)
+
+	f, id1, err := fs.Dequeue("/queue/a")
+	c.Assert(err, IsNil)
+	c.Assert(f, Equals, frames[0])
+	c.Assert(fs.Ack("/queue/a", id1), IsNil)
+	c.Check(fs.Ack("/queue/a", id1), Equals, errUnknownId)
+
+	f, _, err = fs.Dequeue("/queue/a")
+	c.Assert(err, IsNil)
+	c.Assert(f, Equals, frames[1])
+
+	f, id3, err := fs.Dequeue("/queue/a")
+	c.Assert(err, IsNil)
+	c.Assert(f, Equals, frames[2])
+	c.Assert(fs.Requeue("/queue/a", id3), IsNil)
+	c.Check(fs.Requeue("/queue/a", id3), Equals, errUnknownId)
+
+	// the log is recovered without stopping the storage, as if the
+	// server had stopped abruptly: the frame that was not acknowledged
+	// is returned to the head of its queue
+	recovered, err := OpenFileStorage(path)
+	c.Assert(err, IsNil)
+	stored := rangeStorage(c, recovered)
+	c.Assert(stored, HasLen, 3)
+	for i, expected := range []*frame.Frame{frames[1], frames[2], other} {
+		c.Check(stored[i].frame.Command, Equals, frame.MESSAGE)
+		c.Check(stored[i].frame.Header, DeepEquals, expected.Header)
+		c.Check(stored[i].frame.Body, DeepEquals, expected.Body)
+		c.Check(stored[i].queue, Equals, expected.Header.Get(frame.Destination))
+	}
+	c.Check(stored[1].id, Equals, id3)
+
+	// the ids are not reused
+	c.Assert(recovered.Enqueue("/queue/b", frame.New(frame.MESSAGE, frame.Destination, "/queue/b")), IsNil)
+	stored = rangeStorage(c, recovered)
+	c.Check(stored[3].id, Equals, "5")
+
+	// the log has been compacted
+	recovered.Stop()
+	fs.Stop()
+	again, err := OpenFileStorage(path)
+	c.Assert(err, IsNil)
+	defer again.Stop()
+	c.Check(rangeStorage(c, again), HasLen, 4)
+	for _, queue := range []string{"/queue/a", "/queue/a", "/queue/b", "/queue/b"} {
+		f, id, err := again.Dequeue(queue)
+		c.Assert(err, IsNil)
+		c.Assert(f, NotNil)
+		c.Assert(again.Ack(queue, id), IsNil)
+	}
+	f, _, err = again.Dequeue("/queue/a")
+	c.Check(f, IsNil)
+	c.Check(err, IsNil)
+}
+
+func (s *FileStorageSuite) TestIncompleteRecord(c *C) {
+	path := filepath.Join(c.MkDir(), "queues.log")
+	fs, err := OpenFileStorage(path)
+	c.Assert(err, IsNil)
+	c.Assert(fs.Enqueue("/queue/a", frame.New(frame.MESSAGE, frame.Destination, "/queue/a")), IsNil)
+	fs.Stop()
+
+	// the server stopped while writing a record
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	c.Assert(err, IsNil)
+	_, err = file.WriteString("ENQUEUE\ndestination:/queue/a\nid:2\ncontent-length:100\n\nbody")
+	c.Assert(err, IsNil)
+	c.Assert(file.Close(), IsNil)
+
+	fs, err = OpenFileStorage(path)
+	c.Assert(err, IsNil)
+	c.Check(rangeStorage(c, fs), HasLen, 1)
+	c.Assert(fs.Enqueue("/queue/a", frame.New(frame.MESSAGE, frame.Destination, "/queue/a")), IsNil)
+	fs.Stop()
+
+	fs, err = OpenFileStorage(path)
+	c.Assert(err, IsNil)
+	defer fs.Stop()
+	c.Check(rangeStorage(c, fs), HasLen, 2)
+}
+
+func (s *FileStorageSuite) TestCorruptRecord(c *C) {
+	path := filepath.Join(c.MkDir(), "queues.log")
+	fs, err := OpenFileStorage(path)
+	c.Assert(err, IsNil)
+	c.Assert(fs.Enqueue("/queue/a", frame.New(frame.MESSAGE, frame.Destination, "/queue/a")), IsNil)
+	fs.Stop()
+
+	// a record that is complete but cannot be read is not discarded
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	c.Assert(err, IsNil)
+	_, err = file.WriteString("DEQUEUE\nno colon\n\n\x00")
+	c.Assert(err, IsNil)
+	c.Assert(file.Close(), IsNil)
+	log, err := os.ReadFile(path)
+	c.Assert(err, IsNil)
+
+	_, err = OpenFileStorage(path)
+	c.Check(err, NotNil)
+	unchanged, err := os.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Check(unchanged, DeepEquals, log)
+}
+
+func (s *FileStorageSuite) TestMemoryAckAndRequeue(c *C) {
+	mq := NewMemoryQueueStorage()
+	f1 := frame.New(frame.MESSAGE, frame.Destination, "/queue/a")
+	f2 := frame.New(frame.MESSAGE, frame.Destination, "/queue/a")
+	c.Assert(mq.Enqueue("/queue/a", f1), IsNil)
+	c.Assert(mq.Enqueue("/queue/a", f2), IsNil)
+
+	f, id, err := mq.Dequeue("/queue/a")
+	c.Assert(err, IsNil)
+	c.Assert(f, Equals, f1)
+	c.Assert(mq.Requeue("/queue/a", id), IsNil)
+	c.Check(mq.Requeue("/queue/a", id), Equals, errUnknownId)
+	c.Check(rangeStorage(c, mq), DeepEquals, []storedFrame{{"/queue/a", id, f1}, {"/queue/a", "2", f2}})
+
+	f, id, err = mq.Dequeue("/queue/a")
+	c.Assert(err, IsNil)
+	c.Assert(f, Equals, f1)
+	c.Assert(mq.Ack("/queue/a", id), IsNil)
+	c.Check(mq.Ack("/queue/a", id), Equals, errUnknownId)
+	c.Check(rangeStorage(c, mq), DeepEquals, []storedFrame{{"/queue/a", "2", f2}})
+}
+
+func (s *FileStorageSuite) TestRemove(c *C) {
+	path := filepath.Join(c.MkDir(), "queues.log")
+	fs, err := OpenFileStorage(path)
+	c.Assert(err, IsNil)
+
+	for _, body := range []string{"one", "two"} {
+		f := frame.New(frame.MESSAGE, frame.Destination, "/queue/a")
+		f.Body = []byte(body)
+		c.Assert(fs.Enqueue("/queue/a", f), IsNil)
+	}
+	c.Assert(fs.Remove("/queue/a", "1"), IsNil)
+	c.Check(fs.Remove("/queue/a", "1"), Equals, errUnknownId)
+
+	// the frame removed is not recovered
+	fs.Stop()
+	recovered, err := OpenFileStorage(path)
+	c.Assert(err, IsNil)
+	defer recovered.Stop()
+	stored := rangeStorage(c, recovered)
+	c.Assert(stored, HasLen, 1)
+	c.Check(stored[0].id, Equals, "2")
+	c.Check(string(stored[0].frame.Body), Equals, "two")
+}
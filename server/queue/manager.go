@@ -1,14 +1,57 @@
 package queue
 
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// Header entries of a message moved to a dead-letter queue.
+const (
+	OriginalDestination = "original-destination" // destination that the message was sent to
+	RedeliveryCount     = "redelivery-count"     // times that the message was redelivered after a NACK
+	LastError           = "last-error"           // "message" header entry of the last NACK frame
+)
+
+// Default destination of the dead-letter queue of the messages that
+// have been redelivered too many times, in which "{destination}" is
+// replaced by the destination of the message.
+const DefaultDeadLetterPattern = "{destination}.DLQ"
+
+// The "requeue" header entry of a NACK frame, which moves the message
+// to the dead-letter queue at once if it is "false".
+const requeueHeader = "requeue"
+
 // Queue manager.
 type Manager struct {
-	qstore Storage // handles queue storage
-	queues map[string]*Queue
+	qstore            Storage      // handles queue storage
+	mu                sync.RWMutex // protects queues from Depths, which may be called from another go-routine
+	queues            map[string]*Queue
+	recovered         map[string]int // messages in the queues not yet found, when the manager was created
+	enqueued          atomic.Uint64
+	dequeued          atomic.Uint64
+	deadLetterSuffix  string                                      // empty if expired messages are discarded
+	onExpire          func(destination string, deadLettered bool) // nil if not notified
+	maxRedeliveries   func(destination string) int                // nil if there is no maximum
+	deadLetterPattern string
+	delays            bool      // messages with a delay are held back
+	delayed           delayHeap // messages held back, by release time
+	lastSeq           uint64
 }
 
 // Create a queue manager with the specified queue storage mechanism
 func NewManager(qstore Storage) *Manager {
-	qm := &Manager{qstore: qstore, queues: make(map[string]*Queue)}
+	qm := &Manager{qstore: qstore, queues: make(map[string]*Queue), recovered: make(map[string]int), deadLetterPattern: DefaultDeadLetterPattern}
+	// count the messages recovered by a persistent storage, so that
+	// the depths of their queues are known
+	qstore.Range(func(queue string, id string, f *frame.Frame) bool {
+		qm.recovered[queue]++
+		return true
+	})
 	return qm
 }
 
@@ -16,8 +59,157 @@ func NewManager(qstore Storage) *Manager {
 func (qm *Manager) Find(destination string) *Queue {
 	q, ok := qm.queues[destination]
 	if !ok {
-		q = newQueue(destination, qm.qstore)
+		q = newQueue(destination, qm)
+		q.depth.Store(int64(qm.recovered[destination]))
+		delete(qm.recovered, destination)
+		qm.mu.Lock()
 		qm.queues[destination] = q
+		qm.mu.Unlock()
 	}
 	return q
 }
+
+// Returns the number of messages waiting to be delivered in each
+// queue, by destination. Unlike the other methods, it may be called
+// from any go-routine.
+func (qm *Manager) Depths() map[string]int {
+	qm.mu.RLock()
+	defer qm.mu.RUnlock()
+	depths := make(map[string]int, len(qm.queues))
+	for destination, q := range qm.queues {
+		depths[destination] = q.Depth()
+	}
+	return depths
+}
+
+// Returns the number of messages enqueued to the queues, including
+// those moved to dead-letter queues. It may be called from any
+// go-routine.
+func (qm *Manager) Enqueued() uint64 {
+	return qm.enqueued.Load()
+}
+
+// Returns the number of times that messages have been dequeued and
+// delivered to subscriptions, including redeliveries. It may be
+// called from any go-routine.
+func (qm *Manager) Dequeued() uint64 {
+	return qm.dequeued.Load()
+}
+
+// Moves the messages that expire to the queue whose destination is
+// that of the message followed by suffix, instead of discarding them.
+// A message expires if the time in its "expires" header, in
+// milliseconds since the Unix epoch, has passed before it is
+// delivered. The message moved does not expire again.
+func (qm *Manager) SetDeadLetterSuffix(suffix string) {
+	qm.deadLetterSuffix = suffix
+}
+
+// Calls fn for each message that expires, with the destination that
+// it was sent to, and whether it was moved to a dead-letter queue.
+func (qm *Manager) OnExpire(fn func(destination string, deadLettered bool)) {
+	qm.onExpire = fn
+}
+
+// Limits the number of times that a message negatively acknowledged
+// is redelivered to the value returned by fn for the destination of
+// its queue, after which it is moved to the dead-letter queue. If fn
+// returns zero, there is no limit.
+func (qm *Manager) SetMaxRedeliveries(fn func(destination string) int) {
+	qm.maxRedeliveries = fn
+}
+
+// Sets the destination of the dead-letter queue of the messages that
+// have been redelivered too many times, in which "{destination}" is
+// replaced by the destination of the message.
+func (qm *Manager) SetDeadLetterPattern(pattern string) {
+	qm.deadLetterPattern = pattern
+}
+
+// Sweep removes the messages that have expired at the time now from
+// the queues, so that the queues without subscriptions do not grow
+// forever. The messages that expire are also removed when they are
+// dequeued.
+func (qm *Manager) Sweep(now time.Time) error {
+	var expired []*entry
+	err := qm.qstore.Range(func(queue string, id string, f *frame.Frame) bool {
+		if isExpired(f, now) {
+			expired = append(expired, &entry{id: id, queue: queue, frame: f})
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range expired {
+		if err := qm.expire(e, qm.remove); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expire moves a message that has expired to its dead-letter queue,
+// if there is one, and then calls discard to discard it from its queue.
+func (qm *Manager) expire(e *entry, discard func(queue string, id string) error) error {
+	deadLettered := qm.deadLetterSuffix != ""
+	if deadLettered {
+		if err := qm.deadLetter(e, e.queue+qm.deadLetterSuffix); err != nil {
+			return err
+		}
+	}
+	if err := discard(e.queue, e.id); err != nil {
+		return err
+	}
+	if q, ok := qm.queues[e.queue]; ok {
+		delete(q.redeliveries, e.id)
+	}
+	if qm.onExpire != nil {
+		qm.onExpire(e.queue, deadLettered)
+	}
+	return nil
+}
+
+// remove removes a message that has not been dequeued from its queue.
+func (qm *Manager) remove(queue string, id string) error {
+	if err := qm.qstore.Remove(queue, id); err != nil {
+		return err
+	}
+	qm.Find(queue).depth.Add(-1)
+	return nil
+}
+
+// deadLetter enqueues a copy of the message in the entry to the queue
+// with the destination specified, without the header entries that
+// describe its delivery, and with the header entries in headers, a
+// list of names and values, added.
+func (qm *Manager) deadLetter(e *entry, destination string, headers ...string) error {
+	f := e.frame.Clone()
+	f.Header.Set(frame.Destination, destination)
+	f.Header.Set(OriginalDestination, e.queue)
+	f.Header.Del(frame.Expires)
+	f.Header.Del(frame.Subscription)
+	f.Header.Del(frame.MessageId)
+	f.Header.Del(frame.Ack)
+	f.Header.Del(frame.Redelivered)
+	f.Header.Del(DelayHeader)
+	f.Header.Del(ScheduledDelayHeader)
+	for i := 0; i+1 < len(headers); i += 2 {
+		f.Header.Set(headers[i], headers[i+1])
+	}
+	return qm.Find(destination).Enqueue(f)
+}
+
+// deadLetterDestination returns the destination of the dead-letter
+// queue of the messages redelivered too many times from the queue.
+func (qm *Manager) deadLetterDestination(queue string) string {
+	return strings.ReplaceAll(qm.deadLetterPattern, "{destination}", queue)
+}
+
+// isExpired reports whether the message in the frame has expired at
+// the time now. A message without a valid "expires" header, or whose
+// "expires" header is zero, does not expire.
+func isExpired(f *frame.Frame, now time.Time) bool {
+	expires, err := strconv.ParseInt(f.Header.Get(frame.Expires), 10, 64)
+	return err == nil && expires > 0 && now.UnixMilli() >= expires
+}
@@ -1,6 +1,11 @@
 package queue
 
 import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
 	. "gopkg.in/check.v1"
 )
 
@@ -19,3 +24,141 @@ func (s *ManagerSuite) TestManager(c *C) {
 
 	c.Assert(mgr.Find("/queue/1"), Equals, q1)
 }
+
+func (s *ManagerSuite) TestSweep(c *C) {
+	qs := NewMemoryQueueStorage()
+	mgr := NewManager(qs)
+	var expired []string
+	mgr.OnExpire(func(destination string, deadLettered bool) {
+		expired = append(expired, fmt.Sprintf("%s %v", destination, deadLettered))
+	})
+
+	now := time.Now()
+	enqueue := func(destination string, expires time.Time) *frame.Frame {
+		f := frame.New(frame.MESSAGE, frame.Destination, destination)
+		if !expires.IsZero() {
+			f.Header.Set(frame.Expires, strconv.FormatInt(expires.UnixMilli(), 10))
+		}
+		c.Assert(mgr.Find(destination).Enqueue(f), IsNil)
+		return f
+	}
+	enqueue("/queue/a", now.Add(-time.Second))
+	f2 := enqueue("/queue/a", time.Time{})
+	f3 := enqueue("/queue/a", now.Add(time.Minute))
+	enqueue("/queue/b", now)
+
+	c.Assert(mgr.Sweep(now), IsNil)
+	c.Check(expired, DeepEquals, []string{"/queue/a false", "/queue/b false"})
+	c.Check(rangeStorage(c, qs), DeepEquals, []storedFrame{{"/queue/a", "2", f2}, {"/queue/a", "3", f3}})
+
+	// the expired messages are moved to dead-letter queues
+	mgr.SetDeadLetterSuffix(".DLQ")
+	expired = nil
+	c.Assert(mgr.Sweep(now.Add(time.Hour)), IsNil)
+	c.Check(expired, DeepEquals, []string{"/queue/a true"})
+	stored := rangeStorage(c, qs)
+	c.Assert(stored, HasLen, 2)
+	c.Check(stored[0].frame, Equals, f2)
+	c.Check(stored[1].queue, Equals, "/queue/a.DLQ")
+	c.Check(stored[1].frame.Header.Get(frame.Destination), Equals, "/queue/a.DLQ")
+	c.Check(stored[1].frame.Header.Get(OriginalDestination), Equals, "/queue/a")
+	_, ok := stored[1].frame.Header.Contains(frame.Expires)
+	c.Check(ok, Equals, false)
+
+	// the messages moved do not expire again
+	expired = nil
+	c.Assert(mgr.Sweep(now.Add(time.Hour)), IsNil)
+	c.Check(expired, IsNil)
+}
+
+func (s *ManagerSuite) TestDepths(c *C) {
+	qs := NewMemoryQueueStorage()
+	mgr := NewManager(qs)
+	q := mgr.Find("/queue/a")
+	for i := 0; i < 3; i++ {
+		c.Assert(q.Enqueue(frame.New(frame.MESSAGE, frame.Destination, "/queue/a")), IsNil)
+	}
+	c.Assert(mgr.Find("/queue/b").Enqueue(frame.New(frame.MESSAGE, frame.Destination, "/queue/b")), IsNil)
+	c.Check(mgr.Depths(), DeepEquals, map[string]int{"/queue/a": 3, "/queue/b": 1})
+	c.Check(mgr.Enqueued(), Equals, uint64(4))
+
+	// a message removed by a sweep is no longer waiting
+	past := strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10)
+	c.Assert(q.Enqueue(frame.New(frame.MESSAGE, frame.Destination, "/queue/a", frame.Expires, past)), IsNil)
+	c.Check(q.Depth(), Equals, 4)
+	c.Assert(mgr.Sweep(time.Now()), IsNil)
+	c.Check(q.Depth(), Equals, 3)
+
+	// the depths of the queues recovered from the storage are known
+	mgr = NewManager(qs)
+	c.Check(mgr.Depths(), DeepEquals, map[string]int{})
+	c.Check(mgr.Find("/queue/a").Depth(), Equals, 3)
+	c.Check(mgr.Find("/queue/b").Depth(), Equals, 1)
+}
+
+func (s *ManagerSuite) TestBrowse(c *C) {
+	mgr := NewManager(NewMemoryQueueStorage())
+	q := mgr.Find("/queue/a")
+	past := strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10)
+	c.Assert(q.Enqueue(frame.New(frame.MESSAGE, frame.Destination, "/queue/a", frame.MessageId, "1")), IsNil)
+	c.Assert(mgr.Find("/queue/b").Enqueue(frame.New(frame.MESSAGE, frame.Destination, "/queue/b")), IsNil)
+	c.Assert(q.Enqueue(frame.New(frame.MESSAGE, frame.Destination, "/queue/a", frame.Expires, past)), IsNil)
+	c.Assert(q.Enqueue(frame.New(frame.MESSAGE, frame.Destination, "/queue/a", frame.MessageId, "2")), IsNil)
+
+	frames, err := q.Browse()
+	c.Assert(err, IsNil)
+	c.Assert(frames, HasLen, 2)
+	c.Check(frames[0].Header.Get(frame.MessageId), Equals, "1")
+	c.Check(frames[1].Header.Get(frame.MessageId), Equals, "2")
+
+	// the frames browsed are copies, and remain in the queue
+	frames[0].Header.Set(frame.MessageId, "changed")
+	c.Assert(q.Enqueue(frame.New(frame.MESSAGE, frame.Destination, "/queue/a", frame.MessageId, "3")), IsNil)
+	c.Check(frames, HasLen, 2)
+	c.Check(q.Depth(), Equals, 4)
+	f, _, err := q.dequeue()
+	c.Assert(err, IsNil)
+	c.Check(f.Header.Get(frame.MessageId), Equals, "1")
+}
+
+func (s *ManagerSuite) TestDelay(c *C) {
+	qs := NewMemoryQueueStorage()
+	mgr := NewManager(qs)
+	q := mgr.Find("/queue/a")
+
+	enqueue := func(headers ...string) *frame.Frame {
+		f := frame.New(frame.MESSAGE, append([]string{frame.Destination, "/queue/a"}, headers...)...)
+		c.Assert(q.Enqueue(f), IsNil)
+		return f
+	}
+
+	// the delays are ignored unless delayed delivery is enabled
+	f1 := enqueue(DelayHeader, "1000")
+	_, ok := mgr.NextRelease()
+	c.Check(ok, Equals, false)
+
+	mgr.SetDelayedDelivery(true)
+	start := time.Now()
+	f2 := enqueue(DelayHeader, "2000")
+	f3 := enqueue(ScheduledDelayHeader, "1000")
+	f4 := enqueue(DelayHeader, "invalid")
+	f5 := enqueue(DelayHeader, "1000", ScheduledDelayHeader, "3000")
+	c.Check(rangeStorage(c, qs), DeepEquals, []storedFrame{{"/queue/a", "1", f1}, {"/queue/a", "2", f4}})
+	c.Check(q.Depth(), Equals, 2)
+
+	next, ok := mgr.NextRelease()
+	c.Assert(ok, Equals, true)
+	c.Check(next.Sub(start) >= time.Second, Equals, true)
+	c.Check(next.Sub(start) < 1100*time.Millisecond, Equals, true)
+
+	// the messages are released in the order of their release times
+	c.Assert(mgr.Release(start), IsNil)
+	c.Check(q.Depth(), Equals, 2)
+	c.Assert(mgr.Release(start.Add(1500*time.Millisecond)), IsNil)
+	c.Check(rangeStorage(c, qs), DeepEquals, []storedFrame{{"/queue/a", "1", f1}, {"/queue/a", "2", f4}, {"/queue/a", "3", f3}, {"/queue/a", "4", f5}})
+	c.Assert(mgr.Release(start.Add(time.Hour)), IsNil)
+	c.Check(q.Depth(), Equals, 5)
+	c.Check(rangeStorage(c, qs)[4], DeepEquals, storedFrame{"/queue/a", "5", f2})
+	_, ok = mgr.NextRelease()
+	c.Check(ok, Equals, false)
+}
@@ -2,69 +2,193 @@ package queue
 
 import (
 	"container/list"
+	"sort"
+	"strconv"
 
 	"github.com/go-stomp/stomp/frame"
 )
 
 // In-memory implementation of the QueueStorage interface.
 type MemoryQueueStorage struct {
-	lists map[string]*list.List
+	lists    map[string]*list.List    // of *entry
+	elements map[string]*list.Element // elements of the lists, by id
+	dequeued map[string]*entry        // frames not yet acknowledged, by id
+	lastId   uint64
+	priority bool // frames are dequeued by priority
 }
 
+// A frame in a queue, with its id.
+type entry struct {
+	id       string
+	queue    string
+	frame    *frame.Frame
+	priority int // used by priority storage only
+}
+
+// Priority of the frames without a valid "priority" header entry, in
+// the storage returned by NewPriorityMemoryQueueStorage.
+const DefaultPriority = 4
+
 func NewMemoryQueueStorage() Storage {
-	m := &MemoryQueueStorage{lists: make(map[string]*list.List)}
+	m := &MemoryQueueStorage{
+		lists:    make(map[string]*list.List),
+		elements: make(map[string]*list.Element),
+		dequeued: make(map[string]*entry),
+	}
+	return m
+}
+
+// Creates an in-memory storage that dequeues the frames of a queue by
+// their "priority" header entry, from 9, the highest, to 0, the
+// lowest, and the frames with the same priority in the order in which
+// they were enqueued. A frame that is requeued is dequeued before the
+// others with its priority.
+func NewPriorityMemoryQueueStorage() Storage {
+	m := NewMemoryQueueStorage().(*MemoryQueueStorage)
+	m.priority = true
 	return m
 }
 
 func (m *MemoryQueueStorage) Enqueue(queue string, frame *frame.Frame) error {
-	l, ok := m.lists[queue]
-	if !ok {
-		l = list.New()
-		m.lists[queue] = l
+	m.lastId++
+	e := &entry{id: strconv.FormatUint(m.lastId, 10), queue: queue, frame: frame}
+	l := m.list(queue)
+	if !m.priority {
+		m.elements[e.id] = l.PushBack(e)
+		return nil
+	}
+	// after the frames with the same or a higher priority
+	e.priority = framePriority(frame)
+	element := l.Back()
+	for element != nil && element.Value.(*entry).priority < e.priority {
+		element = element.Prev()
+	}
+	if element == nil {
+		m.elements[e.id] = l.PushFront(e)
+	} else {
+		m.elements[e.id] = l.InsertAfter(e, element)
 	}
-	l.PushBack(frame)
-
 	return nil
 }
 
-// Pushes a frame to the head of the queue. Sets
-// the "message-id" header of the frame if it is not
-// already set.
-func (m *MemoryQueueStorage) Requeue(queue string, frame *frame.Frame) error {
-	l, ok := m.lists[queue]
+// Pushes a frame that has been dequeued back to the head
+// of the queue.
+func (m *MemoryQueueStorage) Requeue(queue string, id string) error {
+	e, ok := m.dequeued[id]
 	if !ok {
-		l = list.New()
-		m.lists[queue] = l
+		return errUnknownId
+	}
+	delete(m.dequeued, id)
+	l := m.list(queue)
+	if !m.priority {
+		m.elements[id] = l.PushFront(e)
+		return nil
+	}
+	// before the frames with the same or a lower priority
+	element := l.Front()
+	for element != nil && element.Value.(*entry).priority > e.priority {
+		element = element.Next()
+	}
+	if element == nil {
+		m.elements[id] = l.PushBack(e)
+	} else {
+		m.elements[id] = l.InsertBefore(e, element)
 	}
-	l.PushFront(frame)
-
 	return nil
 }
 
 // Removes a frame from the head of the queue.
 // Returns nil if no frame is available.
-func (m *MemoryQueueStorage) Dequeue(queue string) (*frame.Frame, error) {
+func (m *MemoryQueueStorage) Dequeue(queue string) (*frame.Frame, string, error) {
 	l, ok := m.lists[queue]
 	if !ok {
-		return nil, nil
+		return nil, "", nil
 	}
-
 	element := l.Front()
 	if element == nil {
-		return nil, nil
+		return nil, "", nil
 	}
+	e := l.Remove(element).(*entry)
+	delete(m.elements, e.id)
+	m.dequeued[e.id] = e
+	return e.frame, e.id, nil
+}
 
-	return l.Remove(element).(*frame.Frame), nil
+// Discards a frame that has been dequeued.
+func (m *MemoryQueueStorage) Ack(queue string, id string) error {
+	if _, ok := m.dequeued[id]; !ok {
+		return errUnknownId
+	}
+	delete(m.dequeued, id)
+	return nil
+}
+
+// Removes a frame that has not been dequeued.
+func (m *MemoryQueueStorage) Remove(queue string, id string) error {
+	element, ok := m.elements[id]
+	if !ok {
+		return errUnknownId
+	}
+	delete(m.elements, id)
+	m.lists[element.Value.(*entry).queue].Remove(element)
+	return nil
+}
+
+// Calls fn with each frame in the queues, in the order of
+// the names of the queues.
+func (m *MemoryQueueStorage) Range(fn func(queue string, id string, frame *frame.Frame) bool) error {
+	rangeLists(m.lists, fn)
+	return nil
 }
 
 // Called at server startup. Allows the queue storage
 // to perform any initialization.
 func (m *MemoryQueueStorage) Start() {
 	m.lists = make(map[string]*list.List)
+	m.elements = make(map[string]*list.Element)
+	m.dequeued = make(map[string]*entry)
 }
 
 // Called prior to server shutdown. Allows the queue storage
 // to perform any cleanup.
 func (m *MemoryQueueStorage) Stop() {
 	m.lists = nil
+	m.elements = nil
+	m.dequeued = nil
+}
+
+// Returns the priority of the frame, from 0 to 9.
+func framePriority(f *frame.Frame) int {
+	priority, err := strconv.Atoi(f.Header.Get(frame.Priority))
+	if err != nil || priority < 0 || priority > 9 {
+		return DefaultPriority
+	}
+	return priority
+}
+
+func (m *MemoryQueueStorage) list(queue string) *list.List {
+	l, ok := m.lists[queue]
+	if !ok {
+		l = list.New()
+		m.lists[queue] = l
+	}
+	return l
+}
+
+// Calls fn with each entry in the lists, in the order of the
+// names of the queues, until fn returns false.
+func rangeLists(lists map[string]*list.List, fn func(queue string, id string, frame *frame.Frame) bool) {
+	queues := make([]string, 0, len(lists))
+	for queue := range lists {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	for _, queue := range queues {
+		for element := lists[queue].Front(); element != nil; element = element.Next() {
+			e := element.Value.(*entry)
+			if !fn(queue, e.id, e.frame) {
+				return
+			}
+		}
+	}
 }
@@ -38,27 +38,69 @@ func (s *MemoryQueueSuite) Test1(c *C) {
 	c.Assert(err, IsNil)
 
 	// attempt to dequeue from a different queue
-	f, err := mq.Dequeue("/queue/other-queue")
+	f, _, err := mq.Dequeue("/queue/other-queue")
 	c.Check(err, IsNil)
 	c.Assert(f, IsNil)
 
-	f, err = mq.Dequeue("/queue/test2")
+	f, _, err = mq.Dequeue("/queue/test2")
 	c.Check(err, IsNil)
 	c.Assert(f, Equals, f3)
 
-	f, err = mq.Dequeue("/queue/test")
+	f, _, err = mq.Dequeue("/queue/test")
 	c.Check(err, IsNil)
 	c.Assert(f, Equals, f1)
 
-	f, err = mq.Dequeue("/queue/test")
+	f, _, err = mq.Dequeue("/queue/test")
 	c.Check(err, IsNil)
 	c.Assert(f, Equals, f2)
 
-	f, err = mq.Dequeue("/queue/test")
+	f, _, err = mq.Dequeue("/queue/test")
 	c.Check(err, IsNil)
 	c.Assert(f, IsNil)
 
-	f, err = mq.Dequeue("/queue/test2")
+	f, _, err = mq.Dequeue("/queue/test2")
 	c.Check(err, IsNil)
 	c.Assert(f, IsNil)
 }
+
+func (s *MemoryQueueSuite) TestPriority(c *C) {
+	mq := NewPriorityMemoryQueueStorage()
+	mq.Start()
+
+	enqueue := func(priority string) *frame.Frame {
+		f := frame.New(frame.MESSAGE, frame.Destination, "/queue/test")
+		if priority != "" {
+			f.Header.Set(frame.Priority, priority)
+		}
+		c.Assert(mq.Enqueue("/queue/test", f), IsNil)
+		return f
+	}
+	f1 := enqueue("1")
+	f2 := enqueue("9")
+	f3 := enqueue("")
+	f4 := enqueue("9")
+	f5 := enqueue("invalid")
+	f6 := enqueue("0")
+
+	dequeue := func() (*frame.Frame, string) {
+		f, id, err := mq.Dequeue("/queue/test")
+		c.Assert(err, IsNil)
+		return f, id
+	}
+	f, _ := dequeue()
+	c.Check(f, Equals, f2)
+	f, id := dequeue()
+	c.Check(f, Equals, f4)
+
+	// a frame requeued is dequeued before the others with its priority
+	c.Assert(mq.Requeue("/queue/test", id), IsNil)
+	f, _ = dequeue()
+	c.Check(f, Equals, f4)
+	f, id = dequeue()
+	c.Check(f, Equals, f3)
+	c.Assert(mq.Requeue("/queue/test", id), IsNil)
+	for _, expected := range []*frame.Frame{f3, f5, f1, f6, nil} {
+		f, _ = dequeue()
+		c.Check(f, Equals, expected)
+	}
+}
@@ -4,23 +4,34 @@ Package queue provides implementations of server-side queues.
 package queue
 
 import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
 	"github.com/go-stomp/stomp/frame"
 	"github.com/go-stomp/stomp/server/client"
 )
 
 // Queue for storing message frames.
 type Queue struct {
-	destination string
-	qstore      Storage
-	subs        *client.SubscriptionList
+	destination  string
+	qm           *Manager
+	qstore       Storage
+	subs         *client.SubscriptionList
+	dequeued     map[*frame.Frame]string // ids of the frames sent to subscriptions
+	redeliveries map[string]int          // times that the frames with the ids were redelivered after a NACK
+	depth        atomic.Int64            // frames waiting to be dequeued
 }
 
 // Create a new queue -- called from the queue manager only.
-func newQueue(destination string, qstore Storage) *Queue {
+func newQueue(destination string, qm *Manager) *Queue {
 	return &Queue{
-		destination: destination,
-		qstore:      qstore,
-		subs:        client.NewSubscriptionList(),
+		destination:  destination,
+		qm:           qm,
+		qstore:       qm.qstore,
+		subs:         client.NewSubscriptionList(),
+		dequeued:     make(map[*frame.Frame]string),
+		redeliveries: make(map[string]int),
 	}
 }
 
@@ -30,7 +41,7 @@ func newQueue(destination string, qstore Storage) *Queue {
 // has been received by the client.
 func (q *Queue) Subscribe(sub *client.Subscription) error {
 	// see if there is a frame available for this subscription
-	f, err := q.qstore.Dequeue(sub.Destination())
+	f, id, err := q.dequeue()
 	if err != nil {
 		return err
 	}
@@ -40,6 +51,8 @@ func (q *Queue) Subscribe(sub *client.Subscription) error {
 	} else {
 		// a frame is available, so send straight away without
 		// adding the subscription to the list
+		q.dequeued[f] = id
+		q.qm.dequeued.Add(1)
 		sub.SendQueueFrame(f)
 	}
 	return nil
@@ -50,37 +63,164 @@ func (q *Queue) Unsubscribe(sub *client.Subscription) {
 	q.subs.Remove(sub)
 }
 
-// Send a message to the queue. If a subscription is available
-// to receive the message, it is sent to the subscription without
-// making it to the queue. Otherwise, the message is queued until
-// a message is available.
+// Returns copies of the messages waiting in the queue, in the order
+// in which they will be delivered, without removing them. The copies
+// are taken at once, so later changes to the queue are not seen. The
+// messages that have expired, and those delivered to clients that
+// have not acknowledged them, are not included.
+func (q *Queue) Browse() ([]*frame.Frame, error) {
+	var frames []*frame.Frame
+	now := time.Now()
+	err := q.qstore.Range(func(queue string, id string, f *frame.Frame) bool {
+		if queue == q.destination && !isExpired(f, now) {
+			frames = append(frames, f.Clone())
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return frames, nil
+}
+
+// Send a message to the queue. The message is stored, so that it
+// is not lost if the server stops before the message is
+// acknowledged. If a subscription is available to receive the
+// message, it is sent to the subscription. Otherwise, the message
+// is queued until a subscription is available. If delayed delivery
+// is enabled, a message with a delay is held back by the manager,
+// and it is enqueued once it is released.
 func (q *Queue) Enqueue(f *frame.Frame) error {
-	// find a subscription ready to receive the frame
-	sub := q.subs.Get()
-	if sub == nil {
-		// no subscription available, add to the queue
-		return q.qstore.Enqueue(q.destination, f)
-	} else {
-		// subscription is available, send it now without adding to queue
-		sub.SendQueueFrame(f)
+	if q.qm.delay(q.destination, f) {
+		return nil
 	}
-	return nil
+	return q.enqueue(f)
 }
 
-// Send a message to the front of the queue, probably because it
-// failed to be sent to a client. If a subscription is available
-// to receive the message, it is sent to the subscription without
-// making it to the queue. Otherwise, the message is queued until
-// a message is available.
+// Stores a message and delivers it, as Enqueue does, without a delay.
+func (q *Queue) enqueue(f *frame.Frame) error {
+	if err := q.qstore.Enqueue(q.destination, f); err != nil {
+		return err
+	}
+	q.depth.Add(1)
+	q.qm.enqueued.Add(1)
+	return q.deliver()
+}
+
+// Send a message that has been sent to a subscription back to the
+// front of the queue, probably because it failed to be sent to a
+// client, with the "redelivered:true" header entry. If a subscription is available to receive the message,
+// it is sent to the subscription. Otherwise, the message is queued
+// until a subscription is available.
 func (q *Queue) Requeue(f *frame.Frame) error {
+	id, ok := q.dequeued[f]
+	if !ok {
+		return errUnknownId
+	}
+	delete(q.dequeued, f)
+	// the client may have received the message
+	f.Header.Set(frame.Redelivered, "true")
+	if err := q.qstore.Requeue(q.destination, id); err != nil {
+		return err
+	}
+	q.depth.Add(1)
+	return q.deliver()
+}
+
+// Discard a message that has been sent to a subscription, because
+// the client has acknowledged it.
+func (q *Queue) Ack(f *frame.Frame) error {
+	id, ok := q.dequeued[f]
+	if !ok {
+		return errUnknownId
+	}
+	delete(q.dequeued, f)
+	delete(q.redeliveries, id)
+	return q.qstore.Ack(q.destination, id)
+}
+
+// Send a message that has been sent to a subscription back to the
+// front of the queue, as Requeue does, because the client has
+// negatively acknowledged it in the NACK frame nack. If the message
+// has already been redelivered the maximum number of times, or if
+// nack has the "requeue:false" header entry, the message is moved to
+// the dead-letter queue instead.
+func (q *Queue) Nack(f *frame.Frame, nack *frame.Frame) error {
+	id, ok := q.dequeued[f]
+	if !ok {
+		return errUnknownId
+	}
+	redeliveries := q.redeliveries[id]
+	if nack.Header.Get(requeueHeader) != "false" && !q.redeliveredTooOften(redeliveries) {
+		q.redeliveries[id] = redeliveries + 1
+		return q.Requeue(f)
+	}
+
+	headers := []string{RedeliveryCount, strconv.Itoa(redeliveries)}
+	if message, ok := nack.Header.Contains(frame.Message); ok {
+		headers = append(headers, LastError, message)
+	}
+	e := &entry{id: id, queue: q.destination, frame: f}
+	if err := q.qm.deadLetter(e, q.qm.deadLetterDestination(q.destination), headers...); err != nil {
+		return err
+	}
+	return q.Ack(f)
+}
+
+// redeliveredTooOften reports whether a message that has been
+// redelivered the number of times specified must not be redelivered
+// again.
+func (q *Queue) redeliveredTooOften(redeliveries int) bool {
+	if q.qm.maxRedeliveries == nil {
+		return false
+	}
+	limit := q.qm.maxRedeliveries(q.destination)
+	return limit > 0 && redeliveries >= limit
+}
+
+// Send the message at the front of the queue to a subscription,
+// if one is available to receive it.
+func (q *Queue) deliver() error {
 	// find a subscription ready to receive the frame
 	sub := q.subs.Get()
 	if sub == nil {
-		// no subscription available, add to the queue
-		return q.qstore.Requeue(q.destination, f)
-	} else {
-		// subscription is available, send it now without adding to queue
-		sub.SendQueueFrame(f)
+		return nil
+	}
+	f, id, err := q.dequeue()
+	if err != nil || f == nil {
+		// put the subscription back, it is still ready
+		q.subs.Add(sub)
+		return err
 	}
+	q.dequeued[f] = id
+	q.qm.dequeued.Add(1)
+	sub.SendQueueFrame(f)
 	return nil
 }
+
+// Returns the number of messages waiting to be delivered in the
+// queue, which does not include the messages delivered to clients
+// that have not acknowledged them. It may be called from any
+// go-routine.
+func (q *Queue) Depth() int {
+	return int(q.depth.Load())
+}
+
+// Removes the first frame from the queue that has not expired. The
+// frames that have expired are removed as well.
+func (q *Queue) dequeue() (*frame.Frame, string, error) {
+	for {
+		f, id, err := q.qstore.Dequeue(q.destination)
+		if err != nil || f == nil {
+			return f, id, err
+		}
+		q.depth.Add(-1)
+		if !isExpired(f, time.Now()) {
+			return f, id, nil
+		}
+		err = q.qm.expire(&entry{id: id, queue: q.destination, frame: f}, q.qstore.Ack)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+}
@@ -1,28 +1,55 @@
 package queue
 
 import (
+	"errors"
+
 	"github.com/go-stomp/stomp/frame"
 )
 
+// Returned by Ack and Requeue for a frame that has not been dequeued,
+// and by Remove for a frame that is not in the queue.
+var errUnknownId = errors.New("unknown frame id")
+
 // Interface for queue storage. The intent is that
 // different queue storage implementations can be
 // used, depending on preference. Queue storage
 // mechanisms could include in-memory, and various
 // persistent storage mechanisms (eg file system, DB, etc)
+//
+// A frame that is dequeued is delivered to a client, and it is
+// kept by the storage until the client acknowledges it, when Ack
+// is called, or until it cannot be delivered, when Requeue is
+// called. A persistent storage returns the frames that were
+// dequeued but not acknowledged to the head of their queues when
+// it recovers its frames, so that a frame is not lost if the server
+// stops before it has been acknowledged. The methods are called
+// from one go-routine.
 type Storage interface {
-	// Pushes a MESSAGE frame to the end of the queue. Sets
-	// the "message-id" header of the frame before adding to
-	// the queue.
+	// Pushes a MESSAGE frame to the end of the queue.
 	Enqueue(queue string, frame *frame.Frame) error
 
-	// Pushes a MESSAGE frame to the head of the queue. Sets
-	// the "message-id" header of the frame if it is not
-	// already set.
-	Requeue(queue string, frame *frame.Frame) error
+	// Removes a frame from the head of the queue, and returns it
+	// with the id that identifies it to Ack and Requeue.
+	// Returns a nil frame if no frame is available.
+	Dequeue(queue string) (frame *frame.Frame, id string, err error)
+
+	// Discards a frame that has been dequeued, because it has
+	// been acknowledged by the client.
+	Ack(queue string, id string) error
+
+	// Pushes a frame that has been dequeued back to the head of
+	// the queue, because it has not been acknowledged by the client.
+	Requeue(queue string, id string) error
+
+	// Removes a frame that has not been dequeued, such as one
+	// that has expired.
+	Remove(queue string, id string) error
 
-	// Removes a frame from the head of the queue.
-	// Returns nil if no frame is available.
-	Dequeue(queue string) (*frame.Frame, error)
+	// Calls fn with each frame in the queues, in the order in which
+	// they will be dequeued, until fn returns false. This allows the
+	// frames recovered by a persistent storage to be inspected. The
+	// frames that have been dequeued are not included.
+	Range(fn func(queue string, id string, frame *frame.Frame) bool) error
 
 	// Called at server startup. Allows the queue storage
 	// to perform any initialization.
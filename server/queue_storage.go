@@ -1,13 +1,27 @@
 package server
 
 import (
+	"strconv"
+
 	"github.com/go-stomp/stomp/frame"
+	"github.com/go-stomp/stomp/server/queue"
 )
 
+// Storage is an interface that abstracts the queue storage mechanism.
+// The intent is that different queue storage implementations can be
+// used, depending on preference: queue.NewMemoryQueueStorage keeps the
+// queues in memory, and queue.OpenFileStorage keeps them in a file, from
+// which the frames that have not been acknowledged are recovered when the
+// server restarts.
+type Storage = queue.Storage
+
 // QueueStorage is an interface that abstracts the queue storage mechanism.
 // The intent is that different queue storage implementations can be
 // used, depending on preference. Queue storage mechanisms could include
 // in-memory, and various persistent storage mechanisms (eg file system, DB, etc).
+//
+// Deprecated: A QueueStorage is not told when a frame is acknowledged, so
+// it cannot keep the frames that have been dequeued until then. Use Storage.
 type QueueStorage interface {
 	// Enqueue adds a MESSAGE frame to the end of the queue.
 	Enqueue(queue string, frame *frame.Frame) error
@@ -28,3 +42,50 @@ type QueueStorage interface {
 	// to perform any cleanup, such as flushing to disk.
 	Stop()
 }
+
+// queueStorage adapts a QueueStorage to the Storage interface, by
+// keeping the frames dequeued until they are acknowledged itself.
+type queueStorage struct {
+	QueueStorage
+	dequeued map[string]*frame.Frame
+	lastId   uint64
+}
+
+func newQueueStorage(qs QueueStorage) *queueStorage {
+	return &queueStorage{QueueStorage: qs, dequeued: make(map[string]*frame.Frame)}
+}
+
+func (qs *queueStorage) Dequeue(queue string) (*frame.Frame, string, error) {
+	f, err := qs.QueueStorage.Dequeue(queue)
+	if f == nil || err != nil {
+		return nil, "", err
+	}
+	qs.lastId++
+	id := strconv.FormatUint(qs.lastId, 10)
+	qs.dequeued[id] = f
+	return f, id, nil
+}
+
+func (qs *queueStorage) Ack(queue string, id string) error {
+	delete(qs.dequeued, id)
+	return nil
+}
+
+func (qs *queueStorage) Requeue(queue string, id string) error {
+	f, ok := qs.dequeued[id]
+	if !ok {
+		return nil
+	}
+	delete(qs.dequeued, id)
+	return qs.QueueStorage.Requeue(queue, f)
+}
+
+// Remove does nothing, because Range returns no frames to remove.
+func (qs *queueStorage) Remove(queue string, id string) error {
+	return nil
+}
+
+// Range does nothing, because a QueueStorage cannot be iterated.
+func (qs *queueStorage) Range(fn func(queue string, id string, frame *frame.Frame) bool) error {
+	return nil
+}
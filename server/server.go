@@ -4,8 +4,19 @@ Package server contains a simple STOMP server implementation.
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	"github.com/go-stomp/stomp/server/client"
+	"github.com/go-stomp/stomp/server/queue"
+	"github.com/go-stomp/stomp/server/topic"
 )
 
 // The STOMP server has the concept of queues and topics. A message
@@ -16,6 +27,7 @@ import (
 //
 // Destinations that start with this prefix are considered to be queues.
 // Destinations that do not start with this prefix are considered to be topics.
+// Override by setting Server.QueuePrefixes.
 const QueuePrefix = "/queue"
 
 // Default server parameters.
@@ -26,8 +38,58 @@ const (
 	// Default read timeout for heart-beat.
 	// Override by setting Server.HeartBeat.
 	DefaultHeartBeat = time.Minute
+
+	// Default multiplier of the read heart-beat interval, giving the time
+	// after which a silent client is disconnected. Override by setting
+	// Server.HeartBeatGracePeriodMultiplier.
+	DefaultHeartBeatGracePeriodMultiplier = 1.5
+
+	// Default message of the ERROR frame sent to the clients by
+	// Server.Shutdown. Override by setting Server.ShutdownMessage.
+	DefaultShutdownMessage = "server shutting down"
+
+	// Default tokens of hierarchical topic destinations, such as
+	// "/topic/orders.*" and "/topic/orders.>". Override by setting
+	// Server.TopicSeparator, Server.TopicWildcard and
+	// Server.TopicRecursiveWildcard.
+	DefaultTopicSeparator         = "."
+	DefaultTopicWildcard          = "*"
+	DefaultTopicRecursiveWildcard = ">"
+
+	// Default interval between the sweeps that remove expired messages
+	// from the queues. Override by setting Server.SweepInterval.
+	DefaultSweepInterval = time.Minute
+
+	// Default destination of the dead-letter queue of the messages that
+	// have been redelivered too many times. Override by setting
+	// Server.DeadLetterPattern.
+	DefaultDeadLetterPattern = queue.DefaultDeadLetterPattern
+
+	// Default interval between the snapshots of the statistics of the
+	// server published to Server.StatsDestination. Override by setting
+	// Server.StatsInterval.
+	DefaultStatsInterval = 10 * time.Second
+
+	// Default number of messages buffered by each durable subscription
+	// while no client is subscribed to it. Override by setting
+	// Server.DurableBufferSize.
+	DefaultDurableBufferSize = 1000
+)
+
+// An OverflowPolicy determines what happens to a message sent to a
+// topic when a durable subscription to the topic has buffered
+// Server.DurableBufferSize messages.
+type OverflowPolicy = topic.OverflowPolicy
+
+const (
+	DropOldest     = topic.DropOldest     // the oldest message buffered is discarded
+	RejectProducer = topic.RejectProducer // the message is not sent, and its producer is sent an ERROR frame
 )
 
+// ErrServerClosed is returned by the Serve and ListenAndServe methods
+// of a Server after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("stomp: server closed")
+
 // Interface for authenticating STOMP clients.
 type Authenticator interface {
 	// Authenticate based on the given login and passcode, either of which might be nil.
@@ -35,12 +97,261 @@ type Authenticator interface {
 	Authenticate(login, passcode string) bool
 }
 
+// A Principal identifies an authenticated STOMP client, such as a user or
+// a service. It is attached to the connection of the client, for use by
+// authorization.
+type Principal = client.Principal
+
+// Interface for authenticating STOMP clients from the whole CONNECT or
+// STOMP frame, for example from a token in a custom header entry.
+type FrameAuthenticator interface {
+	// AuthenticateFrame returns the principal of the client that sent
+	// the frame, or an error if the client is not permitted to connect.
+	AuthenticateFrame(f *frame.Frame) (Principal, error)
+}
+
+// Interface for authenticating STOMP clients from the CONNECT or STOMP
+// frame and the TLS connection, for example from the verified client
+// certificate. If the FrameAuthenticator of a server implements this
+// interface, AuthenticateTLS is called instead of AuthenticateFrame.
+type TLSFrameAuthenticator interface {
+	FrameAuthenticator
+
+	// AuthenticateTLS is called as AuthenticateFrame is, with the state
+	// of the TLS connection of the client, which is nil if the client
+	// has not connected with TLS.
+	AuthenticateTLS(f *frame.Frame, state *tls.ConnectionState) (Principal, error)
+}
+
+// CertificatePrincipal is the principal of a client that has connected
+// with a TLS client certificate verified by the server, if it has been
+// authenticated by the Authenticator of the server, or if no
+// authentication is performed.
+type CertificatePrincipal struct {
+	Login       string            // Login in the CONNECT frame, if authenticated by the Authenticator
+	Certificate *x509.Certificate // Verified certificate of the client
+}
+
+// Name returns the login of the client or, if it is empty, the common
+// name of the subject of its certificate.
+func (p CertificatePrincipal) Name() string {
+	if p.Login != "" {
+		return p.Login
+	}
+	return p.Certificate.Subject.CommonName
+}
+
 // A Server defines parameters for running a STOMP server.
 type Server struct {
-	Addr          string        // TCP address to listen on, DefaultAddr if empty
-	Authenticator Authenticator // Authenticates login/passcodes. If nil no authentication is performed
-	QueueStorage  QueueStorage  // Implementation of queue storage. If nil, in-memory queues are used.
-	HeartBeat     time.Duration // Preferred value for heart-beat read/write timeout, if zero, then DefaultHeartBeat.
+	Addr               string             // TCP address to listen on, DefaultAddr if empty
+	Authenticator      Authenticator      // Authenticates login/passcodes. If nil no authentication is performed
+	FrameAuthenticator FrameAuthenticator // Authenticates CONNECT frames. If not nil, used instead of Authenticator
+	Authorizer         Authorizer         // Authorizes SEND and SUBSCRIBE frames. If nil all are permitted
+	Storage            Storage            // Implementation of queue storage. If nil, QueueStorage is used.
+	QueueStorage       QueueStorage       // Deprecated: use Storage. If both are nil, in-memory queues are used.
+	HeartBeat          time.Duration      // Preferred value for heart-beat read/write timeout, if zero, then DefaultHeartBeat.
+	TLSConfig          *tls.Config        // If not nil, clients must connect with TLS, and ClientAuth can require their certificates.
+
+	// A message sent to a queue is delivered to one of its subscribers,
+	// which take turns, and a subscriber with an ack mode other than auto
+	// is sent no other message from the queue until it has acknowledged
+	// the message. A message that is negatively acknowledged, or that has
+	// not been acknowledged when its subscriber disconnects, is delivered
+	// again with the "redelivered:true" header entry. A message sent to a
+	// topic is delivered to every subscriber, and a subscriber that falls
+	// too far behind is disconnected, rather than hold up the others.
+	// A subscription to a queue whose SUBSCRIBE frame has the
+	// "browser:true" header entry browses the queue instead: it is sent
+	// copies of the messages waiting in the queue when it subscribed,
+	// which remain in the queue, followed by a message with the
+	// "browser:end" header entry.
+	QueuePrefixes []string // Destinations with these prefixes are queues, and the others topics, if empty, then QueuePrefix.
+
+	// Scheduling of the messages sent to queues, which are otherwise
+	// delivered in the order in which they were sent. With priority
+	// queues, a message is delivered before those with a lower
+	// "priority" header entry, from 9, the highest, to 0, the lowest,
+	// and those without one have queue.DefaultPriority. With delayed
+	// delivery, a message with a "delay-ms" or "scheduled-delay" header
+	// entry, in milliseconds, is enqueued once the delay has passed. The
+	// messages delayed are kept in memory until then, and are lost if
+	// the server stops.
+	PriorityQueues  bool // If true, and both Storage and QueueStorage are nil, the in-memory queues are priority queues.
+	DelayedDelivery bool // If true, messages with a delay are held back.
+
+	// A subscription to a topic whose SUBSCRIBE frame has the
+	// "activemq.subscriptionName" or "durable-subscription-name" header
+	// entry, from a client whose CONNECT frame has the "client-id" header
+	// entry, is durable: once the client has unsubscribed or
+	// disconnected, the messages sent to the topic are buffered, and
+	// they are delivered first when a client with the same client-id
+	// subscribes again with the same name. A client that subscribes
+	// while another is subscribed replaces it. An UNSUBSCRIBE frame with
+	// the header entry removes the durable subscription. The messages
+	// buffered are kept in memory, and are lost if the server stops.
+	DurableBufferSize int            // Most messages buffered for each durable subscription, if zero, then DefaultDurableBufferSize, if negative, no maximum.
+	DurableOverflow   OverflowPolicy // What happens to a message sent once a buffer is full, DropOldest if zero.
+
+	// Hooks that let a program, such as the tests that use the stomptest
+	// package, observe the clients and the messages that they send, and
+	// send frames to the clients with client.Conn.Send. They are called
+	// from the go-routine that processes the requests of the clients,
+	// which they must not block.
+	OnConnect    func(conn *client.Conn)                 // Called once a client has connected, if not nil.
+	OnDisconnect func(conn *client.Conn)                 // Called once a client that connected has disconnected, if not nil.
+	OnSend       func(conn *client.Conn, f *frame.Frame) // Called with each MESSAGE frame sent by a client, before it is delivered, if not nil. f must not be modified.
+
+	// Heart-beats are negotiated with the heart-beat header entry of the
+	// CONNECT frame: each interval requested by a client is lengthened to
+	// HeartBeat if it is shorter, and the CONNECTED frame has the intervals
+	// negotiated. The server writes a heart-beat when it has written
+	// nothing for its interval, and disconnects a client that has sent
+	// nothing for its interval multiplied by the grace period multiplier.
+	HeartBeatMax                   time.Duration // Longest heart-beat interval accepted from clients, and used for them, if zero, then no maximum.
+	HeartBeatGracePeriodMultiplier float64       // Tolerance of late heart-beats, if zero, then DefaultHeartBeatGracePeriodMultiplier.
+
+	// Limits that keep a client from making the server use too much
+	// memory. A client that sends a frame exceeding a limit, or that has
+	// too many subscriptions, is sent an ERROR frame and disconnected,
+	// and a connection accepted beyond MaxConnections is sent an ERROR
+	// frame in reply to its CONNECT frame and closed. The other clients
+	// are not affected.
+	MaxFrameSize            int // Largest body of a frame received, in bytes, if zero, then no maximum.
+	MaxHeaders              int // Most header entries of a frame received, if zero, then no maximum.
+	MaxHeaderBytes          int // Largest command and header lines of a frame received, in bytes, if zero, then no maximum.
+	MaxSubscriptionsPerConn int // Most subscriptions of a client, if zero, then no maximum.
+	MaxConnections          int // Most connections served at once, if zero, then no maximum.
+
+	// Limits the rate at which each client sends SEND frames. The limit
+	// can be changed with SetSendRateLimit while the server is serving,
+	// without disconnecting the clients.
+	SendRateLimit RateLimit // If zero, then no limit.
+
+	// Tokens of hierarchical topic destinations. A subscription to a topic
+	// destination with a wildcard token receives the messages sent to the
+	// matching destinations, for example "/topic/orders.*" matches
+	// "/topic/orders.created", and "/topic/orders.>" also matches
+	// "/topic/orders.eu.created". Other destinations are matched exactly.
+	TopicSeparator         string // Separates the tokens of a destination, DefaultTopicSeparator if empty
+	TopicWildcard          string // Matches any one token, DefaultTopicWildcard if empty
+	TopicRecursiveWildcard string // As the last token, matches one or more tokens, DefaultTopicRecursiveWildcard if empty
+
+	// A message sent to a queue with an "expires" header, the time in
+	// milliseconds since the Unix epoch after which it must not be
+	// delivered, is removed from the queue once it has expired: when it
+	// is dequeued, or by a sweep of the queues, so that the queues without
+	// subscriptions do not grow forever.
+	SweepInterval    time.Duration // Interval between sweeps, if zero, then DefaultSweepInterval, if negative, no sweeps.
+	DeadLetterSuffix string        // If not empty, expired messages are moved to the queue whose destination has this suffix added.
+
+	// A message sent to a queue that is negatively acknowledged is
+	// delivered again, until it has been redelivered the maximum number of
+	// times, when the next NACK frame moves it to a dead-letter queue. A
+	// NACK frame with the "requeue:false" header entry moves it at once.
+	// The message moved has the "original-destination" and
+	// "redelivery-count" header entries, and the "last-error" header entry
+	// if the NACK frame has a "message" header entry. A NACK frame applies
+	// to the message that it identifies alone, even in ack:client mode,
+	// while an ACK frame in ack:client mode also acknowledges the messages
+	// sent earlier on the connection, which are then never moved.
+	MaxRedeliveries            int            // Maximum redeliveries of a message, if zero, then no maximum.
+	DestinationMaxRedeliveries map[string]int // Overrides MaxRedeliveries for the queues with these destinations.
+	DeadLetterPattern          string         // Dead-letter queue, in which "{destination}" is replaced by the message destination, if empty, then DefaultDeadLetterPattern.
+
+	// Shutdown sends the clients connected an ERROR frame, and the server
+	// closes their connections once it has been written.
+	ShutdownMessage string // Message of the ERROR frame, if empty, then DefaultShutdownMessage.
+	ShutdownQuietly bool   // If true, no ERROR frame is sent, and Shutdown waits for the clients to disconnect.
+
+	// The statistics of the server returned by Stats can also be read by
+	// STOMP clients: a subscription to the topic destination
+	// StatsDestination, such as "/internal/stats", receives a snapshot
+	// encoded in JSON when it is created, and then every StatsInterval.
+	// The messages sent by clients to the destination are discarded.
+	StatsDestination string        // Topic destination of the snapshots, if empty, then none are published.
+	StatsInterval    time.Duration // Interval between snapshots, if zero, then DefaultStatsInterval.
+
+	rateLimit    atomic.Pointer[RateLimit] // set by SetSendRateLimit, overrides SendRateLimit
+	connections  atomic.Int64
+	frames       atomic.Uint64
+	expired      atomic.Uint64
+	deadLettered atomic.Uint64
+
+	mu     sync.Mutex
+	procs  map[*requestProcessor]struct{}
+	slots  chan struct{} // one for each connection served, nil if there is no maximum
+	closed bool
+}
+
+// A RateLimitPolicy determines what happens to a client that sends
+// frames faster than a RateLimit allows.
+type RateLimitPolicy int
+
+const (
+	// RateLimitDelay reads the frames of the client more slowly, until
+	// it is back within the limit, so that TCP flow control slows it down.
+	RateLimitDelay RateLimitPolicy = iota
+
+	// RateLimitReject sends the client an ERROR frame and disconnects it.
+	RateLimitReject
+)
+
+// A RateLimit limits the rate at which each client sends frames, with
+// token buckets that allow bursts of up to one second at the rate.
+type RateLimit struct {
+	FramesPerSecond float64         // Frames per second, if zero, then no limit.
+	BytesPerSecond  float64         // Bytes of the frame bodies per second, if zero, then no limit.
+	Policy          RateLimitPolicy // What happens to a client that exceeds the limit.
+}
+
+// SetSendRateLimit changes the limit on the rate of the SEND frames of
+// each client, replacing SendRateLimit. It may be called from any
+// go-routine, and it applies to the next SEND frame of the clients
+// connected, as well as to the clients that connect later.
+func (s *Server) SetSendRateLimit(limit RateLimit) {
+	s.rateLimit.Store(&limit)
+}
+
+// sendRateLimit returns the limit on the rate of the SEND frames.
+func (s *Server) sendRateLimit() RateLimit {
+	if limit := s.rateLimit.Load(); limit != nil {
+		return *limit
+	}
+	return s.SendRateLimit
+}
+
+// ServerStats contains statistics of the clients of a server and of
+// the messages that it has processed.
+type ServerStats struct {
+	Connections  int            `json:"connections"`  // Clients connected
+	QueueDepths  map[string]int `json:"queueDepths"`  // Messages waiting to be delivered in each queue, by destination
+	Enqueued     uint64         `json:"enqueued"`     // Messages enqueued to the queues, including dead-letter queues
+	Dequeued     uint64         `json:"dequeued"`     // Messages delivered from the queues, including redeliveries
+	Frames       uint64         `json:"frames"`       // Frames processed: messages, subscriptions and acknowledgements from the clients
+	Expired      uint64         `json:"expired"`      // Messages that expired before they were delivered
+	DeadLettered uint64         `json:"deadLettered"` // Expired messages that were moved to a dead-letter queue
+}
+
+// Stats returns the statistics of the server, which are updated while
+// it is serving. It may be called from any go-routine.
+func (s *Server) Stats() ServerStats {
+	stats := ServerStats{
+		Connections:  int(s.connections.Load()),
+		QueueDepths:  make(map[string]int),
+		Frames:       s.frames.Load(),
+		Expired:      s.expired.Load(),
+		DeadLettered: s.deadLettered.Load(),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for proc := range s.procs {
+		for destination, depth := range proc.qm.Depths() {
+			stats.QueueDepths[destination] += depth
+		}
+		stats.Enqueued += proc.qm.Enqueued()
+		stats.Dequeued += proc.qm.Dequeued()
+	}
+	return stats
 }
 
 // ListenAndServe listens on the TCP network address addr and then calls Serve.
@@ -49,6 +360,14 @@ func ListenAndServe(addr string) error {
 	return s.ListenAndServe()
 }
 
+// ListenAndServeTLS listens on the TCP network address addr and then
+// calls Serve, accepting the connections with TLS as configured by
+// tlsConfig, which must contain a certificate.
+func ListenAndServeTLS(addr string, tlsConfig *tls.Config) error {
+	s := &Server{Addr: addr, TLSConfig: tlsConfig}
+	return s.ListenAndServe()
+}
+
 // Serve accepts incoming TCP connections on the listener l, creating a new
 // STOMP service thread for each connection.
 func Serve(l net.Listener) error {
@@ -74,8 +393,91 @@ func (s *Server) ListenAndServe() error {
 
 // Serve accepts incoming connections on the Listener l, creating a new
 // service thread for each connection. The service threads read
-// requests and then process each request.
+// requests and then process each request. If s.TLSConfig is not nil,
+// the connections are accepted with TLS, and those whose handshake
+// fails are logged and closed.
+//
+// Serve always returns a non-nil error. After Shutdown or Close, the
+// returned error is ErrServerClosed.
 func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	if s.MaxConnections > 0 && s.slots == nil {
+		s.slots = make(chan struct{}, s.MaxConnections)
+	}
 	proc := newRequestProcessor(s)
+	if s.procs == nil {
+		s.procs = make(map[*requestProcessor]struct{})
+	}
+	s.procs[proc] = struct{}{}
+	s.mu.Unlock()
+
+	if s.TLSConfig != nil {
+		l = tls.NewListener(l, s.TLSConfig)
+	}
 	return proc.Serve(l)
 }
+
+// Shutdown gracefully shuts down the server. It closes the listeners,
+// so that no connections are accepted, and sends the clients connected
+// an ERROR frame, unless ShutdownQuietly is set. It then waits for the
+// connections to close, and for the server to process their last
+// requests, which return the messages that the clients have not
+// acknowledged to their queues, before it stops the queue storage and
+// returns.
+//
+// If ctx is done first, the connections still open are closed, as
+// Close does, and Shutdown returns the context's error. The queue
+// storage is then stopped once the connections have been cleaned up.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var notice error
+	if !s.ShutdownQuietly {
+		notice = errors.New(s.shutdownMessage())
+	}
+	for _, stopped := range s.shutdown(ctx, notice) {
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Close immediately closes the listeners and the connections of the
+// server, without notifying the clients. The messages that the clients
+// have not acknowledged are returned to their queues, and the queue
+// storage is stopped, after Close has returned. For a graceful
+// shutdown, use Shutdown.
+func (s *Server) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.shutdown(ctx, nil)
+	return nil
+}
+
+// shutdown marks the server closed, and shuts down its processors.
+// Returns the channels that are closed once they have stopped.
+func (s *Server) shutdown(ctx context.Context, notice error) []<-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stopped []<-chan struct{}
+	if !s.closed {
+		s.closed = true
+		for proc := range s.procs {
+			stopped = append(stopped, proc.shutdown(ctx, notice))
+		}
+	}
+	return stopped
+}
+
+func (s *Server) shutdownMessage() string {
+	if s.ShutdownMessage == "" {
+		return DefaultShutdownMessage
+	}
+	return s.ShutdownMessage
+}
@@ -1,12 +1,22 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+	"github.com/go-stomp/stomp/server/queue"
 	. "gopkg.in/check.v1"
 )
 
@@ -135,3 +145,1284 @@ func runReceiver(c *C, ch chan bool, count int, destination, addr string, starte
 	}
 	ch <- true
 }
+
+func (s *ServerSuite) TestWithTransaction(c *C) {
+	addr := ":59093"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	defer func() { l.Close() }()
+	go Serve(l)
+
+	client, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer client.Disconnect()
+
+	// an error aborts the transaction
+	failed := errors.New("failed")
+	err = client.WithTransaction(context.Background(), func(tx *stomp.Transaction) error {
+		c.Assert(tx.Send("/queue/tx-1", "text/plain", []byte("aborted")), IsNil)
+		return failed
+	})
+	c.Check(err, Equals, failed)
+
+	// so does a panic, which continues
+	func() {
+		defer func() {
+			c.Check(recover(), Equals, "cannot send")
+		}()
+		client.WithTransaction(context.Background(), func(tx *stomp.Transaction) error {
+			c.Assert(tx.Send("/queue/tx-1", "text/plain", []byte("panicked")), IsNil)
+			panic("cannot send")
+		})
+	}()
+
+	err = client.WithTransaction(context.Background(), func(tx *stomp.Transaction) error {
+		err := client.WithTransaction(tx.Context(), func(*stomp.Transaction) error {
+			c.Error("nested transaction")
+			return nil
+		})
+		c.Check(err, Equals, stomp.ErrNestedTransaction)
+		return tx.Send("/queue/tx-1", "text/plain", []byte("committed"))
+	})
+	c.Check(err, IsNil)
+
+	// only the committed message is delivered
+	sub, err := client.Subscribe("/queue/tx-1", stomp.AckAuto)
+	c.Assert(err, IsNil)
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(string(msg.Body), Equals, "committed")
+	select {
+	case msg := <-sub.C:
+		c.Errorf("unexpected message: %q", msg.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type testAuthenticator struct{}
+
+func (testAuthenticator) Authenticate(login, passcode string) bool {
+	if login == "panic" {
+		panic("cannot authenticate")
+	}
+	return login == "user" && passcode == "secret"
+}
+
+type testPrincipal string
+
+func (p testPrincipal) Name() string {
+	return string(p)
+}
+
+type tokenAuthenticator struct{}
+
+func (tokenAuthenticator) AuthenticateFrame(f *frame.Frame) (Principal, error) {
+	token, ok := f.Header.Contains("token")
+	switch {
+	case !ok:
+		return nil, errors.New("missing token")
+	case token == "panic":
+		panic("cannot authenticate")
+	case token != "t0k3n":
+		return nil, errors.New("invalid token")
+	}
+	return testPrincipal("service"), nil
+}
+
+func (s *ServerSuite) TestAuthenticate(c *C) {
+	login := func(login, passcode string) *frame.Frame {
+		return frame.New(frame.CONNECT, frame.AcceptVersion, "1.2", frame.Login, login, frame.Passcode, passcode)
+	}
+	token := func(token string) *frame.Frame {
+		return frame.New(frame.CONNECT, frame.AcceptVersion, "1.2", "token", token)
+	}
+	testCases := []struct {
+		server    *Server
+		f         *frame.Frame
+		principal Principal
+		err       string
+	}{
+		{&Server{}, login("user", "wrong"), nil, ""},
+		{&Server{Authenticator: testAuthenticator{}}, login("user", "secret"), testPrincipal("user"), ""},
+		{&Server{Authenticator: testAuthenticator{}}, login("user", "wrong"), nil, "invalid login or passcode"},
+		{&Server{Authenticator: testAuthenticator{}}, frame.New(frame.CONNECT), nil, "invalid login or passcode"},
+		{&Server{Authenticator: testAuthenticator{}}, login("panic", ""), nil, "authenticator panicked: cannot authenticate"},
+		{&Server{FrameAuthenticator: tokenAuthenticator{}}, token("t0k3n"), testPrincipal("service"), ""},
+		{&Server{FrameAuthenticator: tokenAuthenticator{}}, token("wrong"), nil, "invalid token"},
+		{&Server{FrameAuthenticator: tokenAuthenticator{}}, login("user", "secret"), nil, "missing token"},
+		{&Server{FrameAuthenticator: tokenAuthenticator{}}, token("panic"), nil, "authenticator panicked: cannot authenticate"},
+	}
+
+	for i, tc := range testCases {
+		principal, err := newConfig(tc.server).Authenticate(tc.f, nil)
+		if tc.err != "" {
+			c.Check(err, ErrorMatches, tc.err, Commentf("test case %d", i))
+		} else {
+			c.Check(err, IsNil, Commentf("test case %d", i))
+		}
+		if tc.principal == nil {
+			c.Check(principal, IsNil, Commentf("test case %d", i))
+		} else {
+			c.Check(principal.Name(), Equals, tc.principal.Name(), Commentf("test case %d", i))
+		}
+	}
+}
+
+func (s *ServerSuite) TestAccessDenied(c *C) {
+	addr := ":59094"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	defer func() { l.Close() }()
+	go (&Server{Authenticator: testAuthenticator{}}).Serve(l)
+
+	for _, headers := range [][]string{
+		{frame.Login, "user", frame.Passcode, "wrong"},
+		{},
+		{frame.Login, "panic"},
+	} {
+		conn, err := net.Dial("tcp", "127.0.0.1"+addr)
+		c.Assert(err, IsNil)
+		w := frame.NewWriter(conn)
+		r := frame.NewReader(conn)
+		c.Assert(w.Write(frame.New(frame.CONNECT, append([]string{frame.AcceptVersion, "1.2"}, headers...)...)), IsNil)
+
+		f, err := r.Read()
+		c.Assert(err, IsNil)
+		c.Check(f.Command, Equals, frame.ERROR)
+		c.Check(f.Header.Get(frame.Message), Equals, "access denied")
+
+		// the connection is closed
+		_, err = r.Read()
+		c.Check(err, Equals, io.EOF)
+		conn.Close()
+	}
+
+	// the server is still running
+	client, err := stomp.Dial("tcp", "127.0.0.1"+addr, stomp.ConnOpt.Login("user", "secret"))
+	c.Assert(err, IsNil)
+	c.Check(client.Disconnect(), IsNil)
+}
+
+func (s *ServerSuite) TestMatchDestination(c *C) {
+	testCases := []struct {
+		pattern, destination string
+		match                bool
+	}{
+		{"/queue/orders", "/queue/orders", true},
+		{"/queue/orders", "/queue/orders.created", false},
+		{"/queue/orders.created", "/queue/orders", false},
+		{"queue.orders.>", "/queue/orders.created", true},
+		{"queue.orders.>", "/queue/orders.eu.created", true},
+		{"queue.orders.>", "/queue/orders", false},
+		{"/queue/orders.*", "/queue/orders.created", true},
+		{"/queue/orders.*", "/queue/orders.eu.created", false},
+		{"/queue/*.created", "/queue/orders.created", true},
+		{"/queue/*.created", "/queue/orders.deleted", false},
+		{">", "/topic/prices", true},
+		{"/topic/>.prices", "/topic/a.prices", false},
+		{"/topic/>.prices", "/topic/>.prices", true},
+	}
+	for i, tc := range testCases {
+		c.Check(MatchDestination(tc.pattern, tc.destination), Equals, tc.match, Commentf("test case %d", i))
+	}
+}
+
+func (s *ServerSuite) TestRuleAuthorizer(c *C) {
+	a := RuleAuthorizer{
+		{Principal: "*", Subscribe: []string{"/topic/public.>"}},
+		{Principal: "user", Send: []string{"/queue/orders.>"}, Subscribe: []string{"/queue/orders.*"}},
+	}
+	user := testPrincipal("user")
+	other := testPrincipal("other")
+
+	c.Check(a.CanSend(user, "/queue/orders.created"), Equals, true)
+	c.Check(a.CanSend(other, "/queue/orders.created"), Equals, false)
+	c.Check(a.CanSend(nil, "/queue/orders.created"), Equals, false)
+	c.Check(a.CanSend(user, "/topic/public.news"), Equals, false)
+	c.Check(a.CanSubscribe(user, "/queue/orders.created"), Equals, true)
+	c.Check(a.CanSubscribe(user, "/topic/public.news"), Equals, true)
+	c.Check(a.CanSubscribe(nil, "/topic/public.news"), Equals, true)
+	c.Check(a.CanSubscribe(other, "/queue/orders.created"), Equals, false)
+}
+
+type panicAuthorizer struct{}
+
+func (panicAuthorizer) CanSend(principal Principal, destination string) bool {
+	panic("cannot authorize")
+}
+
+func (panicAuthorizer) CanSubscribe(principal Principal, destination string) bool {
+	panic("cannot authorize")
+}
+
+func (s *ServerSuite) TestAuthorize(c *C) {
+	addr := ":59095"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	defer func() { l.Close() }()
+	go (&Server{
+		Authenticator: testAuthenticator{},
+		Authorizer: RuleAuthorizer{
+			{Principal: "user", Send: []string{"/queue/orders.>"}, Subscribe: []string{"/queue/orders.*"}},
+		},
+	}).Serve(l)
+
+	client, err := stomp.Dial("tcp", "127.0.0.1"+addr, stomp.ConnOpt.Login("user", "secret"))
+	c.Assert(err, IsNil)
+	sub, err := client.Subscribe("/queue/orders.created", stomp.AckAuto)
+	c.Assert(err, IsNil)
+
+	denied := func(f *frame.Frame, headers ...string) {
+		conn, err := net.Dial("tcp", "127.0.0.1"+addr)
+		c.Assert(err, IsNil)
+		defer conn.Close()
+		w := frame.NewWriter(conn)
+		r := frame.NewReader(conn)
+		c.Assert(w.Write(frame.New(frame.CONNECT, frame.AcceptVersion, "1.2", frame.Login, "user", frame.Passcode, "secret")), IsNil)
+		connected, err := r.Read()
+		c.Assert(err, IsNil)
+		c.Assert(connected.Command, Equals, frame.CONNECTED)
+
+		c.Assert(w.Write(f), IsNil)
+		errorFrame, err := r.Read()
+		c.Assert(err, IsNil)
+		c.Check(errorFrame.Command, Equals, frame.ERROR)
+		c.Check(errorFrame.Header.Get(frame.Message), Equals, "not authorized: "+f.Header.Get(frame.Destination))
+		for i := 0; i < len(headers); i += 2 {
+			c.Check(errorFrame.Header.Get(headers[i]), Equals, headers[i+1])
+		}
+
+		// the connection is closed
+		_, err = r.Read()
+		c.Check(err, Equals, io.EOF)
+	}
+	denied(frame.New(frame.SEND, frame.Destination, "/queue/other", frame.Receipt, "receipt-1"),
+		frame.ReceiptId, "receipt-1")
+	denied(frame.New(frame.SUBSCRIBE, frame.Destination, "/queue/orders.eu.created", frame.Id, "sub-1", frame.Receipt, "receipt-2"),
+		frame.ReceiptId, "receipt-2", frame.Subscription, "sub-1")
+
+	// the other clients are not affected
+	c.Assert(client.Send("/queue/orders.created", "text/plain", []byte("order")), IsNil)
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(string(msg.Body), Equals, "order")
+	c.Check(client.Disconnect(), IsNil)
+
+	// a panic in the authorizer denies the operation
+	c.Check(newConfig(&Server{Authorizer: panicAuthorizer{}}).CanSend(nil, "/queue/orders"), Equals, false)
+	c.Check(newConfig(&Server{Authorizer: panicAuthorizer{}}).CanSubscribe(nil, "/queue/orders"), Equals, false)
+}
+
+func (s *ServerSuite) TestTopicWildcards(c *C) {
+	addr := ":59096"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	defer func() { l.Close() }()
+	go (&Server{TopicSeparator: "/", TopicWildcard: "+", TopicRecursiveWildcard: "#"}).Serve(l)
+
+	client, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer client.Disconnect()
+
+	one, err := client.Subscribe("/topic/orders/+", stomp.AckAuto)
+	c.Assert(err, IsNil)
+	all, err := client.Subscribe("/topic/orders/#", stomp.AckAuto)
+	c.Assert(err, IsNil)
+
+	// the server processes the frames of a connection in order, so the
+	// subscriptions are in place before the messages are sent
+	for _, destination := range []string{"/topic/orders/eu/created", "/topic/orders/created"} {
+		c.Assert(client.Send(destination, "text/plain", []byte(destination)), IsNil)
+	}
+
+	for _, expected := range []string{"/topic/orders/eu/created", "/topic/orders/created"} {
+		msg := <-all.C
+		c.Assert(msg.Err, IsNil)
+		c.Check(msg.Destination, Equals, expected)
+	}
+	msg := <-one.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(msg.Destination, Equals, "/topic/orders/created")
+}
+
+func (s *ServerSuite) TestRecoverStorage(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "queues.log")
+	qs, err := queue.OpenFileStorage(path)
+	c.Assert(err, IsNil)
+
+	addr := ":59097"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	defer func() { l.Close() }()
+	go (&Server{Storage: qs}).Serve(l)
+
+	// the messages are queued once the sender has disconnected
+	sender, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	for i := 1; i <= 3; i++ {
+		c.Assert(sender.Send("/queue/recover", "text/plain", []byte(fmt.Sprintf("message %d", i))), IsNil)
+	}
+	c.Assert(sender.Disconnect(), IsNil)
+
+	receiver, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer receiver.Disconnect()
+	sub, err := receiver.Subscribe("/queue/recover", stomp.AckClientIndividual)
+	c.Assert(err, IsNil)
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(string(msg.Body), Equals, "message 1")
+	c.Assert(receiver.Ack(msg), IsNil)
+
+	// the second message is sent once the first has been acknowledged
+	msg = <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(string(msg.Body), Equals, "message 2")
+
+	// the log is copied while the second message has not been
+	// acknowledged, as if the server had stopped abruptly
+	log, err := os.ReadFile(path)
+	c.Assert(err, IsNil)
+	crashed := filepath.Join(dir, "crashed.log")
+	c.Assert(os.WriteFile(crashed, log, 0o600), IsNil)
+
+	qs, err = queue.OpenFileStorage(crashed)
+	c.Assert(err, IsNil)
+	defer qs.Stop()
+	addr = ":59098"
+	l2, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	defer func() { l2.Close() }()
+	go (&Server{Storage: qs}).Serve(l2)
+
+	client, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer client.Disconnect()
+	sub, err = client.Subscribe("/queue/recover", stomp.AckClientIndividual)
+	c.Assert(err, IsNil)
+	for _, expected := range []string{"message 2", "message 3"} {
+		msg := <-sub.C
+		c.Assert(msg.Err, IsNil)
+		c.Check(string(msg.Body), Equals, expected)
+		c.Assert(client.Ack(msg), IsNil)
+	}
+}
+
+func (s *ServerSuite) TestExpiration(c *C) {
+	addr := ":59099"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	defer func() { l.Close() }()
+	server := &Server{SweepInterval: -1}
+	go server.Serve(l)
+
+	client, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer client.Disconnect()
+
+	// the expired message is not delivered
+	past := strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10)
+	c.Assert(client.Send("/queue/ttl", "text/plain", []byte("expired"), stomp.SendOpt.Header(frame.Expires, past), stomp.SendOpt.Receipt), IsNil)
+	c.Assert(client.Send("/queue/ttl", "text/plain", []byte("live"), stomp.SendOpt.Receipt), IsNil)
+	sub, err := client.Subscribe("/queue/ttl", stomp.AckAuto)
+	c.Assert(err, IsNil)
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(string(msg.Body), Equals, "live")
+	c.Check(server.Stats().Expired, Equals, uint64(1))
+	c.Check(server.Stats().DeadLettered, Equals, uint64(0))
+
+	// the sweeper moves the expired message to the dead-letter queue,
+	// although nobody subscribes to its destination
+	addr = ":59100"
+	l2, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	defer func() { l2.Close() }()
+	server = &Server{SweepInterval: 10 * time.Millisecond, DeadLetterSuffix: ".DLQ"}
+	go server.Serve(l2)
+
+	client2, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer client2.Disconnect()
+
+	expires := strconv.FormatInt(time.Now().Add(50*time.Millisecond).UnixMilli(), 10)
+	c.Assert(client2.Send("/queue/ttl", "text/plain", []byte("expired"), stomp.SendOpt.Header(frame.Expires, expires), stomp.SendOpt.Receipt), IsNil)
+	for i := 0; i < 100 && server.Stats().Expired == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(server.Stats().Expired, Equals, uint64(1))
+	c.Check(server.Stats().DeadLettered, Equals, uint64(1))
+
+	sub, err = client2.Subscribe("/queue/ttl.DLQ", stomp.AckAuto)
+	c.Assert(err, IsNil)
+	msg = <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(string(msg.Body), Equals, "expired")
+	c.Check(msg.Header.Get(queue.OriginalDestination), Equals, "/queue/ttl")
+	c.Check(msg.Header.Get(frame.Expires), Equals, "")
+}
+
+func (s *ServerSuite) TestStats(c *C) {
+	addr := ":59108"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	server := &Server{StatsDestination: "/internal/stats", StatsInterval: 20 * time.Millisecond}
+	go server.Serve(l)
+	defer server.Close()
+
+	client, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer client.Disconnect()
+	for i := 0; i < 3; i++ {
+		c.Assert(client.Send("/queue/stats", "text/plain", []byte("message"), stomp.SendOpt.Receipt), IsNil)
+	}
+	// the message delivered, and not yet acknowledged, is no longer
+	// waiting in the queue
+	sub, err := client.Subscribe("/queue/stats", stomp.AckClientIndividual)
+	c.Assert(err, IsNil)
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+
+	// a message sent to the stats destination is not published
+	c.Assert(client.Send("/internal/stats", "text/plain", []byte("forged"), stomp.SendOpt.Receipt), IsNil)
+
+	// the first snapshot is received on subscribing, and then more
+	// are published, with the counts when they were taken
+	statsSub, err := client.Subscribe("/internal/stats", stomp.AckAuto)
+	c.Assert(err, IsNil)
+	for i := 0; i < 2; i++ {
+		msg = <-statsSub.C
+		c.Assert(msg.Err, IsNil)
+		var stats ServerStats
+		c.Assert(msg.DecodeJSON(&stats, false), IsNil)
+		c.Check(stats.Connections, Equals, 1)
+		c.Check(stats.QueueDepths["/queue/stats"], Equals, 2)
+		c.Check(stats.Enqueued, Equals, uint64(3))
+		c.Check(stats.Dequeued, Equals, uint64(1))
+		c.Check(stats.Frames > 0, Equals, true)
+	}
+
+	client2, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	c.Assert(client2.Send("/queue/stats", "text/plain", []byte("message"), stomp.SendOpt.Receipt), IsNil)
+	stats := server.Stats()
+	c.Check(stats.Connections, Equals, 2)
+	c.Check(stats.QueueDepths, DeepEquals, map[string]int{"/queue/stats": 3})
+	c.Assert(client2.Disconnect(), IsNil)
+	for i := 0; i < 100 && server.Stats().Connections != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(server.Stats().Connections, Equals, 1)
+}
+
+func (s *ServerSuite) TestDeadLetterOnNack(c *C) {
+	addr := ":59101"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	defer func() { l.Close() }()
+	go (&Server{
+		MaxRedeliveries:            2,
+		DestinationMaxRedeliveries: map[string]int{"/queue/client": 1},
+		DeadLetterPattern:          "/queue/DLQ.{destination}",
+	}).Serve(l)
+
+	client, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer client.Disconnect()
+
+	receive := func(sub *stomp.Subscription, body string) *stomp.Message {
+		select {
+		case msg := <-sub.C:
+			c.Assert(msg.Err, IsNil)
+			c.Assert(string(msg.Body), Equals, body)
+			return msg
+		case <-time.After(5 * time.Second):
+			c.Fatalf("message not received: %s", body)
+			return nil
+		}
+	}
+
+	// the message is delivered, and redelivered twice
+	c.Assert(client.Send("/queue/poison", "text/plain", []byte("poison"), stomp.SendOpt.Receipt), IsNil)
+	sub, err := client.Subscribe("/queue/poison", stomp.AckClientIndividual)
+	c.Assert(err, IsNil)
+	for i := 0; i < 2; i++ {
+		c.Assert(client.Nack(receive(sub, "poison")), IsNil)
+	}
+	c.Assert(receive(sub, "poison").NackWithOpts(stomp.NackOpt.Header(frame.Message, "cannot parse")), IsNil)
+
+	dlq, err := client.Subscribe("/queue/DLQ./queue/poison", stomp.AckAuto)
+	c.Assert(err, IsNil)
+	msg := receive(dlq, "poison")
+	c.Check(msg.Header.Get(queue.OriginalDestination), Equals, "/queue/poison")
+	c.Check(msg.Header.Get(queue.RedeliveryCount), Equals, "2")
+	c.Check(msg.Header.Get(queue.LastError), Equals, "cannot parse")
+
+	// a message is moved at once if it must not be requeued
+	c.Assert(client.Send("/queue/poison", "text/plain", []byte("reject"), stomp.SendOpt.Receipt), IsNil)
+	c.Assert(receive(sub, "reject").NackWithOpts(stomp.NackOpt.NoRequeue), IsNil)
+	msg = receive(dlq, "reject")
+	c.Check(msg.Header.Get(queue.RedeliveryCount), Equals, "0")
+	c.Check(msg.Header.Get(queue.LastError), Equals, "")
+
+	// in ack:client mode, the ACK of a message redelivered acknowledges
+	// the message sent earlier to the other subscription, while a NACK
+	// applies to one message
+	one, err := client.Subscribe("/queue/client", stomp.AckClient)
+	c.Assert(err, IsNil)
+	other, err := client.Subscribe("/queue/other", stomp.AckClient)
+	c.Assert(err, IsNil)
+	c.Assert(client.Send("/queue/client", "text/plain", []byte("one"), stomp.SendOpt.Receipt), IsNil)
+	receive(one, "one")
+	c.Assert(client.Send("/queue/other", "text/plain", []byte("other"), stomp.SendOpt.Receipt), IsNil)
+	c.Assert(client.Nack(receive(other, "other")), IsNil)
+	c.Assert(client.Ack(receive(other, "other")), IsNil)
+
+	// the message acknowledged is not redelivered, and the next message
+	// is moved after its one redelivery
+	c.Assert(client.Send("/queue/client", "text/plain", []byte("two"), stomp.SendOpt.Receipt), IsNil)
+	c.Assert(client.Nack(receive(one, "two")), IsNil)
+	c.Assert(client.Nack(receive(one, "two")), IsNil)
+	dlq, err = client.Subscribe("/queue/DLQ./queue/client", stomp.AckAuto)
+	c.Assert(err, IsNil)
+	msg = receive(dlq, "two")
+	c.Check(msg.Header.Get(queue.RedeliveryCount), Equals, "1")
+}
+
+func (s *ServerSuite) TestHeartBeat(c *C) {
+	addr := ":59102"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	defer func() { l.Close() }()
+	go (&Server{HeartBeat: 50 * time.Millisecond, HeartBeatMax: time.Second}).Serve(l)
+
+	connect := func(heartBeat string) (net.Conn, *frame.Reader, *frame.Writer, *frame.Frame) {
+		conn, err := net.Dial("tcp", "127.0.0.1"+addr)
+		c.Assert(err, IsNil)
+		w := frame.NewWriter(conn)
+		r := frame.NewReader(conn)
+		c.Assert(w.Write(frame.New(frame.CONNECT, frame.AcceptVersion, "1.2", frame.HeartBeat, heartBeat)), IsNil)
+		f, err := r.Read()
+		c.Assert(err, IsNil)
+		return conn, r, w, f
+	}
+
+	// a client without heart-beats is neither sent them nor disconnected
+	conn, r, w, f := connect("0,0")
+	c.Check(f.Command, Equals, frame.CONNECTED)
+	c.Check(f.Header.Get(frame.HeartBeat), Equals, "0,0")
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	_, err = r.Read()
+	netErr, ok := err.(net.Error)
+	c.Assert(ok, Equals, true, Commentf("%v", err))
+	c.Check(netErr.Timeout(), Equals, true)
+	conn.SetReadDeadline(time.Time{})
+	c.Assert(w.Write(frame.New(frame.SEND, frame.Destination, "/queue/hb", frame.Receipt, "1")), IsNil)
+	f, err = r.Read()
+	c.Assert(err, IsNil)
+	c.Check(f.Command, Equals, frame.RECEIPT)
+	conn.Close()
+
+	// heart-beats are written while the client sends frames that
+	// the server does not reply to
+	conn, r, w, f = connect("0,20")
+	c.Check(f.Header.Get(frame.HeartBeat), Equals, "50,0")
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				w.Write(frame.New(frame.SEND, frame.Destination, "/topic/hb"))
+			}
+		}
+	}()
+	f, err = r.Read()
+	c.Check(err, IsNil)
+	c.Check(f, IsNil)
+	close(stop)
+	conn.Close()
+
+	// a silent client is disconnected once its interval and the grace
+	// period have passed, although the server writes heart-beats
+	conn, r, _, f = connect("100,100")
+	c.Check(f.Header.Get(frame.HeartBeat), Equals, "100,100")
+	start := time.Now()
+	heartBeats := 0
+	for {
+		f, err = r.Read()
+		if err != nil {
+			break
+		}
+		c.Check(f, IsNil)
+		heartBeats++
+	}
+	c.Check(err, Equals, io.EOF)
+	c.Check(time.Since(start) >= 150*time.Millisecond, Equals, true)
+	c.Check(heartBeats > 0, Equals, true)
+	conn.Close()
+
+	// the write interval is shortened to the maximum, but a client that
+	// cannot send heart-beats often enough is refused
+	conn, _, _, f = connect("0,5000")
+	c.Check(f.Header.Get(frame.HeartBeat), Equals, "1000,0")
+	conn.Close()
+	conn, _, _, f = connect("2000,0")
+	c.Check(f.Command, Equals, frame.ERROR)
+	c.Check(f.Header.Get(frame.Message), Equals, "heart-beat interval too long")
+	conn.Close()
+}
+
+func (s *ServerSuite) TestLimits(c *C) {
+	addr := ":59109"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	server := &Server{MaxFrameSize: 100, MaxHeaders: 5, MaxHeaderBytes: 512, MaxSubscriptionsPerConn: 2}
+	go server.Serve(l)
+	defer server.Close()
+
+	subscribe := func(id string) *frame.Frame {
+		return frame.New(frame.SUBSCRIBE, frame.Id, id, frame.Destination, "/queue/limits")
+	}
+	largeBody := frame.New(frame.SEND, frame.Destination, "/queue/limits")
+	largeBody.Body = []byte(strings.Repeat("x", 1000))
+	manyHeaders := frame.New(frame.SEND, frame.Destination, "/queue/limits")
+	for i := 0; i < 10; i++ {
+		manyHeaders.Header.Add("header-"+strconv.Itoa(i), "value")
+	}
+	largeHeader := frame.New(frame.SEND, frame.Destination, "/queue/limits", "header", strings.Repeat("x", 600))
+	testCases := []struct {
+		frames  []*frame.Frame
+		message string
+	}{
+		{[]*frame.Frame{largeBody}, "exceeded max frame size"},
+		{[]*frame.Frame{manyHeaders}, "exceeded max frame size"},
+		{[]*frame.Frame{largeHeader}, "exceeded max frame size"},
+		{[]*frame.Frame{subscribe("1"), subscribe("2"), subscribe("3")}, "too many subscriptions"},
+	}
+
+	// a client within the limits is not affected by the clients that
+	// exceed them
+	client, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer client.Disconnect()
+	sub, err := client.Subscribe("/queue/limits", stomp.AckAuto)
+	c.Assert(err, IsNil)
+
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for j, tc := range testCases {
+				conn, err := net.Dial("tcp", "127.0.0.1"+addr)
+				if !c.Check(err, IsNil) {
+					return
+				}
+				w := frame.NewWriter(conn)
+				r := frame.NewReader(conn)
+				c.Check(w.Write(frame.New(frame.CONNECT, frame.AcceptVersion, "1.2")), IsNil)
+				f, err := r.Read()
+				if c.Check(err, IsNil) {
+					c.Check(f.Command, Equals, frame.CONNECTED)
+				}
+				for _, f := range tc.frames {
+					c.Check(w.Write(f), IsNil)
+				}
+				f, err = r.Read()
+				if c.Check(err, IsNil, Commentf("test case %d", j)) {
+					c.Check(f.Command, Equals, frame.ERROR, Commentf("test case %d", j))
+					c.Check(f.Header.Get(frame.Message), Equals, tc.message, Commentf("test case %d", j))
+				}
+				_, err = r.Read()
+				c.Check(err, Equals, io.EOF, Commentf("test case %d", j))
+				conn.Close()
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		c.Assert(client.Send("/queue/limits", "text/plain", []byte(strconv.Itoa(i))), IsNil)
+		msg := <-sub.C
+		c.Assert(msg.Err, IsNil)
+		c.Check(string(msg.Body), Equals, strconv.Itoa(i))
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+}
+
+func (s *ServerSuite) TestMaxConnections(c *C) {
+	addr := ":59110"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	server := &Server{MaxConnections: 5}
+	go server.Serve(l)
+	defer server.Close()
+
+	// the connections beyond the maximum are refused, however many
+	// are opened at once
+	clients := make(chan *stomp.Conn, 20)
+	refused := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		go func() {
+			client, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+			if err != nil {
+				refused <- err
+				return
+			}
+			clients <- client
+		}()
+	}
+	var connected []*stomp.Conn
+	for i := 0; i < 20; i++ {
+		select {
+		case client := <-clients:
+			connected = append(connected, client)
+		case err := <-refused:
+			c.Check(err, ErrorMatches, ".*too many connections.*")
+		}
+	}
+	c.Assert(connected, HasLen, 5)
+
+	// the clients connected are not affected
+	for _, client := range connected[1:] {
+		c.Check(client.Send("/queue/connections", "text/plain", nil, stomp.SendOpt.Receipt), IsNil)
+	}
+
+	// a connection can be opened once another has closed
+	c.Assert(connected[0].Disconnect(), IsNil)
+	var client *stomp.Conn
+	for i := 0; i < 100 && client == nil; i++ {
+		if client, err = stomp.Dial("tcp", "127.0.0.1"+addr); err != nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	c.Assert(client, NotNil)
+	connected[0] = client
+	for _, client := range connected {
+		c.Check(client.Disconnect(), IsNil)
+	}
+}
+
+func (s *ServerSuite) TestQueuePrefixes(c *C) {
+	addr := ":59111"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	server := &Server{QueuePrefixes: []string{"/jobs/"}}
+	go server.Serve(l)
+	defer server.Close()
+
+	dial := func() *stomp.Conn {
+		client, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+		c.Assert(err, IsNil)
+		return client
+	}
+	producer := dial()
+	defer producer.Disconnect()
+	consumer1, consumer2 := dial(), dial()
+	defer consumer1.Disconnect()
+	subscribe := func(consumer *stomp.Conn) *stomp.Subscription {
+		sub, err := consumer.Subscribe("/jobs/a", stomp.AckClientIndividual)
+		c.Assert(err, IsNil)
+		// the SUBSCRIBE frame has been written once the receipt has arrived
+		c.Assert(consumer.Send("/queue/other", "text/plain", nil, stomp.SendOpt.Receipt), IsNil)
+		return sub
+	}
+	sub1, sub2 := subscribe(consumer1), subscribe(consumer2)
+
+	// the consumers take turns, and are sent no other message until
+	// they have acknowledged theirs
+	for i := 0; i < 4; i++ {
+		c.Assert(producer.Send("/jobs/a", "text/plain", []byte(strconv.Itoa(i)), stomp.SendOpt.Receipt), IsNil)
+	}
+	msg1 := <-sub1.C
+	c.Assert(msg1.Err, IsNil)
+	c.Check(string(msg1.Body), Equals, "0")
+	msg2 := <-sub2.C
+	c.Assert(msg2.Err, IsNil)
+	c.Check(string(msg2.Body), Equals, "1")
+	c.Check(msg2.Header.Get(frame.Redelivered), Equals, "")
+	select {
+	case msg := <-sub1.C:
+		c.Fatalf("unexpected message %q", msg.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Assert(consumer1.Ack(msg1), IsNil)
+	msg1 = <-sub1.C
+	c.Assert(msg1.Err, IsNil)
+	c.Check(string(msg1.Body), Equals, "2")
+
+	// the message of a consumer that disconnects without acknowledging
+	// it is delivered again
+	c.Assert(consumer2.Disconnect(), IsNil)
+	for i := 0; i < 100 && server.Stats().QueueDepths["/jobs/a"] != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(consumer1.Ack(msg1), IsNil)
+	msg1 = <-sub1.C
+	c.Assert(msg1.Err, IsNil)
+	c.Check(string(msg1.Body), Equals, "1")
+	c.Check(msg1.Header.Get(frame.Redelivered), Equals, "true")
+	c.Assert(consumer1.Ack(msg1), IsNil)
+	msg1 = <-sub1.C
+	c.Assert(msg1.Err, IsNil)
+	c.Check(string(msg1.Body), Equals, "3")
+	c.Check(msg1.Header.Get(frame.Redelivered), Equals, "")
+	c.Assert(consumer1.Ack(msg1), IsNil)
+
+	// the other destinations are topics
+	subscribers := []*stomp.Conn{dial(), dial()}
+	var subs []*stomp.Subscription
+	for _, subscriber := range subscribers {
+		defer subscriber.Disconnect()
+		sub, err := subscriber.Subscribe("/queue/a", stomp.AckAuto)
+		c.Assert(err, IsNil)
+		subs = append(subs, sub)
+		// the SUBSCRIBE frame has been written once the receipt has arrived
+		c.Assert(subscriber.Send("/queue/other", "text/plain", nil, stomp.SendOpt.Receipt), IsNil)
+	}
+	c.Assert(producer.Send("/queue/a", "text/plain", []byte("fan-out")), IsNil)
+	for _, sub := range subs {
+		msg := <-sub.C
+		c.Assert(msg.Err, IsNil)
+		c.Check(string(msg.Body), Equals, "fan-out")
+	}
+}
+
+func (s *ServerSuite) TestSlowTopicSubscriber(c *C) {
+	addr := ":59112"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	server := &Server{}
+	go server.Serve(l)
+	defer server.Close()
+
+	// a subscriber that reads nothing
+	slow, err := net.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer slow.Close()
+	w := frame.NewWriter(slow)
+	r := frame.NewReader(slow)
+	c.Assert(w.Write(frame.New(frame.CONNECT, frame.AcceptVersion, "1.2")), IsNil)
+	f, err := r.Read()
+	c.Assert(err, IsNil)
+	c.Assert(f.Command, Equals, frame.CONNECTED)
+	c.Assert(w.Write(frame.New(frame.SUBSCRIBE, frame.Id, "1", frame.Destination, "/topic/slow")), IsNil)
+	c.Assert(w.Write(frame.New(frame.SEND, frame.Destination, "/queue/other", frame.Receipt, "1")), IsNil)
+	f, err = r.Read()
+	c.Assert(err, IsNil)
+	c.Assert(f.Command, Equals, frame.RECEIPT)
+
+	client, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer client.Disconnect()
+	sub, err := client.Subscribe("/topic/slow", stomp.AckAuto)
+	c.Assert(err, IsNil)
+	c.Assert(client.Send("/queue/other", "text/plain", nil, stomp.SendOpt.Receipt), IsNil)
+
+	// the other subscriber receives every message, although the slow
+	// one has fallen behind, which is then disconnected
+	producer, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer producer.Disconnect()
+	body := []byte(strings.Repeat("x", 32768))
+	for i := 0; i < 2000; i++ {
+		c.Assert(producer.Send("/topic/slow", "text/plain", body), IsNil)
+		msg := <-sub.C
+		c.Assert(msg.Err, IsNil)
+	}
+	slow.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for err == nil {
+		_, err = r.Read()
+	}
+	netErr, ok := err.(net.Error)
+	c.Check(ok && netErr.Timeout(), Equals, false, Commentf("%v", err))
+}
+
+func (s *ServerSuite) TestBrowse(c *C) {
+	addr := ":59113"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	server := &Server{}
+	go server.Serve(l)
+	defer server.Close()
+
+	producer, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer producer.Disconnect()
+	for i := 0; i < 100; i++ {
+		c.Assert(producer.Send("/queue/browse", "text/plain", []byte(strconv.Itoa(i)), stomp.SendOpt.Receipt), IsNil)
+	}
+
+	// the browser sees the messages in the queue when it subscribed,
+	// while the producer keeps sending more
+	stop := make(chan struct{})
+	sent := make(chan int)
+	go func() {
+		i := 100
+		defer func() { sent <- i }()
+		for ; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if producer.Send("/queue/browse", "text/plain", []byte(strconv.Itoa(i)), stomp.SendOpt.Receipt) != nil {
+				return
+			}
+		}
+	}()
+	browser, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer browser.Disconnect()
+	sub, err := browser.Subscribe("/queue/browse", stomp.AckAuto, stomp.SubscribeOpt.Header("browser", "true"))
+	c.Assert(err, IsNil)
+	browsed := 0
+	for {
+		msg := <-sub.C
+		c.Assert(msg.Err, IsNil)
+		if msg.Header.Get("browser") == "end" {
+			c.Check(msg.Body, HasLen, 0)
+			break
+		}
+		c.Assert(string(msg.Body), Equals, strconv.Itoa(browsed))
+		browsed++
+	}
+	close(stop)
+	total := <-sent
+	c.Check(browsed >= 100 && browsed <= total, Equals, true, Commentf("browsed %d of %d", browsed, total))
+
+	// the messages browsed have not been consumed
+	consumer, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer consumer.Disconnect()
+	sub, err = consumer.Subscribe("/queue/browse", stomp.AckAuto)
+	c.Assert(err, IsNil)
+	for i := 0; i < total; i++ {
+		msg := <-sub.C
+		c.Assert(msg.Err, IsNil)
+		c.Assert(string(msg.Body), Equals, strconv.Itoa(i))
+	}
+}
+
+func (s *ServerSuite) TestShutdown(c *C) {
+	path := filepath.Join(c.MkDir(), "queues.log")
+	qs, err := queue.OpenFileStorage(path)
+	c.Assert(err, IsNil)
+
+	addr := ":59103"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	server := &Server{Storage: qs}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+
+	client, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	for i := 1; i <= 3; i++ {
+		c.Assert(client.Send("/queue/drain", "text/plain", []byte(fmt.Sprintf("message %d", i)), stomp.SendOpt.Receipt), IsNil)
+	}
+	sub, err := client.Subscribe("/queue/drain", stomp.AckClientIndividual)
+	c.Assert(err, IsNil)
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(string(msg.Body), Equals, "message 1")
+	c.Assert(client.Ack(msg), IsNil)
+
+	// the second message has been handed to the consumer, but it has
+	// not been acknowledged when the server shuts down
+	msg = <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(string(msg.Body), Equals, "message 2")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.Assert(server.Shutdown(ctx), IsNil)
+	c.Check(<-served, Equals, ErrServerClosed)
+	msg = <-sub.C
+	c.Assert(msg.Err, NotNil)
+	c.Check(msg.Err.Error(), Matches, ".*"+DefaultShutdownMessage+".*")
+
+	// no connections are accepted, and the server cannot serve again
+	_, err = net.Dial("tcp", "127.0.0.1"+addr)
+	c.Check(err, NotNil)
+	l, err = net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	c.Check(server.Serve(l), Equals, ErrServerClosed)
+
+	// the storage has been stopped, and the messages not acknowledged
+	// are delivered by the next server
+	qs, err = queue.OpenFileStorage(path)
+	c.Assert(err, IsNil)
+	server = &Server{Storage: qs}
+	l, err = net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	go server.Serve(l)
+	defer server.Close()
+
+	client, err = stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer client.Disconnect()
+	sub, err = client.Subscribe("/queue/drain", stomp.AckAuto)
+	c.Assert(err, IsNil)
+	for _, expected := range []string{"message 2", "message 3"} {
+		msg := <-sub.C
+		c.Assert(msg.Err, IsNil)
+		c.Check(string(msg.Body), Equals, expected)
+	}
+}
+
+func (s *ServerSuite) TestShutdownDeadline(c *C) {
+	addr := ":59104"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	server := &Server{ShutdownQuietly: true}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+
+	client, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	sub, err := client.Subscribe("/queue/deadline", stomp.AckAuto)
+	c.Assert(err, IsNil)
+	c.Assert(client.Send("/queue/other", "text/plain", nil, stomp.SendOpt.Receipt), IsNil)
+
+	// the client does not disconnect, so its connection is closed once
+	// the deadline has passed
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c.Check(server.Shutdown(ctx), Equals, context.DeadlineExceeded)
+	c.Check(<-served, Equals, ErrServerClosed)
+	msg := <-sub.C
+	c.Check(msg.Err, NotNil)
+
+	// Close does not wait for the clients
+	l, err = net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	server = &Server{}
+	go func() { served <- server.Serve(l) }()
+	client, err = stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	sub, err = client.Subscribe("/queue/deadline", stomp.AckAuto)
+	c.Assert(err, IsNil)
+	// the SUBSCRIBE frame has been written once the receipt has arrived
+	c.Assert(client.Send("/queue/other", "text/plain", nil, stomp.SendOpt.Receipt), IsNil)
+	c.Check(server.Close(), IsNil)
+	c.Check(<-served, Equals, ErrServerClosed)
+	msg = <-sub.C
+	c.Check(msg.Err, NotNil)
+}
+
+func (s *ServerSuite) TestSendRateLimit(c *C) {
+	addr := ":59114"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	server := &Server{SendRateLimit: RateLimit{FramesPerSecond: 20}}
+	go server.Serve(l)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	w := frame.NewWriter(conn)
+	r := frame.NewReader(conn)
+	c.Assert(w.Write(frame.New(frame.CONNECT, frame.AcceptVersion, "1.2")), IsNil)
+	f, err := r.Read()
+	c.Assert(err, IsNil)
+	c.Assert(f.Command, Equals, frame.CONNECTED)
+
+	// a burst of a second of frames is processed at once, and the frames
+	// beyond it are delayed
+	start := time.Now()
+	for i := 0; i < 29; i++ {
+		c.Assert(w.Write(frame.New(frame.SEND, frame.Destination, "/queue/rate")), IsNil)
+	}
+	c.Assert(w.Write(frame.New(frame.SEND, frame.Destination, "/queue/rate", frame.Receipt, "1")), IsNil)
+	f, err = r.Read()
+	c.Assert(err, IsNil)
+	c.Assert(f.Command, Equals, frame.RECEIPT)
+	c.Check(time.Since(start) >= 400*time.Millisecond, Equals, true)
+
+	// the other clients have their own limits
+	client, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer client.Disconnect()
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		c.Assert(client.Send("/queue/rate", "text/plain", nil, stomp.SendOpt.Receipt), IsNil)
+	}
+	c.Check(time.Since(start) < 400*time.Millisecond, Equals, true)
+
+	// the limit changes for the clients connected, and a client that
+	// exceeds it is disconnected
+	server.SetSendRateLimit(RateLimit{FramesPerSecond: 5, Policy: RateLimitReject})
+	for i := 0; i < 20; i++ {
+		w.Write(frame.New(frame.SEND, frame.Destination, "/queue/rate"))
+	}
+	f, err = r.Read()
+	c.Assert(err, IsNil)
+	c.Check(f.Command, Equals, frame.ERROR)
+	c.Check(f.Header.Get(frame.Message), Equals, "send rate exceeded")
+	_, err = r.Read()
+	c.Check(err, Equals, io.EOF)
+
+	for i := 0; i < 3; i++ {
+		c.Check(client.Send("/queue/rate", "text/plain", nil, stomp.SendOpt.Receipt), IsNil)
+	}
+	c.Check(server.Stats().QueueDepths["/queue/rate"] >= 43, Equals, true)
+}
+
+func (s *ServerSuite) TestScheduling(c *C) {
+	addr := ":59115"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	server := &Server{PriorityQueues: true, DelayedDelivery: true}
+	go server.Serve(l)
+	defer server.Close()
+
+	producer, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer producer.Disconnect()
+	consumer, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer consumer.Disconnect()
+
+	// the messages waiting are delivered by priority
+	for i, priority := range []int{1, 9, 4, 9, 0} {
+		body := []byte(strconv.Itoa(i))
+		c.Assert(producer.Send("/queue/scheduling", "text/plain", body, stomp.SendOpt.Priority(priority), stomp.SendOpt.Receipt), IsNil)
+	}
+	sub, err := consumer.Subscribe("/queue/scheduling", stomp.AckAuto)
+	c.Assert(err, IsNil)
+	for _, expected := range []string{"1", "3", "2", "0", "4"} {
+		msg := <-sub.C
+		c.Assert(msg.Err, IsNil)
+		c.Check(string(msg.Body), Equals, expected)
+	}
+
+	// a delayed message is delivered once its delay has passed
+	start := time.Now()
+	c.Assert(producer.Send("/queue/scheduling", "text/plain", []byte("later"), stomp.SendOpt.Header("delay-ms", "500")), IsNil)
+	c.Assert(producer.Send("/queue/scheduling", "text/plain", []byte("sooner"), stomp.SendOpt.Header("scheduled-delay", "200")), IsNil)
+	c.Assert(producer.Send("/queue/scheduling", "text/plain", []byte("now"), stomp.SendOpt.Receipt), IsNil)
+	for _, expected := range []string{"now", "sooner", "later"} {
+		msg := <-sub.C
+		c.Assert(msg.Err, IsNil)
+		c.Check(string(msg.Body), Equals, expected)
+		elapsed := time.Since(start)
+		switch expected {
+		case "now":
+			c.Check(elapsed < 500*time.Millisecond, Equals, true, Commentf("%v", elapsed))
+		case "sooner":
+			c.Check(elapsed >= 200*time.Millisecond, Equals, true, Commentf("%v", elapsed))
+		case "later":
+			c.Check(elapsed >= 500*time.Millisecond && elapsed < 1500*time.Millisecond, Equals, true, Commentf("%v", elapsed))
+		}
+	}
+}
+
+func (s *ServerSuite) TestDurable(c *C) {
+	addr := ":59116"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	server := &Server{DurableBufferSize: 3}
+	go server.Serve(l)
+	defer server.Close()
+
+	producer, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	defer producer.Disconnect()
+	send := func(bodies ...string) {
+		for _, body := range bodies {
+			c.Assert(producer.Send("/topic/orders", "text/plain", []byte(body), stomp.SendOpt.Receipt), IsNil)
+		}
+	}
+	subscribe := func() (*stomp.Conn, *stomp.Subscription) {
+		conn, err := stomp.Dial("tcp", "127.0.0.1"+addr, stomp.ConnOpt.Header("client-id", "client-1"))
+		c.Assert(err, IsNil)
+		sub, err := conn.Subscribe("/topic/orders", stomp.AckAuto, stomp.SubscribeOpt.Durable("orders", stomp.BrokerActiveMQ))
+		c.Assert(err, IsNil)
+		c.Assert(conn.Send("/queue/other", "text/plain", nil, stomp.SendOpt.Receipt), IsNil)
+		return conn, sub
+	}
+	receive := func(sub *stomp.Subscription, bodies ...string) {
+		for _, body := range bodies {
+			msg := <-sub.C
+			c.Assert(msg.Err, IsNil)
+			c.Check(string(msg.Body), Equals, body)
+		}
+	}
+	disconnect := func(conn *stomp.Conn) {
+		c.Assert(conn.Disconnect(), IsNil)
+		for i := 0; i < 100 && server.Stats().Connections != 1; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Assert(server.Stats().Connections, Equals, 1)
+	}
+
+	// a subscription requires a client-id to be durable
+	conn, err := stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	sub, err := conn.Subscribe("/topic/orders", stomp.AckAuto, stomp.SubscribeOpt.Durable("orders", stomp.BrokerActiveMQ))
+	c.Assert(err, IsNil)
+	msg := <-sub.C
+	c.Check(msg.Err, ErrorMatches, ".*durable subscription requires client-id.*")
+	conn.Disconnect()
+
+	conn, sub = subscribe()
+	send("1")
+	receive(sub, "1")
+
+	// the messages sent while the client is disconnected are delivered
+	// when it subscribes again, up to the size of the buffer
+	disconnect(conn)
+	send("2", "3", "4", "5")
+	conn, sub = subscribe()
+	send("6")
+	receive(sub, "3", "4", "5", "6")
+
+	// the durable subscription is removed by an UNSUBSCRIBE frame
+	disconnect(conn)
+	send("7")
+	raw, err := net.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	w := frame.NewWriter(raw)
+	r := frame.NewReader(raw)
+	c.Assert(w.Write(frame.New(frame.CONNECT, frame.AcceptVersion, "1.2", "client-id", "client-1")), IsNil)
+	f, err := r.Read()
+	c.Assert(err, IsNil)
+	c.Assert(f.Command, Equals, frame.CONNECTED)
+	c.Assert(w.Write(frame.New(frame.UNSUBSCRIBE, frame.Id, "orders", "activemq.subscriptionName", "orders")), IsNil)
+	c.Assert(w.Write(frame.New(frame.SEND, frame.Destination, "/queue/other", frame.Receipt, "1")), IsNil)
+	f, err = r.Read()
+	c.Assert(err, IsNil)
+	c.Assert(f.Command, Equals, frame.RECEIPT)
+	raw.Close()
+	send("8")
+	conn, sub = subscribe()
+	send("9")
+	receive(sub, "9")
+	c.Check(conn.Disconnect(), IsNil)
+
+	// a full buffer can reject the producer instead
+	addr = ":59117"
+	l, err = net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	server = &Server{DurableBufferSize: 1, DurableOverflow: RejectProducer}
+	go server.Serve(l)
+	defer server.Close()
+	producer, err = stomp.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	conn, _ = subscribe()
+	disconnect(conn)
+	send("1")
+	err = producer.Send("/topic/orders", "text/plain", []byte("2"))
+	for i := 0; i < 100 && err == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		err = producer.Send("/topic/orders", "text/plain", []byte("2"))
+	}
+	c.Check(err, NotNil)
+	conn, sub = subscribe()
+	receive(sub, "1")
+	c.Check(conn.Disconnect(), IsNil)
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+// testCA issues the certificates of the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(c *C) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for the server at 127.0.0.1, or for a
+// client, with the common name specified.
+func (ca *testCA) issue(c *C, commonName string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	c.Assert(err, IsNil)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Authenticates the clients from the common names of their certificates.
+type certificateAuthenticator struct {
+	names chan string
+}
+
+func (a certificateAuthenticator) AuthenticateFrame(f *frame.Frame) (Principal, error) {
+	return nil, errors.New("not called for TLS authenticators")
+}
+
+func (a certificateAuthenticator) AuthenticateTLS(f *frame.Frame, state *tls.ConnectionState) (Principal, error) {
+	cert := verifiedCertificate(state)
+	if cert == nil {
+		return nil, errors.New("no certificate")
+	}
+	a.names <- cert.Subject.CommonName
+	return loginPrincipal(cert.Subject.CommonName), nil
+}
+
+func (s *ServerSuite) TestTLS(c *C) {
+	ca := newTestCA(c)
+	serverCert := ca.issue(c, "server", x509.ExtKeyUsageServerAuth)
+	clientTLS := &tls.Config{RootCAs: ca.pool}
+
+	addr := ":59105"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	server := &Server{TLSConfig: &tls.Config{Certificates: []tls.Certificate{serverCert}}}
+	go server.Serve(l)
+	defer server.Close()
+
+	// a client that does not use TLS is refused, without stopping the
+	// accept loop
+	raw, err := net.Dial("tcp", "127.0.0.1"+addr)
+	c.Assert(err, IsNil)
+	c.Assert(frame.NewWriter(raw).Write(frame.New(frame.CONNECT, frame.AcceptVersion, "1.2")), IsNil)
+	_, err = frame.NewReader(raw).Read()
+	c.Check(err, NotNil)
+	raw.Close()
+
+	client, err := stomp.DialTLS("tcp", "127.0.0.1"+addr, clientTLS)
+	c.Assert(err, IsNil)
+	sub, err := client.Subscribe("/queue/tls", stomp.AckAuto)
+	c.Assert(err, IsNil)
+	c.Assert(client.Send("/queue/tls", "text/plain", []byte("secret")), IsNil)
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(string(msg.Body), Equals, "secret")
+	c.Check(client.Disconnect(), IsNil)
+}
+
+func (s *ServerSuite) TestMutualTLS(c *C) {
+	ca := newTestCA(c)
+	serverCert := ca.issue(c, "server", x509.ExtKeyUsageServerAuth)
+	clientCert := ca.issue(c, "client-1", x509.ExtKeyUsageClientAuth)
+	serverTLS := &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+
+	addr := ":59106"
+	l, err := net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	server := &Server{
+		TLSConfig: serverTLS,
+		Authorizer: RuleAuthorizer{
+			{Principal: "client-1", Send: []string{"/queue/mtls"}, Subscribe: []string{"/queue/mtls"}},
+		},
+	}
+	go server.Serve(l)
+	defer server.Close()
+
+	// a client without a certificate fails the handshake
+	_, err = stomp.DialTLS("tcp", "127.0.0.1"+addr, &tls.Config{RootCAs: ca.pool})
+	c.Check(err, NotNil)
+
+	// the principal of the client is named by its certificate, and it
+	// is authorized by its name
+	client, err := stomp.DialTLS("tcp", "127.0.0.1"+addr, &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{clientCert}})
+	c.Assert(err, IsNil)
+	sub, err := client.Subscribe("/queue/mtls", stomp.AckAuto)
+	c.Assert(err, IsNil)
+	c.Assert(client.Send("/queue/mtls", "text/plain", []byte("mutual")), IsNil)
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(string(msg.Body), Equals, "mutual")
+	c.Check(client.Disconnect(), IsNil)
+
+	// the certificate is given to a TLS authenticator
+	addr = ":59107"
+	l, err = net.Listen("tcp", addr)
+	c.Assert(err, IsNil)
+	names := make(chan string, 1)
+	server = &Server{TLSConfig: serverTLS, FrameAuthenticator: certificateAuthenticator{names}}
+	go server.Serve(l)
+	defer server.Close()
+	client, err = stomp.DialTLS("tcp", "127.0.0.1"+addr, &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{clientCert}})
+	c.Assert(err, IsNil)
+	c.Check(<-names, Equals, "client-1")
+	c.Check(client.Disconnect(), IsNil)
+}
+
+func (s *ServerSuite) TestCertificatePrincipal(c *C) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client-1"}}
+	state := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	f := frame.New(frame.CONNECT, frame.Login, "user", frame.Passcode, "secret")
+
+	principal, err := newConfig(&Server{}).Authenticate(f, state)
+	c.Assert(err, IsNil)
+	c.Check(principal, Equals, CertificatePrincipal{Certificate: cert})
+	c.Check(principal.Name(), Equals, "client-1")
+
+	principal, err = newConfig(&Server{Authenticator: testAuthenticator{}}).Authenticate(f, state)
+	c.Assert(err, IsNil)
+	c.Check(principal, Equals, CertificatePrincipal{Login: "user", Certificate: cert})
+	c.Check(principal.Name(), Equals, "user")
+
+	// a certificate that has not been verified is ignored
+	principal, err = newConfig(&Server{}).Authenticate(f, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	c.Assert(err, IsNil)
+	c.Check(principal, IsNil)
+}
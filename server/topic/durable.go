@@ -0,0 +1,122 @@
+package topic
+
+import (
+	"errors"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// An OverflowPolicy determines what happens to a message sent to a
+// topic when an inactive durable subscription to the topic has
+// buffered as many messages as the limit set by SetDurableLimit.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest message buffered, to make room.
+	DropOldest OverflowPolicy = iota
+
+	// RejectProducer rejects the message: it is sent to none of the
+	// subscriptions, and Enqueue returns ErrBufferFull.
+	RejectProducer
+)
+
+// Returned by Enqueue for a message rejected by a durable subscription
+// whose buffer is full.
+var ErrBufferFull = errors.New("durable subscription buffer full")
+
+// A durable subscription stays subscribed to its topic while no client
+// is subscribed to it, and buffers the messages sent to the topic in
+// the meantime.
+type durable struct {
+	destination string
+	sub         Subscription   // nil while inactive
+	buffer      []*frame.Frame // messages sent while inactive
+	limit       int            // most messages buffered, no maximum if zero
+	policy      OverflowPolicy
+}
+
+func (d *durable) SendTopicFrame(f *frame.Frame) {
+	if d.sub != nil {
+		d.sub.SendTopicFrame(f)
+		return
+	}
+	if d.limit > 0 && len(d.buffer) >= d.limit {
+		// the policy is DropOldest, RejectProducer is checked before
+		clear(d.buffer[:len(d.buffer)-d.limit+1])
+		d.buffer = d.buffer[len(d.buffer)-d.limit+1:]
+	}
+	d.buffer = append(d.buffer, f)
+}
+
+// full reports whether the durable subscription rejects another message.
+func (d *durable) full() bool {
+	return d.sub == nil && d.policy == RejectProducer && d.limit > 0 && len(d.buffer) >= d.limit
+}
+
+// Limits the number of messages buffered by each inactive durable
+// subscription, with the policy for the messages beyond the limit.
+// There is no limit if limit is zero. The limit applies to the durable
+// subscriptions created afterwards.
+func (tm *Manager) SetDurableLimit(limit int, policy OverflowPolicy) {
+	tm.durableLimit = limit
+	tm.durablePolicy = policy
+}
+
+// SubscribeDurable subscribes sub to the destination as the durable
+// subscription identified by key, creating the durable subscription
+// if necessary, and returns the messages that it has buffered, which
+// must be sent to sub before the messages sent to sub from then on.
+// A client subscribed to the durable subscription is replaced by sub,
+// and a durable subscription to another destination is replaced by
+// a new one, whose buffered messages are discarded.
+func (tm *Manager) SubscribeDurable(key, destination string, sub Subscription) []*frame.Frame {
+	d, ok := tm.durables[key]
+	if ok && d.destination != destination {
+		tm.RemoveDurable(key)
+		ok = false
+	}
+	if !ok {
+		d = &durable{destination: destination, limit: tm.durableLimit, policy: tm.durablePolicy}
+		if tm.durables == nil {
+			tm.durables = make(map[string]*durable)
+			tm.attached = make(map[Subscription]*durable)
+		}
+		tm.durables[key] = d
+		tm.Subscribe(destination, d)
+	}
+	if d.sub != nil {
+		delete(tm.attached, d.sub)
+	}
+	d.sub = sub
+	tm.attached[sub] = d
+	buffer := d.buffer
+	d.buffer = nil
+	return buffer
+}
+
+// RemoveDurable removes the durable subscription identified by key,
+// and reports whether there was one. A client subscribed to it no
+// longer receives messages.
+func (tm *Manager) RemoveDurable(key string) bool {
+	d, ok := tm.durables[key]
+	if !ok {
+		return false
+	}
+	delete(tm.durables, key)
+	if d.sub != nil {
+		delete(tm.attached, d.sub)
+	}
+	tm.Unsubscribe(d.destination, d)
+	return true
+}
+
+// rejects reports whether a durable subscription among subs rejects
+// another message.
+func rejects(subs []Subscription) bool {
+	for _, sub := range subs {
+		if d, ok := sub.(*durable); ok && d.full() {
+			return true
+		}
+	}
+	return false
+}
@@ -1,18 +1,43 @@
 package topic
 
+import (
+	"github.com/go-stomp/stomp/frame"
+)
+
 // Manager is a struct responsible for finding topics. Topics are
 // not created by the package user, rather they are created on demand
 // by the topic manager.
 type Manager struct {
-	topics map[string]*Topic
+	topics    map[string]*Topic
+	wildcards *Wildcards
+	patterns  *node          // subscriptions to destinations with wildcards
+	matched   []Subscription // reused by Enqueue
+
+	durables      map[string]*durable       // durable subscriptions, by key
+	attached      map[Subscription]*durable // durable subscriptions, by the client subscribed
+	durableLimit  int
+	durablePolicy OverflowPolicy
 }
 
-// NewManager creates a new topic manager.
+// NewManager creates a new topic manager, which matches destinations
+// exactly.
 func NewManager() *Manager {
 	tm := &Manager{topics: make(map[string]*Topic)}
 	return tm
 }
 
+// NewWildcardManager creates a new topic manager, which matches
+// hierarchical destinations with the wildcards specified. A
+// subscription to a destination with a wildcard receives the messages
+// sent to every matching destination, and a subscription to another
+// destination receives the messages sent to that destination only.
+func NewWildcardManager(wildcards Wildcards) *Manager {
+	tm := NewManager()
+	tm.wildcards = &wildcards
+	tm.patterns = newNode("")
+	return tm
+}
+
 // Finds the topic for the given destination, and creates it if necessary.
 func (tm *Manager) Find(destination string) *Topic {
 	t, ok := tm.topics[destination]
@@ -22,3 +47,70 @@ func (tm *Manager) Find(destination string) *Topic {
 	}
 	return t
 }
+
+// Subscribe adds a subscription to the destination, which may contain
+// wildcards if the manager was created with NewWildcardManager.
+func (tm *Manager) Subscribe(destination string, sub Subscription) {
+	if tm.isPattern(destination) {
+		tm.patterns.add(destination, tm.wildcards.Separator).Subscribe(sub)
+		return
+	}
+	tm.Find(destination).Subscribe(sub)
+}
+
+// Unsubscribe removes a subscription added to the destination by
+// Subscribe. A subscription added by SubscribeDurable is removed from
+// its durable subscription, which then buffers the messages sent to
+// the destination.
+func (tm *Manager) Unsubscribe(destination string, sub Subscription) {
+	if d, ok := tm.attached[sub]; ok {
+		delete(tm.attached, sub)
+		d.sub = nil
+		return
+	}
+	if tm.isPattern(destination) {
+		tm.patterns.remove(destination, tm.wildcards.Separator, sub)
+		return
+	}
+	if t, ok := tm.topics[destination]; ok {
+		t.Unsubscribe(sub)
+	}
+}
+
+// Enqueue sends a message to the destination. All subscriptions to the
+// destination, and to the destinations with wildcards that match it,
+// receive a copy of the message, unless a durable subscription whose
+// buffer is full rejects it, when ErrBufferFull is returned.
+func (tm *Manager) Enqueue(destination string, f *frame.Frame) error {
+	t := tm.topics[destination]
+	if len(tm.durables) == 0 && (tm.patterns == nil || tm.patterns.empty()) {
+		if t != nil {
+			t.Enqueue(f)
+		}
+		return nil
+	}
+
+	subs := tm.matched[:0]
+	if t != nil {
+		subs = t.appendSubscriptions(subs)
+	}
+	if tm.patterns != nil {
+		subs = tm.patterns.match(destination, false, tm.wildcards, subs)
+	}
+	var err error
+	if rejects(subs) {
+		err = ErrBufferFull
+	} else {
+		sendAll(subs, f)
+	}
+
+	// do not keep the subscriptions from being collected
+	clear(subs)
+	tm.matched = subs[:0]
+	return err
+}
+
+// isPattern reports whether the destination contains wildcards.
+func (tm *Manager) isPattern(destination string) bool {
+	return tm.wildcards != nil && tm.wildcards.match(destination)
+}
@@ -1,6 +1,10 @@
 package topic
 
 import (
+	"fmt"
+	"testing"
+
+	"github.com/go-stomp/stomp/frame"
 	. "gopkg.in/check.v1"
 )
 
@@ -19,3 +23,203 @@ func (s *ManagerSuite) TestManager(c *C) {
 
 	c.Assert(mgr.Find("topic1"), Equals, t1)
 }
+
+var testWildcards = Wildcards{Separator: ".", Wildcard: "*", Recursive: ">"}
+
+func (s *ManagerSuite) TestWildcards(c *C) {
+	mgr := NewWildcardManager(testWildcards)
+	subs := make(map[string]*fakeSubscription)
+	for _, destination := range []string{
+		"/topic/orders.created",
+		"/topic/orders.*",
+		"/topic/orders.>",
+		"*.created",
+		"/topic/orders.*.created",
+		"/topic/orders.>.created",
+		"*",
+		">",
+	} {
+		subs[destination] = &fakeSubscription{}
+		mgr.Subscribe(destination, subs[destination])
+	}
+
+	testCases := []struct {
+		destination string
+		matches     []string
+	}{
+		{"/topic/orders.created", []string{"/topic/orders.created", "/topic/orders.*", "/topic/orders.>", "*.created", ">"}},
+		{"/topic/orders.eu.created", []string{"/topic/orders.>", "/topic/orders.*.created", ">"}},
+		{"/topic/orders", []string{"*", ">"}},
+		{"/topic/orders.>", []string{"/topic/orders.*", "/topic/orders.>", ">"}},
+		{"/topic/orders.>.created", []string{"/topic/orders.>", "/topic/orders.*.created", "/topic/orders.>.created", ">"}},
+		{"/topic/prices.created", []string{"*.created", ">"}},
+	}
+	for i, tc := range testCases {
+		f := frame.New(frame.MESSAGE, frame.Destination, tc.destination)
+		mgr.Enqueue(tc.destination, f)
+
+		received := 0
+		for destination, sub := range subs {
+			expected := 0
+			for _, match := range tc.matches {
+				if match == destination {
+					expected = 1
+				}
+			}
+			c.Check(len(sub.Frames), Equals, expected, Commentf("test case %d: %s", i, destination))
+			received += len(sub.Frames)
+			if len(sub.Frames) > 0 {
+				c.Check(sub.Frames[0].Header.Get(frame.Destination), Equals, tc.destination)
+			}
+			sub.Frames = nil
+		}
+		c.Check(received, Equals, len(tc.matches), Commentf("test case %d", i))
+	}
+}
+
+func (s *ManagerSuite) TestWildcardsUnsubscribe(c *C) {
+	mgr := NewWildcardManager(testWildcards)
+	sub1 := &fakeSubscription{}
+	sub2 := &fakeSubscription{}
+	mgr.Subscribe("/topic/orders.*", sub1)
+	mgr.Subscribe("/topic/orders.*", sub2)
+	mgr.Subscribe("/topic/orders.created", sub2)
+
+	// each subscription receives a copy, except the last
+	f := frame.New(frame.MESSAGE, frame.Destination, "/topic/orders.created")
+	mgr.Enqueue("/topic/orders.created", f)
+	c.Assert(len(sub1.Frames), Equals, 1)
+	c.Assert(len(sub2.Frames), Equals, 2)
+	c.Check(sub1.Frames[0], Not(Equals), f)
+	c.Check(sub2.Frames[0], Not(Equals), f)
+	c.Check(sub2.Frames[1], Equals, f)
+
+	mgr.Unsubscribe("/topic/orders.*", sub1)
+	mgr.Unsubscribe("/topic/orders.*", sub2)
+	c.Check(mgr.patterns.empty(), Equals, true)
+	mgr.Unsubscribe("/topic/orders.*", sub2)
+
+	mgr.Enqueue("/topic/orders.created", f)
+	c.Check(len(sub1.Frames), Equals, 1)
+	c.Check(len(sub2.Frames), Equals, 3)
+}
+
+func (s *ManagerSuite) TestExactManager(c *C) {
+	mgr := NewManager()
+	sub := &fakeSubscription{}
+	mgr.Subscribe("/topic/orders.*", sub)
+
+	mgr.Enqueue("/topic/orders.created", frame.New(frame.MESSAGE))
+	c.Check(len(sub.Frames), Equals, 0)
+	mgr.Enqueue("/topic/orders.*", frame.New(frame.MESSAGE))
+	c.Check(len(sub.Frames), Equals, 1)
+
+	mgr.Unsubscribe("/topic/orders.*", sub)
+	mgr.Enqueue("/topic/orders.*", frame.New(frame.MESSAGE))
+	c.Check(len(sub.Frames), Equals, 1)
+}
+
+type countingSubscription struct {
+	count int
+}
+
+func (s *countingSubscription) SendTopicFrame(f *frame.Frame) {
+	s.count++
+}
+
+// benchmarkEnqueue sends messages to one of n destinations, each with a
+// subscriber, and to which the subscriptions to the patterns also apply.
+func benchmarkEnqueue(b *testing.B, mgr *Manager, n int, patterns ...string) {
+	for i := 0; i < n; i++ {
+		mgr.Subscribe(fmt.Sprintf("/topic/orders.%d.created", i), &countingSubscription{})
+	}
+	for _, pattern := range patterns {
+		mgr.Subscribe(pattern, &countingSubscription{})
+	}
+	f := frame.New(frame.MESSAGE, frame.Destination, "/topic/orders.42.created")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mgr.Enqueue("/topic/orders.42.created", f)
+	}
+}
+
+func BenchmarkEnqueueExact(b *testing.B) {
+	benchmarkEnqueue(b, NewManager(), 10000)
+}
+
+func BenchmarkEnqueueWithoutPatterns(b *testing.B) {
+	benchmarkEnqueue(b, NewWildcardManager(testWildcards), 10000)
+}
+
+func BenchmarkEnqueueWildcards(b *testing.B) {
+	mgr := NewWildcardManager(testWildcards)
+	for i := 0; i < 10000; i++ {
+		mgr.Subscribe(fmt.Sprintf("/topic/orders.%d.*", i), &countingSubscription{})
+		mgr.Subscribe(fmt.Sprintf("/topic/prices.%d.>", i), &countingSubscription{})
+	}
+	benchmarkEnqueue(b, mgr, 10000, "/topic/orders.*.created", "/topic/orders.>")
+}
+
+func (s *ManagerSuite) TestDurable(c *C) {
+	mgr := NewWildcardManager(testWildcards)
+	mgr.SetDurableLimit(3, DropOldest)
+	send := func(destination, body string) error {
+		f := frame.New(frame.MESSAGE, frame.Destination, destination)
+		f.Body = []byte(body)
+		return mgr.Enqueue(destination, f)
+	}
+	bodies := func(frames []*frame.Frame) []string {
+		var bodies []string
+		for _, f := range frames {
+			bodies = append(bodies, string(f.Body))
+		}
+		return bodies
+	}
+
+	sub1 := &fakeSubscription{}
+	c.Check(mgr.SubscribeDurable("client-1 orders", "/topic/orders.*", sub1), HasLen, 0)
+	c.Assert(send("/topic/orders.created", "1"), IsNil)
+	c.Check(bodies(sub1.Frames), DeepEquals, []string{"1"})
+
+	// the messages are buffered while the client is not subscribed,
+	// and the oldest are dropped
+	mgr.Unsubscribe("/topic/orders.*", sub1)
+	for _, body := range []string{"2", "3", "4", "5"} {
+		c.Assert(send("/topic/orders.created", body), IsNil)
+	}
+	c.Assert(send("/topic/prices.created", "6"), IsNil)
+	sub2 := &fakeSubscription{}
+	c.Check(bodies(mgr.SubscribeDurable("client-1 orders", "/topic/orders.*", sub2)), DeepEquals, []string{"3", "4", "5"})
+	c.Assert(send("/topic/orders.created", "7"), IsNil)
+	c.Check(bodies(sub1.Frames), DeepEquals, []string{"1"})
+	c.Check(bodies(sub2.Frames), DeepEquals, []string{"7"})
+
+	// a client subscribing replaces the one subscribed
+	sub3 := &fakeSubscription{}
+	c.Check(mgr.SubscribeDurable("client-1 orders", "/topic/orders.*", sub3), HasLen, 0)
+	c.Assert(send("/topic/orders.created", "8"), IsNil)
+	c.Check(bodies(sub2.Frames), DeepEquals, []string{"7"})
+	c.Check(bodies(sub3.Frames), DeepEquals, []string{"8"})
+
+	// a full buffer rejects the messages, which no subscription receives
+	mgr.SetDurableLimit(2, RejectProducer)
+	other := &fakeSubscription{}
+	mgr.Subscribe("/topic/news", other)
+	c.Check(mgr.SubscribeDurable("client-2 news", "/topic/news", &fakeSubscription{}), HasLen, 0)
+	mgr.Unsubscribe("/topic/news", mgr.durables["client-2 news"].sub)
+	c.Assert(send("/topic/news", "a"), IsNil)
+	c.Assert(send("/topic/news", "b"), IsNil)
+	c.Check(send("/topic/news", "c"), Equals, ErrBufferFull)
+	c.Check(bodies(other.Frames), DeepEquals, []string{"a", "b"})
+
+	// once removed, a durable subscription buffers no messages
+	c.Check(mgr.RemoveDurable("client-2 news"), Equals, true)
+	c.Check(mgr.RemoveDurable("client-2 news"), Equals, false)
+	c.Assert(send("/topic/news", "d"), IsNil)
+	c.Check(mgr.SubscribeDurable("client-2 news", "/topic/news", &fakeSubscription{}), HasLen, 0)
+	c.Check(mgr.RemoveDurable("client-1 orders"), Equals, true)
+	c.Assert(send("/topic/orders.created", "9"), IsNil)
+	c.Check(bodies(sub3.Frames), DeepEquals, []string{"8"})
+}
@@ -71,3 +71,23 @@ func (t *Topic) Enqueue(f *frame.Frame) {
 		}
 	}
 }
+
+// appendSubscriptions appends the subscriptions to the topic to subs.
+func (t *Topic) appendSubscriptions(subs []Subscription) []Subscription {
+	for e := t.subs.Front(); e != nil; e = e.Next() {
+		subs = append(subs, e.Value.(Subscription))
+	}
+	return subs
+}
+
+// sendAll sends a message to the subscriptions, in the same way as
+// Topic.Enqueue.
+func sendAll(subs []Subscription, f *frame.Frame) {
+	for i, sub := range subs {
+		if i == len(subs)-1 {
+			sub.SendTopicFrame(f)
+		} else {
+			sub.SendTopicFrame(f.Clone())
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package topic
+
+import (
+	"strings"
+)
+
+// Wildcards defines the hierarchical destinations of a topic manager.
+// A destination is split into tokens at each separator, and a token that
+// is a wildcard matches other tokens. For example, with the separator ".",
+// the wildcard "*" and the recursive wildcard ">", the destination
+// "/topic/orders.*" matches "/topic/orders.created" but not
+// "/topic/orders.eu.created", which "/topic/orders.>" matches. The first
+// token of these destinations is "/topic/orders".
+type Wildcards struct {
+	Separator string // Separates the tokens of a destination
+	Wildcard  string // Token that matches any one token
+	Recursive string // Last token that matches one or more tokens
+}
+
+// match reports whether the destination contains a wildcard.
+func (w *Wildcards) match(destination string) bool {
+	for rest, more := destination, true; more; {
+		var token string
+		token, rest, more = strings.Cut(rest, w.Separator)
+		if token == w.Wildcard || (token == w.Recursive && !more) {
+			return true
+		}
+	}
+	return false
+}
+
+// A node of the trie of the subscriptions to destinations with
+// wildcards. Each node is a token of a destination, and its topic
+// holds the subscriptions to the destination that ends with it.
+type node struct {
+	topic    *Topic
+	children map[string]*node
+}
+
+func newNode(destination string) *node {
+	return &node{topic: newTopic(destination), children: make(map[string]*node)}
+}
+
+func (n *node) empty() bool {
+	return n.topic.subs.Len() == 0 && len(n.children) == 0
+}
+
+// add returns the topic for the destination, creating the nodes
+// for its tokens if necessary.
+func (n *node) add(destination, separator string) *Topic {
+	for rest, more := destination, true; more; {
+		var token string
+		token, rest, more = strings.Cut(rest, separator)
+		child, ok := n.children[token]
+		if !ok {
+			prefix := destination
+			if more {
+				prefix = destination[:len(destination)-len(rest)-len(separator)]
+			}
+			child = newNode(prefix)
+			n.children[token] = child
+		}
+		n = child
+	}
+	return n.topic
+}
+
+// remove removes the subscription to the destination, and the nodes
+// that are left without subscriptions.
+func (n *node) remove(destination, separator string, sub Subscription) {
+	token, rest, more := strings.Cut(destination, separator)
+	child, ok := n.children[token]
+	if !ok {
+		return
+	}
+	if more {
+		child.remove(rest, separator, sub)
+	} else {
+		child.topic.Unsubscribe(sub)
+	}
+	if child.empty() {
+		delete(n.children, token)
+	}
+}
+
+// match appends the subscriptions under n whose destinations match the
+// rest of a destination, which has no more tokens if end is true.
+func (n *node) match(rest string, end bool, w *Wildcards, subs []Subscription) []Subscription {
+	if end {
+		return n.topic.appendSubscriptions(subs)
+	}
+	token, rest, more := strings.Cut(rest, w.Separator)
+
+	// the recursive wildcard as the last token is handled below
+	if child, ok := n.children[token]; ok && (token != w.Recursive || more) {
+		subs = child.match(rest, !more, w, subs)
+	}
+	if token != w.Wildcard {
+		if child, ok := n.children[w.Wildcard]; ok {
+			subs = child.match(rest, !more, w, subs)
+		}
+	}
+	if child, ok := n.children[w.Recursive]; ok {
+		subs = child.topic.appendSubscriptions(subs)
+	}
+	return subs
+}
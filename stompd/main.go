@@ -12,13 +12,18 @@ TODO: Logging options (syslog, windows event log)
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-stomp/stomp/server"
+	"github.com/go-stomp/stomp/server/queue"
 )
 
 // TODO: experimenting with ways to gracefully shutdown the server,
@@ -42,6 +47,8 @@ func main() {
 */
 
 var listenAddr = flag.String("addr", ":61613", "Listen address")
+var storagePath = flag.String("storage", "", "File in which queued messages are stored, if empty they are kept in memory")
+var statsDestination = flag.String("stats", "", "Topic destination of the JSON statistics snapshots, such as /internal/stats, if empty none are published")
 var helpFlag = flag.Bool("help", false, "Show this help text")
 
 func main() {
@@ -58,6 +65,30 @@ func main() {
 	}
 	defer func() { l.Close() }()
 
+	s := &server.Server{StatsDestination: *statsDestination}
+	if *storagePath != "" {
+		storage, err := queue.OpenFileStorage(*storagePath)
+		if err != nil {
+			log.Fatalf("failed to open storage: %s", err.Error())
+		}
+		s.Storage = storage
+	}
+
+	// shut down gracefully on SIGINT or SIGTERM, so that the messages
+	// not acknowledged are stored
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Println("shutdown failed:", err)
+		}
+	}()
+
 	log.Println("listening on", l.Addr().Network(), l.Addr().String())
-	server.Serve(l)
+	if err := s.Serve(l); err != server.ErrServerClosed {
+		log.Fatalf("failed to serve: %s", err.Error())
+	}
 }
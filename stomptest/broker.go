@@ -0,0 +1,387 @@
+/*
+Package stomptest provides an in-memory STOMP broker for testing the
+programs that use the stomp package, without an external server.
+
+A test starts a broker with NewBroker, connects the program to it with
+Broker.Dial or Broker.Connect, and checks the messages that the program
+sends with Broker.ExpectSend. The frames that a server would send, such
+as ERROR frames, can be sent to the clients connected with Client.Send,
+to test how the program handles them:
+
+	func TestConsumer(t *testing.T) {
+		broker := stomptest.NewBroker(t)
+		conn := broker.Connect()
+		...
+		f := broker.ExpectSend("/queue/orders")
+		broker.ExpectClient().SendError("out of memory")
+	}
+
+The broker is the server of the server package, running in the test
+process, and it is closed when the test completes.
+*/
+package stomptest
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+	"github.com/go-stomp/stomp/server"
+	"github.com/go-stomp/stomp/server/client"
+)
+
+// DefaultTimeout is how long the Expect methods of a Broker wait, if
+// Broker.Timeout is zero.
+const DefaultTimeout = 5 * time.Second
+
+// A Broker is a STOMP server running in the test process, which
+// accepts connections on a TCP port of the loopback interface, and
+// through in-memory pipes.
+type Broker struct {
+	Server  *server.Server // Configured before Start, which sets its hooks, calling those set before as well.
+	Timeout time.Duration  // How long the Expect methods wait, if zero, then DefaultTimeout.
+
+	t        testing.TB
+	listener *listener
+	served   chan error
+	close    sync.Once
+
+	mu      sync.Mutex
+	changed chan struct{}            // closed when a message is sent or a client connects
+	sent    []*frame.Frame           // messages sent, not yet returned by ExpectSend
+	clients []*Client                // clients connected, not yet returned by ExpectClient
+	conns   map[*client.Conn]*Client // clients connected
+}
+
+// NewBroker starts a broker for the test t, which is closed when the
+// test completes.
+func NewBroker(t testing.TB) *Broker {
+	t.Helper()
+	b := NewUnstartedBroker(t)
+	b.Start()
+	return b
+}
+
+// NewUnstartedBroker returns a broker for the test t, which is started
+// by Start, once its Server has been configured.
+func NewUnstartedBroker(t testing.TB) *Broker {
+	return &Broker{
+		Server:  &server.Server{},
+		t:       t,
+		changed: make(chan struct{}),
+		conns:   make(map[*client.Conn]*Client),
+	}
+}
+
+// Start starts the broker, which is closed when the test completes.
+// The test fails if the broker cannot listen on a TCP port.
+func (b *Broker) Start() {
+	b.t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.t.Fatalf("stomptest: cannot listen: %v", err)
+	}
+	b.listener = newListener(l)
+
+	onConnect, onDisconnect, onSend := b.Server.OnConnect, b.Server.OnDisconnect, b.Server.OnSend
+	b.Server.OnConnect = func(conn *client.Conn) {
+		b.connected(conn)
+		if onConnect != nil {
+			onConnect(conn)
+		}
+	}
+	b.Server.OnDisconnect = func(conn *client.Conn) {
+		b.disconnected(conn)
+		if onDisconnect != nil {
+			onDisconnect(conn)
+		}
+	}
+	b.Server.OnSend = func(conn *client.Conn, f *frame.Frame) {
+		b.received(f.Clone())
+		if onSend != nil {
+			onSend(conn, f)
+		}
+	}
+
+	b.served = make(chan error, 1)
+	go func() {
+		b.served <- b.Server.Serve(b.listener)
+	}()
+	b.t.Cleanup(b.Close)
+}
+
+// Close closes the broker and the connections of its clients at once.
+// It is called when the test completes, and it may be called before.
+func (b *Broker) Close() {
+	b.close.Do(func() {
+		b.Server.Close()
+		if b.served != nil {
+			<-b.served
+		}
+	})
+}
+
+// Addr returns the TCP address of the broker.
+func (b *Broker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// Dial connects to the broker over TCP, as stomp.Dial does, and
+// disconnects when the test completes. The test fails if the
+// connection cannot be established.
+func (b *Broker) Dial(opts ...func(*stomp.Conn) error) *stomp.Conn {
+	b.t.Helper()
+	conn, err := stomp.Dial("tcp", b.Addr(), opts...)
+	if err != nil {
+		b.t.Fatalf("stomptest: cannot connect: %v", err)
+	}
+	b.t.Cleanup(func() { conn.Disconnect() })
+	return conn
+}
+
+// Connect connects to the broker through a pipe, as stomp.Connect
+// does, and disconnects when the test completes. The test fails if the
+// connection cannot be established.
+func (b *Broker) Connect(opts ...func(*stomp.Conn) error) *stomp.Conn {
+	b.t.Helper()
+	conn, err := stomp.Connect(b.Pipe(), opts...)
+	if err != nil {
+		b.t.Fatalf("stomptest: cannot connect: %v", err)
+	}
+	b.t.Cleanup(func() { conn.Disconnect() })
+	return conn
+}
+
+// Pipe returns one end of an in-memory pipe to the broker, which
+// accepts the other end as a connection, for stomp.Connect to use.
+// The pipe is closed, like the connections, when the broker closes.
+func (b *Broker) Pipe() io.ReadWriteCloser {
+	b.t.Helper()
+	conn, err := b.listener.pipe()
+	if err != nil {
+		b.t.Fatalf("stomptest: cannot connect: %v", err)
+	}
+	return conn
+}
+
+// ExpectSend returns the next message sent by a client to the
+// destination, which has not been returned before, waiting for it for
+// up to the timeout of the broker. The messages are MESSAGE frames,
+// copied before they are delivered, without the "receipt" header entry.
+// The test fails if no message is sent to the destination in time.
+func (b *Broker) ExpectSend(destination string) *frame.Frame {
+	b.t.Helper()
+	var f *frame.Frame
+	if !b.wait(func() bool {
+		for i, sent := range b.sent {
+			if sent.Header.Get(frame.Destination) == destination {
+				f = sent
+				b.sent = append(b.sent[:i], b.sent[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}) {
+		b.t.Fatalf("stomptest: no message sent to %s within %v", destination, b.timeout())
+	}
+	return f
+}
+
+// ExpectClient returns the next client that has connected, which has
+// not been returned before, waiting for it for up to the timeout of
+// the broker. The test fails if no client connects in time.
+func (b *Broker) ExpectClient() *Client {
+	b.t.Helper()
+	var c *Client
+	if !b.wait(func() bool {
+		if len(b.clients) == 0 {
+			return false
+		}
+		c = b.clients[0]
+		b.clients = b.clients[1:]
+		return true
+	}) {
+		b.t.Fatalf("stomptest: no client connected within %v", b.timeout())
+	}
+	return c
+}
+
+// Clients returns the clients connected, in no particular order,
+// whether or not they have been returned by ExpectClient.
+func (b *Broker) Clients() []*Client {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clients := make([]*Client, 0, len(b.conns))
+	for _, c := range b.conns {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// wait calls found with the mutex locked until it returns true, or
+// until the timeout has passed, when it returns false.
+func (b *Broker) wait(found func() bool) bool {
+	timer := time.NewTimer(b.timeout())
+	defer timer.Stop()
+	for {
+		b.mu.Lock()
+		if found() {
+			b.mu.Unlock()
+			return true
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+func (b *Broker) timeout() time.Duration {
+	if b.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return b.Timeout
+}
+
+// notify wakes the Expect methods, with the mutex locked.
+func (b *Broker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *Broker) connected(conn *client.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := &Client{t: b.t, conn: conn}
+	b.conns[conn] = c
+	b.clients = append(b.clients, c)
+	b.notify()
+}
+
+func (b *Broker) disconnected(conn *client.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.conns, conn)
+}
+
+func (b *Broker) received(f *frame.Frame) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sent = append(b.sent, f)
+	b.notify()
+}
+
+// A Client is a client connected to a Broker.
+type Client struct {
+	t    testing.TB
+	conn *client.Conn
+}
+
+// Send writes the frame to the client as it is, apart from a MESSAGE
+// frame, which is given a "message-id" header entry, and no "ack"
+// header entry, as if it were sent to a topic. The client is
+// disconnected once an ERROR frame has been written. Send may block
+// if the client does not read the frames written to it. The test fails
+// if the client has disconnected.
+func (c *Client) Send(f *frame.Frame) {
+	c.t.Helper()
+	if !c.conn.SendUnlessDone(f) {
+		c.t.Errorf("stomptest: cannot send %s frame, client disconnected", f.Command)
+	}
+}
+
+// SendError writes an ERROR frame with the message to the client,
+// which is then disconnected. The test fails if the client has
+// disconnected already.
+func (c *Client) SendError(message string) {
+	c.t.Helper()
+	c.Send(frame.New(frame.ERROR, frame.Message, message))
+}
+
+// Close closes the connection of the client at once, as if the
+// network had failed.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Done returns a channel that is closed once the client has
+// disconnected.
+func (c *Client) Done() <-chan struct{} {
+	return c.conn.Done()
+}
+
+// A listener accepts the connections of a TCP listener, and the pipes
+// created by pipe.
+type listener struct {
+	net.Listener
+	conns  chan net.Conn
+	closed chan struct{}
+	close  sync.Once
+	err    error // returned by Accept once closed
+}
+
+func newListener(l net.Listener) *listener {
+	ln := &listener{Listener: l, conns: make(chan net.Conn), closed: make(chan struct{})}
+	go ln.acceptLoop()
+	return ln
+}
+
+func (l *listener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.shutdown(err)
+			return
+		}
+		select {
+		case l.conns <- conn:
+		case <-l.closed:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, l.err
+	}
+}
+
+func (l *listener) Close() error {
+	return l.shutdown(net.ErrClosed)
+}
+
+// shutdown closes the listener, and Accept then returns err.
+func (l *listener) shutdown(err error) error {
+	var closeErr error
+	l.close.Do(func() {
+		l.err = err
+		close(l.closed)
+		closeErr = l.Listener.Close()
+	})
+	return closeErr
+}
+
+// pipe returns one end of a pipe, whose other end is accepted.
+func (l *listener) pipe() (net.Conn, error) {
+	conn, serverConn := net.Pipe()
+	select {
+	case l.conns <- serverConn:
+		return conn, nil
+	case <-l.closed:
+		conn.Close()
+		serverConn.Close()
+		return nil, l.err
+	}
+}
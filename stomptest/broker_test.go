@@ -0,0 +1,170 @@
+package stomptest
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+	"github.com/go-stomp/stomp/server/client"
+)
+
+func TestBroker(t *testing.T) {
+	broker := NewBroker(t)
+	consumer := broker.Dial()
+	producer := broker.Connect()
+
+	sub, err := consumer.Subscribe("/queue/orders", stomp.AckAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.Send("/queue/other", "text/plain", nil, stomp.SendOpt.Receipt); err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Send("/queue/orders", "text/plain", []byte("order"), stomp.SendOpt.Receipt); err != nil {
+		t.Fatal(err)
+	}
+
+	// the messages are returned by destination, in the order sent
+	f := broker.ExpectSend("/queue/orders")
+	if f.Command != frame.MESSAGE || string(f.Body) != "order" {
+		t.Errorf("unexpected frame: %v %q", f.Command, f.Body)
+	}
+	if _, ok := f.Header.Contains(frame.Receipt); ok {
+		t.Errorf("unexpected receipt header entry")
+	}
+	if f := broker.ExpectSend("/queue/other"); f.Header.Get(frame.Destination) != "/queue/other" {
+		t.Errorf("unexpected destination: %s", f.Header.Get(frame.Destination))
+	}
+	msg := <-sub.C
+	if msg.Err != nil || string(msg.Body) != "order" {
+		t.Fatalf("unexpected message: %v %q", msg.Err, msg.Body)
+	}
+}
+
+func TestInjectFrames(t *testing.T) {
+	broker := NewUnstartedBroker(t)
+	broker.Server.QueuePrefixes = []string{"/jobs/"}
+	broker.Start()
+	conn := broker.Connect(stomp.ConnOpt.Header("client-id", "client-1"))
+	c := broker.ExpectClient()
+	if n := len(broker.Clients()); n != 1 {
+		t.Errorf("unexpected clients: %d", n)
+	}
+
+	sub, err := conn.Subscribe("/jobs/a", stomp.AckAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a frame injected is received as if the server had sent it
+	c.Send(frame.New(frame.MESSAGE,
+		frame.Destination, "/jobs/a",
+		frame.Subscription, sub.Id(),
+		frame.ContentType, "text/plain"))
+	msg := <-sub.C
+	if msg.Err != nil || msg.Destination != "/jobs/a" {
+		t.Fatalf("unexpected message: %v %s", msg.Err, msg.Destination)
+	}
+
+	// an ERROR frame disconnects the client
+	c.SendError("out of memory")
+	msg = <-sub.C
+	if msg.Err == nil || !strings.Contains(msg.Err.Error(), "out of memory") {
+		t.Errorf("unexpected error: %v", msg.Err)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(DefaultTimeout):
+		t.Fatal("client not disconnected")
+	}
+	for i := 0; i < 100 && len(broker.Clients()) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(broker.Clients()); n != 0 {
+		t.Errorf("unexpected clients: %d", n)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	sent := make(chan string, 1)
+	broker := NewUnstartedBroker(t)
+	broker.Server.OnSend = func(conn *client.Conn, f *frame.Frame) {
+		sent <- string(f.Body)
+	}
+	broker.Start()
+
+	conn := broker.Dial()
+	if err := conn.Send("/topic/news", "text/plain", []byte("news")); err != nil {
+		t.Fatal(err)
+	}
+	broker.ExpectSend("/topic/news")
+	if body := <-sent; body != "news" {
+		t.Errorf("unexpected body: %q", body)
+	}
+}
+
+// fatalTB records the failures of a test, a fatal one stopping its
+// go-routine.
+type fatalTB struct {
+	testing.TB
+	failed chan string
+}
+
+func (tb fatalTB) Fatalf(format string, args ...any) {
+	tb.failed <- format
+	runtime.Goexit()
+}
+
+func (tb fatalTB) Errorf(format string, args ...any) {
+	tb.failed <- format
+}
+
+func TestSendDisconnected(t *testing.T) {
+	failed := make(chan string, 2)
+	broker := NewBroker(fatalTB{TB: t, failed: failed})
+	conn := broker.Connect()
+	c := broker.ExpectClient()
+	if err := conn.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	<-c.Done()
+
+	// the frames are not sent, and the test fails instead of blocking
+	c.Send(frame.New(frame.MESSAGE, frame.Destination, "/queue/a"))
+	c.SendError("out of memory")
+	for i := 0; i < 2; i++ {
+		if format := <-failed; !strings.HasPrefix(format, "stomptest: cannot send ") {
+			t.Errorf("unexpected failure: %s", format)
+		}
+	}
+}
+
+func TestExpectTimeout(t *testing.T) {
+	failed := make(chan string, 1)
+	broker := NewUnstartedBroker(fatalTB{TB: t, failed: failed})
+	broker.Timeout = 50 * time.Millisecond
+	broker.Start()
+
+	conn := broker.Dial()
+	if err := conn.Send("/queue/a", "text/plain", nil, stomp.SendOpt.Receipt); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []func(){
+		func() { broker.ExpectSend("/queue/b") },
+		func() { broker.ExpectClient(); broker.ExpectClient() },
+	} {
+		go expect()
+		select {
+		case format := <-failed:
+			if !strings.HasPrefix(format, "stomptest: no ") {
+				t.Errorf("unexpected failure: %s", format)
+			}
+		case <-time.After(DefaultTimeout):
+			t.Fatal("no failure")
+		}
+	}
+	broker.ExpectSend("/queue/a")
+}
@@ -0,0 +1,51 @@
+package stomp
+
+import (
+	"context"
+	"io"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// streamBody is the body of a SEND frame that the processing loop
+// reads from r while writing the frame.
+type streamBody struct {
+	r    io.Reader
+	size int64
+	done chan error // receives the result of writing the frame
+}
+
+// SendStream sends a message to the STOMP server, in the same way as Send,
+// except that the body is read from r, which must supply size bytes. The
+// body is copied from r to the network connection as the frame is written,
+// so a large body is never held in memory. The content-length header entry
+// is always size, and SendOpt.NoContentLength has no effect.
+//
+// SendStream returns once the frame has been written, or, if a receipt is
+// requested, once the RECEIPT frame has arrived; r is not used after it
+// returns. While the body is being written, no other frames, including
+// heart-beats, can be written. If reading r fails, or r supplies fewer than
+// size bytes, the frame cannot be completed, so the connection fails, in
+// the same way as a network failure, and the error is returned.
+func (c *Conn) SendStream(destination, contentType string, size int64, r io.Reader, opts ...func(*frame.Frame) error) error {
+	if size < 0 || r == nil {
+		return ErrInvalidOptionValue
+	}
+	ctx := context.Background()
+	stream := &streamBody{r: r, size: size, done: make(chan error, 1)}
+	request, options, err := c.enqueueSend(ctx, destination, contentType, nil, opts, false, stream)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err = <-stream.done:
+	case <-c.closeCh:
+		// the processing loop stopped before writing the frame
+		return ErrClosedUnexpectedly
+	}
+	if err != nil || request.C == nil {
+		return err
+	}
+	return c.waitForReceipt(ctx, request, options.receiptTimeout)
+}
@@ -0,0 +1,169 @@
+package stomp
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_send_stream(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+	body := strings.Repeat("0123456789", 10000)
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Check(f1.Command, Equals, frame.SEND)
+		c.Check(f1.Header.Get(frame.ContentLength), Equals, "100000")
+		c.Check(f1.Header.Get(frame.ContentType), Equals, "text/plain")
+		c.Check(string(f1.Body), Equals, body)
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Check(f2.Header.Get(frame.ContentLength), Equals, "5")
+		receipt, ok := f2.Header.Contains(frame.Receipt)
+		c.Assert(ok, Equals, true)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+		rw.Close()
+	}()
+
+	c.Check(conn.SendStream("/queue/test-1", "text/plain", -1, strings.NewReader("")), Equals, ErrInvalidOptionValue)
+
+	err := conn.SendStream("/queue/test-1", "text/plain", int64(len(body)), strings.NewReader(body))
+	c.Check(err, IsNil)
+	err = conn.SendStream("/queue/test-1", "text/plain", 5, strings.NewReader("hello, world"),
+		SendOpt.NoContentLength, SendOpt.Receipt)
+	c.Check(err, IsNil)
+	<-stop
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func (s *StompSuite) Test_send_stream_read_error(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		// the frame is never completed
+		for {
+			if _, err := rw.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err := conn.SendStream("/queue/test-1", "text/plain", 10, io.MultiReader(strings.NewReader("abc"), failingReader{}))
+	c.Check(err, ErrorMatches, "read failed")
+
+	// the connection has failed
+	err = conn.Send("/queue/test-1", "text/plain", nil)
+	c.Check(err, NotNil)
+	rw.Close()
+	<-stop
+}
+
+func (s *StompSuite) Test_receive_stream(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+	body := strings.Repeat("0123456789", 10000)
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		id := f1.Header.Get(frame.Id)
+
+		for i, b := range []string{body, "short", body, "end"} {
+			f := frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.MessageId, strconv.Itoa(i),
+				frame.Destination, "/queue/test-1",
+				frame.ContentLength, strconv.Itoa(len(b)))
+			f.Body = []byte(b)
+			c.Assert(rw.Write(f), IsNil)
+		}
+	}()
+
+	_, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.StreamBodiesOver(-1))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.StreamBodiesOver(10))
+	c.Assert(err, IsNil)
+
+	// read to the end
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(msg.Body, IsNil)
+	c.Assert(msg.BodyReader, NotNil)
+	b, err := io.ReadAll(msg.BodyReader)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, body)
+
+	msg = <-sub.C
+	c.Check(msg.BodyReader, IsNil)
+	c.Check(string(msg.Body), Equals, "short")
+
+	// close after reading part of the body
+	msg = <-sub.C
+	c.Assert(msg.BodyReader, NotNil)
+	p := make([]byte, 10)
+	_, err = io.ReadFull(msg.BodyReader, p)
+	c.Assert(err, IsNil)
+	c.Check(string(p), Equals, "0123456789")
+	c.Check(msg.BodyReader.Close(), IsNil)
+
+	msg = <-sub.C
+	c.Check(msg.Id(), Equals, "3")
+	c.Check(string(msg.Body), Equals, "end")
+
+	<-stop
+	rw.Close()
+}
+
+func (s *StompSuite) Test_receive_stream_handler(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+	received := make(chan string, 2)
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		id := f1.Header.Get(frame.Id)
+
+		for _, b := range []string{"first body", "second body"} {
+			f := frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.Destination, "/queue/test-1",
+				frame.ContentLength, strconv.Itoa(len(b)))
+			f.Body = []byte(b)
+			c.Assert(rw.Write(f), IsNil)
+		}
+	}()
+
+	// the handler reads part of each body, and the rest is discarded
+	_, err := conn.SubscribeHandler("/queue/test-1", AckAuto, func(msg *Message) error {
+		p := make([]byte, 5)
+		n, _ := io.ReadFull(msg.BodyReader, p)
+		received <- string(p[:n])
+		return nil
+	}, SubscribeOpt.StreamBodiesOver(0))
+	c.Assert(err, IsNil)
+
+	c.Check(<-received, Equals, "first")
+	c.Check(<-received, Equals, "secon")
+	<-stop
+	rw.Close()
+}
@@ -1,21 +1,222 @@
 package stomp
 
 import (
+	"time"
+
 	"github.com/go-stomp/stomp/frame"
 )
 
+// Default capacity of the Subscription.C channel.
+const defaultSubscriptionChannelCapacity = 16
+
+// subscribeOptions are the settings for a single
+// call to Conn.Subscribe.
+type subscribeOptions struct {
+	channelCapacity int // -1 unless specified
+	overflow        OverflowStrategy
+	workers         int
+	autoAckEvery    int
+	autoAckInterval time.Duration
+	onError         func(*Subscription, *Error) bool
+	retry           *ReconnectPolicy
+	flavor          BrokerFlavor // the flavor of the server, as for Conn.Flavor
+	durable         string
+	durableFlavor   BrokerFlavor
+	streamOver      int // -1 unless streaming bodies
+	keepOpen        bool
+	onCancel        func(*Subscription)
+	separateErrors  bool
+	receipt         bool
+	receiptTimeout  time.Duration
+}
+
+func newSubscribeOptions() *subscribeOptions {
+	return &subscribeOptions{
+		channelCapacity: -1,
+		workers:         1,
+		streamOver:      -1,
+	}
+}
+
+// subscribeOptionsFor returns the subscribe settings associated
+// with frame f, or ErrInvalidCommand if f is not a SUBSCRIBE frame
+// being built by Conn.Subscribe.
+func subscribeOptionsFor(f *frame.Frame) (*subscribeOptions, error) {
+	opts, ok := settingsFor(f).(*subscribeOptions)
+	if f.Command != frame.SUBSCRIBE || !ok {
+		return nil, ErrInvalidCommand
+	}
+	return opts, nil
+}
+
 // SubscribeOpt contains options for for the Conn.Subscribe function.
 var SubscribeOpt struct {
 	// Id provides the opportunity to specify the value of the "id" header
-	// entry in the STOMP SUBSCRIBE frame.
+	// entry in the STOMP SUBSCRIBE frame, instead of the id that is
+	// generated, such as a value derived from the name of the consumer.
 	//
-	// If the client program does specify the value for "id",
-	// it is responsible for choosing a unique value.
+	// If the client program does specify the value for "id", it is
+	// responsible for choosing a value that is unique among the active
+	// subscriptions of the Conn, otherwise Subscribe returns an error that
+	// wraps ErrSubscriptionIdInUse. The generated ids have the form
+	// "sub-<epoch>-<n>", which a chosen id should avoid. An id that
+	// starts with "rcpt-", like the generated receipt ids, is rejected
+	// with ErrInvalidOptionValue.
 	Id func(id string) func(*frame.Frame) error
 
 	// Header provides the opportunity to include custom header entries
 	// in the SUBSCRIBE frame that the client sends to the server.
 	Header func(key, value string) func(*frame.Frame) error
+
+	// ChannelCapacity specifies the capacity of the Subscription.C channel.
+	// A larger capacity allows more messages to be received from the server
+	// before a slow reader of the channel causes the connection to stop
+	// reading from the server. A capacity of zero creates an unbuffered
+	// channel. If not specified, the capacity is 16, or zero with
+	// SubscribeOpt.AutoCumulativeAck.
+	ChannelCapacity func(capacity int) func(*frame.Frame) error
+
+	// OverflowStrategy specifies what happens when a message is received
+	// from the server and the Subscription.C channel is full. The default,
+	// OverflowBlock, waits for room in the channel. The drop strategies
+	// never block the connection, and the number of discarded messages
+	// is available from Subscription.Dropped.
+	OverflowStrategy func(strategy OverflowStrategy) func(*frame.Frame) error
+
+	// Workers specifies the number of goroutines that call the handler of a
+	// subscription created by Conn.SubscribeFunc or Conn.SubscribeHandler,
+	// so that up to n messages are processed concurrently. It cannot be used
+	// with Conn.Subscribe. With AckClient, where acknowledging a message also
+	// acknowledges the messages before it, messages are acknowledged in the
+	// order they were received, once the handler has finished with all of the
+	// earlier messages. If not specified, there is one worker.
+	Workers func(n int) func(*frame.Frame) error
+
+	// AutoCumulativeAck is for subscriptions with AckClient, where an ACK
+	// frame acknowledges a message and all of the messages before it. It
+	// automatically acknowledges the latest message delivered on the C channel
+	// once every messages have been delivered since the last ACK frame, or
+	// every interval, whichever comes first. Either value can be zero, but not
+	// both. C is unbuffered, so that a message counts as delivered only once
+	// the program has received it, and a message that the program has not
+	// yet read is never acknowledged; it cannot be used with a non-zero
+	// SubscribeOpt.ChannelCapacity. A program that is slow to read C stops
+	// the connection reading from the server sooner, and the ACK frames
+	// wait for it. Nothing is acknowledged after the subscription has started
+	// to close, or after an error has been delivered on C. It cannot be used
+	// with Conn.SubscribeFunc or Conn.SubscribeHandler, which acknowledge each
+	// message after calling the handler.
+	AutoCumulativeAck func(every int, interval time.Duration) func(*frame.Frame) error
+
+	// OnError specifies a function that is called with each error received by
+	// the subscription, instead of the error being delivered on C. If f returns
+	// true, the subscription survives errors that the server reports for this
+	// subscription alone, which are ERROR frames with a "subscription" header
+	// equal to the subscription id: C stays open, and the connection is not
+	// closed. If f returns false, C is closed. Errors that end the connection
+	// always close C, whatever f returns. The function is called on the goroutine
+	// that delivers messages to C, so it should return promptly. Without this
+	// option, every ERROR frame closes the connection, and the error is delivered
+	// on C before it is closed.
+	OnError func(f func(sub *Subscription, err *Error) bool) func(*frame.Frame) error
+
+	// RetryOnError specifies that the subscription is re-established after the
+	// server reports an error for it alone, according to the policy, instead of
+	// the error closing the subscription. Such errors do not close the connection.
+	// Once the policy's MaxAttempts is exhausted, the error is delivered on C, or
+	// to the function specified with SubscribeOpt.OnError. Subscription.Retries
+	// returns the number of times that the subscription has been re-established.
+	RetryOnError func(policy RetryPolicy) func(*frame.Frame) error
+
+	// Durable specifies that the subscription is a durable subscription called
+	// name, which the server keeps while the program is not connected, so that
+	// messages sent to a topic in the meantime are delivered when the program
+	// subscribes again with the same name. The header entries of the SUBSCRIBE
+	// frame depend on the flavor of the server. With BrokerAuto, the flavor is
+	// the one returned by Conn.Flavor, and ErrUnknownBroker is returned if the
+	// server is not recognised. The "id" header
+	// entry is set to name, which RabbitMQ requires. ActiveMQ and Artemis also
+	// require a "client-id" header entry in the CONNECT frame, which can be
+	// specified with ConnOpt.Header. Use Conn.UnsubscribeDurable to remove the
+	// durable subscription from the server.
+	Durable func(name string, flavor BrokerFlavor) func(*frame.Frame) error
+
+	// Prefetch limits the number of messages that the server sends to the
+	// subscription before they are acknowledged, so that a slow consumer does
+	// not accumulate messages. The header entry of the SUBSCRIBE frame depends
+	// on the flavor of the server, which is detected from the "server" header
+	// entry of the CONNECTED frame: "activemq.prefetchSize" for ActiveMQ,
+	// "consumer-window-size" for Artemis, which treats the value as a number of
+	// bytes, and "prefetch-count" for RabbitMQ. If the flavor is not recognised,
+	// all three are set. The value must be greater than zero.
+	Prefetch func(n int) func(*frame.Frame) error
+
+	// Selector specifies a JMS-style selector, so that the server only delivers
+	// the messages whose properties match the expression, for example
+	// "color = 'red' AND (size > 2 OR weight < 5)". The properties are the
+	// application-defined header entries of the message, see Message.Property.
+	// The expression is checked for obvious mistakes before the SUBSCRIBE frame
+	// is sent: ErrInvalidSelector is returned if it is blank, if a string literal
+	// is not terminated, or if its parentheses are unbalanced. The server checks
+	// the expression in full.
+	Selector func(expr string) func(*frame.Frame) error
+
+	// StreamBodiesOver specifies that the body of a message that is larger
+	// than threshold bytes is streamed from the connection, instead of being
+	// read into memory: the message has a nil Body, and its body is read from
+	// Message.BodyReader. Only a message with a "content-length" header entry
+	// can be streamed. Because the body is read from the connection, no more
+	// frames are received, for any subscription, until the body has been read
+	// to the end or the BodyReader closed. A subscription created by
+	// Conn.SubscribeFunc or Conn.SubscribeHandler closes the BodyReader once
+	// the handler returns. Bodies of messages that are discarded, for example
+	// by the overflow strategy, are discarded too. The threshold must not be
+	// negative.
+	StreamBodiesOver func(threshold int) func(*frame.Frame) error
+
+	// KeepOpenOnError specifies that the errors that the server reports for
+	// this subscription alone, which are ERROR frames with a "subscription"
+	// header equal to the subscription id, are delivered on C as messages
+	// whose Err field is set, without closing C or the connection. This suits
+	// servers that report failures of individual operations in this way, such
+	// as Artemis. C is still closed once the subscription is unsubscribed, or
+	// when the connection closes, with the error that closed it. If
+	// SubscribeOpt.OnError is also specified, its function decides instead.
+	KeepOpenOnError func() func(*frame.Frame) error
+
+	// OnCancel specifies a function that is called once the server has
+	// cancelled the subscription, as RabbitMQ does when the queue of the
+	// subscription is deleted, so that the program can create the queue again
+	// and subscribe again. The cancellation is recognised from the ERROR frame
+	// that RabbitMQ sends, which does not close the connection. Whatever the
+	// other options, the cancellation closes the subscription: an error that
+	// wraps ErrSubscriptionCancelledByBroker is delivered on C, or passed to
+	// the function specified with SubscribeOpt.OnError, and then C is closed.
+	// Without this option the subscription closes in the same way. The
+	// function is called on its own, once the subscription has been removed
+	// from the connection, so it may call Conn.Subscribe.
+	OnCancel func(f func(sub *Subscription)) func(*frame.Frame) error
+
+	// SeparateErrorChannel specifies that the errors received by the
+	// subscription are delivered on Subscription.Errs instead of C, so that
+	// C only carries messages whose Err field is nil. The error that ends the
+	// subscription is delivered on Errs before C is closed, and Errs is closed
+	// after C. The errors that leave the subscription open, as specified with
+	// SubscribeOpt.KeepOpenOnError, are also delivered on Errs. Read and
+	// Messages return the errors from Errs as they do the errors on C. For a
+	// subscription created by Conn.SubscribeFunc or Conn.SubscribeHandler,
+	// the errors are not passed to the handler.
+	SeparateErrorChannel func() func(*frame.Frame) error
+
+	// Receipt requests a receipt for the SUBSCRIBE frame, so that Subscribe
+	// returns once the server has created the subscription, and messages sent
+	// to the destination from then on are received. Less than or equal to
+	// zero means wait indefinitely. If the receipt does not arrive in time,
+	// ErrMsgSendTimeout is returned; if the server responds with an ERROR
+	// frame, the error returned wraps a *BrokerError for the frame. In either
+	// case no subscription is returned, and the client unsubscribes in case
+	// the server has created it. The RECEIPT frame is not delivered on C.
+	Receipt func(timeout time.Duration) func(*frame.Frame) error
 }
 
 func init() {
@@ -24,6 +225,9 @@ func init() {
 			if f.Command != frame.SUBSCRIBE {
 				return ErrInvalidCommand
 			}
+			if id == "" || isReceiptId(id) {
+				return ErrInvalidOptionValue
+			}
 			f.Header.Set(frame.Id, id)
 			return nil
 		}
@@ -39,4 +243,194 @@ func init() {
 			return nil
 		}
 	}
+
+	SubscribeOpt.ChannelCapacity = func(capacity int) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			opts, err := subscribeOptionsFor(f)
+			if err != nil {
+				return err
+			}
+			if capacity < 0 {
+				return ErrInvalidOptionValue
+			}
+			opts.channelCapacity = capacity
+			return nil
+		}
+	}
+
+	SubscribeOpt.OverflowStrategy = func(strategy OverflowStrategy) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			opts, err := subscribeOptionsFor(f)
+			if err != nil {
+				return err
+			}
+			if !strategy.isValid() {
+				return ErrInvalidOptionValue
+			}
+			opts.overflow = strategy
+			return nil
+		}
+	}
+
+	SubscribeOpt.Workers = func(n int) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			opts, err := subscribeOptionsFor(f)
+			if err != nil {
+				return err
+			}
+			if n < 1 {
+				return ErrInvalidOptionValue
+			}
+			opts.workers = n
+			return nil
+		}
+	}
+
+	SubscribeOpt.AutoCumulativeAck = func(every int, interval time.Duration) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			opts, err := subscribeOptionsFor(f)
+			if err != nil {
+				return err
+			}
+			if f.Header.Get(frame.Ack) != frame.AckClient {
+				return ErrNoCumulativeAck
+			}
+			if every < 0 || interval < 0 || (every == 0 && interval == 0) {
+				return ErrInvalidOptionValue
+			}
+			opts.autoAckEvery = every
+			opts.autoAckInterval = interval
+			return nil
+		}
+	}
+	SubscribeOpt.OnError = func(f func(sub *Subscription, err *Error) bool) func(*frame.Frame) error {
+		return func(fr *frame.Frame) error {
+			opts, err := subscribeOptionsFor(fr)
+			if err != nil {
+				return err
+			}
+			if f == nil {
+				return ErrNilOption
+			}
+			opts.onError = f
+			return nil
+		}
+	}
+	SubscribeOpt.RetryOnError = func(policy RetryPolicy) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			opts, err := subscribeOptionsFor(f)
+			if err != nil {
+				return err
+			}
+			backoff := policy.backoff()
+			if err = backoff.validate(); err != nil {
+				return err
+			}
+			opts.retry = backoff
+			return nil
+		}
+	}
+	SubscribeOpt.Durable = func(name string, flavor BrokerFlavor) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			opts, err := subscribeOptionsFor(f)
+			if err != nil {
+				return err
+			}
+			if name == "" {
+				return ErrInvalidOptionValue
+			}
+			if flavor, err = flavor.resolve(opts.flavor); err != nil {
+				return err
+			}
+			if err = flavor.setDurableHeader(f, name); err != nil {
+				return err
+			}
+			opts.durable = name
+			opts.durableFlavor = flavor
+			return nil
+		}
+	}
+	SubscribeOpt.Prefetch = func(n int) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			opts, err := subscribeOptionsFor(f)
+			if err != nil {
+				return err
+			}
+			if n <= 0 {
+				return ErrInvalidOptionValue
+			}
+			opts.flavor.setPrefetchHeader(f, n)
+			return nil
+		}
+	}
+	SubscribeOpt.Selector = func(expr string) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			if f.Command != frame.SUBSCRIBE {
+				return ErrInvalidCommand
+			}
+			if err := validateSelector(expr); err != nil {
+				return err
+			}
+			f.Header.Set(frame.Selector, expr)
+			return nil
+		}
+	}
+	SubscribeOpt.StreamBodiesOver = func(threshold int) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			opts, err := subscribeOptionsFor(f)
+			if err != nil {
+				return err
+			}
+			if threshold < 0 {
+				return ErrInvalidOptionValue
+			}
+			opts.streamOver = threshold
+			return nil
+		}
+	}
+	SubscribeOpt.KeepOpenOnError = func() func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			opts, err := subscribeOptionsFor(f)
+			if err != nil {
+				return err
+			}
+			opts.keepOpen = true
+			return nil
+		}
+	}
+	SubscribeOpt.OnCancel = func(f func(sub *Subscription)) func(*frame.Frame) error {
+		return func(fr *frame.Frame) error {
+			opts, err := subscribeOptionsFor(fr)
+			if err != nil {
+				return err
+			}
+			if f == nil {
+				return ErrNilOption
+			}
+			opts.onCancel = f
+			return nil
+		}
+	}
+	SubscribeOpt.SeparateErrorChannel = func() func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			opts, err := subscribeOptionsFor(f)
+			if err != nil {
+				return err
+			}
+			opts.separateErrors = true
+			return nil
+		}
+	}
+	SubscribeOpt.Receipt = func(timeout time.Duration) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			opts, err := subscribeOptionsFor(f)
+			if err != nil {
+				return err
+			}
+			f.Header.Set(frame.Receipt, allocateReceiptId())
+			opts.receipt = true
+			opts.receiptTimeout = timeout
+			return nil
+		}
+	}
 }
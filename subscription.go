@@ -1,8 +1,10 @@
 package stomp
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -20,18 +22,46 @@ const (
 //
 // Once a client has subscribed, it can receive messages from the C channel.
 type Subscription struct {
-	C           chan *Message
-	id          string
-	destination string
-	conn        *Conn
-	ackMode     AckMode
-	state       int32
-	closeChan   chan struct{}
+	dropped        uint64 // accessed atomically, first for alignment
+	retries        uint64 // accessed atomically
+	deliveredCount uint64 // accessed atomically
+	ackedCount     uint64 // accessed atomically
+	nackedCount    uint64 // accessed atomically
+	errorCount     uint64 // accessed atomically
+	lastDelivery   int64  // accessed atomically, in nanoseconds since the epoch
+	inFlight       int32  // accessed atomically
+	C              chan *Message
+	Errs           <-chan *Error // nil unless SubscribeOpt.SeparateErrorChannel
+	errs           chan *Error
+	id             string
+	destination    string
+	conn           *Conn
+	ackMode        AckMode
+	overflow       OverflowStrategy
+	state          int32
+	closeChan      chan struct{}
+	closeErr       error         // why the subscription closed, set before closeChan is closed
+	unsubscribing  chan struct{} // closed when Unsubscribe is called
+	epoch          uint64        // connection that messages are arriving on, used by readLoop
+	handlerDone    chan struct{} // if non-nil, closed when the handler has finished
+	autoAck        *autoAcker    // nil unless SubscribeOpt.AutoCumulativeAck
+	onError        func(*Subscription, *Error) bool
+	subscribeFrame *frame.Frame     // the SUBSCRIBE frame that created the subscription
+	retry          *ReconnectPolicy // nil unless SubscribeOpt.RetryOnError
+	retryAttempts  int              // consecutive errors, used by readLoop
+	retryInterval  time.Duration    // the latest wait, used by readLoop
+	streamOver     int              // -1 unless SubscribeOpt.StreamBodiesOver
+	keepOpen       bool             // SubscribeOpt.KeepOpenOnError
+	pending        []*Message       // received while unsubscribing, used by readLoop
+	onCancel       func(*Subscription)
+	pauseMutex     sync.Mutex
+	resumed        chan struct{} // non-nil while paused, closed by Resume
 }
 
 // BUG(jpj): If the client does not read messages from the Subscription.C
 // channel quickly enough, the client will stop reading messages from the
-// server.
+// server. The capacity of the channel can be increased using
+// SubscribeOpt.ChannelCapacity.
 
 // Identification for this subscription. Unique among
 // all subscriptions for the same Client.
@@ -44,40 +74,171 @@ func (s *Subscription) Destination() string {
 	return s.destination
 }
 
+// Headers returns a copy of the header entries of the SUBSCRIBE frame
+// that created the subscription, including those added by subscribe
+// options and send interceptors, such as the "id" and "selector" header
+// entries. Changing the returned header does not affect the subscription.
+func (s *Subscription) Headers() *frame.Header {
+	return s.subscribeFrame.Header.Clone()
+}
+
 // AckMode returns the Acknowledgement mode specified when the
 // subscription was created.
 func (s *Subscription) AckMode() AckMode {
 	return s.ackMode
 }
 
+// Dropped returns the number of messages received from the server
+// that were discarded because the Subscription.C channel was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// AckUpTo acknowledges msg, and all of the messages received before it on
+// this subscription. For a subscription with AckClient, this is how the STOMP
+// server treats every ACK frame, including those sent by Conn.Ack; AckUpTo
+// makes the intent explicit. Returns an error if the subscription has
+// AckClientIndividual, where each message must be acknowledged separately,
+// or if msg was not received on this subscription. If the subscription has
+// AckAuto, no operation is performed.
+func (s *Subscription) AckUpTo(msg *Message) error {
+	if msg.Subscription != s {
+		return ErrNotReceivedMessage
+	}
+	switch s.ackMode {
+	case AckAuto:
+		return nil
+	case AckClientIndividual:
+		return ErrNoCumulativeAck
+	}
+	return s.conn.Ack(msg)
+}
+
+// InFlight returns the number of messages that have been passed to the
+// handler of a subscription created by Conn.SubscribeFunc or
+// Conn.SubscribeHandler, and have not yet been acknowledged. For other
+// subscriptions it returns zero.
+func (s *Subscription) InFlight() int {
+	return int(atomic.LoadInt32(&s.inFlight))
+}
+
 // Active returns whether the subscription is still active.
 // Returns false if the subscription has been unsubscribed.
 func (s *Subscription) Active() bool {
 	return atomic.LoadInt32(&s.state) == subStateActive
 }
 
+// Pause stops the delivery of messages on C, without unsubscribing, until
+// Resume is called. Messages already on C remain available. The message
+// that arrives next is held until the subscription is resumed, whatever its
+// overflow strategy, and as with OverflowBlock the connection stops reading
+// from the server while it is held, so that the server stops sending
+// messages once it has sent as many as the network and its prefetch limit
+// allow. Frames for the other subscriptions of the Conn are delayed too,
+// so a subscription should not be paused for long if the Conn has others.
+// Unsubscribing a paused subscription delivers the held message if there
+// is room for it on C. Pausing a paused subscription has no effect.
+func (s *Subscription) Pause() {
+	s.pauseMutex.Lock()
+	defer s.pauseMutex.Unlock()
+	if s.resumed == nil {
+		s.resumed = make(chan struct{})
+	}
+}
+
+// Resume continues the delivery of messages on C after Pause. Resuming a
+// subscription that is not paused has no effect.
+func (s *Subscription) Resume() {
+	s.pauseMutex.Lock()
+	defer s.pauseMutex.Unlock()
+	if s.resumed != nil {
+		close(s.resumed)
+		s.resumed = nil
+	}
+}
+
+// Paused reports whether the subscription has been paused by Pause,
+// and not yet resumed.
+func (s *Subscription) Paused() bool {
+	s.pauseMutex.Lock()
+	defer s.pauseMutex.Unlock()
+	return s.resumed != nil
+}
+
+// waitIfPaused waits until the subscription is resumed, if it is paused.
+// It stops waiting once Unsubscribe is called or the processing loop starts
+// to close the channels, so that the frames that follow can be read.
+func (s *Subscription) waitIfPaused() {
+	s.pauseMutex.Lock()
+	resumed := s.resumed
+	s.pauseMutex.Unlock()
+	if resumed == nil {
+		return
+	}
+	select {
+	case <-resumed:
+	case <-s.unsubscribing:
+	case <-s.conn.channelsClosing:
+	}
+}
+
 // Unsubscribes and closes the channel C.
+//
+// Unsubscribe waits for the server to confirm that the subscription
+// is closed. For a subscription created by Conn.SubscribeFunc or
+// Conn.SubscribeHandler, it also waits for the handler to finish with
+// the messages already received. The time it waits is specified by ConnOpt.UnsubscribeTimeout,
+// and can be overridden for this call with UnsubscribeOpt.Timeout. If the
+// wait times out, ErrUnsubscribeTimeout is returned. If the connection
+// closes before the server confirms, ErrConnectionClosed is returned
+// without waiting any longer.
+//
+// The messages that the server sends before it confirms are all delivered
+// on C, in order, before C is closed, unless their bodies are streamed
+// (see SubscribeOpt.StreamBodiesOver) and there is no room for them in C.
+// Unsubscribe does not wait for them to be read, so C should be read until
+// it is closed.
 func (s *Subscription) Unsubscribe(opts ...func(*frame.Frame) error) error {
+	return s.UnsubscribeWithContext(context.Background(), opts...)
+}
+
+// UnsubscribeWithContext is the same as Unsubscribe, except that it stops
+// waiting for the subscription to close when the context is done. In this
+// case the returned error is an Error that wraps ctx.Err().
+func (s *Subscription) UnsubscribeWithContext(ctx context.Context, opts ...func(*frame.Frame) error) error {
 	// transition to the "closing" state
 	if !atomic.CompareAndSwapInt32(&s.state, subStateActive, subStateClosing) {
 		return ErrCompletedSubscription
 	}
 
 	f := frame.New(frame.UNSUBSCRIBE, frame.Id, s.id)
+	options := &unsubscribeOptions{timeout: s.conn.unsubscribeTimeout}
 
-	for _, opt := range opts {
-		if opt == nil {
-			return ErrNilOption
-		}
-		err := opt(f)
-		if err != nil {
-			return err
+	err := withSettings(f, options, func() error {
+		for _, opt := range opts {
+			if opt == nil {
+				return ErrNilOption
+			}
+			err := opt(f)
+			if err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	err := s.conn.sendFrame(f)
+	// Messages that arrive from now on are only delivered at once if
+	// there is room in C, otherwise the read loop could block and never
+	// see the RECEIPT for the UNSUBSCRIBE frame. The others are delivered
+	// after the RECEIPT, before C is closed.
+	close(s.unsubscribing)
+
+	err = s.conn.sendFrame(f)
 	if err != nil {
-		log.Printf("failed to send frame in unsubscribe: %v", err)
+		s.conn.log.Errorf("failed to send frame in unsubscribe: %v", err)
 	}
 
 	// UNSUBSCRIBE is a bit weird in that it is tagged with a "receipt" header
@@ -85,47 +246,172 @@ func (s *Subscription) Unsubscribe(opts ...func(*frame.Frame) error) error {
 	// for the resulting RECEIPT.
 	//
 	// We don't want to interfere with `s.C` since we might be "stealing"
-	// MESSAGEs or ERRORs from another goroutine, so use a sync.Cond to
-	// wait for the terminal state transition instead.
-	timer := time.NewTimer(120 * time.Second)
-	defer timer.Stop()
-	select {
-	case <-s.closeChan:
-		return nil
-		//log.Printf("Got the go ahead to close this subscription")
-	case <-timer.C:
-		log.Printf("timeout waiting for close")
-		return ErrUnsubscribeTimeout
+	// MESSAGEs or ERRORs from another goroutine, so wait on closeChan for
+	// the terminal state transition instead.
+	var timeoutCh <-chan time.Time
+	if options.timeout > 0 {
+		timer := time.NewTimer(options.timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	closed := []<-chan struct{}{s.closeChan}
+	if s.handlerDone != nil {
+		closed = append(closed, s.handlerDone)
+	}
+	for _, ch := range closed {
+		select {
+		case <-ch:
+		case <-s.conn.closeCh:
+			// the connection has closed, so the server will not respond
+			select {
+			case <-ch:
+			default:
+				return ErrConnectionClosed
+			}
+		case <-timeoutCh:
+			s.conn.log.Warnf("timeout waiting for close")
+			return ErrUnsubscribeTimeout
+		case <-ctx.Done():
+			return newContextError(ctx.Err())
+		}
 	}
+	return s.closeErr
 }
 
 // Read a message from the subscription. This is a convenience
 // method: many callers will prefer to read from the channel C
 // directly.
 func (s *Subscription) Read() (*Message, error) {
+	return s.ReadWithContext(context.Background())
+}
+
+// ReadWithContext reads a message from the subscription, in the same way
+// as Read, but gives up and returns ctx.Err() if the context is done
+// before a message arrives. The subscription remains active.
+func (s *Subscription) ReadWithContext(ctx context.Context) (*Message, error) {
 	if !s.Active() {
 		return nil, ErrCompletedSubscription
 	}
-	msg, ok := <-s.C
-	if !ok {
-		return nil, ErrCompletedSubscription
-	}
-	if msg.Err != nil {
-		return nil, msg.Err
+	select {
+	case msg, ok := <-s.C:
+		if !ok {
+			// the error that ended the subscription is delivered before C is closed
+			if s.errs != nil {
+				select {
+				case err, ok := <-s.errs:
+					if ok {
+						return nil, err
+					}
+				default:
+				}
+			}
+			return nil, ErrCompletedSubscription
+		}
+		if msg.Err != nil {
+			return nil, msg.Err
+		}
+		return msg, nil
+	case err, ok := <-s.errs:
+		if !ok {
+			return nil, ErrCompletedSubscription
+		}
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	return msg, nil
 }
 
+// closeChannel transitions the subscription to the closed state and
+// closes C. If msg is non-nil it is delivered on C before C is closed.
+// Any goroutine waiting in Unsubscribe is released before msg is
+// delivered, so that a full C cannot prevent Unsubscribe from returning.
+// Only the first call has any effect, so C is closed exactly once.
 func (s *Subscription) closeChannel(msg *Message) {
-	if msg != nil {
+	s.closeChannelWithError(msg, nil)
+}
+
+// closeChannelWithError is the same as closeChannel, except that any
+// goroutine waiting in Unsubscribe returns err.
+func (s *Subscription) closeChannelWithError(msg *Message, err error) {
+	if atomic.SwapInt32(&s.state, subStateClosed) == subStateClosed {
+		return
+	}
+	s.closeErr = err
+	s.conn.removeSubscription(s)
+	close(s.closeChan)
+	s.deliverPending()
+	if msg != nil && msg.Err != nil && s.errs != nil {
+		s.errs <- asError(msg.Err)
+	} else if msg != nil {
 		s.C <- msg
 	}
-	atomic.StoreInt32(&s.state, subStateClosed)
 	close(s.C)
-	close(s.closeChan)
+	if s.errs != nil {
+		close(s.errs)
+	}
+}
+
+// asError returns err as an *Error, for Subscription.Errs.
+func asError(err error) *Error {
+	switch e := err.(type) {
+	case *Error:
+		return e
+	case Error:
+		return &e
+	}
+	return &Error{Message: err.Error(), cause: err}
+}
+
+// putError delivers an error that leaves the subscription open on Errs,
+// in the same way as put delivers a message on C. If Unsubscribe has been
+// called and there is no room for err, it is discarded.
+func (s *Subscription) putError(err *Error) {
+	select {
+	case s.errs <- err:
+	case <-s.unsubscribing:
+		select {
+		case s.errs <- err:
+		default:
+			s.conn.log.Debugf("Subscription %s: %s: discarded error received while unsubscribing: %v", s.id, s.destination, err)
+		}
+	}
+}
+
+// deliverPending delivers on C the messages that were received while
+// unsubscribing, in the order they were received, once the processing
+// loop no longer waits for the subscription. The messages that have not
+// been read when the connection closes are discarded.
+func (s *Subscription) deliverPending() {
+	for i, msg := range s.pending {
+		select {
+		case s.C <- msg:
+			s.delivered(msg)
+		case <-s.conn.closeCh:
+			for _, msg := range s.pending[i:] {
+				s.discard(msg)
+			}
+			s.pending = nil
+			return
+		}
+	}
+	s.pending = nil
 }
 
 func (s *Subscription) readLoop(ch chan *frame.Frame) {
+	defer func() {
+		if r := recover(); r != nil {
+			// the subscription cannot go on
+			err := panicked("subscription "+s.id, r, s.conn.onPanic)
+			s.conn.reportPanic(err)
+			if atomic.LoadInt32(&s.state) != subStateClosed {
+				s.closeChannel(&Message{Err: err, Conn: s.conn, Subscription: s})
+			}
+			go s.conn.forgetSubscription(s.id)
+			s.drain(ch)
+		}
+	}()
+
 	for {
 		f, ok := <-ch
 		if !ok {
@@ -136,28 +422,56 @@ func (s *Subscription) readLoop(ch chan *frame.Frame) {
 						Message: fmt.Sprintf("Subscription %s: %s: channel read failed", s.id, s.destination),
 					},
 				}
-				s.closeChannel(msg)
+				s.closeChannelWithError(msg, ErrConnectionClosed)
 			}
 			return
 		}
 
 		switch f.Command {
 		case frame.MESSAGE:
-			s.handleMessage(f)
+			s.retryAttempts = 0
+			if !s.handleMessage(f) {
+				s.drain(ch)
+				return
+			}
 		case frame.ERROR:
-			s.handleError(f)
+			atomic.AddUint64(&s.errorCount, 1)
+			if s.isOwnError(f) && isCancellation(f) {
+				s.handleCancel(f, ch)
+				return
+			}
+			if s.retryAfter(f, ch) || s.handleError(f) {
+				continue
+			}
+			if s.handlesErrors() && s.isOwnError(f) {
+				// the processing loop still has the channel
+				go s.conn.forgetSubscription(s.id)
+				s.drain(ch)
+			}
 			return
 		case frame.RECEIPT:
+			if !s.isUnsubscribeReceipt(f) {
+				s.conn.log.Debugf("Subscription %s: %s: ignored RECEIPT frame for %s", s.id, s.destination, f.Header.Get(frame.ReceiptId))
+				continue
+			}
 			s.handleReceipt(f)
 			return
+		case frame.CONNECTED:
+			// sent by the processing loop, not the server: the
+			// messages that follow are from a new connection
+			s.epoch, _ = strconv.ParseUint(f.Header.Get(epochHeader), 10, 64)
 		default:
-			log.Printf("Subscription %s: %s: unsupported frame type: %+v\n", s.id, s.destination, f)
+			s.conn.log.Warnf("Subscription %s: %s: unsupported frame type: %+v", s.id, s.destination, f)
 		}
 
 	}
 }
 
-func (s *Subscription) handleMessage(f *frame.Frame) {
+// handleMessage delivers a MESSAGE frame on C according to the
+// overflow strategy. Returns false if the subscription has failed
+// and no more messages should be delivered.
+func (s *Subscription) handleMessage(f *frame.Frame) bool {
+	s.waitIfPaused()
 	msg := &Message{
 		Destination:  f.Header.Get(frame.Destination),
 		ContentType:  f.Header.Get(frame.ContentType),
@@ -165,33 +479,313 @@ func (s *Subscription) handleMessage(f *frame.Frame) {
 		Subscription: s,
 		Header:       f.Header,
 		Body:         f.Body,
+		BodyReader:   s.conn.takeBody(f),
+		epoch:        s.epoch,
+		frame:        f,
+	}
+	if s.conn.autoDecompress && msg.BodyReader == nil {
+		body, err := decompress(msg, s.conn.maxDecompressedSize)
+		if err != nil {
+			s.decompressFailed(msg, err)
+			return true
+		}
+		if body != nil {
+			msg.Body = body
+		}
+	}
+	if s.conn.discardFrames {
+		msg.frame = nil
+	}
+
+	switch s.overflow {
+	case OverflowDropNewest:
+		select {
+		case s.C <- msg:
+			s.delivered(msg)
+		default:
+			s.discard(msg)
+		}
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.C <- msg:
+				s.delivered(msg)
+				return true
+			default:
+			}
+			if cap(s.C) == 0 {
+				// nothing is buffered, so there is nothing older to drop
+				s.discard(msg)
+				return true
+			}
+			select {
+			case old := <-s.C:
+				s.discard(old)
+			default:
+			}
+		}
+
+	case OverflowFail:
+		select {
+		case s.C <- msg:
+			s.delivered(msg)
+		default:
+			if msg.BodyReader != nil {
+				msg.BodyReader.Close()
+			}
+			s.handleOverflow()
+			return false
+		}
+
+	default:
+		s.put(msg)
+	}
+	return true
+}
+
+// put delivers msg on C, waiting for room in C until Unsubscribe is
+// called. From then on msg is kept if there is no room for it.
+func (s *Subscription) put(msg *Message) {
+	if len(s.pending) > 0 {
+		// unsubscribing, and the messages must stay in order
+		s.keep(msg)
+		return
+	}
+	select {
+	case s.C <- msg:
+		s.delivered(msg)
+	case <-s.unsubscribing:
+		// Unsubscribe has been called, so the message is only
+		// delivered now if there is room for it.
+		select {
+		case s.C <- msg:
+			s.delivered(msg)
+		default:
+			s.keep(msg)
+		}
+	}
+}
+
+// decompressFailed delivers msg, whose body cannot be decompressed, with
+// its Err field set, or delivers the error on Errs with
+// SubscribeOpt.SeparateErrorChannel. The subscription stays open.
+func (s *Subscription) decompressFailed(msg *Message, err error) {
+	atomic.AddUint64(&s.errorCount, 1)
+	s.conn.log.Warnf("Subscription %s: %s: %v", s.id, s.destination, err)
+	msgErr := &Error{Message: err.Error(), Frame: msg.frame, cause: err}
+	if s.errs != nil {
+		s.putError(msgErr)
+		return
+	}
+	msg.Err = msgErr
+	s.put(msg)
+}
+
+// keep holds msg, received while unsubscribing, until the processing loop
+// no longer waits for the subscription, so that waiting for room in C
+// cannot prevent the RECEIPT for the UNSUBSCRIBE frame from arriving. A
+// message whose body is streamed is discarded instead, as the next frame
+// is not read until the body has been read.
+func (s *Subscription) keep(msg *Message) {
+	if msg.BodyReader != nil {
+		s.discard(msg)
+		s.conn.log.Debugf("Subscription %s: %s: discarded message received while unsubscribing", s.id, s.destination)
+		return
+	}
+	s.pending = append(s.pending, msg)
+}
+
+// discard counts msg as dropped, and discards its body if it is streamed.
+func (s *Subscription) discard(msg *Message) {
+	if msg.BodyReader != nil {
+		msg.BodyReader.Close()
+	}
+	msg.Release()
+	atomic.AddUint64(&s.dropped, 1)
+}
+
+// delivered is called once msg has been delivered on C. An error
+// delivered with SubscribeOpt.KeepOpenOnError is not a message.
+func (s *Subscription) delivered(msg *Message) {
+	if msg.Err != nil {
+		return
+	}
+	atomic.AddUint64(&s.deliveredCount, 1)
+	atomic.StoreInt64(&s.lastDelivery, time.Now().UnixNano())
+	if s.conn.metrics != nil {
+		s.conn.metrics.MessageDelivered(msg.Destination)
+	}
+	if s.autoAck != nil {
+		s.autoAck.delivered(msg)
 	}
-	s.C <- msg
 }
 
-func (s *Subscription) handleError(f *frame.Frame) {
+// handleOverflow closes the subscription when C is full and the
+// overflow strategy is OverflowFail.
+func (s *Subscription) handleOverflow() {
+	if !atomic.CompareAndSwapInt32(&s.state, subStateActive, subStateClosing) {
+		// already unsubscribing, the RECEIPT will close the channel,
+		// when drain sees it
+		return
+	}
+	s.conn.log.Warnf("Subscription %s: %s: channel full, closing subscription", s.id, s.destination)
+
+	// make room for the error message by discarding the oldest message
+	select {
+	case old := <-s.C:
+		s.discard(old)
+	default:
+	}
+
+	s.closeChannel(&Message{
+		Err:          ErrSubscriptionOverflow,
+		Conn:         s.conn,
+		Subscription: s,
+	})
+
+	// Tell the server that we are no longer interested. This happens on
+	// another goroutine because the processing loop may be blocked sending
+	// us a frame while we are trying to write to it.
+	go func() {
+		f := frame.New(frame.UNSUBSCRIBE, frame.Id, s.id)
+		if err := s.conn.sendFrame(f); err != nil {
+			s.conn.log.Errorf("failed to send frame in unsubscribe: %v", err)
+		}
+	}()
+}
+
+// drain discards frames for a subscription that has already been closed,
+// or is closing, until the processing loop has finished with the
+// subscription. The RECEIPT for the UNSUBSCRIBE frame closes C if
+// Unsubscribe was called before the subscription was closed.
+func (s *Subscription) drain(ch chan *frame.Frame) {
+	for f := range ch {
+		if f.Command == frame.MESSAGE {
+			s.conn.discardBody(f)
+			atomic.AddUint64(&s.dropped, 1)
+			continue
+		}
+		if f.Command == frame.RECEIPT && s.isUnsubscribeReceipt(f) {
+			s.handleReceipt(f)
+			return
+		}
+		if f.Command == frame.ERROR {
+			return
+		}
+	}
+}
+
+// handleError delivers an ERROR frame, and closes C unless the subscription
+// survives the error. Returns true if the subscription survives.
+func (s *Subscription) handleError(f *frame.Frame) bool {
 	state := atomic.LoadInt32(&s.state)
 	if state == subStateActive || state == subStateClosing {
 		message, _ := f.Header.Contains(frame.Message)
-		text := fmt.Sprintf("Subscription %s: %s: ERROR message:%s",
+		s.conn.log.Errorf("Subscription %s: %s: ERROR message:%s",
 			s.id,
 			s.destination,
 			message)
-		log.Println(text)
+		err := &Error{
+			Message: f.Header.Get(frame.Message),
+			Frame:   f,
+			cause:   errorFrameCause(f, s.conn.lastFailure()),
+		}
+		// unless the error is for this subscription alone,
+		// the connection is closing
+		var closeErr error
+		if !s.handlesErrors() || !s.isOwnError(f) {
+			closeErr = ErrConnectionClosed
+		}
+		if s.onError != nil {
+			survive := false
+			s.conn.safely("subscription error function", func() {
+				survive = s.onError(s, err)
+			})
+			if survive && s.isOwnError(f) && atomic.LoadInt32(&s.state) == subStateActive {
+				return true
+			}
+			s.closeChannelWithError(nil, closeErr)
+			return false
+		}
 		contentType := f.Header.Get(frame.ContentType)
 		msg := &Message{
-			Err: &Error{
-				Message: f.Header.Get(frame.Message),
-				Frame:   f,
-			},
+			Err:          err,
 			ContentType:  contentType,
 			Conn:         s.conn,
 			Subscription: s,
 			Header:       f.Header,
 			Body:         f.Body,
 		}
-		s.closeChannel(msg)
+		if s.keepOpen && closeErr == nil {
+			if s.errs != nil {
+				s.putError(err)
+			} else {
+				s.put(msg)
+			}
+			return true
+		}
+		s.closeChannelWithError(msg, closeErr)
+	}
+	return false
+}
+
+// handleCancel closes the subscription after the server has cancelled it,
+// and calls the function specified with SubscribeOpt.OnCancel once the
+// processing loop has finished with the subscription.
+func (s *Subscription) handleCancel(f *frame.Frame, ch chan *frame.Frame) {
+	s.conn.log.Warnf("Subscription %s: %s: cancelled by the server", s.id, s.destination)
+	if atomic.LoadInt32(&s.state) != subStateClosed {
+		err := &Error{
+			Message: f.Header.Get(frame.Message),
+			Frame:   f,
+			cause:   newSubscriptionCancelledError(f),
+		}
+		if s.onError != nil {
+			s.conn.safely("subscription error function", func() {
+				s.onError(s, err)
+			})
+			s.closeChannelWithError(nil, ErrSubscriptionCancelledByBroker)
+		} else {
+			s.closeChannelWithError(&Message{
+				Err:          err,
+				ContentType:  f.Header.Get(frame.ContentType),
+				Conn:         s.conn,
+				Subscription: s,
+				Header:       f.Header,
+				Body:         f.Body,
+			}, ErrSubscriptionCancelledByBroker)
+		}
 	}
+
+	// the processing loop still has the channel
+	go s.conn.forgetSubscription(s.id)
+	s.drain(ch)
+	if s.onCancel != nil {
+		s.conn.safely("subscription cancel function", func() {
+			s.onCancel(s)
+		})
+	}
+}
+
+// handlesErrors reports whether the subscription handles the errors that
+// the server reports for it alone, without the connection being closed.
+func (s *Subscription) handlesErrors() bool {
+	return s.onError != nil || s.retry != nil || s.keepOpen
+}
+
+// isOwnError reports whether an ERROR frame is one that the processing
+// loop delivered to this subscription alone, for SubscribeOpt.OnError.
+func (s *Subscription) isOwnError(f *frame.Frame) bool {
+	_, local := f.Header.Contains(localErrorHeader)
+	return !local && f.Header.Get(frame.Subscription) == s.id
+}
+
+// isUnsubscribeReceipt reports whether f is the RECEIPT frame for the
+// UNSUBSCRIBE frame of the subscription, whose receipt id the processing
+// loop sets to the subscription id.
+func (s *Subscription) isUnsubscribeReceipt(f *frame.Frame) bool {
+	return f.Header.Get(frame.ReceiptId) == s.id
 }
 
 func (s *Subscription) handleReceipt(f *frame.Frame) {
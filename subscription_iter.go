@@ -0,0 +1,81 @@
+//go:build go1.23
+
+package stomp
+
+import (
+	"context"
+	"errors"
+	"iter"
+)
+
+// Messages returns an iterator over the messages received by the
+// subscription, for use in a range loop:
+//
+//	for msg, err := range sub.Messages() {
+//		if err != nil {
+//			// the subscription has closed after an error
+//			break
+//		}
+//		// process msg
+//	}
+//
+// The iteration ends when the subscription closes. If it closes because
+// of an error, such as an ERROR frame from the server, the error is
+// yielded with a nil message before the iteration ends; if it is
+// unsubscribed, the iteration ends without an error. With
+// SubscribeOpt.KeepOpenOnError, the errors that leave the subscription
+// open are yielded in the same way, and the iteration goes on, as it does
+// after a body that ConnOpt.AutoDecompress cannot decompress. Breaking
+// out of the loop does not unsubscribe.
+func (s *Subscription) Messages() iter.Seq2[*Message, error] {
+	return s.MessagesCtx(context.Background())
+}
+
+// MessagesCtx is the same as Messages, except that the iteration also
+// ends when the context is done, and yields ctx.Err() with a nil message.
+// The subscription remains active.
+func (s *Subscription) MessagesCtx(ctx context.Context) iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		errs := s.errs
+		for {
+			select {
+			case msg, ok := <-s.C:
+				if !ok {
+					if errs != nil {
+						// the error that ended the subscription
+						select {
+						case err, ok := <-errs:
+							if ok {
+								yield(nil, err)
+							}
+						default:
+						}
+					}
+					return
+				}
+				if msg.Err != nil {
+					// the error for a message that cannot be decompressed
+					// leaves the subscription open
+					if !yield(nil, msg.Err) || !(s.keepOpen || errors.Is(msg.Err, ErrDecompress)) {
+						return
+					}
+					continue
+				}
+				if !yield(msg, nil) {
+					return
+				}
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				if !yield(nil, err) || !(s.keepOpen || errors.Is(err, ErrDecompress)) {
+					return
+				}
+			case <-ctx.Done():
+				yield(nil, ctx.Err())
+				return
+			}
+		}
+	}
+}
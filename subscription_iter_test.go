@@ -0,0 +1,190 @@
+//go:build go1.23
+
+package stomp
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_subscription_messages(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		id := f1.Header.Get(frame.Id)
+		for _, messageId := range []string{"message-1", "message-2"} {
+			rw.Write(frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.MessageId, messageId,
+				frame.Destination, "/queue/test-1"))
+		}
+		rw.Write(frame.New(frame.ERROR, frame.Message, "no such destination"))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+
+	var messageIds []string
+	var final error
+	for msg, err := range sub.Messages() {
+		if err != nil {
+			final = err
+			continue
+		}
+		messageIds = append(messageIds, msg.Header.Get(frame.MessageId))
+	}
+	c.Check(messageIds, DeepEquals, []string{"message-1", "message-2"})
+	var brokerError *BrokerError
+	c.Assert(errors.As(final, &brokerError), Equals, true)
+	c.Check(brokerError.Message, Equals, "no such destination")
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_messages_ctx(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		rw.Write(frame.New(frame.MESSAGE,
+			frame.Subscription, f1.Header.Get(frame.Id),
+			frame.MessageId, "message-1",
+			frame.Destination, "/queue/test-1"))
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.UNSUBSCRIBE)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+
+	// no more messages are coming, so the context deadline applies
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var errs []error
+	count := 0
+	for msg, err := range sub.MessagesCtx(ctx) {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c.Check(msg.Header.Get(frame.MessageId), Equals, "message-1")
+		count++
+	}
+	c.Check(count, Equals, 1)
+	c.Check(errs, DeepEquals, []error{context.DeadlineExceeded})
+	c.Check(sub.Active(), Equals, true)
+
+	// once unsubscribed, the iteration ends without an error
+	c.Assert(sub.Unsubscribe(), IsNil)
+	for _, err := range sub.Messages() {
+		c.Check(err, IsNil)
+	}
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_messages_keep_open(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		id := f1.Header.Get(frame.Id)
+		rw.Write(frame.New(frame.ERROR, frame.Message, "operation failed", frame.Subscription, id))
+		rw.Write(frame.New(frame.MESSAGE,
+			frame.Subscription, id,
+			frame.MessageId, "message-1",
+			frame.Destination, "/queue/test-1"))
+		rw.Write(frame.New(frame.ERROR, frame.Message, "no such destination"))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.KeepOpenOnError())
+	c.Assert(err, IsNil)
+
+	// the iteration goes on after the error for the subscription
+	var errs []string
+	var messageIds []string
+	for msg, err := range sub.Messages() {
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		messageIds = append(messageIds, msg.Header.Get(frame.MessageId))
+	}
+	c.Check(messageIds, DeepEquals, []string{"message-1"})
+	c.Assert(errs, HasLen, 2)
+	c.Check(errs[0], Matches, ".*operation failed.*")
+	c.Check(errs[1], Matches, ".*no such destination.*")
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_messages_separate_errors(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		rw.Write(frame.New(frame.MESSAGE,
+			frame.Subscription, f1.Header.Get(frame.Id),
+			frame.MessageId, "message-1",
+			frame.Destination, "/queue/test-1"))
+		rw.Write(frame.New(frame.ERROR, frame.Message, "no such destination"))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.SeparateErrorChannel())
+	c.Assert(err, IsNil)
+
+	// the error on Errs is yielded as if it were on C
+	var messageIds []string
+	var final error
+	for msg, err := range sub.Messages() {
+		if err != nil {
+			final = err
+			continue
+		}
+		messageIds = append(messageIds, msg.Header.Get(frame.MessageId))
+	}
+	c.Check(messageIds, DeepEquals, []string{"message-1"})
+	c.Assert(final, NotNil)
+	c.Check(final, ErrorMatches, "no such destination")
+	<-stop
+}
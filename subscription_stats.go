@@ -0,0 +1,68 @@
+package stomp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// SubscriptionStats contains counts of the messages received on a
+// subscription, as returned by Subscription.Stats, or on all of the
+// subscriptions of a connection, as returned by Conn.SubscriptionStats.
+type SubscriptionStats struct {
+	Delivered    uint64    // messages delivered on the C channel
+	Dropped      uint64    // messages discarded, as counted by Subscription.Dropped
+	Acked        uint64    // ACK frames written for the messages
+	Nacked       uint64    // NACK frames written for the messages
+	Errors       uint64    // errors received, such as ERROR frames from the server
+	LastDelivery time.Time // when a message was last delivered, zero if none has been
+}
+
+// Stats returns the counts of the messages received on the subscription
+// so far. ACK and NACK frames are counted once they have been written to
+// the connection, including those sent in a transaction that is aborted
+// later. The counts continue once the subscription has closed.
+func (s *Subscription) Stats() SubscriptionStats {
+	stats := SubscriptionStats{
+		Delivered: atomic.LoadUint64(&s.deliveredCount),
+		Dropped:   atomic.LoadUint64(&s.dropped),
+		Acked:     atomic.LoadUint64(&s.ackedCount),
+		Nacked:    atomic.LoadUint64(&s.nackedCount),
+		Errors:    atomic.LoadUint64(&s.errorCount),
+	}
+	if last := atomic.LoadInt64(&s.lastDelivery); last != 0 {
+		stats.LastDelivery = time.Unix(0, last)
+	}
+	return stats
+}
+
+// SubscriptionStats returns the counts of the messages received on the
+// subscriptions of the connection that have not closed, added together.
+// LastDelivery is the latest delivery on any of them.
+func (c *Conn) SubscriptionStats() SubscriptionStats {
+	var total SubscriptionStats
+	for _, sub := range c.activeSubscriptions() {
+		stats := sub.Stats()
+		total.Delivered += stats.Delivered
+		total.Dropped += stats.Dropped
+		total.Acked += stats.Acked
+		total.Nacked += stats.Nacked
+		total.Errors += stats.Errors
+		if stats.LastDelivery.After(total.LastDelivery) {
+			total.LastDelivery = stats.LastDelivery
+		}
+	}
+	return total
+}
+
+// acknowledged is called once an ACK or NACK frame for a message
+// received on the subscription has been written.
+func (s *Subscription) acknowledged(command string) {
+	switch command {
+	case frame.ACK:
+		atomic.AddUint64(&s.ackedCount, 1)
+	case frame.NACK:
+		atomic.AddUint64(&s.nackedCount, 1)
+	}
+}
@@ -0,0 +1,77 @@
+package stomp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_subscription_stats(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		id := f1.Header.Get(frame.Id)
+
+		for i := 0; i < 3; i++ {
+			rw.Write(frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.MessageId, fmt.Sprintf("message-%d", i),
+				frame.Destination, "/queue/test-1",
+				frame.Ack, fmt.Sprintf("ack-%d", i)))
+		}
+
+		for _, command := range []string{"ACK", "ACK", "NACK"} {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, command)
+		}
+		rw.Write(frame.New(frame.ERROR, frame.Message, "failed"))
+	}()
+
+	before := time.Now()
+	sub, err := conn.Subscribe("/queue/test-1", AckClientIndividual)
+	c.Assert(err, IsNil)
+	c.Check(sub.Stats(), Equals, SubscriptionStats{})
+
+	var msgs []*Message
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, <-sub.C)
+	}
+	c.Check(conn.Ack(msgs[0]), IsNil)
+	c.Check(conn.Ack(msgs[1]), IsNil)
+	c.Check(conn.Nack(msgs[2]), IsNil)
+
+	// the counts are updated once C has been read
+	for i := 0; i < 100 && conn.SubscriptionStats().Delivered < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	total := conn.SubscriptionStats()
+	c.Check(total.Delivered, Equals, uint64(3))
+	c.Check(total.LastDelivery.Before(before), Equals, false)
+
+	msg := <-sub.C
+	c.Assert(msg.Err, NotNil)
+	<-stop
+
+	stats := sub.Stats()
+	c.Check(stats.Delivered, Equals, uint64(3))
+	c.Check(stats.Dropped, Equals, uint64(0))
+	c.Check(stats.Acked, Equals, uint64(2))
+	c.Check(stats.Nacked, Equals, uint64(1))
+	c.Check(stats.Errors, Equals, uint64(1))
+	c.Check(stats.LastDelivery, Equals, total.LastDelivery)
+
+	// the subscription has closed, so it is no longer counted
+	c.Check(conn.SubscriptionStats(), Equals, SubscriptionStats{})
+}
@@ -0,0 +1,1502 @@
+package stomp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_subscription_read_with_context(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		id := f1.Header.Get(frame.Id)
+
+		f2 := frame.New(frame.MESSAGE,
+			frame.Subscription, id,
+			frame.MessageId, "message-1",
+			frame.Destination, "/queue/test-1")
+		f2.Body = []byte("message body")
+		rw.Write(f2)
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "UNSUBSCRIBE")
+		rw.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+
+		f4, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f4.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f4.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+
+	msg, err := sub.ReadWithContext(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Body), Equals, "message body")
+
+	// no more messages are coming, so the context deadline applies
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	msg, err = sub.ReadWithContext(ctx)
+	c.Assert(msg, IsNil)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+	c.Assert(sub.Active(), Equals, true)
+
+	err = sub.Unsubscribe()
+	c.Assert(err, IsNil)
+
+	msg, err = sub.ReadWithContext(context.Background())
+	c.Assert(msg, IsNil)
+	c.Assert(err, Equals, ErrCompletedSubscription)
+
+	err = conn.Disconnect()
+	c.Assert(err, IsNil)
+	<-stop
+}
+
+// Starts a fake server that accepts a subscription and then ignores the
+// UNSUBSCRIBE frame, so the client never receives the RECEIPT.
+func unsubscribeIgnoredHelper(c *C, rw *fakeReaderWriter, stop chan struct{}) {
+	defer func() {
+		rw.Close()
+		close(stop)
+	}()
+
+	f1, err := rw.Read()
+	c.Assert(err, IsNil)
+	c.Assert(f1.Command, Equals, "SUBSCRIBE")
+
+	f2, err := rw.Read()
+	c.Assert(err, IsNil)
+	c.Assert(f2.Command, Equals, "UNSUBSCRIBE")
+
+	f3, err := rw.Read()
+	c.Assert(err, IsNil)
+	c.Assert(f3.Command, Equals, "DISCONNECT")
+	rw.Write(frame.New(frame.RECEIPT,
+		frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+}
+
+func (s *StompSuite) Test_unsubscribe_timeout_option(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+	go unsubscribeIgnoredHelper(c, rw, stop)
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+
+	start := time.Now()
+	err = sub.Unsubscribe(UnsubscribeOpt.Timeout(20 * time.Millisecond))
+	c.Assert(err, Equals, ErrUnsubscribeTimeout)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+
+	err = conn.Disconnect()
+	c.Assert(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_unsubscribe_timeout_conn_option(c *C) {
+	conn, rw := connectHelper(c, V12, ConnOpt.UnsubscribeTimeout(20*time.Millisecond))
+	stop := make(chan struct{})
+	go unsubscribeIgnoredHelper(c, rw, stop)
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+
+	err = sub.Unsubscribe()
+	c.Assert(err, Equals, ErrUnsubscribeTimeout)
+
+	err = conn.Disconnect()
+	c.Assert(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_unsubscribe_with_context(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+	go unsubscribeIgnoredHelper(c, rw, stop)
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = sub.UnsubscribeWithContext(ctx)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+
+	err = conn.Disconnect()
+	c.Assert(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_unsubscribe_connection_closed(c *C) {
+	const n = 500
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		for i := 0; i < n; i++ {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, frame.SUBSCRIBE)
+		}
+		// no response to the UNSUBSCRIBE frames
+		for i := 0; i < n; i++ {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, frame.UNSUBSCRIBE)
+		}
+		rw.Close()
+	}()
+
+	subs := make([]*Subscription, n)
+	for i := range subs {
+		var err error
+		subs[i], err = conn.Subscribe(fmt.Sprintf("/queue/test-%d", i), AckAuto)
+		c.Assert(err, IsNil)
+	}
+
+	start := time.Now()
+	errs := make(chan error, n)
+	for _, sub := range subs {
+		go func(sub *Subscription) {
+			errs <- sub.Unsubscribe(UnsubscribeOpt.Timeout(time.Minute))
+		}(sub)
+	}
+	for i := 0; i < n; i++ {
+		c.Check(<-errs, Equals, ErrConnectionClosed)
+	}
+	<-stop
+	c.Check(time.Since(start) < time.Second, Equals, true)
+
+	for _, sub := range subs {
+		for range sub.C {
+		}
+		c.Check(atomic.LoadInt32(&sub.state), Equals, int32(subStateClosed))
+	}
+}
+
+func (s *StompSuite) Test_unsubscribe_timeout_option_invalid_command(c *C) {
+	f := frame.New(frame.SEND)
+	err := UnsubscribeOpt.Timeout(time.Second)(f)
+	c.Assert(err, Equals, ErrInvalidCommand)
+}
+
+func (s *StompSuite) Test_subscription_channel_capacity(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+	const count = 50
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		id := f1.Header.Get(frame.Id)
+
+		for i := 0; i < count; i++ {
+			rw.Write(frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.MessageId, fmt.Sprintf("message-%d", i),
+				frame.Destination, "/queue/test-1"))
+		}
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "UNSUBSCRIBE")
+		rw.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto,
+		SubscribeOpt.ChannelCapacity(100))
+	c.Assert(err, IsNil)
+	c.Assert(cap(sub.C), Equals, 100)
+
+	// all messages fit in the channel without being read
+	for i := 0; i < 100 && len(sub.C) < count; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(len(sub.C), Equals, count)
+
+	err = sub.Unsubscribe()
+	c.Assert(err, IsNil)
+
+	for i := 0; i < count; i++ {
+		msg := <-sub.C
+		c.Assert(msg.Header.Get(frame.MessageId), Equals, fmt.Sprintf("message-%d", i))
+	}
+	_, ok := <-sub.C
+	c.Assert(ok, Equals, false)
+
+	err = conn.Disconnect()
+	c.Assert(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_unsubscribe_with_full_channel(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		id := f1.Header.Get(frame.Id)
+
+		for i := 0; i < 5; i++ {
+			rw.Write(frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.MessageId, fmt.Sprintf("message-%d", i),
+				frame.Destination, "/queue/test-1"))
+		}
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "UNSUBSCRIBE")
+		rw.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto,
+		SubscribeOpt.ChannelCapacity(1))
+	c.Assert(err, IsNil)
+
+	// wait for the channel to fill up
+	for i := 0; i < 100 && len(sub.C) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// nobody is reading from C, but unsubscribe still completes
+	err = sub.Unsubscribe(UnsubscribeOpt.Timeout(5 * time.Second))
+	c.Assert(err, IsNil)
+
+	msg := <-sub.C
+	c.Assert(msg.Header.Get(frame.MessageId), Equals, "message-0")
+	for range sub.C {
+	}
+
+	err = conn.Disconnect()
+	c.Assert(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_unsubscribe_delivers_every_message(c *C) {
+	const count = 20
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		id := f1.Header.Get(frame.Id)
+
+		// a second subscription to the same destination
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "SUBSCRIBE")
+		other := f2.Header.Get(frame.Id)
+
+		for i := 0; i < count; i++ {
+			rw.Write(frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.MessageId, fmt.Sprintf("message-%d", i),
+				frame.Destination, "/queue/test-1"))
+		}
+
+		// the RECEIPT follows the messages at once
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "UNSUBSCRIBE")
+		c.Assert(f3.Header.Get(frame.Id), Equals, id)
+		rw.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+		rw.Write(frame.New(frame.MESSAGE,
+			frame.Subscription, other,
+			frame.MessageId, "other",
+			frame.Destination, "/queue/test-1"))
+
+		f4, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f4.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f4.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto,
+		SubscribeOpt.ChannelCapacity(1))
+	c.Assert(err, IsNil)
+	otherSub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+
+	// wait for the channel to fill up
+	for i := 0; i < 100 && len(sub.C) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// nobody is reading from C, but every message is delivered once
+	// the server has confirmed
+	err = sub.Unsubscribe(UnsubscribeOpt.Timeout(5 * time.Second))
+	c.Assert(err, IsNil)
+
+	i := 0
+	for msg := range sub.C {
+		c.Check(msg.Err, IsNil)
+		c.Check(msg.Header.Get(frame.MessageId), Equals, fmt.Sprintf("message-%d", i))
+		i++
+	}
+	c.Check(i, Equals, count)
+	c.Check(sub.Dropped(), Equals, uint64(0))
+
+	msg := <-otherSub.C
+	c.Check(msg.Header.Get(frame.MessageId), Equals, "other")
+
+	err = conn.Disconnect()
+	c.Assert(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscribe_invalid_channel_capacity(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f1.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto,
+		SubscribeOpt.ChannelCapacity(-1))
+	c.Assert(sub, IsNil)
+	c.Assert(err, Equals, ErrInvalidOptionValue)
+
+	err = conn.Disconnect()
+	c.Assert(err, IsNil)
+	<-stop
+}
+
+// Subscribes with the given options, has the server send count messages
+// and waits until they have all been processed by the subscription.
+func overflowHelper(c *C, count int, opts ...func(*frame.Frame) error) (*Conn, *Subscription, *fakeReaderWriter) {
+	conn, rw := connectHelper(c, V12)
+	subscribed := make(chan string)
+
+	go func() {
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		subscribed <- f1.Header.Get(frame.Id)
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto, opts...)
+	c.Assert(err, IsNil)
+	id := <-subscribed
+
+	for i := 0; i < count; i++ {
+		rw.Write(frame.New(frame.MESSAGE,
+			frame.Subscription, id,
+			frame.MessageId, fmt.Sprintf("message-%d", i),
+			frame.Destination, "/queue/test-1"))
+	}
+	return conn, sub, rw
+}
+
+func waitForDropped(sub *Subscription, n uint64) {
+	for i := 0; i < 200 && sub.Dropped() < n; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func unsubscribeAndDisconnectHelper(c *C, conn *Conn, sub *Subscription, rw *fakeReaderWriter) {
+	stop := make(chan struct{})
+	unsubscribed := make(chan struct{})
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "UNSUBSCRIBE")
+		rw.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f1.Header.Get(frame.Receipt)))
+		close(unsubscribed)
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+	}()
+
+	if sub.Active() {
+		err := sub.Unsubscribe()
+		c.Assert(err, IsNil)
+	}
+	// a subscription that is already closed sends UNSUBSCRIBE by itself
+	<-unsubscribed
+	err := conn.Disconnect()
+	c.Assert(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_overflow_drop_newest(c *C) {
+	conn, sub, rw := overflowHelper(c, 5,
+		SubscribeOpt.ChannelCapacity(2),
+		SubscribeOpt.OverflowStrategy(OverflowDropNewest))
+
+	waitForDropped(sub, 3)
+	c.Assert(sub.Dropped(), Equals, uint64(3))
+	c.Assert((<-sub.C).Header.Get(frame.MessageId), Equals, "message-0")
+	c.Assert((<-sub.C).Header.Get(frame.MessageId), Equals, "message-1")
+
+	unsubscribeAndDisconnectHelper(c, conn, sub, rw)
+}
+
+func (s *StompSuite) Test_subscription_overflow_drop_oldest(c *C) {
+	conn, sub, rw := overflowHelper(c, 5,
+		SubscribeOpt.ChannelCapacity(2),
+		SubscribeOpt.OverflowStrategy(OverflowDropOldest))
+
+	waitForDropped(sub, 3)
+	c.Assert(sub.Dropped(), Equals, uint64(3))
+	c.Assert((<-sub.C).Header.Get(frame.MessageId), Equals, "message-3")
+	c.Assert((<-sub.C).Header.Get(frame.MessageId), Equals, "message-4")
+
+	unsubscribeAndDisconnectHelper(c, conn, sub, rw)
+}
+
+func (s *StompSuite) Test_subscription_overflow_fail(c *C) {
+	conn, sub, rw := overflowHelper(c, 2,
+		SubscribeOpt.ChannelCapacity(1),
+		SubscribeOpt.OverflowStrategy(OverflowFail))
+
+	for i := 0; i < 200 && sub.Active(); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the error replaces the oldest message in the channel
+	msg := <-sub.C
+	c.Assert(msg.Err, Equals, ErrSubscriptionOverflow)
+	_, ok := <-sub.C
+	c.Assert(ok, Equals, false)
+	c.Assert(sub.Active(), Equals, false)
+	c.Assert(sub.Dropped(), Equals, uint64(1))
+
+	// the subscription unsubscribes itself
+	unsubscribeAndDisconnectHelper(c, conn, sub, rw)
+}
+
+func (s *StompSuite) Test_subscription_overflow_fail_while_unsubscribing(c *C) {
+	conn, sub, rw := overflowHelper(c, 1,
+		SubscribeOpt.ChannelCapacity(1),
+		SubscribeOpt.OverflowStrategy(OverflowFail))
+	for i := 0; i < 200 && len(sub.C) < 1; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "UNSUBSCRIBE")
+		// the channel is full, so this message overflows it
+		rw.Write(frame.New(frame.MESSAGE,
+			frame.Subscription, sub.Id(),
+			frame.MessageId, "message-1",
+			frame.Destination, "/queue/test-1"))
+		rw.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f1.Header.Get(frame.Receipt)))
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT,
+			frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+	}()
+
+	unsubscribed := make(chan error, 1)
+	go func() {
+		unsubscribed <- sub.Unsubscribe()
+	}()
+	select {
+	case err := <-unsubscribed:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("Unsubscribe did not return")
+	}
+
+	msg := <-sub.C
+	c.Assert(msg.Header.Get(frame.MessageId), Equals, "message-0")
+	_, ok := <-sub.C
+	c.Assert(ok, Equals, false)
+
+	err := conn.Disconnect()
+	c.Assert(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_overflow_invalid(c *C) {
+	f := frame.New(frame.SUBSCRIBE)
+	err := withSettings(f, newSubscribeOptions(), func() error {
+		return SubscribeOpt.OverflowStrategy(OverflowStrategy(99))(f)
+	})
+	c.Assert(err, Equals, ErrInvalidOptionValue)
+	c.Assert(SubscribeOpt.OverflowStrategy(OverflowFail)(f), Equals, ErrInvalidCommand)
+}
+
+func (s *StompSuite) Test_subscription_ack_up_to(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		for i := 1; i <= 3; i++ {
+			rw.Write(frame.New(frame.MESSAGE,
+				frame.Subscription, f1.Header.Get(frame.Id),
+				frame.MessageId, fmt.Sprintf("message-%d", i),
+				frame.Ack, fmt.Sprintf("ack-%d", i),
+				frame.Destination, "/queue/test-1"))
+		}
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "ACK")
+		c.Check(f2.Header.Get(frame.Id), Equals, "ack-3")
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckClient)
+	c.Assert(err, IsNil)
+	var msg *Message
+	for i := 0; i < 3; i++ {
+		msg = <-sub.C
+		c.Assert(msg.Err, IsNil)
+	}
+	err = sub.AckUpTo(msg)
+	c.Check(err, IsNil)
+
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+
+	individual := &Subscription{ackMode: AckClientIndividual}
+	err = individual.AckUpTo(&Message{Subscription: individual})
+	c.Check(err, Equals, ErrNoCumulativeAck)
+	err = individual.AckUpTo(msg)
+	c.Check(err, Equals, ErrNotReceivedMessage)
+}
+
+// autoAckHelper sends messages to a subscription with automatic cumulative
+// acks, and checks the ACK frame that follows each group of messages.
+func autoAckHelper(c *C, groups [][]string, acks []string, opts ...func(*frame.Frame) error) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+	acked := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		for i, group := range groups {
+			for _, messageId := range group {
+				rw.Write(frame.New(frame.MESSAGE,
+					frame.Subscription, f1.Header.Get(frame.Id),
+					frame.MessageId, messageId,
+					frame.Ack, "ack-"+messageId,
+					frame.Destination, "/queue/test-1"))
+			}
+			f2, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f2.Command, Equals, "ACK")
+			c.Check(f2.Header.Get(frame.Id), Equals, acks[i])
+			acked <- struct{}{}
+		}
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, "DISCONNECT")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckClient, opts...)
+	c.Assert(err, IsNil)
+	for _, group := range groups {
+		for range group {
+			msg := <-sub.C
+			c.Assert(msg.Err, IsNil)
+		}
+		<-acked
+	}
+
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_auto_cumulative_ack_every(c *C) {
+	autoAckHelper(c,
+		[][]string{{"1", "2"}, {"3", "4"}},
+		[]string{"ack-2", "ack-4"},
+		SubscribeOpt.AutoCumulativeAck(2, 0))
+}
+
+func (s *StompSuite) Test_subscription_auto_cumulative_ack_interval(c *C) {
+	autoAckHelper(c,
+		[][]string{{"1"}, {"2"}},
+		[]string{"ack-1", "ack-2"},
+		SubscribeOpt.AutoCumulativeAck(100, 20*time.Millisecond))
+}
+
+func (s *StompSuite) Test_subscription_auto_cumulative_ack_unread(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+	acked := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, "SUBSCRIBE")
+		for _, messageId := range []string{"1", "2"} {
+			rw.Write(frame.New(frame.MESSAGE,
+				frame.Subscription, f1.Header.Get(frame.Id),
+				frame.MessageId, messageId,
+				frame.Ack, "ack-"+messageId,
+				frame.Destination, "/queue/test-1"))
+		}
+
+		// only the message that the program has read is acknowledged,
+		// although the other has arrived
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, "ACK")
+		c.Check(f2.Header.Get(frame.Id), Equals, "ack-1")
+		close(acked)
+
+		for {
+			f3, err := rw.Read()
+			c.Assert(err, IsNil)
+			if f3.Command == "DISCONNECT" {
+				rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+				return
+			}
+			c.Check(f3.Command, Equals, "ACK")
+		}
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckClient,
+		SubscribeOpt.AutoCumulativeAck(0, 20*time.Millisecond))
+	c.Assert(err, IsNil)
+	c.Check(cap(sub.C), Equals, 0)
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	<-acked
+
+	msg = <-sub.C
+	c.Assert(msg.Err, IsNil)
+	err = conn.Disconnect()
+	c.Check(err, IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_auto_cumulative_ack_invalid(c *C) {
+	conn, rw := connectHelper(c, V12)
+	defer rw.Close()
+
+	_, err := conn.Subscribe("/queue/test-1", AckClientIndividual, SubscribeOpt.AutoCumulativeAck(10, 0))
+	c.Check(err, Equals, ErrNoCumulativeAck)
+	_, err = conn.Subscribe("/queue/test-1", AckClient, SubscribeOpt.AutoCumulativeAck(0, 0))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+	_, err = conn.Subscribe("/queue/test-1", AckClient, SubscribeOpt.AutoCumulativeAck(-1, time.Second))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+	_, err = conn.SubscribeFunc("/queue/test-1", AckClient, func(*Message) {}, SubscribeOpt.AutoCumulativeAck(10, 0))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+	_, err = conn.Subscribe("/queue/test-1", AckClient,
+		SubscribeOpt.AutoCumulativeAck(10, 0), SubscribeOpt.ChannelCapacity(4))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+}
+
+func (s *StompSuite) Test_subscription_on_error(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		id := f1.Header.Get(frame.Id)
+
+		// the subscription survives the first error
+		rw.Write(frame.New(frame.ERROR, frame.Message, "not authorized", frame.Subscription, id))
+		rw.Write(frame.New(frame.MESSAGE, frame.Subscription, id, frame.MessageId, "1", frame.Destination, "/queue/test-1"))
+		rw.Write(frame.New(frame.ERROR, frame.Message, "no such destination", frame.Subscription, id))
+
+		// the connection is still open
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+	}()
+
+	errs := make(chan *Error, 2)
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.OnError(func(sub *Subscription, err *Error) bool {
+		errs <- err
+		return len(errs) == 1
+	}))
+	c.Assert(err, IsNil)
+
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(msg.Header.Get(frame.MessageId), Equals, "1")
+	_, ok := <-sub.C
+	c.Check(ok, Equals, false)
+	c.Check((<-errs).Message, Equals, "not authorized")
+	c.Check((<-errs).Message, Equals, "no such destination")
+
+	_, err = conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.OnError(nil))
+	c.Check(err, Equals, ErrNilOption)
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_keep_open_on_error(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		id := f1.Header.Get(frame.Id)
+		rw.Write(frame.New(frame.MESSAGE, frame.Subscription, id, frame.MessageId, "1", frame.Destination, "/queue/test-1"))
+		rw.Write(frame.New(frame.ERROR, frame.Message, "operation failed", frame.Subscription, id))
+		rw.Write(frame.New(frame.MESSAGE, frame.Subscription, id, frame.MessageId, "2", frame.Destination, "/queue/test-1"))
+
+		// the connection is still open
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.UNSUBSCRIBE)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.KeepOpenOnError())
+	c.Assert(err, IsNil)
+
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(msg.Header.Get(frame.MessageId), Equals, "1")
+	msg = <-sub.C
+	c.Assert(msg.Err, NotNil)
+	c.Check(msg.Err.(*Error).Message, Equals, "operation failed")
+	c.Check(msg.Header.Get(frame.Subscription), Equals, sub.Id())
+	c.Check(sub.Active(), Equals, true)
+	msg = <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(msg.Header.Get(frame.MessageId), Equals, "2")
+
+	stats := sub.Stats()
+	c.Check(stats.Delivered, Equals, uint64(2))
+	c.Check(stats.Errors, Equals, uint64(1))
+
+	c.Check(sub.Unsubscribe(), IsNil)
+	_, ok := <-sub.C
+	c.Check(ok, Equals, false)
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_keep_open_connection_error(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+
+		// an error for the connection still closes the subscription
+		rw.Write(frame.New(frame.ERROR, frame.Message, "shutting down"))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.KeepOpenOnError())
+	c.Assert(err, IsNil)
+
+	msg := <-sub.C
+	c.Assert(msg.Err, NotNil)
+	_, ok := <-sub.C
+	c.Check(ok, Equals, false)
+	c.Check(sub.Active(), Equals, false)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_separate_error_channel(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		id := f1.Header.Get(frame.Id)
+		rw.Write(frame.New(frame.MESSAGE, frame.Subscription, id, frame.MessageId, "1", frame.Destination, "/queue/test-1"))
+		rw.Write(frame.New(frame.MESSAGE, frame.Subscription, id, frame.MessageId, "2", frame.Destination, "/queue/test-1"))
+		rw.Write(frame.New(frame.ERROR, frame.Message, "shutting down"))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.SeparateErrorChannel())
+	c.Assert(err, IsNil)
+
+	var messageIds []string
+	for msg := range sub.C {
+		c.Check(msg.Err, IsNil)
+		messageIds = append(messageIds, msg.Header.Get(frame.MessageId))
+	}
+	c.Check(messageIds, DeepEquals, []string{"1", "2"})
+
+	e, ok := <-sub.Errs
+	c.Assert(ok, Equals, true)
+	c.Check(e.Message, Equals, "shutting down")
+	var brokerError *BrokerError
+	c.Check(errors.As(e, &brokerError), Equals, true)
+	_, ok = <-sub.Errs
+	c.Check(ok, Equals, false)
+	<-stop
+
+	// without the option there is no error channel
+	conn, rw = connectHelper(c, V12)
+	go func() {
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.SUBSCRIBE)
+		rw.Close()
+	}()
+	sub, err = conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+	c.Check(sub.Errs, IsNil)
+	msg := <-sub.C
+	c.Check(msg.Err, NotNil)
+}
+
+func (s *StompSuite) Test_subscription_separate_error_channel_read(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		id := f1.Header.Get(frame.Id)
+		rw.Write(frame.New(frame.ERROR, frame.Message, "operation failed", frame.Subscription, id))
+		rw.Write(frame.New(frame.MESSAGE, frame.Subscription, id, frame.MessageId, "1", frame.Destination, "/queue/test-1"))
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.UNSUBSCRIBE)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto,
+		SubscribeOpt.SeparateErrorChannel(), SubscribeOpt.KeepOpenOnError())
+	c.Assert(err, IsNil)
+
+	// Read returns the errors and the messages, as without the option
+	msg, err := sub.Read()
+	c.Check(msg, IsNil)
+	c.Assert(err, NotNil)
+	c.Check(err.(*Error).Message, Equals, "operation failed")
+	msg, err = sub.Read()
+	c.Assert(err, IsNil)
+	c.Check(msg.Header.Get(frame.MessageId), Equals, "1")
+
+	c.Check(sub.Unsubscribe(), IsNil)
+	_, ok := <-sub.C
+	c.Check(ok, Equals, false)
+	_, ok = <-sub.Errs
+	c.Check(ok, Equals, false)
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_cancelled_by_broker(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		f := frame.New(frame.ERROR,
+			frame.Message, "Server cancelled subscription",
+			frame.Subscription, f1.Header.Get(frame.Id))
+		f.Body = []byte("The server has canceled a subscription.")
+		rw.Write(f)
+
+		// the connection is still open, and the function has subscribed again
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Check(f2.Command, Equals, frame.SUBSCRIBE)
+		c.Check(f2.Header.Get(frame.Destination), Equals, "/queue/test-1")
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	cancelled := make(chan *Subscription, 1)
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto,
+		SubscribeOpt.RetryOnError(RetryPolicy{InitialInterval: time.Millisecond}),
+		SubscribeOpt.OnCancel(func(sub *Subscription) {
+			_, err := sub.conn.Subscribe(sub.Destination(), AckAuto)
+			c.Check(err, IsNil)
+			cancelled <- sub
+		}))
+	c.Assert(err, IsNil)
+
+	msg := <-sub.C
+	c.Assert(msg.Err, NotNil)
+	c.Check(errors.Is(msg.Err, ErrSubscriptionCancelledByBroker), Equals, true)
+	var brokerError *BrokerError
+	c.Assert(errors.As(msg.Err, &brokerError), Equals, true)
+	c.Check(string(brokerError.Body), Equals, "The server has canceled a subscription.")
+	_, ok := <-sub.C
+	c.Check(ok, Equals, false)
+	c.Check(<-cancelled, Equals, sub)
+	c.Check(sub.Retries(), Equals, uint64(0))
+
+	_, err = conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.OnCancel(nil))
+	c.Check(err, Equals, ErrNilOption)
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_retry_on_error(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		id := f1.Header.Get(frame.Id)
+		rw.Write(frame.New(frame.ERROR, frame.Message, "not authorized", frame.Subscription, id))
+
+		// the same SUBSCRIBE frame is sent again
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Check(f2.Command, Equals, frame.SUBSCRIBE)
+		c.Check(f2.Header, DeepEquals, f1.Header)
+		rw.Write(frame.New(frame.MESSAGE, frame.Subscription, id, frame.MessageId, "1", frame.Destination, "/queue/test-1"))
+
+		// after a message, the attempts start again
+		rw.Write(frame.New(frame.ERROR, frame.Message, "not authorized", frame.Subscription, id))
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Check(f3.Command, Equals, frame.SUBSCRIBE)
+
+		// the policy is exhausted
+		rw.Write(frame.New(frame.ERROR, frame.Message, "no such destination", frame.Subscription, id))
+
+		f4, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f4.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f4.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckClient,
+		SubscribeOpt.Header("x-custom", "1"),
+		SubscribeOpt.RetryOnError(RetryPolicy{InitialInterval: time.Millisecond, MaxAttempts: 1}))
+	c.Assert(err, IsNil)
+
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(msg.Header.Get(frame.MessageId), Equals, "1")
+	msg = <-sub.C
+	c.Assert(msg.Err, NotNil)
+	c.Check(msg.Err.Error(), Equals, "no such destination")
+	_, ok := <-sub.C
+	c.Check(ok, Equals, false)
+	c.Check(sub.Retries(), Equals, uint64(2))
+
+	_, err = conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.RetryOnError(RetryPolicy{Multiplier: 0.5}))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_retry_stops_on_unsubscribe(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		id := f1.Header.Get(frame.Id)
+		rw.Write(frame.New(frame.ERROR, frame.Message, "not authorized", frame.Subscription, id))
+
+		// no SUBSCRIBE frame is sent after the UNSUBSCRIBE frame
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.UNSUBSCRIBE)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto,
+		SubscribeOpt.RetryOnError(RetryPolicy{InitialInterval: 100 * time.Millisecond}))
+	c.Assert(err, IsNil)
+	err = <-conn.Errors()
+	c.Check(err, ErrorMatches, "not authorized")
+	time.Sleep(10 * time.Millisecond)
+	c.Check(sub.Unsubscribe(), IsNil)
+	time.Sleep(200 * time.Millisecond)
+	c.Check(sub.Retries(), Equals, uint64(0))
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_headers(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		rw.Close()
+	}()
+
+	sub, err := conn.Subscribe("/topic/test-1", AckClient,
+		SubscribeOpt.Id("sub-1"),
+		SubscribeOpt.Header("activemq.prefetchSize", "10"))
+	c.Assert(err, IsNil)
+	<-stop
+
+	header := sub.Headers()
+	c.Check(header.Get(frame.Destination), Equals, "/topic/test-1")
+	c.Check(header.Get(frame.Ack), Equals, "client")
+	c.Check(header.Get(frame.Id), Equals, "sub-1")
+	c.Check(header.Get("activemq.prefetchSize"), Equals, "10")
+
+	header.Set("activemq.prefetchSize", "20")
+	c.Check(sub.Headers().Get("activemq.prefetchSize"), Equals, "10")
+}
+
+func (s *StompSuite) Test_subscription_id(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		c.Check(f1.Header.Get(frame.Id), Equals, "orders-consumer")
+
+		// the subscription with the same id is not sent
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.SUBSCRIBE)
+		c.Check(f2.Header.Get(frame.Id), Matches, `sub-\d+-\d+`)
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, frame.UNSUBSCRIBE)
+		c.Check(f3.Header.Get(frame.Id), Equals, "orders-consumer")
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+
+		f4, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f4.Command, Equals, frame.SUBSCRIBE)
+		c.Check(f4.Header.Get(frame.Id), Equals, "orders-consumer")
+
+		f5, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f5.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f5.Header.Get(frame.Receipt)))
+	}()
+
+	sub1, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.Id("orders-consumer"))
+	c.Assert(err, IsNil)
+	c.Check(sub1.Id(), Equals, "orders-consumer")
+
+	_, err = conn.Subscribe("/queue/test-2", AckAuto, SubscribeOpt.Id("orders-consumer"))
+	c.Check(errors.Is(err, ErrSubscriptionIdInUse), Equals, true)
+	c.Check(err, ErrorMatches, `subscription id is in use: "orders-consumer"`)
+	_, err = conn.Subscribe("/queue/test-2", AckAuto, SubscribeOpt.Id(""))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+
+	sub2, err := conn.Subscribe("/queue/test-2", AckAuto)
+	c.Assert(err, IsNil)
+	c.Check(sub2.Id(), Matches, `sub-0-\d+`)
+
+	// the id can be used again once the subscription has closed
+	c.Assert(sub1.Unsubscribe(), IsNil)
+	sub3, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.Id("orders-consumer"))
+	c.Assert(err, IsNil)
+	c.Check(sub3.Id(), Equals, "orders-consumer")
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_id_not_receipt_id(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	// the id that a receipt would have been given
+	id := strconv.FormatUint(atomic.LoadUint64(&_lastId)+1, 10)
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		c.Check(f1.Header.Get(frame.Id), Equals, id)
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.SEND)
+		receipt := f2.Header.Get(frame.Receipt)
+		c.Check(receipt, Matches, `rcpt-\d+`)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+		rw.Write(frame.New(frame.MESSAGE, frame.Subscription, id,
+			frame.Destination, "/queue/test-1", frame.MessageId, "message-1"))
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	_, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.Id("rcpt-1"))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.Id(id))
+	c.Assert(err, IsNil)
+	c.Check(conn.Send("/queue/test-1", "text/plain", []byte("hello"), SendOpt.Receipt), IsNil)
+
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(msg.Header.Get(frame.MessageId), Equals, "message-1")
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_pause(c *C) {
+	conn, rw := connectHelper(c, V12)
+	paused := make(chan struct{})
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		id := f1.Header.Get(frame.Id)
+
+		for _, messageId := range []string{"message-1", "message-2"} {
+			<-paused
+			rw.Write(frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.MessageId, messageId,
+				frame.Destination, "/queue/test-1"))
+		}
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.UNSUBSCRIBE)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+	c.Check(sub.Paused(), Equals, false)
+	sub.Pause()
+	sub.Pause()
+	c.Check(sub.Paused(), Equals, true)
+	paused <- struct{}{}
+
+	select {
+	case msg := <-sub.C:
+		c.Fatalf("message delivered while paused: %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sub.Resume()
+	c.Check(sub.Paused(), Equals, false)
+	msg := <-sub.C
+	c.Check(msg.Header.Get(frame.MessageId), Equals, "message-1")
+
+	// the message held while paused is delivered on unsubscribing
+	sub.Pause()
+	paused <- struct{}{}
+	c.Assert(sub.Unsubscribe(), IsNil)
+	msg = <-sub.C
+	c.Assert(msg, NotNil)
+	c.Check(msg.Header.Get(frame.MessageId), Equals, "message-2")
+	_, ok := <-sub.C
+	c.Check(ok, Equals, false)
+	sub.Resume()
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_subscription_pause_connection_lost(c *C) {
+	conn, rw := connectHelper(c, V12)
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+	sub.Pause()
+
+	f1, err := rw.Read()
+	c.Assert(err, IsNil)
+	c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+	rw.Write(frame.New(frame.MESSAGE,
+		frame.Subscription, f1.Header.Get(frame.Id),
+		frame.MessageId, "message-1",
+		frame.Destination, "/queue/test-1"))
+	rw.Close()
+
+	// the subscription closes, although a message is held
+	for msg := range sub.C {
+		if msg.Err != nil {
+			c.Check(errors.Is(msg.Err, ErrConnectionClosed), Equals, true)
+		}
+	}
+	c.Check(sub.Active(), Equals, false)
+}
+
+func (s *StompSuite) Test_subscribe_receipt(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer func() {
+			rw.Close()
+			close(stop)
+		}()
+
+		// the message is sent once the subscription is confirmed
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		receipt, ok := f1.Header.Contains(frame.Receipt)
+		c.Assert(ok, Equals, true)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+		rw.Write(frame.New(frame.MESSAGE,
+			frame.Subscription, f1.Header.Get(frame.Id),
+			frame.MessageId, "message-1",
+			frame.Destination, "/queue/test-1"))
+
+		// a subscription that is not confirmed in time is unsubscribed
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.SUBSCRIBE)
+
+		// the third subscription may be sent before the UNSUBSCRIBE frame,
+		// and the ERROR frame for it closes the connection
+		var denied *frame.Frame
+		for i := 0; i < 2; i++ {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			switch f.Command {
+			case frame.UNSUBSCRIBE:
+				c.Check(f.Header.Get(frame.Id), Equals, f2.Header.Get(frame.Id))
+				rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+			case frame.SUBSCRIBE:
+				c.Check(f.Header.Get(frame.Destination), Equals, "/queue/test-3")
+				denied = f
+			}
+		}
+		c.Assert(denied, NotNil)
+		rw.Write(frame.New(frame.ERROR,
+			frame.ReceiptId, denied.Header.Get(frame.Receipt),
+			frame.Message, "access denied"))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.Receipt(time.Second))
+	c.Assert(err, IsNil)
+	msg := <-sub.C
+	c.Assert(msg.Err, IsNil)
+	c.Check(msg.Id(), Equals, "message-1")
+	c.Check(sub.Active(), Equals, true)
+	_, ok := sub.Headers().Contains(frame.Receipt)
+	c.Check(ok, Equals, false)
+
+	sub2, err := conn.Subscribe("/queue/test-2", AckAuto, SubscribeOpt.Receipt(50*time.Millisecond))
+	c.Check(err, Equals, ErrMsgSendTimeout)
+	c.Check(sub2, IsNil)
+
+	_, err = conn.Subscribe("/queue/test-3", AckAuto, SubscribeOpt.Receipt(0))
+	c.Assert(err, NotNil)
+	var brokerErr *BrokerError
+	c.Assert(errors.As(err, &brokerErr), Equals, true)
+	c.Check(brokerErr.Message, Equals, "access denied")
+	<-stop
+
+	// the connection closed after the ERROR frame
+	msg = <-sub.C
+	c.Check(msg.Err, NotNil)
+}
+
+func (s *StompSuite) Test_subscription_unrelated_receipts(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SUBSCRIBE)
+		c.Check(f1.Header.Get(frame.Receipt), Equals, "my-receipt")
+		id := f1.Header.Get(frame.Id)
+
+		// receipts that are not for the UNSUBSCRIBE frame, including
+		// one with the id of the subscription, do not close it
+		for i, receipt := range []string{"my-receipt", "unknown", id + "-1"} {
+			rw.Write(frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.MessageId, fmt.Sprintf("message-%d", i),
+				frame.Destination, "/queue/test-1"))
+			rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+		}
+		rw.Write(frame.New(frame.MESSAGE,
+			frame.Subscription, id,
+			frame.MessageId, "message-3",
+			frame.Destination, "/queue/test-1"))
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.UNSUBSCRIBE)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto, SubscribeOpt.Header(frame.Receipt, "my-receipt"))
+	c.Assert(err, IsNil)
+	for i := 0; i < 4; i++ {
+		msg := <-sub.C
+		c.Assert(msg.Err, IsNil)
+		c.Check(msg.Id(), Equals, fmt.Sprintf("message-%d", i))
+	}
+	c.Check(sub.Active(), Equals, true)
+
+	c.Check(sub.Unsubscribe(), IsNil)
+	_, ok := <-sub.C
+	c.Check(ok, Equals, false)
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
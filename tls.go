@@ -0,0 +1,72 @@
+package stomp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// A TLSHandshakeError is returned by DialTLS and the other dial functions
+// when the TLS handshake with the server fails. No STOMP frames have been
+// exchanged, which distinguishes it from a failure of the STOMP connect
+// protocol sequence.
+type TLSHandshakeError struct {
+	Err error // the error from the TLS handshake
+}
+
+func (e *TLSHandshakeError) Error() string {
+	return "tls handshake failed: " + e.Err.Error()
+}
+
+// Unwrap returns the error from the TLS handshake.
+func (e *TLSHandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// DialTLS is the same as Dial, except that the network connection is
+// secured with TLS, in the same way as with ConnOpt.TLSConfig. If
+// tlsConfig is nil, the default configuration is used.
+func DialTLS(network, addr string, tlsConfig *tls.Config, opts ...func(*Conn) error) (*Conn, error) {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	return Dial(network, addr, append(opts, ConnOpt.TLSConfig(tlsConfig))...)
+}
+
+// dialNetwork creates a network connection to addr, using the dialer and
+// the timeout specified in options. If config is non-nil, the connection
+// is secured with TLS, and the TLS handshake is complete when it returns.
+func dialNetwork(ctx context.Context, network, addr string, config *tls.Config, options *connOptions) (net.Conn, error) {
+	if options.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.ConnectTimeout)
+		defer cancel()
+	}
+
+	dial := options.Dialer
+	if dial == nil {
+		var dialer net.Dialer
+		dial = dialer.DialContext
+	}
+	conn, err := dial(ctx, network, addr)
+	if err != nil || config == nil {
+		return conn, err
+	}
+
+	if config.ServerName == "" {
+		// the host name is used for SNI, and to verify the certificate
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, &TLSHandshakeError{Err: err}
+	}
+	return tlsConn, nil
+}
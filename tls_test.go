@@ -0,0 +1,140 @@
+package stomp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+// newTestCertificate creates a self-signed certificate for the
+// loopback address and the host name stomp.example.com.
+func newTestCertificate(c *C) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "stomp test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+		DNSNames:     []string{"stomp.example.com"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// tlsServer accepts TLS connections that present a client certificate,
+// and completes the STOMP connect sequence on each of them.
+type tlsServer struct {
+	listener    net.Listener
+	serverNames chan string
+}
+
+func newTLSServer(c *C, cert tls.Certificate, pool *x509.CertPool) *tlsServer {
+	s := &tlsServer{serverNames: make(chan string, 4)}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			s.serverNames <- hello.ServerName
+			return nil, nil
+		},
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	c.Assert(err, IsNil)
+	s.listener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := frame.NewReader(conn)
+				writer := frame.NewWriter(conn)
+				f, err := reader.Read()
+				if err != nil || f.Command != frame.CONNECT {
+					return
+				}
+				writer.Write(frame.New(frame.CONNECTED, frame.Version, "1.2"))
+				for {
+					f, err := reader.Read()
+					if err != nil {
+						return
+					}
+					if f != nil && f.Command == frame.DISCONNECT {
+						writer.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+					}
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *StompSuite) Test_dial_tls(c *C) {
+	cert, pool := newTestCertificate(c)
+	server := newTLSServer(c, cert, pool)
+	defer server.listener.Close()
+	addr := server.listener.Addr().String()
+
+	// the server name is taken from the address
+	conn, err := DialTLS("tcp", addr, &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+	})
+	c.Assert(err, IsNil)
+	c.Check(conn.Version(), Equals, V12)
+	c.Check(<-server.serverNames, Equals, "")
+	c.Check(conn.Disconnect(), IsNil)
+
+	// SNI
+	conn, err = Dial("tcp", addr, ConnOpt.TLSConfig(&tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+		ServerName:   "stomp.example.com",
+	}))
+	c.Assert(err, IsNil)
+	c.Check(<-server.serverNames, Equals, "stomp.example.com")
+	c.Check(conn.Disconnect(), IsNil)
+}
+
+func (s *StompSuite) Test_dial_tls_handshake_error(c *C) {
+	cert, pool := newTestCertificate(c)
+	server := newTLSServer(c, cert, pool)
+	defer server.listener.Close()
+
+	// the server's certificate is not trusted
+	_, err := DialTLS("tcp", server.listener.Addr().String(), nil)
+	c.Assert(err, NotNil)
+	var tlsErr *TLSHandshakeError
+	c.Check(errors.As(err, &tlsErr), Equals, true)
+
+	_, err = Dial("tcp", server.listener.Addr().String(), ConnOpt.TLSConfig(nil))
+	c.Check(err, Equals, ErrNilOption)
+}
@@ -0,0 +1,241 @@
+package stomp
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// A TraceContext identifies a span of a distributed trace, as described
+// by the W3C Trace Context recommendation. It is carried in the
+// "traceparent" and "tracestate" header entries of a message.
+type TraceContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Flags      byte   // trace flags, such as TraceSampled
+	TraceState string // vendor-specific trace information, may be empty
+}
+
+// TraceSampled is the trace flag that indicates that the
+// caller may have recorded trace data.
+const TraceSampled byte = 0x01
+
+// IsValid returns whether the trace and span ids are set.
+// A TraceContext with an id of all zeros cannot be propagated.
+func (tc TraceContext) IsValid() bool {
+	return tc.TraceID != [16]byte{} && tc.SpanID != [8]byte{}
+}
+
+// TraceParent returns the value of the "traceparent" header entry for tc.
+func (tc TraceContext) TraceParent() string {
+	var b strings.Builder
+	b.WriteString("00-")
+	b.WriteString(hex.EncodeToString(tc.TraceID[:]))
+	b.WriteByte('-')
+	b.WriteString(hex.EncodeToString(tc.SpanID[:]))
+	b.WriteByte('-')
+	b.WriteString(hex.EncodeToString([]byte{tc.Flags}))
+	return b.String()
+}
+
+var errInvalidTraceParent = errors.New("invalid traceparent")
+
+// ParseTraceParent parses the value of a "traceparent" header entry. Values
+// of a later version than 00 are accepted if they start with the fields
+// of version 00, as the recommendation requires. The TraceState of the
+// result is empty.
+func ParseTraceParent(s string) (TraceContext, error) {
+	var tc TraceContext
+	// version-traceid-spanid-flags, of 2, 32, 16 and 2 hex digits
+	const length = 2 + 1 + 32 + 1 + 16 + 1 + 2
+	if len(s) < length || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return tc, errInvalidTraceParent
+	}
+	version, ok := parseHex(s[0:2])
+	if !ok || version[0] == 0xff {
+		return tc, errInvalidTraceParent
+	}
+	if version[0] == 0 && len(s) != length {
+		return tc, errInvalidTraceParent
+	}
+	if len(s) > length && s[length] != '-' {
+		return tc, errInvalidTraceParent
+	}
+
+	traceID, ok1 := parseHex(s[3:35])
+	spanID, ok2 := parseHex(s[36:52])
+	flags, ok3 := parseHex(s[53:55])
+	if !ok1 || !ok2 || !ok3 {
+		return tc, errInvalidTraceParent
+	}
+	copy(tc.TraceID[:], traceID)
+	copy(tc.SpanID[:], spanID)
+	tc.Flags = flags[0]
+	if !tc.IsValid() {
+		return TraceContext{}, errInvalidTraceParent
+	}
+	return tc, nil
+}
+
+// parseHex decodes lower-case hex digits, which is the
+// only case permitted in a "traceparent" header entry.
+func parseHex(s string) ([]byte, bool) {
+	if strings.ToLower(s) != s {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
+
+// validTraceState reports whether s is a plausible value for a "tracestate"
+// header entry: a list of at most 32 key=value members separated by commas.
+func validTraceState(s string) bool {
+	members := strings.Split(s, ",")
+	if len(members) > 32 {
+		return false
+	}
+	for _, member := range members {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			// empty members are allowed, and ignored
+			continue
+		}
+		key, value, ok := strings.Cut(member, "=")
+		if !ok || key == "" || value == "" || strings.ContainsAny(value, "=") {
+			return false
+		}
+	}
+	return true
+}
+
+type traceContextKey struct{}
+
+// ContextWithTrace returns a copy of ctx that carries tc, for use with
+// SendOpt.Inject by the default TracePropagator.
+func ContextWithTrace(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceFromContext returns the TraceContext that ctx carries, and whether
+// it carries a valid one.
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok && tc.IsValid()
+}
+
+// A TraceCarrier holds the header entries that propagate a trace.
+// HeaderCarrier adapts a frame header to the interface, whose methods are
+// those of the TextMapCarrier of OpenTelemetry, so that a HeaderCarrier can
+// be passed to an OpenTelemetry propagator.
+type TraceCarrier interface {
+	Get(key string) string
+	Set(key, value string)
+	Keys() []string
+}
+
+// HeaderCarrier is a TraceCarrier for the header entries of a frame.
+type HeaderCarrier struct {
+	Header *frame.Header
+}
+
+// Get returns the value of the first header entry for key.
+func (hc HeaderCarrier) Get(key string) string {
+	return hc.Header.Get(key)
+}
+
+// Set replaces the header entries for key with one that has value.
+func (hc HeaderCarrier) Set(key, value string) {
+	hc.Header.Set(key, value)
+}
+
+// Keys returns the keys of the header entries, in order, without duplicates.
+func (hc HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, hc.Header.Len())
+	seen := make(map[string]bool, hc.Header.Len())
+	for i := 0; i < hc.Header.Len(); i++ {
+		key, _ := hc.Header.GetAt(i)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// A TracePropagator writes the trace that a context carries to the header
+// entries of a frame, and reads it back. The default propagates the
+// TraceContext of ContextWithTrace in the W3C format. A program that uses
+// OpenTelemetry can install a propagator that calls the Inject and Extract
+// methods of otel.GetTextMapPropagator with the carrier.
+type TracePropagator interface {
+	Inject(ctx context.Context, carrier TraceCarrier)
+	Extract(ctx context.Context, carrier TraceCarrier) context.Context
+}
+
+// w3cPropagator is the default TracePropagator.
+type w3cPropagator struct{}
+
+func (w3cPropagator) Inject(ctx context.Context, carrier TraceCarrier) {
+	tc, ok := TraceFromContext(ctx)
+	if !ok {
+		return
+	}
+	carrier.Set(frame.TraceParent, tc.TraceParent())
+	if tc.TraceState != "" {
+		carrier.Set(frame.TraceState, tc.TraceState)
+	}
+}
+
+func (w3cPropagator) Extract(ctx context.Context, carrier TraceCarrier) context.Context {
+	tc, err := ParseTraceParent(carrier.Get(frame.TraceParent))
+	if err != nil {
+		// a missing or malformed trace is not propagated
+		return ctx
+	}
+	// a malformed tracestate is discarded, but the trace is propagated
+	if state := carrier.Get(frame.TraceState); validTraceState(state) {
+		tc.TraceState = state
+	}
+	return ContextWithTrace(ctx, tc)
+}
+
+// propagatorValue wraps the propagator, because an atomic.Value
+// requires every value stored to have the same concrete type.
+type propagatorValue struct {
+	TracePropagator
+}
+
+var tracePropagator atomic.Value
+
+func init() {
+	tracePropagator.Store(propagatorValue{w3cPropagator{}})
+}
+
+// SetTracePropagator sets the propagator used by SendOpt.Inject and
+// Message.Extract. Passing nil restores the default, which propagates
+// the TraceContext of ContextWithTrace.
+func SetTracePropagator(p TracePropagator) {
+	if p == nil {
+		p = w3cPropagator{}
+	}
+	tracePropagator.Store(propagatorValue{p})
+}
+
+func getTracePropagator() TracePropagator {
+	return tracePropagator.Load().(propagatorValue).TracePropagator
+}
+
+// Extract returns a copy of ctx that carries the trace propagated in the
+// header entries of the message, by the propagator set with
+// SetTracePropagator. If the message has no trace, or its "traceparent"
+// header entry is malformed, ctx is returned unchanged.
+func (msg *Message) Extract(ctx context.Context) context.Context {
+	if msg.Header == nil {
+		return ctx
+	}
+	return getTracePropagator().Extract(ctx, HeaderCarrier{msg.Header})
+}
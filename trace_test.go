@@ -0,0 +1,125 @@
+package stomp
+
+import (
+	"context"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func (s *StompSuite) Test_parse_trace_parent(c *C) {
+	tc, err := ParseTraceParent(testTraceParent)
+	c.Assert(err, IsNil)
+	c.Check(tc.TraceID, Equals, [16]byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36})
+	c.Check(tc.SpanID, Equals, [8]byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7})
+	c.Check(tc.Flags, Equals, TraceSampled)
+	c.Check(tc.TraceParent(), Equals, testTraceParent)
+
+	// a later version may have more fields
+	tc, err = ParseTraceParent("cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-what-the-future-holds")
+	c.Assert(err, IsNil)
+	c.Check(tc.Flags, Equals, byte(0))
+
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01x",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+	} {
+		_, err = ParseTraceParent(s)
+		c.Check(err, NotNil, Commentf("%q", s))
+	}
+}
+
+func (s *StompSuite) Test_send_inject_trace(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SEND)
+		c.Check(f1.Header.Get(frame.TraceParent), Equals, testTraceParent)
+		c.Check(f1.Header.Get(frame.TraceState), Equals, "congo=t61rcWkgMzE")
+
+		// without a trace in the context
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		_, ok := f2.Header.Contains(frame.TraceParent)
+		c.Check(ok, Equals, false)
+		rw.Close()
+	}()
+
+	tc, err := ParseTraceParent(testTraceParent)
+	c.Assert(err, IsNil)
+	tc.TraceState = "congo=t61rcWkgMzE"
+	ctx := ContextWithTrace(context.Background(), tc)
+	c.Check(conn.Send("/queue/test-1", "text/plain", nil, SendOpt.Inject(ctx)), IsNil)
+	c.Check(conn.Send("/queue/test-1", "text/plain", nil, SendOpt.Inject(context.Background())), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_message_extract_trace(c *C) {
+	msg := &Message{Header: frame.NewHeader(
+		frame.TraceParent, testTraceParent,
+		frame.TraceState, "rojo=00f067aa0ba902b7,congo=t61rcWkgMzE")}
+	tc, ok := TraceFromContext(msg.Extract(context.Background()))
+	c.Assert(ok, Equals, true)
+	c.Check(tc.TraceParent(), Equals, testTraceParent)
+	c.Check(tc.TraceState, Equals, "rojo=00f067aa0ba902b7,congo=t61rcWkgMzE")
+
+	// a malformed tracestate is discarded
+	msg.Header.Set(frame.TraceState, "rojo")
+	tc, ok = TraceFromContext(msg.Extract(context.Background()))
+	c.Assert(ok, Equals, true)
+	c.Check(tc.TraceState, Equals, "")
+
+	// a missing or malformed traceparent is not propagated
+	for _, header := range []*frame.Header{
+		nil,
+		frame.NewHeader(),
+		frame.NewHeader(frame.TraceState, "congo=t61rcWkgMzE"),
+		frame.NewHeader(frame.TraceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736"),
+	} {
+		ctx := context.Background()
+		c.Check((&Message{Header: header}).Extract(ctx), Equals, ctx)
+	}
+}
+
+// headerPropagator propagates a trace in a custom header entry.
+type headerPropagator struct{}
+
+type headerPropagatorKey struct{}
+
+func (headerPropagator) Inject(ctx context.Context, carrier TraceCarrier) {
+	if id, ok := ctx.Value(headerPropagatorKey{}).(string); ok {
+		carrier.Set("x-trace", id)
+	}
+}
+
+func (headerPropagator) Extract(ctx context.Context, carrier TraceCarrier) context.Context {
+	return context.WithValue(ctx, headerPropagatorKey{}, carrier.Get("x-trace"))
+}
+
+func (s *StompSuite) Test_set_trace_propagator(c *C) {
+	SetTracePropagator(headerPropagator{})
+	defer SetTracePropagator(nil)
+
+	f := frame.New(frame.SEND, frame.Destination, "/queue/test-1")
+	ctx := context.WithValue(context.Background(), headerPropagatorKey{}, "trace-1")
+	c.Assert(SendOpt.Inject(ctx)(f), IsNil)
+	f.Header.Add("x-trace", "ignored")
+	c.Check(HeaderCarrier{f.Header}.Keys(), DeepEquals, []string{frame.Destination, "x-trace"})
+
+	msg := &Message{Header: f.Header}
+	c.Check(msg.Extract(context.Background()).Value(headerPropagatorKey{}), Equals, "trace-1")
+}
@@ -0,0 +1,131 @@
+package stomp
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// DefaultTraceBodyLength is the number of bytes of each frame body
+// written by ConnOpt.TraceWriter, unless ConnOpt.TraceBodyLength
+// specifies otherwise.
+const DefaultTraceBodyLength = 256
+
+// traceBufferSize is the number of entries waiting to be written by
+// a tracer, beyond which entries are dropped.
+const traceBufferSize = 256
+
+// traceTimeFormat is the format of the timestamp of each line.
+const traceTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// tracer writes the frames sent and received on a connection to the
+// writer specified with ConnOpt.TraceWriter. Each frame is formatted by
+// the goroutine that sends or receives it, and written by the tracer's
+// own goroutine with a single call to Write, so that a slow writer
+// cannot block the connection and the lines of frames do not interleave.
+// The methods of a nil tracer do nothing.
+type tracer struct {
+	w          io.Writer
+	bodyLength int
+	entries    chan []byte
+	done       chan struct{}
+	stopOnce   sync.Once
+	dropped    uint64
+}
+
+func newTracer(w io.Writer, bodyLength int) *tracer {
+	t := &tracer{
+		w:          w,
+		bodyLength: bodyLength,
+		entries:    make(chan []byte, traceBufferSize),
+		done:       make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *tracer) run() {
+	for {
+		select {
+		case entry := <-t.entries:
+			t.w.Write(entry)
+		case <-t.done:
+			// write what was traced before the connection closed
+			for {
+				select {
+				case entry := <-t.entries:
+					t.w.Write(entry)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// stop stops the goroutine once the entries already traced are written.
+func (t *tracer) stop() {
+	if t == nil {
+		return
+	}
+	t.stopOnce.Do(func() {
+		close(t.done)
+	})
+}
+
+// sent traces a frame written to the server, or a heart-beat if f is nil.
+func (t *tracer) sent(f *frame.Frame) {
+	if t != nil {
+		t.trace(">>>", f)
+	}
+}
+
+// received traces a frame read from the server, or a heart-beat if f is nil.
+func (t *tracer) received(f *frame.Frame) {
+	if t != nil {
+		t.trace("<<<", f)
+	}
+}
+
+func (t *tracer) trace(direction string, f *frame.Frame) {
+	prefix := time.Now().UTC().Format(traceTimeFormat) + " " + direction + " "
+
+	var b bytes.Buffer
+	if f == nil {
+		b.WriteString(prefix + "(heart-beat)\n")
+	} else {
+		if _, ok := f.Header.Contains(frame.Passcode); ok {
+			// the passcode of the CONNECT frame is not written
+			f = &frame.Frame{Command: f.Command, Header: f.Header.Clone(), Body: f.Body}
+			f.Header.Set(frame.Passcode, "******")
+		}
+		// the last line is the blank line after the header, or the body
+		s := strings.TrimSuffix(f.StringTruncated(t.bodyLength), "\n")
+		for _, line := range strings.Split(s, "\n") {
+			b.WriteString(prefix)
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+	}
+
+	select {
+	case t.entries <- b.Bytes():
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// TraceDropped returns the number of frames that were not written to the
+// writer specified with ConnOpt.TraceWriter, because it was too slow to
+// keep up with the connection. Returns zero if the option is not specified.
+func (c *Conn) TraceDropped() uint64 {
+	if c.tracer == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.tracer.dropped)
+}
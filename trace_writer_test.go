@@ -0,0 +1,106 @@
+package stomp
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+// entryWriter sends the text of each call to Write on a channel.
+type entryWriter chan string
+
+func (w entryWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+var traceLine = regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}Z (>>>|<<<) `)
+
+// withoutTimestamps returns the lines of a trace entry
+// without their timestamps.
+func withoutTimestamps(c *C, entry string) []string {
+	c.Assert(strings.HasSuffix(entry, "\n"), Equals, true)
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(entry, "\n"), "\n") {
+		c.Assert(traceLine.MatchString(line), Equals, true, Commentf("%q", line))
+		lines = append(lines, line[len("2006-01-02T15:04:05.000000Z "):])
+	}
+	return lines
+}
+
+func (s *StompSuite) Test_trace_writer(c *C) {
+	w := make(entryWriter, 16)
+	conn, rw := connectHelper(c, V12, ConnOpt.TraceWriter(w), ConnOpt.TraceBodyLength(4),
+		ConnOpt.Login("scott", "tiger"), ConnOpt.HeartBeat(0, 0))
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.SEND)
+		rw.Write(nil)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f1.Header.Get(frame.Receipt)))
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+	}()
+
+	c.Check(withoutTimestamps(c, <-w), DeepEquals, []string{
+		">>> CONNECT",
+		">>> host:the-server",
+		">>> heart-beat:0,0",
+		">>> login:scott",
+		">>> passcode:******",
+		">>> accept-version:1.0,1.1,1.2",
+		">>> ",
+	})
+	c.Check(withoutTimestamps(c, <-w), DeepEquals, []string{
+		"<<< CONNECTED",
+		"<<< version:1.2",
+		"<<< ",
+	})
+
+	c.Assert(conn.Send("/queue/test-1", "text/plain", []byte("hello"),
+		SendOpt.Receipt, SendOpt.Header("x-custom", "1")), IsNil)
+	lines := withoutTimestamps(c, <-w)
+	c.Check(lines[0], Equals, ">>> SEND")
+	c.Check(lines[len(lines)-1], Equals, ">>> hell...(1 more bytes)")
+	c.Check(withoutTimestamps(c, <-w), DeepEquals, []string{"<<< (heart-beat)"})
+	c.Check(withoutTimestamps(c, <-w)[0], Equals, "<<< RECEIPT")
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+	c.Check(withoutTimestamps(c, <-w)[0], Equals, ">>> DISCONNECT")
+	c.Check(withoutTimestamps(c, <-w)[0], Equals, "<<< RECEIPT")
+	c.Check(conn.TraceDropped(), Equals, uint64(0))
+
+	_, err := Connect(nil, ConnOpt.TraceWriter(nil))
+	c.Check(err, Equals, ErrNilOption)
+}
+
+// gateWriter discards what is written, once the gate is open.
+type gateWriter chan struct{}
+
+func (w gateWriter) Write(p []byte) (int, error) {
+	<-w
+	return len(p), nil
+}
+
+func (s *StompSuite) Test_trace_writer_drops(c *C) {
+	// the first entry blocks the writer until the gate is open
+	w := make(gateWriter)
+	t := newTracer(w, DefaultTraceBodyLength)
+	defer t.stop()
+	defer close(w)
+
+	for i := 0; i < traceBufferSize+10; i++ {
+		t.sent(nil)
+	}
+	c.Check(t.dropped >= 9, Equals, true)
+	c.Check(t.dropped <= 10, Equals, true)
+}
@@ -1,9 +1,19 @@
 package stomp
 
 import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
 	"github.com/go-stomp/stomp/frame"
 )
 
+// DefaultTransactionTimeout is how long Transaction.Commit waits for the
+// server to process the COMMIT frame, unless ConnOpt.TransactionTimeout
+// specifies otherwise.
+const DefaultTransactionTimeout = 10 * time.Second
+
 // A Transaction applies to the sending of messages to the STOMP server,
 // and the acknowledgement of messages received from the STOMP server.
 // All messages sent and and acknowledged in the context of a transaction
@@ -14,10 +24,123 @@ import (
 // are processed by the STOMP server. Alternatively transactions can be aborted,
 // in which case all sent messages, acknowledgements and negative
 // acknowledgements are discarded by the STOMP server.
+//
+// The server aborts a transaction if the connection fails, so a transaction
+// is broken once the Conn is closed, or has reconnected, and its methods
+// return ErrTransactionBroken instead of writing to the connection.
 type Transaction struct {
-	id        string
-	conn      *Conn
-	completed bool
+	id     string
+	conn   *Conn
+	epoch  uint64 // the connection the transaction was started on
+	ctx    context.Context
+	state  int32 // TransactionState, accessed atomically
+	joined bool
+}
+
+// The TransactionState type is an enumeration of the states of a Transaction.
+type TransactionState int32
+
+const (
+	// The transaction has begun, and frames can be sent in it.
+	TransactionActive TransactionState = iota
+
+	// The COMMIT frame has been sent.
+	TransactionCommitted
+
+	// The ABORT frame has been sent.
+	TransactionAborted
+
+	// The connection that the transaction was started on has closed or
+	// failed, so the server has aborted the transaction.
+	TransactionBroken
+)
+
+// String returns the string representation of the TransactionState value.
+func (s TransactionState) String() string {
+	switch s {
+	case TransactionActive:
+		return "active"
+	case TransactionCommitted:
+		return "committed"
+	case TransactionAborted:
+		return "aborted"
+	case TransactionBroken:
+		return "broken"
+	}
+	panic("invalid TransactionState value")
+}
+
+// transactionKey is the context key of the transaction
+// started by Conn.WithTransaction.
+type transactionKey struct{}
+
+// WithTransaction runs fn in a transaction, which it begins before calling
+// fn. If fn returns nil, the transaction is committed with CommitWithContext,
+// and the result of the commit is returned. If fn returns an error, the
+// transaction is aborted and the error is returned. If fn panics, the
+// transaction is aborted and the panic continues. If fn commits or aborts
+// the transaction itself, WithTransaction does not.
+//
+// STOMP transactions cannot be nested. If ctx is the context of a
+// transaction, as returned by Transaction.Context, ErrNestedTransaction is
+// returned and fn is not called. So that nested calls are detected, fn
+// should pass tx.Context() to the functions it calls.
+//
+// A typical use acknowledges a message and sends the messages that result
+// from it in the same transaction, so that the server processes both or
+// neither:
+//
+//	err := conn.WithTransaction(ctx, func(tx *stomp.Transaction) error {
+//		if err := tx.Send("/queue/output", "text/plain", result); err != nil {
+//			return err
+//		}
+//		return tx.Ack(msg)
+//	})
+func (c *Conn) WithTransaction(ctx context.Context, fn func(tx *Transaction) error) error {
+	if ctx.Value(transactionKey{}) != nil {
+		return ErrNestedTransaction
+	}
+	if err := ctx.Err(); err != nil {
+		return newContextError(err)
+	}
+
+	tx, err := c.BeginWithError()
+	if err != nil {
+		return err
+	}
+	tx.ctx = context.WithValue(ctx, transactionKey{}, tx)
+
+	defer func() {
+		if r := recover(); r != nil {
+			if !tx.completed() {
+				tx.Abort()
+			}
+			panic(r)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		if !tx.completed() {
+			if abortErr := tx.Abort(); abortErr != nil && abortErr != ErrTransactionBroken {
+				return errors.Join(err, abortErr)
+			}
+		}
+		return err
+	}
+	if tx.completed() {
+		return nil
+	}
+	return tx.CommitWithContext(tx.ctx)
+}
+
+// Context returns the context of the transaction, if it was started by
+// Conn.WithTransaction, which is derived from the context passed to
+// WithTransaction. For other transactions it returns context.Background().
+func (tx *Transaction) Context() context.Context {
+	if tx.ctx == nil {
+		return context.Background()
+	}
+	return tx.ctx
 }
 
 // Id returns the unique identifier for the transaction.
@@ -30,74 +153,141 @@ func (tx *Transaction) Conn() *Conn {
 	return tx.conn
 }
 
-// Abort will abort the transaction. Any calls to Send, SendWithReceipt,
-// Ack and Nack on this transaction will be discarded.
-// This function does not wait for the server to process the ABORT frame.
-// See AbortWithReceipt if you want to ensure the ABORT is processed.
-func (tx *Transaction) Abort() error {
-	return tx.abort(false)
+// State returns the current state of the transaction. A transaction that
+// has been committed or aborted stays in that state, even if the
+// connection closes.
+func (tx *Transaction) State() TransactionState {
+	state := TransactionState(atomic.LoadInt32(&tx.state))
+	if state == TransactionActive && tx.Broken() {
+		return TransactionBroken
+	}
+	return state
 }
 
-// Abort will abort the transaction. Any calls to Send, SendWithReceipt,
-// Ack and Nack on this transaction will be discarded.
-func (tx *Transaction) AbortWithReceipt() error {
-	return tx.abort(true)
+// Joined returns whether the transaction was joined with
+// Conn.JoinTransaction, rather than begun by this client.
+func (tx *Transaction) Joined() bool {
+	return tx.joined
+}
+
+// completed returns whether the transaction has been committed or aborted.
+func (tx *Transaction) completed() bool {
+	return atomic.LoadInt32(&tx.state) != int32(TransactionActive)
 }
 
-func (tx *Transaction) abort(receipt bool) error {
-	if tx.completed {
+// check returns the error for using a transaction that is completed or broken.
+func (tx *Transaction) check() error {
+	if tx.completed() {
 		return ErrCompletedTransaction
 	}
+	if tx.Broken() {
+		return ErrTransactionBroken
+	}
+	return nil
+}
 
-	f := frame.New(frame.ABORT, frame.Transaction, tx.id)
+// Broken returns whether the transaction has been lost, because the
+// connection it was started on has closed or failed. A broken transaction
+// cannot be used, and the server has discarded everything sent on it.
+func (tx *Transaction) Broken() bool {
+	c := tx.conn
+	return c.IsClosed() || c.isReconnecting() || atomic.LoadUint64(&c.epoch) != tx.epoch
+}
 
-	if receipt {
-		id := allocateId()
-		f.Header.Set(frame.Receipt, id)
-	}
+// Abort will abort the transaction. Any calls to Send, SendWithReceipt,
+// Ack and Nack on this transaction will be discarded.
+// This function does not wait for the server to process the ABORT frame,
+// unless TransactionOpt.Receipt is specified. See AbortWithReceipt if you
+// want to ensure the ABORT is processed.
+func (tx *Transaction) Abort(opts ...func(*frame.Frame) error) error {
+	return tx.complete(context.Background(), frame.ABORT, false, opts)
+}
 
-	err := tx.conn.sendFrame(f)
-	if err != nil {
-		return err
-	}
-	tx.completed = true
+// Abort will abort the transaction. Any calls to Send, SendWithReceipt,
+// Ack and Nack on this transaction will be discarded.
+func (tx *Transaction) AbortWithReceipt() error {
+	return tx.complete(context.Background(), frame.ABORT, true, nil)
+}
 
-	return nil
+// AbortWithContext aborts the transaction in the same way as
+// AbortWithReceipt, except that it stops waiting for the server when the
+// context is done, or when the timeout specified by ConnOpt.TransactionTimeout
+// expires. The options are those of TransactionOpt.
+func (tx *Transaction) AbortWithContext(ctx context.Context, opts ...func(*frame.Frame) error) error {
+	return tx.complete(ctx, frame.ABORT, true, opts)
 }
 
 // Commit will commit the transaction. All messages and acknowledgements
 // sent to the STOMP server on this transaction will be processed atomically.
-// This function does not wait for the server to process the COMMIT frame.
-// See CommitWithReceipt if you want to ensure the COMMIT is processed.
-func (tx *Transaction) Commit() error {
-	return tx.commit(false)
+// Commit requests a receipt and waits for the server to process the COMMIT
+// frame, for no longer than the timeout specified by ConnOpt.TransactionTimeout.
+// If it times out, ErrMsgSendTimeout is returned. If the server responds with
+// an ERROR frame, the error returned wraps a *BrokerError for the frame. The
+// options are those of TransactionOpt.
+func (tx *Transaction) Commit(opts ...func(*frame.Frame) error) error {
+	return tx.complete(context.Background(), frame.COMMIT, true, opts)
 }
 
-// Commit will commit the transaction. All messages and acknowledgements
-// sent to the STOMP server on this transaction will be processed atomically.
+// CommitWithReceipt is the same as Commit.
 func (tx *Transaction) CommitWithReceipt() error {
-	return tx.commit(true)
+	return tx.complete(context.Background(), frame.COMMIT, true, nil)
 }
 
-func (tx *Transaction) commit(receipt bool) error {
-	if tx.completed {
-		return ErrCompletedTransaction
+// CommitWithContext commits the transaction in the same way as Commit,
+// except that it stops waiting for the server when the context is done.
+// The error returned then wraps ctx.Err().
+//
+// Once the COMMIT frame has been queued for writing, the transaction is
+// completed whatever the result: if the receipt does not arrive, whether
+// the server has committed the transaction is unknown.
+func (tx *Transaction) CommitWithContext(ctx context.Context, opts ...func(*frame.Frame) error) error {
+	return tx.complete(ctx, frame.COMMIT, true, opts)
+}
+
+// complete writes the COMMIT or ABORT frame for the transaction, and if
+// it requests a receipt, waits for the server to process it. If receipt
+// is true, a receipt is requested even if the options do not request one.
+func (tx *Transaction) complete(ctx context.Context, command string, receipt bool, opts []func(*frame.Frame) error) error {
+	if err := tx.check(); err != nil {
+		return err
 	}
 
-	f := frame.New(frame.COMMIT, frame.Transaction, tx.id)
+	f := frame.New(command, frame.Transaction, tx.id)
 
 	if receipt {
-		id := allocateId()
+		id := allocateReceiptId()
 		f.Header.Set(frame.Receipt, id)
 	}
 
-	err := tx.conn.sendFrame(f)
+	c := tx.conn
+	timeout, err := c.transactionOptions(f, opts)
+	if err != nil {
+		return err
+	}
+	state := TransactionAborted
+	if command == frame.COMMIT {
+		state = TransactionCommitted
+	}
+	// only one of the calls that complete the transaction at once
+	// writes its frame
+	if !atomic.CompareAndSwapInt32(&tx.state, int32(TransactionActive), int32(state)) {
+		return ErrCompletedTransaction
+	}
+	if tx.joined {
+		c.log.Debugf("%s of joined transaction %s", command, tx.id)
+	}
+	request, err := c.enqueueFrame(ctx, f, timeout)
 	if err != nil {
+		// the frame has not been queued, so the transaction is
+		// still active
+		atomic.StoreInt32(&tx.state, int32(TransactionActive))
 		return err
 	}
-	tx.completed = true
 
-	return nil
+	if request.C == nil {
+		return nil
+	}
+	return c.waitForReceipt(ctx, request, timeout)
 }
 
 // Send sends a message to the STOMP server as part of a transaction. The server will not process the
@@ -108,20 +298,21 @@ func (tx *Transaction) commit(receipt bool) error {
 // The content type should be specified, according to the STOMP specification, but if contentType is an empty
 // string, the message will be delivered without a content type header entry. The body array contains the
 // message body, and its content should be consistent with the specified content type.
+// The destination and the content-length header entry are checked as for Conn.Send.
 //
 // TODO: document opts
 func (tx *Transaction) Send(destination, contentType string, body []byte, opts ...func(*frame.Frame) error) error {
-	if tx.completed {
-		return ErrCompletedTransaction
+	if err := tx.check(); err != nil {
+		return err
 	}
 
-	f, err := createSendFrame(destination, contentType, body, opts)
+	f, options, err := tx.conn.createSendFrame(destination, contentType, body, opts)
 	if err != nil {
 		return err
 	}
 
 	f.Header.Set(frame.Transaction, tx.id)
-	return tx.conn.sendFrame(f)
+	return tx.conn.sendRequest(writeRequest{Frame: f}, options.receiptTimeout)
 }
 
 // Ack sends an acknowledgement for the message to the server. The STOMP
@@ -129,18 +320,18 @@ func (tx *Transaction) Send(destination, contentType string, body []byte, opts .
 // has been committed. If the subscription has an AckMode of AckAuto, calling
 // this function has no effect.
 func (tx *Transaction) Ack(msg *Message) error {
-	if tx.completed {
-		return ErrCompletedTransaction
+	if err := tx.check(); err != nil {
+		return err
 	}
 
-	f, err := tx.conn.createAckNackFrame(msg, true)
+	f, err := tx.conn.createAckNackFrame(msg, true, nil)
 	if err != nil {
 		return err
 	}
 
 	if f != nil {
 		f.Header.Set(frame.Transaction, tx.id)
-		err := tx.conn.sendFrame(f)
+		err := tx.conn.sendAckFrame(f, msg)
 		if err != nil {
 			return err
 		}
@@ -157,18 +348,18 @@ func (tx *Transaction) Ack(msg *Message) error {
 // of AckAuto, because the STOMP server will not be expecting any kind
 // of acknowledgement (positive or negative) for this message.
 func (tx *Transaction) Nack(msg *Message) error {
-	if tx.completed {
-		return ErrCompletedTransaction
+	if err := tx.check(); err != nil {
+		return err
 	}
 
-	f, err := tx.conn.createAckNackFrame(msg, false)
+	f, err := tx.conn.createAckNackFrame(msg, false, nil)
 	if err != nil {
 		return err
 	}
 
 	if f != nil {
 		f.Header.Set(frame.Transaction, tx.id)
-		err := tx.conn.sendFrame(f)
+		err := tx.conn.sendAckFrame(f, msg)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,80 @@
+package stomp
+
+import (
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// transactionOptions are the settings for a single call to
+// Conn.Begin, Transaction.Commit or Transaction.Abort.
+type transactionOptions struct {
+	timeout time.Duration
+}
+
+// TransactionOpt contains options for the Conn.Begin, Conn.BeginWithError,
+// Transaction.Commit and Transaction.Abort functions, and their variants.
+var TransactionOpt struct {
+	// Receipt requests a receipt for the BEGIN, COMMIT or ABORT frame, so
+	// that the call waits until the server has processed it, for no longer
+	// than the timeout specified by ConnOpt.TransactionTimeout. If the server
+	// responds with an ERROR frame, the error returned wraps a *BrokerError
+	// for the frame, which can be retrieved with errors.As. The receipt id is
+	// allocated in the same way as those of other frames, so it is unique.
+	// Commit always requests a receipt.
+	Receipt func(*frame.Frame) error
+
+	// ReceiptTimeout requests a receipt, in the same way as Receipt, and
+	// limits how long the call waits for it. For this call the timeout
+	// replaces the one specified by ConnOpt.TransactionTimeout. Less than
+	// or equal to zero means wait indefinitely.
+	ReceiptTimeout func(timeout time.Duration) func(*frame.Frame) error
+
+	// Header provides the opportunity to include custom header entries
+	// in the BEGIN, COMMIT or ABORT frame. This option can be specified
+	// multiple times if multiple custom header entries are required.
+	Header func(key, value string) func(*frame.Frame) error
+}
+
+// isTransactionCommand reports whether command is
+// one of the frames that control a transaction.
+func isTransactionCommand(command string) bool {
+	switch command {
+	case frame.BEGIN, frame.COMMIT, frame.ABORT:
+		return true
+	}
+	return false
+}
+
+func init() {
+	TransactionOpt.Receipt = func(f *frame.Frame) error {
+		if !isTransactionCommand(f.Command) {
+			return ErrInvalidCommand
+		}
+		if _, ok := f.Header.Contains(frame.Receipt); !ok {
+			f.Header.Set(frame.Receipt, allocateReceiptId())
+		}
+		return nil
+	}
+
+	TransactionOpt.ReceiptTimeout = func(timeout time.Duration) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			opts, ok := settingsFor(f).(*transactionOptions)
+			if !isTransactionCommand(f.Command) || !ok {
+				return ErrInvalidCommand
+			}
+			opts.timeout = timeout
+			return TransactionOpt.Receipt(f)
+		}
+	}
+
+	TransactionOpt.Header = func(key, value string) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			if !isTransactionCommand(f.Command) {
+				return ErrInvalidCommand
+			}
+			f.Header.Add(key, value)
+			return nil
+		}
+	}
+}
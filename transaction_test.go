@@ -0,0 +1,257 @@
+package stomp
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_transaction_commit_with_context(c *C) {
+	conn, rw := connectHelper(c, V12, ConnOpt.TransactionTimeout(50*time.Millisecond))
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		for _, command := range []string{frame.BEGIN, frame.COMMIT, frame.BEGIN, frame.COMMIT, frame.BEGIN, frame.ABORT} {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, command)
+			if command == frame.ABORT {
+				rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+			}
+		}
+
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+	}()
+
+	// the server never sends the receipt for a COMMIT frame
+	tx := conn.Begin()
+	c.Check(tx.Commit(), Equals, ErrMsgSendTimeout)
+	c.Check(tx.Commit(), Equals, ErrCompletedTransaction)
+
+	tx = conn.Begin()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := tx.CommitWithContext(ctx)
+	c.Check(errors.Is(err, context.DeadlineExceeded), Equals, true)
+
+	tx = conn.Begin()
+	c.Check(tx.AbortWithContext(context.Background()), IsNil)
+	c.Check(tx.Send("/queue/test-1", "text/plain", nil), Equals, ErrCompletedTransaction)
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_transaction_complete_once(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		for _, command := range []string{frame.BEGIN, frame.ABORT, frame.DISCONNECT} {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, command)
+			if receipt, ok := f.Header.Contains(frame.Receipt); ok {
+				rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+			}
+		}
+	}()
+
+	tx := conn.Begin()
+
+	// the transaction is still active if the frame cannot be queued
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := tx.CommitWithContext(ctx)
+	c.Check(errors.Is(err, context.Canceled), Equals, true)
+	c.Check(tx.State(), Equals, TransactionActive)
+
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			errs <- tx.AbortWithReceipt()
+		}()
+	}
+	completed := 0
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err == nil {
+			completed++
+		} else {
+			c.Check(err, Equals, ErrCompletedTransaction)
+		}
+	}
+	c.Check(completed, Equals, 1)
+	c.Check(tx.State(), Equals, TransactionAborted)
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_transaction_broken(c *C) {
+	conn, rw := connectHelper(c, V12)
+
+	go func() {
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.BEGIN)
+		rw.Close()
+	}()
+
+	tx := conn.Begin()
+	c.Check(tx.Broken(), Equals, false)
+	for range conn.Errors() {
+		// wait for the connection to close
+	}
+	c.Check(tx.Broken(), Equals, true)
+	c.Check(tx.State(), Equals, TransactionBroken)
+	c.Check(tx.Send("/queue/test-1", "text/plain", nil), Equals, ErrTransactionBroken)
+	c.Check(tx.Ack(&Message{}), Equals, ErrTransactionBroken)
+	c.Check(tx.Commit(), Equals, ErrTransactionBroken)
+	c.Check(tx.Abort(), Equals, ErrTransactionBroken)
+}
+
+func (s *StompSuite) Test_transaction_broken_by_reconnect(c *C) {
+	dialer := newFakeDialer(c, V12)
+	conn, rw := connectHelper(c, V12, ConnOpt.Reconnect(ReconnectPolicy{
+		InitialInterval: time.Millisecond,
+		Dial:            dialer.Dial,
+	}))
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.BEGIN)
+		rw.Close()
+
+		rw2 := <-dialer.servers
+		f2, err := rw2.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.DISCONNECT)
+		rw2.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f2.Header.Get(frame.Receipt)))
+	}()
+
+	tx := conn.Begin()
+	<-conn.Errors()
+	for i := 0; i < 1000 && (atomic.LoadUint64(&conn.epoch) == 0 || conn.State() != Connected); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(conn.State(), Equals, Connected)
+
+	// the server has aborted the transaction
+	c.Check(tx.Broken(), Equals, true)
+	c.Check(tx.Commit(), Equals, ErrTransactionBroken)
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_join_transaction(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		id := "tx-other"
+		for _, command := range []string{frame.SEND, frame.COMMIT, frame.BEGIN, frame.ABORT} {
+			f, err := rw.Read()
+			c.Assert(err, IsNil)
+			c.Assert(f.Command, Equals, command)
+			if command == frame.BEGIN {
+				id = f.Header.Get(frame.Transaction)
+			}
+			c.Check(f.Header.Get(frame.Transaction), Equals, id)
+			if receipt, ok := f.Header.Contains(frame.Receipt); ok {
+				rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+			}
+		}
+
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+	}()
+
+	// no BEGIN frame is sent for a joined transaction
+	tx := conn.JoinTransaction("tx-other")
+	c.Check(tx.Id(), Equals, "tx-other")
+	c.Check(tx.Joined(), Equals, true)
+	c.Check(tx.State(), Equals, TransactionActive)
+	c.Check(tx.Send("/queue/test-1", "text/plain", nil), IsNil)
+	c.Check(tx.Commit(), IsNil)
+	c.Check(tx.State(), Equals, TransactionCommitted)
+	c.Check(tx.Commit(), Equals, ErrCompletedTransaction)
+
+	tx = conn.Begin()
+	c.Check(tx.Joined(), Equals, false)
+	c.Check(tx.Abort(), IsNil)
+	c.Check(tx.State(), Equals, TransactionAborted)
+	c.Check(tx.State().String(), Equals, "aborted")
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+
+	// a completed transaction stays completed
+	c.Check(tx.State(), Equals, TransactionAborted)
+}
+
+func (s *StompSuite) Test_transaction_receipts(c *C) {
+	conn, rw := connectHelper(c, V12)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		f, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.BEGIN)
+		c.Check(f.Header.Get("x-custom"), Equals, "1")
+		beginReceipt := f.Header.Get(frame.Receipt)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, beginReceipt))
+
+		// no response to the ABORT frame
+		f, err = rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.ABORT)
+		receipt, ok := f.Header.Contains(frame.Receipt)
+		c.Check(ok, Equals, true)
+		c.Check(receipt, Not(Equals), beginReceipt)
+
+		f, err = rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.BEGIN)
+		f, err = rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f.Command, Equals, frame.COMMIT)
+		rw.Write(frame.New(frame.ERROR,
+			frame.ReceiptId, f.Header.Get(frame.Receipt),
+			frame.Message, "commit failed"))
+	}()
+
+	tx, err := conn.BeginWithError(TransactionOpt.Receipt, TransactionOpt.Header("x-custom", "1"))
+	c.Assert(err, IsNil)
+	c.Check(tx.Abort(TransactionOpt.ReceiptTimeout(20*time.Millisecond)), Equals, ErrMsgSendTimeout)
+	c.Check(tx.State(), Equals, TransactionAborted)
+
+	tx, err = conn.BeginWithError()
+	c.Assert(err, IsNil)
+	err = tx.Commit()
+	var brokerError *BrokerError
+	c.Assert(errors.As(err, &brokerError), Equals, true)
+	c.Check(brokerError.Message, Equals, "commit failed")
+	c.Check(brokerError.Frame.Command, Equals, frame.ERROR)
+	<-stop
+
+	f := frame.New(frame.SEND, frame.Destination, "/queue/test-1")
+	c.Check(TransactionOpt.Receipt(f), Equals, ErrInvalidCommand)
+	c.Check(TransactionOpt.Header("x-custom", "1")(f), Equals, ErrInvalidCommand)
+}
@@ -0,0 +1,40 @@
+package stomp
+
+import (
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// Default time that Subscription.Unsubscribe waits for the
+// subscription to close.
+const DefaultUnsubscribeTimeout = 120 * time.Second
+
+// unsubscribeOptions are the settings for a single call
+// to Subscription.Unsubscribe.
+type unsubscribeOptions struct {
+	timeout time.Duration
+}
+
+// UnsubscribeOpt contains options for the Subscription.Unsubscribe function.
+// Header entries for the UNSUBSCRIBE frame can be added using SubscribeOpt.Header.
+var UnsubscribeOpt struct {
+	// Timeout specifies how long Unsubscribe waits for the server to
+	// confirm that the subscription is closed. This overrides the value
+	// specified by ConnOpt.UnsubscribeTimeout for one call. Less than or
+	// equal to zero means wait indefinitely.
+	Timeout func(timeout time.Duration) func(*frame.Frame) error
+}
+
+func init() {
+	UnsubscribeOpt.Timeout = func(timeout time.Duration) func(*frame.Frame) error {
+		return func(f *frame.Frame) error {
+			opts, ok := settingsFor(f).(*unsubscribeOptions)
+			if f.Command != frame.UNSUBSCRIBE || !ok {
+				return ErrInvalidCommand
+			}
+			opts.timeout = timeout
+			return nil
+		}
+	}
+}
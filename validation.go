@@ -0,0 +1,107 @@
+package stomp
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// The ValidationLevel type is an enumeration of how thoroughly the frames
+// sent to the server are checked before they are written, as specified
+// with ConnOpt.ValidateFrames.
+type ValidationLevel int
+
+const (
+	// Frames are not checked, the default.
+	ValidationNone ValidationLevel = iota
+
+	// Frames are checked for mistakes that would corrupt the frame, or
+	// that the server would reject: a SEND frame without a destination, a
+	// destination that contains a newline, a header name that contains a
+	// colon or a newline, a header value that cannot be encoded in the
+	// protocol version of the connection, and a body on a frame that
+	// must not have one.
+	ValidationBasic
+
+	// Frames are checked as for ValidationBasic, and the header names
+	// and values must also be valid UTF-8, as the STOMP specification
+	// requires.
+	ValidationStrict
+)
+
+// String returns the string representation of the ValidationLevel value.
+func (v ValidationLevel) String() string {
+	switch v {
+	case ValidationNone:
+		return "none"
+	case ValidationBasic:
+		return "basic"
+	case ValidationStrict:
+		return "strict"
+	}
+	panic("invalid ValidationLevel value")
+}
+
+// hasBody reports whether frames with the command may have a body.
+func hasBody(command string) bool {
+	switch command {
+	case frame.SEND, frame.MESSAGE, frame.ERROR:
+		return true
+	}
+	return false
+}
+
+// validateFrame checks a frame to be sent on a connection with the
+// protocol version, as specified by level. The error returned wraps
+// ErrInvalidFrame, and describes the first problem found.
+func validateFrame(f *frame.Frame, level ValidationLevel, version Version) error {
+	if level == ValidationNone {
+		return nil
+	}
+
+	if f.Command == frame.SEND {
+		destination, ok := f.Header.Contains(frame.Destination)
+		if !ok || destination == "" {
+			return newInvalidFrameError("SEND frame has no destination")
+		}
+		if strings.ContainsAny(destination, "\r\n") {
+			return newInvalidFrameError(fmt.Sprintf("destination %q contains a line break", destination))
+		}
+	}
+	if len(f.Body) > 0 && !hasBody(f.Command) {
+		return newInvalidFrameError(f.Command + " frame cannot have a body")
+	}
+
+	// the characters that the protocol version cannot encode in a value
+	unencodable := "\r\n"
+	switch version {
+	case V11:
+		unencodable = "\r"
+	case V12:
+		unencodable = ""
+	}
+
+	for i := 0; i < f.Header.Len(); i++ {
+		key, value := f.Header.GetAt(i)
+		if key == "" {
+			return newInvalidFrameError("header name is empty")
+		}
+		if strings.ContainsAny(key, ":\r\n") {
+			return newInvalidFrameError(fmt.Sprintf("header name %q contains a colon or a line break", key))
+		}
+		if unencodable != "" && strings.ContainsAny(value, unencodable) {
+			return newInvalidFrameError(fmt.Sprintf("value of header %q contains a line break, which STOMP %s cannot encode", key, version))
+		}
+		if level == ValidationStrict {
+			if !utf8.ValidString(key) {
+				return newInvalidFrameError(fmt.Sprintf("header name %q is not valid UTF-8", key))
+			}
+			if !utf8.ValidString(value) {
+				return newInvalidFrameError(fmt.Sprintf("value of header %q is not valid UTF-8", key))
+			}
+		}
+	}
+	return nil
+}
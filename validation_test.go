@@ -0,0 +1,99 @@
+package stomp
+
+import (
+	"errors"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StompSuite) Test_validate_frame(c *C) {
+	body := func(f *frame.Frame) *frame.Frame {
+		f.Body = []byte("body")
+		return f
+	}
+	testCases := []struct {
+		f       *frame.Frame
+		level   ValidationLevel
+		version Version
+		err     string
+	}{
+		{frame.New(frame.SEND, frame.Destination, "/queue/1"), ValidationStrict, V10, ""},
+		{frame.New(frame.SEND), ValidationNone, V12, ""},
+		{frame.New(frame.SEND), ValidationBasic, V12,
+			"invalid frame: SEND frame has no destination"},
+		{frame.New(frame.SEND, frame.Destination, ""), ValidationBasic, V12,
+			"invalid frame: SEND frame has no destination"},
+		{frame.New(frame.SEND, frame.Destination, "/queue/1\n"), ValidationBasic, V12,
+			`invalid frame: destination "/queue/1\n" contains a line break`},
+		{frame.New(frame.SEND, frame.Destination, "/queue/1", "a:b", "1"), ValidationBasic, V12,
+			`invalid frame: header name "a:b" contains a colon or a line break`},
+		{frame.New(frame.SEND, frame.Destination, "/queue/1", "", "1"), ValidationBasic, V12,
+			"invalid frame: header name is empty"},
+		{frame.New(frame.SEND, frame.Destination, "/queue/1", "x", "a\r\nb"), ValidationBasic, V10,
+			`invalid frame: value of header "x" contains a line break, which STOMP 1.0 cannot encode`},
+		{frame.New(frame.SEND, frame.Destination, "/queue/1", "x", "a\nb"), ValidationBasic, V11, ""},
+		{frame.New(frame.SEND, frame.Destination, "/queue/1", "x", "a\rb"), ValidationBasic, V11,
+			`invalid frame: value of header "x" contains a line break, which STOMP 1.1 cannot encode`},
+		{frame.New(frame.SEND, frame.Destination, "/queue/1", "x", "a\r\nb"), ValidationBasic, V12, ""},
+		{body(frame.New(frame.SEND, frame.Destination, "/queue/1")), ValidationBasic, V12, ""},
+		{body(frame.New(frame.ACK, frame.Id, "1")), ValidationBasic, V12,
+			"invalid frame: ACK frame cannot have a body"},
+		{frame.New(frame.SEND, frame.Destination, "/queue/1", "x", "\xff"), ValidationBasic, V12, ""},
+		{frame.New(frame.SEND, frame.Destination, "/queue/1", "x", "\xff"), ValidationStrict, V12,
+			`invalid frame: value of header "x" is not valid UTF-8`},
+		{frame.New(frame.SEND, frame.Destination, "/queue/1", "\xff", "1"), ValidationStrict, V12,
+			`invalid frame: header name "\xff" is not valid UTF-8`},
+	}
+
+	for i, tc := range testCases {
+		err := validateFrame(tc.f, tc.level, tc.version)
+		if tc.err == "" {
+			c.Check(err, IsNil, Commentf("test case %d", i))
+			continue
+		}
+		c.Assert(err, NotNil, Commentf("test case %d", i))
+		c.Check(err.Error(), Equals, tc.err, Commentf("test case %d", i))
+		c.Check(errors.Is(err, ErrInvalidFrame), Equals, true)
+	}
+}
+
+func (s *StompSuite) Test_validate_frames_option(c *C) {
+	conn, rw := connectHelper(c, V10, ConnOpt.ValidateFrames(ValidationBasic))
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		// the invalid frames are not written
+		f1, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f1.Command, Equals, frame.BEGIN)
+
+		f2, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f2.Command, Equals, frame.SEND)
+		c.Check(f2.Header.Get(frame.Destination), Equals, "/queue/test-1")
+		c.Check(f2.Header.Get(frame.Transaction), Equals, f1.Header.Get(frame.Transaction))
+
+		f3, err := rw.Read()
+		c.Assert(err, IsNil)
+		c.Assert(f3.Command, Equals, frame.DISCONNECT)
+		rw.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt)))
+	}()
+
+	err := conn.Send("/queue/test-1\n", "text/plain", []byte("hello"))
+	c.Check(errors.Is(err, ErrInvalidFrame), Equals, true)
+	err = conn.Send("/queue/test-1", "text/plain", []byte("hello"), SendOpt.Header("x", "a\rb"))
+	c.Check(err, ErrorMatches, `invalid frame: value of header "x" contains a line break, which STOMP 1.0 cannot encode`)
+
+	tx, err := conn.BeginWithError()
+	c.Assert(err, IsNil)
+	err = tx.Send("", "text/plain", []byte("hello"))
+	c.Check(err, Equals, ErrEmptyDestination)
+	c.Check(tx.Send("/queue/test-1", "text/plain", []byte("hello")), IsNil)
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+
+	_, err = Connect(nil, ConnOpt.ValidateFrames(ValidationLevel(-1)))
+	c.Check(err, Equals, ErrInvalidOptionValue)
+}
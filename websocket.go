@@ -0,0 +1,407 @@
+package stomp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes, see RFC 6455
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// websocketGUID is used to compute the Sec-WebSocket-Accept header.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocketProtocols are the subprotocols for STOMP over WebSocket.
+const websocketProtocols = "v12.stomp, v11.stomp, v10.stomp"
+
+// ConnectWebsocket creates a WebSocket connection to the STOMP server at
+// url, which has the scheme "ws" or "wss", and performs the STOMP connect
+// protocol sequence over it, in the same way as Dial. The context applies
+// until the connect sequence is complete.
+//
+// STOMP frames are sent in WebSocket text messages, unless the
+// ConnOpt.WebsocketBinary option is specified. For "wss" URLs the
+// configuration specified with ConnOpt.TLSConfig is used. If a
+// ReconnectPolicy without a Dial function is specified, the Conn
+// reconnects to the same URL.
+func ConnectWebsocket(ctx context.Context, url string, opts ...func(*Conn) error) (*Conn, error) {
+	options, err := newConnOptions(&Conn{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	binary, tlsConfig := options.WebsocketBinary, options.TLSConfig
+
+	conn, host, err := dialWebsocket(ctx, url, tlsConfig, binary)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add option to set host and make it the first option in list,
+	// so that if host has been explicitly specified it will override.
+	opts = append([](func(*Conn) error){ConnOpt.Host(host)}, opts...)
+	opts = append(opts, func(c *Conn) error {
+		if c.options.Reconnect != nil && c.options.Reconnect.Dial == nil {
+			c.options.Reconnect.Dial = func() (io.ReadWriteCloser, error) {
+				conn, _, err := dialWebsocket(context.Background(), url, tlsConfig, binary)
+				return conn, err
+			}
+		}
+		return nil
+	})
+
+	c, err := ConnectWithContext(ctx, conn, opts...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialWebsocket creates a WebSocket connection to rawURL, and returns it
+// with the host name of the server.
+func dialWebsocket(ctx context.Context, rawURL string, tlsConfig *tls.Config, binary bool) (*websocketConn, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	addr := u.Host
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+	default:
+		return nil, "", fmt.Errorf("unsupported websocket scheme: %q", u.Scheme)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if u.Scheme == "wss" {
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, "", &TLSHandshakeError{Err: err}
+		}
+		conn = tlsConn
+	}
+
+	// the handshake is abandoned if the context is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	reader, err := websocketHandshake(conn, u)
+	if !stop() {
+		conn.Close()
+		return nil, "", newContextError(ctx.Err())
+	}
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+
+	ws := newWebsocketConn(conn, reader, true)
+	if binary {
+		ws.opcode = wsBinary
+	}
+	return ws, u.Hostname(), nil
+}
+
+// websocketHandshake sends the HTTP request that opens a WebSocket on
+// conn, and checks the response. Returns the reader for the connection,
+// which may already contain the first WebSocket frames.
+func websocketHandshake(conn net.Conn, u *url.URL) (*bufio.Reader, error) {
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Opaque: u.RequestURI()},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", websocketProtocols)
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket handshake failed: %s", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.New("websocket handshake failed: missing upgrade header")
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		return nil, errors.New("websocket handshake failed: invalid accept header")
+	}
+	return reader, nil
+}
+
+// websocketAccept returns the value of the Sec-WebSocket-Accept
+// header for the value of the Sec-WebSocket-Key header.
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// websocketConn adapts a WebSocket connection to the stream of bytes
+// that the frame package reads and writes. The payloads of the data
+// messages received are read in order, so STOMP frames can be split
+// across messages, or several can be in one message. Heart-beats are
+// sent and received as messages containing only an end-of-line.
+type websocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	client bool // frames sent by a client are masked
+	opcode byte // for the messages sent
+
+	writeMutex sync.Mutex
+	pending    []byte // written data, not yet sent as a message
+	closeOnce  sync.Once
+
+	payload []byte // data received, not yet read
+	closed  bool   // a close frame has been received
+}
+
+func newWebsocketConn(conn net.Conn, reader *bufio.Reader, client bool) *websocketConn {
+	return &websocketConn{
+		conn:   conn,
+		reader: reader,
+		client: client,
+		opcode: wsText,
+	}
+}
+
+// Read reads the payloads of the data messages received, replying to
+// pings and ignoring pongs. Returns io.EOF once the server has closed
+// the WebSocket.
+func (ws *websocketConn) Read(p []byte) (int, error) {
+	for len(ws.payload) == 0 {
+		if ws.closed {
+			return 0, io.EOF
+		}
+
+		opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case wsText, wsBinary, wsContinuation:
+			ws.payload = payload
+		case wsPing:
+			if err = ws.writeFrame(wsPong, payload); err != nil {
+				return 0, err
+			}
+		case wsClose:
+			ws.closed = true
+			ws.sendClose(payload)
+		case wsPong:
+			// nothing to do
+		default:
+			return 0, fmt.Errorf("unexpected websocket opcode: %d", opcode)
+		}
+	}
+
+	n := copy(p, ws.payload)
+	ws.payload = ws.payload[n:]
+	return n, nil
+}
+
+// Write holds data until Flush sends it as a WebSocket message. The
+// frame writer writes a frame in one or more calls, and calls Flush
+// once the data written ends with complete frames or heart-beats. This
+// means that each message contains complete STOMP frames, which some
+// servers require.
+func (ws *websocketConn) Write(p []byte) (int, error) {
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+	ws.pending = append(ws.pending, p...)
+	return len(p), nil
+}
+
+// Flush sends the data written since the last call as a message.
+func (ws *websocketConn) Flush() error {
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+	if len(ws.pending) == 0 {
+		return nil
+	}
+
+	err := ws.writeFrameLocked(ws.opcode, ws.pending)
+	ws.pending = ws.pending[:0]
+	return err
+}
+
+// RemoteAddr returns the network address of the server.
+func (ws *websocketConn) RemoteAddr() net.Addr {
+	return ws.conn.RemoteAddr()
+}
+
+// Close sends a close frame, and closes the network connection.
+func (ws *websocketConn) Close() error {
+	// a write that is blocked does not prevent the close
+	ws.conn.SetWriteDeadline(time.Now().Add(websocketCloseTimeout))
+	ws.sendClose([]byte{0x03, 0xe8}) // 1000, normal closure
+	return ws.conn.Close()
+}
+
+// sendClose sends a close frame once.
+func (ws *websocketConn) sendClose(payload []byte) {
+	ws.closeOnce.Do(func() {
+		if len(payload) > 2 {
+			payload = payload[:2]
+		}
+		ws.writeFrame(wsClose, payload)
+	})
+}
+
+func (ws *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+	return ws.writeFrameLocked(opcode, payload)
+}
+
+// writeFrameLocked writes payload in a single WebSocket frame.
+func (ws *websocketConn) writeFrameLocked(opcode byte, payload []byte) error {
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode // final fragment
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	data := payload
+	if ws.client {
+		var mask [4]byte
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+		header[1] |= 0x80
+		header = append(header, mask[:]...)
+		data = make([]byte, len(payload))
+		for i, b := range payload {
+			data[i] = b ^ mask[i%4]
+		}
+	}
+
+	if _, err := ws.conn.Write(append(header, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readFrame reads a WebSocket frame, and returns its opcode and payload.
+func (ws *websocketConn) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWebsocketPayload {
+		return 0, nil, errors.New("websocket frame too large")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
+
+const (
+	// maxWebsocketPayload limits the memory used by a single WebSocket frame.
+	maxWebsocketPayload = 64 << 20
+
+	// websocketCloseTimeout limits the time spent sending the close frame.
+	websocketCloseTimeout = time.Second
+)
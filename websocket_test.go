@@ -0,0 +1,172 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	. "gopkg.in/check.v1"
+)
+
+// acceptWebsocket accepts a connection on listener, and completes the
+// server side of the WebSocket handshake.
+func acceptWebsocket(c *C, listener net.Listener) *websocketConn {
+	conn, err := listener.Accept()
+	c.Assert(err, IsNil)
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	c.Assert(err, IsNil)
+	c.Check(req.URL.Path, Equals, "/ws")
+	c.Check(req.Header.Get("Upgrade"), Equals, "websocket")
+	c.Check(req.Header.Get("Sec-WebSocket-Protocol"), Equals, websocketProtocols)
+
+	_, err = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(req.Header.Get("Sec-WebSocket-Key")) + "\r\n" +
+		"Sec-WebSocket-Protocol: v12.stomp\r\n\r\n"))
+	c.Assert(err, IsNil)
+	return newWebsocketConn(conn, reader, false)
+}
+
+// readWebsocketFrame reads a WebSocket message containing one STOMP frame.
+func readWebsocketFrame(c *C, ws *websocketConn, opcode byte) *frame.Frame {
+	op, payload, err := ws.readFrame()
+	c.Assert(err, IsNil)
+	c.Assert(op, Equals, opcode)
+	reader := bytes.NewReader(payload)
+	f, err := frame.NewReader(reader).Read()
+	c.Assert(err, IsNil)
+	c.Check(reader.Len(), Equals, 0)
+	return f
+}
+
+func (s *StompSuite) Test_connect_websocket(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(stop)
+		ws := acceptWebsocket(c, listener)
+		defer ws.conn.Close()
+
+		f1 := readWebsocketFrame(c, ws, wsText)
+		c.Assert(f1.Command, Equals, frame.CONNECT)
+		c.Check(f1.Header.Get(frame.Host), Equals, "127.0.0.1")
+
+		// a STOMP frame split across messages, with a ping between them
+		c.Assert(ws.writeFrame(wsText, []byte("CONNECTED\nversion:1.2\n")), IsNil)
+		c.Assert(ws.writeFrame(wsPing, []byte("ping")), IsNil)
+		c.Assert(ws.writeFrame(wsText, []byte("\n\x00")), IsNil)
+
+		op, payload, err := ws.readFrame()
+		c.Assert(err, IsNil)
+		c.Check(op, Equals, byte(wsPong))
+		c.Check(string(payload), Equals, "ping")
+
+		f2 := readWebsocketFrame(c, ws, wsText)
+		c.Assert(f2.Command, Equals, frame.SUBSCRIBE)
+		id := f2.Header.Get(frame.Id)
+
+		// a heart-beat, then STOMP frames coalesced in one message
+		c.Assert(ws.writeFrame(wsText, []byte("\n")), IsNil)
+		var b bytes.Buffer
+		writer := frame.NewWriter(&b)
+		for _, body := range []string{"one", "two"} {
+			f := frame.New(frame.MESSAGE,
+				frame.Subscription, id,
+				frame.MessageId, body,
+				frame.Destination, "/queue/test-1")
+			f.Body = []byte(body)
+			c.Assert(writer.Write(f), IsNil)
+		}
+		c.Assert(ws.writeFrame(wsText, b.Bytes()), IsNil)
+
+		f3 := readWebsocketFrame(c, ws, wsText)
+		c.Assert(f3.Command, Equals, frame.DISCONNECT)
+		b.Reset()
+		c.Assert(writer.Write(frame.New(frame.RECEIPT, frame.ReceiptId, f3.Header.Get(frame.Receipt))), IsNil)
+		c.Assert(ws.writeFrame(wsText, b.Bytes()), IsNil)
+
+		op, _, err = ws.readFrame()
+		c.Assert(err, IsNil)
+		c.Check(op, Equals, byte(wsClose))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := ConnectWebsocket(ctx, "ws://"+listener.Addr().String()+"/ws", ConnOpt.HeartBeat(0, 0))
+	c.Assert(err, IsNil)
+	c.Check(conn.Version(), Equals, V12)
+
+	sub, err := conn.Subscribe("/queue/test-1", AckAuto)
+	c.Assert(err, IsNil)
+	for _, body := range []string{"one", "two"} {
+		msg := <-sub.C
+		c.Assert(msg.Err, IsNil)
+		c.Check(string(msg.Body), Equals, body)
+	}
+
+	c.Check(conn.Disconnect(), IsNil)
+	<-stop
+}
+
+func (s *StompSuite) Test_connect_websocket_binary(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	go func() {
+		ws := acceptWebsocket(c, listener)
+		defer ws.conn.Close()
+
+		f1 := readWebsocketFrame(c, ws, wsBinary)
+		c.Assert(f1.Command, Equals, frame.CONNECT)
+		c.Assert(ws.writeFrame(wsBinary, []byte("CONNECTED\nversion:1.2\n\n\x00")), IsNil)
+
+		// a body larger than the write buffer, which is written in
+		// several parts ending with NUL, is in one message
+		f2 := readWebsocketFrame(c, ws, wsBinary)
+		c.Assert(f2.Command, Equals, frame.SEND)
+		c.Check(f2.Body, DeepEquals, make([]byte, 10000))
+		c.Assert(ws.writeFrame(wsBinary, []byte("RECEIPT\nreceipt-id:"+f2.Header.Get(frame.Receipt)+"\n\n\x00")), IsNil)
+		ws.readFrame()
+	}()
+
+	conn, err := ConnectWebsocket(context.Background(), "ws://"+listener.Addr().String()+"/ws",
+		ConnOpt.HeartBeat(0, 0), ConnOpt.WebsocketBinary)
+	c.Assert(err, IsNil)
+	c.Assert(conn.Send("/queue/test-1", "application/octet-stream", make([]byte, 10000), SendOpt.Receipt), IsNil)
+	c.Check(conn.MustDisconnect(), IsNil)
+}
+
+func (s *StompSuite) Test_connect_websocket_cancelled(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	// the server never responds to the handshake
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			conn.Read(make([]byte, 4096))
+			time.Sleep(time.Second)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = ConnectWebsocket(ctx, "ws://"+listener.Addr().String()+"/ws")
+	c.Check(err, ErrorMatches, context.DeadlineExceeded.Error())
+
+	_, err = ConnectWebsocket(ctx, "http://"+listener.Addr().String()+"/ws")
+	c.Check(err, ErrorMatches, "unsupported websocket scheme.*")
+}